@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto"
 	"crypto/ecdsa"
@@ -8,9 +9,9 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -19,29 +20,43 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	oidc "github.com/coreos/go-oidc"
 	"github.com/oklog/run"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/http2"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 
+	"github.com/openshift/telemeter/pkg/audit"
 	"github.com/openshift/telemeter/pkg/authorize"
 	"github.com/openshift/telemeter/pkg/authorize/jwt"
+	"github.com/openshift/telemeter/pkg/authorize/kubernetes"
 	"github.com/openshift/telemeter/pkg/authorize/stub"
 	"github.com/openshift/telemeter/pkg/authorize/tollbooth"
+	sharedcache "github.com/openshift/telemeter/pkg/cache"
 	"github.com/openshift/telemeter/pkg/cluster"
 	telemeter_http "github.com/openshift/telemeter/pkg/http"
+	"github.com/openshift/telemeter/pkg/http/admin"
 	httpserver "github.com/openshift/telemeter/pkg/http/server"
+	"github.com/openshift/telemeter/pkg/idempotency"
+	"github.com/openshift/telemeter/pkg/logthrottle"
 	"github.com/openshift/telemeter/pkg/metricfamily"
 	"github.com/openshift/telemeter/pkg/receive"
 	"github.com/openshift/telemeter/pkg/store"
 	"github.com/openshift/telemeter/pkg/store/forward"
+	"github.com/openshift/telemeter/pkg/store/lastupload"
 	"github.com/openshift/telemeter/pkg/store/memstore"
+	"github.com/openshift/telemeter/pkg/store/quota"
 	"github.com/openshift/telemeter/pkg/store/ratelimited"
+	"github.com/openshift/telemeter/pkg/tracing"
 	"github.com/openshift/telemeter/pkg/validate"
 )
 
@@ -72,16 +87,97 @@ identify the server within the cluster - if it changes client data may be sent t
 another cluster member.
 `
 
+// shutdownTimeout is how long in-flight requests may take to complete on shutdown.
+const shutdownTimeout = 30 * time.Second
+
+// validationConfigCheckInterval is how often the validation config file is checked for changes.
+const validationConfigCheckInterval = 10 * time.Second
+
 func main() {
 	opt := &Options{
 		Listen:         "0.0.0.0:9003",
 		ListenInternal: "localhost:9004",
 
-		LimitBytes:         500 * 1024,
-		TokenExpireSeconds: 24 * 60 * 60,
-		PartitionKey:       "_id",
-		Ratelimit:          4*time.Minute + 30*time.Second,
-		TTL:                10 * time.Minute,
+		LimitBytes:           500 * 1024,
+		TokenExpireSeconds:   24 * 60 * 60,
+		TokenRefreshGrace:    time.Hour,
+		ClientAuth:           "token",
+		AuthorizeTimeout:     20 * time.Second,
+		AuthorizeRetries:     2,
+		PartitionKey:         "_id",
+		PartitionKeyFormat:   validate.PartitionKeyFormatUUID,
+		Ratelimit:            4*time.Minute + 30*time.Second,
+		TTL:                  10 * time.Minute,
+		SampleQuotaWindow:    24 * time.Hour,
+		SampleQuotaClients:   100000,
+		MaxSampleAge:         24 * time.Hour,
+		OldSamples:           "reject",
+		SampleTimestamps:     "overwrite",
+		DuplicateSeries:      "merge",
+		SampleOrder:          "reject",
+		EmptyUploads:         "accept",
+		SampleOrderTolerance: 10 * time.Second,
+		MaxFutureSkew:        5 * time.Minute,
+		FutureSamples:        "reject",
+		MaxReportedDrops:     10,
+
+		EnforceClientLabels: true,
+
+		AllowMetricsMaxListed: validate.DefaultMaxNotAllowlisted,
+
+		FailureLogWindow:  time.Minute,
+		FailureLogMaxKeys: 10000,
+
+		LimitUncompressedBytes: 5 * 1024 * 1024,
+		LimitClientInFlight:    2,
+
+		IdempotencyCacheSize: 10000,
+
+		SharedCacheTimeout:      100 * time.Millisecond,
+		SharedCacheBackoff:      10 * time.Second,
+		SharedCacheFallbackSize: 100000,
+		CardinalityWindow:       24 * time.Hour,
+		CardinalityCacheSize:    600000,
+
+		AuthorizeCacheSize:        10000,
+		AuthorizeCacheTTL:         5 * time.Minute,
+		AuthorizeCacheNegativeTTL: 30 * time.Second,
+
+		AuthorizeLockoutThreshold:   10,
+		AuthorizeLockoutWindow:      5 * time.Minute,
+		AuthorizeLockoutDuration:    time.Minute,
+		AuthorizeLockoutMaxDuration: time.Hour,
+		AuthorizeLockoutMaxKeys:     100000,
+
+		ClientHMACWindow:    5 * time.Minute,
+		ClientHMACCacheSize: 100000,
+
+		ClientKubernetesGroup:    "telemeter.openshift.io",
+		ClientKubernetesResource: "uploads",
+		ClientKubernetesVerb:     "create",
+		ClientKubernetesCacheTTL: time.Minute,
+
+		ClientOIDCIDClaim:         "sub",
+		ClientOIDCClockSkew:       time.Minute,
+		ClientOIDCRefreshInterval: time.Hour,
+
+		StaleClusterThresholds: []time.Duration{10 * time.Minute, time.Hour, 6 * time.Hour},
+
+		APIMaxLabelValues: 10000,
+		APIMaxSeries:      10000,
+
+		TracingServiceName:   "telemeter-server",
+		TracingSampleRatio:   1,
+		TracingFlushInterval: 5 * time.Second,
+
+		CORSAllowedMethods: []string{"GET", "POST", "DELETE"},
+		CORSAllowedHeaders: []string{"Authorization", "Content-Type"},
+		CORSMaxAge:         10 * time.Minute,
+
+		ReadTimeout:       30 * time.Second,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       120 * time.Second,
 	}
 	cmd := &cobra.Command{
 		Short:        "Aggregate federated metrics pushes",
@@ -93,25 +189,61 @@ func main() {
 	}
 
 	cmd.Flags().StringVar(&opt.Listen, "listen", opt.Listen, "A host:port to listen on for upload traffic.")
-	cmd.Flags().StringVar(&opt.ListenInternal, "listen-internal", opt.ListenInternal, "A host:port to listen on for health and metrics.")
+	cmd.Flags().StringVar(&opt.ListenInternal, "listen-internal", opt.ListenInternal, "A host:port to listen on for health, metrics, federation, pprof and admin endpoints. Must not share a port with --listen. Only the admin endpoints, and the read endpoints with --authorize-reads, require a token, so bind it to localhost or an address only trusted clients can reach.")
+	cmd.Flags().StringVar(&opt.ListenDebug, "listen-debug", opt.ListenDebug, "A host:port to serve pprof and store statistics on. Disabled if empty, and must not share a port with --listen.")
 	cmd.Flags().StringVar(&opt.ListenCluster, "listen-cluster", opt.ListenCluster, "A host:port for cluster gossip.")
 
+	cmd.Flags().DurationVar(&opt.ReadTimeout, "read-timeout", opt.ReadTimeout, "The maximum time to read a request, including its body. 0 disables the timeout.")
+	cmd.Flags().DurationVar(&opt.ReadHeaderTimeout, "read-header-timeout", opt.ReadHeaderTimeout, "The maximum time to read the headers of a request. 0 uses --read-timeout.")
+	cmd.Flags().DurationVar(&opt.WriteTimeout, "write-timeout", opt.WriteTimeout, "The maximum time to handle a request and write its response on the upload listener. The internal listener streams federation and profiling responses and is not limited. 0 disables the timeout.")
+	cmd.Flags().DurationVar(&opt.IdleTimeout, "idle-timeout", opt.IdleTimeout, "The maximum time an idle keep-alive connection is kept open. 0 disables the timeout.")
+
 	cmd.Flags().StringVar(&opt.TLSKeyPath, "tls-key", opt.TLSKeyPath, "Path to a private key to serve TLS for external traffic.")
 	cmd.Flags().StringVar(&opt.TLSCertificatePath, "tls-crt", opt.TLSCertificatePath, "Path to a certificate to serve TLS for external traffic.")
 
+	cmd.Flags().StringVar(&opt.TLSClientCAPath, "tls-client-ca", opt.TLSClientCAPath, "Path to a CA bundle to verify client certificates presented to the external server.")
+	cmd.Flags().BoolVar(&opt.TLSRequireClientCert, "tls-require-client-cert", opt.TLSRequireClientCert, "Reject external clients that do not present a certificate signed by --tls-client-ca.")
+
+	cmd.Flags().StringVar(&opt.ClientAuth, "client-auth", opt.ClientAuth, "How uploading clients are identified, one of 'token' for bearer tokens, 'certificate' for client certificates verified by --tls-client-ca, or 'any' to use the certificate if one is presented and the token otherwise.")
+	cmd.Flags().StringSliceVar(&opt.ClientCertLabels, "client-cert-label", opt.ClientCertLabels, "Certificate extensions to add as labels to clients identified by certificate, in oid=label form. The client ID is the first URI SAN or the common name.")
+	cmd.Flags().StringVar(&opt.ClientCertLabelsFile, "client-cert-labels-file", opt.ClientCertLabelsFile, "A file of lines of the form id,label=value,... adding labels to clients identified by certificate.")
+
+	cmd.Flags().BoolVar(&opt.H2C, "h2c", opt.H2C, "Accept HTTP/2 without TLS from clients with prior knowledge on the upload listener. Ignored if --tls-crt is set, HTTP/2 is always negotiated over TLS.")
+
 	cmd.Flags().StringVar(&opt.InternalTLSKeyPath, "internal-tls-key", opt.InternalTLSKeyPath, "Path to a private key to serve TLS for internal traffic.")
 	cmd.Flags().StringVar(&opt.InternalTLSCertificatePath, "internal-tls-crt", opt.InternalTLSCertificatePath, "Path to a certificate to serve TLS for internal traffic.")
 
 	cmd.Flags().StringSliceVar(&opt.LabelFlag, "label", opt.LabelFlag, "Labels to add to each outgoing metric, in key=value form.")
 	cmd.Flags().StringVar(&opt.PartitionKey, "partition-label", opt.PartitionKey, "The label to separate incoming data on. This label will be required for callers to include.")
+	cmd.Flags().StringVar(&opt.PartitionKeyFormat, "partition-label-format", opt.PartitionKeyFormat, "The format of the --partition-label values of uploads: 'uuid' for UUID v4s in any case, a regular expression matching entire values, or empty to accept any value. Uploads of clients with other values are rejected with 400.")
+	cmd.Flags().StringArrayVar(&opt.PartitionKeyBypass, "partition-label-format-bypass", opt.PartitionKeyBypass, "A --partition-label value accepted regardless of --partition-label-format, such as the ID of a legacy cluster. May be repeated.")
 
 	cmd.Flags().StringSliceVar(&opt.Members, "join", opt.Members, "One or more host:ports to contact to find other peers.")
 	cmd.Flags().StringVar(&opt.Name, "name", opt.Name, "The name to identify this node in the cluster. If not specified will be the hostname and a random suffix.")
 
 	cmd.Flags().StringVar(&opt.SharedKey, "shared-key", opt.SharedKey, "The path to a private key file that will be used to sign authentication requests and secure the cluster protocol.")
 	cmd.Flags().Int64Var(&opt.TokenExpireSeconds, "token-expire-seconds", opt.TokenExpireSeconds, "The expiration of auth tokens in seconds.")
+	cmd.Flags().StringVar(&opt.TokenKeyring, "token-keyring", opt.TokenKeyring, "A JSON file of the keys client tokens are signed and verified with, as {\"primary\": \"<kid>\", \"keys\": [{\"kid\": \"<kid>\", \"file\": \"<pem file>\"}]}. New tokens are signed with the primary key, which must be a private key, and tokens are verified with the key named by their kid header. The file is reloaded when it changes, so keys are rotated by adding a key, making it primary, and removing the previous key once its tokens expired. Defaults to the --shared-key, whose tokens continue to be accepted. The public keys are served at /.well-known/jwks.json.")
+	cmd.Flags().StringArrayVar(&opt.TokenPublicKeys, "token-public-key", opt.TokenPublicKeys, "The path to a PEM file of public keys or certificates that client tokens are also accepted from, for instance the previous --shared-key while it is rotated. May be repeated.")
+	cmd.Flags().StringVar(&opt.TokenLimitsFile, "token-limits-file", opt.TokenLimitsFile, "A JSON file mapping the accounts authorized by --authorize to the upload limits carried by their tokens, as {\"<account>\": {\"max_upload_interval_seconds\": 60, \"max_samples_per_upload\": 10000}}. Limits of a token take precedence over --ratelimit and --limit-samples-per-upload.")
+	cmd.Flags().DurationVar(&opt.TokenRefreshGrace, "token-refresh-grace", opt.TokenRefreshGrace, "How long after expiry a token may still be exchanged for a new one at /authorize/refresh.")
 
 	cmd.Flags().StringVar(&opt.AuthorizeEndpoint, "authorize", opt.AuthorizeEndpoint, "A URL against which to authorize client requests.")
+	cmd.Flags().DurationVar(&opt.AuthorizeTimeout, "authorize-timeout", opt.AuthorizeTimeout, "The timeout of a single request to the --authorize endpoint.")
+	cmd.Flags().IntVar(&opt.AuthorizeRetries, "authorize-retries", opt.AuthorizeRetries, "How often a request to the --authorize endpoint is retried if it times out or fails with a server error.")
+	cmd.Flags().StringVar(&opt.AuthorizeAccountLabel, "authorize-account-label", opt.AuthorizeAccountLabel, "A label the account ID returned by the --authorize endpoint is attached to every series of the cluster as, for example account_id. Labels returned by the endpoint are always attached.")
+	cmd.Flags().StringVar(&opt.AuthorizeCAPath, "authorize-ca", opt.AuthorizeCAPath, "Path to a CA bundle to verify the certificate of the --authorize endpoint. Defaults to the system roots.")
+	cmd.Flags().IntVar(&opt.AuthorizeCacheSize, "authorize-cache-size", opt.AuthorizeCacheSize, "The number of --authorize decisions to cache. Set to 0 to disable caching.")
+	cmd.Flags().DurationVar(&opt.AuthorizeCacheTTL, "authorize-cache-ttl", opt.AuthorizeCacheTTL, "How long a cluster authorized by --authorize is cached. A revoked cluster is rejected after at most this duration.")
+	cmd.Flags().DurationVar(&opt.AuthorizeCacheNegativeTTL, "authorize-cache-negative-ttl", opt.AuthorizeCacheNegativeTTL, "How long a cluster denied by --authorize is cached. Errors reaching the endpoint are never cached.")
+	cmd.Flags().IntVar(&opt.AuthorizeLockoutThreshold, "authorize-lockout-threshold", opt.AuthorizeLockoutThreshold, "The number of failed /authorize requests of a source IP or cluster ID within --authorize-lockout-window after which it is rejected with 429. Set to 0 to disable lockouts.")
+	cmd.Flags().DurationVar(&opt.AuthorizeLockoutWindow, "authorize-lockout-window", opt.AuthorizeLockoutWindow, "The window failed /authorize requests are counted in.")
+	cmd.Flags().DurationVar(&opt.AuthorizeLockoutDuration, "authorize-lockout-duration", opt.AuthorizeLockoutDuration, "How long the first lockout of a source IP or cluster ID lasts. Each consecutive lockout lasts twice as long.")
+	cmd.Flags().DurationVar(&opt.AuthorizeLockoutMaxDuration, "authorize-lockout-max-duration", opt.AuthorizeLockoutMaxDuration, "The longest a source IP or cluster ID is locked out.")
+	cmd.Flags().IntVar(&opt.AuthorizeLockoutMaxKeys, "authorize-lockout-max-keys", opt.AuthorizeLockoutMaxKeys, "The number of source IPs and cluster IDs whose failures are tracked, the least recently seen are forgotten first.")
+	cmd.Flags().StringVar(&opt.ClusterRegistry, "cluster-registry", opt.ClusterRegistry, "Bind each cluster ID to the account that first authorized it and reject other accounts, one of 'memory', 'file' or empty to disable. Neither registry is shared between servers.")
+	cmd.Flags().DurationVar(&opt.ClusterRegistryTTL, "cluster-registry-ttl", opt.ClusterRegistryTTL, "How long the memory registry keeps the binding of a cluster that is not seen, so that its ID may be reused. Set to 0 to keep bindings until restart.")
+	cmd.Flags().StringVar(&opt.ClusterRegistryFile, "cluster-registry-file", opt.ClusterRegistryFile, "The file the 'file' registry persists the bindings of clusters to.")
 
 	cmd.Flags().StringVar(&opt.OIDCIssuer, "oidc-issuer", opt.OIDCIssuer, "The OIDC issuer URL, see https://openid.net/specs/openid-connect-discovery-1_0.html#IssuerDiscovery.")
 	cmd.Flags().StringVar(&opt.ClientSecret, "client-secret", opt.ClientSecret, "The OIDC client secret, see https://tools.ietf.org/html/rfc6749#section-2.3.")
@@ -120,14 +252,103 @@ func main() {
 
 	cmd.Flags().DurationVar(&opt.Ratelimit, "ratelimit", opt.Ratelimit, "The rate limit of metric uploads per cluster ID. Uploads happening more often than this limit will be rejected.")
 	cmd.Flags().DurationVar(&opt.TTL, "ttl", opt.TTL, "The TTL for metrics to be held in memory.")
+	cmd.Flags().Int64Var(&opt.SampleQuota, "sample-quota", opt.SampleQuota, "The number of samples each client may upload per --sample-quota-window. Uploads exceeding it will be rejected. With --admin-token-file, admins list the top consumers with GET /admin/quota and reset a client with DELETE /admin/quota?client=<id>. Disabled if 0.")
+	cmd.Flags().DurationVar(&opt.SampleQuotaWindow, "sample-quota-window", opt.SampleQuotaWindow, "The window over which --sample-quota is accounted.")
+	cmd.Flags().DurationVar(&opt.IdempotencyTTL, "idempotency-ttl", opt.IdempotencyTTL, "How long the successful response to an upload is remembered to answer retries of the same upload, identified by the Idempotency-Key header. Disabled if 0, the default.")
+	cmd.Flags().IntVar(&opt.IdempotencyCacheSize, "idempotency-cache-size", opt.IdempotencyCacheSize, "The maximum number of upload responses remembered for --idempotency-ttl.")
+	cmd.Flags().StringVar(&opt.SharedCache, "shared-cache", opt.SharedCache, "Share --authorize decisions, upload responses and rate limits between servers, one of 'redis' or empty to keep them in memory. Without a shared cache, every server enforces --ratelimit on its own.")
+	cmd.Flags().StringVar(&opt.SharedCacheAddr, "shared-cache-addr", opt.SharedCacheAddr, "The host:port of the Redis server of --shared-cache.")
+	cmd.Flags().StringVar(&opt.SharedCacheUsername, "shared-cache-username", opt.SharedCacheUsername, "The user to authenticate to the Redis server of --shared-cache as, which requires Redis 6. Requires --shared-cache-password-file.")
+	cmd.Flags().StringVar(&opt.SharedCachePasswordFile, "shared-cache-password-file", opt.SharedCachePasswordFile, "Path to a file holding the password to authenticate to the Redis server of --shared-cache with.")
+	cmd.Flags().BoolVar(&opt.SharedCacheTLS, "shared-cache-tls", opt.SharedCacheTLS, "Connect to the Redis server of --shared-cache with TLS.")
+	cmd.Flags().StringVar(&opt.SharedCacheCAPath, "shared-cache-ca", opt.SharedCacheCAPath, "Path to a CA bundle to verify the certificate of the Redis server of --shared-cache. Implies --shared-cache-tls. Defaults to the system roots.")
+	cmd.Flags().StringVar(&opt.SharedCachePrefix, "shared-cache-prefix", opt.SharedCachePrefix, "A prefix of the keys in the shared cache, to share a Redis server between deployments.")
+	cmd.Flags().DurationVar(&opt.SharedCacheTimeout, "shared-cache-timeout", opt.SharedCacheTimeout, "How long an operation of the shared cache may take before the local cache is used instead.")
+	cmd.Flags().DurationVar(&opt.SharedCacheBackoff, "shared-cache-backoff", opt.SharedCacheBackoff, "How long the local cache is used after the shared cache failed.")
+	cmd.Flags().IntVar(&opt.SharedCacheFallbackSize, "shared-cache-fallback-size", opt.SharedCacheFallbackSize, "The number of keys the local cache used while the shared cache fails holds.")
 	cmd.Flags().StringVar(&opt.ForwardURL, "forward-url", opt.ForwardURL, "All written metrics will be written to this URL additionally")
+	cmd.Flags().StringVar(&opt.TracingEndpoint, "tracing-endpoint", opt.TracingEndpoint, "A URL accepting spans in the Zipkin v2 JSON format, such as http://zipkin:9411/api/v2/spans, to export the spans of uploads, reads and forwarded writes to. Jaeger and the OpenTelemetry collector accept this format. Trace context is propagated in B3 headers. Tracing is disabled if unset.")
+	cmd.Flags().StringVar(&opt.TracingServiceName, "tracing-service-name", opt.TracingServiceName, "The service name of the spans exported to --tracing-endpoint.")
+	cmd.Flags().Float64Var(&opt.TracingSampleRatio, "tracing-sample-ratio", opt.TracingSampleRatio, "The ratio of traces started by this server that are exported to --tracing-endpoint, between 0 and 1. Traces propagated by a caller keep its sampling decision.")
+	cmd.Flags().DurationVar(&opt.TracingFlushInterval, "tracing-flush-interval", opt.TracingFlushInterval, "How often finished spans are exported to --tracing-endpoint.")
 
 	cmd.Flags().BoolVarP(&opt.Verbose, "verbose", "v", opt.Verbose, "Show verbose output.")
 
 	cmd.Flags().StringSliceVar(&opt.RequiredLabelFlag, "required-label", opt.RequiredLabelFlag, "Labels that must be present on each incoming metric, in key=value form.")
+	cmd.Flags().StringVar(&opt.ValidationConfigFile, "validation-config-file", opt.ValidationConfigFile, "A JSON (or YAML in JSON syntax) file of validation rules replacing those of the flags, as {\"allow_metrics\": [\"up\"], \"strict_allowlist\": false, \"require_labels\": [\"job\"], \"max_series\": 10000, \"limit_bytes\": 512000, \"elide_labels\": [\"prometheus_replica\"], \"label_limits\": {\"max_labels\": 30, \"max_name_length\": 128, \"max_value_length\": 2048, \"max_series_size\": 8192, \"validate_utf8\": true, \"truncate_values\": false}, \"overrides\": [...]}, where overrides are as in --validation-overrides-file. The file is reloaded on SIGHUP and when it changes; invalid files are counted and leave the previous rules in place.")
+	cmd.Flags().StringVar(&opt.ValidationOverridesFile, "validation-overrides-file", opt.ValidationOverridesFile, "A JSON (or YAML in JSON syntax) file of validation rule profiles replacing the defaults for the clients they select, as {\"overrides\": [{\"name\": \"test-clusters\", \"labels\": {\"tier\": \"test\"}, \"allow_metrics\": [\"test_.*\"], \"max_series\": 20000}]}. The file is reloaded when it changes.")
+	cmd.Flags().StringArrayVar(&opt.RequireLabelFlag, "require-label", opt.RequireLabelFlag, "A label each incoming series must have with a non-empty value, in the form name or name=~regex where regex must match the entire value.")
 	cmd.Flags().StringArrayVar(&opt.Whitelist, "whitelist", opt.Whitelist, "Allowed rules for incoming metrics. If one of these rules is not matched, the metric is dropped.")
+	cmd.Flags().StringArrayVar(&opt.AllowMetrics, "allow-metric", opt.AllowMetrics, "A metric name, or a regular expression matching entire metric names, accepted by the validator. Families of other metrics are dropped. All metrics are accepted if unset.")
+	cmd.Flags().BoolVar(&opt.AllowMetricsStrict, "allow-metric-strict", opt.AllowMetricsStrict, "Reject uploads with 422 if they contain metrics not accepted by --allow-metric, instead of dropping them.")
+	cmd.Flags().IntVar(&opt.AllowMetricsMaxListed, "allow-metric-max-listed", opt.AllowMetricsMaxListed, "The maximum number of metrics not accepted by --allow-metric listed in rejections, or in the summary of uploads they are dropped from.")
 	cmd.Flags().StringVar(&opt.WhitelistFile, "whitelist-file", opt.WhitelistFile, "A file of allowed rules for incoming metrics. If one of these rules is not matched, the metric is dropped; one label key per line.")
-	cmd.Flags().StringArrayVar(&opt.ElideLabels, "elide-label", opt.ElideLabels, "A list of labels to be elided from incoming metrics.")
+	cmd.Flags().StringArrayVar(&opt.AnonymizeLabels, "anonymize-label", opt.AnonymizeLabels, "A label whose values are anonymized in incoming metrics before they are stored or forwarded, as name=action where action is 'hash' to replace values with a truncated HMAC keyed by --anonymize-secret-file, 'redact' to replace them with a fixed value, or 'drop' to remove the label. May be repeated.")
+	cmd.Flags().StringVar(&opt.AnonymizeSecret, "anonymize-secret-file", opt.AnonymizeSecret, "A file containing the secret keying the hashes of --anonymize-label values. Values are hashed alike while it is unchanged.")
+	cmd.Flags().StringArrayVar(&opt.ElideLabels, "elide-label", opt.ElideLabels, "A list of labels to be elided from incoming metrics during validation. Series that become identical are merged, keeping the newest sample, or only samples with the same timestamp with --sample-timestamps=keep. Replaced by the elide_labels of --validation-config-file.")
+	cmd.Flags().DurationVar(&opt.MaxSampleAge, "max-sample-age", opt.MaxSampleAge, "How far behind the server clock incoming sample timestamps may be. Disabled if 0.")
+	cmd.Flags().StringVar(&opt.OldSamples, "old-samples", opt.OldSamples, "What to do with samples older than --max-sample-age, one of 'reject' or 'clamp'.")
+	cmd.Flags().StringVar(&opt.SampleTimestamps, "sample-timestamps", opt.SampleTimestamps, "The timestamps samples are stored with, one of 'overwrite' to use the time of the upload, or 'keep' to use those uploaded, within --max-sample-age and --max-future-skew. Clients sending metrics they could not upload before, from their spool or merged into later uploads, need 'keep' for them to be stored.")
+	cmd.Flags().StringVar(&opt.SampleOrder, "sample-order", opt.SampleOrder, "What to do with uploads whose samples are not in increasing timestamp order, one of 'reject', 'sort' to sort the samples of each series, or 'strict' to sort them and reject uploads with series going back in time by more than --sample-order-tolerance.")
+	cmd.Flags().DurationVar(&opt.SampleOrderTolerance, "sample-order-tolerance", opt.SampleOrderTolerance, "How far a sample may go back in time from a previous sample of its series before uploads are rejected with --sample-order=strict.")
+	cmd.Flags().BoolVar(&opt.DropInconsistentTypes, "drop-inconsistent-types", opt.DropInconsistentTypes, "Drop series lacking the value of the type of their metric, such as counters with a gauge value, instead of rejecting the upload with 400.")
+	cmd.Flags().StringArrayVar(&opt.ReportOnlyRules, "validation-report-only", opt.ReportOnlyRules, "A validation rule to evaluate without enforcing it, one of 'allowlist', 'inconsistent_type', 'client_labels', 'required_labels', 'duplicates', 'series_limit', 'empty_uploads' or 'label_limits'. Uploads it would reject or series it would drop are counted and logged, and listed in the "+httpserver.ReportOnlyHeader+" response header, but stored unchanged. May be repeated.")
+	cmd.Flags().StringVar(&opt.EmptyUploads, "empty-uploads", opt.EmptyUploads, "What to do with uploads without series to store, one of 'accept' to respond with 204 and a Warning header, or 'reject' to reject them with 400. Either way they are not stored and are counted by client.")
+	cmd.Flags().StringVar(&opt.DuplicateSeries, "duplicate-series", opt.DuplicateSeries, "What to do with series present more than once in an upload, one of 'allow', 'merge' to keep the newest sample, or 'reject' to reject the upload with 422.")
+	cmd.Flags().DurationVar(&opt.MaxFutureSkew, "max-future-skew", opt.MaxFutureSkew, "How far ahead of the server clock incoming sample timestamps may be. Disabled if 0.")
+	cmd.Flags().StringVar(&opt.FutureSamples, "future-samples", opt.FutureSamples, "What to do with samples further in the future than --max-future-skew, one of 'reject' or 'clamp'.")
+	cmd.Flags().Int64Var(&opt.LimitUncompressedBytes, "limit-uncompressed-bytes", opt.LimitUncompressedBytes, "The maximum size of a snappy compressed upload once decompressed. 0 disables the limit.")
+	cmd.Flags().IntVar(&opt.CardinalityBudget, "cardinality-budget", opt.CardinalityBudget, "The maximum number of distinct series a cluster may upload within --cardinality-window. Uploads exceeding it are rejected with 429. The series seen are shared through --shared-cache if set. 0 disables the budget.")
+	cmd.Flags().DurationVar(&opt.CardinalityWindow, "cardinality-window", opt.CardinalityWindow, "The rolling window of --cardinality-budget.")
+	cmd.Flags().IntVar(&opt.CardinalityCacheSize, "cardinality-cache-size", opt.CardinalityCacheSize, "The number of keys held in memory to track --cardinality-budget without a shared cache. Each cluster uses up to 6 keys.")
+	cmd.Flags().IntVar(&opt.LimitSeriesPerUpload, "limit-series-per-upload", opt.LimitSeriesPerUpload, "The maximum number of valid series in a single upload, counted after filtering. Uploads exceeding it are rejected with 422. 0 disables the limit.")
+	cmd.Flags().IntVar(&opt.LimitSamplesPerUpload, "limit-samples-per-upload", opt.LimitSamplesPerUpload, "The maximum number of samples retained from a single upload, unless the token of the client carries a max_samples_per_upload claim. Uploads exceeding it are rejected. 0 disables the limit.")
+	cmd.Flags().IntVar(&opt.LabelLimits.MaxLabels, "limit-labels-per-series", opt.LabelLimits.MaxLabels, "The maximum number of labels of an uploaded series, including its name. Uploads with a series exceeding it are rejected. 0 disables the limit.")
+	cmd.Flags().IntVar(&opt.LabelLimits.MaxNameLength, "limit-label-name-length", opt.LabelLimits.MaxNameLength, "The maximum length in bytes of a label name in uploaded series. 0 disables the limit.")
+	cmd.Flags().IntVar(&opt.LabelLimits.MaxValueLength, "limit-label-value-length", opt.LabelLimits.MaxValueLength, "The maximum length in bytes of a label value in uploaded series. 0 disables the limit.")
+	cmd.Flags().IntVar(&opt.LabelLimits.MaxSeriesSize, "limit-series-labels-size", opt.LabelLimits.MaxSeriesSize, "The maximum size in bytes of the label names and values of an uploaded series, including its name. Uploads with a series exceeding it are rejected. 0 disables the limit.")
+	cmd.Flags().BoolVar(&opt.LabelLimits.ValidateUTF8, "validate-label-values-utf8", opt.LabelLimits.ValidateUTF8, "Reject uploads with label values that are not valid UTF-8.")
+	cmd.Flags().BoolVar(&opt.LabelLimits.TruncateValues, "truncate-label-values", opt.LabelLimits.TruncateValues, "Truncate label values longer than --limit-label-value-length at the last character that fits, and invalid UTF-8 values before their first invalid byte, instead of rejecting the upload.")
+	cmd.Flags().IntVar(&opt.LimitClientInFlight, "limit-client-in-flight", opt.LimitClientInFlight, "The maximum number of uploads a client may have in flight at once. Further uploads are rejected until one completes. 0 disables the limit.")
+	cmd.Flags().StringVar(&opt.ClientTokenFile, "client-token-file", opt.ClientTokenFile, "A file of 'token,id[,label=value...]' lines granting upload access in addition to issued tokens. Tokens with scope=<scope> fields, such as scope=metrics:read, are granted those scopes instead of metrics:write. The file is reloaded when it changes, invalid lines are logged and skipped.")
+	cmd.Flags().StringVar(&opt.ClientHMACKeysFile, "client-hmac-keys-file", opt.ClientHMACKeysFile, "A file of 'key-id,secret,id[,label=value...]' lines granting upload access to requests signed with the secret in the "+authorize.SignatureHeader+" header, identifying the key with the "+authorize.KeyIDHeader+" header.")
+	cmd.Flags().DurationVar(&opt.ClientHMACWindow, "client-hmac-window", opt.ClientHMACWindow, "How far the timestamp of a signed request may be from the server clock. Signatures cannot be reused within the window.")
+	cmd.Flags().IntVar(&opt.ClientHMACCacheSize, "client-hmac-cache-size", opt.ClientHMACCacheSize, "The maximum number of signatures remembered to reject replays. Must exceed the number of signed uploads within twice --client-hmac-window.")
+	cmd.Flags().StringArrayVar(&opt.ClientOIDCIssuers, "client-oidc-issuer", opt.ClientOIDCIssuers, "An OIDC issuer whose tokens grant upload access, as 'issuer-url[,jwks-url]'. The keys are discovered from the issuer if no JWKS URL is given. May be repeated.")
+	cmd.Flags().StringVar(&opt.ClientOIDCAudience, "client-oidc-audience", opt.ClientOIDCAudience, "The audience OIDC tokens of --client-oidc-issuer must be issued for.")
+	cmd.Flags().StringVar(&opt.ClientOIDCIDClaim, "client-oidc-id-claim", opt.ClientOIDCIDClaim, "The claim of OIDC tokens identifying the cluster, set as the --partition-label of its data.")
+	cmd.Flags().StringArrayVar(&opt.ClientOIDCLabelClaims, "client-oidc-label-claim", opt.ClientOIDCLabelClaims, "A claim of OIDC tokens to set as label of the data of the cluster, as 'claim=label'. May be repeated.")
+	cmd.Flags().DurationVar(&opt.ClientOIDCClockSkew, "client-oidc-clock-skew", opt.ClientOIDCClockSkew, "How long OIDC tokens are accepted after they expire, and before they were issued, to tolerate clock skew.")
+	cmd.Flags().DurationVar(&opt.ClientOIDCRefreshInterval, "client-oidc-jwks-refresh", opt.ClientOIDCRefreshInterval, "How long the keys of an OIDC issuer are cached. They are fetched earlier if a token is signed by an unknown key.")
+	cmd.Flags().StringVar(&opt.AdminTokenFile, "admin-token-file", opt.AdminTokenFile, "A file of 'token,name[,label=value...]' lines granting access to the /admin endpoints and /authorize/introspect on the internal listener. Tokens with scope=<scope> fields are limited to those scopes, others are granted the admin and metrics:read scopes. Deleting partitions requires the role=admin label. The endpoints are disabled if unset.")
+	cmd.Flags().BoolVar(&opt.ClientKubernetesReview, "client-kubernetes-review", opt.ClientKubernetesReview, "Grant upload access to the tokens of Kubernetes service accounts, authenticated with a TokenReview and authorized with a SubjectAccessReview against the Kubernetes API of the cluster telemeter-server runs in. The client ID is 'namespace/name' of the service account.")
+	cmd.Flags().StringArrayVar(&opt.ClientKubernetesAudiences, "client-kubernetes-audience", opt.ClientKubernetesAudiences, "An audience service account tokens must be issued for. May be repeated.")
+	cmd.Flags().StringVar(&opt.ClientKubernetesNamespace, "client-kubernetes-namespace", opt.ClientKubernetesNamespace, "The namespace service accounts are authorized in, the namespace of the service account if empty.")
+	cmd.Flags().StringVar(&opt.ClientKubernetesGroup, "client-kubernetes-group", opt.ClientKubernetesGroup, "The API group of the resource service accounts are authorized for.")
+	cmd.Flags().StringVar(&opt.ClientKubernetesResource, "client-kubernetes-resource", opt.ClientKubernetesResource, "The resource service accounts are authorized for.")
+	cmd.Flags().StringVar(&opt.ClientKubernetesVerb, "client-kubernetes-verb", opt.ClientKubernetesVerb, "The verb service accounts are authorized for.")
+	cmd.Flags().DurationVar(&opt.ClientKubernetesCacheTTL, "client-kubernetes-cache-ttl", opt.ClientKubernetesCacheTTL, "How long accepted service account tokens are cached before they are reviewed again. 0 disables the cache.")
+	cmd.Flags().StringVar(&opt.ClusterAccessFile, "cluster-access-file", opt.ClusterAccessFile, "A JSON file of cluster IDs allowed and denied to upload, as {\"allow\": [...], \"deny\": [...]}. Denied clusters are rejected even if allowed, and only allowed clusters may upload if the allow list is not empty. The file is reloaded when it changes, and admins with the role=admin label replace it with PUT /admin/cluster-access.")
+	cmd.Flags().StringVar(&opt.RevocationFile, "revocation-file", opt.RevocationFile, "A JSON file of revoked token IDs and cluster IDs rejected on every request. Admins with the role=admin label add to it with POST /admin/revocations. The file is created if missing. Revocation is disabled if unset.")
+	cmd.Flags().StringVar(&opt.AuditLogFile, "audit-log-file", opt.AuditLogFile, "A file that issued tokens and admin actions are appended to as JSON lines. Defaults to the standard log.")
+	cmd.Flags().DurationSliceVar(&opt.StaleClusterThresholds, "stale-cluster-threshold", opt.StaleClusterThresholds, "Report the number of clusters that have not uploaded within each of these durations. Clusters are forgotten once their metrics expired after --ttl and they were stale past the longest duration.")
+	cmd.Flags().StringArrayVar(&opt.WatchedClusters, "watch-cluster", opt.WatchedClusters, "A cluster ID to report the last upload time of individually. May be repeated.")
+	cmd.Flags().BoolVar(&opt.AuthorizeReads, "authorize-reads", opt.AuthorizeReads, "Require a token with the metrics:read scope for the read endpoints of the internal listener. Admin tokens without scopes may read, client tokens need the scope and read only their own partition.")
+	cmd.Flags().IntVar(&opt.APIMaxLabelValues, "api-max-label-values", opt.APIMaxLabelValues, "The maximum number of values returned by /api/v1/label/{name}/values on the internal listener. 0 disables the limit.")
+	cmd.Flags().IntVar(&opt.APIMaxSeries, "api-max-series", opt.APIMaxSeries, "The maximum number of series returned by /api/v1/series on the internal listener. 0 disables the limit.")
+	cmd.Flags().StringArrayVar(&opt.CORSAllowedOrigins, "cors-allowed-origin", opt.CORSAllowedOrigins, "An origin allowed to call the read and admin endpoints of the internal listener from a browser, or '*' for any. May be repeated. Cross-origin requests are not allowed if unset, and are never allowed to upload.")
+	cmd.Flags().StringSliceVar(&opt.CORSAllowedMethods, "cors-allowed-methods", opt.CORSAllowedMethods, "The methods allowed in cross-origin requests.")
+	cmd.Flags().StringSliceVar(&opt.CORSAllowedHeaders, "cors-allowed-headers", opt.CORSAllowedHeaders, "The request headers allowed in cross-origin requests.")
+	cmd.Flags().DurationVar(&opt.CORSMaxAge, "cors-max-age", opt.CORSMaxAge, "How long browsers may cache the result of a cross-origin preflight request.")
+	cmd.Flags().BoolVar(&opt.RejectPartialUploads, "reject-partial-uploads", opt.RejectPartialUploads, "Reject uploads with 422 if any of their series are dropped as invalid or filtered, instead of storing the rest with a Warning header.")
+	cmd.Flags().IntVar(&opt.MaxReportedDrops, "max-reported-drops", opt.MaxReportedDrops, "The maximum number of dropped series listed when rejecting a partial upload.")
+	cmd.Flags().BoolVar(&opt.EnforceClientLabels, "enforce-client-labels", opt.EnforceClientLabels, "Set the labels of the authorized client, such as the cluster ID, on every uploaded series, overwriting conflicting values.")
+	cmd.Flags().StringVar(&opt.PartitionFrom, "partition-from", opt.PartitionFrom, "How the --partition-label of uploads is derived from the authorized client: 'label' keeps the label set by the authorizer, 'id' uses the client ID, 'label=<name>' another label of the client, 'claim=<name>' a claim of its token, and 'issuer' the tenant of the issuer of its token given by --partition-issuer-tenant.")
+	cmd.Flags().StringArrayVar(&opt.PartitionIssuerTenants, "partition-issuer-tenant", opt.PartitionIssuerTenants, "The tenant the data of clients with tokens of an issuer is partitioned under with --partition-from=issuer, as 'issuer=tenant'. May be repeated.")
+	cmd.Flags().BoolVar(&opt.RejectLabelConflicts, "reject-label-conflicts", opt.RejectLabelConflicts, "Reject uploads with series carrying a different value for a label of the authorized client instead of overwriting it. Requires --enforce-client-labels.")
+	cmd.Flags().DurationVar(&opt.FailureLogWindow, "failure-log-window", opt.FailureLogWindow, "Log identical upload failures of a client at most once in this window, followed by a count of the repeats. 0 logs every failure.")
+	cmd.Flags().IntVar(&opt.FailureLogMaxKeys, "failure-log-max-keys", opt.FailureLogMaxKeys, "The maximum number of distinct client failures tracked per --failure-log-window. Further failures are only counted.")
+	cmd.Flags().BoolVar(&opt.LenientContentType, "lenient-content-type", opt.LenientContentType, "Accept uploads with a missing or unsupported Content-Type by guessing the format, for compatibility with old clients.")
 
 	if err := cmd.Execute(); err != nil {
 		os.Exit(1)
@@ -137,10 +358,24 @@ func main() {
 type Options struct {
 	Listen         string
 	ListenInternal string
+	ListenDebug    string
 	ListenCluster  string
 
-	TLSKeyPath         string
-	TLSCertificatePath string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	TLSKeyPath           string
+	TLSCertificatePath   string
+	TLSClientCAPath      string
+	TLSRequireClientCert bool
+
+	H2C bool
+
+	ClientAuth           string
+	ClientCertLabels     []string
+	ClientCertLabelsFile string
 
 	InternalTLSKeyPath         string
 	InternalTLSCertificatePath string
@@ -150,9 +385,33 @@ type Options struct {
 	Name               string
 	SharedKey          string
 	TokenExpireSeconds int64
+	TokenPublicKeys    []string
+	TokenKeyring       string
+	TokenLimitsFile    string
+
+	TokenRefreshGrace time.Duration
+
+	ClusterRegistry     string
+	ClusterRegistryTTL  time.Duration
+	ClusterRegistryFile string
 
 	AuthorizeEndpoint string
 
+	AuthorizeTimeout      time.Duration
+	AuthorizeRetries      int
+	AuthorizeAccountLabel string
+	AuthorizeCAPath       string
+
+	AuthorizeCacheSize        int
+	AuthorizeCacheTTL         time.Duration
+	AuthorizeCacheNegativeTTL time.Duration
+
+	AuthorizeLockoutThreshold   int
+	AuthorizeLockoutWindow      time.Duration
+	AuthorizeLockoutDuration    time.Duration
+	AuthorizeLockoutMaxDuration time.Duration
+	AuthorizeLockoutMaxKeys     int
+
 	OIDCIssuer   string
 	ClientID     string
 	ClientSecret string
@@ -164,22 +423,264 @@ type Options struct {
 	LimitBytes        int64
 	RequiredLabelFlag []string
 	RequiredLabels    map[string]string
+	RequireLabelFlag  []string
+	Requirements      []validate.Requirement
 	Whitelist         []string
 	ElideLabels       []string
+	AnonymizeLabels   []string
+	AnonymizeSecret   string
 	WhitelistFile     string
 
+	AllowMetrics          []string
+	AllowMetricsStrict    bool
+	AllowMetricsMaxListed int
+
+	ValidationOverridesFile string
+	ValidationConfigFile    string
+	ReportOnlyRules         []string
+
+	PartitionKeyFormat string
+	PartitionKeyBypass []string
+
+	LimitUncompressedBytes int64
+	LimitSamplesPerUpload  int
+	LimitSeriesPerUpload   int
+	CardinalityBudget      int
+	CardinalityWindow      time.Duration
+	CardinalityCacheSize   int
+	LimitClientInFlight    int
+	LabelLimits            metricfamily.LabelLimits
+
+	LenientContentType    bool
+	MaxSampleAge          time.Duration
+	OldSamples            string
+	SampleTimestamps      string
+	DuplicateSeries       string
+	SampleOrder           string
+	EmptyUploads          string
+	SampleOrderTolerance  time.Duration
+	DropInconsistentTypes bool
+	MaxFutureSkew         time.Duration
+	FutureSamples         string
+
+	RejectPartialUploads bool
+	MaxReportedDrops     int
+
+	EnforceClientLabels  bool
+	RejectLabelConflicts bool
+
+	PartitionFrom          string
+	PartitionIssuerTenants []string
+
+	FailureLogWindow  time.Duration
+	FailureLogMaxKeys int
+
 	TTL        time.Duration
 	Ratelimit  time.Duration
 	ForwardURL string
 
+	TracingEndpoint      string
+	TracingServiceName   string
+	TracingSampleRatio   float64
+	TracingFlushInterval time.Duration
+
+	SampleQuota        int64
+	SampleQuotaWindow  time.Duration
+	SampleQuotaClients int
+
+	IdempotencyTTL       time.Duration
+	IdempotencyCacheSize int
+
+	SharedCache             string
+	SharedCacheAddr         string
+	SharedCachePrefix       string
+	SharedCacheUsername     string
+	SharedCachePasswordFile string
+	SharedCacheTLS          bool
+	SharedCacheCAPath       string
+	SharedCacheTimeout      time.Duration
+	SharedCacheBackoff      time.Duration
+	SharedCacheFallbackSize int
+
+	AdminTokenFile string
+	AuthorizeReads bool
+
+	ClientTokenFile string
+
+	ClientHMACKeysFile  string
+	ClientHMACWindow    time.Duration
+	ClientHMACCacheSize int
+
+	ClientOIDCIssuers         []string
+	ClientOIDCAudience        string
+	ClientOIDCIDClaim         string
+	ClientOIDCLabelClaims     []string
+	ClientOIDCClockSkew       time.Duration
+	ClientOIDCRefreshInterval time.Duration
+
+	ClientKubernetesReview    bool
+	ClientKubernetesAudiences []string
+	ClientKubernetesNamespace string
+	ClientKubernetesGroup     string
+	ClientKubernetesResource  string
+	ClientKubernetesVerb      string
+	ClientKubernetesCacheTTL  time.Duration
+
+	RevocationFile string
+
+	ClusterAccessFile string
+
+	AuditLogFile string
+
+	StaleClusterThresholds []time.Duration
+	WatchedClusters        []string
+
+	APIMaxLabelValues int
+	APIMaxSeries      int
+
+	CORSAllowedOrigins []string
+	CORSAllowedMethods []string
+	CORSAllowedHeaders []string
+	CORSMaxAge         time.Duration
+
+	// Registerer receives the metrics of the server, defaulting to the global registry.
+	Registerer prometheus.Registerer
+
 	Verbose bool
 }
 
+// validateDebugListen ensures the debug endpoints cannot end up on the public upload listener.
+func validateDebugListen(listen, debug string) error {
+	return validateDistinctListen("--listen-debug", listen, debug)
+}
+
+// validateDistinctListen ensures the address of flag does not share a port with the public
+// upload listener, so that internal endpoints are never exposed on it.
+func validateDistinctListen(flag, listen, addr string) error {
+	if len(addr) == 0 {
+		return nil
+	}
+	_, addrPort, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%s must be a host:port: %v", flag, err)
+	}
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("--listen must be a host:port: %v", err)
+	}
+	if port == addrPort {
+		return fmt.Errorf("%s must not use the same port as --listen", flag)
+	}
+	return nil
+}
+
+// isLoopback returns true if the host of addr is localhost or a loopback IP, so that only
+// local clients can connect to it.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// labelActionsFor returns the transformer of the --anonymize-label flags, or nil if there are
+// none.
+func labelActionsFor(flags []string, secretFile string) (metricfamily.Transformer, error) {
+	actions := make(map[string]string, len(flags))
+	for _, flag := range flags {
+		name, action, err := metricfamily.ParseLabelAction(flag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --anonymize-label: %v", err)
+		}
+		actions[name] = action
+	}
+	var secret []byte
+	if len(secretFile) > 0 {
+		data, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read --anonymize-secret-file: %v", err)
+		}
+		secret = bytes.TrimSpace(data)
+	}
+	t, err := metricfamily.NewLabelActions(actions, secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --anonymize-label: %v", err)
+	}
+	return t, nil
+}
+
+// partitionerFor returns the partitioner of the --partition-from flag, or nil if the partition
+// label set by the authorizer is kept.
+func partitionerFor(from string, issuerTenants []string) (authorize.Partitioner, error) {
+	values := strings.SplitN(from, "=", 2)
+	switch {
+	case from == "" || from == "label":
+		return nil, nil
+	case from == "id":
+		return authorize.PartitionByID(), nil
+	case from == "issuer":
+		tenants := make(map[string]string)
+		for _, flag := range issuerTenants {
+			values := strings.SplitN(flag, "=", 2)
+			if len(values) != 2 || len(values[0]) == 0 || len(values[1]) == 0 {
+				return nil, fmt.Errorf("--partition-issuer-tenant must be of the form issuer=tenant: %s", flag)
+			}
+			tenants[values[0]] = values[1]
+		}
+		if len(tenants) == 0 {
+			return nil, fmt.Errorf("--partition-from=issuer requires --partition-issuer-tenant")
+		}
+		return authorize.PartitionByIssuer(tenants), nil
+	case len(values) == 2 && values[0] == "label" && len(values[1]) > 0:
+		return authorize.PartitionByLabel(values[1]), nil
+	case len(values) == 2 && values[0] == "claim" && len(values[1]) > 0:
+		return authorize.PartitionByClaim(values[1]), nil
+	default:
+		return nil, fmt.Errorf("--partition-from must be one of 'label', 'id', 'label=<name>', 'claim=<name>' or 'issuer': %s", from)
+	}
+}
+
+// shutdown stops the server from accepting connections and waits for in-flight
+// requests to complete, closing any remaining connections after shutdownTimeout.
+func shutdown(s *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("error: graceful shutdown failed: %v", err)
+		s.Close()
+	}
+}
+
+// debugHandler returns the handler served on the debug listener.
+func debugHandler(stats http.Handler) http.Handler {
+	mux := telemeter_http.DebugRoutes(http.NewServeMux())
+	mux.Handle("/debug/store", stats)
+	return mux
+}
+
 type Paths struct {
 	Paths []string `json:"paths"`
 }
 
+// Run serves until interrupted, then shuts all listeners down gracefully.
 func (o *Options) Run() error {
+	stop := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.Printf("Shutting down")
+		close(stop)
+	}()
+	return o.run(stop)
+}
+
+func (o *Options) run(stop <-chan struct{}) error {
 	for _, flag := range o.LabelFlag {
 		values := strings.SplitN(flag, "=", 2)
 		if len(values) != 2 {
@@ -202,6 +703,90 @@ func (o *Options) Run() error {
 		o.RequiredLabels[values[0]] = values[1]
 	}
 
+	for _, flag := range o.RequireLabelFlag {
+		requirement, err := validate.ParseRequirement(flag)
+		if err != nil {
+			return fmt.Errorf("invalid --require-label: %v", err)
+		}
+		o.Requirements = append(o.Requirements, requirement)
+	}
+
+	switch o.ClientAuth {
+	case "", "token", "certificate", "any":
+	default:
+		return fmt.Errorf("--client-auth must be one of 'token', 'certificate' or 'any': %s", o.ClientAuth)
+	}
+
+	switch o.SharedCache {
+	case "":
+	case "redis":
+		if len(o.SharedCacheAddr) == 0 {
+			return fmt.Errorf("--shared-cache-addr is required by the redis cache")
+		}
+		if len(o.SharedCacheUsername) > 0 && len(o.SharedCachePasswordFile) == 0 {
+			return fmt.Errorf("--shared-cache-username requires --shared-cache-password-file")
+		}
+	default:
+		return fmt.Errorf("--shared-cache must be one of 'redis' or empty: %s", o.SharedCache)
+	}
+
+	switch o.ClusterRegistry {
+	case "", "memory":
+	case "file":
+		if len(o.ClusterRegistryFile) == 0 {
+			return fmt.Errorf("--cluster-registry-file is required by the file registry")
+		}
+	default:
+		return fmt.Errorf("--cluster-registry must be one of 'memory', 'file' or empty: %s", o.ClusterRegistry)
+	}
+
+	switch o.FutureSamples {
+	case "reject", "clamp":
+	default:
+		return fmt.Errorf("--future-samples must be one of 'reject' or 'clamp': %s", o.FutureSamples)
+	}
+
+	switch o.OldSamples {
+	case "reject", "clamp":
+	default:
+		return fmt.Errorf("--old-samples must be one of 'reject' or 'clamp': %s", o.OldSamples)
+	}
+
+	switch o.SampleTimestamps {
+	case "overwrite", "keep":
+	default:
+		return fmt.Errorf("--sample-timestamps must be one of 'overwrite' or 'keep': %s", o.SampleTimestamps)
+	}
+
+	switch o.SampleOrder {
+	case "reject", "sort", "strict":
+	default:
+		return fmt.Errorf("--sample-order must be one of 'reject', 'sort' or 'strict': %s", o.SampleOrder)
+	}
+
+	switch o.DuplicateSeries {
+	case "allow", "merge", "reject":
+	default:
+		return fmt.Errorf("--duplicate-series must be one of 'allow', 'merge' or 'reject': %s", o.DuplicateSeries)
+	}
+
+	switch o.EmptyUploads {
+	case "accept", "reject":
+	default:
+		return fmt.Errorf("--empty-uploads must be one of 'accept' or 'reject': %s", o.EmptyUploads)
+	}
+
+	for _, rule := range o.ReportOnlyRules {
+		if !validate.IsRule(rule) {
+			return fmt.Errorf("--validation-report-only must be a validation rule: %s", rule)
+		}
+	}
+
+	partitioner, err := partitionerFor(o.PartitionFrom, o.PartitionIssuerTenants)
+	if err != nil {
+		return err
+	}
+
 	if len(o.Name) == 0 {
 		hostname, err := os.Hostname()
 		if err != nil {
@@ -221,8 +806,22 @@ func (o *Options) Run() error {
 		}
 		authorizeURL = u
 
+		var tlsConfig *tls.Config
+		if len(o.AuthorizeCAPath) > 0 {
+			data, err := ioutil.ReadFile(o.AuthorizeCAPath)
+			if err != nil {
+				return fmt.Errorf("unable to read --authorize-ca: %v", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return fmt.Errorf("no certificates found in --authorize-ca")
+			}
+			tlsConfig = &tls.Config{RootCAs: pool}
+		}
+
 		var transport http.RoundTripper = &http.Transport{
 			Dial:                (&net.Dialer{Timeout: 10 * time.Second}).Dial,
+			TLSClientConfig:     tlsConfig,
 			MaxIdleConnsPerHost: 10,
 			IdleConnTimeout:     30 * time.Second,
 		}
@@ -232,7 +831,7 @@ func (o *Options) Run() error {
 		}
 
 		authorizeClient = &http.Client{
-			Timeout:   20 * time.Second,
+			Timeout:   o.AuthorizeTimeout,
 			Transport: telemeter_http.NewInstrumentedRoundTripper("authorize", transport),
 		}
 
@@ -267,6 +866,19 @@ func (o *Options) Run() error {
 		return fmt.Errorf("both --tls-key and --tls-crt must be provided")
 	case (len(o.InternalTLSCertificatePath) == 0) != (len(o.InternalTLSKeyPath) == 0):
 		return fmt.Errorf("both --internal-tls-key and --internal-tls-crt must be provided")
+	case (o.ClientAuth == "certificate" || o.ClientAuth == "any") && len(o.TLSClientCAPath) == 0:
+		return fmt.Errorf("--tls-client-ca must be provided to identify clients by certificate")
+	case len(o.TLSCertificatePath) == 0 && (len(o.TLSClientCAPath) > 0 || o.TLSRequireClientCert):
+		return fmt.Errorf("--tls-client-ca and --tls-require-client-cert require --tls-key and --tls-crt")
+	}
+	if err := validateDistinctListen("--listen-internal", o.Listen, o.ListenInternal); err != nil {
+		return err
+	}
+	if err := validateDebugListen(o.Listen, o.ListenDebug); err != nil {
+		return err
+	}
+	if !o.AuthorizeReads && !isLoopback(o.ListenInternal) {
+		log.Printf("warning: --listen-internal %s is not a loopback address and serves the read endpoints without authorization, use --authorize-reads or bind it to localhost", o.ListenInternal)
 	}
 	useTLS := len(o.TLSCertificatePath) > 0
 	useInternalTLS := len(o.InternalTLSCertificatePath) > 0
@@ -283,7 +895,7 @@ func (o *Options) Run() error {
 			return fmt.Errorf("unable to read --shared-key: %v", err)
 		}
 
-		key, err := loadPrivateKey(data)
+		key, err := jwt.LoadPrivateKey(data)
 		if err != nil {
 			return err
 		}
@@ -343,12 +955,123 @@ func (o *Options) Run() error {
 	issuer := "telemeter.selfsigned"
 	audience := "federate"
 
-	jwtAuthorizer := jwt.NewClientAuthorizer(
+	// tokens are signed with the keyring, or the shared key if there is none
+	var publicKeys []crypto.PublicKey
+	keyring, err := jwt.NewStaticKeyring(privateKey)
+	if err != nil {
+		return fmt.Errorf("unable to use --shared-key to sign tokens: %v", err)
+	}
+	if len(o.TokenKeyring) > 0 {
+		keyring, err = jwt.NewKeyring(o.TokenKeyring)
+		if err != nil {
+			return fmt.Errorf("unable to load --token-keyring: %v", err)
+		}
+		// tokens issued before the keyring was configured remain valid
+		publicKeys = append(publicKeys, publicKey)
+	}
+	for _, path := range o.TokenPublicKeys {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("unable to read --token-public-key: %v", err)
+		}
+		keys, err := jwt.LoadPublicKeys(data)
+		if err != nil {
+			return fmt.Errorf("unable to load --token-public-key %s: %v", path, err)
+		}
+		publicKeys = append(publicKeys, keys...)
+	}
+
+	jwtAuthorizer := jwt.NewKeyringClientAuthorizer(
 		issuer,
-		[]crypto.PublicKey{publicKey},
+		keyring,
+		publicKeys,
 		jwt.NewValidator([]string{audience}),
 	)
-	signer := jwt.NewSigner(issuer, privateKey)
+	signer := jwt.NewKeyringSigner(issuer, keyring)
+
+	var clientAuthorizers authorize.ClientAuthorizers
+	if len(o.ClientTokenFile) > 0 {
+		fileAuthorizer, err := authorize.NewFileAuthorizer(o.ClientTokenFile)
+		if err != nil {
+			return fmt.Errorf("unable to load --client-token-file: %v", err)
+		}
+		clientAuthorizers = append(clientAuthorizers, fileAuthorizer)
+	}
+	clientAuthorizers = append(clientAuthorizers, jwtAuthorizer)
+	if len(o.ClientOIDCIssuers) > 0 {
+		config := jwt.OIDCConfig{
+			Audience:        o.ClientOIDCAudience,
+			ClockSkew:       o.ClientOIDCClockSkew,
+			IDClaim:         o.ClientOIDCIDClaim,
+			PartitionKey:    o.PartitionKey,
+			LabelClaims:     make(map[string]string),
+			RefreshInterval: o.ClientOIDCRefreshInterval,
+			Client: &http.Client{
+				Timeout:   20 * time.Second,
+				Transport: telemeter_http.NewInstrumentedRoundTripper("oidc_keys", http.DefaultTransport),
+			},
+		}
+		for _, flag := range o.ClientOIDCIssuers {
+			values := strings.SplitN(flag, ",", 2)
+			issuer := jwt.OIDCIssuer{URL: values[0]}
+			if len(values) == 2 {
+				issuer.JWKSURL = values[1]
+			}
+			config.Issuers = append(config.Issuers, issuer)
+		}
+		for _, flag := range o.ClientOIDCLabelClaims {
+			values := strings.SplitN(flag, "=", 2)
+			if len(values) != 2 || len(values[0]) == 0 || len(values[1]) == 0 {
+				return fmt.Errorf("--client-oidc-label-claim must be of the form claim=label: %s", flag)
+			}
+			config.LabelClaims[values[0]] = values[1]
+		}
+		oidcAuthorizer, err := jwt.NewOIDCAuthorizer(ctx, config)
+		if err != nil {
+			return fmt.Errorf("unable to configure --client-oidc-issuer: %v", err)
+		}
+		clientAuthorizers = append(clientAuthorizers, oidcAuthorizer)
+	}
+	if o.ClientKubernetesReview {
+		reviews, err := kubernetes.NewInClusterReviewClient()
+		if err != nil {
+			return fmt.Errorf("unable to configure --client-kubernetes-review: %v", err)
+		}
+		kubernetesAuthorizer, err := kubernetes.NewAuthorizer(reviews, kubernetes.Config{
+			Audiences: o.ClientKubernetesAudiences,
+			Attributes: kubernetes.ResourceAttributes{
+				Namespace: o.ClientKubernetesNamespace,
+				Group:     o.ClientKubernetesGroup,
+				Resource:  o.ClientKubernetesResource,
+				Verb:      o.ClientKubernetesVerb,
+			},
+			PartitionKey: o.PartitionKey,
+			CacheTTL:     o.ClientKubernetesCacheTTL,
+			CacheSize:    100000,
+			Timeout:      10 * time.Second,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to configure --client-kubernetes-review: %v", err)
+		}
+		clientAuthorizers = append(clientAuthorizers, kubernetesAuthorizer)
+	}
+	// Tokens issued before scopes were introduced, and static tokens without scopes, only upload.
+	var clientAuthorizer authorize.ClientAuthorizer = authorize.WithDefaultScopes(clientAuthorizers, authorize.ScopeMetricsWrite)
+	var revocations *authorize.Revocations
+	if len(o.RevocationFile) > 0 {
+		revocations, err = authorize.NewRevocations(o.RevocationFile)
+		if err != nil {
+			return fmt.Errorf("unable to load --revocation-file: %v", err)
+		}
+		clientAuthorizer = authorize.NewRevokingClientAuthorizer(revocations, o.PartitionKey, clientAuthorizer)
+	}
+	var clusterAccess *authorize.ClusterAccess
+	if len(o.ClusterAccessFile) > 0 {
+		clusterAccess, err = authorize.NewClusterAccess(o.ClusterAccessFile)
+		if err != nil {
+			return fmt.Errorf("unable to load --cluster-access-file: %v", err)
+		}
+	}
 
 	// create a secret for the JWT key
 	h := sha256.New()
@@ -360,16 +1083,167 @@ func (o *Options) Run() error {
 	external := http.NewServeMux()
 	internal := http.NewServeMux()
 
-	internalPaths := []string{"/", "/federate", "/metrics", "/debug/pprof", "/healthz", "/healthz/ready"}
+	internalPaths := []string{"/", "/federate", "/api/v1/read", "/api/v1/label/{name}/values", "/api/v1/series", "/metrics", "/debug/pprof", "/healthz", "/healthz/ready"}
+
+	var shared sharedcache.Cache
+	if o.SharedCache == "redis" {
+		local, err := sharedcache.NewMemory(o.SharedCacheFallbackSize)
+		if err != nil {
+			return fmt.Errorf("unable to create shared cache fallback: %v", err)
+		}
+		redis := sharedcache.NewRedis(o.SharedCacheAddr, o.SharedCachePrefix, o.SharedCacheTimeout, 64)
+		redis.Username = o.SharedCacheUsername
+		if len(o.SharedCachePasswordFile) > 0 {
+			data, err := ioutil.ReadFile(o.SharedCachePasswordFile)
+			if err != nil {
+				return fmt.Errorf("unable to read --shared-cache-password-file: %v", err)
+			}
+			redis.Password = strings.TrimSpace(string(data))
+		}
+		if o.SharedCacheTLS || len(o.SharedCacheCAPath) > 0 {
+			redis.TLSConfig = &tls.Config{}
+			if len(o.SharedCacheCAPath) > 0 {
+				data, err := ioutil.ReadFile(o.SharedCacheCAPath)
+				if err != nil {
+					return fmt.Errorf("unable to read --shared-cache-ca: %v", err)
+				}
+				pool := x509.NewCertPool()
+				if !pool.AppendCertsFromPEM(data) {
+					return fmt.Errorf("no certificates found in --shared-cache-ca")
+				}
+				redis.TLSConfig.RootCAs = pool
+			}
+		}
+		shared = sharedcache.NewFallback(redis, local, o.SharedCacheBackoff)
+	}
+
+	reg := o.Registerer
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
 
 	// configure the authenticator and incoming data validator
+	authorizeMetrics := authorize.NewMetrics(reg)
 	var clusterAuth authorize.ClusterAuthorizer = authorize.ClusterAuthorizerFunc(stub.Authorize)
 	if authorizeURL != nil {
-		clusterAuth = tollbooth.NewAuthorizer(authorizeClient, authorizeURL)
+		tb := tollbooth.NewAuthorizer(authorizeClient, authorizeURL)
+		tb.Retries = o.AuthorizeRetries
+		tb.AccountLabel = o.AuthorizeAccountLabel
+		tb.Metrics = authorizeMetrics
+		clusterAuth = tb
+		if shared != nil {
+			clusterAuth = authorize.NewSharedCachingClusterAuthorizer(clusterAuth, shared, o.AuthorizeCacheTTL, o.AuthorizeCacheNegativeTTL)
+		} else if o.AuthorizeCacheSize > 0 {
+			cached, err := authorizeMetrics.NewCachingClusterAuthorizer(clusterAuth, o.AuthorizeCacheSize, o.AuthorizeCacheTTL, o.AuthorizeCacheNegativeTTL)
+			if err != nil {
+				return fmt.Errorf("unable to create authorize cache: %v", err)
+			}
+			clusterAuth = cached
+		}
+	}
+	var registry authorize.ClusterRegistry
+	switch o.ClusterRegistry {
+	case "memory":
+		registry = authorize.NewMemoryRegistry(o.ClusterRegistryTTL)
+	case "file":
+		registry, err = authorize.NewFileRegistry(o.ClusterRegistryFile)
+		if err != nil {
+			return err
+		}
+	}
+	if registry != nil {
+		clusterAuth = authorize.NewRegisteringClusterAuthorizer(clusterAuth, registry)
+	}
+	if revocations != nil {
+		clusterAuth = authorize.NewRevokingClusterAuthorizer(revocations, clusterAuth)
+	}
+
+	auditLog := audit.NewStandardLogger()
+	if len(o.AuditLogFile) > 0 {
+		auditLog, err = audit.NewFileLogger(o.AuditLogFile)
+		if err != nil {
+			return fmt.Errorf("unable to open --audit-log-file: %v", err)
+		}
 	}
 
 	auth := jwt.NewAuthorizeClusterHandler(o.PartitionKey, o.TokenExpireSeconds, signer, o.RequiredLabels, clusterAuth)
-	validator := validate.New(o.PartitionKey, o.LimitBytes, 24*time.Hour, time.Now)
+	auth.Audit = auditLog
+	if len(o.TokenLimitsFile) > 0 {
+		f, err := os.Open(o.TokenLimitsFile)
+		if err != nil {
+			return fmt.Errorf("unable to read --token-limits-file: %v", err)
+		}
+		auth.Limits, err = jwt.ParseLimits(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("unable to read --token-limits-file: %v", err)
+		}
+	}
+	var refresh http.Handler = auth.RefreshHandler(jwtAuthorizer, revocations, o.TokenRefreshGrace)
+	var authorizeHandler http.Handler = auth
+	if o.AuthorizeLockoutThreshold > 0 {
+		lockout, err := authorize.NewLockout(o.AuthorizeLockoutThreshold, o.AuthorizeLockoutWindow, o.AuthorizeLockoutDuration, o.AuthorizeLockoutMaxDuration, o.AuthorizeLockoutMaxKeys)
+		if err != nil {
+			return fmt.Errorf("unable to create authorize lockout: %v", err)
+		}
+		authorizeHandler = authorize.NewLockoutHandler(lockout, authorizeHandler)
+		refresh = authorize.NewLockoutHandler(lockout, refresh)
+	}
+	allowlist, err := validate.NewAllowlist(o.AllowMetrics)
+	if err != nil {
+		return fmt.Errorf("invalid --allow-metric: %v", err)
+	}
+	partitionKeyFormat, err := validate.NewPartitionKeyFormat(o.PartitionKeyFormat, o.PartitionKeyBypass)
+	if err != nil {
+		return fmt.Errorf("invalid --partition-label-format: %v", err)
+	}
+	validation := validate.Options{
+		Allowlist:             allowlist,
+		StrictAllowlist:       o.AllowMetricsStrict,
+		MaxNotAllowlisted:     o.AllowMetricsMaxListed,
+		Requirements:          o.Requirements,
+		ElideLabels:           o.ElideLabels,
+		LabelLimits:           o.LabelLimits,
+		MaxSeries:             o.LimitSeriesPerUpload,
+		MaxFutureSkew:         o.MaxFutureSkew,
+		ClampFutureSamples:    o.FutureSamples == "clamp",
+		ClampOldSamples:       o.OldSamples == "clamp",
+		KeepTimestamps:        o.SampleTimestamps == "keep",
+		Duplicates:            o.DuplicateSeries != "allow",
+		DropInconsistentTypes: o.DropInconsistentTypes,
+		SortSamples:           o.SampleOrder != "reject",
+		StrictSampleOrder:     o.SampleOrder == "strict",
+		SampleOrderTolerance:  o.SampleOrderTolerance,
+		StrictDuplicates:      o.DuplicateSeries == "reject",
+		RejectEmptyUploads:    o.EmptyUploads == "reject",
+		ReportOnly:            o.ReportOnlyRules,
+		PartitionKeyFormat:    partitionKeyFormat,
+		Metrics:               validate.NewMetrics(reg),
+	}
+	if o.CardinalityBudget > 0 {
+		cardinalityCache := shared
+		if cardinalityCache == nil {
+			if cardinalityCache, err = sharedcache.NewMemory(o.CardinalityCacheSize); err != nil {
+				return fmt.Errorf("unable to create cardinality cache: %v", err)
+			}
+		}
+		validation.Cardinality = validate.NewCardinalityBudget(o.CardinalityBudget, o.CardinalityWindow, cardinalityCache)
+	}
+	if len(o.ValidationOverridesFile) > 0 {
+		validation.Overrides, err = validate.NewOverrides(o.ValidationOverridesFile, validation)
+		if err != nil {
+			return fmt.Errorf("unable to load --validation-overrides-file: %v", err)
+		}
+	}
+	var validator validate.Validator = validate.NewWithOptions(o.PartitionKey, o.LimitBytes, o.MaxSampleAge, time.Now, validation)
+	var validationConfig *validate.ConfigFile
+	if len(o.ValidationConfigFile) > 0 {
+		validationConfig, err = validate.NewConfigFile(o.ValidationConfigFile, o.PartitionKey, o.LimitBytes, o.MaxSampleAge, time.Now, validation)
+		if err != nil {
+			return fmt.Errorf("unable to load --validation-config-file: %v", err)
+		}
+		validator = validationConfig
+	}
 
 	var store store.Store
 
@@ -377,6 +1251,11 @@ func (o *Options) Run() error {
 	ms.StartCleaner(ctx, time.Minute)
 	store = ms
 
+	// Count the clusters this node has not heard from recently.
+	lu := lastupload.New(o.TTL, o.StaleClusterThresholds, o.WatchedClusters, store)
+	reg.MustRegister(lu)
+	store = lu
+
 	// If specified all written metrics will be written to the remote forward URL
 	if o.ForwardURL != "" {
 		u, err := url.Parse(o.ForwardURL)
@@ -386,8 +1265,13 @@ func (o *Options) Run() error {
 		store = forward.New(u, store)
 	}
 
-	// Create a rate-limited store with a memory-store as its backend.
-	store = ratelimited.New(o.Ratelimit, store)
+	// Create a rate-limited store with a memory-store as its backend. Without a cluster, rate
+	// limits are shared between servers if they share a cache.
+	if shared != nil && len(o.ListenCluster) == 0 {
+		store = ratelimited.NewShared(o.Ratelimit, shared, store)
+	} else {
+		store = ratelimited.New(o.Ratelimit, store)
+	}
 
 	if len(o.ListenCluster) > 0 {
 		c := cluster.NewDynamic(o.Name, store)
@@ -420,25 +1304,141 @@ func (o *Options) Run() error {
 		// to node A's bucket enter the cluster on different node, node B,
 		// then node B will dutifully pass along the requests to the node A
 		// and can DOS the target and congest the internal network.
-		if o.Ratelimit != 0 {
+		// With a shared cache, this limit applies to all nodes together instead.
+		if o.Ratelimit != 0 && shared != nil {
+			store = ratelimited.NewShared(o.Ratelimit, shared, store)
+		} else if o.Ratelimit != 0 {
 			store = ratelimited.New(o.Ratelimit, store)
 		}
 	}
 
+	// Account uploaded samples against the quota of each client.
+	var quotas *quota.Store
+	if o.SampleQuota > 0 {
+		quotas = quota.New(o.SampleQuota, o.SampleQuotaWindow, o.SampleQuotaClients, store)
+		store = quotas
+	}
+
+	// Allow browsers to call the read and admin endpoints, preflight requests are
+	// answered before authorization.
+	cors := func(h http.Handler) http.Handler {
+		if len(o.CORSAllowedOrigins) == 0 {
+			return h
+		}
+		return telemeter_http.NewCORSHandler(telemeter_http.CORSOptions{
+			AllowedOrigins: o.CORSAllowedOrigins,
+			AllowedMethods: o.CORSAllowedMethods,
+			AllowedHeaders: o.CORSAllowedHeaders,
+			MaxAge:         o.CORSMaxAge,
+		}, h)
+	}
+
+	// Expose the admin endpoints to holders of an admin token.
+	var adminAuth authorize.ClientAuthorizer
+	if len(o.AdminTokenFile) > 0 {
+		f, err := os.Open(o.AdminTokenFile)
+		if err != nil {
+			return fmt.Errorf("unable to read --admin-token-file: %v", err)
+		}
+		admins, err := authorize.ParseStaticTokens(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("unable to parse --admin-token-file: %v", err)
+		}
+		// Admin tokens without scopes may administer and read.
+		adminAuth = authorize.WithDefaultScopes(authorize.NewStaticAuthorizer(admins), authorize.ScopeAdmin, authorize.ScopeMetricsRead)
+		authorizeAdmin := authorizeMetrics.Middleware(authorize.TokenAuthorizer(adminAuth))
+		partitionsHandler := admin.NewPartitions(ms, store)
+		partitionsHandler.Audit = auditLog
+		partitions := cors(authorizeAdmin(authorize.RequireScope(authorize.ScopeAdmin, partitionsHandler)))
+		internalPaths = append(internalPaths, admin.PartitionsPath, "/authorize/introspect")
+		introspect := jwt.NewIntrospectHandler(jwtAuthorizer, revocations, o.PartitionKey)
+		introspect.Audit = auditLog
+		internal.Handle("/authorize/introspect", cors(authorizeAdmin(authorize.RequireScope(authorize.ScopeAdmin, introspect))))
+		internal.Handle(admin.PartitionsPath, partitions)
+		internal.Handle(admin.PartitionsPath+"/", partitions)
+		if revocations != nil {
+			internalPaths = append(internalPaths, admin.RevocationsPath)
+			revocationsHandler := admin.NewRevocations(revocations)
+			revocationsHandler.Audit = auditLog
+			internal.Handle(admin.RevocationsPath, cors(authorizeAdmin(authorize.RequireScope(authorize.ScopeAdmin, revocationsHandler))))
+		}
+		if clusterAccess != nil {
+			internalPaths = append(internalPaths, admin.ClusterAccessPath)
+			accessHandler := admin.NewClusterAccess(clusterAccess)
+			accessHandler.Audit = auditLog
+			internal.Handle(admin.ClusterAccessPath, cors(authorizeAdmin(authorize.RequireScope(authorize.ScopeAdmin, accessHandler))))
+		}
+		if quotas != nil {
+			internalPaths = append(internalPaths, admin.QuotaPath)
+			quotaHandler := admin.NewQuota(quotas)
+			quotaHandler.Audit = auditLog
+			internal.Handle(admin.QuotaPath, cors(authorizeAdmin(authorize.RequireScope(authorize.ScopeAdmin, quotaHandler))))
+		}
+		if registry != nil {
+			internalPaths = append(internalPaths, admin.ClusterBindingsPath)
+			bindingsHandler := admin.NewClusterBindings(registry)
+			bindingsHandler.Audit = auditLog
+			bindings := cors(authorizeAdmin(authorize.RequireScope(authorize.ScopeAdmin, bindingsHandler)))
+			internal.Handle(admin.ClusterBindingsPath, bindings)
+			internal.Handle(admin.ClusterBindingsPath+"/", bindings)
+		}
+	}
+
+	anonymizer, err := labelActionsFor(o.AnonymizeLabels, o.AnonymizeSecret)
+	if err != nil {
+		return err
+	}
+
 	transforms := metricfamily.MultiTransformer{}
 	transforms.With(whitelister)
 	if len(o.Labels) > 0 {
 		transforms.With(metricfamily.NewLabel(o.Labels, nil))
 	}
-	transforms.With(metricfamily.NewElide(o.ElideLabels...))
+	transforms.With(anonymizer)
 
 	server := httpserver.New(store, validator, transforms, o.TTL)
+	server.Lenient = o.LenientContentType
+	server.EnforceClientLabels = o.EnforceClientLabels
+	server.RejectLabelConflicts = o.RejectLabelConflicts
+	server.MaxUncompressedBytes = o.LimitUncompressedBytes
+	server.MaxSamplesPerUpload = o.LimitSamplesPerUpload
+	server.RejectPartialUploads = o.RejectPartialUploads
+	server.MaxReportedDrops = o.MaxReportedDrops
+	if o.FailureLogWindow > 0 {
+		server.FailureLog = logthrottle.New(o.FailureLogWindow, o.FailureLogMaxKeys)
+	}
+	server.PartitionLabel = o.PartitionKey
+	server.Partitioner = partitioner
+	server.MaxLabelValues = o.APIMaxLabelValues
+	server.MaxSeries = o.APIMaxSeries
 	receiver := receive.NewHandler(o.ForwardURL)
 
+	// Spans of uploads and reads are exported to --tracing-endpoint, or else received by the
+	// tracer registered as the global tracer, by default disabling tracing.
+	tracer := opentracing.GlobalTracer()
+	var zipkin *tracing.Zipkin
+	if len(o.TracingEndpoint) > 0 {
+		u, err := url.Parse(o.TracingEndpoint)
+		if err != nil {
+			return fmt.Errorf("--tracing-endpoint must be a valid URL: %v", err)
+		}
+		if o.TracingSampleRatio < 0 || o.TracingSampleRatio > 1 {
+			return fmt.Errorf("--tracing-sample-ratio must be between 0 and 1")
+		}
+		zipkin = tracing.NewZipkin(o.TracingServiceName, u, &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: telemeter_http.NewInstrumentedRoundTripper("tracing", http.DefaultTransport),
+		}, o.TracingSampleRatio)
+		tracer = zipkin
+	}
+
 	internalPathJSON, _ := json.MarshalIndent(Paths{Paths: internalPaths}, "", "  ")
-	externalPathJSON, _ := json.MarshalIndent(Paths{Paths: []string{"/", "/authorize", "/upload", "/healthz", "/healthz/ready", "/metrics/v1/receive"}}, "", "  ")
+	externalPathJSON, _ := json.MarshalIndent(Paths{Paths: []string{"/", "/authorize", "/authorize/refresh", "/.well-known/jwks.json", "/upload", "/upload/v1", "/upload/v2", "/healthz", "/healthz/ready", "/metrics/v1/receive"}}, "", "  ")
 
-	// TODO: add internal authorization
+	// The internal listener is trusted: only the admin endpoints, and the read endpoints with
+	// --authorize-reads, require a token. It is expected to bind to localhost or a private
+	// network, which is not enforced.
 	telemeter_http.DebugRoutes(internal)
 
 	internal.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -451,7 +1451,22 @@ func (o *Options) Run() error {
 		}
 		w.WriteHeader(http.StatusNotFound)
 	}))
-	internal.Handle("/federate", http.HandlerFunc(server.Get))
+	// With --authorize-reads, the read endpoints are served to holders of an admin or client
+	// token with the read scope. Clients without the admin scope read only their partition.
+	read := func(h http.Handler) http.Handler {
+		if !o.AuthorizeReads {
+			return cors(h)
+		}
+		readAuth := authorize.ClientAuthorizers{clientAuthorizer}
+		if adminAuth != nil {
+			readAuth = authorize.ClientAuthorizers{adminAuth, clientAuthorizer}
+		}
+		return cors(authorizeMetrics.Middleware(authorize.TokenAuthorizer(readAuth))(authorize.RequireScope(authorize.ScopeMetricsRead, authorize.NewReadPartitionHandler(o.PartitionKey, partitioner, h))))
+	}
+	internal.Handle("/federate", read(telemeter_http.NewTracingHandler(tracer, "federate", http.HandlerFunc(server.Get))))
+	internal.Handle("/api/v1/read", read(telemeter_http.NewTracingHandler(tracer, "read", http.HandlerFunc(server.Read))))
+	internal.Handle(httpserver.LabelValuesPrefix, read(http.HandlerFunc(server.LabelValues)))
+	internal.Handle("/api/v1/series", read(http.HandlerFunc(server.Series)))
 	telemeter_http.MetricRoutes(internal)
 	telemeter_http.HealthRoutes(internal)
 
@@ -467,15 +1482,111 @@ func (o *Options) Run() error {
 	}))
 	telemeter_http.HealthRoutes(external)
 
+	var cache *idempotency.Cache
+	if o.IdempotencyTTL > 0 && shared != nil {
+		cache = idempotency.NewSharedCache(shared, o.IdempotencyTTL)
+	} else if o.IdempotencyTTL > 0 {
+		c, err := idempotency.NewCache(o.IdempotencyCacheSize, o.IdempotencyTTL)
+		if err != nil {
+			return fmt.Errorf("unable to create idempotency cache: %v", err)
+		}
+		cache = c
+	}
+	var limiter *httpserver.ClientLimiter
+	if o.LimitClientInFlight > 0 {
+		limiter = httpserver.NewClientLimiter(o.LimitClientInFlight)
+	}
+	certMapper := &authorize.CertificateMapper{ExtensionLabels: make(map[string]string)}
+	for _, flag := range o.ClientCertLabels {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 || len(values[0]) == 0 || len(values[1]) == 0 {
+			return fmt.Errorf("--client-cert-label must be of the form oid=label: %s", flag)
+		}
+		certMapper.ExtensionLabels[values[0]] = values[1]
+	}
+	if len(o.ClientCertLabelsFile) > 0 {
+		f, err := os.Open(o.ClientCertLabelsFile)
+		if err != nil {
+			return fmt.Errorf("unable to read --client-cert-labels-file: %v", err)
+		}
+		certMapper.Labels, err = authorize.ParseClientLabels(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("unable to parse --client-cert-labels-file: %v", err)
+		}
+	}
+
+	// Certificates take precedence over tokens with --client-auth=any.
+	tokens := authorize.TokenAuthorizer(clientAuthorizer)
+	certificates := authorize.CertificateAuthorizer(certMapper, authorize.ScopeMetricsWrite)
+	if revocations != nil {
+		certificates = authorize.NewRevokingAuthorizer(revocations, o.PartitionKey, certificates)
+	}
+	var uploadAuthorizers authorize.Authorizers
+	var extractors []authorize.Extractor
+	switch o.ClientAuth {
+	case "certificate":
+		uploadAuthorizers, extractors = authorize.Authorizers{certificates}, []authorize.Extractor{authorize.ClientCertificate()}
+	case "any":
+		uploadAuthorizers, extractors = authorize.Authorizers{certificates, tokens}, []authorize.Extractor{authorize.ClientCertificate(), authorize.BearerToken()}
+	default:
+		uploadAuthorizers, extractors = authorize.Authorizers{tokens}, []authorize.Extractor{authorize.BearerToken()}
+	}
+	// Signed requests are accepted in addition to any --client-auth.
+	if len(o.ClientHMACKeysFile) > 0 {
+		f, err := os.Open(o.ClientHMACKeysFile)
+		if err != nil {
+			return fmt.Errorf("unable to read --client-hmac-keys-file: %v", err)
+		}
+		keys, err := authorize.ParseHMACKeys(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("unable to parse --client-hmac-keys-file: %v", err)
+		}
+		for _, key := range keys {
+			if len(key.Client.Scopes) == 0 {
+				key.Client.Scopes = []string{authorize.ScopeMetricsWrite}
+			}
+		}
+		hmacAuthorizer, err := authorize.NewHMACAuthorizer(keys, o.ClientHMACWindow, o.ClientHMACCacheSize)
+		if err != nil {
+			return fmt.Errorf("unable to configure --client-hmac-keys-file: %v", err)
+		}
+		var signatures authorize.Authorizer = hmacAuthorizer
+		if revocations != nil {
+			signatures = authorize.NewRevokingAuthorizer(revocations, o.PartitionKey, signatures)
+		}
+		uploadAuthorizers = append(uploadAuthorizers, signatures)
+		extractors = append(extractors, authorize.HMACSignature(o.LimitBytes))
+	}
+	authorizeUpload := authorizeMetrics.Middleware(uploadAuthorizers, extractors...)
+
+	uploadHandler := func(name string, post http.HandlerFunc) http.Handler {
+		var upload http.Handler = post
+		if cache != nil {
+			upload = idempotency.NewHandler(cache, upload)
+		}
+		if limiter != nil {
+			upload = limiter.Handler(upload)
+		}
+		upload = telemeter_http.NewInstrumentedHandler(name, upload)
+		if clusterAccess != nil {
+			upload = authorize.NewClusterAccessHandler(clusterAccess, o.PartitionKey, upload)
+		}
+		if registry != nil {
+			upload = authorize.NewClusterBindingHandler(registry, o.PartitionKey, upload)
+		}
+
+		return telemeter_http.NewTracingHandler(tracer, name, authorizeUpload(authorize.RequireScope(authorize.ScopeMetricsWrite, upload)))
+	}
+
 	// v1 routes
-	external.Handle("/authorize", telemeter_http.NewInstrumentedHandler("authorize", auth))
-	external.Handle("/upload",
-		authorize.NewAuthorizeClientHandler(jwtAuthorizer,
-			telemeter_http.NewInstrumentedHandler("upload",
-				http.HandlerFunc(server.Post),
-			),
-		),
-	)
+	external.Handle("/authorize", telemeter_http.NewInstrumentedHandler("authorize", authorizeHandler))
+	external.Handle("/authorize/refresh", telemeter_http.NewInstrumentedHandler("authorize_refresh", refresh))
+	external.Handle("/.well-known/jwks.json", telemeter_http.NewInstrumentedHandler("jwks", jwt.NewJWKSHandler(keyring)))
+	external.Handle("/upload", uploadHandler("upload", server.Post))
+	external.Handle("/upload/v1", uploadHandler("upload", server.Post))
+	external.Handle("/upload/v2", uploadHandler("upload_v2", server.PostV2))
 
 	// v1 routes
 	external.Handle("/metris/v1/receive",
@@ -496,81 +1607,206 @@ func (o *Options) Run() error {
 	if err != nil {
 		return err
 	}
+	var debugListener net.Listener
+	if len(o.ListenDebug) > 0 {
+		log.Printf("Serving debug endpoints on %s", o.ListenDebug)
+		debugListener, err = net.Listen("tcp", o.ListenDebug)
+		if err != nil {
+			return err
+		}
+	}
+
+	timeouts := httpserver.Timeouts{
+		Read:       o.ReadTimeout,
+		ReadHeader: o.ReadHeaderTimeout,
+		Write:      o.WriteTimeout,
+		Idle:       o.IdleTimeout,
+	}
+
+	var reloaders []*httpserver.CertificateReloader
+	internalServer := &http.Server{
+		Handler: internal,
+	}
+	// responses on the internal listener, such as federation, may take arbitrarily long to stream
+	internalTimeouts := timeouts
+	internalTimeouts.Write = 0
+	internalTimeouts.Apply(internalServer)
+	if useInternalTLS {
+		cfg, r, err := httpserver.TLSConfig(httpserver.TLSOptions{
+			CertFile: o.InternalTLSCertificatePath,
+			KeyFile:  o.InternalTLSKeyPath,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to configure internal TLS: %v", err)
+		}
+		internalServer.TLSConfig = cfg
+		reloaders = append(reloaders, r)
+	}
+	externalServer := &http.Server{
+		Handler: authorize.NewCertificateHandler(external),
+	}
+	timeouts.Apply(externalServer)
+	if useTLS {
+		cfg, r, err := httpserver.TLSConfig(httpserver.TLSOptions{
+			CertFile:          o.TLSCertificatePath,
+			KeyFile:           o.TLSKeyPath,
+			ClientCAFile:      o.TLSClientCAPath,
+			RequireClientCert: o.TLSRequireClientCert,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to configure TLS: %v", err)
+		}
+		externalServer.TLSConfig = cfg
+		reloaders = append(reloaders, r)
+		if err := http2.ConfigureServer(externalServer, &http2.Server{}); err != nil {
+			return fmt.Errorf("unable to configure HTTP/2: %v", err)
+		}
+	} else if o.H2C {
+		externalServer.Handler = httpserver.NewH2CHandler(externalServer.Handler, &http2.Server{})
+	}
 
 	var g run.Group
 	{
 		// Run the internal server.
 		g.Add(func() error {
-			s := &http.Server{
-				Handler: internal,
-			}
 			if useInternalTLS {
-				if err := s.ServeTLS(internalListener, o.InternalTLSCertificatePath, o.InternalTLSKeyPath); err != nil && err != http.ErrServerClosed {
+				if err := internalServer.ServeTLS(internalListener, "", ""); err != nil && err != http.ErrServerClosed {
 					log.Printf("error: internal HTTPS server exited: %v", err)
 					return err
 				}
 			} else {
-				if err := s.Serve(internalListener); err != nil && err != http.ErrServerClosed {
+				if err := internalServer.Serve(internalListener); err != nil && err != http.ErrServerClosed {
 					log.Printf("error: internal HTTP server exited: %v", err)
 					return err
 				}
 			}
 			return nil
 		}, func(error) {
-			internalListener.Close()
+			shutdown(internalServer)
 		})
 	}
 
 	{
 		// Run the external server.
 		g.Add(func() error {
-			s := &http.Server{
-				Handler: external,
-			}
 			if useTLS {
-				if err := s.ServeTLS(externalListener, o.TLSCertificatePath, o.TLSKeyPath); err != nil && err != http.ErrServerClosed {
+				if err := externalServer.ServeTLS(externalListener, "", ""); err != nil && err != http.ErrServerClosed {
 					log.Printf("error: external HTTPS server exited: %v", err)
 					return err
 				}
 			} else {
-				if err := s.Serve(externalListener); err != nil && err != http.ErrServerClosed {
+				if err := externalServer.Serve(externalListener); err != nil && err != http.ErrServerClosed {
 					log.Printf("error: external HTTP server exited: %v", err)
 					return err
 				}
 			}
 			return nil
 		}, func(error) {
-			externalListener.Close()
+			shutdown(externalServer)
 		})
 	}
 
-	return g.Run()
-}
+	if debugListener != nil {
+		// Run the debug server.
+		debugServer := &http.Server{Handler: debugHandler(ms)}
+		g.Add(func() error {
+			if err := debugServer.Serve(debugListener); err != nil && err != http.ErrServerClosed {
+				log.Printf("error: debug HTTP server exited: %v", err)
+				return err
+			}
+			return nil
+		}, func(error) {
+			shutdown(debugServer)
+		})
+	}
 
-// loadPrivateKey loads a private key from PEM/DER-encoded data.
-func loadPrivateKey(data []byte) (crypto.PrivateKey, error) {
-	input := data
+	if zipkin != nil {
+		// Export the spans of finished requests.
+		cancel := make(chan struct{})
+		g.Add(func() error {
+			zipkin.Run(o.TracingFlushInterval, cancel)
+			return nil
+		}, func(error) {
+			close(cancel)
+		})
+	}
 
-	block, _ := pem.Decode(data)
-	if block != nil {
-		input = block.Bytes
+	if server.FailureLog != nil {
+		// Summarize the repeated upload failures of each window.
+		cancel := make(chan struct{})
+		g.Add(func() error {
+			server.FailureLog.Run(cancel)
+			return nil
+		}, func(error) {
+			close(cancel)
+		})
 	}
 
-	var priv interface{}
-	priv, err0 := x509.ParsePKCS1PrivateKey(input)
-	if err0 == nil {
-		return priv, nil
+	{
+		// Stop all servers once asked to.
+		cancel := make(chan struct{})
+		g.Add(func() error {
+			select {
+			case <-stop:
+			case <-cancel:
+			}
+			return nil
+		}, func(error) {
+			close(cancel)
+		})
 	}
 
-	priv, err1 := x509.ParsePKCS8PrivateKey(input)
-	if err1 == nil {
-		return priv, nil
+	if validationConfig != nil {
+		// Reload the validation config on SIGHUP and when the file changes.
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		cancel := make(chan struct{})
+		g.Add(func() error {
+			go validationConfig.Watch(cancel, validationConfigCheckInterval)
+			for {
+				select {
+				case <-hup:
+					if err := validationConfig.Reload(); err != nil {
+						log.Printf("error: failed to reload validation config, continuing with the previous rules: %v", err)
+					}
+				case <-cancel:
+					return nil
+				}
+			}
+		}, func(error) {
+			close(cancel)
+		})
 	}
 
-	priv, err2 := x509.ParseECPrivateKey(input)
-	if err2 == nil {
-		return priv, nil
+	if len(reloaders) > 0 {
+		// Reload the serving certificates on SIGHUP.
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		cancel := make(chan struct{})
+		g.Add(func() error {
+			for {
+				select {
+				case <-hup:
+					for _, r := range reloaders {
+						if err := r.Reload(); err != nil {
+							log.Printf("error: failed to reload certificate: %v", err)
+						}
+					}
+				case <-cancel:
+					return nil
+				}
+			}
+		}, func(error) {
+			close(cancel)
+		})
 	}
 
-	return nil, fmt.Errorf("unable to parse private key data: '%s', '%s' and '%s'", err0, err1, err2)
+	err = g.Run()
+	if zipkin != nil {
+		// Export the spans of the requests completed during shutdown.
+		if err := zipkin.Flush(); err != nil {
+			log.Printf("error exporting spans: %v", err)
+		}
+	}
+	return err
 }
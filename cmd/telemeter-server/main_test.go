@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -17,6 +18,7 @@ import (
 	"github.com/openshift/telemeter/pkg/store/memstore"
 	"github.com/openshift/telemeter/pkg/validate"
 
+	"github.com/prometheus/client_golang/prometheus"
 	clientmodel "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 
@@ -54,7 +56,7 @@ func TestPostError(t *testing.T) {
 	server := server.New(store, validator, nil, ttl)
 	labels := map[string]string{"cluster": "test"}
 
-	s := httptest.NewServer(fakeAuthorizeHandler(http.HandlerFunc(server.Post), &authorize.Client{ID: "test", Labels: labels}))
+	s := httptest.NewServer(testAuthorize(&authorize.Client{ID: "test", Labels: labels})(http.HandlerFunc(server.Post)))
 	defer s.Close()
 
 	longName := strings.Repeat("abcd", 2048)
@@ -62,16 +64,17 @@ func TestPostError(t *testing.T) {
 	testCases := []struct {
 		name   string
 		send   []*clientmodel.MetricFamily
+		code   int
 		expect string
 	}{
-		{name: "without cluster ID", send: sort(mustReadString(sampleMetrics)), expect: "a required label is missing from the metric"},
-		{name: "lack timestamp", send: withLabels(mustReadString(missingTimestamp), labels), expect: "do not have a timestamp"},
-		{name: "too large", send: []*clientmodel.MetricFamily{{Name: &longName}}, expect: "incoming sample data is too long"},
+		{name: "without cluster ID", send: sort(mustReadString(sampleMetrics)), code: http.StatusBadRequest, expect: `without the required label cluster=\"test\"`},
+		{name: "lack timestamp", send: withLabels(mustReadString(missingTimestamp), labels), code: http.StatusInternalServerError, expect: "do not have a timestamp"},
+		{name: "too large", send: []*clientmodel.MetricFamily{{Name: &longName}}, code: http.StatusRequestEntityTooLarge, expect: "incoming sample data is too long"},
 	}
 	for _, test := range testCases {
 		t.Run(test.name, func(t *testing.T) {
-			code, body := mustPostError(s.URL, expfmt.FmtProtoDelim, test.send)
-			if code != http.StatusInternalServerError {
+			code, body := mustPostError(s.URL+"/upload", expfmt.FmtProtoDelim, test.send)
+			if code != test.code {
 				t.Errorf("unexpected code: %d", code)
 			}
 			if !strings.Contains(body, test.expect) {
@@ -89,10 +92,10 @@ func testPost(t *testing.T, validator validate.Validator, send, expect []*client
 	memStore := memstore.New(ttl)
 	server := server.New(memStore, validator, nil, ttl)
 
-	s := httptest.NewServer(fakeAuthorizeHandler(http.HandlerFunc(server.Post), &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}}))
+	s := httptest.NewServer(testAuthorize(&authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}})(http.HandlerFunc(server.Post)))
 	defer s.Close()
 
-	mustPost(s.URL, expfmt.FmtProtoDelim, send)
+	mustPost(s.URL+"/upload", expfmt.FmtProtoDelim, send)
 
 	var actual []*clientmodel.MetricFamily
 	ps, err := memStore.ReadMetrics(context.Background(), 0)
@@ -201,6 +204,7 @@ func mustPostError(addr string, format expfmt.Format, families []*clientmodel.Me
 		panic(err)
 	}
 	req.Header.Add("Content-Type", string(format))
+	req.Header.Set("Authorization", "Bearer "+testToken)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -227,6 +231,7 @@ func mustPost(addr string, format expfmt.Format, families []*clientmodel.MetricF
 		panic(err)
 	}
 	req.Header.Add("Content-Type", string(format))
+	req.Header.Set("Authorization", "Bearer "+testToken)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -255,9 +260,138 @@ func mustGet(addr string, format expfmt.Format) []*clientmodel.MetricFamily {
 	return mustRead(resp.Body, expfmt.ResponseFormat(resp.Header))
 }
 
-func fakeAuthorizeHandler(h http.Handler, client *authorize.Client) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		req = req.WithContext(authorize.WithClient(req.Context(), client))
-		h.ServeHTTP(w, req)
-	})
+// testToken authorizes uploads as the client of testAuthorize.
+const testToken = "test-token"
+
+func testAuthorize(client *authorize.Client) func(http.Handler) http.Handler {
+	return authorize.Middleware(authorize.TokenAuthorizer(authorize.NewStaticAuthorizer(map[string]*authorize.Client{testToken: client})))
+}
+
+func TestDebugHandler(t *testing.T) {
+	ms := memstore.New(10 * time.Minute)
+	srv := httptest.NewServer(debugHandler(ms))
+	defer srv.Close()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/store"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: unexpected code %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestValidateDebugListen(t *testing.T) {
+	for _, tt := range []struct {
+		listen, debug string
+		wantErr       bool
+	}{
+		{listen: "0.0.0.0:9003"},
+		{listen: "0.0.0.0:9003", debug: "localhost:9005"},
+		{listen: "0.0.0.0:9003", debug: "0.0.0.0:9003", wantErr: true},
+		{listen: "0.0.0.0:9003", debug: "localhost:9003", wantErr: true},
+		{listen: "0.0.0.0:9003", debug: "9005", wantErr: true},
+	} {
+		if err := validateDebugListen(tt.listen, tt.debug); (err != nil) != tt.wantErr {
+			t.Errorf("validateDebugListen(%q, %q) = %v, want error %t", tt.listen, tt.debug, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"localhost:9004": true,
+		"127.0.0.1:9004": true,
+		"[::1]:9004":     true,
+		"0.0.0.0:9004":   false,
+		":9004":          false,
+		"10.0.0.1:9004":  false,
+		"localhost":      false,
+	} {
+		if got := isLoopback(addr); got != want {
+			t.Errorf("isLoopback(%q) = %t, want %t", addr, got, want)
+		}
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestListeners(t *testing.T) {
+	// the server runs twice in the same process, registering its metrics with a new registry each time
+	for _, name := range []string{"first", "second"} {
+		t.Run(name, testListeners)
+	}
+}
+
+func testListeners(t *testing.T) {
+	o := &Options{
+		Registerer:       prometheus.NewRegistry(),
+		Listen:           freeAddr(t),
+		ListenInternal:   freeAddr(t),
+		PartitionKey:     "_id",
+		TTL:              10 * time.Minute,
+		Ratelimit:        time.Minute,
+		FutureSamples:    "reject",
+		OldSamples:       "reject",
+		SampleTimestamps: "overwrite",
+		DuplicateSeries:  "merge",
+		SampleOrder:      "reject",
+		EmptyUploads:     "accept",
+	}
+	stop := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() { errCh <- o.run(stop) }()
+
+	get := func(addr, path string) int {
+		for i := 0; ; i++ {
+			resp, err := http.Get("http://" + addr + path)
+			if err != nil {
+				if i == 50 {
+					t.Fatal(err)
+				}
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+	}
+
+	for _, tt := range []struct {
+		addr, path string
+		want       int
+	}{
+		{addr: o.ListenInternal, path: "/metrics", want: http.StatusOK},
+		{addr: o.ListenInternal, path: "/healthz", want: http.StatusOK},
+		{addr: o.ListenInternal, path: "/debug/pprof/", want: http.StatusOK},
+		{addr: o.Listen, path: "/metrics", want: http.StatusNotFound},
+		{addr: o.Listen, path: "/debug/pprof/", want: http.StatusNotFound},
+		{addr: o.Listen, path: "/federate", want: http.StatusNotFound},
+		{addr: o.Listen, path: "/healthz", want: http.StatusOK},
+	} {
+		if got := get(tt.addr, tt.path); got != tt.want {
+			t.Errorf("%s%s: want %d, got %d", tt.addr, tt.path, tt.want, got)
+		}
+	}
+
+	close(stop)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("unexpected error on shutdown: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("servers did not shut down")
+	}
 }
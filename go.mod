@@ -9,9 +9,11 @@ require (
 	github.com/golang/protobuf v1.2.0
 	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db
 	github.com/hashicorp/go-msgpack v0.5.3
+	github.com/hashicorp/golang-lru v0.5.0
 	github.com/hashicorp/memberlist v0.1.4
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/oklog/run v0.0.0-20180308005104-6934b124db28
+	github.com/opentracing/opentracing-go v1.0.1
 	github.com/pquerna/cachecontrol v0.0.0-20180517163645-1555304b9b35 // indirect
 	github.com/prometheus/client_golang v0.9.1
 	github.com/prometheus/client_model v0.0.0-20180712105110-5c3871d89910
@@ -20,6 +22,7 @@ require (
 	github.com/satori/go.uuid v1.2.1-0.20181028125025-b2ce2384e17b
 	github.com/serialx/hashring v0.0.0-20180504054112-49a4782e9908
 	github.com/spf13/cobra v0.0.3
+	golang.org/x/net v0.0.0-20181114220301-adae6a3d119a
 	golang.org/x/oauth2 v0.0.0-20180821212333-d2e6202438be
 	golang.org/x/sys v0.0.0-20190124100055-b90733256f2e // indirect
 	golang.org/x/time v0.0.0-20170424234030-8be79e1e0910
@@ -0,0 +1,134 @@
+// Package audit records who obtained tokens and which administrative actions were taken,
+// as JSON lines that are only ever appended to.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var writeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "telemeter_audit_write_failures_total",
+	Help: "Tracks the number of audit entries that could not be written.",
+})
+
+func init() {
+	prometheus.MustRegister(writeFailures)
+}
+
+// Actions recorded in the audit log.
+const (
+	ActionIssueToken      = "token.issue"
+	ActionRefreshToken    = "token.refresh"
+	ActionIntrospectToken = "token.introspect"
+	ActionDeletePartition = "partition.delete"
+	ActionRevoke          = "revoke"
+	ActionClusterAccess   = "cluster_access.replace"
+	ActionClusterRebind   = "cluster.rebind"
+	ActionResetQuota      = "quota.reset"
+)
+
+// Outcomes of audited actions. Admin actions may record more specific outcomes.
+const (
+	OutcomeAllowed = "allowed"
+	OutcomeDenied  = "denied"
+	OutcomeFailed  = "failed"
+)
+
+// Anonymous is the actor of actions whose caller could not be identified.
+const Anonymous = "anonymous"
+
+// requestIDHeader identifies a request across logs, as set by the caller or a proxy.
+const requestIDHeader = "X-Request-Id"
+
+// Entry is a single audited action. It must never carry credentials.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Outcome   string    `json:"outcome"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// Logger records audit entries. Failing to record an entry does not fail the action.
+type Logger interface {
+	Log(e Entry)
+}
+
+// Log records an entry for the action taken by req, timestamped now.
+func Log(l Logger, req *http.Request, actor, action, target, outcome string) {
+	if len(actor) == 0 {
+		actor = Anonymous
+	}
+	l.Log(Entry{
+		Time:      time.Now().UTC(),
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		Outcome:   outcome,
+		RequestID: req.Header.Get(requestIDHeader),
+	})
+}
+
+type writerLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewLogger returns a Logger writing an entry per line to w.
+func NewLogger(w io.Writer) Logger {
+	return &writerLogger{w: w}
+}
+
+// NewFileLogger returns a Logger appending to the file at path, creating it if it does not exist.
+// The file is kept open for the lifetime of the process.
+func NewFileLogger(path string) (Logger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log: %v", err)
+	}
+	return NewLogger(f), nil
+}
+
+func (l *writerLogger) Log(e Entry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		writeFailures.Inc()
+		log.Printf("error: unable to marshal audit entry: %v", err)
+		return
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(data); err != nil {
+		writeFailures.Inc()
+		log.Printf("error: unable to write audit entry %s: %v", data[:len(data)-1], err)
+	}
+}
+
+type standardLogger struct{}
+
+// NewStandardLogger returns a Logger writing entries to the standard logger.
+func NewStandardLogger() Logger {
+	return standardLogger{}
+}
+
+func (standardLogger) Log(e Entry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		writeFailures.Inc()
+		log.Printf("error: unable to marshal audit entry: %v", err)
+		return
+	}
+	log.Printf("audit: %s", data)
+}
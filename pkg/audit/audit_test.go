@@ -0,0 +1,57 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewLogger(buf)
+	req := httptest.NewRequest("POST", "/authorize", nil)
+	Log(l, req, "", ActionIssueToken, "cluster-1", OutcomeDenied)
+	req.Header.Set("X-Request-Id", "req-1")
+	Log(l, req, "account-1", ActionIssueToken, "cluster-1", OutcomeAllowed)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected an entry per line, got %q", buf.String())
+	}
+	var entries []Entry
+	for _, line := range lines {
+		var e Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if e := entries[0]; e.Actor != Anonymous || e.Outcome != OutcomeDenied || len(e.RequestID) != 0 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e := entries[1]; e.Actor != "account-1" || e.Outcome != OutcomeAllowed || e.RequestID != "req-1" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	failures := func() float64 {
+		m := &clientmodel.Metric{}
+		if err := writeFailures.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	before := failures()
+	Log(NewLogger(failingWriter{}), req, "account-1", ActionIssueToken, "cluster-1", OutcomeAllowed)
+	if after := failures(); after != before+1 {
+		t.Fatalf("expected the write failure to be counted, got %v failures", after-before)
+	}
+}
@@ -0,0 +1,197 @@
+package authorize
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CodeClusterDenied is the code of the error response of uploads of denied clusters.
+const CodeClusterDenied = "cluster_denied"
+
+var clusterAccessDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "telemeter_cluster_access_denied_total",
+	Help: "Tracks the number of requests of clusters denied by the cluster access lists, by list.",
+}, []string{"list"})
+
+func init() {
+	prometheus.MustRegister(clusterAccessDenied)
+}
+
+// AccessList lists the cluster IDs allowed and denied access. If Allow is empty, all clusters
+// that are not denied are allowed.
+type AccessList struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// ClusterAccess holds the cluster access lists, persisted to a file that is reloaded when it
+// changes, at most every tokenFileCheckInterval.
+type ClusterAccess struct {
+	path  string
+	nowFn func() time.Time
+
+	mu      sync.RWMutex
+	allow   map[string]struct{}
+	deny    map[string]struct{}
+	modTime time.Time
+	checked time.Time
+}
+
+// NewClusterAccess loads the access lists stored at path. A missing file allows all clusters
+// and is created when the lists are first replaced.
+func NewClusterAccess(path string) (*ClusterAccess, error) {
+	a := &ClusterAccess{
+		path:  path,
+		nowFn: time.Now,
+		allow: make(map[string]struct{}),
+		deny:  make(map[string]struct{}),
+	}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reload reads the lists from disk. The caller must hold the lock.
+func (a *ClusterAccess) reload() error {
+	fi, err := os.Stat(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read cluster access file: %v", err)
+	}
+	data, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return fmt.Errorf("unable to read cluster access file: %v", err)
+	}
+	var list AccessList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("unable to parse cluster access file %s: %v", a.path, err)
+	}
+	a.allow, a.deny = make(map[string]struct{}), make(map[string]struct{})
+	addAll(a.allow, list.Allow)
+	addAll(a.deny, list.Deny)
+	a.modTime = fi.ModTime()
+	return nil
+}
+
+// check reloads the file if it changed, at most every tokenFileCheckInterval. A removed file
+// allows all clusters, as a missing one does on start.
+func (a *ClusterAccess) check() {
+	now := a.nowFn()
+	a.mu.RLock()
+	checked := a.checked
+	a.mu.RUnlock()
+	if now.Sub(checked) < tokenFileCheckInterval {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.checked) < tokenFileCheckInterval {
+		return
+	}
+	a.checked = now
+	fi, err := os.Stat(a.path)
+	if os.IsNotExist(err) {
+		if !a.modTime.IsZero() {
+			log.Printf("Cluster access file %s was removed, allowing all clusters", a.path)
+		}
+		a.allow, a.deny = make(map[string]struct{}), make(map[string]struct{})
+		a.modTime = time.Time{}
+		return
+	}
+	if err != nil {
+		log.Printf("error: unable to check cluster access file, continuing with the previous lists: %v", err)
+		return
+	}
+	if fi.ModTime().Equal(a.modTime) {
+		return
+	}
+	if err := a.reload(); err != nil {
+		log.Printf("error: unable to reload cluster access file, continuing with the previous lists: %v", err)
+	}
+}
+
+// Replace replaces the access lists and persists them. If they cannot be persisted, the
+// lists are left unchanged.
+func (a *ClusterAccess) Replace(list AccessList) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	allow, deny := make(map[string]struct{}), make(map[string]struct{})
+	addAll(allow, list.Allow)
+	addAll(deny, list.Deny)
+	data, err := json.MarshalIndent(AccessList{Allow: sortedKeys(allow), Deny: sortedKeys(deny)}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(a.path, data); err != nil {
+		return fmt.Errorf("unable to write cluster access file: %v", err)
+	}
+	if fi, err := os.Stat(a.path); err == nil {
+		a.modTime = fi.ModTime()
+	}
+	a.allow, a.deny = allow, deny
+	return nil
+}
+
+// List returns the access lists in order.
+func (a *ClusterAccess) List() AccessList {
+	a.check()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return AccessList{Allow: sortedKeys(a.allow), Deny: sortedKeys(a.deny)}
+}
+
+// Allowed returns an error if the cluster is denied, or if there is an allow list that does not
+// list it. Denying a cluster takes precedence over allowing it.
+func (a *ClusterAccess) Allowed(cluster string) error {
+	a.check()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if _, ok := a.deny[cluster]; ok {
+		clusterAccessDenied.WithLabelValues("deny").Inc()
+		return fmt.Errorf("cluster %s is denied", cluster)
+	}
+	if _, ok := a.allow[cluster]; !ok && len(a.allow) > 0 {
+		clusterAccessDenied.WithLabelValues("allow").Inc()
+		return fmt.Errorf("cluster %s is not allowed", cluster)
+	}
+	return nil
+}
+
+// NewClusterAccessHandler serves next only to clients whose cluster is allowed, and responds
+// with 403 to all others. The cluster of a client is the value of its partitionKey label, or
+// its ID if it has none. It must be wrapped by a handler authorizing the client.
+func NewClusterAccessHandler(access *ClusterAccess, partitionKey string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		client, ok := FromContext(req.Context())
+		if !ok {
+			writeErrorResponse(w, req, http.StatusUnauthorized, &errorResponse{Code: CodeUnauthorized, Message: "not authorized"})
+			return
+		}
+		cluster := client.Labels[partitionKey]
+		if len(cluster) == 0 {
+			cluster = client.ID
+		}
+		if err := access.Allowed(cluster); err != nil {
+			writeErrorResponse(w, req, http.StatusForbidden, &errorResponse{
+				Code:    CodeClusterDenied,
+				Message: err.Error(),
+				Details: map[string]interface{}{"cluster": cluster},
+			})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,134 @@
+package authorize
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestClusterAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.json")
+
+	write := func(list AccessList, modTime time.Time) {
+		t.Helper()
+		data, err := json.Marshal(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	denied := func(list string) float64 {
+		t.Helper()
+		m := &clientmodel.Metric{}
+		if err := clusterAccessDenied.WithLabelValues(list).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+
+	// a missing file allows all clusters
+	a, err := NewClusterAccess(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	a.nowFn = func() time.Time { return now }
+	if err := a.Allowed("cluster-1"); err != nil {
+		t.Fatalf("expected all clusters to be allowed without a file: %v", err)
+	}
+
+	write(AccessList{Allow: []string{"cluster-1", "cluster-2"}, Deny: []string{"cluster-2"}}, time.Unix(1000, 0))
+	now = now.Add(tokenFileCheckInterval)
+	beforeDeny, beforeAllow := denied("deny"), denied("allow")
+	if err := a.Allowed("cluster-1"); err != nil {
+		t.Fatalf("expected the allowed cluster to be allowed: %v", err)
+	}
+	if err := a.Allowed("cluster-2"); err == nil {
+		t.Fatal("expected the denied cluster to be denied even though it is allowed")
+	}
+	if err := a.Allowed("cluster-3"); err == nil {
+		t.Fatal("expected a cluster missing from the allow list to be denied")
+	}
+	if d, a := denied("deny")-beforeDeny, denied("allow")-beforeAllow; d != 1 || a != 1 {
+		t.Fatalf("expected a denial to be counted per list, got deny=%v allow=%v", d, a)
+	}
+
+	// changes are picked up after the check interval
+	write(AccessList{Deny: []string{"cluster-1"}}, time.Unix(2000, 0))
+	if err := a.Allowed("cluster-3"); err == nil {
+		t.Fatal("expected the file not to be checked again within the interval")
+	}
+	now = now.Add(tokenFileCheckInterval)
+	if err := a.Allowed("cluster-3"); err != nil {
+		t.Fatalf("expected the reloaded lists to allow the cluster: %v", err)
+	}
+	if err := a.Allowed("cluster-1"); err == nil {
+		t.Fatal("expected the reloaded lists to deny the cluster")
+	}
+
+	// an invalid file keeps the previous lists
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(tokenFileCheckInterval)
+	if err := a.Allowed("cluster-1"); err == nil {
+		t.Fatal("expected the previous lists to be kept")
+	}
+
+	// a removed file allows all clusters
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(tokenFileCheckInterval)
+	if err := a.Allowed("cluster-1"); err != nil {
+		t.Fatalf("expected all clusters to be allowed once the file is removed: %v", err)
+	}
+
+	// replaced lists are persisted
+	if err := a.Replace(AccessList{Allow: []string{"cluster-4"}}); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewClusterAccess(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reloaded.List(); len(list.Allow) != 1 || list.Allow[0] != "cluster-4" || len(list.Deny) != 0 {
+		t.Fatalf("unexpected persisted lists %v", list)
+	}
+
+	var served bool
+	h := NewClusterAccessHandler(reloaded, "_id", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { served = true }))
+	for cluster, wantCode := range map[string]int{"cluster-4": http.StatusOK, "cluster-1": http.StatusForbidden} {
+		served = false
+		req := httptest.NewRequest("POST", "/upload", nil)
+		req = req.WithContext(WithClient(req.Context(), &Client{ID: "account", Labels: map[string]string{"_id": cluster}}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != wantCode || served != (wantCode == http.StatusOK) {
+			t.Fatalf("%s: want status %d, got %d", cluster, wantCode, w.Code)
+		}
+		if wantCode == http.StatusForbidden {
+			var body errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Code != CodeClusterDenied {
+				t.Fatalf("%s: expected the %s code, got %s", cluster, CodeClusterDenied, w.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package authorize
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/telemeter/pkg/cache"
+)
+
+var (
+	authorizeCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "telemeter_authorize_cache_hits_total",
+		Help: "Tracks the number of cluster authorizations answered from the cache.",
+	})
+	authorizeCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "telemeter_authorize_cache_misses_total",
+		Help: "Tracks the number of cluster authorizations not found in the cache.",
+	})
+	authorizeCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "telemeter_authorize_cache_evictions_total",
+		Help: "Tracks the number of cached cluster authorizations evicted to make room for others.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(authorizeCacheHits, authorizeCacheMisses, authorizeCacheEvictions)
+}
+
+type cacheEntry struct {
+	subject string
+	labels  map[string]string
+	err     error
+	expires time.Time
+}
+
+type cachingAuthorizer struct {
+	next   ClusterAuthorizer
+	ttl    time.Duration
+	negTTL time.Duration
+	nowFn  func() time.Time
+
+	metrics *Metrics
+	// shared holds the decisions instead of lru if set
+	shared cache.Cache
+
+	mu  sync.Mutex
+	lru *simplelru.LRU
+}
+
+// NewCachingClusterAuthorizer returns a cluster authorizer remembering up to size decisions
+// of next. Authorized clusters are remembered for ttl and denied clusters for negativeTTL,
+// so that a revocation takes effect after at most ttl. Only denials by next are cached, never
+// errors reaching it or rate limits.
+func NewCachingClusterAuthorizer(next ClusterAuthorizer, size int, ttl, negativeTTL time.Duration) (ClusterAuthorizer, error) {
+	var m *Metrics
+	return m.NewCachingClusterAuthorizer(next, size, ttl, negativeTTL)
+}
+
+// NewCachingClusterAuthorizer returns the NewCachingClusterAuthorizer of next that records the
+// number of cached decisions.
+func (m *Metrics) NewCachingClusterAuthorizer(next ClusterAuthorizer, size int, ttl, negativeTTL time.Duration) (ClusterAuthorizer, error) {
+	lru, err := simplelru.NewLRU(size, func(interface{}, interface{}) { m.addCached(-1) })
+	if err != nil {
+		return nil, err
+	}
+	return &cachingAuthorizer{
+		next:    next,
+		ttl:     ttl,
+		negTTL:  negativeTTL,
+		nowFn:   time.Now,
+		metrics: m,
+		lru:     lru,
+	}, nil
+}
+
+// sharedEntry is a decision held by a shared cache.
+type sharedEntry struct {
+	Subject string            `json:"subject,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	Code    int               `json:"code,omitempty"`
+}
+
+// NewSharedCachingClusterAuthorizer returns a cluster authorizer like NewCachingClusterAuthorizer
+// that remembers decisions in shared, so that a decision of one server is used by every server
+// sharing it.
+func NewSharedCachingClusterAuthorizer(next ClusterAuthorizer, shared cache.Cache, ttl, negativeTTL time.Duration) ClusterAuthorizer {
+	return &cachingAuthorizer{
+		next:   next,
+		ttl:    ttl,
+		negTTL: negativeTTL,
+		nowFn:  time.Now,
+		shared: shared,
+	}
+}
+
+func (a *cachingAuthorizer) AuthorizeCluster(token, cluster string) (string, error) {
+	subject, _, err := a.AuthorizeClusterLabels(token, cluster)
+	return subject, err
+}
+
+func (a *cachingAuthorizer) AuthorizeClusterLabels(token, cluster string) (string, map[string]string, error) {
+	// the credential is only held as a hash
+	sum := sha256.Sum256([]byte(token + "\x00" + cluster))
+	key := hex.EncodeToString(sum[:])
+
+	if e, ok := a.get(key); ok {
+		authorizeCacheHits.Inc()
+		return e.subject, e.labels, e.err
+	}
+	authorizeCacheMisses.Inc()
+
+	subject, labels, err := AuthorizeClusterLabels(a.next, token, cluster)
+	switch {
+	case err == nil:
+		a.add(key, cacheEntry{subject: subject, labels: labels}, a.ttl)
+	case isDenial(err):
+		a.add(key, cacheEntry{err: err}, a.negTTL)
+	}
+	return subject, labels, err
+}
+
+// isDenial returns true if err is a decision of the authorizer that may be cached.
+func isDenial(err error) bool {
+	scerr, ok := err.(ErrorWithCode)
+	if !ok {
+		return false
+	}
+	code := scerr.HTTPStatusCode()
+	return code >= http.StatusBadRequest && code < http.StatusInternalServerError && code != http.StatusTooManyRequests
+}
+
+func (a *cachingAuthorizer) get(key string) (cacheEntry, bool) {
+	if a.shared != nil {
+		data, ok, err := a.shared.Get("authorize/" + key)
+		if err != nil || !ok {
+			return cacheEntry{}, false
+		}
+		var e sharedEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return cacheEntry{}, false
+		}
+		if len(e.Error) > 0 {
+			return cacheEntry{err: NewErrorWithCode(errors.New(e.Error), e.Code)}, true
+		}
+		return cacheEntry{subject: e.Subject, labels: e.Labels}, true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	v, ok := a.lru.Get(key)
+	if !ok {
+		return cacheEntry{}, false
+	}
+	e := v.(cacheEntry)
+	if !a.nowFn().Before(e.expires) {
+		a.lru.Remove(key)
+		return cacheEntry{}, false
+	}
+	return e, true
+}
+
+func (a *cachingAuthorizer) add(key string, e cacheEntry, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	if a.shared != nil {
+		shared := sharedEntry{Subject: e.subject, Labels: e.labels}
+		if e.err != nil {
+			shared = sharedEntry{Error: e.err.Error(), Code: e.err.(ErrorWithCode).HTTPStatusCode()}
+		}
+		if data, err := json.Marshal(shared); err == nil {
+			a.shared.Set("authorize/"+key, data, ttl)
+		}
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e.expires = a.nowFn().Add(ttl)
+	if !a.lru.Contains(key) {
+		a.metrics.addCached(1)
+	}
+	if a.lru.Add(key, e) {
+		authorizeCacheEvictions.Inc()
+	}
+}
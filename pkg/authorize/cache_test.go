@@ -0,0 +1,141 @@
+package authorize
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/cache"
+)
+
+type countingAuthorizer struct {
+	calls int
+	// results maps a token to the error it is authorized with
+	results map[string]error
+}
+
+func (a *countingAuthorizer) AuthorizeCluster(token, cluster string) (string, error) {
+	a.calls++
+	if err := a.results[token]; err != nil {
+		return "", err
+	}
+	return "subject-" + token, nil
+}
+
+func TestCachingClusterAuthorizer(t *testing.T) {
+	denied := NewErrorWithCode(errors.New("denied"), http.StatusForbidden)
+	unavailable := NewErrorWithCode(errors.New("unavailable"), http.StatusServiceUnavailable)
+	limited := NewErrorWithCode(errors.New("limited"), http.StatusTooManyRequests)
+
+	type step struct {
+		after     time.Duration
+		token     string
+		results   map[string]error
+		wantErr   error
+		wantCalls int
+	}
+	tests := []struct {
+		name  string
+		size  int
+		steps []step
+	}{
+		{
+			name: "allowed within ttl",
+			size: 10,
+			steps: []step{
+				{token: "a", wantCalls: 1},
+				{after: time.Minute - time.Second, token: "a", wantCalls: 1},
+				{after: time.Second, token: "a", wantCalls: 2},
+			},
+		},
+		{
+			name: "revocation effective once expired",
+			size: 10,
+			steps: []step{
+				{token: "a", wantCalls: 1},
+				{after: 30 * time.Second, token: "a", results: map[string]error{"a": denied}, wantCalls: 1},
+				{after: 30 * time.Second, token: "a", wantErr: denied, wantCalls: 2},
+				{after: 5 * time.Second, token: "a", results: map[string]error{}, wantErr: denied, wantCalls: 2},
+				{after: 5 * time.Second, token: "a", wantCalls: 3},
+			},
+		},
+		{
+			name: "errors are not cached",
+			size: 10,
+			steps: []step{
+				{token: "a", results: map[string]error{"a": unavailable, "b": limited, "c": errors.New("connection refused")}, wantErr: unavailable, wantCalls: 1},
+				{token: "a", wantErr: unavailable, wantCalls: 2},
+				{token: "b", wantErr: limited, wantCalls: 3},
+				{token: "b", wantErr: limited, wantCalls: 4},
+				{token: "c", wantErr: errors.New("connection refused"), wantCalls: 5},
+				{token: "c", wantErr: errors.New("connection refused"), wantCalls: 6},
+			},
+		},
+		{
+			name: "least recently used is evicted",
+			size: 2,
+			steps: []step{
+				{token: "a", wantCalls: 1},
+				{token: "b", wantCalls: 2},
+				{token: "a", wantCalls: 2},
+				{token: "c", wantCalls: 3},
+				{token: "a", wantCalls: 3},
+				{token: "b", wantCalls: 4},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &countingAuthorizer{}
+			ca, err := NewCachingClusterAuthorizer(next, tt.size, time.Minute, 10*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Unix(0, 0)
+			ca.(*cachingAuthorizer).nowFn = func() time.Time { return now }
+
+			for i, s := range tt.steps {
+				now = now.Add(s.after)
+				if s.results != nil {
+					next.results = s.results
+				}
+				subject, err := ca.AuthorizeCluster(s.token, "cluster")
+				if (err == nil) != (s.wantErr == nil) || (err != nil && err.Error() != s.wantErr.Error()) {
+					t.Fatalf("step %d: want error %v, got %v", i, s.wantErr, err)
+				}
+				if err == nil && subject != "subject-"+s.token {
+					t.Fatalf("step %d: unexpected subject %q", i, subject)
+				}
+				if next.calls != s.wantCalls {
+					t.Fatalf("step %d: want %d calls, got %d", i, s.wantCalls, next.calls)
+				}
+			}
+		})
+	}
+}
+
+func TestSharedCachingClusterAuthorizer(t *testing.T) {
+	shared, err := cache.NewMemory(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := &countingAuthorizer{results: map[string]error{"denied": NewErrorWithCode(errors.New("denied"), http.StatusForbidden)}}
+	// two servers sharing a cache
+	a := NewSharedCachingClusterAuthorizer(next, shared, time.Minute, time.Minute)
+	b := NewSharedCachingClusterAuthorizer(next, shared, time.Minute, time.Minute)
+
+	for _, ca := range []ClusterAuthorizer{a, b} {
+		subject, labels, err := AuthorizeClusterLabels(ca, "valid", "cluster-1")
+		if err != nil || subject != "subject-valid" || labels != nil {
+			t.Fatalf("want subject-valid, got %q %v %v", subject, labels, err)
+		}
+		_, err = ca.AuthorizeCluster("denied", "cluster-1")
+		if scerr, ok := err.(ErrorWithCode); !ok || scerr.HTTPStatusCode() != http.StatusForbidden || err.Error() != "denied" {
+			t.Fatalf("want cached denial, got %v", err)
+		}
+	}
+	if next.calls != 2 {
+		t.Fatalf("want decisions of one server to be used by the other, got %d calls", next.calls)
+	}
+}
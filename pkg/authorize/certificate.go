@@ -0,0 +1,105 @@
+package authorize
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// WithCertificate returns a context carrying the verified client certificate of a request.
+func WithCertificate(ctx context.Context, cert *x509.Certificate) context.Context {
+	return context.WithValue(ctx, certificateKey, cert)
+}
+
+// CertificateFromContext returns the verified client certificate of a request, if any.
+// Its subject common name and SANs identify the client.
+func CertificateFromContext(ctx context.Context) (*x509.Certificate, bool) {
+	cert, ok := ctx.Value(certificateKey).(*x509.Certificate)
+	return cert, ok
+}
+
+// NewCertificateHandler exposes the verified client certificate of TLS requests
+// to next via the request context.
+func NewCertificateHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+			req = req.WithContext(WithCertificate(req.Context(), req.TLS.VerifiedChains[0][0]))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// CertificateMapper derives the client of a verified certificate. The client ID is the first
+// URI SAN of the certificate, or its subject common name if it has none.
+type CertificateMapper struct {
+	// ExtensionLabels maps the dotted OIDs of certificate extensions to the labels their
+	// string values are added as.
+	ExtensionLabels map[string]string
+	// Labels maps client IDs to labels added to the client. They take precedence over labels
+	// from extensions.
+	Labels map[string]map[string]string
+}
+
+// Client returns the client identified by cert.
+func (m *CertificateMapper) Client(cert *x509.Certificate) (*Client, error) {
+	var id string
+	if len(cert.URIs) > 0 {
+		id = cert.URIs[0].String()
+	} else {
+		id = cert.Subject.CommonName
+	}
+	if len(id) == 0 {
+		return nil, fmt.Errorf("certificate has neither a URI SAN nor a common name")
+	}
+
+	client := &Client{ID: id, Labels: make(map[string]string)}
+	for _, ext := range cert.Extensions {
+		label, ok := m.ExtensionLabels[ext.Id.String()]
+		if !ok {
+			continue
+		}
+		var value string
+		if _, err := asn1.Unmarshal(ext.Value, &value); err != nil {
+			return nil, fmt.Errorf("certificate extension %s is not a string: %v", ext.Id, err)
+		}
+		client.Labels[label] = value
+	}
+	for k, v := range m.Labels[id] {
+		client.Labels[k] = v
+	}
+	return client, nil
+}
+
+// ParseClientLabels reads lines of the form "id,label=value,..." into a map of client ID to
+// labels. Empty lines and lines starting with '#' are ignored.
+func ParseClientLabels(r io.Reader) (map[string]map[string]string, error) {
+	clients := make(map[string]map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields[0]) == 0 {
+			return nil, fmt.Errorf("line %d: must be of the form id[,label=value...]", line)
+		}
+		if _, ok := clients[fields[0]]; ok {
+			return nil, fmt.Errorf("line %d: duplicate client", line)
+		}
+		labels, err := parseLabels(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		clients[fields[0]] = labels
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
@@ -0,0 +1,178 @@
+package authorize
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testLabelOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+
+// testCA issues client certificates for tests.
+type testCA struct {
+	t    *testing.T
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{t: t, key: key, cert: cert}
+}
+
+// issue returns a certificate for cn with the given URI SANs, carrying ext as the value of
+// the testLabelOID extension if it is not nil.
+func (ca *testCA) issue(cn string, uris []string, ext interface{}) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, s := range uris {
+		u, err := url.Parse(s)
+		if err != nil {
+			ca.t.Fatal(err)
+		}
+		tmpl.URIs = append(tmpl.URIs, u)
+	}
+	if ext != nil {
+		params := ""
+		if _, ok := ext.(string); ok {
+			params = "utf8"
+		}
+		data, err := asn1.MarshalWithParams(ext, params)
+		if err != nil {
+			ca.t.Fatal(err)
+		}
+		tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, pkix.Extension{Id: testLabelOID, Value: data})
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: ca.pool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		ca.t.Fatal(err)
+	}
+	return cert
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func TestCertificateMapper(t *testing.T) {
+	ca := newTestCA(t)
+	m := &CertificateMapper{
+		ExtensionLabels: map[string]string{testLabelOID.String(): "account"},
+		Labels: map[string]map[string]string{
+			"spiffe://telemeter/cluster-1": {"env": "prod"},
+			"cluster-2":                    {"env": "dev", "account": "static"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		cert    *x509.Certificate
+		want    *Client
+		wantErr bool
+	}{
+		{
+			name: "uri san",
+			cert: ca.issue("ignored", []string{"spiffe://telemeter/cluster-1", "spiffe://telemeter/other"}, "acme"),
+			want: &Client{ID: "spiffe://telemeter/cluster-1", Labels: map[string]string{"account": "acme", "env": "prod"}},
+		},
+		{
+			name: "common name",
+			cert: ca.issue("cluster-2", nil, nil),
+			want: &Client{ID: "cluster-2", Labels: map[string]string{"env": "dev", "account": "static"}},
+		},
+		{
+			name: "static labels override extensions",
+			cert: ca.issue("cluster-2", nil, "acme"),
+			want: &Client{ID: "cluster-2", Labels: map[string]string{"env": "dev", "account": "static"}},
+		},
+		{
+			name: "unmapped client",
+			cert: ca.issue("cluster-3", nil, nil),
+			want: &Client{ID: "cluster-3", Labels: map[string]string{}},
+		},
+		{
+			name:    "no identity",
+			cert:    ca.issue("", nil, nil),
+			wantErr: true,
+		},
+		{
+			name:    "extension is not a string",
+			cert:    ca.issue("cluster-3", nil, 42),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.Client(tt.cert)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("want error %t, got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("want %#v, got %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseClientLabels(t *testing.T) {
+	got, err := ParseClientLabels(strings.NewReader("# clusters\ncluster-1,env=prod\n\ncluster-2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]string{"cluster-1": {"env": "prod"}, "cluster-2": {}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for _, in := range []string{",env=prod\n", "cluster-1,env\n", "cluster-1\ncluster-1\n"} {
+		if _, err := ParseClientLabels(strings.NewReader(in)); err == nil {
+			t.Errorf("expected %q to be rejected", in)
+		}
+	}
+}
@@ -2,15 +2,53 @@ package authorize
 
 import (
 	"context"
+	"strings"
+	"time"
 )
 
 type ClientAuthorizer interface {
 	AuthorizeClient(token string) (*Client, bool, error)
 }
 
+// ClientAuthorizers authorizes a token with the first of its authorizers accepting it.
+// If none does, the first error is returned.
+type ClientAuthorizers []ClientAuthorizer
+
+func (as ClientAuthorizers) AuthorizeClient(token string) (*Client, bool, error) {
+	var firstErr error
+	for _, a := range as {
+		client, ok, err := a.AuthorizeClient(token)
+		if ok {
+			return client, true, nil
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, false, firstErr
+}
+
 type Client struct {
 	ID     string
 	Labels map[string]string
+	// Scopes lists the operations the client was granted, if its token carried any.
+	Scopes []string
+	// TokenID identifies the token the client was authorized with, if it carried an ID.
+	TokenID string
+	// Claims holds the claims of the token the client was authorized with that are strings,
+	// numbers or booleans, if it was a JWT.
+	Claims map[string]string
+	// Limits overrides the upload limits of the server for the client, if its token carried any.
+	Limits Limits
+}
+
+// Limits are the upload allowances of a client. Zero values defer to the limits configured
+// on the server.
+type Limits struct {
+	// UploadInterval is the minimum interval between two uploads of the client.
+	UploadInterval time.Duration
+	// MaxSamplesPerUpload bounds the samples of a single upload.
+	MaxSamplesPerUpload int
 }
 
 func WithClient(ctx context.Context, client *Client) context.Context {
@@ -21,3 +59,35 @@ func FromContext(ctx context.Context) (*Client, bool) {
 	client, ok := ctx.Value(clientKey).(*Client)
 	return client, ok
 }
+
+// SanitizeLabels returns labels whose names are valid Prometheus label names, so that labels
+// supplied by authorization services may be attached to series. Invalid characters are
+// replaced with underscores, and names starting with a digit are prefixed with one. Labels
+// with reserved names, starting with "__", or with empty values are dropped.
+func SanitizeLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	sanitized := make(map[string]string, len(labels))
+	for name, value := range labels {
+		name = sanitizeLabelName(name)
+		if len(name) == 0 || len(value) == 0 || strings.HasPrefix(name, "__") {
+			continue
+		}
+		sanitized[name] = value
+	}
+	return sanitized
+}
+
+func sanitizeLabelName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
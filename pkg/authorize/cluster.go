@@ -9,3 +9,19 @@ func (f ClusterAuthorizerFunc) AuthorizeCluster(token, cluster string) (subject
 type ClusterAuthorizer interface {
 	AuthorizeCluster(token, cluster string) (subject string, err error)
 }
+
+// ClusterLabeler is implemented by cluster authorizers that return labels to attach to
+// the clients they authorize.
+type ClusterLabeler interface {
+	AuthorizeClusterLabels(token, cluster string) (subject string, labels map[string]string, err error)
+}
+
+// AuthorizeClusterLabels authorizes the cluster with a and returns the labels of the client.
+// If a does not implement ClusterLabeler, no labels are returned.
+func AuthorizeClusterLabels(a ClusterAuthorizer, token, cluster string) (string, map[string]string, error) {
+	if l, ok := a.(ClusterLabeler); ok {
+		return l.AuthorizeClusterLabels(token, cluster)
+	}
+	subject, err := a.AuthorizeCluster(token, cluster)
+	return subject, nil, err
+}
@@ -5,4 +5,6 @@ type key int
 const (
 	clientKey key = iota
 	TenantKey
+	certificateKey
+	readPartitionKey
 )
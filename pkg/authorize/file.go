@@ -0,0 +1,109 @@
+package authorize
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tokenFileCheckInterval limits how often a token file is checked for changes.
+const tokenFileCheckInterval = 10 * time.Second
+
+var tokenFileReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "telemeter_token_file_reloads_total",
+	Help: "Tracks the number of times a static token file was reloaded, by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(tokenFileReloads)
+}
+
+// FileAuthorizer authorizes the tokens of a file of "token,id,label=value,..." lines,
+// picking up changes to the file.
+type FileAuthorizer struct {
+	path  string
+	nowFn func() time.Time
+
+	// authorizer holds the ClientAuthorizer of the last loaded file
+	authorizer atomic.Value
+
+	mu      sync.Mutex
+	modTime time.Time
+	checked time.Time
+}
+
+// NewFileAuthorizer loads the tokens of the given file. Invalid lines are logged and skipped.
+func NewFileAuthorizer(path string) (*FileAuthorizer, error) {
+	a := &FileAuthorizer{path: path, nowFn: time.Now}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the tokens from disk. If the file cannot be read, the previous tokens
+// continue to be authorized.
+func (a *FileAuthorizer) Reload() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reload()
+}
+
+func (a *FileAuthorizer) reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		tokenFileReloads.WithLabelValues("failure").Inc()
+		return fmt.Errorf("unable to read token file: %v", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		tokenFileReloads.WithLabelValues("failure").Inc()
+		return fmt.Errorf("unable to read token file: %v", err)
+	}
+	clients, lineErrs, err := parseStaticTokens(f)
+	if err != nil {
+		tokenFileReloads.WithLabelValues("failure").Inc()
+		return fmt.Errorf("unable to read token file: %v", err)
+	}
+	for _, err := range lineErrs {
+		log.Printf("warning: skipping invalid entry of token file %s: %v", a.path, err)
+	}
+	a.authorizer.Store(NewStaticAuthorizer(clients))
+	a.modTime = fi.ModTime()
+	tokenFileReloads.WithLabelValues("success").Inc()
+	return nil
+}
+
+// check reloads the file if it changed, at most every tokenFileCheckInterval.
+func (a *FileAuthorizer) check() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.nowFn()
+	if now.Sub(a.checked) < tokenFileCheckInterval {
+		return
+	}
+	a.checked = now
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		log.Printf("error: unable to check token file, continuing with the previous tokens: %v", err)
+		return
+	}
+	if fi.ModTime().Equal(a.modTime) {
+		return
+	}
+	if err := a.reload(); err != nil {
+		log.Printf("error: unable to reload token file, continuing with the previous tokens: %v", err)
+	}
+}
+
+func (a *FileAuthorizer) AuthorizeClient(token string) (*Client, bool, error) {
+	a.check()
+	return a.authorizer.Load().(ClientAuthorizer).AuthorizeClient(token)
+}
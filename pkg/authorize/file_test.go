@@ -0,0 +1,98 @@
+package authorize
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileAuthorizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens")
+
+	modTime := time.Unix(1000, 0)
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// make every write visible regardless of the file system timestamp resolution
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewFileAuthorizer(path); err == nil {
+		t.Fatal("expected a missing file to be rejected")
+	}
+
+	write("secret-1,cluster-1,team=a\ninvalid\n")
+	a, err := NewFileAuthorizer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(0, 0)
+	a.nowFn = func() time.Time { return now }
+
+	authorized := func(token, wantID string) {
+		t.Helper()
+		client, ok, err := a.AuthorizeClient(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(wantID) == 0 {
+			if ok {
+				t.Fatalf("expected token %s to be rejected, got client %s", token, client.ID)
+			}
+			return
+		}
+		if !ok || client.ID != wantID {
+			t.Fatalf("expected token %s to authorize %s, got %v", token, wantID, client)
+		}
+	}
+
+	// invalid lines are skipped
+	authorized("secret-1", "cluster-1")
+	authorized("invalid", "")
+
+	// changes are picked up once the check interval passed
+	write("secret-2,cluster-2\n")
+	authorized("secret-1", "cluster-1")
+	now = now.Add(tokenFileCheckInterval)
+	authorized("secret-1", "")
+	authorized("secret-2", "cluster-2")
+
+	// the previous tokens are kept if the file cannot be read
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(tokenFileCheckInterval)
+	authorized("secret-2", "cluster-2")
+
+	write("secret-1,cluster-1\nsecret-2,cluster-2\n")
+	now = now.Add(tokenFileCheckInterval)
+	authorized("secret-1", "cluster-1")
+	authorized("secret-2", "cluster-2")
+}
+
+func TestClientAuthorizers(t *testing.T) {
+	as := ClientAuthorizers{
+		NewStaticAuthorizer(map[string]*Client{"a": {ID: "first"}}),
+		NewStaticAuthorizer(map[string]*Client{"a": {ID: "second"}, "b": {ID: "second"}}),
+	}
+	for token, want := range map[string]string{"a": "first", "b": "second", "c": ""} {
+		client, ok, err := as.AuthorizeClient(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (len(want) > 0) || (ok && client.ID != want) {
+			t.Errorf("token %s: want client %q, got %v", token, want, client)
+		}
+	}
+}
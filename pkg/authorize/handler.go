@@ -1,6 +1,7 @@
 package authorize
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -12,32 +13,6 @@ import (
 	"strings"
 )
 
-func NewAuthorizeClientHandler(authorizer ClientAuthorizer, next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		auth := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
-		if strings.ToLower(auth[0]) != "bearer" {
-			http.Error(w, "Only bearer authorization allowed", http.StatusUnauthorized)
-			return
-		}
-		if len(auth) != 2 || len(strings.TrimSpace(auth[1])) == 0 {
-			http.Error(w, "Invalid Authorization header", http.StatusUnauthorized)
-			return
-		}
-
-		client, ok, err := authorizer.AuthorizeClient(auth[1])
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Not authorized: %v", err), http.StatusUnauthorized)
-			return
-		}
-		if !ok {
-			http.Error(w, "Not authorized", http.StatusUnauthorized)
-			return
-		}
-
-		next.ServeHTTP(w, req.WithContext(WithClient(req.Context(), client)))
-	})
-}
-
 type errorWithCode struct {
 	error
 	code int
@@ -97,6 +72,8 @@ func AgainstEndpoint(client *http.Client, endpoint *url.URL, buf io.Reader, clus
 	switch res.StatusCode {
 	case http.StatusUnauthorized:
 		return body, NewErrorWithCode(fmt.Errorf("unauthorized"), http.StatusUnauthorized)
+	case http.StatusForbidden:
+		return body, NewErrorWithCode(fmt.Errorf("forbidden"), http.StatusForbidden)
 	case http.StatusTooManyRequests:
 		return body, NewErrorWithCode(fmt.Errorf("rate limited, please try again later"), http.StatusTooManyRequests)
 	case http.StatusConflict:
@@ -134,12 +111,26 @@ func NewHandler(client *http.Client, endpoint *url.URL, tenantKey string, next h
 			}
 			tenant = token[tenantKey]
 		}
-		if _, err := AgainstEndpoint(client, endpoint, strings.NewReader(authParts[1]), tenant, nil); err != nil {
+		body, err := AgainstEndpoint(client, endpoint, strings.NewReader(authParts[1]), tenant, nil)
+		if err != nil {
 			log.Printf("unauthorized request made: %v", err)
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), TenantKey, tenant)))
+		// the labels of the account, if the endpoint returned any, are attached to the series
+		var response struct {
+			Labels map[string]string `json:"labels"`
+		}
+		if len(bytes.TrimSpace(body)) > 0 {
+			if err := json.Unmarshal(body, &response); err != nil {
+				log.Printf("unable to read the labels of tenant %q from the authorization response: %v", tenant, err)
+				http.Error(w, "invalid authorization response", http.StatusBadGateway)
+				return
+			}
+		}
+		ctx := context.WithValue(r.Context(), TenantKey, tenant)
+		ctx = WithClient(ctx, &Client{ID: tenant, Labels: SanitizeLabels(response.Labels)})
+		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
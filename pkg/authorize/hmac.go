@@ -0,0 +1,210 @@
+package authorize
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Headers of requests signed with a shared secret.
+const (
+	// SignatureHeader carries the signature of a request as "t=<unix seconds>,v1=<hex>", where
+	// v1 is the HMAC-SHA256 of the timestamp, a dot and the request body.
+	SignatureHeader = "X-Telemeter-Signature"
+	// KeyIDHeader identifies the secret a request is signed with.
+	KeyIDHeader = "X-Telemeter-Key-Id"
+)
+
+var hmacRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "telemeter_hmac_rejected_total",
+	Help: "Tracks the number of signed requests rejected, by reason.",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(hmacRejected)
+}
+
+// Signature is the signature of a request and the body it was computed over.
+type Signature struct {
+	KeyID     string
+	Timestamp int64
+	MAC       []byte
+	Body      []byte
+}
+
+// Sign returns the SignatureHeader value of body signed with secret at time t.
+func Sign(secret []byte, t time.Time, body []byte) string {
+	return fmt.Sprintf("t=%d,v1=%s", t.Unix(), hex.EncodeToString(signatureMAC(secret, t.Unix(), body)))
+}
+
+func signatureMAC(secret []byte, timestamp int64, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// parseSignature parses a SignatureHeader value.
+func parseSignature(header string) (int64, []byte, error) {
+	var timestamp int64
+	var mac []byte
+	for _, field := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return 0, nil, fmt.Errorf("signature must be of the form t=<unix>,v1=<hex>")
+		}
+		var err error
+		switch kv[0] {
+		case "t":
+			if timestamp, err = strconv.ParseInt(kv[1], 10, 64); err != nil {
+				return 0, nil, fmt.Errorf("invalid signature timestamp: %v", err)
+			}
+		case "v1":
+			if mac, err = hex.DecodeString(kv[1]); err != nil {
+				return 0, nil, fmt.Errorf("invalid signature: %v", err)
+			}
+		}
+	}
+	if timestamp == 0 || len(mac) == 0 {
+		return 0, nil, fmt.Errorf("signature must be of the form t=<unix>,v1=<hex>")
+	}
+	return timestamp, mac, nil
+}
+
+// HMACSignature extracts the signature of requests signed with a shared secret. The body is
+// read to verify the signature and replaced for the handlers that follow. Bodies larger than
+// maxBodyBytes are rejected.
+func HMACSignature(maxBodyBytes int64) Extractor {
+	return func(req *http.Request, creds *Credentials) (bool, error) {
+		header := req.Header.Get(SignatureHeader)
+		if len(header) == 0 {
+			return false, nil
+		}
+		keyID := req.Header.Get(KeyIDHeader)
+		if len(keyID) == 0 {
+			return false, fmt.Errorf("signed requests must identify their key with the %s header", KeyIDHeader)
+		}
+		timestamp, mac, err := parseSignature(header)
+		if err != nil {
+			return false, err
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodyBytes+1))
+		if err != nil {
+			return false, fmt.Errorf("unable to read signed body: %v", err)
+		}
+		if int64(len(body)) > maxBodyBytes {
+			return false, NewErrorWithCode(fmt.Errorf("signed body exceeds %d bytes", maxBodyBytes), http.StatusRequestEntityTooLarge)
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		creds.Signature = &Signature{KeyID: keyID, Timestamp: timestamp, MAC: mac, Body: body}
+		return true, nil
+	}
+}
+
+// HMACKey is the shared secret of a client.
+type HMACKey struct {
+	Secret []byte
+	Client *Client
+}
+
+// ParseHMACKeys reads lines of the form "key-id,secret,id,label=value,..." into a map of
+// key ID to the secret and client it identifies. Fields of the form "scope=value" grant the
+// client a scope. Empty lines and lines starting with '#' are ignored.
+func ParseHMACKeys(r io.Reader) (map[string]*HMACKey, error) {
+	keys := make(map[string]*HMACKey)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) < 3 || len(fields[0]) == 0 || len(fields[1]) == 0 || len(fields[2]) == 0 {
+			return nil, fmt.Errorf("line %d: must be of the form key-id,secret,id[,label=value...]", line)
+		}
+		if _, ok := keys[fields[0]]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key ID", line)
+		}
+		labels, scopes, err := parseClientFields(fields[3:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		keys[fields[0]] = &HMACKey{Secret: []byte(fields[1]), Client: &Client{ID: fields[2], Labels: labels, Scopes: scopes}}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// HMACAuthorizer authorizes requests signed with the shared secret of a client.
+type HMACAuthorizer struct {
+	keys   map[string]*HMACKey
+	window time.Duration
+	nowFn  func() time.Time
+
+	mu sync.Mutex
+	// seen holds the signatures accepted within the window, to reject replays
+	seen *simplelru.LRU
+}
+
+// NewHMACAuthorizer returns an authorizer of requests signed with the secrets of keys. Requests
+// signed more than window before or after the current time are rejected, as are the accepted
+// signatures when presented again. Up to size accepted signatures are remembered, so size must
+// exceed the number of signed requests expected within twice the window.
+func NewHMACAuthorizer(keys map[string]*HMACKey, window time.Duration, size int) (*HMACAuthorizer, error) {
+	seen, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &HMACAuthorizer{keys: keys, window: window, nowFn: time.Now, seen: seen}, nil
+}
+
+func (a *HMACAuthorizer) Authorize(creds Credentials) (*Client, bool, error) {
+	sig := creds.Signature
+	if sig == nil {
+		return nil, false, nil
+	}
+	key, ok := a.keys[sig.KeyID]
+	if !ok {
+		hmacRejected.WithLabelValues("unknown_key").Inc()
+		return nil, false, errors.New("unknown signing key")
+	}
+	if !hmac.Equal(sig.MAC, signatureMAC(key.Secret, sig.Timestamp, sig.Body)) {
+		hmacRejected.WithLabelValues("invalid").Inc()
+		return nil, false, errors.New("invalid signature")
+	}
+
+	now := a.nowFn()
+	signed := time.Unix(sig.Timestamp, 0)
+	if signed.Before(now.Add(-a.window)) || signed.After(now.Add(a.window)) {
+		hmacRejected.WithLabelValues("stale").Inc()
+		return nil, false, fmt.Errorf("signature timestamp is outside of the %s window", a.window)
+	}
+
+	seenKey := sig.KeyID + ":" + hex.EncodeToString(sig.MAC)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if v, ok := a.seen.Get(seenKey); ok && now.Before(v.(time.Time)) {
+		hmacRejected.WithLabelValues("replayed").Inc()
+		return nil, false, errors.New("signature was already used")
+	}
+	// the signature cannot be replayed once its timestamp leaves the window
+	a.seen.Add(seenKey, signed.Add(a.window))
+	return key.Client, true, nil
+}
@@ -0,0 +1,87 @@
+package authorize
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACAuthorizer(t *testing.T) {
+	keys, err := ParseHMACKeys(strings.NewReader("# agents\nkey-1,secret-1,cluster-1,cluster=cluster-1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewHMACAuthorizer(keys, 5*time.Minute, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(100000, 0)
+	a.nowFn = func() time.Time { return now }
+
+	var body string
+	handler := Middleware(a, HMACSignature(1024))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		client, _ := FromContext(req.Context())
+		data, _ := ioutil.ReadAll(req.Body)
+		body = client.ID + ":" + string(data)
+	}))
+	signed := func(keyID, signature, body string) *http.Request {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader(body))
+		req.Header.Set(KeyIDHeader, keyID)
+		req.Header.Set(SignatureHeader, signature)
+		return req
+	}
+	reused := Sign([]byte("secret-1"), now.Add(-time.Minute), []byte("reused"))
+
+	tests := []struct {
+		name     string
+		req      *http.Request
+		wantCode int
+		want     string
+	}{
+		{name: "valid", req: signed("key-1", Sign([]byte("secret-1"), now, []byte("metrics")), "metrics"), wantCode: http.StatusOK, want: "cluster-1:metrics"},
+		{name: "within window", req: signed("key-1", Sign([]byte("secret-1"), now.Add(-4*time.Minute), []byte("metrics")), "metrics"), wantCode: http.StatusOK, want: "cluster-1:metrics"},
+		{name: "first use", req: signed("key-1", reused, "reused"), wantCode: http.StatusOK, want: "cluster-1:reused"},
+		{name: "reused signature", req: signed("key-1", reused, "reused"), wantCode: http.StatusUnauthorized},
+		{name: "stale timestamp", req: signed("key-1", Sign([]byte("secret-1"), now.Add(-6*time.Minute), []byte("metrics")), "metrics"), wantCode: http.StatusUnauthorized},
+		{name: "future timestamp", req: signed("key-1", Sign([]byte("secret-1"), now.Add(6*time.Minute), []byte("metrics")), "metrics"), wantCode: http.StatusUnauthorized},
+		{name: "wrong secret", req: signed("key-1", Sign([]byte("secret-2"), now, []byte("metrics")), "metrics"), wantCode: http.StatusUnauthorized},
+		{name: "modified body", req: signed("key-1", Sign([]byte("secret-1"), now, []byte("metrics")), "other"), wantCode: http.StatusUnauthorized},
+		{name: "unknown key", req: signed("key-2", Sign([]byte("secret-1"), now, []byte("metrics")), "metrics"), wantCode: http.StatusUnauthorized},
+		{name: "missing key id", req: signed("", Sign([]byte("secret-1"), now, []byte("metrics")), "metrics"), wantCode: http.StatusUnauthorized},
+		{name: "malformed signature", req: signed("key-1", "v1=abc", "metrics"), wantCode: http.StatusUnauthorized},
+		{name: "too large", req: signed("key-1", Sign([]byte("secret-1"), now, []byte(strings.Repeat("a", 1025))), strings.Repeat("a", 1025)), wantCode: http.StatusRequestEntityTooLarge},
+		{name: "unsigned", req: httptest.NewRequest("POST", "/upload", strings.NewReader("metrics")), wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body = ""
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, tt.req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("want status %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if body != tt.want {
+				t.Fatalf("want body %q, got %q", tt.want, body)
+			}
+		})
+	}
+
+	// once a signature is forgotten after the window, its stale timestamp still rejects it
+	now = now.Add(10 * time.Minute)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, signed("key-1", reused, "reused"))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the stale signature to be rejected, got %d", w.Code)
+	}
+}
+
+func TestParseHMACKeys(t *testing.T) {
+	for _, in := range []string{"key-1,secret-1\n", "key-1,,cluster-1\n", "key-1,secret-1,cluster-1,label\n", "key-1,s,c\nkey-1,s,c\n"} {
+		if _, err := ParseHMACKeys(strings.NewReader(in)); err == nil {
+			t.Errorf("expected %q to be rejected", in)
+		}
+	}
+}
@@ -1,22 +1,73 @@
 package jwt
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
 	"time"
 
 	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/openshift/telemeter/pkg/authorize"
 )
 
 type telemeter struct {
 	Labels map[string]string `json:"labels,omitempty"`
+	Scopes []string          `json:"scopes,omitempty"`
+	limitClaims
+}
+
+// limitClaims are the upload limits of a client, as carried by its token.
+type limitClaims struct {
+	MaxUploadIntervalSeconds int64 `json:"max_upload_interval_seconds,omitempty"`
+	MaxSamplesPerUpload      int   `json:"max_samples_per_upload,omitempty"`
+}
+
+func newLimitClaims(limits authorize.Limits) limitClaims {
+	return limitClaims{
+		MaxUploadIntervalSeconds: int64(limits.UploadInterval / time.Second),
+		MaxSamplesPerUpload:      limits.MaxSamplesPerUpload,
+	}
+}
+
+func (c limitClaims) limits() authorize.Limits {
+	return authorize.Limits{
+		UploadInterval:      time.Duration(c.MaxUploadIntervalSeconds) * time.Second,
+		MaxSamplesPerUpload: c.MaxSamplesPerUpload,
+	}
+}
+
+// ParseLimits reads a JSON object mapping the subjects tokens are issued to onto their upload
+// limits, given as the max_upload_interval_seconds and max_samples_per_upload claims.
+func ParseLimits(r io.Reader) (map[string]authorize.Limits, error) {
+	var claims map[string]limitClaims
+	if err := json.NewDecoder(r).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("unable to parse client limits: %v", err)
+	}
+	limits := make(map[string]authorize.Limits, len(claims))
+	for subject, c := range claims {
+		if c.MaxUploadIntervalSeconds < 0 || c.MaxSamplesPerUpload < 0 {
+			return nil, fmt.Errorf("limits of %s may not be negative", subject)
+		}
+		limits[subject] = c.limits()
+	}
+	return limits, nil
 }
 
 type privateClaims struct {
 	Telemeter telemeter `json:"telemeter.openshift.io,omitempty"`
 }
 
-func Claims(subject string, labels map[string]string, expirationSeconds int64, audience []string) (*jwt.Claims, interface{}) {
+// Claims returns the public and private claims of a token identifying the client subject.
+// The scopes are opaque to the token and interpreted by the handlers that authorize the client.
+// Limits that are not zero are carried as claims and override the limits of the server.
+// Every token gets a random ID, so that it can be revoked individually.
+func Claims(subject string, labels map[string]string, scopes []string, limits authorize.Limits, expirationSeconds int64, audience []string) (*jwt.Claims, interface{}) {
 	now := now()
 	sc := &jwt.Claims{
+		ID:        newTokenID(),
 		Subject:   subject,
 		Audience:  jwt.Audience(audience),
 		IssuedAt:  jwt.NewNumericDate(now),
@@ -25,8 +76,18 @@ func Claims(subject string, labels map[string]string, expirationSeconds int64, a
 	}
 	pc := &privateClaims{
 		Telemeter: telemeter{
-			Labels: labels,
+			Labels:      labels,
+			Scopes:      scopes,
+			limitClaims: newLimitClaims(limits),
 		},
 	}
 	return sc, pc
 }
+
+func newTokenID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
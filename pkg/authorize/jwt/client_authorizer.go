@@ -4,6 +4,7 @@ import (
 	"crypto"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"strings"
 
 	"github.com/openshift/telemeter/pkg/authorize"
@@ -16,55 +17,100 @@ import (
 func NewClientAuthorizer(issuer string, keys []crypto.PublicKey, v Validator) *clientAuthorizer {
 	return &clientAuthorizer{
 		iss:       issuer,
-		keys:      keys,
+		keys:      func(string) []crypto.PublicKey { return keys },
+		validator: v,
+	}
+}
+
+// NewKeyringClientAuthorizer returns an authorizer of the tokens signed by the keys of the
+// keyring, selected by the "kid" header of a token, or by any of the additional keys.
+func NewKeyringClientAuthorizer(issuer string, keyring *Keyring, additional []crypto.PublicKey, v Validator) *clientAuthorizer {
+	return &clientAuthorizer{
+		iss: issuer,
+		keys: func(id string) []crypto.PublicKey {
+			return append(keyring.PublicKeys(id), additional...)
+		},
 		validator: v,
 	}
 }
 
 type clientAuthorizer struct {
-	iss       string
-	keys      []crypto.PublicKey
+	iss string
+	// keys returns the keys a token with the key ID may be verified with
+	keys      func(id string) []crypto.PublicKey
 	validator Validator
 }
 
 func (j *clientAuthorizer) AuthorizeClient(tokenData string) (*authorize.Client, bool, error) {
+	public, private, ok, err := j.verify(tokenData)
+	if !ok {
+		return nil, false, err
+	}
+
+	// If we get here, we have a token with a recognized signature and
+	// issuer string.
+	client, err := j.validator.Validate(tokenData, public, private)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return client, true, nil
+}
+
+// verify returns the claims of a token issued by this authorizer and signed by one of its keys.
+// The claims are not validated. Tokens of other issuers are ignored without an error.
+func (j *clientAuthorizer) verify(tokenData string) (*jwt.Claims, interface{}, bool, error) {
 	if !j.hasCorrectIssuer(tokenData) {
-		return nil, false, nil
+		return nil, nil, false, nil
+	}
+	public, private, _, err := j.verifyKey(tokenData)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if public == nil {
+		return nil, nil, false, nil
 	}
+	return public, private, true, nil
+}
+
+// verifyKey returns the claims of a token signed by one of the keys of this authorizer, and
+// the key it was signed with. The issuer and claims are not validated. If the token cannot be
+// parsed, no claims and no error are returned.
+func (j *clientAuthorizer) verifyKey(tokenData string) (*jwt.Claims, interface{}, crypto.PublicKey, error) {
 
 	tok, err := jwt.ParseSigned(tokenData)
 	if err != nil {
-		return nil, false, nil
+		return nil, nil, nil, nil
 	}
 
 	public := &jwt.Claims{}
 	private := j.validator.NewPrivateClaims()
 
 	var (
-		found bool
+		found crypto.PublicKey
 		errs  []error
 	)
-	for _, key := range j.keys {
+	var keyID string
+	if len(tok.Headers) > 0 {
+		keyID = tok.Headers[0].KeyID
+	}
+	keys := j.keys(keyID)
+	if len(keys) == 0 {
+		return nil, nil, nil, fmt.Errorf("token is signed by unknown key %q", keyID)
+	}
+	for _, key := range keys {
 		if err := tok.Claims(key, public, private); err != nil {
 			errs = append(errs, err)
 			continue
 		}
-		found = true
+		found = key
 		break
 	}
 
-	if !found {
-		return nil, false, multipleErrors(errs)
+	if found == nil {
+		return nil, nil, nil, multipleErrors(errs)
 	}
-
-	// If we get here, we have a token with a recognized signature and
-	// issuer string.
-	client, err := j.validator.Validate(tokenData, public, private)
-	if err != nil {
-		return nil, false, err
-	}
-
-	return client, true, nil
+	return public, private, found, nil
 }
 
 // hasCorrectIssuer returns true if tokenData is a valid JWT in compact
@@ -74,24 +120,25 @@ func (j *clientAuthorizer) AuthorizeClient(tokenData string) (*authorize.Client,
 // Note: go-jose currently does not allow access to unverified JWS payloads.
 // See https://github.com/square/go-jose/issues/169
 func (j *clientAuthorizer) hasCorrectIssuer(tokenData string) bool {
-	parts := strings.SplitN(tokenData, ".", 4)
+	return unverifiedIssuer(tokenData) == j.iss
+}
+
+// unverifiedIssuer returns the "iss" claim of a JWT without verifying it.
+func unverifiedIssuer(token string) string {
+	parts := strings.SplitN(token, ".", 4)
 	if len(parts) != 3 {
-		return false
+		return ""
 	}
 	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		return false
+		return ""
 	}
 	claims := struct {
 		// WARNING: this JWT is not verified. Do not trust these claims.
 		Issuer string `json:"iss"`
 	}{}
 	if err := json.Unmarshal(payload, &claims); err != nil {
-		return false
+		return ""
 	}
-	if claims.Issuer != j.iss {
-		return false
-	}
-	return true
-
+	return claims.Issuer
 }
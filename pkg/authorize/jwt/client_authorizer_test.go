@@ -0,0 +1,211 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func TestClientAuthorizer(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]string{"cluster": "a"}
+	scopes := []string{"upload"}
+
+	tests := []struct {
+		name       string
+		key        crypto.PrivateKey
+		issuer     string
+		expiration int64
+		audience   []string
+		tamper     func(string) string
+		want       *authorize.Client
+		wantErr    bool
+	}{
+		{
+			name:       "valid rsa",
+			key:        rsaKey,
+			expiration: 60,
+			audience:   []string{"federate"},
+			want:       &authorize.Client{ID: "a", Labels: labels, Scopes: scopes},
+		},
+		{
+			name:       "valid ecdsa",
+			key:        ecKey,
+			expiration: 60,
+			audience:   []string{"federate"},
+			want:       &authorize.Client{ID: "a", Labels: labels, Scopes: scopes},
+		},
+		{
+			name:       "expired",
+			key:        ecKey,
+			expiration: -3600,
+			audience:   []string{"federate"},
+			wantErr:    true,
+		},
+		{
+			name:       "wrong audience",
+			key:        ecKey,
+			expiration: 60,
+			audience:   []string{"other"},
+			wantErr:    true,
+		},
+		{
+			name:       "unknown key",
+			key:        otherKey,
+			expiration: 60,
+			audience:   []string{"federate"},
+			wantErr:    true,
+		},
+		{
+			name:       "tampered payload",
+			key:        ecKey,
+			expiration: 60,
+			audience:   []string{"federate"},
+			tamper: func(token string) string {
+				parts := strings.Split(token, ".")
+				signed, err := NewSigner("test", ecKey).GenerateToken(Claims("b", labels, scopes, authorize.Limits{}, 60, []string{"federate"}))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return parts[0] + "." + strings.Split(signed, ".")[1] + "." + parts[2]
+			},
+			wantErr: true,
+		},
+		{
+			name:       "other issuer",
+			key:        ecKey,
+			issuer:     "other",
+			expiration: 60,
+			audience:   []string{"federate"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := tt.issuer
+			if len(issuer) == 0 {
+				issuer = "test"
+			}
+			token, err := NewSigner(issuer, tt.key).GenerateToken(Claims("a", labels, scopes, authorize.Limits{}, tt.expiration, tt.audience))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.tamper != nil {
+				token = tt.tamper(token)
+			}
+
+			a := NewClientAuthorizer("test", []crypto.PublicKey{rsaKey.Public(), ecKey.Public()}, NewValidator([]string{"federate"}))
+			client, ok, err := a.AuthorizeClient(token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok != (tt.want != nil) {
+				t.Fatalf("expected authorized %t, got %t", tt.want != nil, ok)
+			}
+			if ok {
+				if len(client.TokenID) == 0 {
+					t.Fatal("expected the token to carry an ID")
+				}
+				if client.Claims["jti"] != client.TokenID || client.Claims["sub"] != client.ID {
+					t.Fatalf("expected the claims of the token, got %v", client.Claims)
+				}
+				client.TokenID, client.Claims = "", nil
+			}
+			if !reflect.DeepEqual(client, tt.want) {
+				t.Errorf("expected client %#v, got %#v", tt.want, client)
+			}
+		})
+	}
+}
+
+func TestClientAuthorizerHandler(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewSigner("test", key).GenerateToken(Claims("a", nil, nil, authorize.Limits{}, 60, []string{"federate"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *authorize.Client
+	h := authorize.Middleware(authorize.TokenAuthorizer(
+		NewClientAuthorizer("test", []crypto.PublicKey{key.Public()}, NewValidator([]string{"federate"})),
+	))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got, _ = authorize.FromContext(req.Context())
+	}))
+
+	for _, header := range []string{"", "Basic " + token, "Bearer " + token[:len(token)-4]} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/upload", nil)
+		req.Header.Set("Authorization", header)
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected header %q to be rejected, got %d", header, w.Code)
+		}
+	}
+	if got != nil {
+		t.Fatalf("expected no client to be authorized, got %#v", got)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/upload", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || got == nil || got.ID != "a" {
+		t.Fatalf("expected client a to be authorized, got %d %#v", w.Code, got)
+	}
+}
+
+func TestLoadPublicKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPublic, err := x509.MarshalPKIXPublicKey(ecKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := append(
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ecPublic}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})...,
+	)
+	keys, err := LoadPublicKeys(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []crypto.PublicKey{ecKey.Public(), rsaKey.Public()}) {
+		t.Errorf("unexpected keys: %#v", keys)
+	}
+
+	if _, err := LoadPublicKeys([]byte("not a key")); err == nil {
+		t.Errorf("expected data without keys to be rejected")
+	}
+}
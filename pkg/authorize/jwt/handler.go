@@ -8,10 +8,30 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/telemeter/pkg/audit"
 	"github.com/openshift/telemeter/pkg/authorize"
 )
 
+var tokensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "telemeter_authorize_tokens_total",
+	Help: "Tokens handled by the authorize endpoints, by result: issued, refreshed or denied.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(tokensTotal)
+}
+
+// tokenAudience is the audience of the tokens issued to clusters.
+const tokenAudience = "federate"
+
 type authorizeClusterHandler struct {
+	// Audit records every token that is issued or denied, by default to the standard logger.
+	Audit audit.Logger
+	// Limits are the upload limits carried by the tokens issued to a subject, if any.
+	Limits map[string]authorize.Limits
+
 	partitionKey    string
 	labels          map[string]string
 	expireInSeconds int64
@@ -28,6 +48,7 @@ type authorizeClusterHandler struct {
 // A single partition key parameter must be passed to uniquely identify the caller's data.
 func NewAuthorizeClusterHandler(partitionKey string, expireInSeconds int64, signer *Signer, labels map[string]string, ca authorize.ClusterAuthorizer) *authorizeClusterHandler {
 	return &authorizeClusterHandler{
+		Audit:           audit.NewStandardLogger(),
 		partitionKey:    partitionKey,
 		expireInSeconds: expireInSeconds,
 		signer:          signer,
@@ -57,51 +78,92 @@ func (a *authorizeClusterHandler) ServeHTTP(w http.ResponseWriter, req *http.Req
 		return
 	}
 
+	clientToken, ok := bearerToken(w, req)
+	if !ok {
+		return
+	}
+
+	subject, labels, err := authorize.AuthorizeClusterLabels(a.clusterAuth, clientToken, cluster)
+	if err != nil {
+		audit.Log(a.Audit, req, "", audit.ActionIssueToken, cluster, errorOutcome(err))
+		writeAuthorizeError(w, err)
+		return
+	}
+
+	if !a.writeToken(w, subject, cluster, labels, []string{authorize.ScopeMetricsWrite}) {
+		audit.Log(a.Audit, req, subject, audit.ActionIssueToken, cluster, audit.OutcomeFailed)
+		return
+	}
+	tokensTotal.WithLabelValues("issued").Inc()
+	audit.Log(a.Audit, req, subject, audit.ActionIssueToken, cluster, audit.OutcomeAllowed)
+}
+
+// bearerToken returns the bearer token of the request, or responds with an error if it has none.
+func bearerToken(w http.ResponseWriter, req *http.Request) (string, bool) {
 	auth := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
 	if strings.ToLower(auth[0]) != "bearer" {
 		http.Error(w, "Only bearer authorization allowed", http.StatusUnauthorized)
-		return
+		return "", false
 	}
 	if len(auth) != 2 || len(strings.TrimSpace(auth[1])) == 0 {
 		http.Error(w, "Invalid Authorization header", http.StatusUnauthorized)
-		return
+		return "", false
 	}
-	clientToken := auth[1]
+	return auth[1], true
+}
 
-	subject, err := a.clusterAuth.AuthorizeCluster(clientToken, cluster)
+// errorOutcome returns the audit outcome of an error of a cluster authorizer.
+func errorOutcome(err error) string {
+	if scerr, ok := err.(authorize.ErrorWithCode); ok && scerr.HTTPStatusCode() < http.StatusInternalServerError {
+		return audit.OutcomeDenied
+	}
+	return audit.OutcomeFailed
+}
 
-	if err != nil {
-		if scerr, ok := err.(authorize.ErrorWithCode); ok {
-			if scerr.HTTPStatusCode() >= http.StatusInternalServerError {
-				log.Printf("error: unable to authorize request: %v", scerr)
-			}
-			if scerr.HTTPStatusCode() == http.StatusTooManyRequests {
-				w.Header().Set("Retry-After", "300")
-			}
-			http.Error(w, scerr.Error(), scerr.HTTPStatusCode())
-			return
+// writeAuthorizeError responds with the error of a cluster authorizer.
+func writeAuthorizeError(w http.ResponseWriter, err error) {
+	if scerr, ok := err.(authorize.ErrorWithCode); ok {
+		if scerr.HTTPStatusCode() >= http.StatusInternalServerError {
+			log.Printf("error: unable to authorize request: %v", scerr)
+		} else {
+			tokensTotal.WithLabelValues("denied").Inc()
 		}
-
-		// always hide errors from the upstream service from the client
-		uid := rand.Int63()
-		log.Printf("error: unable to authorize request %d: %v", uid, err)
-		http.Error(w, fmt.Sprintf("Internal server error, requestid=%d", uid), http.StatusInternalServerError)
+		if scerr.HTTPStatusCode() == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "300")
+		}
+		http.Error(w, scerr.Error(), scerr.HTTPStatusCode())
 		return
 	}
 
+	// always hide errors from the upstream service from the client
+	uid := rand.Int63()
+	log.Printf("error: unable to authorize request %d: %v", uid, err)
+	http.Error(w, fmt.Sprintf("Internal server error, requestid=%d", uid), http.StatusInternalServerError)
+}
+
+// writeToken responds with a new token for the subject, labeled with the cluster, the labels
+// of the handler and the labels returned by the cluster authorizer, and carrying the limits of
+// the subject. It returns false if no token could be issued.
+func (a *authorizeClusterHandler) writeToken(w http.ResponseWriter, subject, cluster string, clusterLabels map[string]string, scopes []string) bool {
 	labels := map[string]string{
 		a.partitionKey: cluster,
 	}
 	for k, v := range a.labels {
 		labels[k] = v
 	}
+	// the authorizer may not override the cluster or the labels of the handler
+	for k, v := range clusterLabels {
+		if _, ok := labels[k]; !ok {
+			labels[k] = v
+		}
+	}
 
 	// create a token that asserts the client and the labels
-	authToken, err := a.signer.GenerateToken(Claims(subject, labels, a.expireInSeconds, []string{"federate"}))
+	authToken, err := a.signer.GenerateToken(Claims(subject, labels, scopes, a.Limits[subject], a.expireInSeconds, []string{tokenAudience}))
 	if err != nil {
 		log.Printf("error: unable to generate token: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return false
 	}
 
 	// write the data back to the client
@@ -115,10 +177,11 @@ func (a *authorizeClusterHandler) ServeHTTP(w http.ResponseWriter, req *http.Req
 	if err != nil {
 		log.Printf("error: unable to marshal token: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return false
 	}
 
 	if _, err := w.Write(data); err != nil {
 		log.Printf("writing auth token failed: %v", err)
 	}
+	return true
 }
@@ -1,18 +1,23 @@
 package jwt
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 
+	"github.com/openshift/telemeter/pkg/audit"
 	"github.com/openshift/telemeter/pkg/authorize"
 )
 
@@ -200,3 +205,150 @@ func TestAuthorizeClusterHandler(t *testing.T) {
 		})
 	}
 }
+
+type labelingClusterAuthorizer map[string]string
+
+func (a labelingClusterAuthorizer) AuthorizeCluster(token, cluster string) (string, error) {
+	return "subject", nil
+}
+
+func (a labelingClusterAuthorizer) AuthorizeClusterLabels(token, cluster string) (string, map[string]string, error) {
+	return "subject", a, nil
+}
+
+func TestAuthorizeClusterHandlerLabels(t *testing.T) {
+	pk, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := labelingClusterAuthorizer{"plan": "premium", "foo": "other", "partitionKey": "other"}
+	h := NewAuthorizeClusterHandler("partitionKey", 60, NewSigner("iss", pk), map[string]string{"foo": "bar"}, ca)
+
+	req := requestBuilder{httptest.NewRequest("POST", "https://telemeter", nil)}.
+		WithHeaders("Authorization", "bearer whatever").
+		WithForm("id", "test").Request
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want HTTP response code 200, got %d", rec.Code)
+	}
+
+	var tr authorize.TokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &tr); err != nil {
+		t.Fatal(err)
+	}
+	// the authorizer labels may not override the cluster or the labels of the handler
+	want := map[string]string{"partitionKey": "test", "foo": "bar", "plan": "premium"}
+	if !reflect.DeepEqual(tr.Labels, want) {
+		t.Errorf("want labels %v, got %v", want, tr.Labels)
+	}
+}
+
+func TestAuthorizeClusterHandlerAudit(t *testing.T) {
+	pk, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := authorize.ClusterAuthorizerFunc(func(token, cluster string) (string, error) {
+		switch token {
+		case "valid":
+			return "account-1", nil
+		case "down":
+			return "", errors.New("upstream unavailable")
+		}
+		return "", authorize.NewErrorWithCode(errors.New("unauthorized"), http.StatusUnauthorized)
+	})
+
+	tests := []struct {
+		token string
+		want  audit.Entry
+	}{
+		{token: "valid", want: audit.Entry{Actor: "account-1", Action: audit.ActionIssueToken, Target: "cluster-1", Outcome: audit.OutcomeAllowed, RequestID: "req-1"}},
+		{token: "invalid", want: audit.Entry{Actor: audit.Anonymous, Action: audit.ActionIssueToken, Target: "cluster-1", Outcome: audit.OutcomeDenied, RequestID: "req-1"}},
+		{token: "down", want: audit.Entry{Actor: audit.Anonymous, Action: audit.ActionIssueToken, Target: "cluster-1", Outcome: audit.OutcomeFailed, RequestID: "req-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			h := NewAuthorizeClusterHandler("_id", 60, NewSigner("iss", pk), nil, ca)
+			h.Audit = audit.NewLogger(buf)
+
+			req := requestBuilder{httptest.NewRequest("POST", "https://telemeter", nil)}.
+				WithHeaders("Authorization", "bearer "+tt.token, "X-Request-Id", "req-1").
+				WithForm("id", "cluster-1").Request
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if strings.Contains(buf.String(), tt.token) {
+				t.Fatalf("the audit log must not contain credentials: %s", buf.String())
+			}
+			var entry audit.Entry
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatalf("expected a single audit entry, got %q: %v", buf.String(), err)
+			}
+			if entry.Time.IsZero() {
+				t.Fatal("expected the audit entry to be timestamped")
+			}
+			entry.Time = time.Time{}
+			if entry != tt.want {
+				t.Fatalf("want audit entry %+v, got %+v", tt.want, entry)
+			}
+		})
+	}
+}
+
+func TestAuthorizeClusterHandlerLimits(t *testing.T) {
+	pk, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subject is the account presenting the token
+	ca := authorize.ClusterAuthorizerFunc(func(token, cluster string) (string, error) {
+		return token, nil
+	})
+	h := NewAuthorizeClusterHandler("_id", 60, NewSigner("iss", pk), nil, ca)
+	h.Limits, err = ParseLimits(strings.NewReader(`{"premium": {"max_upload_interval_seconds": 60, "max_samples_per_upload": 1000}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizer := NewClientAuthorizer("iss", []crypto.PublicKey{pk.Public()}, NewValidator([]string{tokenAudience}))
+
+	tests := []struct {
+		account string
+		want    authorize.Limits
+	}{
+		{account: "premium", want: authorize.Limits{UploadInterval: time.Minute, MaxSamplesPerUpload: 1000}},
+		{account: "basic", want: authorize.Limits{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.account, func(t *testing.T) {
+			req := requestBuilder{httptest.NewRequest("POST", "https://telemeter", nil)}.
+				WithHeaders("Authorization", "bearer "+tt.account).
+				WithForm("id", "cluster-1").Request
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("want HTTP response code 200, got %d", rec.Code)
+			}
+			var tr authorize.TokenResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &tr); err != nil {
+				t.Fatal(err)
+			}
+			client, ok, err := authorizer.AuthorizeClient(tr.Token)
+			if err != nil || !ok {
+				t.Fatalf("expected the token to be authorized: %v", err)
+			}
+			if client.Limits != tt.want {
+				t.Fatalf("want limits %+v, got %+v", tt.want, client.Limits)
+			}
+		})
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	if _, err := ParseLimits(strings.NewReader(`{"a": {"max_samples_per_upload": -1}}`)); err == nil {
+		t.Fatal("expected negative limits to be rejected")
+	}
+	if _, err := ParseLimits(strings.NewReader(`[]`)); err == nil {
+		t.Fatal("expected invalid JSON to be rejected")
+	}
+}
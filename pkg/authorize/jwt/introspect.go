@@ -0,0 +1,186 @@
+package jwt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/openshift/telemeter/pkg/audit"
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+// Reasons an introspected token is not active.
+const (
+	ReasonMalformed        = "malformed"
+	ReasonUnknownIssuer    = "unknown_issuer"
+	ReasonInvalidSignature = "invalid_signature"
+	ReasonExpired          = "expired"
+	ReasonNotYetValid      = "not_yet_valid"
+	ReasonInvalidClaims    = "invalid_claims"
+	ReasonRevoked          = "revoked"
+)
+
+// Introspection describes a token. The claims are only set for tokens signed by a known key.
+type Introspection struct {
+	// Active is true if the token would be accepted.
+	Active bool `json:"active"`
+	// Reason is the reason the token is not active, and Message describes it.
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// KeyID is the "kid" header of the token, and KeyThumbprint the RFC 7638 thumbprint of the
+	// key its signature was verified with.
+	KeyID         string `json:"key_id,omitempty"`
+	KeyThumbprint string `json:"key_thumbprint,omitempty"`
+
+	Subject   string            `json:"sub,omitempty"`
+	Issuer    string            `json:"iss,omitempty"`
+	TokenID   string            `json:"jti,omitempty"`
+	Audience  []string          `json:"aud,omitempty"`
+	IssuedAt  *time.Time        `json:"issued_at,omitempty"`
+	NotBefore *time.Time        `json:"not_before,omitempty"`
+	Expiry    *time.Time        `json:"expiry,omitempty"`
+	Scopes    []string          `json:"scopes,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Revoked   bool              `json:"revoked"`
+	// Claims are all claims of the token.
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+// Introspect describes the token as it would be authorized by AuthorizeClient at now. The
+// revocations, if set, are checked for the token and the cluster in its partitionKey label.
+func (j *clientAuthorizer) Introspect(tokenData string, revocations *authorize.Revocations, partitionKey string, now time.Time) *Introspection {
+	tok, err := jwt.ParseSigned(tokenData)
+	if err != nil {
+		return &Introspection{Reason: ReasonMalformed, Message: "the token is not a JWT"}
+	}
+	in := &Introspection{}
+	if len(tok.Headers) > 0 {
+		in.KeyID = tok.Headers[0].KeyID
+	}
+	if issuer := unverifiedIssuer(tokenData); issuer != j.iss {
+		in.Reason, in.Message = ReasonUnknownIssuer, fmt.Sprintf("the token is issued by %q, not %q", issuer, j.iss)
+		return in
+	}
+	public, private, key, err := j.verifyKey(tokenData)
+	if err != nil || public == nil {
+		in.Reason, in.Message = ReasonInvalidSignature, "the token is not signed by a known key"
+		if err != nil {
+			in.Message = err.Error()
+		}
+		return in
+	}
+
+	in.KeyThumbprint, _ = thumbprint(key)
+	in.Subject, in.Issuer, in.TokenID, in.Audience = public.Subject, public.Issuer, public.ID, public.Audience
+	in.IssuedAt, in.NotBefore, in.Expiry = timeOf(public.IssuedAt), timeOf(public.NotBefore), timeOf(public.Expiry)
+	if p, ok := private.(*privateClaims); ok {
+		in.Scopes, in.Labels = p.Telemeter.Scopes, p.Telemeter.Labels
+	}
+	// the signature is verified, so the payload may be decoded
+	if payload, err := base64.RawURLEncoding.DecodeString(strings.Split(tokenData, ".")[1]); err == nil {
+		json.Unmarshal(payload, &in.Claims)
+	}
+
+	if revocations != nil && authorize.IsRevoked(revocations.Check(public.ID, in.Labels[partitionKey])) {
+		in.Revoked = true
+		in.Reason, in.Message = ReasonRevoked, "the token or its cluster is revoked"
+		return in
+	}
+	switch err := public.Validate(jwt.Expected{Time: now}); err {
+	case nil:
+	case jwt.ErrExpired:
+		in.Reason, in.Message = ReasonExpired, fmt.Sprintf("the token expired %s ago", now.Sub(*in.Expiry).Round(time.Second))
+		return in
+	case jwt.ErrNotValidYet:
+		in.Reason, in.Message = ReasonNotYetValid, "the token is not valid yet"
+		return in
+	default:
+		in.Reason, in.Message = ReasonInvalidClaims, err.Error()
+		return in
+	}
+	if _, err := j.validator.Validate(tokenData, public, private); err != nil {
+		in.Reason, in.Message = ReasonInvalidClaims, err.Error()
+		return in
+	}
+	in.Active = true
+	return in
+}
+
+// timeOf returns the time of a date claim, or nil if the claim is not set.
+func timeOf(d jwt.NumericDate) *time.Time {
+	if d == 0 {
+		return nil
+	}
+	t := d.Time().UTC()
+	return &t
+}
+
+type introspectHandler struct {
+	authorizer   *clientAuthorizer
+	revocations  *authorize.Revocations
+	partitionKey string
+	nowFn        func() time.Time
+
+	// Audit records every introspection, by default to the standard logger.
+	Audit audit.Logger
+}
+
+// NewIntrospectHandler returns a handler for POST /authorize/introspect describing the token in
+// the "token" form parameter as an Introspection, so that operators can tell why a token is
+// rejected. The token itself is never logged, only its ID. The handler must be wrapped by one
+// authorizing admins.
+func NewIntrospectHandler(authorizer *clientAuthorizer, revocations *authorize.Revocations, partitionKey string) *introspectHandler {
+	return &introspectHandler{
+		authorizer:   authorizer,
+		revocations:  revocations,
+		partitionKey: partitionKey,
+		nowFn:        time.Now,
+		Audit:        audit.NewStandardLogger(),
+	}
+}
+
+func (h *introspectHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Only POST is allowed to this endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, 8*1024)
+	defer req.Body.Close()
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token := req.PostForm.Get("token")
+	if len(token) == 0 {
+		http.Error(w, "The 'token' parameter must be specified via url-encoded form body", http.StatusBadRequest)
+		return
+	}
+
+	in := h.authorizer.Introspect(token, h.revocations, h.partitionKey, h.nowFn())
+	var actor string
+	if client, ok := authorize.FromContext(req.Context()); ok {
+		actor = client.ID
+	}
+	outcome := "active"
+	if !in.Active {
+		outcome = in.Reason
+	}
+	audit.Log(h.Audit, req, actor, audit.ActionIntrospectToken, in.TokenID, outcome)
+
+	data, err := json.MarshalIndent(in, "", "  ")
+	if err != nil {
+		log.Printf("marshaling token introspection failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
@@ -0,0 +1,115 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/audit"
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+type recordingLogger []audit.Entry
+
+func (l *recordingLogger) Log(e audit.Entry) { *l = append(*l, e) }
+
+func TestIntrospectHandler(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := NewStaticKeyring(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := keyring.Primary()
+	signer := NewKeyringSigner("test", keyring)
+	authorizer := NewKeyringClientAuthorizer("test", keyring, nil, NewValidator([]string{tokenAudience}))
+
+	issue := func(cluster string) string {
+		token, err := signer.GenerateToken(Claims("account-1", map[string]string{"_id": cluster}, []string{authorize.ScopeMetricsWrite}, authorize.Limits{}, 3600, []string{tokenAudience}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid, revoked := issue("cluster-1"), issue("cluster-2")
+
+	dir, err := ioutil.TempDir("", "telemeter-introspect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	revocations, err := authorize.NewRevocations(filepath.Join(dir, "revocations.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := revocations.Revoke(authorize.RevocationList{Clusters: []string{"cluster-2"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		after      time.Duration
+		wantActive bool
+		wantReason string
+		wantClaims bool
+	}{
+		{name: "valid", token: valid, wantActive: true, wantClaims: true},
+		{name: "expired", token: valid, after: 2 * time.Hour, wantReason: ReasonExpired, wantClaims: true},
+		{name: "revoked", token: revoked, wantReason: ReasonRevoked, wantClaims: true},
+		{name: "garbage", token: "not-a-token", wantReason: ReasonMalformed},
+		{name: "other issuer", token: mustToken(t, NewSigner("other", key)), wantReason: ReasonUnknownIssuer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events recordingLogger
+			h := NewIntrospectHandler(authorizer, revocations, "_id")
+			h.Audit = &events
+			h.nowFn = func() time.Time { return time.Now().Add(tt.after) }
+
+			req := httptest.NewRequest("POST", "/authorize/introspect", strings.NewReader(url.Values{"token": {tt.token}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("want status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			var got Introspection
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Active != tt.wantActive || got.Reason != tt.wantReason {
+				t.Fatalf("want active=%t reason=%q, got active=%t reason=%q", tt.wantActive, tt.wantReason, got.Active, got.Reason)
+			}
+			if tt.wantClaims {
+				if got.Subject != "account-1" || got.KeyID != kid || got.KeyThumbprint != kid || got.Expiry == nil || len(got.Scopes) != 1 || got.Claims["sub"] != "account-1" {
+					t.Fatalf("want the claims of the token, got %+v", got)
+				}
+			}
+			if len(events) != 1 || strings.Contains(events[0].Target, tt.token) {
+				t.Fatalf("want a single audit event without the token, got %+v", events)
+			}
+		})
+	}
+}
+
+func mustToken(t *testing.T, signer *Signer) string {
+	t.Helper()
+	token, err := signer.GenerateToken(Claims("account-1", nil, nil, authorize.Limits{}, 3600, []string{tokenAudience}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
@@ -0,0 +1,304 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// keyringCheckInterval is how often the keyring file is checked for changes.
+const keyringCheckInterval = 10 * time.Second
+
+// KeyringConfig is the file format of a keyring. Key files hold a PEM encoded private key, which
+// may sign tokens, or public key, which may only verify them. Relative paths are resolved
+// against the directory of the keyring file.
+type KeyringConfig struct {
+	// Primary is the ID of the key new tokens are signed with.
+	Primary string       `json:"primary"`
+	Keys    []KeyringKey `json:"keys"`
+}
+
+// KeyringKey is a key of a keyring.
+type KeyringKey struct {
+	ID   string `json:"kid"`
+	File string `json:"file"`
+}
+
+// Keyring holds the keys tokens are signed and verified with, identified by the "kid" header
+// of tokens. Keys are rotated by adding a new key, making it primary once every replica
+// verifies it, and removing the previous key once the tokens signed with it have expired.
+type Keyring struct {
+	path  string
+	nowFn func() time.Time
+
+	mu      sync.RWMutex
+	primary string
+	private map[string]crypto.PrivateKey
+	public  map[string]crypto.PublicKey
+	modTime time.Time
+	checked time.Time
+}
+
+// NewKeyring loads the keyring configured by the KeyringConfig at path. The file is reloaded
+// when it changes, at most every 10 seconds. If it cannot be reloaded, the previous keys
+// continue to be used.
+func NewKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path, nowFn: time.Now}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// NewStaticKeyring returns a keyring of a single key that signs all tokens. Its ID is the
+// RFC 7638 thumbprint of the key.
+func NewStaticKeyring(key crypto.PrivateKey) (*Keyring, error) {
+	public, err := publicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	id, err := thumbprint(public)
+	if err != nil {
+		return nil, err
+	}
+	return &Keyring{
+		primary: id,
+		private: map[string]crypto.PrivateKey{id: key},
+		public:  map[string]crypto.PublicKey{id: public},
+	}, nil
+}
+
+// reload reads the keys from disk. The caller must hold the lock.
+func (k *Keyring) reload() error {
+	fi, err := os.Stat(k.path)
+	if err != nil {
+		return fmt.Errorf("unable to read keyring: %v", err)
+	}
+	data, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return fmt.Errorf("unable to read keyring: %v", err)
+	}
+	var config KeyringConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("unable to parse keyring %s: %v", k.path, err)
+	}
+
+	private := make(map[string]crypto.PrivateKey)
+	public := make(map[string]crypto.PublicKey)
+	for _, key := range config.Keys {
+		if len(key.ID) == 0 {
+			return fmt.Errorf("keys of keyring %s must have a kid", k.path)
+		}
+		if _, ok := public[key.ID]; ok {
+			return fmt.Errorf("duplicate key %s in keyring %s", key.ID, k.path)
+		}
+		file := key.File
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(k.path), file)
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("unable to read key %s: %v", key.ID, err)
+		}
+		if priv, err := LoadPrivateKey(data); err == nil {
+			pub, err := publicKey(priv)
+			if err != nil {
+				return fmt.Errorf("key %s: %v", key.ID, err)
+			}
+			private[key.ID], public[key.ID] = priv, pub
+			continue
+		}
+		keys, err := LoadPublicKeys(data)
+		if err != nil {
+			return fmt.Errorf("unable to load key %s: %v", key.ID, err)
+		}
+		if len(keys) != 1 {
+			return fmt.Errorf("key file of %s must hold a single key", key.ID)
+		}
+		public[key.ID] = keys[0]
+	}
+	if _, ok := private[config.Primary]; !ok {
+		return fmt.Errorf("the primary key %q of keyring %s must be a private key of the keyring", config.Primary, k.path)
+	}
+
+	k.primary, k.private, k.public = config.Primary, private, public
+	k.modTime = fi.ModTime()
+	return nil
+}
+
+// check reloads the file if it changed, at most every keyringCheckInterval. A removed file
+// keeps the previous keys, as tokens could not be signed without a primary key, and is
+// reloaded once it is restored.
+func (k *Keyring) check() {
+	if len(k.path) == 0 {
+		return
+	}
+	now := k.nowFn()
+	k.mu.RLock()
+	checked := k.checked
+	k.mu.RUnlock()
+	if now.Sub(checked) < keyringCheckInterval {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if now.Sub(k.checked) < keyringCheckInterval {
+		return
+	}
+	k.checked = now
+	fi, err := os.Stat(k.path)
+	if os.IsNotExist(err) {
+		if !k.modTime.IsZero() {
+			log.Printf("error: keyring %s was removed, continuing with the previous keys", k.path)
+		}
+		k.modTime = time.Time{}
+		return
+	}
+	if err != nil {
+		log.Printf("error: unable to check keyring, continuing with the previous keys: %v", err)
+		return
+	}
+	if fi.ModTime().Equal(k.modTime) {
+		return
+	}
+	if err := k.reload(); err != nil {
+		log.Printf("error: unable to reload keyring, continuing with the previous keys: %v", err)
+		return
+	}
+	log.Printf("Reloaded keyring %s, signing with key %s", k.path, k.primary)
+}
+
+// Primary returns the ID and private key new tokens are signed with.
+func (k *Keyring) Primary() (string, crypto.PrivateKey) {
+	k.check()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.primary, k.private[k.primary]
+}
+
+// PublicKeys returns the key with the ID, or all keys if id is empty, so that tokens signed
+// before keys had IDs continue to be verified.
+func (k *Keyring) PublicKeys(id string) []crypto.PublicKey {
+	k.check()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(id) > 0 {
+		if key, ok := k.public[id]; ok {
+			return []crypto.PublicKey{key}
+		}
+		return nil
+	}
+	keys := make([]crypto.PublicKey, 0, len(k.public))
+	for _, id := range k.ids() {
+		keys = append(keys, k.public[id])
+	}
+	return keys
+}
+
+// JWKS returns the public keys of the keyring as a JSON Web Key Set.
+func (k *Keyring) JWKS() jose.JSONWebKeySet {
+	k.check()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	set := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{}}
+	for _, id := range k.ids() {
+		key := k.public[id]
+		alg, err := algorithm(key)
+		if err != nil {
+			continue
+		}
+		set.Keys = append(set.Keys, jose.JSONWebKey{Key: key, KeyID: id, Algorithm: string(alg), Use: "sig"})
+	}
+	return set
+}
+
+// ids returns the IDs of the keys in order. The caller must hold the lock.
+func (k *Keyring) ids() []string {
+	ids := make([]string, 0, len(k.public))
+	for id := range k.public {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// NewJWKSHandler serves the public keys of the keyring as a JSON Web Key Set, typically at
+// /.well-known/jwks.json, so that the tokens signed by the keyring can be verified elsewhere.
+func NewJWKSHandler(k *Keyring) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			http.Error(w, "Only GET is allowed to this endpoint", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := json.Marshal(k.JWKS())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// keys are rotated over hours, not seconds
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.Write(data)
+	})
+}
+
+// publicKey returns the public key of an RSA or ECDSA private key.
+func publicKey(key crypto.PrivateKey) (crypto.PublicKey, error) {
+	switch t := key.(type) {
+	case *rsa.PrivateKey:
+		return t.Public(), nil
+	case *ecdsa.PrivateKey:
+		return t.Public(), nil
+	default:
+		return nil, fmt.Errorf("unknown private key type %T, must be *rsa.PrivateKey or *ecdsa.PrivateKey", key)
+	}
+}
+
+// thumbprint returns the base64url encoded RFC 7638 thumbprint of a public key.
+func thumbprint(key crypto.PublicKey) (string, error) {
+	sum, err := (&jose.JSONWebKey{Key: key}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(sum), nil
+}
+
+// algorithm returns the signature algorithm of an RSA or ECDSA key.
+func algorithm(key interface{}) (jose.SignatureAlgorithm, error) {
+	var curve elliptic.Curve
+	switch t := key.(type) {
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		curve = t.Curve
+	case *ecdsa.PublicKey:
+		curve = t.Curve
+	default:
+		return "", fmt.Errorf("unknown key type %T, must be an RSA or ECDSA key", key)
+	}
+	switch curve {
+	case elliptic.P256():
+		return jose.ES256, nil
+	case elliptic.P384():
+		return jose.ES384, nil
+	case elliptic.P521():
+		return jose.ES512, nil
+	default:
+		return "", fmt.Errorf("unknown key curve, must be 256, 384, or 521")
+	}
+}
@@ -0,0 +1,216 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+// writeKey writes a new private key to dir and returns it.
+func writeKey(t *testing.T, dir, name string) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writeKeyring writes a keyring of the key files, named by their key ID, with a modification
+// time of at, so that changes are detected regardless of the resolution of the file system.
+func writeKeyring(t *testing.T, path, primary string, ids []string, at time.Time) {
+	t.Helper()
+	var config KeyringConfig
+	config.Primary = primary
+	for _, id := range ids {
+		config.Keys = append(config.Keys, KeyringKey{ID: id, File: id + ".pem"})
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, at, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeKey(t, dir, "a.pem")
+	writeKey(t, dir, "b.pem")
+	path := filepath.Join(dir, "keyring.json")
+	now := time.Unix(100000, 0)
+	writeKeyring(t, path, "a", []string{"a"}, now)
+
+	keyring, err := NewKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring.nowFn = func() time.Time { return now }
+	signer := NewKeyringSigner("test", keyring)
+	authorizer := NewKeyringClientAuthorizer("test", keyring, nil, NewValidator([]string{"federate"}))
+
+	mint := func() string {
+		t.Helper()
+		token, err := signer.GenerateToken(Claims("cluster-1", nil, nil, authorize.Limits{}, 3600, []string{"federate"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	keyID := func(token string) string {
+		t.Helper()
+		sig, err := jose.ParseSigned(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig.Signatures[0].Header.KeyID
+	}
+	valid := func(token string) bool {
+		_, ok, err := authorizer.AuthorizeClient(token)
+		return ok && err == nil
+	}
+	rotate := func(primary string, ids ...string) {
+		now = now.Add(time.Minute)
+		writeKeyring(t, path, primary, ids, now)
+	}
+
+	tokenA := mint()
+	if id := keyID(tokenA); id != "a" {
+		t.Fatalf("want token signed with key a, got %q", id)
+	}
+
+	// the new key is verified before it signs
+	rotate("a", "a", "b")
+	if id := keyID(mint()); id != "a" {
+		t.Fatalf("want token signed with key a until b is primary, got %q", id)
+	}
+
+	rotate("b", "a", "b")
+	tokenB := mint()
+	if id := keyID(tokenB); id != "b" {
+		t.Fatalf("want token signed with key b, got %q", id)
+	}
+	if !valid(tokenA) || !valid(tokenB) {
+		t.Fatal("want tokens of both keys to be valid until a is retired")
+	}
+
+	rotate("b", "b")
+	if valid(tokenA) {
+		t.Fatal("want tokens of a retired key to be rejected")
+	}
+	if !valid(tokenB) {
+		t.Fatal("want tokens of the primary key to be valid")
+	}
+
+	// a keyring that cannot be loaded leaves the previous keys in place
+	rotate("c", "b", "c")
+	if !valid(tokenB) || keyID(mint()) != "b" {
+		t.Fatal("want the previous keys to be used if the keyring cannot be reloaded")
+	}
+
+	// a removed keyring keeps the previous keys, and is reloaded once restored
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	if !valid(tokenB) || keyID(mint()) != "b" {
+		t.Fatal("want the previous keys to be used if the keyring is removed")
+	}
+	writeKeyring(t, path, "a", []string{"a", "b"}, now)
+	now = now.Add(time.Minute)
+	if keyID(mint()) != "a" {
+		t.Fatal("want the restored keyring to be loaded")
+	}
+}
+
+func TestKeyringAdditionalKeys(t *testing.T) {
+	legacy, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := NewStaticKeyring(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizer := NewKeyringClientAuthorizer("test", keyring, []crypto.PublicKey{legacy.Public()}, NewValidator([]string{"federate"}))
+
+	for name, signer := range map[string]*Signer{
+		"keyring":    NewKeyringSigner("test", keyring),
+		"without id": NewSigner("test", legacy),
+	} {
+		token, err := signer.GenerateToken(Claims("cluster-1", nil, nil, authorize.Limits{}, 3600, []string{"federate"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok, err := authorizer.AuthorizeClient(token); !ok || err != nil {
+			t.Errorf("%s: want token to be valid, got %v", name, err)
+		}
+	}
+}
+
+func TestJWKSHandler(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := NewStaticKeyring(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := keyring.Primary()
+
+	rec := httptest.NewRecorder()
+	NewJWKSHandler(keyring).ServeHTTP(rec, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want HTTP response code 200, got %d", rec.Code)
+	}
+	var set jose.JSONWebKeySet
+	if err := json.Unmarshal(rec.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 1 {
+		t.Fatalf("want a single key, got %d", len(set.Keys))
+	}
+	got := set.Keys[0]
+	if got.KeyID != id || got.Algorithm != string(jose.ES256) || got.Use != "sig" || !got.IsPublic() {
+		t.Fatalf("unexpected key %+v", got)
+	}
+	if !reflect.DeepEqual(got.Key, key.Public()) {
+		t.Fatal("want the public key of the keyring to be published")
+	}
+}
@@ -0,0 +1,305 @@
+package jwt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+// OIDCIssuer is an issuer of OIDC tokens accepted from clients.
+type OIDCIssuer struct {
+	// URL is the issuer as given in the "iss" claim of its tokens.
+	URL string
+	// JWKSURL is the URL of the keys of the issuer. If empty, it is discovered from the
+	// OIDC configuration of the issuer.
+	JWKSURL string
+}
+
+// OIDCConfig configures the validation of OIDC tokens.
+type OIDCConfig struct {
+	Issuers []OIDCIssuer
+	// Audience must be one of the audiences of a token.
+	Audience string
+	// ClockSkew is how long after its expiry a token is still accepted.
+	ClockSkew time.Duration
+	// IDClaim is the claim identifying the client, "sub" if empty. The client ID is also set
+	// as the value of the PartitionKey label.
+	IDClaim      string
+	PartitionKey string
+	// LabelClaims maps claims to the client labels they are set as.
+	LabelClaims map[string]string
+	// RefreshInterval is how long the keys of an issuer are cached. They are fetched earlier
+	// if a token is signed by an unknown key.
+	RefreshInterval time.Duration
+	// Client fetches the keys of the issuers, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// jwksMinRefreshInterval limits how often the keys of an issuer are fetched, such as because of
+// tokens signed by unknown keys.
+const jwksMinRefreshInterval = 10 * time.Second
+
+type oidcAuthorizer struct {
+	ctx       context.Context
+	config    OIDCConfig
+	verifiers map[string]*oidc.IDTokenVerifier
+	nowFn     func() time.Time
+}
+
+// NewOIDCAuthorizer returns a client authorizer for OIDC tokens of the configured issuers, for
+// instance the workload identity tokens of a cluster. The keys of an issuer are cached and fetched
+// again when a token is signed by an unknown key. Tokens of other issuers are ignored without an
+// error. The space separated scope claim of a token grants the client its scopes, and the
+// max_upload_interval_seconds and max_samples_per_upload claims its limits. The keys are
+// fetched until ctx is done.
+func NewOIDCAuthorizer(ctx context.Context, config OIDCConfig) (authorize.ClientAuthorizer, error) {
+	if len(config.Audience) == 0 {
+		return nil, fmt.Errorf("an audience is required to accept OIDC tokens")
+	}
+	if len(config.IDClaim) == 0 {
+		config.IDClaim = "sub"
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	ctx = oidc.ClientContext(ctx, config.Client)
+
+	a := &oidcAuthorizer{
+		ctx:       ctx,
+		config:    config,
+		verifiers: make(map[string]*oidc.IDTokenVerifier),
+		nowFn:     time.Now,
+	}
+	verifierConfig := &oidc.Config{
+		ClientID:             config.Audience,
+		SupportedSigningAlgs: []string{oidc.RS256, oidc.RS384, oidc.RS512, oidc.ES256, oidc.ES384, oidc.ES512, oidc.PS256, oidc.PS384, oidc.PS512},
+		Now:                  func() time.Time { return a.nowFn().Add(-config.ClockSkew) },
+	}
+	for _, issuer := range config.Issuers {
+		jwksURL := issuer.JWKSURL
+		if len(jwksURL) == 0 {
+			provider, err := oidc.NewProvider(ctx, issuer.URL)
+			if err != nil {
+				return nil, fmt.Errorf("unable to discover OIDC issuer %s: %v", issuer.URL, err)
+			}
+			var discovery struct {
+				JWKSURL string `json:"jwks_uri"`
+			}
+			if err := provider.Claims(&discovery); err != nil || len(discovery.JWKSURL) == 0 {
+				return nil, fmt.Errorf("OIDC issuer %s does not publish its keys", issuer.URL)
+			}
+			jwksURL = discovery.JWKSURL
+		}
+		keys := &keySet{
+			url:             jwksURL,
+			client:          config.Client,
+			refreshInterval: config.RefreshInterval,
+			nowFn:           func() time.Time { return a.nowFn() },
+		}
+		a.verifiers[issuer.URL] = oidc.NewVerifier(issuer.URL, keys, verifierConfig)
+	}
+	return a, nil
+}
+
+func (a *oidcAuthorizer) AuthorizeClient(token string) (*authorize.Client, bool, error) {
+	verifier, ok := a.verifiers[unverifiedIssuer(token)]
+	if !ok {
+		return nil, false, nil
+	}
+	idToken, err := verifier.Verify(a.ctx, token)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "oidc: token is expired") {
+			return nil, false, authorize.ErrTokenExpired
+		}
+		return nil, false, err
+	}
+	if !idToken.IssuedAt.IsZero() && idToken.IssuedAt.After(a.nowFn().Add(a.config.ClockSkew)) {
+		return nil, false, fmt.Errorf("token was issued in the future")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, false, err
+	}
+	id, ok := claimValue(claims[a.config.IDClaim])
+	if !ok || len(id) == 0 {
+		return nil, false, fmt.Errorf("token has no %s claim identifying the client", a.config.IDClaim)
+	}
+	labels := make(map[string]string)
+	for claim, label := range a.config.LabelClaims {
+		if v, ok := claimValue(claims[claim]); ok {
+			labels[label] = v
+		}
+	}
+	if len(a.config.PartitionKey) > 0 {
+		labels[a.config.PartitionKey] = id
+	}
+	client := &authorize.Client{ID: id, Labels: labels, Claims: make(map[string]string)}
+	for claim, v := range claims {
+		if s, ok := claimValue(v); ok {
+			client.Claims[claim] = s
+		}
+	}
+	client.TokenID = client.Claims["jti"]
+	if scope, ok := claims["scope"].(string); ok {
+		client.Scopes = strings.Fields(scope)
+	}
+	if v, ok := claims["max_upload_interval_seconds"].(float64); ok && v > 0 {
+		client.Limits.UploadInterval = time.Duration(v) * time.Second
+	}
+	if v, ok := claims["max_samples_per_upload"].(float64); ok && v > 0 {
+		client.Limits.MaxSamplesPerUpload = int(v)
+	}
+	return client, true, nil
+}
+
+// claimValue returns a claim that is a string, number or boolean as a string.
+func claimValue(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(t), true
+	default:
+		return "", false
+	}
+}
+
+// keySet verifies signatures with the keys published at a JWKS URL. The keys are cached for the
+// refresh interval and fetched again earlier if a token is signed by an unknown key. Keys are
+// fetched at most every jwksMinRefreshInterval, by a single request that concurrent
+// verifications wait for, and without holding the lock. If the keys cannot be fetched, the
+// cached keys continue to be used.
+type keySet struct {
+	url             string
+	client          *http.Client
+	refreshInterval time.Duration
+	nowFn           func() time.Time
+
+	mu      sync.Mutex
+	keys    []jose.JSONWebKey
+	fetched time.Time
+	// fetching is closed once the fetch in flight, if any, completes with fetchErr
+	fetching chan struct{}
+	fetchErr error
+}
+
+func (s *keySet) VerifySignature(ctx context.Context, token string) ([]byte, error) {
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %v", err)
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, errors.New("token must have exactly one signature")
+	}
+	kid := jws.Signatures[0].Header.KeyID
+
+	now := s.nowFn()
+	s.mu.Lock()
+	keys := s.keys
+	expired := s.fetched.IsZero() || (s.refreshInterval > 0 && now.Sub(s.fetched) >= s.refreshInterval)
+	s.mu.Unlock()
+
+	var fetchErr error
+	if expired {
+		keys, fetchErr = s.refresh(ctx, now)
+	}
+	if payload, ok := verifyWithKeys(jws, kid, keys); ok {
+		return payload, nil
+	}
+	if fetchErr == nil {
+		keys, fetchErr = s.refresh(ctx, now)
+		if payload, ok := verifyWithKeys(jws, kid, keys); ok {
+			return payload, nil
+		}
+	}
+	if fetchErr != nil {
+		return nil, fmt.Errorf("unable to verify token signature: %v", fetchErr)
+	}
+	return nil, errors.New("token is not signed by a known key")
+}
+
+// refresh fetches the keys unless they were fetched within jwksMinRefreshInterval, and returns
+// the cached keys. If a fetch is in flight, it waits for it instead of fetching again.
+func (s *keySet) refresh(ctx context.Context, now time.Time) ([]jose.JSONWebKey, error) {
+	s.mu.Lock()
+	if fetching := s.fetching; fetching != nil {
+		s.mu.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.keys, s.fetchErr
+	}
+	if !s.fetched.IsZero() && now.Sub(s.fetched) < jwksMinRefreshInterval {
+		defer s.mu.Unlock()
+		return s.keys, nil
+	}
+	fetching := make(chan struct{})
+	s.fetching, s.fetched = fetching, now
+	s.mu.Unlock()
+
+	keys, err := s.fetch(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.keys = keys
+	}
+	s.fetching, s.fetchErr = nil, err
+	close(fetching)
+	return s.keys, err
+}
+
+func verifyWithKeys(jws *jose.JSONWebSignature, kid string, keys []jose.JSONWebKey) ([]byte, bool) {
+	for i := range keys {
+		if len(kid) > 0 && keys[i].KeyID != kid {
+			continue
+		}
+		if payload, err := jws.Verify(&keys[i]); err == nil {
+			return payload, true
+		}
+	}
+	return nil, false
+}
+
+func (s *keySet) fetch(ctx context.Context) ([]jose.JSONWebKey, error) {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch keys: %v", err)
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch keys: %s", resp.Status)
+	}
+	var set jose.JSONWebKeySet
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("unable to decode keys: %v", err)
+	}
+	return set.Keys, nil
+}
@@ -0,0 +1,246 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+// fakeJWKS serves the public keys of its signing keys.
+type fakeJWKS struct {
+	t        *testing.T
+	mu       sync.Mutex
+	keys     map[string]*ecdsa.PrivateKey
+	requests int
+}
+
+func (f *fakeJWKS) addKey(kid string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys[kid] = key
+}
+
+func (f *fakeJWKS) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	var set jose.JSONWebKeySet
+	for kid, key := range f.keys {
+		set.Keys = append(set.Keys, jose.JSONWebKey{Key: key.Public(), KeyID: kid, Algorithm: "ES256", Use: "sig"})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(set); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fakeJWKS) sign(kid string, claims interface{}) string {
+	f.mu.Lock()
+	key := f.keys[kid]
+	f.mu.Unlock()
+	if key == nil {
+		var err error
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", kid))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return token
+}
+
+func TestOIDCAuthorizer(t *testing.T) {
+	jwks := &fakeJWKS{t: t, keys: make(map[string]*ecdsa.PrivateKey)}
+	jwks.addKey("key-1")
+	s := httptest.NewServer(jwks)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, err := NewOIDCAuthorizer(ctx, OIDCConfig{
+		Issuers: []OIDCIssuer{
+			{URL: "https://cluster-1.example.com", JWKSURL: s.URL},
+			{URL: "https://cluster-2.example.com", JWKSURL: s.URL},
+		},
+		Audience:     "telemeter",
+		ClockSkew:    time.Minute,
+		IDClaim:      "cluster_id",
+		PartitionKey: "_id",
+		LabelClaims:  map[string]string{"account": "account", "sub": "service_account"},
+
+		RefreshInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(100000, 0)
+	a.(*oidcAuthorizer).nowFn = func() time.Time { return now }
+
+	claims := func(issuer string, audience string, expiry time.Time, extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":        issuer,
+			"aud":        audience,
+			"sub":        "system:serviceaccount:openshift-monitoring:telemeter-client",
+			"exp":        expiry.Unix(),
+			"iat":        now.Add(-time.Minute).Unix(),
+			"cluster_id": "cluster-1",
+			"account":    "acme",
+			"jti":        "token-1",
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	valid := &authorize.Client{
+		ID:      "cluster-1",
+		Labels:  map[string]string{"_id": "cluster-1", "account": "acme", "service_account": "system:serviceaccount:openshift-monitoring:telemeter-client"},
+		TokenID: "token-1",
+	}
+	validClaims := func(issuer string) *authorize.Client {
+		c := *valid
+		c.Claims = map[string]string{
+			"iss":        issuer,
+			"aud":        "telemeter",
+			"sub":        "system:serviceaccount:openshift-monitoring:telemeter-client",
+			"exp":        "103600",
+			"iat":        "99940",
+			"cluster_id": "cluster-1",
+			"account":    "acme",
+			"jti":        "token-1",
+		}
+		return &c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		want    *authorize.Client
+		wantErr bool
+	}{
+		{name: "valid", token: jwks.sign("key-1", claims("https://cluster-1.example.com", "telemeter", now.Add(time.Hour), nil)), want: validClaims("https://cluster-1.example.com")},
+		{name: "second issuer", token: jwks.sign("key-1", claims("https://cluster-2.example.com", "telemeter", now.Add(time.Hour), nil)), want: validClaims("https://cluster-2.example.com")},
+		{name: "expired within clock skew", token: jwks.sign("key-1", claims("https://cluster-1.example.com", "telemeter", now.Add(-30*time.Second), nil)), want: func() *authorize.Client {
+			c := validClaims("https://cluster-1.example.com")
+			c.Claims["exp"] = "99970"
+			return c
+		}()},
+		{name: "expired", token: jwks.sign("key-1", claims("https://cluster-1.example.com", "telemeter", now.Add(-2*time.Minute), nil)), wantErr: true},
+		{name: "issued in the future", token: jwks.sign("key-1", claims("https://cluster-1.example.com", "telemeter", now.Add(time.Hour), map[string]interface{}{"iat": now.Add(time.Hour).Unix()})), wantErr: true},
+		{name: "wrong audience", token: jwks.sign("key-1", claims("https://cluster-1.example.com", "other", now.Add(time.Hour), nil)), wantErr: true},
+		{name: "unknown key", token: jwks.sign("key-2", claims("https://cluster-1.example.com", "telemeter", now.Add(time.Hour), nil)), wantErr: true},
+		{name: "missing id claim", token: jwks.sign("key-1", claims("https://cluster-1.example.com", "telemeter", now.Add(time.Hour), map[string]interface{}{"cluster_id": nil})), wantErr: true},
+		{name: "other issuer", token: jwks.sign("key-1", claims("https://other.example.com", "telemeter", now.Add(time.Hour), nil))},
+		{name: "not a jwt", token: "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, ok, err := a.AuthorizeClient(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("want error %t, got %v", tt.wantErr, err)
+			}
+			if ok != (tt.want != nil) {
+				t.Fatalf("want authorized %t, got %t", tt.want != nil, ok)
+			}
+			if !reflect.DeepEqual(client, tt.want) {
+				t.Fatalf("want client %#v, got %#v", tt.want, client)
+			}
+		})
+	}
+
+	// unknown keys do not cause the keys to be fetched more often than the minimum interval
+	if jwks.requests != 2 {
+		t.Fatalf("expected the keys to be fetched once per issuer, got %d requests", jwks.requests)
+	}
+
+	// a rotated key is fetched once it signs a token
+	jwks.addKey("key-2")
+	now = now.Add(jwksMinRefreshInterval)
+	before := jwks.requests
+	token := jwks.sign("key-2", claims("https://cluster-1.example.com", "telemeter", now.Add(time.Hour), nil))
+	if _, ok, err := a.AuthorizeClient(token); !ok || err != nil {
+		t.Fatalf("expected a token of the rotated key to be accepted: %v", err)
+	}
+	if _, ok, err := a.AuthorizeClient(token); !ok || err != nil {
+		t.Fatalf("expected a token of the rotated key to be accepted: %v", err)
+	}
+	if jwks.requests != before+1 {
+		t.Fatalf("expected the keys to be fetched once, got %d requests", jwks.requests-before)
+	}
+}
+
+func TestKeySetRefresh(t *testing.T) {
+	jwks := &fakeJWKS{t: t, keys: make(map[string]*ecdsa.PrivateKey)}
+	jwks.addKey("key-1")
+	var block int32
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&block) == 1 {
+			started <- struct{}{}
+			<-release
+		}
+		jwks.ServeHTTP(w, req)
+	}))
+	defer s.Close()
+
+	now := time.Unix(100000, 0)
+	keys := &keySet{url: s.URL, client: http.DefaultClient, refreshInterval: time.Hour, nowFn: func() time.Time { return now }}
+	ctx := context.Background()
+	claims := map[string]interface{}{"sub": "cluster-1"}
+	tokenA := jwks.sign("key-1", claims)
+	if _, err := keys.VerifySignature(ctx, tokenA); err != nil {
+		t.Fatal(err)
+	}
+
+	// verifications of a rotated key wait for a single fetch
+	jwks.addKey("key-2")
+	tokenB := jwks.sign("key-2", claims)
+	now = now.Add(jwksMinRefreshInterval)
+	atomic.StoreInt32(&block, 1)
+	errs := make(chan error, 3)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := keys.VerifySignature(ctx, tokenB)
+			errs <- err
+		}()
+	}
+	<-started
+
+	// known keys are verified while the keys are fetched
+	if _, err := keys.VerifySignature(ctx, tokenA); err != nil {
+		t.Fatalf("expected the cached keys to verify while fetching: %v", err)
+	}
+	close(release)
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("expected the rotated key to be fetched: %v", err)
+		}
+	}
+	if jwks.requests != 2 {
+		t.Fatalf("expected the keys to be fetched once per interval, got %d requests", jwks.requests)
+	}
+}
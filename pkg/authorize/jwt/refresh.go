@@ -0,0 +1,127 @@
+package jwt
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/audit"
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+type refreshHandler struct {
+	*authorizeClusterHandler
+	authorizer  *clientAuthorizer
+	revocations *authorize.Revocations
+	grace       time.Duration
+	nowFn       func() time.Time
+}
+
+// RefreshHandler returns an HTTP endpoint that exchanges a token issued by this handler for a
+// new one. The token is passed in the "token" form parameter and must be signed by one of the keys
+// of the authorizer. It may have expired no longer than grace ago.
+//
+// The cluster credential the token was issued for must be passed as bearer token, and the cluster
+// is authorized again, so that a cluster that is no longer authorized cannot renew its token.
+// The new token keeps the scopes of the previous one. Revoked tokens are not refreshed if
+// revocations is set.
+func (a *authorizeClusterHandler) RefreshHandler(authorizer *clientAuthorizer, revocations *authorize.Revocations, grace time.Duration) http.Handler {
+	return &refreshHandler{
+		authorizeClusterHandler: a,
+		authorizer:              authorizer,
+		revocations:             revocations,
+		grace:                   grace,
+		nowFn:                   time.Now,
+	}
+}
+
+func (r *refreshHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Only POST is allowed to this endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, 8*1024)
+	defer req.Body.Close()
+
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tokenKey := "token"
+	token := req.Form.Get(tokenKey)
+	if len(token) == 0 {
+		http.Error(w, fmt.Sprintf("The '%s' parameter must be specified via URL or url-encoded form body", tokenKey), http.StatusBadRequest)
+		return
+	}
+
+	clientToken, ok := bearerToken(w, req)
+	if !ok {
+		return
+	}
+
+	subject, cluster, scopes, err := r.verify(token)
+	if err != nil {
+		tokensTotal.WithLabelValues("denied").Inc()
+		audit.Log(r.Audit, req, subject, audit.ActionRefreshToken, cluster, audit.OutcomeDenied)
+		http.Error(w, fmt.Sprintf("Not authorized: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	authorized, labels, err := authorize.AuthorizeClusterLabels(r.clusterAuth, clientToken, cluster)
+	if err != nil {
+		audit.Log(r.Audit, req, subject, audit.ActionRefreshToken, cluster, errorOutcome(err))
+		writeAuthorizeError(w, err)
+		return
+	}
+	if authorized != subject {
+		tokensTotal.WithLabelValues("denied").Inc()
+		audit.Log(r.Audit, req, subject, audit.ActionRefreshToken, cluster, audit.OutcomeDenied)
+		http.Error(w, "Not authorized: the token was issued for a different credential", http.StatusUnauthorized)
+		return
+	}
+
+	if !r.writeToken(w, subject, cluster, labels, scopes) {
+		audit.Log(r.Audit, req, subject, audit.ActionRefreshToken, cluster, audit.OutcomeFailed)
+		return
+	}
+	tokensTotal.WithLabelValues("refreshed").Inc()
+	audit.Log(r.Audit, req, subject, audit.ActionRefreshToken, cluster, audit.OutcomeAllowed)
+}
+
+// verify returns the subject, cluster and scopes of a token that may be refreshed.
+func (r *refreshHandler) verify(token string) (string, string, []string, error) {
+	public, privateObj, ok, err := r.authorizer.verify(token)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if !ok {
+		return "", "", nil, fmt.Errorf("token was not issued by this server")
+	}
+	private, ok := privateObj.(*privateClaims)
+	if !ok {
+		return "", "", nil, fmt.Errorf("token could not be validated")
+	}
+
+	if !public.Audience.Contains(tokenAudience) {
+		return "", "", nil, fmt.Errorf("token is invalid for this audience")
+	}
+	if public.Expiry == 0 {
+		return "", "", nil, fmt.Errorf("token has no expiry")
+	}
+	if r.nowFn().After(public.Expiry.Time().Add(r.grace)) {
+		return "", "", nil, fmt.Errorf("token has expired")
+	}
+
+	cluster := private.Telemeter.Labels[r.partitionKey]
+	if len(cluster) == 0 {
+		return "", "", nil, fmt.Errorf("token does not identify a cluster")
+	}
+	if r.revocations != nil {
+		if err := r.revocations.Check(public.ID, public.Subject, cluster); err != nil {
+			return "", "", nil, err
+		}
+	}
+	return public.Subject, cluster, private.Telemeter.Scopes, nil
+}
@@ -0,0 +1,150 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func TestRefreshHandler(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := NewSigner("test", key)
+	authorizer := NewClientAuthorizer("test", []crypto.PublicKey{key.Public()}, NewValidator([]string{tokenAudience}))
+
+	// tokens issued now with an expiry of one hour
+	issue := func(signer *Signer, subject string, labels map[string]string, audience string) string {
+		token, err := signer.GenerateToken(Claims(subject, labels, []string{"upload"}, authorize.Limits{}, 3600, []string{audience}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	cluster := map[string]string{"_id": "cluster-1"}
+	valid := issue(signer, "account-1", cluster, tokenAudience)
+	public, _, _, err := authorizer.verify(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := public.Expiry.Time()
+	grace := 10 * time.Minute
+
+	allow := authorize.ClusterAuthorizerFunc(func(token, cluster string) (string, error) {
+		if token != "credential" || cluster != "cluster-1" {
+			return "", errors.New("unexpected credential")
+		}
+		return "account-1", nil
+	})
+	revoked := authorize.ClusterAuthorizerFunc(func(token, cluster string) (string, error) {
+		return "", authorize.NewErrorWithCode(errors.New("cluster is not entitled"), http.StatusForbidden)
+	})
+	rebound := authorize.ClusterAuthorizerFunc(func(token, cluster string) (string, error) {
+		return "account-2", nil
+	})
+
+	dir, err := ioutil.TempDir("", "telemeter-refresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	revocations, err := authorize.NewRevocations(filepath.Join(dir, "revocations.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := revocations.Revoke(authorize.RevocationList{Tokens: []string{public.ID}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		token       string
+		credential  string
+		now         time.Time
+		clusterAuth authorize.ClusterAuthorizer
+		revocations *authorize.Revocations
+		wantCode    int
+	}{
+		{name: "valid", token: valid, now: expiry.Add(-time.Minute), clusterAuth: allow, wantCode: http.StatusOK},
+		{name: "expired within grace", token: valid, now: expiry.Add(grace - time.Second), clusterAuth: allow, wantCode: http.StatusOK},
+		{name: "expired at end of grace", token: valid, now: expiry.Add(grace), clusterAuth: allow, wantCode: http.StatusOK},
+		{name: "expired after grace", token: valid, now: expiry.Add(grace + time.Second), clusterAuth: allow, wantCode: http.StatusUnauthorized},
+		{name: "revoked cluster", token: valid, now: expiry, clusterAuth: revoked, wantCode: http.StatusForbidden},
+		{name: "revoked token", token: valid, now: expiry, clusterAuth: allow, revocations: revocations, wantCode: http.StatusUnauthorized},
+		{name: "different account", token: valid, now: expiry, clusterAuth: rebound, wantCode: http.StatusUnauthorized},
+		{name: "wrong audience", token: issue(signer, "account-1", cluster, "other"), now: expiry, clusterAuth: allow, wantCode: http.StatusUnauthorized},
+		{name: "unknown key", token: issue(NewSigner("test", otherKey), "account-1", cluster, tokenAudience), now: expiry, clusterAuth: allow, wantCode: http.StatusUnauthorized},
+		{name: "other issuer", token: issue(NewSigner("other", key), "account-1", cluster, tokenAudience), now: expiry, clusterAuth: allow, wantCode: http.StatusUnauthorized},
+		{name: "no cluster", token: issue(signer, "account-1", nil, tokenAudience), now: expiry, clusterAuth: allow, wantCode: http.StatusUnauthorized},
+		{name: "missing token", now: expiry, clusterAuth: allow, wantCode: http.StatusBadRequest},
+		{name: "missing credential", token: valid, credential: " ", now: expiry, clusterAuth: allow, wantCode: http.StatusUnauthorized},
+		{name: "invalid method", method: "GET", token: valid, now: expiry, clusterAuth: allow, wantCode: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewAuthorizeClusterHandler("_id", 3600, signer, map[string]string{"env": "test"}, tt.clusterAuth).RefreshHandler(authorizer, tt.revocations, grace).(*refreshHandler)
+			h.nowFn = func() time.Time { return tt.now }
+
+			method := tt.method
+			if len(method) == 0 {
+				method = "POST"
+			}
+			credential := tt.credential
+			if len(credential) == 0 {
+				credential = "credential"
+			}
+			req := httptest.NewRequest(method, "/authorize/refresh", strings.NewReader(url.Values{"token": []string{tt.token}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Authorization", "Bearer "+credential)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var tr authorize.TokenResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &tr); err != nil {
+				t.Fatal(err)
+			}
+			if want := map[string]string{"_id": "cluster-1", "env": "test"}; !reflect.DeepEqual(tr.Labels, want) {
+				t.Errorf("expected labels %v, got %v", want, tr.Labels)
+			}
+			client, ok, err := authorizer.AuthorizeClient(tr.Token)
+			if err != nil || !ok {
+				t.Fatalf("expected refreshed token to be valid: %v", err)
+			}
+			if len(client.TokenID) == 0 || client.TokenID == public.ID {
+				t.Errorf("expected the refreshed token to get a new ID, got %q", client.TokenID)
+			}
+			client.TokenID, client.Claims = "", nil
+			if want := (&authorize.Client{ID: "account-1", Labels: tr.Labels, Scopes: []string{"upload"}}); !reflect.DeepEqual(client, want) {
+				t.Errorf("expected client %#v, got %#v", want, client)
+			}
+		})
+	}
+}
@@ -2,10 +2,6 @@ package jwt
 
 import (
 	"crypto"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rsa"
-	"fmt"
 	"strings"
 	"time"
 
@@ -15,40 +11,37 @@ import (
 
 func NewSigner(issuer string, private crypto.PrivateKey) *Signer {
 	return &Signer{
-		iss:        issuer,
-		privateKey: private,
+		iss: issuer,
+		key: func() (string, crypto.PrivateKey) { return "", private },
+	}
+}
+
+// NewKeyringSigner returns a signer of tokens with the primary key of the keyring, identified by
+// the "kid" header of the tokens.
+func NewKeyringSigner(issuer string, keys *Keyring) *Signer {
+	return &Signer{
+		iss: issuer,
+		key: keys.Primary,
 	}
 }
 
 type Signer struct {
-	iss        string
-	privateKey crypto.PrivateKey
+	iss string
+	// key returns the ID, which may be empty, and the key tokens are signed with
+	key func() (string, crypto.PrivateKey)
 }
 
 func (j *Signer) GenerateToken(claims *jwt.Claims, privateClaims interface{}) (string, error) {
-	var alg jose.SignatureAlgorithm
-	switch privateKey := j.privateKey.(type) {
-	case *rsa.PrivateKey:
-		alg = jose.RS256
-	case *ecdsa.PrivateKey:
-		switch privateKey.Curve {
-		case elliptic.P256():
-			alg = jose.ES256
-		case elliptic.P384():
-			alg = jose.ES384
-		case elliptic.P521():
-			alg = jose.ES512
-		default:
-			return "", fmt.Errorf("unknown private key curve, must be 256, 384, or 521")
-		}
-	default:
-		return "", fmt.Errorf("unknown private key type %T, must be *rsa.PrivateKey or *ecdsa.PrivateKey", j.privateKey)
+	keyID, privateKey := j.key()
+	alg, err := algorithm(privateKey)
+	if err != nil {
+		return "", err
 	}
 
 	signer, err := jose.NewSigner(
 		jose.SigningKey{
 			Algorithm: alg,
-			Key:       j.privateKey,
+			Key:       jose.JSONWebKey{Key: privateKey, KeyID: keyID},
 		},
 		nil,
 	)
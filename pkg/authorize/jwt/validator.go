@@ -47,7 +47,7 @@ func (v *validator) Validate(_ string, public *jwt.Claims, privateObj interface{
 	switch {
 	case err == nil:
 	case err == jwt.ErrExpired:
-		return nil, errors.New("token has expired")
+		return nil, authorize.ErrTokenExpired
 	default:
 		log.Printf("unexpected validation error: %T", err)
 		return nil, errors.New("token could not be validated")
@@ -67,8 +67,12 @@ func (v *validator) Validate(_ string, public *jwt.Claims, privateObj interface{
 	}
 
 	return &authorize.Client{
-		ID:     public.Subject,
-		Labels: private.Telemeter.Labels,
+		ID:      public.Subject,
+		Labels:  private.Telemeter.Labels,
+		Scopes:  private.Telemeter.Scopes,
+		TokenID: public.ID,
+		Claims:  map[string]string{"iss": public.Issuer, "sub": public.Subject, "jti": public.ID},
+		Limits:  private.Telemeter.limits(),
 	}, nil
 }
 
@@ -0,0 +1,142 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+const serviceAccountPrefix = "system:serviceaccount:"
+
+var reviewsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "telemeter_kubernetes_reviews_total",
+	Help: "Tracks the number of tokens reviewed with the Kubernetes API, by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(reviewsTotal)
+}
+
+// Config configures the delegation of client authorization to the Kubernetes API.
+type Config struct {
+	// Audiences the reviewed tokens must be issued for, if any.
+	Audiences []string
+	// Attributes are the access service accounts are reviewed for. If Namespace is empty, the
+	// namespace of the service account is used.
+	Attributes ResourceAttributes
+	// PartitionKey is the label the client ID is set as.
+	PartitionKey string
+	// CacheTTL is how long the clients of accepted tokens are cached, up to CacheSize clients.
+	CacheTTL  time.Duration
+	CacheSize int
+	// Timeout bounds the reviews of a token.
+	Timeout time.Duration
+}
+
+type cacheEntry struct {
+	client  *authorize.Client
+	expires time.Time
+}
+
+type authorizer struct {
+	reviews ReviewClient
+	config  Config
+	nowFn   func() time.Time
+
+	mu    sync.Mutex
+	cache *simplelru.LRU
+}
+
+// NewAuthorizer returns a client authorizer of the tokens of Kubernetes service accounts. A
+// token is authenticated with a TokenReview, and its service account authorized with a
+// SubjectAccessReview for the configured access. The client ID is the namespace and name of
+// the service account, as "namespace/name". Tokens that are not authenticated are ignored
+// without an error. Service accounts that are denied access are rejected with 403, and tokens
+// that cannot be reviewed with 503.
+func NewAuthorizer(reviews ReviewClient, config Config) (authorize.ClientAuthorizer, error) {
+	if config.CacheSize <= 0 {
+		config.CacheSize = 1
+	}
+	cache, err := simplelru.NewLRU(config.CacheSize, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &authorizer{reviews: reviews, config: config, nowFn: time.Now, cache: cache}, nil
+}
+
+func (a *authorizer) AuthorizeClient(token string) (*authorize.Client, bool, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	now := a.nowFn()
+	a.mu.Lock()
+	if v, ok := a.cache.Get(key); ok {
+		entry := v.(cacheEntry)
+		if now.Before(entry.expires) {
+			a.mu.Unlock()
+			reviewsTotal.WithLabelValues("cached").Inc()
+			return entry.client, true, nil
+		}
+		a.cache.Remove(key)
+	}
+	a.mu.Unlock()
+
+	ctx := context.Background()
+	if a.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.config.Timeout)
+		defer cancel()
+	}
+
+	user, ok, err := a.reviews.ReviewToken(ctx, token, a.config.Audiences)
+	if err != nil {
+		reviewsTotal.WithLabelValues("error").Inc()
+		return nil, false, authorize.NewErrorWithCode(fmt.Errorf("unable to review token: %v", err), http.StatusServiceUnavailable)
+	}
+	if !ok {
+		reviewsTotal.WithLabelValues("unauthenticated").Inc()
+		return nil, false, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(user.Username, serviceAccountPrefix), ":")
+	if !strings.HasPrefix(user.Username, serviceAccountPrefix) || len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		reviewsTotal.WithLabelValues("denied").Inc()
+		return nil, false, authorize.NewErrorWithCode(fmt.Errorf("only service accounts may be authorized, not %s", user.Username), http.StatusForbidden)
+	}
+	namespace, name := parts[0], parts[1]
+
+	attributes := a.config.Attributes
+	if len(attributes.Namespace) == 0 {
+		attributes.Namespace = namespace
+	}
+	allowed, reason, err := a.reviews.ReviewAccess(ctx, user, attributes)
+	if err != nil {
+		reviewsTotal.WithLabelValues("error").Inc()
+		return nil, false, authorize.NewErrorWithCode(fmt.Errorf("unable to review access: %v", err), http.StatusServiceUnavailable)
+	}
+	if !allowed {
+		reviewsTotal.WithLabelValues("denied").Inc()
+		return nil, false, authorize.NewErrorWithCode(fmt.Errorf("service account %s/%s may not %s %s: %s", namespace, name, attributes.Verb, attributes.Resource, reason), http.StatusForbidden)
+	}
+
+	id := namespace + "/" + name
+	client := &authorize.Client{ID: id, Labels: make(map[string]string)}
+	if len(a.config.PartitionKey) > 0 {
+		client.Labels[a.config.PartitionKey] = id
+	}
+	reviewsTotal.WithLabelValues("allowed").Inc()
+	if a.config.CacheTTL > 0 {
+		a.mu.Lock()
+		a.cache.Add(key, cacheEntry{client: client, expires: now.Add(a.config.CacheTTL)})
+		a.mu.Unlock()
+	}
+	return client, true, nil
+}
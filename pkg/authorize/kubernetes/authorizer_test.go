@@ -0,0 +1,161 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+// fakeReviews authenticates tokens as the users they map to, and allows the users listed.
+type fakeReviews struct {
+	users   map[string]*UserInfo
+	allowed map[string]bool
+	err     error
+
+	tokenReviews  int
+	accessReviews []ResourceAttributes
+}
+
+func (f *fakeReviews) ReviewToken(ctx context.Context, token string, audiences []string) (*UserInfo, bool, error) {
+	f.tokenReviews++
+	if f.err != nil {
+		return nil, false, f.err
+	}
+	user, ok := f.users[token]
+	return user, ok, nil
+}
+
+func (f *fakeReviews) ReviewAccess(ctx context.Context, user *UserInfo, attributes ResourceAttributes) (bool, string, error) {
+	f.accessReviews = append(f.accessReviews, attributes)
+	if f.allowed[user.Username] {
+		return true, "", nil
+	}
+	return false, "no RBAC policy matched", nil
+}
+
+func TestAuthorizer(t *testing.T) {
+	reviews := &fakeReviews{
+		users: map[string]*UserInfo{
+			"allowed": {Username: "system:serviceaccount:openshift-monitoring:telemeter-client"},
+			"denied":  {Username: "system:serviceaccount:default:builder"},
+			"user":    {Username: "alice"},
+		},
+		allowed: map[string]bool{"system:serviceaccount:openshift-monitoring:telemeter-client": true, "alice": true},
+	}
+	a, err := NewAuthorizer(reviews, Config{
+		Attributes:   ResourceAttributes{Verb: "create", Group: "telemeter.openshift.io", Resource: "uploads"},
+		PartitionKey: "_id",
+		CacheTTL:     time.Minute,
+		CacheSize:    10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	a.(*authorizer).nowFn = func() time.Time { return now }
+
+	tests := []struct {
+		name     string
+		token    string
+		want     *authorize.Client
+		wantCode int
+	}{
+		{name: "allowed", token: "allowed", want: &authorize.Client{ID: "openshift-monitoring/telemeter-client", Labels: map[string]string{"_id": "openshift-monitoring/telemeter-client"}}},
+		{name: "denied", token: "denied", wantCode: http.StatusForbidden},
+		{name: "not a service account", token: "user", wantCode: http.StatusForbidden},
+		{name: "unauthenticated", token: "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, ok, err := a.AuthorizeClient(tt.token)
+			if tt.wantCode != 0 {
+				cerr, isCode := err.(authorize.ErrorWithCode)
+				if !isCode || cerr.HTTPStatusCode() != tt.wantCode {
+					t.Fatalf("want error with status %d, got %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (tt.want != nil) || !reflect.DeepEqual(client, tt.want) {
+				t.Fatalf("want client %#v, got %#v", tt.want, client)
+			}
+		})
+	}
+	if want := (ResourceAttributes{Namespace: "openshift-monitoring", Verb: "create", Group: "telemeter.openshift.io", Resource: "uploads"}); !reflect.DeepEqual(reviews.accessReviews[0], want) {
+		t.Fatalf("expected access to be reviewed in the namespace of the service account, got %#v", reviews.accessReviews[0])
+	}
+
+	// accepted tokens are cached until the TTL expires, even while the API is unavailable
+	reviews.err = errors.New("connection refused")
+	before := reviews.tokenReviews
+	if _, ok, err := a.AuthorizeClient("allowed"); !ok || err != nil {
+		t.Fatalf("expected the cached client, got %v", err)
+	}
+	if reviews.tokenReviews != before {
+		t.Fatal("expected the cached token not to be reviewed again")
+	}
+	now = now.Add(time.Minute)
+	_, ok, err := a.AuthorizeClient("allowed")
+	if cerr, isCode := err.(authorize.ErrorWithCode); ok || !isCode || cerr.HTTPStatusCode() != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while the API is unavailable, got %v", err)
+	}
+}
+
+func TestReviewClient(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer reviewer" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch req.URL.Path {
+		case "/apis/authentication.k8s.io/v1/tokenreviews":
+			var review tokenReview
+			if err := json.NewDecoder(req.Body).Decode(&review); err != nil {
+				t.Fatal(err)
+			}
+			review.Status.Authenticated = review.Spec.Token == "valid"
+			review.Status.User = UserInfo{Username: "system:serviceaccount:ns:sa", Groups: []string{"system:serviceaccounts"}}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(review)
+		case "/apis/authorization.k8s.io/v1/subjectaccessreviews":
+			var review subjectAccessReview
+			if err := json.NewDecoder(req.Body).Decode(&review); err != nil {
+				t.Fatal(err)
+			}
+			review.Status.Allowed = review.Spec.User == "system:serviceaccount:ns:sa" && review.Spec.ResourceAttributes.Verb == "create"
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(review)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer s.Close()
+
+	ctx := context.Background()
+	c := NewReviewClient(s.URL, "reviewer", s.Client())
+	user, ok, err := c.ReviewToken(ctx, "valid", nil)
+	if err != nil || !ok || user.Username != "system:serviceaccount:ns:sa" {
+		t.Fatalf("expected the token to be authenticated, got %v %t %v", user, ok, err)
+	}
+	if _, ok, err := c.ReviewToken(ctx, "invalid", nil); err != nil || ok {
+		t.Fatalf("expected the token not to be authenticated, got %t %v", ok, err)
+	}
+	if allowed, _, err := c.ReviewAccess(ctx, user, ResourceAttributes{Verb: "create", Resource: "uploads"}); err != nil || !allowed {
+		t.Fatalf("expected access to be allowed, got %t %v", allowed, err)
+	}
+	if allowed, _, err := c.ReviewAccess(ctx, user, ResourceAttributes{Verb: "delete", Resource: "uploads"}); err != nil || allowed {
+		t.Fatalf("expected access to be denied, got %t %v", allowed, err)
+	}
+	if _, _, err := NewReviewClient(s.URL, "other", s.Client()).ReviewToken(ctx, "valid", nil); err == nil {
+		t.Fatal("expected an error if the API rejects the review")
+	}
+}
@@ -0,0 +1,183 @@
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Paths of the service account credentials mounted into pods.
+const (
+	serviceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAPath    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// UserInfo is the user a token was issued to.
+type UserInfo struct {
+	Username string              `json:"username"`
+	UID      string              `json:"uid,omitempty"`
+	Groups   []string            `json:"groups,omitempty"`
+	Extra    map[string][]string `json:"extra,omitempty"`
+}
+
+// ResourceAttributes describe the access a user is reviewed for.
+type ResourceAttributes struct {
+	Namespace string `json:"namespace,omitempty"`
+	Verb      string `json:"verb"`
+	Group     string `json:"group,omitempty"`
+	Resource  string `json:"resource"`
+	Name      string `json:"name,omitempty"`
+}
+
+// ReviewClient reviews tokens and access with the Kubernetes API.
+type ReviewClient interface {
+	// ReviewToken returns the user the token was issued to, or false if it is not
+	// authenticated.
+	ReviewToken(ctx context.Context, token string, audiences []string) (*UserInfo, bool, error)
+	// ReviewAccess returns whether the user is allowed the access, and the reason if not.
+	ReviewAccess(ctx context.Context, user *UserInfo, attributes ResourceAttributes) (bool, string, error)
+}
+
+type tokenReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Token     string   `json:"token"`
+		Audiences []string `json:"audiences,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Authenticated bool     `json:"authenticated"`
+		User          UserInfo `json:"user"`
+		Error         string   `json:"error"`
+	} `json:"status"`
+}
+
+type subjectAccessReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		ResourceAttributes ResourceAttributes  `json:"resourceAttributes"`
+		User               string              `json:"user"`
+		UID                string              `json:"uid,omitempty"`
+		Groups             []string            `json:"groups,omitempty"`
+		Extra              map[string][]string `json:"extra,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Allowed         bool   `json:"allowed"`
+		Denied          bool   `json:"denied"`
+		Reason          string `json:"reason"`
+		EvaluationError string `json:"evaluationError"`
+	} `json:"status"`
+}
+
+type reviewClient struct {
+	host   string
+	token  string
+	client *http.Client
+}
+
+// NewReviewClient returns a client creating TokenReviews and SubjectAccessReviews at the
+// Kubernetes API served at host, authenticating with the bearer token.
+func NewReviewClient(host, token string, client *http.Client) ReviewClient {
+	return &reviewClient{host: host, token: token, client: client}
+}
+
+// NewInClusterReviewClient returns a review client authenticating as the service account of
+// the pod it runs in.
+func NewInClusterReviewClient() (ReviewClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if len(host) == 0 || len(port) == 0 {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+	token, err := ioutil.ReadFile(serviceAccountTokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account token: %v", err)
+	}
+	ca, err := ioutil.ReadFile(serviceAccountCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", serviceAccountCAPath)
+	}
+	return NewReviewClient("https://"+net.JoinHostPort(host, port), string(bytes.TrimSpace(token)), &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     &tls.Config{RootCAs: pool},
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}), nil
+}
+
+func (c *reviewClient) ReviewToken(ctx context.Context, token string, audiences []string) (*UserInfo, bool, error) {
+	review := tokenReview{APIVersion: "authentication.k8s.io/v1", Kind: "TokenReview"}
+	review.Spec.Token = token
+	review.Spec.Audiences = audiences
+	if err := c.create(ctx, "/apis/authentication.k8s.io/v1/tokenreviews", &review); err != nil {
+		return nil, false, err
+	}
+	if !review.Status.Authenticated {
+		return nil, false, nil
+	}
+	return &review.Status.User, true, nil
+}
+
+func (c *reviewClient) ReviewAccess(ctx context.Context, user *UserInfo, attributes ResourceAttributes) (bool, string, error) {
+	review := subjectAccessReview{APIVersion: "authorization.k8s.io/v1", Kind: "SubjectAccessReview"}
+	review.Spec.ResourceAttributes = attributes
+	review.Spec.User = user.Username
+	review.Spec.UID = user.UID
+	review.Spec.Groups = user.Groups
+	review.Spec.Extra = user.Extra
+	if err := c.create(ctx, "/apis/authorization.k8s.io/v1/subjectaccessreviews", &review); err != nil {
+		return false, "", err
+	}
+	if review.Status.Allowed && !review.Status.Denied {
+		return true, "", nil
+	}
+	reason := review.Status.Reason
+	if len(reason) == 0 {
+		reason = review.Status.EvaluationError
+	}
+	return false, reason, nil
+}
+
+// create posts the review and decodes the reviewed object into it.
+func (c *reviewClient) create(ctx context.Context, path string, review interface{}) error {
+	data, err := json.Marshal(review)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.host+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("the Kubernetes API responded with %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(review)
+}
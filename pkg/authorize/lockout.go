@@ -0,0 +1,182 @@
+package authorize
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/prometheus/client_golang/prometheus"
+
+	telemeter_http "github.com/openshift/telemeter/pkg/http"
+)
+
+var (
+	authorizeLockouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_authorize_lockouts_total",
+		Help: "Tracks the number of times a source IP or cluster ID was locked out after repeated authorization failures, by type.",
+	}, []string{"type"})
+	authorizeLockedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "telemeter_authorize_locked_requests_total",
+		Help: "Tracks the number of authorization requests rejected because their source IP or cluster ID was locked out.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(authorizeLockouts, authorizeLockedRequests)
+}
+
+type lockoutEntry struct {
+	// failures within the window starting at first
+	failures int
+	first    time.Time
+	// lockouts is the number of consecutive lockouts, doubling their duration
+	lockouts int
+	until    time.Time
+}
+
+// Lockout tracks authorization failures by source IP and cluster ID and locks out a source or
+// cluster that fails too often. Each consecutive lockout lasts twice as long as the previous one,
+// up to a maximum.
+type Lockout struct {
+	threshold   int
+	window      time.Duration
+	duration    time.Duration
+	maxDuration time.Duration
+	nowFn       func() time.Time
+
+	mu  sync.Mutex
+	lru *simplelru.LRU
+}
+
+// NewLockout returns a Lockout that locks out a source or cluster for duration after threshold
+// failures within window. Failures older than window are forgotten, as are the lockouts of a
+// source or cluster that did not fail for maxDuration after its last lockout. At most size
+// sources and clusters are tracked, evicting the least recently seen.
+func NewLockout(threshold int, window, duration, maxDuration time.Duration, size int) (*Lockout, error) {
+	lru, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+	if maxDuration < duration {
+		maxDuration = duration
+	}
+	return &Lockout{
+		threshold:   threshold,
+		window:      window,
+		duration:    duration,
+		maxDuration: maxDuration,
+		nowFn:       time.Now,
+		lru:         lru,
+	}, nil
+}
+
+// Locked returns how long the first of the given keys remains locked out, or false if none is.
+func (l *Lockout) Locked(keys ...string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.nowFn()
+	for _, key := range keys {
+		v, ok := l.lru.Peek(key)
+		if !ok {
+			continue
+		}
+		if e := v.(*lockoutEntry); now.Before(e.until) {
+			return e.until.Sub(now), true
+		}
+	}
+	return 0, false
+}
+
+// Fail records an authorization failure for each key. It returns true if one of the keys
+// was locked out as a result.
+func (l *Lockout) Fail(keys ...string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.nowFn()
+	locked := false
+	for _, key := range keys {
+		e := &lockoutEntry{}
+		if v, ok := l.lru.Get(key); ok {
+			e = v.(*lockoutEntry)
+		}
+		if now.Sub(e.first) > l.window {
+			e.failures, e.first = 0, now
+		}
+		if !e.until.IsZero() && now.Sub(e.until) > l.maxDuration {
+			e.lockouts = 0
+		}
+		e.failures++
+		if e.failures >= l.threshold {
+			d := l.duration << uint(e.lockouts)
+			if d > l.maxDuration || d <= 0 {
+				d = l.maxDuration
+			}
+			e.lockouts++
+			e.until = now.Add(d)
+			e.failures, e.first = 0, now
+			locked = true
+			authorizeLockouts.WithLabelValues(keyType(key)).Inc()
+		}
+		l.lru.Add(key, e)
+	}
+	return locked
+}
+
+// Succeed forgets the failures and lockouts of the given keys.
+func (l *Lockout) Succeed(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		l.lru.Remove(key)
+	}
+}
+
+// keyType returns the type of a key as created by the lockout handler.
+func keyType(key string) string {
+	if i := strings.IndexByte(key, ':'); i >= 0 {
+		return key[:i]
+	}
+	return "unknown"
+}
+
+// NewLockoutHandler rejects requests to next with 429 while their source IP or the cluster of
+// their "id" form parameter is locked out, without calling next. Responses of next with status
+// 401 or 403 count as failures, successful responses reset the failures of the source and cluster.
+func NewLockoutHandler(l *Lockout, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Body = http.MaxBytesReader(w, req.Body, 8*1024)
+		keys := make([]string, 0, 2)
+		if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			keys = append(keys, "ip:"+ip)
+		}
+		// a malformed form is left to next to reject
+		if err := req.ParseForm(); err == nil {
+			if cluster := req.Form.Get("id"); len(cluster) > 0 {
+				keys = append(keys, "cluster:"+cluster)
+			}
+		}
+
+		if d, ok := l.Locked(keys...); ok {
+			authorizeLockedRequests.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(d.Seconds())+1))
+			http.Error(w, fmt.Sprintf("Too many failed authorization attempts, try again in %s", d.Round(time.Second)), http.StatusTooManyRequests)
+			return
+		}
+
+		sw := telemeter_http.NewStatusWriter(w)
+		next.ServeHTTP(sw, req)
+		switch {
+		case sw.Code == http.StatusUnauthorized || sw.Code == http.StatusForbidden:
+			l.Fail(keys...)
+		case sw.Code >= 200 && sw.Code < 300:
+			l.Succeed(keys...)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package authorize
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockoutHandler(t *testing.T) {
+	l, err := NewLockout(10, 5*time.Minute, time.Minute, 4*time.Minute, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(0, 0)
+	l.nowFn = func() time.Time { return now }
+
+	calls := 0
+	h := NewLockoutHandler(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if req.Header.Get("Authorization") != "Bearer valid" {
+			http.Error(w, "Not authorized", http.StatusUnauthorized)
+		}
+	}))
+	authorize := func(ip, cluster, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/authorize", strings.NewReader(url.Values{"id": []string{cluster}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(ip, cluster, token string, want int) {
+		t.Helper()
+		before := calls
+		w := authorize(ip, cluster, token)
+		if w.Code != want {
+			t.Fatalf("%s %s: want status %d, got %d", ip, cluster, want, w.Code)
+		}
+		if want == http.StatusTooManyRequests && (calls != before || len(w.Header().Get("Retry-After")) == 0) {
+			t.Fatalf("%s %s: expected a locked out request to be rejected before authorization with Retry-After", ip, cluster)
+		}
+	}
+
+	// hammer with bad credentials from one source
+	for i := 0; i < 10; i++ {
+		expect("10.0.0.1", "cluster-a", "bad", http.StatusUnauthorized)
+	}
+	expect("10.0.0.1", "cluster-a", "bad", http.StatusTooManyRequests)
+	expect("10.0.0.1", "cluster-b", "valid", http.StatusTooManyRequests)
+	// the cluster is locked out from any source
+	expect("10.0.0.2", "cluster-a", "valid", http.StatusTooManyRequests)
+	expect("10.0.0.2", "cluster-b", "valid", http.StatusOK)
+
+	// recover after the lockout
+	now = now.Add(time.Minute)
+	expect("10.0.0.1", "cluster-a", "bad", http.StatusUnauthorized)
+
+	// a repeated lockout lasts twice as long
+	for i := 0; i < 9; i++ {
+		expect("10.0.0.1", "cluster-a", "bad", http.StatusUnauthorized)
+	}
+	now = now.Add(time.Minute)
+	expect("10.0.0.1", "cluster-a", "bad", http.StatusTooManyRequests)
+	now = now.Add(time.Minute)
+	expect("10.0.0.1", "cluster-a", "valid", http.StatusOK)
+
+	// success resets the failures
+	for i := 0; i < 9; i++ {
+		expect("10.0.0.1", "cluster-a", "bad", http.StatusUnauthorized)
+	}
+	expect("10.0.0.1", "cluster-a", "valid", http.StatusOK)
+	expect("10.0.0.1", "cluster-a", "bad", http.StatusUnauthorized)
+	expect("10.0.0.1", "cluster-a", "valid", http.StatusOK)
+
+	// failures decay after the window
+	for i := 0; i < 9; i++ {
+		expect("10.0.0.3", "cluster-c", "bad", http.StatusUnauthorized)
+	}
+	now = now.Add(5*time.Minute + time.Second)
+	expect("10.0.0.3", "cluster-c", "bad", http.StatusUnauthorized)
+	expect("10.0.0.3", "cluster-c", "bad", http.StatusUnauthorized)
+}
+
+func TestLockoutDuration(t *testing.T) {
+	l, err := NewLockout(1, time.Minute, time.Minute, 3*time.Minute, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(0, 0)
+	l.nowFn = func() time.Time { return now }
+
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		if !l.Fail("ip:a") {
+			t.Fatal("expected a lockout")
+		}
+		if d, ok := l.Locked("ip:a"); !ok || d != want {
+			t.Fatalf("want lockout of %s, got %s", want, d)
+		}
+		now = now.Add(want)
+	}
+
+	// lockouts are forgotten if there were no failures for the maximum duration
+	now = now.Add(3*time.Minute + time.Second)
+	l.Fail("ip:a")
+	if d, _ := l.Locked("ip:a"); d != time.Minute {
+		t.Fatalf("want lockout of %s, got %s", time.Minute, d)
+	}
+}
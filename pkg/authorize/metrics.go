@@ -0,0 +1,115 @@
+package authorize
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Results of authorizations, as recorded by Metrics.
+const (
+	ResultSuccess       = "success"
+	ResultInvalidToken  = "invalid_token"
+	ResultExpired       = "expired"
+	ResultRevoked       = "revoked"
+	ResultDenied        = "denied"
+	ResultUpstreamError = "upstream_error"
+)
+
+// ErrTokenExpired is returned by authorizers for tokens that are valid but have expired.
+var ErrTokenExpired = errors.New("token has expired")
+
+// Metrics instruments the authorization of requests. Its methods may be called on a nil
+// Metrics, which records nothing.
+type Metrics struct {
+	authorizations *prometheus.CounterVec
+	duration       *prometheus.HistogramVec
+	cached         prometheus.Gauge
+}
+
+// NewMetrics returns metrics registered with reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		authorizations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "telemeter_authorizations_total",
+			Help: "Tracks the number of authorized requests, by result and the type of credentials presented.",
+		}, []string{"result", "extractor"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "telemeter_authorizer_duration_seconds",
+			Help:    "The duration of calls to authorizers, by authorizer.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"authorizer"}),
+		cached: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "telemeter_authorize_cached_decisions",
+			Help: "The number of cluster authorization decisions currently cached.",
+		}),
+	}
+	reg.MustRegister(m.authorizations, m.duration, m.cached)
+	return m
+}
+
+// ObserveAuthorization records the result of authorizing the credentials of the given type.
+func (m *Metrics) ObserveAuthorization(extractor string, err error) {
+	if m == nil {
+		return
+	}
+	m.authorizations.WithLabelValues(Result(err), extractor).Inc()
+}
+
+// ObserveDuration records the duration of a call to the authorizer that started at start.
+func (m *Metrics) ObserveDuration(authorizer string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.duration.WithLabelValues(authorizer).Observe(time.Since(start).Seconds())
+}
+
+// addCached adjusts the number of cached decisions by delta.
+func (m *Metrics) addCached(delta int) {
+	if m == nil {
+		return
+	}
+	m.cached.Add(float64(delta))
+}
+
+// Result classifies the error of an authorizer as one of the results recorded by Metrics.
+// Errors with a status code of 500 and above are upstream errors, and 403, 413 and 429
+// denials. All other errors are invalid tokens.
+func Result(err error) string {
+	if err == nil {
+		return ResultSuccess
+	}
+	if IsRevoked(err) {
+		return ResultRevoked
+	}
+	if err == ErrTokenExpired {
+		return ResultExpired
+	}
+	if scerr, ok := err.(ErrorWithCode); ok {
+		switch status := scerr.HTTPStatusCode(); {
+		case status >= http.StatusInternalServerError:
+			return ResultUpstreamError
+		case status == http.StatusForbidden, status == http.StatusRequestEntityTooLarge, status == http.StatusTooManyRequests:
+			return ResultDenied
+		}
+	}
+	return ResultInvalidToken
+}
+
+// credentialsType returns the type of credentials recorded by Metrics.
+func credentialsType(creds Credentials) string {
+	switch {
+	case creds.Signature != nil:
+		return "hmac"
+	case creds.Certificate != nil:
+		return "certificate"
+	case len(creds.Username) > 0:
+		return "basic"
+	case len(creds.Token) > 0:
+		return "bearer"
+	default:
+		return "none"
+	}
+}
@@ -0,0 +1,143 @@
+package authorize
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gather returns the value of every series of r, keyed by metric name and label values in the
+// order of their names. The value of a histogram is its sample count.
+func gather(t *testing.T, r *prometheus.Registry) map[string]float64 {
+	t.Helper()
+	families, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.Metric {
+			key := f.GetName()
+			for _, l := range m.Label {
+				key += "/" + l.GetValue()
+			}
+			switch {
+			case m.Counter != nil:
+				got[key] = m.GetCounter().GetValue()
+			case m.Gauge != nil:
+				got[key] = m.GetGauge().GetValue()
+			case m.Histogram != nil:
+				got[key] = float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return got
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	authorizer := AuthorizerFunc(func(creds Credentials) (*Client, bool, error) {
+		switch creds.Token {
+		case "valid":
+			return &Client{ID: "cluster-1"}, true, nil
+		case "expired":
+			return nil, false, ErrTokenExpired
+		case "revoked":
+			return nil, false, NewErrorWithCode(ErrTokenRevoked, http.StatusUnauthorized)
+		case "denied":
+			return nil, false, NewErrorWithCode(errors.New("denied"), http.StatusForbidden)
+		case "down":
+			return nil, false, NewErrorWithCode(errors.New("down"), http.StatusServiceUnavailable)
+		}
+		return nil, false, nil
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		basic  bool
+		want   string
+	}{
+		{name: "success", header: "Bearer valid", want: "bearer/success"},
+		{name: "basic auth", header: "valid", basic: true, want: "basic/success"},
+		{name: "unknown token", header: "Bearer other", want: "bearer/invalid_token"},
+		{name: "no credentials", want: "none/invalid_token"},
+		{name: "expired", header: "Bearer expired", want: "bearer/expired"},
+		{name: "revoked", header: "Bearer revoked", want: "bearer/revoked"},
+		{name: "denied", header: "Bearer denied", want: "bearer/denied"},
+		{name: "upstream error", header: "Bearer down", want: "bearer/upstream_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := prometheus.NewRegistry()
+			m := NewMetrics(r)
+			h := m.Middleware(authorizer, BearerToken(), BasicAuth())(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+			req := httptest.NewRequest("POST", "/upload", nil)
+			if tt.basic {
+				req.SetBasicAuth("user", tt.header)
+			} else if len(tt.header) > 0 {
+				req.Header.Set("Authorization", tt.header)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			want := map[string]float64{
+				"telemeter_authorizations_total/" + tt.want: 1,
+				"telemeter_authorize_cached_decisions":      0,
+			}
+			if tt.want != "none/invalid_token" {
+				want["telemeter_authorizer_duration_seconds/client"] = 1
+			}
+			if got := gather(t, r); !reflect.DeepEqual(got, want) {
+				t.Fatalf("want metrics %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestMetricsCachedDecisions(t *testing.T) {
+	r := prometheus.NewRegistry()
+	m := NewMetrics(r)
+	now := time.Unix(1000, 0)
+	down := false
+	next := ClusterAuthorizerFunc(func(token, cluster string) (string, error) {
+		if down {
+			return "", NewErrorWithCode(errors.New("down"), http.StatusServiceUnavailable)
+		}
+		if strings.HasPrefix(cluster, "denied") {
+			return "", NewErrorWithCode(errors.New("denied"), http.StatusForbidden)
+		}
+		return "account", nil
+	})
+	ca, err := m.NewCachingClusterAuthorizer(next, 2, time.Minute, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.(*cachingAuthorizer).nowFn = func() time.Time { return now }
+
+	cached := func() float64 {
+		return gather(t, r)["telemeter_authorize_cached_decisions"]
+	}
+	for _, cluster := range []string{"a", "denied-b", "a"} {
+		ca.AuthorizeCluster("token", cluster)
+	}
+	if got := cached(); got != 2 {
+		t.Fatalf("want 2 cached decisions, got %v", got)
+	}
+	ca.AuthorizeCluster("token", "c")
+	if got := cached(); got != 2 {
+		t.Fatalf("want evicted decisions to be removed, got %v", got)
+	}
+	// errors are not cached, so the expired decision is not replaced
+	now = now.Add(2 * time.Minute)
+	down = true
+	ca.AuthorizeCluster("token", "c")
+	if got := cached(); got != 1 {
+		t.Fatalf("want expired decisions to be removed, got %v", got)
+	}
+}
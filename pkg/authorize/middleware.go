@@ -0,0 +1,248 @@
+package authorize
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// Codes of the error responses of Middleware and RequireScope. They match the codes of the
+// error envelope of the server.
+const (
+	CodeUnauthorized      = "unauthorized"
+	CodeForbidden         = "forbidden"
+	CodeUnavailable       = "unavailable"
+	CodeTooLarge          = "too_large"
+	CodeInsufficientScope = "insufficient_scope"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// errNoCredentials is returned for requests without credentials any extractor accepts.
+var errNoCredentials = errors.New("no credentials presented")
+
+// Credentials are the credentials presented by a request.
+type Credentials struct {
+	// Token is the bearer token, or the password of basic authentication.
+	Token string
+	// Username is the user of basic authentication.
+	Username string
+	// Certificate is the verified client certificate.
+	Certificate *x509.Certificate
+	// Signature is the signature of a request signed with a shared secret.
+	Signature *Signature
+}
+
+// An Extractor adds the credentials it finds in a request to creds, and returns false if
+// it found none.
+type Extractor func(req *http.Request, creds *Credentials) (bool, error)
+
+// BearerToken extracts the token of an "Authorization: Bearer" header.
+func BearerToken() Extractor {
+	return func(req *http.Request, creds *Credentials) (bool, error) {
+		header := req.Header.Get("Authorization")
+		if len(header) == 0 {
+			return false, nil
+		}
+		auth := strings.SplitN(header, " ", 2)
+		if strings.ToLower(auth[0]) != "bearer" {
+			return false, nil
+		}
+		if len(auth) != 2 || len(strings.TrimSpace(auth[1])) == 0 {
+			return false, errors.New("invalid Authorization header")
+		}
+		creds.Token = auth[1]
+		return true, nil
+	}
+}
+
+// BasicAuth extracts the user and password of basic authentication. The password is set as
+// the token of the credentials.
+func BasicAuth() Extractor {
+	return func(req *http.Request, creds *Credentials) (bool, error) {
+		user, password, ok := req.BasicAuth()
+		if !ok {
+			return false, nil
+		}
+		creds.Username, creds.Token = user, password
+		return true, nil
+	}
+}
+
+// ClientCertificate extracts the verified client certificate of TLS requests, or the one
+// exposed by NewCertificateHandler.
+func ClientCertificate() Extractor {
+	return func(req *http.Request, creds *Credentials) (bool, error) {
+		if cert, ok := CertificateFromContext(req.Context()); ok {
+			creds.Certificate = cert
+			return true, nil
+		}
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+			creds.Certificate = req.TLS.VerifiedChains[0][0]
+			return true, nil
+		}
+		return false, nil
+	}
+}
+
+// Authorizer authorizes the client presenting credentials. It returns false without an error
+// if it does not handle the credentials. Errors implementing ErrorWithCode are responded to
+// with their status code, such as 403 or 503, all other errors with 401.
+type Authorizer interface {
+	Authorize(creds Credentials) (*Client, bool, error)
+}
+
+// AuthorizerFunc implements Authorizer.
+type AuthorizerFunc func(creds Credentials) (*Client, bool, error)
+
+func (f AuthorizerFunc) Authorize(creds Credentials) (*Client, bool, error) {
+	return f(creds)
+}
+
+// Authorizers authorizes credentials with the first of its authorizers accepting them.
+// If none does, the first error is returned.
+type Authorizers []Authorizer
+
+func (as Authorizers) Authorize(creds Credentials) (*Client, bool, error) {
+	var firstErr error
+	for _, a := range as {
+		client, ok, err := a.Authorize(creds)
+		if ok {
+			return client, true, nil
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, false, firstErr
+}
+
+// TokenAuthorizer authorizes the token of credentials without a certificate or signature.
+func TokenAuthorizer(authorizer ClientAuthorizer) Authorizer {
+	return AuthorizerFunc(func(creds Credentials) (*Client, bool, error) {
+		if creds.Certificate != nil || creds.Signature != nil || len(creds.Token) == 0 {
+			return nil, false, nil
+		}
+		return authorizer.AuthorizeClient(creds.Token)
+	})
+}
+
+// CertificateAuthorizer authorizes the client derived by m from the certificate of
+// credentials, granting it the given scopes.
+func CertificateAuthorizer(m *CertificateMapper, scopes ...string) Authorizer {
+	return AuthorizerFunc(func(creds Credentials) (*Client, bool, error) {
+		if creds.Certificate == nil {
+			return nil, false, nil
+		}
+		client, err := m.Client(creds.Certificate)
+		if err != nil {
+			return nil, false, err
+		}
+		client.Scopes = scopes
+		return client, true, nil
+	})
+}
+
+// Middleware returns a handler wrapper that authorizes the credentials of requests, as
+// extracted by the extractors or from a bearer token if none are given, and serves
+// authorized requests with the client in their context. Requests without credentials or
+// with credentials that are not authorized are responded to with the JSON error envelope.
+func Middleware(authorizer Authorizer, extractors ...Extractor) func(http.Handler) http.Handler {
+	var m *Metrics
+	return m.Middleware(authorizer, extractors...)
+}
+
+// Middleware returns the Middleware of the authorizer and extractors that records the result
+// and duration of every authorization.
+func (m *Metrics) Middleware(authorizer Authorizer, extractors ...Extractor) func(http.Handler) http.Handler {
+	if len(extractors) == 0 {
+		extractors = []Extractor{BearerToken()}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var creds Credentials
+			var found bool
+			for _, extract := range extractors {
+				ok, err := extract(req, &creds)
+				if err != nil {
+					m.ObserveAuthorization(credentialsType(creds), err)
+					writeAuthorizeError(w, req, err)
+					return
+				}
+				found = found || ok
+			}
+			if !found {
+				m.ObserveAuthorization(credentialsType(creds), errNoCredentials)
+				writeAuthorizeError(w, req, errNoCredentials)
+				return
+			}
+
+			start := time.Now()
+			client, ok, err := authorizer.Authorize(creds)
+			m.ObserveDuration("client", start)
+			if err == nil && !ok {
+				err = errors.New("credentials not accepted")
+			}
+			m.ObserveAuthorization(credentialsType(creds), err)
+			if err != nil {
+				writeAuthorizeError(w, req, err)
+				return
+			}
+
+			if span := opentracing.SpanFromContext(req.Context()); span != nil {
+				span.SetTag("client.id", client.ID)
+			}
+			next.ServeHTTP(w, req.WithContext(WithClient(req.Context(), client)))
+		})
+	}
+}
+
+// writeAuthorizeError responds with the status of errors with a code, and 401 otherwise.
+func writeAuthorizeError(w http.ResponseWriter, req *http.Request, err error) {
+	status, code := http.StatusUnauthorized, CodeUnauthorized
+	if cerr, ok := err.(ErrorWithCode); ok {
+		status = cerr.HTTPStatusCode()
+		switch {
+		case status == http.StatusForbidden:
+			code = CodeForbidden
+		case status == http.StatusRequestEntityTooLarge:
+			code = CodeTooLarge
+		case status >= http.StatusInternalServerError:
+			code = CodeUnavailable
+		}
+	}
+	if IsRevoked(err) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, err.Error()))
+	}
+	writeErrorResponse(w, req, status, &errorResponse{Code: code, Message: fmt.Sprintf("not authorized: %v", err)})
+}
+
+// errorResponse mirrors the JSON error envelope of the server.
+type errorResponse struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestID string                 `json:"request_id"`
+}
+
+func writeErrorResponse(w http.ResponseWriter, req *http.Request, status int, body *errorResponse) {
+	body.RequestID = req.Header.Get(requestIDHeader)
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("error marshaling error response: %v", err)
+		http.Error(w, body.Message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(data); err != nil {
+		log.Printf("error writing error response: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package authorize
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue("cluster-1", nil, nil)
+	tokens := TokenAuthorizer(NewStaticAuthorizer(map[string]*Client{"secret": {ID: "token-client"}}))
+	failing := func(err error) Authorizer {
+		return AuthorizerFunc(func(creds Credentials) (*Client, bool, error) {
+			if creds.Token == "secret" {
+				return nil, false, err
+			}
+			return nil, false, nil
+		})
+	}
+	revoking := AuthorizerFunc(func(creds Credentials) (*Client, bool, error) {
+		if creds.Token == "revoked" {
+			return nil, false, NewErrorWithCode(ErrTokenRevoked, http.StatusUnauthorized)
+		}
+		return nil, false, nil
+	})
+
+	tests := []struct {
+		name       string
+		authorizer Authorizer
+		extractors []Extractor
+		cert       bool
+		header     string
+		basic      [2]string
+		wantCode   int
+		wantError  string
+		want       string
+	}{
+		{name: "bearer token", authorizer: tokens, header: "Bearer secret", wantCode: http.StatusOK, want: "token-client"},
+		{name: "no credentials", authorizer: tokens, wantCode: http.StatusUnauthorized, wantError: CodeUnauthorized},
+		{name: "empty bearer token", authorizer: tokens, header: "Bearer ", wantCode: http.StatusUnauthorized, wantError: CodeUnauthorized},
+		{name: "unknown token", authorizer: tokens, header: "Bearer other", wantCode: http.StatusUnauthorized, wantError: CodeUnauthorized},
+		{name: "basic auth", authorizer: tokens, extractors: []Extractor{BasicAuth()}, basic: [2]string{"user", "secret"}, wantCode: http.StatusOK, want: "token-client"},
+		{name: "basic auth not extracted", authorizer: tokens, basic: [2]string{"user", "secret"}, wantCode: http.StatusUnauthorized, wantError: CodeUnauthorized},
+		{name: "certificate", authorizer: CertificateAuthorizer(&CertificateMapper{}), extractors: []Extractor{ClientCertificate()}, cert: true, wantCode: http.StatusOK, want: "cluster-1"},
+		{name: "certificate required", authorizer: CertificateAuthorizer(&CertificateMapper{}), extractors: []Extractor{ClientCertificate()}, header: "Bearer secret", wantCode: http.StatusUnauthorized, wantError: CodeUnauthorized},
+		{name: "certificate before token", authorizer: Authorizers{CertificateAuthorizer(&CertificateMapper{}), tokens}, extractors: []Extractor{ClientCertificate(), BearerToken()}, cert: true, header: "Bearer secret", wantCode: http.StatusOK, want: "cluster-1"},
+		{name: "token without certificate", authorizer: Authorizers{CertificateAuthorizer(&CertificateMapper{}), tokens}, extractors: []Extractor{ClientCertificate(), BearerToken()}, header: "Bearer secret", wantCode: http.StatusOK, want: "token-client"},
+		{name: "forbidden", authorizer: failing(NewErrorWithCode(errors.New("denied"), http.StatusForbidden)), header: "Bearer secret", wantCode: http.StatusForbidden, wantError: CodeForbidden},
+		{name: "unavailable", authorizer: failing(NewErrorWithCode(errors.New("down"), http.StatusServiceUnavailable)), header: "Bearer secret", wantCode: http.StatusServiceUnavailable, wantError: CodeUnavailable},
+		{name: "error", authorizer: failing(errors.New("invalid")), header: "Bearer secret", wantCode: http.StatusUnauthorized, wantError: CodeUnauthorized},
+		{name: "revoked", authorizer: revoking, header: "Bearer revoked", wantCode: http.StatusUnauthorized, wantError: CodeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				client, _ := FromContext(req.Context())
+				got = client.ID
+			})
+			req := httptest.NewRequest("POST", "/upload", strings.NewReader(""))
+			if tt.cert {
+				req = req.WithContext(WithCertificate(req.Context(), cert))
+			}
+			if len(tt.header) > 0 {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if len(tt.basic[0]) > 0 {
+				req.SetBasicAuth(tt.basic[0], tt.basic[1])
+			}
+			w := httptest.NewRecorder()
+			Middleware(tt.authorizer, tt.extractors...)(next).ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("want status %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if got != tt.want {
+				t.Fatalf("want client %q, got %q", tt.want, got)
+			}
+			if len(tt.wantError) == 0 {
+				return
+			}
+			var body errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("expected a JSON error envelope: %v", err)
+			}
+			if body.Code != tt.wantError {
+				t.Fatalf("want error code %s, got %s", tt.wantError, body.Code)
+			}
+			if tt.name == "revoked" && !strings.Contains(w.Header().Get("WWW-Authenticate"), "invalid_token") {
+				t.Fatalf("expected revoked tokens to be reported as invalid, got %q", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package authorize
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Partitioner derives the partition, or tenant, that the data of an authorized client is
+// stored and forwarded under.
+type Partitioner interface {
+	// Partition returns the partition of the client, or false if it cannot be derived.
+	Partition(client *Client) (string, bool)
+}
+
+// PartitionerFunc implements Partitioner.
+type PartitionerFunc func(client *Client) (string, bool)
+
+func (f PartitionerFunc) Partition(client *Client) (string, bool) {
+	return f(client)
+}
+
+// PartitionByID partitions data by the ID of the client.
+func PartitionByID() Partitioner {
+	return PartitionerFunc(func(client *Client) (string, bool) {
+		return client.ID, len(client.ID) > 0
+	})
+}
+
+// PartitionByLabel partitions data by the value of a label of the client.
+func PartitionByLabel(label string) Partitioner {
+	return PartitionerFunc(func(client *Client) (string, bool) {
+		v := client.Labels[label]
+		return v, len(v) > 0
+	})
+}
+
+// PartitionByClaim partitions data by a claim of the token the client was authorized with.
+func PartitionByClaim(claim string) Partitioner {
+	return PartitionerFunc(func(client *Client) (string, bool) {
+		v := client.Claims[claim]
+		return v, len(v) > 0
+	})
+}
+
+// PartitionByIssuer partitions data by the tenant the issuer of the token of the client is
+// mapped to, so that all clusters of an issuer share a partition.
+func PartitionByIssuer(tenants map[string]string) Partitioner {
+	return PartitionerFunc(func(client *Client) (string, bool) {
+		v := tenants[client.Claims["iss"]]
+		return v, len(v) > 0
+	})
+}
+
+// WithPartition returns a copy of the client whose label is set to its partition.
+func WithPartition(client *Client, label string, p Partitioner) (*Client, bool) {
+	partition, ok := p.Partition(client)
+	if !ok {
+		return nil, false
+	}
+	labels := make(map[string]string, len(client.Labels)+1)
+	for k, v := range client.Labels {
+		labels[k] = v
+	}
+	labels[label] = partition
+	c := *client
+	c.Labels = labels
+	return &c, true
+}
+
+// WithReadPartition returns a context restricting reads to the partition.
+func WithReadPartition(ctx context.Context, partition string) context.Context {
+	return context.WithValue(ctx, readPartitionKey, partition)
+}
+
+// ReadPartitionFromContext returns the partition reads are restricted to, if they are.
+func ReadPartitionFromContext(ctx context.Context) (string, bool) {
+	partition, ok := ctx.Value(readPartitionKey).(string)
+	return partition, ok
+}
+
+// NewReadPartitionHandler restricts the reads of clients that were not granted the admin
+// scope to their own partition, as derived by p, or from their label if p is nil. Clients
+// without a partition are responded to with 403. It must be wrapped by a handler authorizing
+// the client.
+func NewReadPartitionHandler(label string, p Partitioner, next http.Handler) http.Handler {
+	if p == nil {
+		p = PartitionByLabel(label)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		client, ok := FromContext(req.Context())
+		if !ok {
+			writeErrorResponse(w, req, http.StatusUnauthorized, &errorResponse{Code: CodeUnauthorized, Message: "not authorized"})
+			return
+		}
+		if client.HasScope(ScopeAdmin) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		partition, ok := p.Partition(client)
+		if !ok {
+			writeErrorResponse(w, req, http.StatusForbidden, &errorResponse{
+				Code:    CodeForbidden,
+				Message: fmt.Sprintf("the client has no %s partition to read, the %s scope is required to read all partitions", label, ScopeAdmin),
+			})
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(WithReadPartition(req.Context(), partition)))
+	})
+}
@@ -0,0 +1,305 @@
+package authorize
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CodeClusterConflict is the code of the error response of uploads of a cluster bound to a
+// different account.
+const CodeClusterConflict = "cluster_conflict"
+
+var clusterConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "telemeter_cluster_conflicts_total",
+	Help: "Tracks the number of requests for a cluster bound to a different account, by stage: authorize or upload.",
+}, []string{"stage"})
+
+func init() {
+	prometheus.MustRegister(clusterConflicts)
+}
+
+// ErrClusterRegistered is returned when registering a cluster that is bound to another account.
+type ErrClusterRegistered struct {
+	Cluster string
+}
+
+func (e *ErrClusterRegistered) Error() string {
+	return fmt.Sprintf("cluster %s is registered to a different account", e.Cluster)
+}
+
+// ClusterRegistry binds cluster identifiers to the account that first registered them.
+type ClusterRegistry interface {
+	// Register binds cluster to account. Registering a cluster again with the same account
+	// succeeds, registering it with a different account fails with *ErrClusterRegistered.
+	Register(cluster, account string) error
+	// Bind binds cluster to account, replacing any existing binding. An empty account
+	// removes the binding.
+	Bind(cluster, account string) error
+	// Bindings returns the account of every bound cluster.
+	Bindings() map[string]string
+}
+
+type binding struct {
+	account string
+	expires time.Time
+}
+
+type memoryRegistry struct {
+	ttl   time.Duration
+	nowFn func() time.Time
+
+	mu       sync.Mutex
+	bindings map[string]binding
+	// swept is when expired bindings were last removed.
+	swept time.Time
+}
+
+// NewMemoryRegistry returns a cluster registry held in memory. A binding expires if its cluster
+// is not registered again within ttl, so that the ID of a decommissioned cluster may be reused,
+// or never if ttl is zero. Expired bindings are removed as the registry is used, at most once
+// per ttl. Bindings are lost on restart and are not shared between servers.
+func NewMemoryRegistry(ttl time.Duration) ClusterRegistry {
+	return &memoryRegistry{ttl: ttl, nowFn: time.Now, bindings: make(map[string]binding)}
+}
+
+func (r *memoryRegistry) Register(cluster, account string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.nowFn()
+	r.expire(now)
+	if existing, ok := r.bindings[cluster]; ok && existing.account != account && (r.ttl == 0 || now.Before(existing.expires)) {
+		return &ErrClusterRegistered{Cluster: cluster}
+	}
+	r.bindings[cluster] = binding{account: account, expires: now.Add(r.ttl)}
+	return nil
+}
+
+func (r *memoryRegistry) Bind(cluster, account string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.nowFn()
+	r.expire(now)
+	if len(account) == 0 {
+		delete(r.bindings, cluster)
+		return nil
+	}
+	r.bindings[cluster] = binding{account: account, expires: now.Add(r.ttl)}
+	return nil
+}
+
+func (r *memoryRegistry) Bindings() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.nowFn()
+	bindings := make(map[string]string, len(r.bindings))
+	for cluster, b := range r.bindings {
+		if r.ttl > 0 && !now.Before(b.expires) {
+			continue
+		}
+		bindings[cluster] = b.account
+	}
+	return bindings
+}
+
+// expire removes the expired bindings unless it did so within the ttl. The caller must hold
+// the lock.
+func (r *memoryRegistry) expire(now time.Time) {
+	if r.ttl == 0 || now.Sub(r.swept) < r.ttl {
+		return
+	}
+	r.swept = now
+	for cluster, b := range r.bindings {
+		if !now.Before(b.expires) {
+			delete(r.bindings, cluster)
+		}
+	}
+}
+
+// registryEntry is a line of the file of a file registry. It binds a cluster to an account, or
+// removes the binding of the cluster if the account is empty.
+type registryEntry struct {
+	Cluster string `json:"cluster"`
+	Account string `json:"account,omitempty"`
+}
+
+type fileRegistry struct {
+	path string
+
+	mu       sync.Mutex
+	file     *os.File
+	accounts map[string]string
+}
+
+// NewFileRegistry returns a cluster registry persisted to a file, which logs every change of a
+// binding as a JSON line, so that a change only appends to it. Bindings never expire. The file
+// is compacted when the registry is opened, and is read only then, so it must not be shared
+// between servers.
+func NewFileRegistry(path string) (ClusterRegistry, error) {
+	r := &fileRegistry{path: path, accounts: make(map[string]string)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to read cluster registry: %v", err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var entry registryEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			// the last change may have been interrupted while it was written
+			if i == len(lines)-1 {
+				log.Printf("warning: ignoring the incomplete last change of cluster registry %s: %v", path, err)
+				break
+			}
+			return nil, fmt.Errorf("unable to parse cluster registry %s: %v", path, err)
+		}
+		if len(entry.Account) == 0 {
+			delete(r.accounts, entry.Cluster)
+			continue
+		}
+		r.accounts[entry.Cluster] = entry.Account
+	}
+
+	// the file is rewritten with a line per binding, dropping the changes it replaced
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for cluster, account := range r.accounts {
+		if err := enc.Encode(registryEntry{Cluster: cluster, Account: account}); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeFileAtomically(path, buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("unable to write cluster registry: %v", err)
+	}
+	if r.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0); err != nil {
+		return nil, fmt.Errorf("unable to open cluster registry: %v", err)
+	}
+	return r, nil
+}
+
+func (r *fileRegistry) Register(cluster, account string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, ok := r.accounts[cluster]
+	if ok && existing != account {
+		return &ErrClusterRegistered{Cluster: cluster}
+	}
+	if ok {
+		return nil
+	}
+	return r.set(cluster, account)
+}
+
+func (r *fileRegistry) Bind(cluster, account string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.set(cluster, account)
+}
+
+// set changes the binding of a cluster and appends the change to the file. If it cannot be
+// persisted, the binding is left unchanged. The caller must hold the lock.
+func (r *fileRegistry) set(cluster, account string) error {
+	data, err := json.Marshal(registryEntry{Cluster: cluster, Account: account})
+	if err != nil {
+		return err
+	}
+	if _, err := r.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("unable to write cluster registry: %v", err)
+	}
+	if err := r.file.Sync(); err != nil {
+		return fmt.Errorf("unable to write cluster registry: %v", err)
+	}
+	if len(account) == 0 {
+		delete(r.accounts, cluster)
+	} else {
+		r.accounts[cluster] = account
+	}
+	return nil
+}
+
+func (r *fileRegistry) Bindings() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bindings := make(map[string]string, len(r.accounts))
+	for k, v := range r.accounts {
+		bindings[k] = v
+	}
+	return bindings
+}
+
+type registeringAuthorizer struct {
+	next     ClusterAuthorizer
+	registry ClusterRegistry
+}
+
+// NewRegisteringClusterAuthorizer returns a cluster authorizer that binds each cluster to the
+// subject it is authorized for by next, the account of the credential. A cluster bound to a
+// different account is rejected with a conflict, so that a cluster ID cannot be taken over.
+func NewRegisteringClusterAuthorizer(next ClusterAuthorizer, registry ClusterRegistry) ClusterAuthorizer {
+	return &registeringAuthorizer{next: next, registry: registry}
+}
+
+func (a *registeringAuthorizer) AuthorizeCluster(token, cluster string) (string, error) {
+	subject, _, err := a.AuthorizeClusterLabels(token, cluster)
+	return subject, err
+}
+
+func (a *registeringAuthorizer) AuthorizeClusterLabels(token, cluster string) (string, map[string]string, error) {
+	subject, labels, err := AuthorizeClusterLabels(a.next, token, cluster)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := a.registry.Register(cluster, subject); err != nil {
+		if _, ok := err.(*ErrClusterRegistered); ok {
+			clusterConflicts.WithLabelValues("authorize").Inc()
+			return "", nil, NewErrorWithCode(err, http.StatusConflict)
+		}
+		return "", nil, err
+	}
+	return subject, labels, nil
+}
+
+// NewClusterBindingHandler serves next only to clients owning the cluster they upload for,
+// and responds with 409 to others. The cluster of a client is the value of its partitionKey
+// label, and the client is identified by its ID, the account of tokens issued by /authorize.
+// Clusters that are not bound yet are bound to the client. This detects installations that
+// share a cluster ID, such as cloned machines, even if their tokens were issued before the
+// registry bound the cluster. It must be wrapped by a handler authorizing the client.
+func NewClusterBindingHandler(registry ClusterRegistry, partitionKey string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		client, ok := FromContext(req.Context())
+		if !ok {
+			writeErrorResponse(w, req, http.StatusUnauthorized, &errorResponse{Code: CodeUnauthorized, Message: "not authorized"})
+			return
+		}
+		cluster := client.Labels[partitionKey]
+		if len(cluster) == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if err := registry.Register(cluster, client.ID); err != nil {
+			if _, ok := err.(*ErrClusterRegistered); ok {
+				clusterConflicts.WithLabelValues("upload").Inc()
+				writeErrorResponse(w, req, http.StatusConflict, &errorResponse{
+					Code:    CodeClusterConflict,
+					Message: err.Error(),
+					Details: map[string]interface{}{"cluster": cluster},
+				})
+				return
+			}
+			writeErrorResponse(w, req, http.StatusServiceUnavailable, &errorResponse{Code: CodeUnavailable, Message: err.Error()})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
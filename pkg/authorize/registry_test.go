@@ -0,0 +1,210 @@
+package authorize
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRegisteringClusterAuthorizer(t *testing.T) {
+	// the account of a credential is its first character
+	accounts := ClusterAuthorizerFunc(func(token, cluster string) (string, error) {
+		if len(token) == 0 {
+			return "", NewErrorWithCode(errors.New("unauthorized"), http.StatusUnauthorized)
+		}
+		return token[:1], nil
+	})
+	a := NewRegisteringClusterAuthorizer(accounts, NewMemoryRegistry(0))
+
+	tests := []struct {
+		name     string
+		token    string
+		cluster  string
+		want     string
+		wantCode int
+	}{
+		{name: "first registration", token: "a-1", cluster: "cluster-1", want: "a"},
+		{name: "repeat by same credential", token: "a-1", cluster: "cluster-1", want: "a"},
+		{name: "repeat by same account", token: "a-2", cluster: "cluster-1", want: "a"},
+		{name: "hijack by other account", token: "b-1", cluster: "cluster-1", wantCode: http.StatusConflict},
+		{name: "other cluster of other account", token: "b-1", cluster: "cluster-2", want: "b"},
+		{name: "unauthorized credential", token: "", cluster: "cluster-3", wantCode: http.StatusUnauthorized},
+		{name: "unauthorized credential does not bind", token: "c-1", cluster: "cluster-3", want: "c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.AuthorizeCluster(tt.token, tt.cluster)
+			if tt.wantCode != 0 {
+				scerr, ok := err.(ErrorWithCode)
+				if !ok || scerr.HTTPStatusCode() != tt.wantCode {
+					t.Fatalf("want error with code %d, got %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("want subject %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestClusterBindingHandler(t *testing.T) {
+	registry := NewMemoryRegistry(time.Hour)
+	now := time.Unix(100000, 0)
+	registry.(*memoryRegistry).nowFn = func() time.Time { return now }
+	h := NewClusterBindingHandler(registry, "_id", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	conflicts := func() float64 {
+		var m dto.Metric
+		if err := clusterConflicts.WithLabelValues("upload").Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	uploads := func(account, cluster string, want int) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/upload", nil)
+		req = req.WithContext(WithClient(req.Context(), &Client{ID: account, Labels: map[string]string{"_id": cluster}}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("account %s: want status %d, got %d", account, want, w.Code)
+		}
+		if want == http.StatusConflict {
+			var body errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != CodeClusterConflict {
+				t.Fatalf("want error code %s, got %s", CodeClusterConflict, body.Code)
+			}
+		}
+	}
+
+	// a cloned machine uploads with the cluster ID of the original under its own account
+	before := conflicts()
+	uploads("original", "cluster-1", http.StatusOK)
+	uploads("clone", "cluster-1", http.StatusConflict)
+	uploads("original", "cluster-1", http.StatusOK)
+	if got := conflicts() - before; got != 1 {
+		t.Fatalf("want 1 conflict, got %v", got)
+	}
+	uploads("clone", "", http.StatusOK)
+
+	// the binding lasts while the original uploads, and expires after it stops
+	now = now.Add(59 * time.Minute)
+	uploads("original", "cluster-1", http.StatusOK)
+	now = now.Add(59 * time.Minute)
+	uploads("clone", "cluster-1", http.StatusConflict)
+	now = now.Add(2 * time.Minute)
+	uploads("clone", "cluster-1", http.StatusOK)
+	if got := registry.Bindings(); len(got) != 1 || got["cluster-1"] != "clone" {
+		t.Fatalf("want cluster-1 bound to clone, got %v", got)
+	}
+}
+
+func TestMemoryRegistryExpiry(t *testing.T) {
+	registry := NewMemoryRegistry(time.Hour).(*memoryRegistry)
+	now := time.Unix(100000, 0)
+	registry.nowFn = func() time.Time { return now }
+
+	for _, cluster := range []string{"cluster-1", "cluster-2"} {
+		if err := registry.Register(cluster, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = now.Add(30 * time.Minute)
+	if err := registry.Register("cluster-2", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the binding of cluster-1 is removed once it expired, without listing the bindings
+	now = now.Add(45 * time.Minute)
+	if err := registry.Register("cluster-3", "b"); err != nil {
+		t.Fatal(err)
+	}
+	registry.mu.Lock()
+	_, ok := registry.bindings["cluster-1"]
+	registry.mu.Unlock()
+	if ok {
+		t.Fatal("want the expired binding of cluster-1 removed")
+	}
+	if got, want := registry.Bindings(), map[string]string{"cluster-2": "a", "cluster-3": "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want bindings %v, got %v", want, got)
+	}
+}
+
+func TestFileRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "clusters")
+
+	registry, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []struct{ cluster, account string }{{"cluster-1", "a"}, {"cluster-2", "b"}, {"cluster-3", "c"}} {
+		if err := registry.Register(b.cluster, b.account); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := registry.Register("cluster-1", "b").(*ErrClusterRegistered); !ok {
+		t.Fatal("want cluster-1 registered to a")
+	}
+	if err := registry.Bind("cluster-2", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Bind("cluster-3", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// every change is appended to the file
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(data), "\n"); got != 5 {
+		t.Fatalf("want 5 changes logged, got %d: %s", got, data)
+	}
+
+	// the bindings are restored when the registry is opened again, ignoring an incomplete change
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"cluster":"clus`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	registry, err = NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"cluster-1": "a", "cluster-2": "c"}
+	if got := registry.Bindings(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want bindings %v, got %v", want, got)
+	}
+	// the file is compacted
+	if data, err = ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(data), "\n"); got != 2 {
+		t.Fatalf("want 2 bindings in the file, got %d: %s", got, data)
+	}
+}
@@ -0,0 +1,251 @@
+package authorize
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// ErrTokenRevoked is returned for a token that was revoked before it expired.
+	ErrTokenRevoked = errors.New("token has been revoked")
+	// ErrClusterRevoked is returned for a client or cluster whose access was revoked.
+	ErrClusterRevoked = errors.New("cluster has been revoked")
+)
+
+var revokedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "telemeter_revoked_requests_total",
+	Help: "Tracks the number of requests rejected because their token or cluster was revoked, by type.",
+}, []string{"type"})
+
+func init() {
+	prometheus.MustRegister(revokedRequests)
+}
+
+// IsRevoked returns true if err reports a revoked token or cluster.
+func IsRevoked(err error) bool {
+	if scerr, ok := err.(errorWithCode); ok {
+		err = scerr.error
+	}
+	return err == ErrTokenRevoked || err == ErrClusterRevoked
+}
+
+// RevocationList lists revoked token IDs (the "jti" claim) and revoked cluster IDs.
+type RevocationList struct {
+	Tokens   []string `json:"tokens"`
+	Clusters []string `json:"clusters"`
+}
+
+// Revocations holds the revoked tokens and clusters, persisted to a file so that they
+// survive restarts.
+type Revocations struct {
+	path string
+
+	mu       sync.RWMutex
+	tokens   map[string]struct{}
+	clusters map[string]struct{}
+}
+
+// NewRevocations loads the revocations stored at path. A missing file is treated as an
+// empty list and created on the first revocation.
+func NewRevocations(path string) (*Revocations, error) {
+	r := &Revocations{
+		path:     path,
+		tokens:   make(map[string]struct{}),
+		clusters: make(map[string]struct{}),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read revocation file: %v", err)
+	}
+	var list RevocationList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("unable to parse revocation file %s: %v", path, err)
+	}
+	addAll(r.tokens, list.Tokens)
+	addAll(r.clusters, list.Clusters)
+	return r, nil
+}
+
+// Revoke adds the given token and cluster IDs to the revocations and persists them.
+// If they cannot be persisted, the revocations are left unchanged.
+func (r *Revocations) Revoke(list RevocationList) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tokens := copySet(r.tokens)
+	clusters := copySet(r.clusters)
+	addAll(tokens, list.Tokens)
+	addAll(clusters, list.Clusters)
+	if err := r.persist(tokens, clusters); err != nil {
+		return err
+	}
+	r.tokens, r.clusters = tokens, clusters
+	return nil
+}
+
+// List returns the revoked tokens and clusters in order.
+func (r *Revocations) List() RevocationList {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return RevocationList{Tokens: sortedKeys(r.tokens), Clusters: sortedKeys(r.clusters)}
+}
+
+// Check returns ErrTokenRevoked or ErrClusterRevoked if the token ID or one of the cluster
+// IDs was revoked. Empty IDs are never revoked.
+func (r *Revocations) Check(tokenID string, clusters ...string) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, ok := r.tokens[tokenID]; ok && len(tokenID) > 0 {
+		revokedRequests.WithLabelValues("token").Inc()
+		return ErrTokenRevoked
+	}
+	for _, cluster := range clusters {
+		if _, ok := r.clusters[cluster]; ok && len(cluster) > 0 {
+			revokedRequests.WithLabelValues("cluster").Inc()
+			return ErrClusterRevoked
+		}
+	}
+	return nil
+}
+
+// persist replaces the revocation file atomically, so that a crash never leaves a partial list.
+func (r *Revocations) persist(tokens, clusters map[string]struct{}) error {
+	data, err := json.MarshalIndent(RevocationList{Tokens: sortedKeys(tokens), Clusters: sortedKeys(clusters)}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(r.path, data); err != nil {
+		return fmt.Errorf("unable to write revocation file: %v", err)
+	}
+	return nil
+}
+
+// writeFileAtomically replaces the file at path with data through a temporary file in the same
+// directory, so that readers never see a partial file.
+func writeFileAtomically(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func addAll(set map[string]struct{}, values []string) {
+	for _, v := range values {
+		if len(v) > 0 {
+			set[v] = struct{}{}
+		}
+	}
+}
+
+func copySet(set map[string]struct{}) map[string]struct{} {
+	c := make(map[string]struct{}, len(set))
+	for k := range set {
+		c[k] = struct{}{}
+	}
+	return c
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type revokingClientAuthorizer struct {
+	next         ClientAuthorizer
+	revocations  *Revocations
+	partitionKey string
+}
+
+// NewRevokingClientAuthorizer returns a client authorizer rejecting clients authorized by next
+// if their token or cluster was revoked. The cluster of a client is its ID and the value of its
+// partitionKey label.
+func NewRevokingClientAuthorizer(revocations *Revocations, partitionKey string, next ClientAuthorizer) ClientAuthorizer {
+	return &revokingClientAuthorizer{next: next, revocations: revocations, partitionKey: partitionKey}
+}
+
+func (a *revokingClientAuthorizer) AuthorizeClient(token string) (*Client, bool, error) {
+	client, ok, err := a.next.AuthorizeClient(token)
+	if !ok {
+		return client, ok, err
+	}
+	if err := a.revocations.Check(client.TokenID, client.ID, client.Labels[a.partitionKey]); err != nil {
+		return nil, false, err
+	}
+	return client, true, nil
+}
+
+type revokingAuthorizer struct {
+	next         Authorizer
+	revocations  *Revocations
+	partitionKey string
+}
+
+// NewRevokingAuthorizer returns an authorizer rejecting clients authorized by next, such as
+// those identified by a certificate or a signature, if their cluster was revoked. The cluster
+// of a client is its ID and the value of its partitionKey label.
+func NewRevokingAuthorizer(revocations *Revocations, partitionKey string, next Authorizer) Authorizer {
+	return &revokingAuthorizer{next: next, revocations: revocations, partitionKey: partitionKey}
+}
+
+func (a *revokingAuthorizer) Authorize(creds Credentials) (*Client, bool, error) {
+	client, ok, err := a.next.Authorize(creds)
+	if !ok {
+		return client, ok, err
+	}
+	if err := a.revocations.Check(client.TokenID, client.ID, client.Labels[a.partitionKey]); err != nil {
+		return nil, false, err
+	}
+	return client, true, nil
+}
+
+type revokingClusterAuthorizer struct {
+	next        ClusterAuthorizer
+	revocations *Revocations
+}
+
+// NewRevokingClusterAuthorizer returns a cluster authorizer that denies revoked clusters
+// before consulting next, so that they cannot obtain new tokens.
+func NewRevokingClusterAuthorizer(revocations *Revocations, next ClusterAuthorizer) ClusterAuthorizer {
+	return &revokingClusterAuthorizer{next: next, revocations: revocations}
+}
+
+func (a *revokingClusterAuthorizer) AuthorizeCluster(token, cluster string) (string, error) {
+	subject, _, err := a.AuthorizeClusterLabels(token, cluster)
+	return subject, err
+}
+
+func (a *revokingClusterAuthorizer) AuthorizeClusterLabels(token, cluster string) (string, map[string]string, error) {
+	if err := a.revocations.Check("", cluster); err != nil {
+		return "", nil, NewErrorWithCode(err, http.StatusUnauthorized)
+	}
+	return AuthorizeClusterLabels(a.next, token, cluster)
+}
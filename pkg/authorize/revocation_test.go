@@ -0,0 +1,90 @@
+package authorize
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRevokingClusterAuthorizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-revocations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "revocations.json")
+
+	if err := ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRevocations(path); err == nil {
+		t.Fatal("expected an invalid revocation file to be rejected")
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"clusters":["cluster-1"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRevocations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	a := NewRevokingClusterAuthorizer(r, ClusterAuthorizerFunc(func(token, cluster string) (string, error) {
+		calls++
+		return "account", nil
+	}))
+	if _, err := a.AuthorizeCluster("token", "cluster-2"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.AuthorizeCluster("token", "cluster-1")
+	if scerr, ok := err.(ErrorWithCode); !ok || scerr.HTTPStatusCode() != http.StatusUnauthorized || !IsRevoked(err) {
+		t.Fatalf("expected the revoked cluster to be unauthorized, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected revoked clusters not to be authorized upstream, got %d calls", calls)
+	}
+}
+
+func TestRevokingAuthorizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-revocations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "revocations.json")
+	if err := ioutil.WriteFile(path, []byte(`{"clusters":["cluster-1","partition-2"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRevocations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewRevokingAuthorizer(r, "_id", AuthorizerFunc(func(creds Credentials) (*Client, bool, error) {
+		return &Client{ID: creds.Certificate.Subject.CommonName, Labels: map[string]string{"_id": creds.Token}}, true, nil
+	}))
+	for _, tt := range []struct {
+		id, partition string
+		revoked       bool
+	}{
+		{id: "cluster-2", partition: "partition-1"},
+		{id: "cluster-1", partition: "partition-1", revoked: true},
+		{id: "cluster-2", partition: "partition-2", revoked: true},
+	} {
+		creds := Credentials{Token: tt.partition, Certificate: &x509.Certificate{Subject: pkix.Name{CommonName: tt.id}}}
+		client, ok, err := a.Authorize(creds)
+		if tt.revoked {
+			if ok || client != nil || !IsRevoked(err) {
+				t.Errorf("%s/%s: expected the client to be revoked, got %v %t %v", tt.id, tt.partition, client, ok, err)
+			}
+			continue
+		}
+		if !ok || err != nil || client.ID != tt.id {
+			t.Errorf("%s/%s: expected the client to be authorized, got %v %t %v", tt.id, tt.partition, client, ok, err)
+		}
+	}
+}
@@ -2,15 +2,27 @@ package authorize
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sync"
 )
 
+// ServerRotatingRoundTripper authenticates requests with an access token exchanged for the
+// initial token at the authorize endpoint. The token is exchanged again before it expires, and
+// when the server rejects it, in which case the request is retried once with the new token.
 type ServerRotatingRoundTripper struct {
 	endpoint     *url.URL
 	initialToken string
 	tokenStore   tokenStore
 
+	// CacheFile, if set, keeps the access token across restarts. Metrics, if set, records the
+	// exchanges. Both must be set before the first request.
+	CacheFile string
+	Metrics   *TokenMetrics
+	init      sync.Once
+
 	wrapper http.RoundTripper
 }
 
@@ -22,22 +34,49 @@ func NewServerRotatingRoundTripper(initialToken string, endpoint *url.URL, rt ht
 	}
 }
 
+func (rt *ServerRotatingRoundTripper) load() (string, error) {
+	rt.init.Do(func() {
+		rt.tokenStore.cacheFile = rt.CacheFile
+		rt.tokenStore.metrics = rt.Metrics
+	})
+	return rt.tokenStore.Load(rt.endpoint, rt.initialToken, rt.wrapper)
+}
+
 func (rt *ServerRotatingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	token, err := rt.tokenStore.Load(rt.endpoint, rt.initialToken, rt.wrapper)
+	token, err := rt.load()
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
-	resp, err := rt.wrapper.RoundTrip(req)
-	if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-		rt.tokenStore.Invalidate(token)
+	resp, err := rt.wrapper.RoundTrip(withBearer(req, token))
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	rt.tokenStore.Invalidate(token)
+
+	// Retry once with a new token if the body of the request can be sent again.
+	if req.Body != nil && req.GetBody == nil {
+		return resp, err
 	}
-	return resp, err
+	token, loadErr := rt.load()
+	if loadErr != nil {
+		return resp, err
+	}
+	retry := withBearer(req, token)
+	if req.GetBody != nil {
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return resp, err
+		}
+		retry.Body = body
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return rt.wrapper.RoundTrip(retry)
 }
 
 func (rt *ServerRotatingRoundTripper) Labels() (map[string]string, error) {
-	_, err := rt.tokenStore.Load(rt.endpoint, rt.initialToken, rt.wrapper)
+	_, err := rt.load()
 	if err != nil {
 		return nil, fmt.Errorf("unable to authorize to server: %v", err)
 	}
@@ -47,3 +86,16 @@ func (rt *ServerRotatingRoundTripper) Labels() (map[string]string, error) {
 	}
 	return labels, nil
 }
+
+// withBearer returns a shallow copy of the request authenticated with the token, leaving the
+// request of the caller unchanged.
+func withBearer(req *http.Request, token string) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	return r
+}
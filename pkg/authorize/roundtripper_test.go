@@ -0,0 +1,235 @@
+package authorize
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// tokenServer issues tokens expiring after ttl at /authorize, and accepts uploads at /upload
+// authenticated with the last token issued until it expires.
+type tokenServer struct {
+	mu      sync.Mutex
+	now     time.Time
+	ttl     time.Duration
+	down    bool
+	issued  int
+	current string
+	expires time.Time
+	bodies  []string
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch req.URL.Path {
+	case "/authorize":
+		if s.down {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer initial" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s.issued++
+		s.current = fmt.Sprintf("token-%d", s.issued)
+		s.expires = s.now.Add(s.ttl)
+		json.NewEncoder(w).Encode(TokenResponse{Token: s.current, ExpiresInSeconds: int64(s.ttl / time.Second), Labels: map[string]string{"cluster": "a"}})
+	case "/upload":
+		if req.Header.Get("Authorization") != "Bearer "+s.current || !s.now.Before(s.expires) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		s.bodies = append(s.bodies, string(body))
+	}
+}
+
+func (s *tokenServer) advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = s.now.Add(d)
+}
+
+func (s *tokenServer) clock() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+func TestServerRotatingRoundTripper(t *testing.T) {
+	// upload posts a body through rt, returning the status code
+	upload := func(t *testing.T, rt http.RoundTripper, ts *httptest.Server, body string) (int, error) {
+		req, err := http.NewRequest("POST", ts.URL+"/upload", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := (&http.Client{Transport: rt}).Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	newRoundTripper := func(t *testing.T, s *tokenServer, ts *httptest.Server) *ServerRotatingRoundTripper {
+		u, err := url.Parse(ts.URL + "/authorize")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt := NewServerRotatingRoundTripper("initial", u, http.DefaultTransport)
+		rt.tokenStore.nowFunc = s.clock
+		return rt
+	}
+
+	t.Run("refreshed across the expiry", func(t *testing.T) {
+		s := &tokenServer{now: time.Unix(1000, 0), ttl: 100 * time.Second}
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+		rt := newRoundTripper(t, s, ts)
+
+		for i, step := range []struct {
+			advance time.Duration
+			issued  int
+		}{
+			{0, 1},
+			{50 * time.Second, 1},
+			// refreshed before the expiry
+			{35 * time.Second, 2},
+			{60 * time.Second, 2},
+			// the token has expired
+			{90 * time.Second, 3},
+		} {
+			s.advance(step.advance)
+			if code, err := upload(t, rt, ts, fmt.Sprintf("upload-%d", i)); err != nil || code != http.StatusOK {
+				t.Fatalf("%d: want the upload accepted, got %d: %v", i, code, err)
+			}
+			if s.issued != step.issued {
+				t.Errorf("%d: want %d tokens issued, got %d", i, step.issued, s.issued)
+			}
+		}
+		labels, err := rt.Labels()
+		if err != nil || labels["cluster"] != "a" {
+			t.Errorf("want the labels of the token, got %v: %v", labels, err)
+		}
+	})
+
+	t.Run("retried with a new token when rejected", func(t *testing.T) {
+		s := &tokenServer{now: time.Unix(1000, 0), ttl: 100 * time.Second}
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+		rt := newRoundTripper(t, s, ts)
+
+		if code, err := upload(t, rt, ts, "first"); err != nil || code != http.StatusOK {
+			t.Fatalf("want the upload accepted, got %d: %v", code, err)
+		}
+		// the server no longer accepts the token, as after a restart with a new key
+		s.mu.Lock()
+		s.current = "revoked"
+		s.mu.Unlock()
+		if code, err := upload(t, rt, ts, "second"); err != nil || code != http.StatusOK {
+			t.Fatalf("want the upload retried and accepted, got %d: %v", code, err)
+		}
+		if s.issued != 2 {
+			t.Errorf("want a new token issued, got %d tokens", s.issued)
+		}
+		if want := []string{"first", "second"}; fmt.Sprint(s.bodies) != fmt.Sprint(want) {
+			t.Errorf("want bodies %v, got %v", want, s.bodies)
+		}
+	})
+
+	t.Run("failed refreshes back off", func(t *testing.T) {
+		s := &tokenServer{now: time.Unix(1000, 0), ttl: 100 * time.Second}
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+		rt := newRoundTripper(t, s, ts)
+		rt.Metrics = NewTokenMetrics(prometheus.NewRegistry())
+
+		if code, err := upload(t, rt, ts, "first"); err != nil || code != http.StatusOK {
+			t.Fatalf("want the upload accepted, got %d: %v", code, err)
+		}
+		s.mu.Lock()
+		s.down = true
+		s.mu.Unlock()
+
+		// the refresh fails, but the token is used until it expires
+		s.advance(85 * time.Second)
+		if code, err := upload(t, rt, ts, "second"); err != nil || code != http.StatusOK {
+			t.Fatalf("want the upload accepted with the previous token, got %d: %v", code, err)
+		}
+		if got := refreshes(t, rt.Metrics, "failure"); got != 1 {
+			t.Errorf("want 1 failed refresh, got %v", got)
+		}
+		// the refresh is not retried within the backoff
+		if code, err := upload(t, rt, ts, "third"); err != nil || code != http.StatusOK {
+			t.Fatalf("want the upload accepted with the previous token, got %d: %v", code, err)
+		}
+		if got := refreshes(t, rt.Metrics, "failure"); got != 1 {
+			t.Errorf("want the refresh backed off, got %v failures", got)
+		}
+
+		// once the token expires, uploads fail without crashing until the server is back
+		s.advance(20 * time.Second)
+		if _, err := upload(t, rt, ts, "fourth"); err == nil {
+			t.Fatal("want the upload to fail without a token")
+		}
+		s.mu.Lock()
+		s.down = false
+		s.mu.Unlock()
+		s.advance(maxTokenBackoff)
+		if code, err := upload(t, rt, ts, "fifth"); err != nil || code != http.StatusOK {
+			t.Fatalf("want the upload accepted with a new token, got %d: %v", code, err)
+		}
+		if got := refreshes(t, rt.Metrics, "success"); got != 2 {
+			t.Errorf("want 2 successful refreshes, got %v", got)
+		}
+	})
+
+	t.Run("cached on disk", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		s := &tokenServer{now: time.Unix(1000, 0), ttl: 100 * time.Second}
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		rt := newRoundTripper(t, s, ts)
+		rt.CacheFile = filepath.Join(dir, "token")
+		if code, err := upload(t, rt, ts, "first"); err != nil || code != http.StatusOK {
+			t.Fatalf("want the upload accepted, got %d: %v", code, err)
+		}
+
+		// a restarted client reuses the token
+		s.advance(10 * time.Second)
+		rt = newRoundTripper(t, s, ts)
+		rt.CacheFile = filepath.Join(dir, "token")
+		if code, err := upload(t, rt, ts, "second"); err != nil || code != http.StatusOK {
+			t.Fatalf("want the upload accepted, got %d: %v", code, err)
+		}
+		if s.issued != 1 {
+			t.Errorf("want the cached token reused, got %d tokens issued", s.issued)
+		}
+	})
+}
+
+func refreshes(t *testing.T, m *TokenMetrics, result string) float64 {
+	metric := &clientmodel.Metric{}
+	if err := m.refreshes.WithLabelValues(result).Write(metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetCounter().GetValue()
+}
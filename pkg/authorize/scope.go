@@ -0,0 +1,62 @@
+package authorize
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Scopes granting access to groups of handlers.
+const (
+	ScopeMetricsWrite = "metrics:write"
+	ScopeMetricsRead  = "metrics:read"
+	ScopeAdmin        = "admin"
+)
+
+// HasScope returns true if the client was granted the scope.
+func (c *Client) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type defaultScopesAuthorizer struct {
+	next   ClientAuthorizer
+	scopes []string
+}
+
+// WithDefaultScopes grants the given scopes to the clients of authorizer that were not
+// granted any, such as those of tokens issued before scopes were introduced.
+func WithDefaultScopes(authorizer ClientAuthorizer, scopes ...string) ClientAuthorizer {
+	return &defaultScopesAuthorizer{next: authorizer, scopes: scopes}
+}
+
+func (a *defaultScopesAuthorizer) AuthorizeClient(token string) (*Client, bool, error) {
+	client, ok, err := a.next.AuthorizeClient(token)
+	if !ok || len(client.Scopes) > 0 {
+		return client, ok, err
+	}
+	c := *client
+	c.Scopes = a.scopes
+	return &c, true, err
+}
+
+// RequireScope serves next only to authorized clients granted the scope, and responds with
+// 403 to all others. It must be wrapped by a handler authorizing the client.
+func RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		client, ok := FromContext(req.Context())
+		if ok && client.HasScope(scope) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+		writeErrorResponse(w, req, http.StatusForbidden, &errorResponse{
+			Code:    CodeInsufficientScope,
+			Message: fmt.Sprintf("the %s scope is required", scope),
+			Details: map[string]interface{}{"scope": scope},
+		})
+	})
+}
@@ -0,0 +1,94 @@
+package authorize
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireScope(t *testing.T) {
+	authorizer := WithDefaultScopes(NewStaticAuthorizer(map[string]*Client{
+		"writer": {ID: "writer", Scopes: []string{ScopeMetricsWrite}},
+		"reader": {ID: "reader", Scopes: []string{ScopeMetricsRead}},
+		"legacy": {ID: "legacy"},
+	}), ScopeMetricsWrite)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	mux := http.NewServeMux()
+	mux.Handle("/upload", Middleware(TokenAuthorizer(authorizer))(RequireScope(ScopeMetricsWrite, ok)))
+	mux.Handle("/federate", Middleware(TokenAuthorizer(authorizer))(RequireScope(ScopeMetricsRead, ok)))
+
+	tests := []struct {
+		token    string
+		path     string
+		wantCode int
+	}{
+		{token: "writer", path: "/upload", wantCode: http.StatusOK},
+		{token: "writer", path: "/federate", wantCode: http.StatusForbidden},
+		{token: "reader", path: "/federate", wantCode: http.StatusOK},
+		{token: "reader", path: "/upload", wantCode: http.StatusForbidden},
+		{token: "legacy", path: "/upload", wantCode: http.StatusOK},
+		{token: "legacy", path: "/federate", wantCode: http.StatusForbidden},
+		{token: "unknown", path: "/federate", wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			req.Header.Set("X-Request-Id", "req-1")
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("want code %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusForbidden {
+				return
+			}
+			var body errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("expected a JSON error envelope: %v", err)
+			}
+			if body.Code != CodeInsufficientScope || body.RequestID != "req-1" {
+				t.Fatalf("unexpected body %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestReadPartitionHandler(t *testing.T) {
+	var got string
+	var restricted bool
+	h := NewReadPartitionHandler("_id", nil, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got, restricted = ReadPartitionFromContext(req.Context())
+	}))
+
+	tests := []struct {
+		name           string
+		client         *Client
+		wantCode       int
+		wantRestricted bool
+		want           string
+	}{
+		{name: "reader", client: &Client{ID: "reader", Labels: map[string]string{"_id": "cluster-1"}, Scopes: []string{ScopeMetricsRead}}, wantCode: http.StatusOK, wantRestricted: true, want: "cluster-1"},
+		{name: "admin", client: &Client{ID: "admin", Labels: map[string]string{"_id": "cluster-1"}, Scopes: []string{ScopeMetricsRead, ScopeAdmin}}, wantCode: http.StatusOK},
+		{name: "reader without partition", client: &Client{ID: "reader", Scopes: []string{ScopeMetricsRead}}, wantCode: http.StatusForbidden},
+		{name: "unauthorized", wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, restricted = "", false
+			req := httptest.NewRequest("GET", "/federate", nil)
+			if tt.client != nil {
+				req = req.WithContext(WithClient(req.Context(), tt.client))
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("want code %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if restricted != tt.wantRestricted || got != tt.want {
+				t.Fatalf("want reads restricted=%t to %q, got restricted=%t to %q", tt.wantRestricted, tt.want, restricted, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package authorize
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type staticAuthorizer struct {
+	clients map[string]*Client
+}
+
+// NewStaticAuthorizer returns an authorizer accepting a fixed set of tokens, each
+// identifying the given client.
+func NewStaticAuthorizer(clients map[string]*Client) ClientAuthorizer {
+	return &staticAuthorizer{clients: clients}
+}
+
+func (a *staticAuthorizer) AuthorizeClient(token string) (*Client, bool, error) {
+	var match *Client
+	// compare against every token to avoid leaking which one matched through timing
+	for t, client := range a.clients {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			match = client
+		}
+	}
+	return match, match != nil, nil
+}
+
+// ParseStaticTokens reads lines of the form "token,id,label=value,..." into a
+// map of token to client. Fields of the form "scope=value" grant the client a scope
+// instead of setting a label. Empty lines and lines starting with '#' are ignored.
+func ParseStaticTokens(r io.Reader) (map[string]*Client, error) {
+	clients, lineErrs, err := parseStaticTokens(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(lineErrs) > 0 {
+		return nil, lineErrs[0]
+	}
+	return clients, nil
+}
+
+// parseStaticTokens reads the clients of all valid lines of r, and returns the errors of
+// the invalid lines separately from an error reading r.
+func parseStaticTokens(r io.Reader) (map[string]*Client, []error, error) {
+	clients := make(map[string]*Client)
+	var lineErrs []error
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) < 2 || len(fields[0]) == 0 || len(fields[1]) == 0 {
+			lineErrs = append(lineErrs, fmt.Errorf("line %d: must be of the form token,id[,label=value...]", line))
+			continue
+		}
+		if _, ok := clients[fields[0]]; ok {
+			lineErrs = append(lineErrs, fmt.Errorf("line %d: duplicate token", line))
+			continue
+		}
+		labels, scopes, err := parseClientFields(fields[2:])
+		if err != nil {
+			lineErrs = append(lineErrs, fmt.Errorf("line %d: %v", line, err))
+			continue
+		}
+		clients[fields[0]] = &Client{ID: fields[1], Labels: labels, Scopes: scopes}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return clients, lineErrs, nil
+}
+
+// parseClientFields parses fields of the form key=value into the labels of a client, and
+// fields of the form scope=value into its scopes.
+func parseClientFields(fields []string) (map[string]string, []string, error) {
+	var scopes, labelFields []string
+	for _, field := range fields {
+		if strings.HasPrefix(field, "scope=") {
+			scopes = append(scopes, strings.TrimPrefix(field, "scope="))
+			continue
+		}
+		labelFields = append(labelFields, field)
+	}
+	labels, err := parseLabels(labelFields)
+	if err != nil {
+		return nil, nil, err
+	}
+	return labels, scopes, nil
+}
+
+// parseLabels parses fields of the form key=value.
+func parseLabels(fields []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, label := range fields {
+		kv := strings.SplitN(label, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return nil, fmt.Errorf("label must be of the form key=value: %s", label)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
@@ -0,0 +1,50 @@
+package authorize
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseStaticTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    map[string]*Client
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			in:   "# admins\nsecret-1,alice\n\nsecret-2,bob,team=infra\nsecret-3,carol,scope=metrics:read,team=infra,scope=admin\n",
+			want: map[string]*Client{
+				"secret-1": {ID: "alice", Labels: map[string]string{}},
+				"secret-2": {ID: "bob", Labels: map[string]string{"team": "infra"}},
+				"secret-3": {ID: "carol", Labels: map[string]string{"team": "infra"}, Scopes: []string{"metrics:read", "admin"}},
+			},
+		},
+		{name: "missing id", in: "secret-1\n", wantErr: true},
+		{name: "invalid label", in: "secret-1,alice,team\n", wantErr: true},
+		{name: "duplicate token", in: "secret-1,alice\nsecret-1,bob\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseStaticTokens(strings.NewReader(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("want error %t, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestStaticAuthorizer(t *testing.T) {
+	a := NewStaticAuthorizer(map[string]*Client{"secret-1": {ID: "alice"}})
+	if client, ok, err := a.AuthorizeClient("secret-1"); err != nil || !ok || client.ID != "alice" {
+		t.Fatalf("expected alice to be authorized, got %v %t %v", client, ok, err)
+	}
+	if _, ok, err := a.AuthorizeClient("secret-2"); err != nil || ok {
+		t.Fatalf("expected unknown token to be rejected, got %t %v", ok, err)
+	}
+}
@@ -5,10 +5,27 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// tokenRefreshFraction is the fraction of the lifetime of a token after which it is
+	// refreshed, while it can still be used if the refresh fails.
+	tokenRefreshFraction = 0.8
+	// tokenExpirySkew is the longest time before the expiry of a token it stops being used, to
+	// allow for the clocks of the client and the server to differ.
+	tokenExpirySkew = 15 * time.Second
+
+	minTokenBackoff = time.Second
+	maxTokenBackoff = 5 * time.Minute
 )
 
 type TokenResponse struct {
@@ -20,55 +37,219 @@ type TokenResponse struct {
 	Labels map[string]string `json:"labels"`
 }
 
+// TokenMetrics instruments the exchanges of tokens by a ServerRotatingRoundTripper. Its
+// methods may be called on a nil TokenMetrics, which records nothing.
+type TokenMetrics struct {
+	refreshes *prometheus.CounterVec
+	failures  prometheus.Gauge
+	expiry    prometheus.Gauge
+}
+
+// NewTokenMetrics returns metrics registered with reg.
+func NewTokenMetrics(reg prometheus.Registerer) *TokenMetrics {
+	m := &TokenMetrics{
+		refreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "telemeter_client_token_refreshes_total",
+			Help: "Tracks the number of exchanges of the initial token for an access token, by result.",
+		}, []string{"result"}),
+		failures: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "telemeter_client_token_refresh_consecutive_failures",
+			Help: "The number of exchanges of the initial token that failed since the last one that succeeded.",
+		}),
+		expiry: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "telemeter_client_token_expiry_timestamp_seconds",
+			Help: "The time the current access token expires at, or 0 if it does not expire.",
+		}),
+	}
+	reg.MustRegister(m.refreshes, m.failures, m.expiry)
+	return m
+}
+
+func (m *TokenMetrics) observeRefresh(err error, expires time.Time, failures int) {
+	if m == nil {
+		return
+	}
+	m.failures.Set(float64(failures))
+	if err != nil {
+		m.refreshes.WithLabelValues("failure").Inc()
+		return
+	}
+	m.refreshes.WithLabelValues("success").Inc()
+	if expires.IsZero() {
+		m.expiry.Set(0)
+		return
+	}
+	m.expiry.Set(float64(expires.Unix()))
+}
+
+// cachedToken is the content of a token cache file.
+type cachedToken struct {
+	Token   string            `json:"token"`
+	Refresh time.Time         `json:"refresh,omitempty"`
+	Expires time.Time         `json:"expires,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
 type tokenStore struct {
-	lock    sync.Mutex
-	value   string
+	lock  sync.Mutex
+	value string
+	// refresh is when the token is exchanged again, and expires when it may no longer be used.
+	// Both are zero for tokens that do not expire.
+	refresh time.Time
 	expires time.Time
 	labels  map[string]string
+
+	// failures counts the exchanges failed in a row, which are not retried before retry.
+	failures int
+	retry    time.Time
+	lastErr  error
+
+	cacheFile   string
+	cacheLoaded bool
+	metrics     *TokenMetrics
+	nowFunc     func() time.Time
+}
+
+func (t *tokenStore) now() time.Time {
+	if t.nowFunc != nil {
+		return t.nowFunc()
+	}
+	return time.Now()
 }
 
 func (t *tokenStore) Load(endpoint *url.URL, initialToken string, rt http.RoundTripper) (string, error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	if len(t.value) > 0 && (t.expires.IsZero() || t.expires.After(time.Now())) {
+	now := t.now()
+	if !t.cacheLoaded {
+		t.cacheLoaded = true
+		t.loadCache(now)
+	}
+	valid := len(t.value) > 0 && (t.expires.IsZero() || t.expires.After(now))
+	if valid && (t.refresh.IsZero() || t.refresh.After(now)) {
 		return t.value, nil
 	}
+	if now.Before(t.retry) {
+		if valid {
+			return t.value, nil
+		}
+		return "", t.lastErr
+	}
 
+	err := t.exchange(endpoint, initialToken, rt, now)
+	if err != nil {
+		t.failures++
+		t.metrics.observeRefresh(err, t.expires, t.failures)
+		backoff := minTokenBackoff << uint(t.failures-1)
+		if backoff > maxTokenBackoff || backoff <= 0 {
+			backoff = maxTokenBackoff
+		}
+		t.retry = now.Add(backoff)
+		t.lastErr = err
+		if valid {
+			log.Printf("warning: unable to refresh the access token, retrying in %s: %v", backoff, err)
+			return t.value, nil
+		}
+		return "", err
+	}
+	t.failures = 0
+	t.metrics.observeRefresh(nil, t.expires, 0)
+	t.retry = time.Time{}
+	t.lastErr = nil
+	t.saveCache()
+	return t.value, nil
+}
+
+// exchange exchanges the initial token for an access token. The caller must hold the lock.
+func (t *tokenStore) exchange(endpoint *url.URL, initialToken string, rt http.RoundTripper, now time.Time) error {
 	c := http.Client{Transport: rt, Timeout: 30 * time.Second}
 	req, err := http.NewRequest("POST", endpoint.String(), nil)
 	if err != nil {
-		return "", fmt.Errorf("unable to create authentication request: %v", err)
+		return fmt.Errorf("unable to create authentication request: %v", err)
 	}
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", initialToken))
 	resp, err := c.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("unable to perform authentication request: %v", err)
+		return fmt.Errorf("unable to perform authentication request: %v", err)
 	}
 	defer resp.Body.Close()
 
 	switch resp.StatusCode {
 	case http.StatusOK, http.StatusCreated:
 	case http.StatusUnauthorized:
-		return "", fmt.Errorf("initial authentication token is expired or invalid")
+		return fmt.Errorf("initial authentication token is expired or invalid")
 	default:
 		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4*1024))
-		return "", fmt.Errorf("unable to exchange initial token for a long lived token: %d:\n%s", resp.StatusCode, string(body))
+		return fmt.Errorf("unable to exchange initial token for a long lived token: %d:\n%s", resp.StatusCode, string(body))
 	}
 
 	response, parseErr := parseTokenFromBody(resp.Body, 16*1024)
 	if parseErr != nil {
-		return "", parseErr
+		return parseErr
 	}
 
 	t.value = response.Token
 	t.labels = response.Labels
-	if response.ExpiresInSeconds >= 60 {
-		t.expires = time.Now().Add(time.Duration(response.ExpiresInSeconds-15) * time.Second)
-	} else {
-		t.expires = time.Time{}
+	t.refresh, t.expires = time.Time{}, time.Time{}
+	if response.ExpiresInSeconds > 0 {
+		lifetime := time.Duration(response.ExpiresInSeconds) * time.Second
+		skew := lifetime / 10
+		if skew > tokenExpirySkew {
+			skew = tokenExpirySkew
+		}
+		t.expires = now.Add(lifetime - skew)
+		t.refresh = now.Add(time.Duration(float64(lifetime) * tokenRefreshFraction))
 	}
+	return nil
+}
 
-	return t.value, nil
+// loadCache loads the token of the cache file, if it has not expired. The caller must hold the
+// lock.
+func (t *tokenStore) loadCache(now time.Time) {
+	if len(t.cacheFile) == 0 {
+		return
+	}
+	data, err := ioutil.ReadFile(t.cacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("warning: unable to read the token cache file: %v", err)
+		}
+		return
+	}
+	var cached cachedToken
+	if err := json.Unmarshal(data, &cached); err != nil {
+		log.Printf("warning: ignoring invalid token cache file: %v", err)
+		return
+	}
+	if len(cached.Token) == 0 || (!cached.Expires.IsZero() && !cached.Expires.After(now)) {
+		return
+	}
+	t.value = cached.Token
+	t.labels = cached.Labels
+	t.refresh = cached.Refresh
+	t.expires = cached.Expires
+}
+
+// saveCache writes the token to the cache file. The caller must hold the lock.
+func (t *tokenStore) saveCache() {
+	if len(t.cacheFile) == 0 {
+		return
+	}
+	data, err := json.Marshal(cachedToken{Token: t.value, Refresh: t.refresh, Expires: t.expires, Labels: t.labels})
+	if err != nil {
+		log.Printf("warning: unable to encode the token cache file: %v", err)
+		return
+	}
+	tmp := filepath.Join(filepath.Dir(t.cacheFile), "."+filepath.Base(t.cacheFile)+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		log.Printf("warning: unable to write the token cache file: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, t.cacheFile); err != nil {
+		os.Remove(tmp)
+		log.Printf("warning: unable to write the token cache file: %v", err)
+	}
 }
 
 func (t *tokenStore) Invalidate(token string) {
@@ -77,7 +258,10 @@ func (t *tokenStore) Invalidate(token string) {
 	if token == t.value {
 		t.value = ""
 		t.labels = nil
+		t.refresh = time.Time{}
 		t.expires = time.Time{}
+		// a token the server does not accept is exchanged again right away
+		t.retry = time.Time{}
 	}
 }
 
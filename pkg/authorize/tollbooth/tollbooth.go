@@ -8,6 +8,7 @@ import (
 	"mime"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/openshift/telemeter/pkg/authorize"
 )
@@ -16,6 +17,8 @@ type clusterRegistration struct {
 	ClusterID          string `json:"cluster_id"`
 	AuthorizationToken string `json:"authorization_token"`
 	AccountID          string `json:"account_id"`
+	// Labels are attached to the client of an authorized cluster.
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type registrationError struct {
@@ -26,16 +29,39 @@ type registrationError struct {
 type authorizer struct {
 	to     *url.URL
 	client *http.Client
+
+	// Retries is the number of times a request is retried if the server is unreachable or
+	// responds with a server error.
+	Retries int
+	// RetryBackoff is the delay before the first retry. It doubles with every further retry.
+	RetryBackoff time.Duration
+	// Metrics, if set, records the duration of every request to the server.
+	Metrics *authorize.Metrics
+	// AccountLabel, if set, is the label the account ID of an authorized cluster is attached
+	// as, in addition to the labels returned by the server.
+	AccountLabel string
 }
 
 func NewAuthorizer(c *http.Client, to *url.URL) *authorizer {
 	return &authorizer{
-		to:     to,
-		client: c,
+		to:           to,
+		client:       c,
+		RetryBackoff: 100 * time.Millisecond,
 	}
 }
 
 func (a *authorizer) AuthorizeCluster(token, cluster string) (string, error) {
+	subject, _, err := a.AuthorizeClusterLabels(token, cluster)
+	return subject, err
+}
+
+// AuthorizeClusterLabels asks the server whether the token may send data for the cluster.
+// The labels returned by the server, such as the organization or support level of the
+// account, are sanitized to valid label names.
+// Responses other than 2xx deny the cluster with the status of the server. If the server cannot
+// be reached or keeps failing, a 503 error is returned, and a 502 error if its response cannot
+// be parsed.
+func (a *authorizer) AuthorizeClusterLabels(token, cluster string) (string, map[string]string, error) {
 	regReq := &clusterRegistration{
 		ClusterID:          cluster,
 		AuthorizationToken: token,
@@ -43,32 +69,61 @@ func (a *authorizer) AuthorizeCluster(token, cluster string) (string, error) {
 
 	data, err := json.Marshal(regReq)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	body, err := authorize.AgainstEndpoint(a.client, a.to, bytes.NewReader(data), cluster, func(res *http.Response) error {
-		contentType := res.Header.Get("Content-Type")
-		mediaType, _, err := mime.ParseMediaType(contentType)
-		if err != nil || mediaType != "application/json" {
-			log.Printf("warning: Upstream server %s responded with an unknown content type %q", a.to, contentType)
-			return fmt.Errorf("unrecognized token response content-type %q", contentType)
+	var body []byte
+	for attempt := 0; ; attempt++ {
+		var status int
+		start := time.Now()
+		body, err = authorize.AgainstEndpoint(a.client, a.to, bytes.NewReader(data), cluster, func(res *http.Response) error {
+			status = res.StatusCode
+			if status >= http.StatusInternalServerError {
+				return fmt.Errorf("upstream responded with code %d", status)
+			}
+			if status != http.StatusOK && status != http.StatusCreated {
+				return nil
+			}
+			contentType := res.Header.Get("Content-Type")
+			mediaType, _, err := mime.ParseMediaType(contentType)
+			if err != nil || mediaType != "application/json" {
+				log.Printf("warning: Upstream server %s responded with an unknown content type %q", a.to, contentType)
+				return authorize.NewErrorWithCode(fmt.Errorf("unrecognized token response content-type %q", contentType), http.StatusBadGateway)
+			}
+			return nil
+		})
+		a.Metrics.ObserveDuration("external", start)
+		if err == nil {
+			break
 		}
-		return nil
-	})
-	if err != nil {
-		return "", err
+		// the server answered and denied the request
+		if status > 0 && status < http.StatusInternalServerError {
+			return "", nil, err
+		}
+		if attempt >= a.Retries {
+			log.Printf("warning: Upstream server %s is unavailable: %v", a.to, err)
+			return "", nil, authorize.NewErrorWithCode(fmt.Errorf("authorization service is unavailable"), http.StatusServiceUnavailable)
+		}
+		time.Sleep(a.RetryBackoff << uint(attempt))
 	}
 
 	response := &clusterRegistration{}
 	if err := json.Unmarshal(body, response); err != nil {
 		log.Printf("warning: Upstream server %s response could not be parsed", a.to)
-		return "", fmt.Errorf("unable to parse response body: %v", err)
+		return "", nil, authorize.NewErrorWithCode(fmt.Errorf("unable to parse response body: %v", err), http.StatusBadGateway)
 	}
 
 	if len(response.AccountID) == 0 {
 		log.Printf("warning: Upstream server %s responded with an empty user string", a.to)
-		return "", fmt.Errorf("server responded with an empty user string")
+		return "", nil, authorize.NewErrorWithCode(fmt.Errorf("server responded with an empty user string"), http.StatusBadGateway)
 	}
 
-	return response.AccountID, nil
+	labels := authorize.SanitizeLabels(response.Labels)
+	if len(a.AccountLabel) > 0 {
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[a.AccountLabel] = response.AccountID
+	}
+	return response.AccountID, labels, nil
 }
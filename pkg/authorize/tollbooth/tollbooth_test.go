@@ -0,0 +1,218 @@
+package tollbooth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func TestAuthorizeClusterLabels(t *testing.T) {
+	allow := func(w http.ResponseWriter, req *http.Request) {
+		var reg clusterRegistration
+		if err := json.NewDecoder(req.Body).Decode(&reg); err != nil {
+			t.Fatal(err)
+		}
+		Write(w, http.StatusOK, clusterRegistration{
+			ClusterID: reg.ClusterID,
+			AccountID: "account-" + reg.AuthorizationToken,
+			Labels:    map[string]string{"plan": "premium"},
+		})
+	}
+
+	tests := []struct {
+		name         string
+		handler      func(calls int32) http.HandlerFunc
+		timeout      time.Duration
+		wantSubject  string
+		wantLabels   map[string]string
+		wantCode     int
+		wantAttempts int32
+	}{
+		{
+			name:         "allow",
+			handler:      func(int32) http.HandlerFunc { return allow },
+			wantSubject:  "account-a",
+			wantLabels:   map[string]string{"plan": "premium"},
+			wantAttempts: 1,
+		},
+		{
+			name: "deny",
+			handler: func(int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, req *http.Request) {
+					Write(w, http.StatusForbidden, &registrationError{Name: "Forbidden", Reason: "The cluster is not entitled."})
+				}
+			},
+			wantCode:     http.StatusForbidden,
+			wantAttempts: 1,
+		},
+		{
+			name: "unauthorized",
+			handler: func(int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, req *http.Request) {
+					Write(w, http.StatusUnauthorized, &registrationError{Name: "NotAuthorized"})
+				}
+			},
+			wantCode:     http.StatusUnauthorized,
+			wantAttempts: 1,
+		},
+		{
+			name: "malformed response",
+			handler: func(int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, req *http.Request) {
+					w.Header().Set("Content-Type", "application/json")
+					w.Write([]byte("{"))
+				}
+			},
+			wantCode:     http.StatusBadGateway,
+			wantAttempts: 1,
+		},
+		{
+			name: "unknown content type",
+			handler: func(int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, req *http.Request) {
+					w.Write([]byte("ok"))
+				}
+			},
+			wantCode:     http.StatusBadGateway,
+			wantAttempts: 1,
+		},
+		{
+			name: "empty account",
+			handler: func(int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, req *http.Request) {
+					Write(w, http.StatusOK, clusterRegistration{ClusterID: "cluster-1"})
+				}
+			},
+			wantCode:     http.StatusBadGateway,
+			wantAttempts: 1,
+		},
+		{
+			name: "server error is retried",
+			handler: func(calls int32) http.HandlerFunc {
+				if calls < 3 {
+					return func(w http.ResponseWriter, req *http.Request) {
+						w.WriteHeader(http.StatusInternalServerError)
+					}
+				}
+				return allow
+			},
+			wantSubject:  "account-a",
+			wantLabels:   map[string]string{"plan": "premium"},
+			wantAttempts: 3,
+		},
+		{
+			name: "server error after retries",
+			handler: func(int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, req *http.Request) {
+					w.WriteHeader(http.StatusBadGateway)
+				}
+			},
+			wantCode:     http.StatusServiceUnavailable,
+			wantAttempts: 3,
+		},
+		{
+			name: "timeout",
+			handler: func(int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, req *http.Request) {
+					time.Sleep(100 * time.Millisecond)
+					allow(w, req)
+				}
+			},
+			timeout:      20 * time.Millisecond,
+			wantCode:     http.StatusServiceUnavailable,
+			wantAttempts: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				tt.handler(atomic.AddInt32(&calls, 1))(w, req)
+			}))
+			defer s.Close()
+			u, _ := url.Parse(s.URL)
+
+			a := NewAuthorizer(&http.Client{Timeout: tt.timeout}, u)
+			a.Retries = 2
+			a.RetryBackoff = time.Millisecond
+			r := prometheus.NewRegistry()
+			a.Metrics = authorize.NewMetrics(r)
+
+			subject, labels, err := a.AuthorizeClusterLabels("a", "cluster-1")
+			if got := atomic.LoadInt32(&calls); got != tt.wantAttempts {
+				t.Errorf("want %d attempts, got %d", tt.wantAttempts, got)
+			}
+			if got := observedAttempts(t, r); got != uint64(tt.wantAttempts) {
+				t.Errorf("want the duration of %d attempts observed, got %d", tt.wantAttempts, got)
+			}
+			if tt.wantCode != 0 {
+				scerr, ok := err.(authorize.ErrorWithCode)
+				if !ok || scerr.HTTPStatusCode() != tt.wantCode {
+					t.Fatalf("want error with code %d, got %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if subject != tt.wantSubject {
+				t.Errorf("want subject %q, got %q", tt.wantSubject, subject)
+			}
+			if !reflect.DeepEqual(labels, tt.wantLabels) {
+				t.Errorf("want labels %v, got %v", tt.wantLabels, labels)
+			}
+		})
+	}
+}
+
+func TestAuthorizeClusterAccountLabels(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		Write(w, http.StatusOK, clusterRegistration{
+			ClusterID: "cluster-1",
+			AccountID: "account-1",
+			Labels:    map[string]string{"support-level": "premium", "1org": "org-1", "__name__": "spoofed", "empty": ""},
+		})
+	}))
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+
+	a := NewAuthorizer(http.DefaultClient, u)
+	a.AccountLabel = "account_id"
+	_, labels, err := a.AuthorizeClusterLabels("a", "cluster-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"account_id": "account-1", "support_level": "premium", "_1org": "org-1"}
+	if !reflect.DeepEqual(labels, want) {
+		t.Fatalf("want labels %v, got %v", want, labels)
+	}
+}
+
+// observedAttempts returns the number of requests to the server whose duration was observed.
+func observedAttempts(t *testing.T, r *prometheus.Registry) uint64 {
+	t.Helper()
+	families, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "telemeter_authorizer_duration_seconds" {
+			continue
+		}
+		for _, m := range f.Metric {
+			if len(m.Label) == 1 && m.Label[0].GetValue() == "external" {
+				return m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,210 @@
+// Package cache holds the state the servers of a deployment share, such as authorization
+// decisions, idempotency keys and rate limits, so that a replicated server behaves like a
+// single one. The state is held by a Redis server, or in memory if it is not shared.
+package cache
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cacheFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "telemeter_cache_fallbacks_total",
+	Help: "Tracks the number of cache operations served by the local fallback because the shared cache failed, by operation.",
+}, []string{"operation"})
+
+func init() {
+	prometheus.MustRegister(cacheFallbacks)
+}
+
+// Cache stores values that expire.
+type Cache interface {
+	// Get returns the value of key, and false if it is not set or has expired.
+	Get(key string) ([]byte, bool, error)
+	// Set sets the value of key, expiring after ttl.
+	Set(key string, value []byte, ttl time.Duration) error
+	// Incr increments the counter at key and returns its new value. A counter that is not set
+	// is created with the value 1, expiring after ttl. Later increments do not extend it.
+	Incr(key string, ttl time.Duration) (int64, error)
+	// Append appends value to the value at key. A key that is not set is created with the
+	// value, expiring after ttl. Later appends do not extend it.
+	Append(key string, value []byte, ttl time.Duration) error
+}
+
+type entry struct {
+	value   []byte
+	expires time.Time
+}
+
+// Memory is a cache of a single process.
+type Memory struct {
+	nowFn func() time.Time
+
+	mu  sync.Mutex
+	lru *simplelru.LRU
+}
+
+// NewMemory returns a cache holding up to size keys. The least recently used keys are evicted
+// first.
+func NewMemory(size int) (*Memory, error) {
+	lru, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Memory{nowFn: time.Now, lru: lru}, nil
+}
+
+func (c *Memory) Get(key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.get(key)
+	return e.value, ok, nil
+}
+
+// get returns the entry of key if it has not expired. The caller must hold the lock.
+func (c *Memory) get(key string) (entry, bool) {
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return entry{}, false
+	}
+	e := v.(entry)
+	if !c.nowFn().Before(e.expires) {
+		c.lru.Remove(key)
+		return entry{}, false
+	}
+	return e, true
+}
+
+func (c *Memory) Set(key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Add(key, entry{value: value, expires: c.nowFn().Add(ttl)})
+	return nil
+}
+
+func (c *Memory) Incr(key string, ttl time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.get(key)
+	if !ok {
+		e = entry{expires: c.nowFn().Add(ttl)}
+	}
+	n, _ := strconv.ParseInt(string(e.value), 10, 64)
+	n++
+	e.value = []byte(strconv.FormatInt(n, 10))
+	c.lru.Add(key, e)
+	return n, nil
+}
+
+func (c *Memory) Append(key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.get(key)
+	if !ok {
+		e = entry{expires: c.nowFn().Add(ttl)}
+	}
+	appended := make([]byte, 0, len(e.value)+len(value))
+	e.value = append(append(appended, e.value...), value...)
+	c.lru.Add(key, e)
+	return nil
+}
+
+// fallback uses a local cache while the shared cache fails.
+type fallback struct {
+	shared  Cache
+	local   Cache
+	backoff time.Duration
+	nowFn   func() time.Time
+
+	mu    sync.Mutex
+	until time.Time
+}
+
+// NewFallback returns a cache that uses shared, and local if shared fails. After a failure,
+// local is used for backoff before shared is tried again, so that an unavailable shared cache
+// delays at most one request per backoff. Errors of shared are logged and never returned.
+func NewFallback(shared, local Cache, backoff time.Duration) Cache {
+	return &fallback{shared: shared, local: local, backoff: backoff, nowFn: time.Now}
+}
+
+// available returns true if the shared cache should be tried.
+func (c *fallback) available() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.nowFn().Before(c.until)
+}
+
+// failed records a failure of the shared cache and backs off from it. Only the first failure of
+// each backoff is logged.
+func (c *fallback) failed(operation string, err error) {
+	cacheFallbacks.WithLabelValues(operation).Inc()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.nowFn()
+	if now.Before(c.until) {
+		return
+	}
+	c.until = now.Add(c.backoff)
+	log.Printf("error: shared cache failed, using the local cache for %s: %v", c.backoff, err)
+}
+
+func (c *fallback) Get(key string) ([]byte, bool, error) {
+	if c.available() {
+		value, ok, err := c.shared.Get(key)
+		if err == nil {
+			return value, ok, nil
+		}
+		c.failed("get", err)
+	} else {
+		cacheFallbacks.WithLabelValues("get").Inc()
+	}
+	value, ok, _ := c.local.Get(key)
+	return value, ok, nil
+}
+
+func (c *fallback) Set(key string, value []byte, ttl time.Duration) error {
+	if c.available() {
+		err := c.shared.Set(key, value, ttl)
+		if err == nil {
+			return nil
+		}
+		c.failed("set", err)
+	} else {
+		cacheFallbacks.WithLabelValues("set").Inc()
+	}
+	c.local.Set(key, value, ttl)
+	return nil
+}
+
+func (c *fallback) Incr(key string, ttl time.Duration) (int64, error) {
+	if c.available() {
+		n, err := c.shared.Incr(key, ttl)
+		if err == nil {
+			return n, nil
+		}
+		c.failed("incr", err)
+	} else {
+		cacheFallbacks.WithLabelValues("incr").Inc()
+	}
+	n, _ := c.local.Incr(key, ttl)
+	return n, nil
+}
+
+func (c *fallback) Append(key string, value []byte, ttl time.Duration) error {
+	if c.available() {
+		err := c.shared.Append(key, value, ttl)
+		if err == nil {
+			return nil
+		}
+		c.failed("append", err)
+	} else {
+		cacheFallbacks.WithLabelValues("append").Inc()
+	}
+	c.local.Append(key, value, ttl)
+	return nil
+}
@@ -0,0 +1,229 @@
+package cache
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// errNil is the reply to GET of a key that is not set.
+var errNil = errors.New("nil reply")
+
+// Redis is a cache held by a Redis server, shared by every server using it. Keys are prefixed,
+// so that deployments may share a Redis server.
+type Redis struct {
+	// Username and Password authenticate new connections with AUTH if Password is set. A
+	// username requires Redis 6 or later.
+	Username string
+	Password string
+	// TLSConfig, if set, secures connections with TLS.
+	TLSConfig *tls.Config
+
+	addr    string
+	prefix  string
+	timeout time.Duration
+
+	idle chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewRedis returns a cache held by the Redis server at addr, prefixing keys with prefix. Each
+// operation fails if it does not complete within timeout. Up to maxIdle connections are kept
+// open between operations.
+func NewRedis(addr, prefix string, timeout time.Duration, maxIdle int) *Redis {
+	return &Redis{addr: addr, prefix: prefix, timeout: timeout, idle: make(chan *redisConn, maxIdle)}
+}
+
+func (c *Redis) Get(key string) ([]byte, bool, error) {
+	replies, err := c.do([]string{"GET", c.prefix + key})
+	if err == errNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	value, ok := replies[0].([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("unexpected reply to GET: %v", replies[0])
+	}
+	return value, true, nil
+}
+
+func (c *Redis) Set(key string, value []byte, ttl time.Duration) error {
+	_, err := c.do([]string{"SET", c.prefix + key, string(value), "PX", milliseconds(ttl)})
+	return err
+}
+
+// Incr creates the counter with its expiry unless it exists, and increments it, in a single
+// round trip. INCR keeps the expiry of the counter.
+func (c *Redis) Incr(key string, ttl time.Duration) (int64, error) {
+	key = c.prefix + key
+	replies, err := c.do(
+		[]string{"SET", key, "0", "PX", milliseconds(ttl), "NX"},
+		[]string{"INCR", key},
+	)
+	if err != nil && err != errNil {
+		return 0, err
+	}
+	n, ok := replies[1].(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply to INCR: %v", replies[1])
+	}
+	return n, nil
+}
+
+// Append creates the value with its expiry unless it exists, and appends to it, in a single
+// round trip. APPEND keeps the expiry of the value.
+func (c *Redis) Append(key string, value []byte, ttl time.Duration) error {
+	key = c.prefix + key
+	replies, err := c.do(
+		[]string{"SET", key, "", "PX", milliseconds(ttl), "NX"},
+		[]string{"APPEND", key, string(value)},
+	)
+	if err != nil && err != errNil {
+		return err
+	}
+	if _, ok := replies[1].(int64); !ok {
+		return fmt.Errorf("unexpected reply to APPEND: %v", replies[1])
+	}
+	return nil
+}
+
+// milliseconds formats d as milliseconds, at least 1 as Redis rejects expiries of 0.
+func milliseconds(d time.Duration) string {
+	ms := int64(d / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+// do sends the commands in a single write and returns their replies. If a command is answered
+// with a nil reply, errNil is returned along with all replies.
+func (c *Redis) do(commands ...[]string) ([]interface{}, error) {
+	conn, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := c.roundTrip(conn, commands)
+	if err != nil && err != errNil {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return replies, err
+}
+
+func (c *Redis) conn() (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	dialer := &net.Dialer{Timeout: c.timeout}
+	var conn net.Conn
+	var err error
+	if c.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	if len(c.Password) > 0 {
+		auth := []string{"AUTH", c.Password}
+		if len(c.Username) > 0 {
+			auth = []string{"AUTH", c.Username, c.Password}
+		}
+		if _, err := c.roundTrip(rc, [][]string{auth}); err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("unable to authenticate: %v", err)
+		}
+	}
+	return rc, nil
+}
+
+func (c *Redis) roundTrip(conn *redisConn, commands [][]string) ([]interface{}, error) {
+	if err := conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	var buf []byte
+	for _, args := range commands {
+		buf = append(buf, '*')
+		buf = strconv.AppendInt(buf, int64(len(args)), 10)
+		buf = append(buf, '\r', '\n')
+		for _, arg := range args {
+			buf = append(buf, '$')
+			buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+			buf = append(buf, '\r', '\n')
+			buf = append(buf, arg...)
+			buf = append(buf, '\r', '\n')
+		}
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	var result error
+	replies := make([]interface{}, len(commands))
+	for i := range commands {
+		reply, err := readReply(conn.r)
+		if err == errNil {
+			result = errNil
+		} else if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, result
+}
+
+// readReply reads a reply of the Redis protocol: a status, error, integer or bulk string.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed reply %q", line)
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	default:
+		return nil, fmt.Errorf("unsupported reply %q", line)
+	}
+}
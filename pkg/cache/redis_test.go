@@ -0,0 +1,296 @@
+package cache
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves the subset of the Redis protocol used by Redis.
+type fakeRedis struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	values   map[string]entry
+	down     bool
+	password string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFakeRedis(l)
+}
+
+func serveFakeRedis(l net.Listener) *fakeRedis {
+	s := &fakeRedis{l: l, values: make(map[string]entry)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	s.mu.Lock()
+	authenticated := len(s.password) == 0
+	s.mu.Unlock()
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		reply := "-NOAUTH Authentication required.\r\n"
+		switch {
+		case strings.ToUpper(args[0]) == "AUTH":
+			s.mu.Lock()
+			authenticated = args[len(args)-1] == s.password
+			s.mu.Unlock()
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-WRONGPASS invalid username-password pair\r\n"
+			}
+		case authenticated:
+			reply = s.exec(args)
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line)[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func (s *fakeRedis) exec(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return "-LOADING Redis is loading the dataset in memory\r\n"
+	}
+	now := time.Now()
+	e, ok := s.values[args[1]]
+	if ok && !now.Before(e.expires) {
+		delete(s.values, args[1])
+		ok = false
+	}
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(e.value), e.value)
+	case "SET":
+		ms, _ := strconv.Atoi(args[4])
+		if ok && len(args) > 5 && args[5] == "NX" {
+			return "$-1\r\n"
+		}
+		s.values[args[1]] = entry{value: []byte(args[2]), expires: now.Add(time.Duration(ms) * time.Millisecond)}
+		return "+OK\r\n"
+	case "INCR":
+		if !ok {
+			e = entry{expires: now.Add(time.Hour)}
+		}
+		n, _ := strconv.ParseInt(string(e.value), 10, 64)
+		n++
+		e.value = []byte(strconv.FormatInt(n, 10))
+		s.values[args[1]] = e
+		return fmt.Sprintf(":%d\r\n", n)
+	case "APPEND":
+		if !ok {
+			e = entry{expires: now.Add(time.Hour)}
+		}
+		e.value = append(append([]byte(nil), e.value...), args[2]...)
+		s.values[args[1]] = e
+		return fmt.Sprintf(":%d\r\n", len(e.value))
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func TestRedis(t *testing.T) {
+	s := newFakeRedis(t)
+	defer s.l.Close()
+	// two servers sharing the cache
+	a := NewRedis(s.l.Addr().String(), "test/", time.Second, 2)
+	b := NewRedis(s.l.Addr().String(), "test/", time.Second, 2)
+
+	if _, ok, err := a.Get("key"); ok || err != nil {
+		t.Fatalf("want unset key, got %t %v", ok, err)
+	}
+	if err := a.Set("key", []byte("value"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok, err := b.Get("key"); !ok || err != nil || string(value) != "value" {
+		t.Fatalf("want value, got %q %t %v", value, ok, err)
+	}
+
+	for i, c := range []*Redis{a, b, a} {
+		n, err := c.Incr("counter", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(i+1) {
+			t.Fatalf("want counter %d, got %d", i+1, n)
+		}
+	}
+	if err := a.Append("list", []byte("a"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Append("list", []byte("b"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok, err := a.Get("list"); !ok || err != nil || string(value) != "ab" {
+		t.Fatalf("want the appended values, got %q %t %v", value, ok, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range []string{"test/counter", "test/list"} {
+		if e := s.values[key]; time.Until(e.expires) > time.Minute {
+			t.Fatalf("want %s to expire after its ttl, expires in %s", key, time.Until(e.expires))
+		}
+	}
+}
+
+func TestRedisAuthAndTLS(t *testing.T) {
+	cert := selfSignedCertificate(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := serveFakeRedis(l)
+	defer s.l.Close()
+	s.mu.Lock()
+	s.password = "secret"
+	s.mu.Unlock()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	c := NewRedis(s.l.Addr().String(), "", time.Second, 2)
+	c.TLSConfig = &tls.Config{RootCAs: pool, ServerName: "redis.example.com"}
+	if _, _, err := c.Get("key"); err == nil {
+		t.Fatal("want unauthenticated connections to be rejected")
+	}
+
+	c.Username, c.Password = "telemeter", "secret"
+	if err := c.Set("key", []byte("value"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok, err := c.Get("key"); !ok || err != nil || string(value) != "value" {
+		t.Fatalf("want value, got %q %t %v", value, ok, err)
+	}
+
+	plain := NewRedis(s.l.Addr().String(), "", time.Second, 2)
+	plain.Username, plain.Password = "telemeter", "secret"
+	if _, _, err := plain.Get("key"); err == nil {
+		t.Fatal("want connections without TLS to fail")
+	}
+}
+
+// selfSignedCertificate returns a certificate of redis.example.com signed by itself.
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis.example.com"},
+		DNSNames:              []string{"redis.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestFallback(t *testing.T) {
+	s := newFakeRedis(t)
+	defer s.l.Close()
+	local, err := NewMemory(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(100000, 0)
+	c := NewFallback(NewRedis(s.l.Addr().String(), "", 100*time.Millisecond, 2), local, 10*time.Second)
+	c.(*fallback).nowFn = func() time.Time { return now }
+
+	if n, err := c.Incr("counter", time.Minute); n != 1 || err != nil {
+		t.Fatalf("want counter 1, got %d %v", n, err)
+	}
+
+	// an unavailable shared cache degrades to the local cache without errors
+	s.mu.Lock()
+	s.down = true
+	s.mu.Unlock()
+	for i := 1; i <= 2; i++ {
+		if n, err := c.Incr("counter", time.Minute); n != int64(i) || err != nil {
+			t.Fatalf("want local counter %d, got %d %v", i, n, err)
+		}
+	}
+	if err := c.Set("key", []byte("value"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok, err := c.Get("key"); !ok || err != nil || string(value) != "value" {
+		t.Fatalf("want local value, got %q %t %v", value, ok, err)
+	}
+	if until := c.(*fallback).until; !until.Equal(now.Add(10 * time.Second)) {
+		t.Fatalf("want to back off from the shared cache until %s, got %s", now.Add(10*time.Second), until)
+	}
+}
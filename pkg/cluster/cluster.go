@@ -18,6 +18,7 @@ import (
 	"github.com/openshift/telemeter/pkg/metricfamily"
 	"github.com/openshift/telemeter/pkg/metricsclient"
 	"github.com/openshift/telemeter/pkg/store"
+	"github.com/openshift/telemeter/pkg/store/ratelimited"
 )
 
 var (
@@ -53,10 +54,22 @@ const (
 	//   1-??:   <header(metricMessageHeader)>
 	//   remain: <snappy-compressed(protobuf-delimited-metrics)>
 	metricMessage messageType = 1
+
+	// deleteMessage asks the member owning a partition key to delete its partition.
+	// Format is:
+	//   0:      <type(byte)>
+	//   1-??:   <header(deleteMessageHeader)>
+	deleteMessage messageType = 2
 )
 
 type metricMessageHeader struct {
 	PartitionKey string
+	// UploadInterval is the rate limit of the client that uploaded the metrics, if it has one.
+	UploadInterval time.Duration
+}
+
+type deleteMessageHeader struct {
+	PartitionKey string
 }
 
 type nodeData struct {
@@ -274,7 +287,8 @@ func (c *DynamicCluster) LocalState(join bool) []byte { return nil }
 func (c *DynamicCluster) MergeRemoteState(buf []byte, join bool) {}
 
 // handleMessage is invoked as soon as there is data available in the message queue.
-// It decodes the underlying metric families and stores it using the given metrics store.
+// It decodes the underlying metric families and stores it using the given metrics store,
+// or deletes the partition of a delete message from it.
 func (c *DynamicCluster) handleMessage(data []byte) error {
 	switch messageType(data[0]) {
 	case metricMessage:
@@ -296,11 +310,29 @@ func (c *DynamicCluster) handleMessage(data []byte) error {
 		if len(families) == 0 {
 			return nil
 		}
-		return c.store.WriteMetrics(c.ctx, &store.PartitionedMetrics{
+		ctx := c.ctx
+		if header.UploadInterval > 0 {
+			ctx = ratelimited.WithInterval(ctx, header.UploadInterval)
+		}
+		return c.store.WriteMetrics(ctx, &store.PartitionedMetrics{
 			PartitionKey: header.PartitionKey,
 			Families:     families,
 		})
 
+	case deleteMessage:
+		d := codec.NewDecoder(bytes.NewBuffer(data[1:]), msgHandle)
+		var header deleteMessageHeader
+		if err := d.Decode(&header); err != nil {
+			return err
+		}
+		if len(header.PartitionKey) == 0 {
+			return fmt.Errorf("delete message must have a partition key")
+		}
+		if err := store.DeleteMetrics(c.ctx, c.store, header.PartitionKey); err != nil && err != store.ErrPartitionNotFound {
+			return err
+		}
+		return nil
+
 	default:
 		return fmt.Errorf("unrecognized message %0x, len=%d", data[0], len(data))
 	}
@@ -393,7 +425,7 @@ func (c *DynamicCluster) forwardMetrics(ctx context.Context, p *store.Partitione
 
 	// write the metric message
 	buf.WriteByte(byte(metricMessage))
-	if err := enc.Encode(&metricMessageHeader{PartitionKey: p.PartitionKey}); err != nil {
+	if err := enc.Encode(&metricMessageHeader{PartitionKey: p.PartitionKey, UploadInterval: ratelimited.Interval(ctx)}); err != nil {
 		metricForwardResult.WithLabelValues("encode_header").Inc()
 		return false, err
 	}
@@ -421,6 +453,52 @@ func (c *DynamicCluster) ReadMetrics(ctx context.Context, minTimestampMs int64)
 	return c.store.ReadMetrics(ctx, minTimestampMs)
 }
 
+// ReadPartitions simply forwards to the underlying store.
+func (c *DynamicCluster) ReadPartitions(ctx context.Context, minTimestampMs int64, partitionKeys ...string) ([]*store.PartitionedMetrics, error) {
+	return store.ReadPartitions(ctx, c.store, minTimestampMs, partitionKeys...)
+}
+
+// DeleteMetrics asks the member owning the partition key to delete its partition, and
+// deletes the copy of the underlying store, which holds the partitions written while their
+// owner could not be reached. ErrDeletePending is returned once the request is sent to
+// another member, which deletes the partition asynchronously.
+func (c *DynamicCluster) DeleteMetrics(ctx context.Context, partitionKey string) error {
+	forwarded, err := c.forwardDelete(partitionKey)
+	if err != nil {
+		log.Printf("error: Unable to forward the deletion of partition %s, deleting it locally only: %v", partitionKey, err)
+	}
+	err = store.DeleteMetrics(ctx, c.store, partitionKey)
+	if forwarded && (err == nil || err == store.ErrPartitionNotFound) {
+		return store.ErrDeletePending
+	}
+	return err
+}
+
+// forwardDelete sends the deletion of the partition to the member owning the partition key,
+// returning false if it is this one.
+func (c *DynamicCluster) forwardDelete(partitionKey string) (bool, error) {
+	now := time.Now()
+
+	node, ok := c.findRemote(partitionKey, now)
+	if !ok {
+		return false, nil
+	}
+	if node.Name == c.name {
+		return false, nil
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte(byte(deleteMessage))
+	if err := codec.NewEncoder(buf, msgHandle).Encode(&deleteMessageHeader{PartitionKey: partitionKey}); err != nil {
+		return false, err
+	}
+	if err := c.ml.SendReliable(node, buf.Bytes()); err != nil {
+		c.problemDetected(node.Name, now)
+		return false, err
+	}
+	return true, nil
+}
+
 // WriteMetrics stores metrics locally if they were meant for this node
 // and forwards them to the target node matching the given partition key.
 func (c *DynamicCluster) WriteMetrics(ctx context.Context, p *store.PartitionedMetrics) error {
@@ -21,12 +21,21 @@ type testStore struct {
 
 	partitionKey string
 	families     []*clientmodel.MetricFamily
+	deleted      []string
 }
 
 func (s *testStore) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*store.PartitionedMetrics, error) {
 	return nil, s.readErr
 }
 
+func (s *testStore) DeleteMetrics(_ context.Context, partitionKey string) error {
+	s.deleted = append(s.deleted, partitionKey)
+	if partitionKey != s.partitionKey {
+		return store.ErrPartitionNotFound
+	}
+	return nil
+}
+
 func (s *testStore) WriteMetrics(_ context.Context, p *store.PartitionedMetrics) error {
 	s.partitionKey = p.PartitionKey
 	s.families = p.Families
@@ -391,3 +400,83 @@ func TestWriteMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestDeleteMetrics(t *testing.T) {
+	members := func() *testMemberlister {
+		return &testMemberlister{
+			numMembers: 2,
+			members: []*memberlist.Node{
+				{Name: "local"},
+				{Name: "remote"},
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		name, partitionKey string
+		sendReliableErr    error
+		localPartitionKey  string
+
+		wantErr     error
+		wantForward bool
+	}{
+		{
+			name:              "local member deletes",
+			partitionKey:      "c",
+			localPartitionKey: "c",
+		},
+		{
+			name:              "local member without the partition",
+			partitionKey:      "c",
+			localPartitionKey: "d",
+			wantErr:           store.ErrPartitionNotFound,
+		},
+		{
+			name:         "remote member deletes",
+			partitionKey: "a",
+			wantErr:      store.ErrDeletePending,
+			wantForward:  true,
+		},
+		{
+			name:              "remote member unreachable",
+			partitionKey:      "a",
+			sendReliableErr:   errors.New("send error"),
+			localPartitionKey: "a",
+			wantForward:       true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			local := &testStore{partitionKey: tc.localPartitionKey}
+			ml := members()
+			ml.sendReliableErr = tc.sendReliableErr
+			dc := NewDynamic("local", local)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			dc.Start(ml, ctx)
+			dc.refreshRing()
+
+			if err := dc.DeleteMetrics(ctx, tc.partitionKey); err != tc.wantErr {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			}
+			// the local copy is deleted in any case
+			if want := []string{tc.partitionKey}; !reflect.DeepEqual(local.deleted, want) {
+				t.Errorf("want partitions %v deleted locally, got %v", want, local.deleted)
+			}
+			if forwarded := ml.sendReliableNode != nil; forwarded != tc.wantForward {
+				t.Fatalf("want the deletion forwarded %t, got %t", tc.wantForward, forwarded)
+			}
+			if !tc.wantForward {
+				return
+			}
+
+			// the owner deletes the partition of the message
+			remote := &testStore{partitionKey: tc.partitionKey}
+			if err := NewDynamic("remote", remote).handleMessage(ml.sendReliablePayload); err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{tc.partitionKey}; !reflect.DeepEqual(remote.deleted, want) {
+				t.Errorf("want partitions %v deleted remotely, got %v", want, remote.deleted)
+			}
+		})
+	}
+}
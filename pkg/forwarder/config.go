@@ -0,0 +1,119 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/telemeter/pkg/metricfamily"
+)
+
+// configFileCheckInterval is how often the config file is checked for changes.
+const configFileCheckInterval = 10 * time.Second
+
+var (
+	counterConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_client_config_reloads_total",
+		Help: "Tracks the number of reloads of the config file after it changed, by result.",
+	}, []string{"result"})
+	gaugeConfigLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "telemeter_client_config_last_reload_successful",
+		Help: "Whether the last reload of the config file succeeded, or else the previous configuration is still in use.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(counterConfigReloads, gaugeConfigLastReloadSuccessful)
+}
+
+// FileConfig is the processing of the federated metrics, loaded from the config file so that
+// it can be changed without a restart. Settings present in the file replace those of Config,
+// including the match and aggregation rules files.
+type FileConfig struct {
+	Rules            []string                       `json:"match_rules"`
+	AnonymizeLabels  []string                       `json:"anonymize_labels"`
+	LabelActions     map[string]string              `json:"label_actions"`
+	AggregationRules []metricfamily.AggregationRule `json:"aggregation_rules"`
+}
+
+// loadConfigFile parses the config file at path, rejecting unknown settings.
+func loadConfigFile(path string) (FileConfig, error) {
+	var file FileConfig
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return file, fmt.Errorf("unable to read config-file: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return file, fmt.Errorf("unable to parse config-file: %v", err)
+	}
+	return file, nil
+}
+
+// apply returns cfg with the settings present in the file.
+func (f FileConfig) apply(cfg Config) Config {
+	if f.Rules != nil {
+		cfg.Rules, cfg.RulesFile = f.Rules, ""
+	}
+	if f.AnonymizeLabels != nil {
+		cfg.AnonymizeLabels = f.AnonymizeLabels
+	}
+	if f.LabelActions != nil {
+		cfg.LabelActions = f.LabelActions
+	}
+	if f.AggregationRules != nil {
+		cfg.AggregationRules, cfg.AggregationRulesFile = f.AggregationRules, ""
+	}
+	return cfg
+}
+
+// WatchConfigFile reconfigures the worker with cfg whenever the content of its config file
+// changes, until the context is done. The new configuration applies from the next upload, and
+// an invalid file is rejected, keeping the previous configuration. As the file is compared by
+// content, the file of a mounted ConfigMap is picked up when the symlinks to it are swapped.
+func (w *Worker) WatchConfigFile(ctx context.Context, cfg Config) {
+	w.watchConfigFile(ctx, cfg, configFileCheckInterval)
+}
+
+func (w *Worker) watchConfigFile(ctx context.Context, cfg Config, interval time.Duration) {
+	last, err := ioutil.ReadFile(cfg.ConfigFile)
+	if err != nil {
+		log.Printf("error: unable to read config-file: %v", err)
+	}
+	gaugeConfigLastReloadSuccessful.Set(1)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		data, err := ioutil.ReadFile(cfg.ConfigFile)
+		if err != nil {
+			// a ConfigMap may be briefly missing while it is updated
+			log.Printf("error: unable to read config-file, keeping the previous configuration: %v", err)
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+		worker, err := New(cfg)
+		if err != nil {
+			counterConfigReloads.WithLabelValues("failure").Inc()
+			gaugeConfigLastReloadSuccessful.Set(0)
+			log.Printf("error: invalid config-file, keeping the previous configuration: %v", err)
+			continue
+		}
+		w.apply(worker)
+		counterConfigReloads.WithLabelValues("success").Inc()
+		gaugeConfigLastReloadSuccessful.Set(1)
+		log.Printf("reloaded config-file %s", cfg.ConfigFile)
+	}
+}
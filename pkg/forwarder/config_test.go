@@ -0,0 +1,176 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+func TestWatchConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.json")
+	// write replaces the config file at once, as ConfigMaps are updated
+	write := func(config string) {
+		tmp := configFile + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, configFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"match_rules": ["{__name__=\"up\"}"]}`)
+
+	var (
+		mu      sync.Mutex
+		uploads []string
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		fmt.Fprint(w, "# TYPE up gauge\nup{job=\"a\"} 1 1000\n# TYPE requests gauge\nrequests{job=\"a\"} 2 1000\nrequests{job=\"b\"} 3 1000\n")
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+		families, err := metricsclient.Read(req.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var names []string
+		for _, family := range families {
+			names = append(names, family.GetName())
+		}
+		sort.Strings(names)
+		mu.Lock()
+		defer mu.Unlock()
+		uploads = append(uploads, strings.Join(names, ","))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	from, _ := url.Parse(ts.URL + "/federate")
+	to, _ := url.Parse(ts.URL + "/upload")
+	cfg := Config{From: from, ToUpload: to, Interval: 50 * time.Millisecond, LimitBytes: 200 * 1024, ConfigFile: configFile}
+	w, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+	go w.watchConfigFile(ctx, cfg, 10*time.Millisecond)
+
+	counter := func(result string) float64 {
+		m := &clientmodel.Metric{}
+		if err := counterConfigReloads.WithLabelValues(result).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	// waitFor waits for an upload of the metrics after the current uploads
+	waitFor := func(metrics string) {
+		mu.Lock()
+		seen := len(uploads)
+		mu.Unlock()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			mu.Lock()
+			n := len(uploads)
+			done := n > seen && uploads[n-1] == metrics
+			mu.Unlock()
+			if done {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		t.Fatalf("want an upload of %s, got %v", metrics, uploads)
+	}
+
+	waitFor("up")
+
+	successes, failures := counter("success"), counter("failure")
+	write(`{"match_rules": ["{__name__=\"requests\"}"], "aggregation_rules": [{"record": "requests:sum", "expr": "sum(requests)"}]}`)
+	waitFor("requests:sum")
+	if got := counter("success") - successes; got != 1 {
+		t.Errorf("want 1 successful reload, got %v", got)
+	}
+
+	// an invalid config is rejected and the previous one kept
+	write(`{"match_rules": ["requests{"]}`)
+	deadline := time.Now().Add(5 * time.Second)
+	for counter("failure") == failures && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := counter("failure") - failures; got != 1 {
+		t.Fatalf("want 1 failed reload, got %v", got)
+	}
+	m := &clientmodel.Metric{}
+	if err := gaugeConfigLastReloadSuccessful.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if m.GetGauge().GetValue() != 0 {
+		t.Errorf("want the last reload unsuccessful")
+	}
+	waitFor("requests:sum")
+	waitFor("requests:sum")
+
+	// settings removed from the file fall back to those of the Config, without aggregation rules
+	write(`{"match_rules": ["{__name__=~\"up|requests\"}"]}`)
+	waitFor("requests,up")
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.json")
+	from := &url.URL{}
+
+	for _, config := range []string{
+		`{"match_rule": ["up"]}`,
+		`{"match_rules": "up"}`,
+		`{"aggregation_rules": [{"record": "up:sum", "expr": "rate(up[5m])"}]}`,
+		`{"anonymize_labels": ["instance"]}`,
+	} {
+		if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := New(Config{From: from, ConfigFile: configFile}); err == nil {
+			t.Errorf("want config %s rejected", config)
+		}
+	}
+
+	if err := ioutil.WriteFile(configFile, []byte(`{"match_rules": ["up"], "label_actions": {"instance": "redact"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, err := New(Config{From: from, ConfigFile: configFile, Rules: []string{"other"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(w.rules, ","); got != "up" {
+		t.Errorf("want the match rules of the file, got %s", got)
+	}
+}
@@ -0,0 +1,104 @@
+package forwarder
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// PayloadHandler returns a handler that federates the source and processes the metrics as for
+// an upload, without uploading them. It responds with the metrics in the text format, preceded
+// by comments with the number of series left by each stage, and narrowed to the metric named
+// by the metric query parameter, if set. Only requests from the loopback interface are served.
+func (w *Worker) PayloadHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !fromLoopback(req) {
+			http.Error(rw, "the payload is only served to localhost", http.StatusForbidden)
+			return
+		}
+		metric := req.URL.Query().Get("metric")
+
+		type stage struct {
+			name   string
+			series int
+		}
+		var stages []stage
+		observe := func(name string, families []*clientmodel.MetricFamily) {
+			stages = append(stages, stage{name: name, series: countSeries(families, metric)})
+		}
+
+		w.lock.Lock()
+		families, err := w.retrieve(req.Context())
+		if err == nil {
+			observe("federate", families)
+			families, err = w.process(families, observe)
+		}
+		w.lock.Unlock()
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("unable to federate the metrics: %v", err), http.StatusBadGateway)
+			return
+		}
+
+		rw.Header().Set("Content-Type", string(expfmt.FmtText))
+		fmt.Fprintf(rw, "# The metrics of the next upload, which were not uploaded.\n")
+		if len(metric) > 0 {
+			fmt.Fprintf(rw, "# Only the series of %s are counted and shown.\n", metric)
+		}
+		for i, s := range stages {
+			fmt.Fprintf(rw, "# %s: %d series", s.name, s.series)
+			if i > 0 {
+				switch change := s.series - stages[i-1].series; {
+				case change < 0:
+					fmt.Fprintf(rw, ", %d dropped", -change)
+				case change > 0:
+					fmt.Fprintf(rw, ", %d added", change)
+				}
+			}
+			fmt.Fprintln(rw)
+		}
+		encoder := expfmt.NewEncoder(rw, expfmt.FmtText)
+		for _, family := range families {
+			if family == nil || len(metric) > 0 && family.GetName() != metric {
+				continue
+			}
+			if err := encoder.Encode(family); err != nil {
+				log.Printf("error: unable to write metrics for family: %v", err)
+				break
+			}
+		}
+	})
+}
+
+// countSeries returns the number of series of the families, only of the metric if set.
+func countSeries(families []*clientmodel.MetricFamily, metric string) int {
+	var n int
+	for _, family := range families {
+		if family == nil || len(metric) > 0 && family.GetName() != metric {
+			continue
+		}
+		for _, m := range family.Metric {
+			if m != nil {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// fromLoopback returns whether the request was sent from the loopback interface.
+func fromLoopback(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
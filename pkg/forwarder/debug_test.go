@@ -0,0 +1,159 @@
+package forwarder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/metricfamily"
+)
+
+func TestPayloadHandler(t *testing.T) {
+	const federated = `# TYPE container_memory_usage_bytes gauge
+container_memory_usage_bytes{namespace="a",pod="a-1"} 100 1000
+container_memory_usage_bytes{namespace="a",pod="a-2"} 200 1000
+# TYPE up gauge
+up{job="a"} 1 1000
+up{job="internal"} 1 1000
+# TYPE unmatched gauge
+unmatched 1 1000
+`
+	var uploads int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		fmt.Fprint(w, federated)
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+		uploads++
+	})
+	source := httptest.NewServer(mux)
+	defer source.Close()
+
+	from, _ := url.Parse(source.URL + "/federate")
+	to, _ := url.Parse(source.URL + "/upload")
+	w, err := New(Config{
+		From:       from,
+		ToUpload:   to,
+		Interval:   time.Minute,
+		LimitBytes: 200 * 1024,
+		Rules:      []string{`{__name__="up"}`, `{__name__="container_memory_usage_bytes"}`},
+		AggregationRules: []metricfamily.AggregationRule{
+			{Record: "namespace:container_memory_usage_bytes:sum", Expr: "sum by (namespace) (container_memory_usage_bytes)"},
+		},
+		// drop the series of internal jobs
+		Transformer: metricfamily.TransformerFunc(func(family *clientmodel.MetricFamily) (bool, error) {
+			for i, m := range family.Metric {
+				for _, l := range m.Label {
+					if l.GetName() == "job" && l.GetValue() == "internal" {
+						family.Metric[i] = nil
+					}
+				}
+			}
+			return metricfamily.PackMetrics(family)
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(w.PayloadHandler())
+	defer ts.Close()
+
+	get := func(t *testing.T, query string) string {
+		resp, err := http.Get(ts.URL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("want status 200, got %d: %s", resp.StatusCode, body)
+		}
+		// the response must be valid in the text format
+		if _, err := (&expfmt.TextParser{}).TextToMetricFamilies(strings.NewReader(string(body))); err != nil {
+			t.Fatalf("invalid text format: %v\n%s", err, body)
+		}
+		return string(body)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		query    string
+		want     []string
+		excluded []string
+	}{
+		{
+			name:  "all metrics",
+			query: "",
+			want: []string{
+				"# federate: 5 series\n",
+				"# match: 4 series, 1 dropped\n",
+				"# aggregate: 3 series, 1 dropped\n",
+				"# transform: 2 series, 1 dropped\n",
+				`namespace:container_memory_usage_bytes:sum{namespace="a"} 300 1000`,
+				`up{job="a"} 1 1000`,
+			},
+			excluded: []string{`job="internal"`, "unmatched 1", `pod="a-1"`},
+		},
+		{
+			name:  "metric",
+			query: "?metric=up",
+			want: []string{
+				"# Only the series of up are counted and shown.\n",
+				"# federate: 2 series\n",
+				"# match: 2 series\n",
+				"# aggregate: 2 series\n",
+				"# transform: 1 series, 1 dropped\n",
+				`up{job="a"} 1 1000`,
+			},
+			excluded: []string{"namespace:container_memory_usage_bytes:sum{", `job="internal"`},
+		},
+		{
+			name:  "aggregated metric",
+			query: "?metric=namespace:container_memory_usage_bytes:sum",
+			want: []string{
+				"# federate: 0 series\n",
+				"# aggregate: 1 series, 1 added\n",
+				`namespace:container_memory_usage_bytes:sum{namespace="a"} 300 1000`,
+			},
+			excluded: []string{`up{`},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body := get(t, "/debug/payload"+tt.query)
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("want %q in\n%s", want, body)
+				}
+			}
+			for _, excluded := range tt.excluded {
+				if strings.Contains(body, excluded) {
+					t.Errorf("want no %q in\n%s", excluded, body)
+				}
+			}
+		})
+	}
+	if uploads != 0 {
+		t.Errorf("want nothing uploaded, got %d uploads", uploads)
+	}
+
+	// only local requests are served
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/debug/payload", nil)
+	req.RemoteAddr = "10.0.0.1:43210"
+	w.PayloadHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("want a remote request forbidden, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,148 @@
+package forwarder
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultFailbackInterval is how long requests stay with the server failed over to before the
+// preferred server is tried again.
+const defaultFailbackInterval = 5 * time.Minute
+
+var (
+	counterEndpointRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_client_endpoint_requests_total",
+		Help: "Tracks the number of requests to the telemeter servers, including uploads and token exchanges, by server endpoint and status code, or error for connection errors.",
+	}, []string{"endpoint", "code"})
+	gaugeActiveEndpoint = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "telemeter_client_active_endpoint",
+		Help: "Whether the server endpoint is the one requests are sent to.",
+	}, []string{"endpoint"})
+)
+
+func init() {
+	prometheus.MustRegister(counterEndpointRequests, gaugeActiveEndpoint)
+}
+
+// failoverTransport sends the requests to the preferred server to the first of the servers that
+// responds without a connection error or 5xx, starting from the active one. Only the scheme and
+// host of requests are replaced. Once requests failed over, the preferred server is tried first
+// again every failback interval, so that requests fail back to it once it recovers.
+type failoverTransport struct {
+	endpoints []*url.URL
+	next      http.RoundTripper
+	failback  time.Duration
+	nowFn     func() time.Time
+
+	mu     sync.Mutex
+	active int
+	probed time.Time
+}
+
+func newFailoverTransport(preferred *url.URL, failover []*url.URL, failback time.Duration, next http.RoundTripper) *failoverTransport {
+	if failback <= 0 {
+		failback = defaultFailbackInterval
+	}
+	t := &failoverTransport{next: next, failback: failback, nowFn: time.Now}
+	for _, u := range append([]*url.URL{preferred}, failover...) {
+		t.endpoints = append(t.endpoints, &url.URL{Scheme: u.Scheme, Host: u.Host})
+	}
+	t.setActive(0)
+	return t
+}
+
+// start returns the index of the endpoint to send the next request to first.
+func (t *failoverTransport) start() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active != 0 && t.nowFn().Sub(t.probed) >= t.failback {
+		t.probed = t.nowFn()
+		return 0
+	}
+	return t.active
+}
+
+// setActive makes the endpoint at index the one requests are sent to first.
+func (t *failoverTransport) setActive(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if index != t.active {
+		if index == 0 {
+			log.Printf("failed back to the telemeter server %s", t.endpoints[index])
+		} else {
+			log.Printf("warning: failed over to the telemeter server %s", t.endpoints[index])
+		}
+		if t.active == 0 {
+			t.probed = t.nowFn()
+		}
+	}
+	t.active = index
+	for i, endpoint := range t.endpoints {
+		if i == index {
+			gaugeActiveEndpoint.WithLabelValues(endpoint.String()).Set(1)
+		} else {
+			gaugeActiveEndpoint.WithLabelValues(endpoint.String()).Set(0)
+		}
+	}
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	preferred := t.endpoints[0]
+	if req.URL.Scheme != preferred.Scheme || req.URL.Host != preferred.Host {
+		return t.next.RoundTrip(req)
+	}
+
+	start := t.start()
+	var (
+		resp *http.Response
+		err  error
+	)
+	for i := range t.endpoints {
+		index := (start + i) % len(t.endpoints)
+		endpoint := t.endpoints[index]
+		r := new(http.Request)
+		*r = *req
+		u := *req.URL
+		u.Scheme, u.Host = endpoint.Scheme, endpoint.Host
+		r.URL, r.Host = &u, ""
+		if i > 0 && req.Body != nil {
+			// the request can only be sent again if its body can be read again
+			if req.GetBody == nil {
+				break
+			}
+			body, berr := req.GetBody()
+			if berr != nil {
+				break
+			}
+			r.Body = body
+		}
+		if resp != nil {
+			// the 5xx response of the previous server is superseded
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		resp, err = t.next.RoundTrip(r)
+		if err != nil {
+			resp = nil
+			counterEndpointRequests.WithLabelValues(endpoint.String(), "error").Inc()
+			log.Printf("warning: unable to reach the telemeter server %s: %v", endpoint, err)
+			continue
+		}
+		counterEndpointRequests.WithLabelValues(endpoint.String(), strconv.Itoa(resp.StatusCode)).Inc()
+		if resp.StatusCode < 500 {
+			t.setActive(index)
+			return resp, nil
+		}
+		log.Printf("warning: the telemeter server %s is unavailable: %s", endpoint, resp.Status)
+	}
+	return resp, err
+}
@@ -0,0 +1,157 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func TestForwardFailover(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		fmt.Fprint(w, "# TYPE up gauge\nup{job=\"a\"} 1 1000\n")
+	}))
+	defer source.Close()
+
+	// server is a telemeter server mock counting the requests to its paths
+	type server struct {
+		*httptest.Server
+		mu       sync.Mutex
+		state    string
+		requests map[string]int
+	}
+	newServer := func() *server {
+		s := &server{state: "up", requests: make(map[string]int)}
+		s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			s.mu.Lock()
+			state := s.state
+			s.mu.Unlock()
+			switch state {
+			case "down":
+				// the connection is closed without a response
+				panic(http.ErrAbortHandler)
+			case "unavailable":
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			s.mu.Lock()
+			s.requests[req.URL.Path]++
+			s.mu.Unlock()
+			if req.URL.Path == "/authorize" {
+				json.NewEncoder(w).Encode(authorize.TokenResponse{Token: "upload-token", ExpiresInSeconds: 3600})
+			}
+		}))
+		return s
+	}
+	set := func(s *server, state string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.state = state
+	}
+	// received returns the requests the servers received since the last call
+	received := func(servers ...*server) []map[string]int {
+		var requests []map[string]int
+		for _, s := range servers {
+			s.mu.Lock()
+			requests = append(requests, s.requests)
+			s.requests = make(map[string]int)
+			s.mu.Unlock()
+		}
+		return requests
+	}
+	primary, secondary := newServer(), newServer()
+	defer primary.Close()
+	defer secondary.Close()
+
+	from, _ := url.Parse(source.URL)
+	toUpload, _ := url.Parse(primary.URL + "/upload")
+	toAuthorize, _ := url.Parse(primary.URL + "/authorize")
+	failover, _ := url.Parse(secondary.URL)
+	w, err := New(Config{
+		From:               from,
+		ToUpload:           toUpload,
+		ToAuthorize:        toAuthorize,
+		ToToken:            "to-token",
+		ToFailover:         []*url.URL{failover},
+		ToFailbackInterval: 200 * time.Millisecond,
+		Interval:           time.Minute,
+		LimitBytes:         200 * 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// forward uploads, and checks the requests received by the primary and secondary servers
+	forward := func(step string, wantPrimary, wantSecondary map[string]int) {
+		if err := w.forward(context.Background(), time.Time{}); err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		got := received(primary, secondary)
+		if fmt.Sprint(got[0]) != fmt.Sprint(wantPrimary) || fmt.Sprint(got[1]) != fmt.Sprint(wantSecondary) {
+			t.Errorf("%s: want requests %v and %v, got %v and %v", step, wantPrimary, wantSecondary, got[0], got[1])
+		}
+	}
+	active := func(s *server) float64 {
+		m := &clientmodel.Metric{}
+		if err := gaugeActiveEndpoint.WithLabelValues(s.URL).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetGauge().GetValue()
+	}
+	requests := func(s *server, code string) float64 {
+		m := &clientmodel.Metric{}
+		if err := counterEndpointRequests.WithLabelValues(s.URL, code).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	none := map[string]int{}
+
+	// the token is exchanged with the server failed over to
+	set(primary, "down")
+	forward("primary down", none, map[string]int{"/authorize": 1, "/upload": 1})
+	if active(primary) != 0 || active(secondary) != 1 {
+		t.Errorf("want the secondary server active")
+	}
+	// the upload is sent to the server failed over to for the token exchange right away
+	if requests(primary, "error") != 1 {
+		t.Errorf("want 1 connection error with the primary server, got %v", requests(primary, "error"))
+	}
+
+	// the server failed over to is kept until the failback interval
+	set(primary, "up")
+	forward("primary revived", none, map[string]int{"/upload": 1})
+
+	time.Sleep(200 * time.Millisecond)
+	forward("failback", map[string]int{"/upload": 1}, none)
+	if active(primary) != 1 || active(secondary) != 0 {
+		t.Errorf("want the primary server active")
+	}
+	if requests(secondary, "200") != 3 {
+		t.Errorf("want 3 requests to the secondary server, got %v", requests(secondary, "200"))
+	}
+
+	// requests fail over on 5xx responses too
+	set(primary, "unavailable")
+	forward("primary unavailable", none, map[string]int{"/upload": 1})
+	if requests(primary, "503") != 1 {
+		t.Errorf("want a 503 response of the primary server, got %v", requests(primary, "503"))
+	}
+
+	// the preferred server failing again when tried keeps the server failed over to
+	time.Sleep(200 * time.Millisecond)
+	forward("failback failed", none, map[string]int{"/upload": 1})
+	if active(secondary) != 1 {
+		t.Errorf("want the secondary server active")
+	}
+}
@@ -0,0 +1,83 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+// Flush sends the metrics held in memory, that is those of an upload interrupted by the
+// shutdown and of the intervals skipped while uploads were paused, together with as many spooled
+// payloads as fit in a single upload, without federating the source again. It is meant to be
+// called once Run returned, before the client exits, and logs how much was flushed and how much
+// is abandoned. Spooled payloads that are not sent stay in the spool for the next start.
+func (w *Worker) Flush(ctx context.Context) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var families []*clientmodel.MetricFamily
+	for _, skipped := range w.skipped {
+		families = mergeFamilies(families, skipped)
+	}
+	families = mergeFamilies(w.pending, families)
+	w.skipped, w.pending = nil, nil
+	series := metricfamily.MetricsCount(families)
+
+	spooled := 0
+	if w.spool != nil {
+		spooled = w.spool.Len()
+	}
+	if w.to == nil || series+spooled == 0 {
+		return nil
+	}
+
+	// Nothing is sent while the server has paused uploads.
+	var err error
+	if time.Now().Before(w.pausedUntil) {
+		err = fmt.Errorf("uploads are paused by the server until %s", w.pausedUntil.Format(time.RFC3339))
+	}
+
+	// The spooled payloads are sent oldest first with the metrics held in memory, as the server
+	// takes a single upload per interval.
+	upload, sent := families, 0
+	if w.spool != nil && err == nil {
+		backlog, done := w.spool.Take(w.spoolDrainBytes)
+		for i := len(backlog) - 1; i >= 0; i-- {
+			upload = mergeFamilies(backlog[i], upload)
+		}
+		err = w.sendParts(ctx, upload)
+		switch err.(type) {
+		case nil:
+			done("")
+			sent = len(backlog)
+		case *metricsclient.ErrRejected:
+			done(spoolDropRejected)
+		}
+	} else if err == nil {
+		err = w.sendParts(ctx, upload)
+	}
+	if err == nil {
+		w.uploaded(upload)
+		log.Printf("flushed %d series and %d spooled payloads", series, sent)
+		return nil
+	}
+
+	// The metrics that could not be sent are kept in the spool for the next start if there is one,
+	// unless the server rejected them.
+	if w.spool != nil {
+		if _, rejected := err.(*metricsclient.ErrRejected); series > 0 && !rejected {
+			w.spool.Enqueue(families)
+		}
+		log.Printf("warning: unable to flush all metrics, leaving %d payloads and %d series spooled: %v", w.spool.Len(), series, err)
+		return err
+	}
+	counterDroppedSamples.WithLabelValues("shutdown").Add(float64(series))
+	log.Printf("warning: unable to flush metrics, abandoning %d series: %v", series, err)
+	return err
+}
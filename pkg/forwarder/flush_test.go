@@ -0,0 +1,156 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+func TestFlushOnShutdown(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		spool bool
+		want  []string
+	}{
+		{
+			name: "pending",
+			want: []string{"up"},
+		},
+		{
+			name:  "spool",
+			spool: true,
+			// the spooled payload is sent with the interrupted upload
+			want: []string{"spooled,up"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{})
+			uploads := make(chan string, 10)
+			mux := http.NewServeMux()
+			mux.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", string(expfmt.FmtText))
+				fmt.Fprint(w, "# TYPE up gauge\nup{job=\"a\"} 1 1000\n")
+			})
+			first := true
+			mux.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+				if first {
+					// the first upload is still in flight when the client is terminated
+					first = false
+					close(started)
+					// the request is only cancelled once its body was read
+					ioutil.ReadAll(req.Body)
+					<-req.Context().Done()
+					return
+				}
+				families, err := metricsclient.Read(req.Body)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var names []string
+				for _, family := range families {
+					names = append(names, family.GetName())
+				}
+				sort.Strings(names)
+				uploads <- strings.Join(names, ",")
+			})
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+
+			from, _ := url.Parse(ts.URL + "/federate")
+			to, _ := url.Parse(ts.URL + "/upload")
+			cfg := Config{From: from, ToUpload: to, Interval: time.Minute, LimitBytes: 200 * 1024}
+			if tt.spool {
+				dir, err := ioutil.TempDir("", "spool")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+				cfg.SpoolDir = dir
+			}
+			w, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.spool {
+				name, typ, value := "spooled", clientmodel.MetricType_GAUGE, 1.0
+				w.spool.Enqueue([]*clientmodel.MetricFamily{{
+					Name:   &name,
+					Type:   &typ,
+					Metric: []*clientmodel.Metric{{Gauge: &clientmodel.Gauge{Value: &value}}},
+				}})
+			}
+
+			term := make(chan os.Signal, 1)
+			signal.Notify(term, syscall.SIGTERM)
+			defer signal.Stop(term)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				w.Run(ctx)
+				close(done)
+			}()
+
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				t.Fatal("want an upload started")
+			}
+			if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+				t.Fatal(err)
+			}
+			<-term
+			cancel()
+			<-done
+
+			const drainTimeout = 2 * time.Second
+			flushCtx, flushCancel := context.WithTimeout(context.Background(), drainTimeout)
+			defer flushCancel()
+			start := time.Now()
+			if err := w.Flush(flushCtx); err != nil {
+				t.Fatalf("unable to flush: %v", err)
+			}
+			if d := time.Since(start); d > drainTimeout {
+				t.Errorf("want the flush done within %s, took %s", drainTimeout, d)
+			}
+			for _, want := range tt.want {
+				select {
+				case got := <-uploads:
+					if got != want {
+						t.Errorf("want an upload of %s, got %s", want, got)
+					}
+				default:
+					t.Errorf("want an upload of %s flushed", want)
+				}
+			}
+			if tt.spool && w.spool.Len() != 0 {
+				t.Errorf("want the spool drained, got %d payloads", w.spool.Len())
+			}
+
+			// nothing is left to flush
+			if err := w.Flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if len(uploads) != 0 {
+				t.Errorf("want nothing flushed again, got %d uploads", len(uploads))
+			}
+		})
+	}
+}
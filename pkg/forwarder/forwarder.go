@@ -4,12 +4,14 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -40,14 +42,31 @@ var (
 		Name: "federate_errors",
 		Help: "The number of times forwarding federated metrics has failed",
 	})
+	counterFederateUnmatchedSamples = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "federate_unmatched_samples_total",
+		Help: "Tracks the number of federated samples dropped because they match none of the match rules.",
+	})
 )
 
+var tokenMetrics = authorize.NewTokenMetrics(prometheus.DefaultRegisterer)
+
 func init() {
 	prometheus.MustRegister(
 		gaugeFederateErrors, gaugeFederateSamples, gaugeFederateFilteredSamples,
+		counterFederateUnmatchedSamples,
 	)
 }
 
+// Formats metrics are uploaded in.
+const (
+	// FormatExpfmt uploads the metric families in the protobuf delimited format to the upload
+	// endpoint.
+	FormatExpfmt = "expfmt"
+	// FormatRemoteWrite uploads Prometheus remote-write requests to the receive endpoint, and falls
+	// back to FormatExpfmt if the server does not have one.
+	FormatRemoteWrite = "remote-write"
+)
+
 // Config defines the parameters that can be used to configure a worker.
 // The only required field is `From`.
 type Config struct {
@@ -60,6 +79,38 @@ type Config struct {
 	ToTokenFile   string
 	FromCAFile    string
 
+	// ToProxy is the HTTP(S) proxy the server is reached through, with its credentials, if any,
+	// as user info. The proxy of the environment is used if it is nil.
+	ToProxy *url.URL
+	// ToFailover are the URLs of further servers, in order of preference, which the requests to
+	// the server of ToUpload fail over to on connection errors and 5xx responses, including the
+	// token exchanges of ToAuthorize on the same server. Only the scheme and host of requests are
+	// replaced. The preferred server is tried again every ToFailbackInterval, 5m if 0.
+	ToFailover         []*url.URL
+	ToFailbackInterval time.Duration
+	// ToCAFile is a bundle of CA certificates verifying the server in addition to the system
+	// roots. ToCertFile and ToKeyFile are the certificate and key the client authenticates to the
+	// server with, if set. The files are reloaded when they change.
+	ToCAFile   string
+	ToCertFile string
+	ToKeyFile  string
+	// ToTLSMinVersion is the minimum version of TLS to the server, from 1.0 to 1.3, 1.2 if empty.
+	ToTLSMinVersion string
+	// ToInsecureSkipVerify does not verify the certificate of the server.
+	ToInsecureSkipVerify bool
+	// ToReceive is the remote-write endpoint of the server, to which uploads are sent if ToFormat
+	// is FormatRemoteWrite.
+	ToReceive *url.URL
+	// ToFormat is the format of uploads, FormatExpfmt if empty.
+	ToFormat string
+	// ToEncoding compresses uploads with one of the metricsclient encodings, snappy if empty.
+	ToEncoding string
+	// ToMaxPayloadBytes splits uploads larger than it once encoded, before compression, into
+	// several requests sent in turn. Uploads are not split if it is 0.
+	ToMaxPayloadBytes int64
+	// ToTokenCacheFile keeps the access token exchanged for ToToken across restarts, if set.
+	ToTokenCacheFile string
+
 	AnonymizeLabels   []string
 	AnonymizeSalt     string
 	AnonymizeSaltFile string
@@ -69,6 +120,58 @@ type Config struct {
 	Rules             []string
 	RulesFile         string
 	Transformer       metricfamily.Transformer
+
+	// LabelActions hash, redact or drop the values of labels by name before they are sent, like
+	// the server does. Values are hashed with the anonymize salt, so that they stay stable across
+	// restarts while the salt is unchanged.
+	LabelActions map[string]string
+
+	// Renames renames the families named as the keys to the values once they are transformed,
+	// merging them into the families already of that name.
+	Renames map[string]string
+
+	// AggregationRules aggregate the federated series before they are sent, in addition to the
+	// rules of AggregationRulesFile, a JSON file of the form {"rules": [...]}.
+	AggregationRules     []metricfamily.AggregationRule
+	AggregationRulesFile string
+
+	// ConfigFile is a JSON file of a FileConfig, whose settings replace those above. It is read
+	// again by WatchConfigFile when it changes.
+	ConfigFile string
+
+	// Jitter is the fraction of the interval uploads are spread over, at a phase derived from ID
+	// that is stable for the instance. Uploads are an interval apart if it is 0.
+	Jitter float64
+	ID     string
+
+	// UploadRetries is how many times an upload failing with a transient error is retried, after
+	// UploadRetryBackoff, doubled for every retry. Retries never start after the next scheduled
+	// upload, and UploadOverlap is the policy applied to their metrics if they are interrupted,
+	// OverlapSupersede if empty.
+	UploadRetries      int
+	UploadRetryBackoff time.Duration
+	UploadOverlap      string
+
+	// MergeSkippedIntervals federates at every interval while the server has paused uploads by
+	// rate limiting them, and sends the metrics of up to maxSkippedIntervals of them with the
+	// next upload. The intervals are skipped altogether otherwise. The server keeps the samples of
+	// the skipped intervals only if it keeps the timestamps of uploaded samples.
+	MergeSkippedIntervals bool
+
+	// SpoolDir is the directory keeping the payloads that failed to upload until the server can be
+	// reached again, bounded by SpoolMaxBytes and SpoolMaxAge. No payloads are kept if it is empty.
+	SpoolDir      string
+	SpoolMaxBytes int64
+	SpoolMaxAge   time.Duration
+	// SpoolDrainBytes bounds the size of the spooled payloads sent with each upload once the
+	// server can be reached again, so that the upload stays within the limits of the server.
+	// The oldest payload is sent in any case, and all of them if it is 0.
+	SpoolDrainBytes int64
+
+	// StateDir is the directory keeping the time and a hash of the last successful upload across
+	// restarts. The first upload after a restart is sent with the time, or skipped if its metrics
+	// were uploaded already. Nothing is kept if it is empty.
+	StateDir string
 }
 
 // Worker represents a metrics forwarding agent. It collects metrics from a source URL and forwards them to a sink.
@@ -79,10 +182,39 @@ type Worker struct {
 	toClient   *metricsclient.Client
 	from       *url.URL
 	to         *url.URL
+	// receive is the remote-write endpoint uploads are sent to until the server turns out not to
+	// have one, if remoteWrite is set.
+	receive     *url.URL
+	remoteWrite bool
 
 	interval    time.Duration
+	schedule    schedule
 	transformer metricfamily.Transformer
+	renamer     *metricfamily.Renamer
 	rules       []string
+	matcher     metricfamily.Transformer
+	aggregator  *metricfamily.Aggregator
+	spool       *Spool
+	// spoolDrainBytes bounds the spooled payloads sent with an upload, if positive.
+	spoolDrainBytes int64
+	retrier         retrier
+	overlap         string
+	// pending are the metrics of the last upload whose retries were interrupted, merged into the
+	// next upload.
+	pending []*clientmodel.MetricFamily
+	// maxPayloadBytes is the size uploads are split at, if positive.
+	maxPayloadBytes int64
+
+	// pausedUntil is when uploads may resume after the server rate limited them, and skipped
+	// the metrics of the intervals since, if they are merged.
+	pausedUntil  time.Time
+	mergeSkipped bool
+	skipped      [][]*clientmodel.MetricFamily
+
+	// stateDir keeps the last successful upload, and restored is the one before the client
+	// started, until the first upload since succeeded.
+	stateDir string
+	restored *uploadState
 
 	lastMetrics []*clientmodel.MetricFamily
 	lock        sync.Mutex
@@ -95,6 +227,13 @@ func New(cfg Config) (*Worker, error) {
 	if cfg.From == nil {
 		return nil, errors.New("a URL from which to scrape is required")
 	}
+	if len(cfg.ConfigFile) > 0 {
+		file, err := loadConfigFile(cfg.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg = file.apply(cfg)
+	}
 	w := Worker{
 		from:        cfg.From,
 		interval:    cfg.Interval,
@@ -105,6 +244,40 @@ func New(cfg Config) (*Worker, error) {
 	if w.interval == 0 {
 		w.interval = 4*time.Minute + 30*time.Second
 	}
+	if cfg.Jitter < 0 || cfg.Jitter > 1 {
+		return nil, fmt.Errorf("the interval jitter must be a fraction between 0 and 1: %v", cfg.Jitter)
+	}
+	w.schedule = newSchedule(w.interval, cfg.Jitter, cfg.ID)
+
+	if cfg.ToMaxPayloadBytes < 0 {
+		return nil, fmt.Errorf("the maximum size of uploads must not be negative: %d", cfg.ToMaxPayloadBytes)
+	}
+	w.maxPayloadBytes = cfg.ToMaxPayloadBytes
+	w.mergeSkipped = cfg.MergeSkippedIntervals
+
+	switch cfg.ToFormat {
+	case "", FormatExpfmt:
+	case FormatRemoteWrite:
+		if cfg.ToReceive == nil {
+			return nil, errors.New("a receive URL is required to upload in the remote-write format")
+		}
+		w.receive, w.remoteWrite = cfg.ToReceive, true
+	default:
+		return nil, fmt.Errorf("the upload format must be %s or %s: %s", FormatExpfmt, FormatRemoteWrite, cfg.ToFormat)
+	}
+
+	if cfg.UploadRetries < 0 {
+		return nil, fmt.Errorf("the number of upload retries must not be negative: %d", cfg.UploadRetries)
+	}
+	w.retrier = newRetrier(cfg.UploadRetries, cfg.UploadRetryBackoff)
+	switch cfg.UploadOverlap {
+	case "":
+		w.overlap = OverlapSupersede
+	case OverlapSupersede, OverlapMerge:
+		w.overlap = cfg.UploadOverlap
+	default:
+		return nil, fmt.Errorf("the upload overlap policy must be %s or %s: %s", OverlapSupersede, OverlapMerge, cfg.UploadOverlap)
+	}
 
 	// Configure the anonymization.
 	anonymizeSalt := cfg.AnonymizeSalt
@@ -118,7 +291,7 @@ func New(cfg Config) (*Worker, error) {
 	if len(cfg.AnonymizeLabels) != 0 && len(anonymizeSalt) == 0 {
 		return nil, fmt.Errorf("anonymize-salt must be specified if anonymize-labels is set")
 	}
-	if len(cfg.AnonymizeLabels) == 0 {
+	if len(cfg.AnonymizeLabels) == 0 && len(cfg.LabelActions) == 0 {
 		log.Printf("warning: not anonymizing any labels")
 	}
 
@@ -127,9 +300,20 @@ func New(cfg Config) (*Worker, error) {
 	if cfg.Transformer != nil {
 		transformer.With(cfg.Transformer)
 	}
+	// Series that disappeared from the source are not sent.
+	transformer.With(metricfamily.TransformerFunc(metricfamily.DropStaleSamples))
 	if len(cfg.AnonymizeLabels) > 0 {
 		transformer.With(metricfamily.NewMetricsAnonymizer(anonymizeSalt, cfg.AnonymizeLabels, nil))
 	}
+	labelActions, err := metricfamily.NewLabelActions(cfg.LabelActions, []byte(anonymizeSalt))
+	if err != nil {
+		return nil, fmt.Errorf("invalid label actions: %v", err)
+	}
+	transformer.With(labelActions)
+	w.renamer, err = metricfamily.NewRenamer(cfg.Renames)
+	if err != nil {
+		return nil, fmt.Errorf("invalid renames: %v", err)
+	}
 
 	// Create the `fromClient`.
 	fromTransport := metricsclient.DefaultTransport()
@@ -167,8 +351,16 @@ func New(cfg Config) (*Worker, error) {
 	w.fromClient = metricsclient.New(fromClient, cfg.LimitBytes, w.interval, "federate_from")
 
 	// Create the `toClient`.
-	toTransport := metricsclient.DefaultTransport()
-	toTransport.Proxy = http.ProxyFromEnvironment
+	toTransport, err := newToRoundTripper(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.ToFailover) > 0 {
+		if cfg.ToUpload == nil {
+			return nil, errors.New("an upload URL is required to fail over to other servers")
+		}
+		toTransport = newFailoverTransport(cfg.ToUpload, cfg.ToFailover, cfg.ToFailbackInterval, toTransport)
+	}
 	toClient := &http.Client{Transport: toTransport}
 	if cfg.Debug {
 		toClient.Transport = telemeterhttp.NewDebugRoundTripper(toClient.Transport)
@@ -187,14 +379,20 @@ func New(cfg Config) (*Worker, error) {
 		// Exchange our token for a token from the authorize endpoint, which also gives us a
 		// set of expected labels we must include.
 		rt := authorize.NewServerRotatingRoundTripper(cfg.ToToken, cfg.ToAuthorize, toClient.Transport)
+		rt.CacheFile = cfg.ToTokenCacheFile
+		rt.Metrics = tokenMetrics
 		toClient.Transport = rt
 		transformer.With(metricfamily.NewLabel(nil, rt))
 	}
+	if len(cfg.ToEncoding) > 0 && !metricsclient.IsEncoding(cfg.ToEncoding) {
+		return nil, fmt.Errorf("the upload encoding must be %s, %s or %s: %s", metricsclient.EncodingSnappy, metricsclient.EncodingGzip, metricsclient.EncodingIdentity, cfg.ToEncoding)
+	}
 	w.toClient = metricsclient.New(toClient, cfg.LimitBytes, w.interval, "federate_to")
+	w.toClient.Encoding = cfg.ToEncoding
 	w.transformer = transformer
 
 	// Configure the matching rules.
-	rules := cfg.Rules
+	rules := append([]string(nil), cfg.Rules...)
 	if len(cfg.RulesFile) > 0 {
 		data, err := ioutil.ReadFile(cfg.RulesFile)
 		if err != nil {
@@ -204,7 +402,7 @@ func New(cfg Config) (*Worker, error) {
 	}
 	for i := 0; i < len(rules); {
 		s := strings.TrimSpace(rules[i])
-		if len(s) == 0 {
+		if len(s) == 0 || strings.HasPrefix(s, "#") {
 			rules = append(rules[:i], rules[i+1:]...)
 			continue
 		}
@@ -213,9 +411,118 @@ func New(cfg Config) (*Worker, error) {
 	}
 	w.rules = rules
 
+	// Drop the federated series matching none of the rules, in case the source ignores them.
+	if len(rules) > 0 {
+		whitelist, err := metricfamily.NewWhitelist(rules)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match rule: %v", err)
+		}
+		var matcher metricfamily.MultiTransformer
+		matcher.With(whitelist)
+		matcher.With(metricfamily.TransformerFunc(metricfamily.PackMetrics))
+		w.matcher = matcher
+	}
+
+	// Configure the aggregation rules.
+	aggregationRules := cfg.AggregationRules
+	if len(cfg.AggregationRulesFile) > 0 {
+		data, err := ioutil.ReadFile(cfg.AggregationRulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read aggregation-rules-file: %v", err)
+		}
+		var file struct {
+			Rules []metricfamily.AggregationRule `json:"rules"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("unable to parse aggregation-rules-file: %v", err)
+		}
+		aggregationRules = append(aggregationRules, file.Rules...)
+	}
+	if len(aggregationRules) > 0 {
+		aggregator, err := metricfamily.NewAggregator(aggregationRules)
+		if err != nil {
+			return nil, err
+		}
+		w.aggregator = aggregator
+	}
+
+	if len(cfg.SpoolDir) > 0 {
+		spool, err := NewSpool(cfg.SpoolDir, cfg.SpoolMaxBytes, cfg.SpoolMaxAge, nil)
+		if err != nil {
+			return nil, err
+		}
+		w.spool = spool
+		w.spoolDrainBytes = cfg.SpoolDrainBytes
+	}
+
+	if len(cfg.StateDir) > 0 {
+		if err := os.MkdirAll(cfg.StateDir, 0700); err != nil {
+			return nil, fmt.Errorf("unable to create state-dir: %v", err)
+		}
+		w.stateDir = cfg.StateDir
+		w.restored = loadState(cfg.StateDir)
+		if w.restored != nil {
+			gaugeLastSuccessfulUpload.Set(float64(w.restored.Time.UnixNano()) / 1e9)
+		}
+	}
+
 	return &w, nil
 }
 
+// newToTransport returns the transport to the server, through proxy if set and otherwise
+// through the proxy of the environment. The credentials of the proxy are sent by the transport
+// in the Proxy-Authorization header, including when tunneling TLS with CONNECT.
+func newToTransport(proxy *url.URL) *http.Transport {
+	transport := metricsclient.DefaultTransport()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+		log.Printf("sending metrics through proxy %s", redactedURL(proxy))
+	}
+	return transport
+}
+
+// newToRoundTripper returns the round tripper to the server with the TLS options of cfg, which
+// apply to both the authorize and upload endpoints.
+func newToRoundTripper(cfg Config) (http.RoundTripper, error) {
+	opts, err := newTLSOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if opts.insecureSkipVerify {
+		log.Printf("WARNING: the certificate of the telemeter server is not verified, anyone on the network path can intercept the uploaded metrics and the authorization token. Do not skip verification outside of testing.")
+	}
+	load := func() (*http.Transport, error) {
+		tlsConfig, err := opts.config()
+		if err != nil {
+			return nil, err
+		}
+		transport := newToTransport(cfg.ToProxy)
+		transport.TLSClientConfig = tlsConfig
+		return transport, nil
+	}
+	if len(opts.files()) == 0 {
+		transport, err := load()
+		if err != nil {
+			return nil, err
+		}
+		return transport, nil
+	}
+	return newReloadingTransport(opts.files(), load)
+}
+
+// redactedURL returns the URL with its password, if any, replaced.
+func redactedURL(u *url.URL) string {
+	if u.User == nil {
+		return u.String()
+	}
+	redacted := *u
+	if _, ok := u.User.Password(); ok {
+		redacted.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return redacted.String()
+}
+
 // Reconfigure temporarily stops a worker and reconfigures is with the provided Config.
 // Is thread safe and can run concurrently with `LastMetrics` and `Run`.
 func (w *Worker) Reconfigure(cfg Config) error {
@@ -223,22 +530,46 @@ func (w *Worker) Reconfigure(cfg Config) error {
 	if err != nil {
 		return fmt.Errorf("failed to reconfigure: %v", err)
 	}
+	w.apply(worker)
 
+	// Signal a restart to Run func.
+	// Do this in a goroutine since we do not care if restarting the Run loop is asynchronous.
+	go func() { w.reconfigure <- struct{}{} }()
+	return nil
+}
+
+// apply swaps the configuration of the worker for that of worker. As uploads hold the lock, the
+// configuration is swapped between them.
+func (w *Worker) apply(worker *Worker) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
 	w.fromClient = worker.fromClient
 	w.toClient = worker.toClient
 	w.interval = worker.interval
+	w.schedule = worker.schedule
 	w.from = worker.from
 	w.to = worker.to
+	w.receive = worker.receive
+	w.remoteWrite = worker.remoteWrite
 	w.transformer = worker.transformer
+	w.renamer = worker.renamer
 	w.rules = worker.rules
-
-	// Signal a restart to Run func.
-	// Do this in a goroutine since we do not care if restarting the Run loop is asynchronous.
-	go func() { w.reconfigure <- struct{}{} }()
-	return nil
+	w.matcher = worker.matcher
+	w.aggregator = worker.aggregator
+	w.spool = worker.spool
+	w.spoolDrainBytes = worker.spoolDrainBytes
+	w.retrier = worker.retrier
+	w.maxPayloadBytes = worker.maxPayloadBytes
+	w.stateDir = worker.stateDir
+	w.mergeSkipped = worker.mergeSkipped
+	if !w.mergeSkipped {
+		w.skipped = nil
+	}
+	w.overlap = worker.overlap
+	if w.overlap != OverlapMerge {
+		w.pending = nil
+	}
 }
 
 func (w *Worker) LastMetrics() []*clientmodel.MetricFamily {
@@ -251,15 +582,40 @@ func (w *Worker) Run(ctx context.Context) {
 	for {
 		// Ensure that the Worker does not access critical configuration during a reconfiguration.
 		w.lock.Lock()
-		wait := w.interval
+		schedule := w.schedule
+		pausedUntil := w.pausedUntil
+		mergeSkipped := w.mergeSkipped
 		// The critical section ends here.
 		w.lock.Unlock()
 
-		if err := w.forward(ctx); err != nil {
-			gaugeFederateErrors.Inc()
-			log.Printf("error: unable to forward results: %v", err)
-			wait = time.Minute
+		var next time.Time
+		if now := time.Now(); now.Before(pausedUntil) {
+			// Nothing is sent while the server has paused uploads, not even after a reconfiguration.
+			if mergeSkipped {
+				if err := w.collect(ctx); err != nil {
+					log.Printf("error: unable to collect metrics while uploads are paused: %v", err)
+				}
+			}
+			next = pausedUntil
+		} else {
+			// Retries of the upload do not start after the next one is due.
+			err := w.forward(ctx, schedule.next(now, nil, 0))
+			if err != nil {
+				gaugeFederateErrors.Inc()
+				log.Printf("error: unable to forward results: %v", err)
+			}
+			now = time.Now()
+			next = schedule.next(now, err, time.Minute)
+			pausedUntil = w.pause(now, next, err)
+		}
+		// The intervals skipped while uploads are paused are still federated if they are merged.
+		if mergeSkipped && next.Equal(pausedUntil) {
+			if tick := schedule.next(time.Now(), nil, 0); tick.Before(next) {
+				next = tick
+			}
 		}
+		gaugeNextUpload.Set(float64(next.Unix()))
+		wait := next.Sub(time.Now())
 
 		select {
 		// If the context is cancelled, then we're done.
@@ -272,49 +628,293 @@ func (w *Worker) Run(ctx context.Context) {
 	}
 }
 
-func (w *Worker) forward(ctx context.Context) error {
+// pause pauses uploads until the next one if the server rate limited the upload that failed
+// with err, and resumes them otherwise. It returns when uploads resume, or zero if they are not
+// paused.
+func (w *Worker) pause(now, next time.Time, err error) time.Time {
 	w.lock.Lock()
 	defer w.lock.Unlock()
+	rerr, ok := err.(*metricsclient.ErrRateLimited)
+	if !ok {
+		w.pausedUntil = time.Time{}
+		gaugeUploadBackoff.Set(0)
+		return w.pausedUntil
+	}
+	w.pausedUntil = next
+	backoff := next.Sub(now)
+	gaugeUploadBackoff.Set(backoff.Seconds())
+	reason := rerr.Reason
+	if len(reason) == 0 {
+		reason = "rate_limited"
+	}
+	log.Printf("warning: the server paused uploads (%s), resuming in %s at %s: %v", reason, backoff.Round(time.Second), next.Format(time.RFC3339), err)
+	return w.pausedUntil
+}
 
-	// Load the match rules each time.
-	from := w.from
-
-	// reset query from last invocation, otherwise match rules will be appended
-	w.from.RawQuery = ""
-	v := from.Query()
-	for _, rule := range w.rules {
-		v.Add("match[]", rule)
+// collect federates the metrics of an interval uploads are paused for, to send them with the
+// next upload.
+func (w *Worker) collect(ctx context.Context) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	families, err := w.federate(ctx)
+	if err != nil || len(families) == 0 {
+		return err
 	}
-	from.RawQuery = v.Encode()
+	w.skipped = append(w.skipped, families)
+	if len(w.skipped) > maxSkippedIntervals {
+		counterDroppedSamples.WithLabelValues("skipped").Add(float64(metricfamily.MetricsCount(w.skipped[0])))
+		w.skipped = w.skipped[1:]
+	}
+	return nil
+}
 
-	req := &http.Request{Method: "GET", URL: from}
-	families, err := w.fromClient.Retrieve(ctx, req)
+// forward federates the metrics and uploads them, retrying transient failures until next, or
+// without limit in time if next is zero.
+func (w *Worker) forward(ctx context.Context, next time.Time) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	families, err := w.federate(ctx)
 	if err != nil {
 		return err
 	}
+	if len(families) == 0 {
+		log.Printf("warning: no metrics to send, doing nothing")
+		return nil
+	}
 
-	before := metricfamily.MetricsCount(families)
-	if err := metricfamily.Filter(families, w.transformer); err != nil {
+	if w.to == nil {
+		return nil
+	}
+
+	// sentBytes is the size of the last request sent.
+	var sentBytes int64
+	send := func(ctx context.Context, families []*clientmodel.MetricFamily, header http.Header) error {
+		n, err := w.send(ctx, families, header)
+		sentBytes = n
 		return err
 	}
+	// The metrics of the intervals skipped while uploads were paused are sent as the current ones.
+	for i := len(w.skipped) - 1; i >= 0; i-- {
+		families = mergeFamilies(w.skipped[i], families)
+	}
+	w.skipped = nil
+	current := families
+	if len(w.pending) > 0 {
+		families = mergeFamilies(w.pending, families)
+		w.pending = nil
+	}
+	// The first upload after a restart is skipped if its metrics were uploaded before it.
+	if w.restored != nil && len(w.restored.Hash) > 0 && w.restored.Hash == payloadHash(families) {
+		log.Printf("the metrics were uploaded before the restart already, skipping them")
+		w.restored = nil
+		return nil
+	}
+	// upload sends the parts of the families with retries, and returns the parts that could not
+	// be sent, unless they are kept to be merged into the next upload. Parts sent successfully
+	// are not sent again.
+	upload := func() ([][]*clientmodel.MetricFamily, bool, error) {
+		start := time.Now()
+		parts := splitFamilies(families, w.maxPayloadBytes)
+		id := newUploadID()
+		var payloadBytes int64
+		var rejected error
+		for i, part := range parts {
+			header := partHeader(i, len(parts), id)
+			if w.restored != nil {
+				if header == nil {
+					header = make(http.Header)
+				}
+				header.Set(metricsclient.LastUploadHeader, w.restored.Time.UTC().Format(time.RFC3339))
+			}
+			// the worker is unlocked between retries, so that its last metrics can be read and
+			// it can be reconfigured meanwhile
+			interrupted, err := w.retrier.send(ctx, next, &w.lock, part, func(ctx context.Context, families []*clientmodel.MetricFamily) error {
+				return send(ctx, families, header)
+			})
+			if err == nil {
+				payloadBytes += sentBytes
+				continue
+			}
+			if _, ok := err.(*metricsclient.ErrRejected); ok {
+				// the part fails the same way if it is sent again, unlike the next ones
+				log.Printf("error: the server rejected part %d of %d of the metrics: %v", i+1, len(parts), err)
+				rejected = err
+				continue
+			}
+			histogramUploadDuration.WithLabelValues("failure").Observe(time.Since(start).Seconds())
+			unsent := parts[i:]
+			if ctx.Err() != nil && w.spool == nil {
+				// the client is shutting down, and flushes the metrics before it exits
+				for _, part := range unsent {
+					w.pending = mergeFamilies(w.pending, part)
+				}
+				return nil, false, err
+			}
+			if !interrupted {
+				return unsent, false, err
+			}
+			counterUploadRetriesInterrupted.WithLabelValues(w.overlap).Inc()
+			if w.overlap == OverlapMerge {
+				// the server stores the parts of an upload only once all of them arrived
+				log.Printf("warning: unable to upload metrics before the next upload, sending them with it: %v", err)
+				w.pending = current
+				return nil, true, err
+			}
+			log.Printf("warning: unable to upload metrics before the next upload, which supersedes them: %v", err)
+			return unsent, false, err
+		}
+		if rejected != nil {
+			histogramUploadDuration.WithLabelValues("failure").Observe(time.Since(start).Seconds())
+			return nil, false, rejected
+		}
+		histogramUploadDuration.WithLabelValues("success").Observe(time.Since(start).Seconds())
+		w.uploaded(families)
+		gaugePayloadSeries.Set(float64(metricfamily.MetricsCount(families)))
+		gaugePayloadBytes.Set(float64(payloadBytes))
+		return nil, false, nil
+	}
+	if w.spool == nil {
+		_, _, err := upload()
+		return err
+	}
+
+	// The payloads spooled during an outage are sent with the metrics of the interval, oldest
+	// first, as the server takes a single upload per interval.
+	spooled := families
+	backlog, done := w.spool.Take(w.spoolDrainBytes)
+	for i := len(backlog) - 1; i >= 0; i-- {
+		families = mergeFamilies(backlog[i], families)
+	}
+	_, merged, err := upload()
+	switch err.(type) {
+	case nil:
+		done("")
+	case *metricsclient.ErrRejected:
+		done(spoolDropRejected)
+	default:
+		// the server stores the parts of an upload only once all of them arrived, so that the
+		// metrics of the interval are spooled whole
+		if !merged {
+			w.spool.Enqueue(spooled)
+		}
+	}
+	return err
+}
+
+// send sends the families in one request with the header, in the remote-write format if it is
+// configured and the server accepts it. It returns the size of the request sent. The caller must
+// hold the lock.
+func (w *Worker) send(ctx context.Context, families []*clientmodel.MetricFamily, header http.Header) (int64, error) {
+	if w.remoteWrite {
+		// copy the headers, so that a fallback to the upload endpoint sends none of remote-write
+		rwHeader := make(http.Header, len(header))
+		for k, v := range header {
+			rwHeader[k] = v
+		}
+		req := &http.Request{Method: "POST", URL: w.receive, Header: rwHeader}
+		err := w.toClient.SendRemoteWrite(ctx, req, families)
+		if err != metricsclient.ErrRemoteWriteUnsupported {
+			return req.ContentLength, err
+		}
+		log.Printf("warning: the server does not accept remote-write requests at %s, uploading to %s instead", w.receive, w.to)
+		w.remoteWrite = false
+	}
+	req := &http.Request{Method: "POST", URL: w.to, Header: header}
+	err := w.toClient.Send(ctx, req, families)
+	return req.ContentLength, err
+}
 
-	families = metricfamily.Pack(families)
-	after := metricfamily.MetricsCount(families)
+// sendParts sends the families in as many requests as the payload limit requires, without
+// retries. The caller must hold the lock.
+func (w *Worker) sendParts(ctx context.Context, families []*clientmodel.MetricFamily) error {
+	parts := splitFamilies(families, w.maxPayloadBytes)
+	id := newUploadID()
+	for i, part := range parts {
+		if _, err := w.send(ctx, part, partHeader(i, len(parts), id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// federate retrieves the metrics of the source, and matches, aggregates and transforms them. The
+// caller must hold the lock.
+func (w *Worker) federate(ctx context.Context) ([]*clientmodel.MetricFamily, error) {
+	families, err := w.retrieve(ctx)
+	if err != nil {
+		counterFederateScrapeErrors.Inc()
+		return nil, err
+	}
+
+	before := metricfamily.MetricsCount(families)
+	counts := make(map[string]int)
+	families, err = w.process(families, func(stage string, families []*clientmodel.MetricFamily) {
+		counts[stage] = metricfamily.MetricsCount(families)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unmatched := before - counts[stageMatch]; unmatched > 0 {
+		counterFederateUnmatchedSamples.Add(float64(unmatched))
+		counterDroppedSamples.WithLabelValues("unmatched").Add(float64(unmatched))
+		log.Printf("warning: dropped %d federated samples matching none of the match rules", unmatched)
+	}
+	after := counts[stageTransform]
+	if dropped := counts[stageAggregate] - after; dropped > 0 {
+		counterDroppedSamples.WithLabelValues("transform").Add(float64(dropped))
+	}
 
 	gaugeFederateSamples.Set(float64(before))
 	gaugeFederateFilteredSamples.Set(float64(before - after))
 
 	w.lastMetrics = families
+	return families, nil
+}
 
-	if len(families) == 0 {
-		log.Printf("warning: no metrics to send, doing nothing")
-		return nil
+// Stages of the processing of federated metrics.
+const (
+	stageMatch     = "match"
+	stageAggregate = "aggregate"
+	stageTransform = "transform"
+)
+
+// retrieve federates the metrics of the source matching the match rules. The caller must hold
+// the lock.
+func (w *Worker) retrieve(ctx context.Context) ([]*clientmodel.MetricFamily, error) {
+	// Load the match rules each time.
+	from := w.from
+
+	// reset query from last invocation, otherwise match rules will be appended
+	w.from.RawQuery = ""
+	v := from.Query()
+	for _, rule := range w.rules {
+		v.Add("match[]", rule)
 	}
+	from.RawQuery = v.Encode()
 
-	if w.to == nil {
-		return nil
+	req := &http.Request{Method: "GET", URL: from}
+	return w.fromClient.Retrieve(ctx, req)
+}
+
+// process matches, aggregates and transforms the families, calling observe with the families
+// after each stage. The caller must hold the lock.
+func (w *Worker) process(families []*clientmodel.MetricFamily, observe func(stage string, families []*clientmodel.MetricFamily)) ([]*clientmodel.MetricFamily, error) {
+	if w.matcher != nil {
+		if err := metricfamily.Filter(families, w.matcher); err != nil {
+			return nil, err
+		}
+		families = metricfamily.Pack(families)
 	}
+	observe(stageMatch, families)
+
+	families = w.aggregator.Aggregate(families)
+	observe(stageAggregate, families)
 
-	req = &http.Request{Method: "POST", URL: w.to}
-	return w.toClient.Send(ctx, req, families)
+	if err := metricfamily.Filter(families, w.transformer); err != nil {
+		return nil, err
+	}
+	families = w.renamer.Rename(metricfamily.Pack(families))
+	observe(stageTransform, families)
+	return families, nil
 }
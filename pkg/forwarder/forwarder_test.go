@@ -2,13 +2,42 @@ package forwarder
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/http/server"
+	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/metricsclient"
+	"github.com/openshift/telemeter/pkg/store/memstore"
+	"github.com/openshift/telemeter/pkg/store/ratelimited"
+	"github.com/openshift/telemeter/pkg/validate"
 )
 
 func TestNew(t *testing.T) {
@@ -288,3 +317,1325 @@ func (frt *fakeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error
 		StatusCode: http.StatusOK,
 	}, nil
 }
+
+func TestForward(t *testing.T) {
+	const federated = `# TYPE up gauge
+up{job="a"} 1 1000
+up{job="b"} 0 1000
+# TYPE scrape_duration_seconds gauge
+scrape_duration_seconds{job="a"} 0.5 1000
+`
+	uploaded := make(chan []*clientmodel.MetricFamily, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+		if got := req.Header.Get("Authorization"); got != "Bearer from-token" {
+			t.Errorf("want the federation token, got %q", got)
+		}
+		if got := req.URL.Query()["match[]"]; !reflect.DeepEqual(got, []string{`{__name__="up"}`, `{__name__="scrape_duration_seconds"}`}) {
+			t.Errorf("want the match rules, got %v", got)
+		}
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		w.Write([]byte(federated))
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, req *http.Request) {
+		if got := req.Header.Get("Authorization"); got != "Bearer to-token" {
+			t.Errorf("want the initial token, got %q", got)
+		}
+		json.NewEncoder(w).Encode(authorize.TokenResponse{Token: "upload-token", Labels: map[string]string{"cluster": "cluster-1"}})
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+		if got := req.Header.Get("Authorization"); got != "Bearer upload-token" {
+			t.Errorf("want the exchanged token, got %q", got)
+		}
+		families, err := metricsclient.Read(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		uploaded <- families
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	parse := func(path string) *url.URL {
+		u, err := url.Parse(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	w, err := New(Config{
+		From:        parse("/federate"),
+		FromToken:   "from-token",
+		ToAuthorize: parse("/authorize"),
+		ToUpload:    parse("/upload"),
+		ToToken:     "to-token",
+		Rules:       []string{`{__name__="up"}`, `{__name__="scrape_duration_seconds"}`},
+		Interval:    time.Minute,
+		LimitBytes:  200 * 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.forward(context.Background(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, f := range <-uploaded {
+		for _, m := range f.Metric {
+			var labels []string
+			for _, l := range m.Label {
+				labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+			}
+			got = append(got, fmt.Sprintf("%s{%s} %v %d", f.GetName(), strings.Join(labels, ","), m.GetGauge().GetValue(), m.GetTimestampMs()))
+		}
+	}
+	// packing the families does not keep their order
+	sort.Strings(got)
+	want := []string{
+		`scrape_duration_seconds{cluster="cluster-1",job="a"} 0.5 1000`,
+		`up{cluster="cluster-1",job="a"} 1 1000`,
+		`up{cluster="cluster-1",job="b"} 0 1000`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want uploaded series\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestForwardClientMetrics(t *testing.T) {
+	const federated = `# TYPE up gauge
+up{job="a"} 1 1000
+up{job="b"} 0 1000
+up{job="internal"} 1 1000
+# TYPE other gauge
+other 1 1000
+`
+	var (
+		mu            sync.Mutex
+		federateDown  bool
+		uploadedBytes int64
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if federateDown {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		w.Write([]byte(federated))
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(authorize.TokenResponse{Token: "upload-token", ExpiresInSeconds: 3600})
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, req.Body)
+		mu.Lock()
+		uploadedBytes = n
+		mu.Unlock()
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// value returns the value of the series of the client metric with the labels, of the
+	// count of observations for histograms, or -1 if there is no such series.
+	value := func(name string, labels ...string) float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range families {
+			if f.GetName() != name {
+				continue
+			}
+		Metric:
+			for _, m := range f.Metric {
+				for i := 0; i < len(labels); i += 2 {
+					found := false
+					for _, l := range m.Label {
+						found = found || l.GetName() == labels[i] && l.GetValue() == labels[i+1]
+					}
+					if !found {
+						continue Metric
+					}
+				}
+				switch {
+				case m.Gauge != nil:
+					return m.Gauge.GetValue()
+				case m.Counter != nil:
+					return m.Counter.GetValue()
+				case m.Histogram != nil:
+					return float64(m.Histogram.GetSampleCount())
+				}
+			}
+		}
+		return -1
+	}
+
+	from, _ := url.Parse(ts.URL + "/federate")
+	toAuthorize, _ := url.Parse(ts.URL + "/authorize")
+	to, _ := url.Parse(ts.URL + "/upload")
+	w, err := New(Config{
+		From:        from,
+		ToAuthorize: toAuthorize,
+		ToUpload:    to,
+		ToToken:     "to-token",
+		Interval:    time.Minute,
+		LimitBytes:  200 * 1024,
+		Rules:       []string{`{__name__="up"}`},
+		// drop the series of internal jobs
+		Transformer: metricfamily.TransformerFunc(func(family *clientmodel.MetricFamily) (bool, error) {
+			for i, m := range family.Metric {
+				for _, l := range m.Label {
+					if l.GetName() == "job" && l.GetValue() == "internal" {
+						family.Metric[i] = nil
+					}
+				}
+			}
+			return metricfamily.PackMetrics(family)
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scrapeErrors := value("telemeter_client_federate_scrape_errors_total")
+	unmatched := value("telemeter_client_dropped_samples_total", "reason", "unmatched")
+	transformed := value("telemeter_client_dropped_samples_total", "reason", "transform")
+	uploads := value("telemeter_client_upload_duration_seconds", "result", "success")
+
+	mu.Lock()
+	federateDown = true
+	mu.Unlock()
+	if err := w.forward(context.Background(), time.Time{}); err == nil {
+		t.Fatal("want the federation to fail")
+	}
+	mu.Lock()
+	federateDown = false
+	mu.Unlock()
+	start := time.Now()
+	if err := w.forward(context.Background(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := value("telemeter_client_federate_scrape_errors_total") - scrapeErrors; got != 1 {
+		t.Errorf("want 1 federation error counted, got %v", got)
+	}
+	if got := value("telemeter_client_dropped_samples_total", "reason", "unmatched") - math.Max(unmatched, 0); got != 1 {
+		t.Errorf("want 1 unmatched sample counted, got %v", got)
+	}
+	if got := value("telemeter_client_dropped_samples_total", "reason", "transform") - math.Max(transformed, 0); got != 1 {
+		t.Errorf("want 1 sample dropped by the transforms counted, got %v", got)
+	}
+	if got := value("telemeter_client_upload_duration_seconds", "result", "success") - math.Max(uploads, 0); got != 1 {
+		t.Errorf("want the duration of 1 upload observed, got %v", got)
+	}
+	seconds := func(t time.Time) float64 { return float64(t.UnixNano()) / 1e9 }
+	if got := value("telemeter_client_last_successful_upload_timestamp_seconds"); got < seconds(start) || got > seconds(time.Now()) {
+		t.Errorf("want the time of the last upload between %v and now, got %v", seconds(start), got)
+	}
+	if got := value("telemeter_client_payload_series"); got != 2 {
+		t.Errorf("want 2 series in the payload, got %v", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := value("telemeter_client_payload_bytes"); got <= 0 || got != float64(uploadedBytes) {
+		t.Errorf("want the size of the payload received, %d bytes, got %v", uploadedBytes, got)
+	}
+	if got := value("telemeter_client_token_refreshes_total", "result", "success"); got < 1 {
+		t.Errorf("want a successful token refresh counted, got %v", got)
+	}
+	if got := value("telemeter_client_token_refresh_consecutive_failures"); got != 0 {
+		t.Errorf("want no token refresh failing, got %v", got)
+	}
+	if got := value("telemeter_client_token_expiry_timestamp_seconds"); got < seconds(start) {
+		t.Errorf("want the token to expire in the future, got %v", got)
+	}
+}
+
+func TestForwardSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the uploads go through the handler and the store chain of the server, which takes one
+	// upload per interval and keeps the timestamps of the samples
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	ms := memstore.New(time.Hour)
+	s := server.New(
+		ratelimited.New(time.Minute, ms),
+		validate.NewWithOptions("cluster", 0, time.Hour, time.Now, validate.Options{KeepTimestamps: true}),
+		nil,
+		time.Hour,
+	)
+	client := &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}}
+	var (
+		mu      sync.Mutex
+		scrapes int64
+		down    bool
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		scrapes++
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		fmt.Fprintf(w, "# TYPE up gauge\nup{cluster=\"test\",job=\"a\"} 1 %d\n", start.Add(time.Duration(scrapes)*time.Second).UnixNano()/int64(time.Millisecond))
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		unavailable := down
+		mu.Unlock()
+		if unavailable {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		s.Post(w, req.WithContext(authorize.WithClient(req.Context(), client)))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	from, _ := url.Parse(ts.URL + "/federate")
+	to, _ := url.Parse(ts.URL + "/upload")
+	w, err := New(Config{
+		From:       from,
+		ToUpload:   to,
+		Interval:   time.Minute,
+		LimitBytes: 200 * 1024,
+		SpoolDir:   dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server is unreachable for three scrapes
+	mu.Lock()
+	down = true
+	mu.Unlock()
+	for i := 1; i <= 3; i++ {
+		if err := w.forward(context.Background(), time.Time{}); err == nil {
+			t.Fatal("want the upload to fail during the outage")
+		}
+		if got := w.spool.Len(); got != i {
+			t.Fatalf("want %d payloads spooled, got %d", i, got)
+		}
+	}
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	if err := w.forward(context.Background(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.spool.Len(); got != 0 {
+		t.Errorf("want the spool drained, got %d payloads", got)
+	}
+
+	// the delayed samples are stored with the timestamps of their scrapes
+	ps, err := ms.ReadMetrics(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got, want []int64
+	for _, p := range ps {
+		for _, f := range p.Families {
+			for _, m := range f.Metric {
+				got = append(got, m.GetTimestampMs())
+			}
+		}
+	}
+	for i := 1; i <= 4; i++ {
+		want = append(want, start.Add(time.Duration(i)*time.Second).UnixNano()/int64(time.Millisecond))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want samples at %v, got %v", want, got)
+	}
+}
+
+func TestForwardRetry(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		scrapes  int64
+		failures int
+		received [][]int64
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		scrapes++
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		fmt.Fprintf(w, "# TYPE up gauge\nup{job=\"a\"} 1 %d\n", scrapes*1000)
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		families, err := metricsclient.Read(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		var timestamps []int64
+		for _, f := range families {
+			for _, m := range f.Metric {
+				timestamps = append(timestamps, m.GetTimestampMs())
+			}
+		}
+		received = append(received, timestamps)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	from, _ := url.Parse(ts.URL + "/federate")
+	to, _ := url.Parse(ts.URL + "/upload")
+	// reset starts a new worker with the upload failing the number of times given
+	reset := func(t *testing.T, fail int, cfg Config) *Worker {
+		mu.Lock()
+		scrapes, failures, received = 0, fail, nil
+		mu.Unlock()
+		cfg.From, cfg.ToUpload = from, to
+		cfg.Interval, cfg.LimitBytes = time.Minute, 200*1024
+		w, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	counter := func(c prometheus.Counter) float64 {
+		m := &clientmodel.Metric{}
+		if err := c.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+
+	t.Run("succeeds after retries", func(t *testing.T) {
+		w := reset(t, 2, Config{UploadRetries: 3, UploadRetryBackoff: time.Millisecond})
+		attempts := counter(counterUploadAttempts)
+		if err := w.forward(context.Background(), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		if got := counter(counterUploadAttempts) - attempts; got != 3 {
+			t.Errorf("want 3 attempts, got %v", got)
+		}
+		if want := [][]int64{{1000}}; !reflect.DeepEqual(received, want) {
+			t.Errorf("want uploads %v, got %v", want, received)
+		}
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		w := reset(t, 10, Config{UploadRetries: 2, UploadRetryBackoff: time.Millisecond})
+		attempts, exhausted := counter(counterUploadAttempts), counter(counterUploadRetriesExhausted)
+		err := w.forward(context.Background(), time.Time{})
+		if _, ok := err.(*metricsclient.ErrUnavailable); !ok {
+			t.Fatalf("want the upload to fail as unavailable, got %v", err)
+		}
+		if got := counter(counterUploadAttempts) - attempts; got != 3 {
+			t.Errorf("want 3 attempts, got %v", got)
+		}
+		if got := counter(counterUploadRetriesExhausted) - exhausted; got != 1 {
+			t.Errorf("want the retries exhausted once, got %v", got)
+		}
+		if len(received) != 0 {
+			t.Errorf("want nothing uploaded, got %v", received)
+		}
+	})
+
+	t.Run("unlocked between retries", func(t *testing.T) {
+		w := reset(t, 1, Config{UploadRetries: 1, UploadRetryBackoff: 2 * time.Second})
+		attempts := counter(counterUploadAttempts)
+		errCh := make(chan error, 1)
+		go func() { errCh <- w.forward(context.Background(), time.Time{}) }()
+		for counter(counterUploadAttempts)-attempts < 1 {
+			time.Sleep(time.Millisecond)
+		}
+		// the retry waits for at least a second
+		done := make(chan struct{})
+		go func() {
+			w.LastMetrics()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(500 * time.Millisecond):
+			t.Error("want the last metrics read while the upload waits to be retried")
+		}
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	for _, tt := range []struct {
+		policy string
+		want   [][]int64
+	}{
+		{policy: OverlapMerge, want: [][]int64{{1000, 2000}}},
+		{policy: OverlapSupersede, want: [][]int64{{2000}}},
+	} {
+		t.Run("interrupted by the next upload with "+tt.policy, func(t *testing.T) {
+			// the retry would start after the next upload is due
+			w := reset(t, 1, Config{UploadRetries: 3, UploadRetryBackoff: time.Hour, UploadOverlap: tt.policy})
+			interrupted := counter(counterUploadRetriesInterrupted.WithLabelValues(tt.policy))
+			if err := w.forward(context.Background(), time.Now().Add(time.Minute)); err == nil {
+				t.Fatal("want the upload to fail")
+			}
+			if got := counter(counterUploadRetriesInterrupted.WithLabelValues(tt.policy)) - interrupted; got != 1 {
+				t.Errorf("want the retries interrupted once, got %v", got)
+			}
+			if err := w.forward(context.Background(), time.Now().Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(received, tt.want) {
+				t.Errorf("want uploads %v, got %v", tt.want, received)
+			}
+		})
+	}
+}
+
+func TestRunRateLimited(t *testing.T) {
+	type upload struct {
+		at      time.Time
+		samples int
+		backoff float64
+	}
+	var (
+		mu      sync.Mutex
+		scrapes int64
+		limited bool
+		uploads []upload
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		scrapes++
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		fmt.Fprintf(w, "# TYPE up gauge\nup{job=\"a\"} 1 %d\n", scrapes*1000)
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		families, err := metricsclient.Read(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		// the backoff is still exposed while the upload resuming after it is in flight
+		backoff := &clientmodel.Metric{}
+		if err := gaugeUploadBackoff.Write(backoff); err != nil {
+			t.Error(err)
+		}
+		uploads = append(uploads, upload{at: time.Now(), samples: metricfamily.MetricsCount(families), backoff: backoff.GetGauge().GetValue()})
+		if !limited {
+			limited = true
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	from, _ := url.Parse(ts.URL + "/federate")
+	to, _ := url.Parse(ts.URL + "/upload")
+
+	for _, merge := range []bool{false, true} {
+		t.Run(fmt.Sprintf("merge skipped intervals %t", merge), func(t *testing.T) {
+			mu.Lock()
+			scrapes, limited, uploads = 0, false, nil
+			mu.Unlock()
+			w, err := New(Config{From: from, ToUpload: to, Interval: 100 * time.Millisecond, LimitBytes: 200 * 1024, MergeSkippedIntervals: merge})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				w.Run(ctx)
+				close(done)
+			}()
+			// wait for the upload after the backoff, and stop before the next one
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				mu.Lock()
+				n := len(uploads)
+				mu.Unlock()
+				if n >= 2 || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			cancel()
+			<-done
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(uploads) != 2 {
+				t.Fatalf("want 2 uploads, got %d", len(uploads))
+			}
+			if d := uploads[1].at.Sub(uploads[0].at); d < time.Second {
+				t.Errorf("want no upload during the backoff of 1s, got one after %s", d)
+			}
+			if uploads[1].backoff < 0.9 || uploads[1].backoff > 1 {
+				t.Errorf("want a backoff of 1s exposed, got %v", uploads[1].backoff)
+			}
+			if merge {
+				// the source is federated at every interval of the backoff
+				if uploads[1].samples < 5 || int64(uploads[1].samples) != scrapes-1 {
+					t.Errorf("want the samples of the %d skipped intervals uploaded, got %d", scrapes-1, uploads[1].samples)
+				}
+			} else if uploads[1].samples != 1 || scrapes != 2 {
+				t.Errorf("want the intervals skipped, got %d samples uploaded after %d scrapes", uploads[1].samples, scrapes)
+			}
+		})
+	}
+
+	t.Run("quota exceeded", func(t *testing.T) {
+		reset := time.Now().Add(time.Hour).UTC()
+		quota := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprintf(w, `{"code":"quota_exceeded","message":"sample quota reached","details":{"quota":10,"reset":%q}}`, reset.Format(time.RFC3339))
+		}))
+		defer quota.Close()
+		to, _ := url.Parse(quota.URL)
+		w, err := New(Config{From: from, ToUpload: to, Interval: time.Minute, LimitBytes: 200 * 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.forward(context.Background(), time.Now().Add(time.Minute))
+		rerr, ok := err.(*metricsclient.ErrRateLimited)
+		if !ok {
+			t.Fatalf("want the upload rate limited, got %v", err)
+		}
+		if rerr.Reason != "quota_exceeded" || !strings.Contains(rerr.Message, "sample quota reached") {
+			t.Errorf("want the reason and message of the server, got %q: %s", rerr.Reason, rerr.Message)
+		}
+		if rerr.RetryAfter <= 59*time.Minute || rerr.RetryAfter > time.Hour {
+			t.Errorf("want a delay until the quota resets, got %s", rerr.RetryAfter)
+		}
+	})
+}
+
+func TestForwardSplit(t *testing.T) {
+	var federated bytes.Buffer
+	federated.WriteString("# TYPE up gauge\n")
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&federated, "up{instance=\"instance-%d\"} 1 1000\n", i)
+	}
+	federated.WriteString("# TYPE scrape_duration_seconds gauge\nscrape_duration_seconds 0.5 1000\n")
+
+	var (
+		mu       sync.Mutex
+		failPart string
+		parts    []string
+		received []string
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		w.Write(federated.Bytes())
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		part := req.Header.Get(metricsclient.PartHeader)
+		parts = append(parts, part)
+		if len(failPart) > 0 && strings.HasPrefix(part, failPart) {
+			failPart = ""
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		families, err := metricsclient.Read(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		for _, f := range families {
+			for _, m := range f.Metric {
+				received = append(received, f.GetName()+m.String())
+			}
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	from, _ := url.Parse(ts.URL + "/federate")
+	to, _ := url.Parse(ts.URL + "/upload")
+	w, err := New(Config{
+		From:               from,
+		ToUpload:           to,
+		Interval:           time.Minute,
+		LimitBytes:         200 * 1024,
+		ToMaxPayloadBytes:  512,
+		UploadRetries:      1,
+		UploadRetryBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second part fails once
+	failPart = "2/"
+	if err := w.forward(context.Background(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for _, f := range w.LastMetrics() {
+		for _, m := range f.Metric {
+			want = append(want, f.GetName()+m.String())
+		}
+	}
+	sort.Strings(want)
+	sort.Strings(received)
+	if len(want) != 51 || !reflect.DeepEqual(received, want) {
+		t.Errorf("want the parts to hold the %d series federated once, got %d series", len(want), len(received))
+	}
+
+	// every part is sent once, except the second one, which is retried
+	if len(parts) < 4 {
+		t.Fatalf("want the upload split in several parts, got %v", parts)
+	}
+	count := len(parts) - 1
+	wantIndexes := []int{1, 2, 2}
+	for i := 3; i <= count; i++ {
+		wantIndexes = append(wantIndexes, i)
+	}
+	var id string
+	for i, part := range parts {
+		var index, n int
+		var upload string
+		if _, err := fmt.Sscanf(part, "%d/%d; upload=%s", &index, &n, &upload); err != nil {
+			t.Fatalf("want a part header, got %q: %v", part, err)
+		}
+		if i == 0 {
+			id = upload
+		}
+		if index != wantIndexes[i] || n != count || upload != id {
+			t.Errorf("want part %d/%d of upload %s, got %q", wantIndexes[i], count, id, part)
+		}
+	}
+}
+
+func TestForwardRemoteWrite(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		status   int
+		received []string
+		receives int
+		uploads  int
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		fmt.Fprint(w, `# TYPE up gauge
+up{job="a"} 1 1000
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.5"} 2 1000
+request_duration_seconds_bucket{le="+Inf"} 3 1000
+request_duration_seconds_sum 1.5 1000
+request_duration_seconds_count 3 1000
+`)
+	})
+	mux.HandleFunc("/metrics/v1/receive", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		receives++
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		if got := req.Header.Get("Content-Type"); got != "application/x-protobuf" {
+			t.Errorf("want a protobuf request, got %s", got)
+		}
+		if got := req.Header.Get("Content-Encoding"); got != "snappy" {
+			t.Errorf("want a snappy compressed request, got %s", got)
+		}
+		if got := req.Header.Get("X-Prometheus-Remote-Write-Version"); got != "0.1.0" {
+			t.Errorf("want remote-write version 0.1.0, got %s", got)
+		}
+		compressed, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var wreq prompb.WriteRequest
+		if err := gogoproto.Unmarshal(data, &wreq); err != nil {
+			t.Error(err)
+			return
+		}
+		for _, ts := range wreq.Timeseries {
+			var name string
+			var labels []string
+			for _, l := range ts.Labels {
+				if l.Name == "__name__" {
+					name = l.Value
+					continue
+				}
+				labels = append(labels, l.Name+"="+l.Value)
+			}
+			for _, sample := range ts.Samples {
+				received = append(received, fmt.Sprintf("%s{%s} %v @%d", name, strings.Join(labels, ","), sample.Value, sample.Timestamp))
+			}
+		}
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		uploads++
+		if got := req.Header.Get("X-Prometheus-Remote-Write-Version"); len(got) > 0 {
+			t.Errorf("want no remote-write header in uploads, got %s", got)
+		}
+		if _, err := metricsclient.Read(req.Body); err != nil {
+			t.Error(err)
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	from, _ := url.Parse(ts.URL + "/federate")
+	to, _ := url.Parse(ts.URL + "/upload")
+	receive, _ := url.Parse(ts.URL + "/metrics/v1/receive")
+	newWorker := func(t *testing.T) *Worker {
+		w, err := New(Config{From: from, ToUpload: to, ToReceive: receive, ToFormat: FormatRemoteWrite, Interval: time.Minute, LimitBytes: 200 * 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	t.Run("remote-write", func(t *testing.T) {
+		mu.Lock()
+		status, received, receives, uploads = 0, nil, 0, 0
+		mu.Unlock()
+		w := newWorker(t)
+		if err := w.forward(context.Background(), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{
+			"request_duration_seconds_bucket{le=+Inf} 3 @1000",
+			"request_duration_seconds_bucket{le=0.5} 2 @1000",
+			"request_duration_seconds_count{} 3 @1000",
+			"request_duration_seconds_sum{} 1.5 @1000",
+			"up{job=a} 1 @1000",
+		}
+		sort.Strings(received)
+		if !reflect.DeepEqual(received, want) {
+			t.Errorf("want series\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(received, "\n"))
+		}
+		if uploads != 0 {
+			t.Errorf("want nothing sent to the upload endpoint, got %d uploads", uploads)
+		}
+	})
+
+	for _, code := range []int{http.StatusNotFound, http.StatusUnsupportedMediaType} {
+		t.Run(fmt.Sprintf("fallback on %d", code), func(t *testing.T) {
+			mu.Lock()
+			status, received, receives, uploads = code, nil, 0, 0
+			mu.Unlock()
+			w := newWorker(t)
+			for i := 0; i < 2; i++ {
+				if err := w.forward(context.Background(), time.Time{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// the receive endpoint is not tried again once the server turned out not to have one
+			if receives != 1 || uploads != 2 {
+				t.Errorf("want 1 remote-write request and 2 uploads, got %d and %d", receives, uploads)
+			}
+		})
+	}
+
+	if _, err := New(Config{From: from, ToUpload: to, ToFormat: FormatRemoteWrite}); err == nil {
+		t.Error("want the remote-write format rejected without a receive URL")
+	}
+	if _, err := New(Config{From: from, ToUpload: to, ToFormat: "json"}); err == nil {
+		t.Error("want an unknown format rejected")
+	}
+}
+
+func TestForwardMatchRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rulesFile := filepath.Join(dir, "rules")
+	if err := ioutil.WriteFile(rulesFile, []byte("# cluster recording rules\n{__name__=~\"cluster:.*\"}\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the source ignores the match rules, returning series that must not leak
+	const federated = `# TYPE up gauge
+up{job="apiserver"} 1 1000
+up{job="node"} 1 1000
+# TYPE cluster:capacity_cpu_cores:sum gauge
+cluster:capacity_cpu_cores:sum 8 1000
+# TYPE secret_metric gauge
+secret_metric{token="x"} 1 1000
+`
+	var (
+		mu       sync.Mutex
+		matches  []string
+		uploaded []string
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		matches = req.URL.Query()["match[]"]
+		mu.Unlock()
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		w.Write([]byte(federated))
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+		families, err := metricsclient.Read(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		uploaded = nil
+		for _, f := range families {
+			for _, m := range f.Metric {
+				var labels []string
+				for _, l := range m.Label {
+					labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+				}
+				uploaded = append(uploaded, fmt.Sprintf("%s{%s}", f.GetName(), strings.Join(labels, ",")))
+			}
+		}
+		sort.Strings(uploaded)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	from, _ := url.Parse(ts.URL + "/federate")
+	to, _ := url.Parse(ts.URL + "/upload")
+	cfg := Config{
+		From:       from,
+		ToUpload:   to,
+		Interval:   time.Minute,
+		LimitBytes: 200 * 1024,
+		Rules:      []string{`up{job="apiserver"}`},
+		RulesFile:  rulesFile,
+	}
+	w, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.forward(context.Background(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if want := []string{`up{job="apiserver"}`, `{__name__=~"cluster:.*"}`}; !reflect.DeepEqual(matches, want) {
+		t.Errorf("want match[] %v, got %v", want, matches)
+	}
+	if want := []string{`cluster:capacity_cpu_cores:sum{}`, `up{job="apiserver"}`}; !reflect.DeepEqual(uploaded, want) {
+		t.Errorf("want uploaded %v, got %v", want, uploaded)
+	}
+	mu.Unlock()
+
+	// the rules file is read again when reconfigured
+	if err := ioutil.WriteFile(rulesFile, []byte("up{job=\"node\"}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Reconfigure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	<-w.reconfigure
+	if err := w.forward(context.Background(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if want := []string{`up{job="apiserver"}`, `up{job="node"}`}; !reflect.DeepEqual(matches, want) {
+		t.Errorf("want match[] %v after the reload, got %v", want, matches)
+	}
+	if want := []string{`up{job="apiserver"}`, `up{job="node"}`}; !reflect.DeepEqual(uploaded, want) {
+		t.Errorf("want uploaded %v after the reload, got %v", want, uploaded)
+	}
+	mu.Unlock()
+
+	if _, err := New(Config{From: from, Rules: []string{`up{`}}); err == nil {
+		t.Error("want an invalid match rule rejected")
+	}
+}
+
+func TestForwardLabelActions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saltFile := filepath.Join(dir, "salt")
+	if err := ioutil.WriteFile(saltFile, []byte("a-secret-salt\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	const federated = `# TYPE up gauge
+up{instance="10.0.0.1:9100",namespace="customer-secrets",pod="billing-7f9c"} 1 1000
+`
+	uploaded := make(chan []*clientmodel.MetricFamily, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		w.Write([]byte(federated))
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+		families, err := metricsclient.Read(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		uploaded <- families
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	from, _ := url.Parse(ts.URL + "/federate")
+	to, _ := url.Parse(ts.URL + "/upload")
+	// upload returns the labels of the series uploaded by a new worker, as a client restarted
+	upload := func() map[string]string {
+		w, err := New(Config{
+			From:              from,
+			ToUpload:          to,
+			Interval:          time.Minute,
+			LimitBytes:        200 * 1024,
+			AnonymizeSaltFile: saltFile,
+			LabelActions:      map[string]string{"instance": "hash", "namespace": "redact", "pod": "drop"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.forward(context.Background(), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		families := <-uploaded
+		if len(families) != 1 || len(families[0].Metric) != 1 {
+			t.Fatalf("want a single series uploaded, got %v", families)
+		}
+		for _, raw := range []string{"10.0.0.1", "customer-secrets", "billing-7f9c"} {
+			if strings.Contains(families[0].String(), raw) {
+				t.Errorf("want no raw value %q uploaded, got %s", raw, families[0])
+			}
+		}
+		labels := make(map[string]string)
+		for _, l := range families[0].Metric[0].Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+		return labels
+	}
+
+	labels := upload()
+	if _, ok := labels["pod"]; ok {
+		t.Errorf("want label pod dropped, got %v", labels)
+	}
+	if labels["namespace"] != metricfamily.RedactedValue {
+		t.Errorf("want label namespace redacted, got %v", labels)
+	}
+	if len(labels["instance"]) == 0 {
+		t.Errorf("want label instance hashed, got %v", labels)
+	}
+	if again := upload(); again["instance"] != labels["instance"] {
+		t.Errorf("want hashes stable across restarts with the same salt, got %q and %q", labels["instance"], again["instance"])
+	}
+
+	if _, err := New(Config{From: from, LabelActions: map[string]string{"instance": "hash"}}); err == nil {
+		t.Error("want hashing without a salt rejected")
+	}
+}
+
+func TestForwardAggregationRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aggregation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rulesFile := filepath.Join(dir, "rules.json")
+	rules := `{"rules": [
+  {"record": "namespace:container_memory_usage_bytes:sum", "expr": "sum by (namespace) (container_memory_usage_bytes)"},
+  {"record": "up:count", "expr": "count(up)", "keep_inputs": true}
+]}`
+	if err := ioutil.WriteFile(rulesFile, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	const federated = `# TYPE container_memory_usage_bytes gauge
+container_memory_usage_bytes{namespace="a",pod="a-1"} 100 1000
+container_memory_usage_bytes{namespace="a",pod="a-2"} 200 1000
+container_memory_usage_bytes{namespace="b",pod="b-1"} 50 1000
+# TYPE up gauge
+up{job="a"} 1 1000
+up{job="b"} 0 1000
+`
+	uploaded := make(chan []*clientmodel.MetricFamily, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		w.Write([]byte(federated))
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+		families, err := metricsclient.Read(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		uploaded <- families
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	from, _ := url.Parse(ts.URL + "/federate")
+	to, _ := url.Parse(ts.URL + "/upload")
+	w, err := New(Config{
+		From:                 from,
+		ToUpload:             to,
+		Interval:             time.Minute,
+		LimitBytes:           200 * 1024,
+		AggregationRulesFile: rulesFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.forward(context.Background(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, f := range <-uploaded {
+		for _, m := range f.Metric {
+			var labels []string
+			for _, l := range m.Label {
+				labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+			}
+			got = append(got, fmt.Sprintf("%s{%s} %v %d", f.GetName(), strings.Join(labels, ","), m.GetGauge().GetValue(), m.GetTimestampMs()))
+		}
+	}
+	sort.Strings(got)
+	want := []string{
+		`namespace:container_memory_usage_bytes:sum{namespace="a"} 300 1000`,
+		`namespace:container_memory_usage_bytes:sum{namespace="b"} 50 1000`,
+		`up:count{} 2 1000`,
+		`up{job="a"} 1 1000`,
+		`up{job="b"} 0 1000`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want uploaded series\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	if err := ioutil.WriteFile(rulesFile, []byte(`{"rules": [{"record": "up:rate", "expr": "sum(rate(up[5m]))"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Reconfigure(Config{From: from, ToUpload: to, Interval: time.Minute, AggregationRulesFile: rulesFile}); err == nil {
+		t.Error("want a rule that is not an aggregation of a metric selector rejected")
+	}
+}
+
+func TestForwardProxy(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	uploaded := make(chan struct{}, 1)
+	backend := http.NewServeMux()
+	backend.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		w.Write([]byte("# TYPE up gauge\nup 1 1000\n"))
+	})
+	backend.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+		uploaded <- struct{}{}
+	})
+	ts := httptest.NewServer(backend)
+	defer ts.Close()
+	tlsServer := httptest.NewTLSServer(backend)
+	defer tlsServer.Close()
+
+	// proxy forwards requests and tunnels CONNECT requests of clients with the credentials
+	var (
+		mu       sync.Mutex
+		proxied  []string
+		wantAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte("telemeter:proxy-secret"))
+	)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Proxy-Authorization") != wantAuth {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		mu.Lock()
+		proxied = append(proxied, req.Method+" "+req.URL.Path)
+		mu.Unlock()
+		if req.Method != http.MethodConnect {
+			req.RequestURI = ""
+			req.Header.Del("Proxy-Authorization")
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+		upstream, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("telemeter", "proxy-secret")
+
+	from, _ := url.Parse(ts.URL + "/federate")
+	to, _ := url.Parse(ts.URL + "/upload")
+	w, err := New(Config{From: from, ToUpload: to, ToProxy: proxyURL, Interval: time.Minute, LimitBytes: 200 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.forward(context.Background(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	<-uploaded
+
+	// TLS is tunneled through the proxy
+	transport := newToTransport(proxyURL)
+	transport.TLSClientConfig = tlsServer.Client().Transport.(*http.Transport).TLSClientConfig
+	req, _ := http.NewRequest("POST", tlsServer.URL+"/upload", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	<-uploaded
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"POST /upload", "CONNECT "}; !reflect.DeepEqual(proxied, want) {
+		t.Errorf("want requests %v through the proxy, got %v", want, proxied)
+	}
+	if !strings.Contains(logs.String(), "through proxy") {
+		t.Errorf("want the proxy logged, got %q", logs.String())
+	}
+	if strings.Contains(logs.String(), "proxy-secret") {
+		t.Errorf("want the proxy credentials not logged, got %q", logs.String())
+	}
+}
+
+func TestForwardEncoding(t *testing.T) {
+	const federated = "# TYPE up gauge\nup{job=\"a\"} 1 1000\nup{job=\"b\"} 0 2000\n"
+	// decode returns the series of an upload body of the encoding
+	decode := func(t *testing.T, body []byte, encoding string) []string {
+		var r io.Reader = bytes.NewReader(body)
+		switch encoding {
+		case "gzip":
+			gr, err := gzip.NewReader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = gr
+		case "snappy":
+			r = snappy.NewReader(r)
+		}
+		var series []string
+		decoder := expfmt.NewDecoder(r, expfmt.FmtProtoDelim)
+		for {
+			family := &clientmodel.MetricFamily{}
+			if err := decoder.Decode(family); err != nil {
+				if err != io.EOF {
+					t.Fatal(err)
+				}
+				break
+			}
+			for _, m := range family.Metric {
+				series = append(series, fmt.Sprintf("%s{%s=%q} %v %d", family.GetName(), m.Label[0].GetName(), m.Label[0].GetValue(), m.GetGauge().GetValue(), m.GetTimestampMs()))
+			}
+		}
+		return series
+	}
+	want := []string{`up{job="a"} 1 1000`, `up{job="b"} 0 2000`}
+
+	for _, tt := range []struct {
+		name         string
+		encoding     string
+		accepted     map[string]bool
+		wantEncoding []string
+	}{
+		{name: "snappy by default", accepted: map[string]bool{"snappy": true}, wantEncoding: []string{"snappy", "snappy"}},
+		{name: "gzip", encoding: "gzip", accepted: map[string]bool{"gzip": true}, wantEncoding: []string{"gzip", "gzip"}},
+		{name: "identity", encoding: "identity", accepted: map[string]bool{"": true}, wantEncoding: []string{"", ""}},
+		{name: "uncompressed after 415", encoding: "gzip", accepted: map[string]bool{"": true}, wantEncoding: []string{"gzip", "", ""}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu        sync.Mutex
+				encodings []string
+			)
+			mux := http.NewServeMux()
+			mux.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", string(expfmt.FmtText))
+				w.Write([]byte(federated))
+			})
+			mux.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+				encoding := req.Header.Get("Content-Encoding")
+				mu.Lock()
+				encodings = append(encodings, encoding)
+				mu.Unlock()
+				if !tt.accepted[encoding] {
+					w.WriteHeader(http.StatusUnsupportedMediaType)
+					return
+				}
+				body, err := ioutil.ReadAll(req.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := decode(t, body, encoding); !reflect.DeepEqual(got, want) {
+					t.Errorf("want uploaded series %v, got %v", want, got)
+				}
+				if encoding == "gzip" && !bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+					t.Errorf("want a gzip body on the wire, got %q", body)
+				}
+			})
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+
+			from, _ := url.Parse(ts.URL + "/federate")
+			to, _ := url.Parse(ts.URL + "/upload")
+			w, err := New(Config{From: from, ToUpload: to, ToEncoding: tt.encoding, Interval: time.Minute, LimitBytes: 200 * 1024})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				if err := w.forward(context.Background(), time.Time{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(encodings, tt.wantEncoding) {
+				t.Errorf("want uploads encoded %q, got %q", tt.wantEncoding, encodings)
+			}
+		})
+	}
+
+	if _, err := New(Config{From: &url.URL{}, ToEncoding: "br"}); err == nil {
+		t.Error("want an unknown encoding rejected")
+	}
+}
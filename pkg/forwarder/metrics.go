@@ -0,0 +1,50 @@
+package forwarder
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics of the client for alerting on the delivery of telemetry, exposed with the other
+// metrics of the process.
+var (
+	gaugeLastSuccessfulUpload = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "telemeter_client_last_successful_upload_timestamp_seconds",
+		Help: "The time metrics were last uploaded successfully.",
+	})
+	histogramUploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "telemeter_client_upload_duration_seconds",
+		Help:    "Tracks the duration of uploads, including retries, by result.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"result"})
+	gaugePayloadSeries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "telemeter_client_payload_series",
+		Help: "The number of series of the last payload uploaded.",
+	})
+	gaugePayloadBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "telemeter_client_payload_bytes",
+		Help: "The size of the last payload uploaded, as sent.",
+	})
+	counterFederateScrapeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "telemeter_client_federate_scrape_errors_total",
+		Help: "Tracks the number of failed federations of the source.",
+	})
+	counterDroppedSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_client_dropped_samples_total",
+		Help: "Tracks the number of federated samples dropped before uploading, by reason: unmatched for those matching none of the match rules, transform for those dropped by the transforms, skipped for those of intervals skipped while uploads were paused beyond the number kept, and shutdown for those that could not be flushed when the client exited without a spool.",
+	}, []string{"reason"})
+	gaugeUploadBackoff = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "telemeter_client_upload_backoff_seconds",
+		Help: "The time uploads were last paused for because the server rate limited them or the quota was exceeded, or 0 if they are not paused.",
+	})
+)
+
+// maxSkippedIntervals is the number of intervals skipped while uploads are paused whose metrics
+// are kept to be sent with the next upload.
+const maxSkippedIntervals = 12
+
+func init() {
+	prometheus.MustRegister(
+		gaugeLastSuccessfulUpload, histogramUploadDuration, gaugePayloadSeries, gaugePayloadBytes,
+		counterFederateScrapeErrors, counterDroppedSamples, gaugeUploadBackoff,
+	)
+}
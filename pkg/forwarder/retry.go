@@ -0,0 +1,180 @@
+package forwarder
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+// Policies for the metrics of an upload whose retries are interrupted by the next scheduled
+// upload.
+const (
+	// OverlapSupersede gives up on the metrics, which are spooled if a spool is configured, as
+	// they are superseded by the next upload.
+	OverlapSupersede = "supersede"
+	// OverlapMerge sends the metrics with those of the next upload. If that upload fails as well,
+	// only the metrics of the newest upload are kept. The server keeps the older samples of the
+	// series only if it keeps the timestamps of uploaded samples.
+	OverlapMerge = "merge"
+)
+
+const (
+	defaultRetryBackoff = 5 * time.Second
+	maxRetryBackoff     = 2 * time.Minute
+)
+
+var (
+	counterUploadAttempts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "federate_upload_attempts_total",
+		Help: "Tracks the number of attempts to upload metrics, including retries.",
+	})
+	counterUploadRetriesExhausted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "federate_upload_retries_exhausted_total",
+		Help: "Tracks the number of uploads that failed with a transient error on every retry.",
+	})
+	counterUploadRetriesInterrupted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federate_upload_retries_interrupted_total",
+		Help: "Tracks the number of uploads whose retries were interrupted by the next scheduled upload, by the overlap policy applied to their metrics.",
+	}, []string{"policy"})
+)
+
+func init() {
+	prometheus.MustRegister(counterUploadAttempts, counterUploadRetriesExhausted, counterUploadRetriesInterrupted)
+}
+
+// retrier retries uploads failing with transient errors, that is network errors, 5xx responses
+// and rate limiting, with an exponential backoff and jitter.
+type retrier struct {
+	retries int
+	backoff time.Duration
+	rand    *rand.Rand
+}
+
+func newRetrier(retries int, backoff time.Duration) retrier {
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	return retrier{
+		retries: retries,
+		backoff: backoff,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// send sends the families, retrying transient failures as long as the retry starts before
+// next, unless next is zero. The locker held by the caller, if not nil, is released while
+// waiting between retries. It returns whether the retries were interrupted by next.
+func (r retrier) send(ctx context.Context, next time.Time, held sync.Locker, families []*clientmodel.MetricFamily, send func(context.Context, []*clientmodel.MetricFamily) error) (bool, error) {
+	for attempt := 0; ; attempt++ {
+		counterUploadAttempts.Inc()
+		err := send(ctx, families)
+		if err == nil {
+			return false, nil
+		}
+		ok, retryAfter := retryable(err)
+		if !ok || ctx.Err() != nil {
+			return false, err
+		}
+		if attempt >= r.retries {
+			counterUploadRetriesExhausted.Inc()
+			return false, err
+		}
+		delay := r.delay(attempt, retryAfter)
+		if !next.IsZero() && !time.Now().Add(delay).Before(next) {
+			return true, err
+		}
+		log.Printf("warning: unable to upload metrics, retrying in %s: %v", delay, err)
+		if !sleep(ctx, delay, held) {
+			return false, err
+		}
+	}
+}
+
+// sleep waits for d, releasing held meanwhile if it is not nil. It returns false if the context
+// is done first.
+func sleep(ctx context.Context, d time.Duration, held sync.Locker) bool {
+	if held != nil {
+		held.Unlock()
+		defer held.Lock()
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// delay returns the delay before the retry following attempt, at least retryAfter. The delay
+// doubles for every attempt, and is randomized over its second half so that clients failing
+// together do not retry in step.
+func (r retrier) delay(attempt int, retryAfter time.Duration) time.Duration {
+	d := r.backoff << uint(attempt)
+	if d > maxRetryBackoff || d <= 0 {
+		d = maxRetryBackoff
+	}
+	d = d/2 + time.Duration(r.rand.Int63n(int64(d/2)+1))
+	if retryAfter > d {
+		d = retryAfter
+	}
+	return d
+}
+
+// retryable returns whether an upload failing with err may succeed if it is sent again, and
+// how long the server asked to wait before that, if it did.
+func retryable(err error) (bool, time.Duration) {
+	switch e := err.(type) {
+	case *metricsclient.ErrRateLimited:
+		return true, e.RetryAfter
+	case *metricsclient.ErrUnavailable:
+		return true, 0
+	case *url.Error:
+		return true, 0
+	}
+	return false, 0
+}
+
+// mergeFamilies returns the families of both uploads, with the series of families of the same
+// name kept in increasing timestamp order, as the server requires. Families of older whose type
+// changed in newer are dropped.
+func mergeFamilies(older, newer []*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	index := make(map[string]int, len(newer))
+	merged := make([]*clientmodel.MetricFamily, 0, len(older)+len(newer))
+	for _, family := range newer {
+		if family == nil {
+			continue
+		}
+		index[family.GetName()] = len(merged)
+		merged = append(merged, family)
+	}
+	for _, family := range older {
+		if family == nil {
+			continue
+		}
+		i, ok := index[family.GetName()]
+		if !ok {
+			merged = append(merged, family)
+			continue
+		}
+		if merged[i].GetType() != family.GetType() {
+			continue
+		}
+		// copy the family of newer, which is still referenced by the last metrics
+		f := *merged[i]
+		f.Metric = append(append([]*clientmodel.Metric(nil), family.Metric...), merged[i].Metric...)
+		sort.SliceStable(f.Metric, func(i, j int) bool {
+			return f.Metric[i].GetTimestampMs() < f.Metric[j].GetTimestampMs()
+		})
+		merged[i] = &f
+	}
+	return merged
+}
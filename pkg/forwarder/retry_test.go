@@ -0,0 +1,72 @@
+package forwarder
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestRetrierDelay(t *testing.T) {
+	r := newRetrier(10, time.Second)
+	for _, tt := range []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{20, maxRetryBackoff},
+		{100, maxRetryBackoff},
+	} {
+		for i := 0; i < 10; i++ {
+			if got := r.delay(tt.attempt, 0); got < tt.want/2 || got > tt.want {
+				t.Errorf("want the delay after attempt %d between %v and %v, got %v", tt.attempt, tt.want/2, tt.want, got)
+			}
+		}
+	}
+	if got := r.delay(0, time.Minute); got != time.Minute {
+		t.Errorf("want the delay the server asked for, got %v", got)
+	}
+}
+
+func TestMergeFamilies(t *testing.T) {
+	family := func(name string, typ clientmodel.MetricType, timestamps ...int64) *clientmodel.MetricFamily {
+		f := &clientmodel.MetricFamily{Name: proto.String(name), Type: typ.Enum()}
+		for _, ts := range timestamps {
+			f.Metric = append(f.Metric, &clientmodel.Metric{TimestampMs: proto.Int64(ts), Gauge: &clientmodel.Gauge{Value: proto.Float64(1)}})
+		}
+		return f
+	}
+	newer := []*clientmodel.MetricFamily{
+		family("up", clientmodel.MetricType_GAUGE, 2000, 2000),
+		family("new", clientmodel.MetricType_GAUGE, 2000),
+		family("changed", clientmodel.MetricType_COUNTER, 2000),
+	}
+	older := []*clientmodel.MetricFamily{
+		family("up", clientmodel.MetricType_GAUGE, 1000, 1000),
+		family("old", clientmodel.MetricType_GAUGE, 1000),
+		family("changed", clientmodel.MetricType_GAUGE, 1000),
+	}
+
+	got := make(map[string][]int64)
+	for _, f := range mergeFamilies(older, newer) {
+		for _, m := range f.Metric {
+			got[f.GetName()] = append(got[f.GetName()], m.GetTimestampMs())
+		}
+	}
+	want := map[string][]int64{
+		"up":      {1000, 1000, 2000, 2000},
+		"new":     {2000},
+		"old":     {1000},
+		"changed": {2000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want merged samples %v, got %v", want, got)
+	}
+	if len(newer[0].Metric) != 2 {
+		t.Errorf("want the newer families unchanged, got %v", newer[0])
+	}
+}
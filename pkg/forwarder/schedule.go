@@ -0,0 +1,85 @@
+package forwarder
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+var gaugeNextUpload = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "federate_next_upload_timestamp_seconds",
+	Help: "The time the next federation and upload is scheduled at.",
+})
+
+func init() {
+	prometheus.MustRegister(gaugeNextUpload)
+}
+
+// schedule decides when a worker uploads. Without jitter, uploads are an interval apart from
+// the previous one. With jitter, uploads happen at a stable phase within each interval, derived
+// from the ID of the instance, so that a fleet of clients restarted together does not upload
+// in step.
+type schedule struct {
+	interval time.Duration
+	// phase is the offset of uploads from the start of each interval, or negative without
+	// jitter.
+	phase  time.Duration
+	jitter time.Duration
+	rand   *rand.Rand
+}
+
+// newSchedule returns the schedule of uploads every interval, spread over a jitter fraction of
+// it by the hash of id. Without an id, the phase is random for each instance.
+func newSchedule(interval time.Duration, jitter float64, id string) schedule {
+	s := schedule{
+		interval: interval,
+		phase:    -1,
+		jitter:   time.Duration(jitter * float64(interval)),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if s.jitter <= 0 {
+		return s
+	}
+	var fraction float64
+	if len(id) > 0 {
+		h := fnv.New64a()
+		h.Write([]byte(id))
+		fraction = float64(h.Sum64()) / (math.MaxUint64 + 1.0)
+	} else {
+		fraction = s.rand.Float64()
+	}
+	s.phase = time.Duration(fraction * float64(s.jitter))
+	return s
+}
+
+// next returns when to upload after an upload that finished at now with err. A failed upload
+// is retried after retry, unless the server rate limited it, in which case it is retried after
+// the delay it asked for and a random jitter, so that rate limited clients do not retry in step.
+func (s schedule) next(now time.Time, err error, retry time.Duration) time.Time {
+	if err != nil {
+		if rerr, ok := err.(*metricsclient.ErrRateLimited); ok {
+			delay := rerr.RetryAfter
+			if delay <= 0 {
+				delay = s.interval
+			}
+			if s.jitter > 0 {
+				delay += time.Duration(s.rand.Int63n(int64(s.jitter)))
+			}
+			return now.Add(delay)
+		}
+		return now.Add(retry)
+	}
+	if s.phase < 0 {
+		return now.Add(s.interval)
+	}
+	next := now.Truncate(s.interval).Add(s.phase)
+	for !next.After(now) {
+		next = next.Add(s.interval)
+	}
+	return next
+}
@@ -0,0 +1,75 @@
+package forwarder
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+func TestScheduleNext(t *testing.T) {
+	const interval = 5 * time.Minute
+	start := time.Date(2019, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	t.Run("without jitter", func(t *testing.T) {
+		s := newSchedule(interval, 0, "cluster-a")
+		now := start.Add(17 * time.Second)
+		if got, want := s.next(now, nil, time.Minute), now.Add(interval); !got.Equal(want) {
+			t.Errorf("want next upload at %v, got %v", want, got)
+		}
+	})
+
+	t.Run("stable phase", func(t *testing.T) {
+		s := newSchedule(interval, 0.5, "cluster-a")
+		if s.phase < 0 || s.phase >= interval/2 {
+			t.Fatalf("want a phase within the jitter, got %v", s.phase)
+		}
+		if again := newSchedule(interval, 0.5, "cluster-a"); again.phase != s.phase {
+			t.Errorf("want the phase stable for the ID, got %v and %v", s.phase, again.phase)
+		}
+		// uploads finishing at any time within an interval are scheduled at the same phase
+		for _, after := range []time.Duration{0, 10 * time.Second, s.phase, s.phase + time.Second, interval - time.Second} {
+			now := start.Add(after)
+			next := s.next(now, nil, time.Minute)
+			if !next.After(now) || next.Sub(now) > interval {
+				t.Errorf("want the next upload within an interval of %v, got %v", now, next)
+			}
+			if got := next.Sub(next.Truncate(interval)); got != s.phase {
+				t.Errorf("want the upload after %v at phase %v, got %v", after, s.phase, got)
+			}
+		}
+	})
+
+	t.Run("phases spread by ID", func(t *testing.T) {
+		phases := make(map[time.Duration]struct{})
+		for i := 0; i < 20; i++ {
+			phases[newSchedule(interval, 1, fmt.Sprintf("cluster-%d", i)).phase] = struct{}{}
+		}
+		if len(phases) < 15 {
+			t.Errorf("want the phases of 20 clusters spread, got %d distinct phases", len(phases))
+		}
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		s := newSchedule(interval, 0.5, "cluster-a")
+		now := start.Add(s.phase)
+		for i := 0; i < 10; i++ {
+			next := s.next(now, &metricsclient.ErrRateLimited{RetryAfter: 2 * time.Minute}, time.Minute)
+			if delay := next.Sub(now); delay < 2*time.Minute || delay >= 2*time.Minute+interval/2 {
+				t.Errorf("want a delay of the retry-after and up to the jitter, got %v", delay)
+			}
+		}
+		next := s.next(now, &metricsclient.ErrRateLimited{}, time.Minute)
+		if delay := next.Sub(now); delay < interval || delay >= interval+interval/2 {
+			t.Errorf("want a delay of an interval and up to the jitter without retry-after, got %v", delay)
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		s := newSchedule(interval, 0.5, "cluster-a")
+		if got, want := s.next(start, fmt.Errorf("unavailable"), time.Minute), start.Add(time.Minute); !got.Equal(want) {
+			t.Errorf("want a retry at %v, got %v", want, got)
+		}
+	})
+}
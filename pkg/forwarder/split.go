@@ -0,0 +1,95 @@
+package forwarder
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+// splitFamilies splits the families into parts of at most maxBytes once encoded, before
+// compression. Families are kept whole in a part unless they alone exceed maxBytes, in which
+// case their series are spread over consecutive parts. A series exceeding maxBytes is sent in
+// a part of its own. The families are returned as a single part if maxBytes is not positive.
+func splitFamilies(families []*clientmodel.MetricFamily, maxBytes int64) [][]*clientmodel.MetricFamily {
+	if maxBytes <= 0 {
+		return [][]*clientmodel.MetricFamily{families}
+	}
+	var (
+		parts [][]*clientmodel.MetricFamily
+		part  []*clientmodel.MetricFamily
+		size  int64
+	)
+	flush := func() {
+		if len(part) > 0 {
+			parts = append(parts, part)
+		}
+		part, size = nil, 0
+	}
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		n := int64(proto.Size(family))
+		n += int64(proto.SizeVarint(uint64(n)))
+		if size+n <= maxBytes {
+			part = append(part, family)
+			size += n
+			continue
+		}
+		if n <= maxBytes {
+			flush()
+			part = append(part, family)
+			size = n
+			continue
+		}
+
+		// Spread the series over parts, with a copy of the family in each.
+		header := &clientmodel.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type}
+		headerSize := int64(proto.Size(header) + binary.MaxVarintLen64)
+		var chunk *clientmodel.MetricFamily
+		for _, m := range family.Metric {
+			ms := int64(proto.Size(m))
+			// the tag and length of the series within the family
+			ms += 1 + int64(proto.SizeVarint(uint64(ms)))
+			if chunk == nil || size+ms > maxBytes {
+				if chunk != nil || size+headerSize+ms > maxBytes {
+					flush()
+				}
+				chunk = &clientmodel.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type}
+				part = append(part, chunk)
+				size += headerSize
+			}
+			chunk.Metric = append(chunk.Metric, m)
+			size += ms
+		}
+	}
+	flush()
+	return parts
+}
+
+// newUploadID returns a random ID shared by the parts of an upload.
+func newUploadID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// partHeader returns the headers of the part at index of an upload split in count parts, or
+// nil if the upload is not split.
+func partHeader(index, count int, id string) http.Header {
+	if count <= 1 {
+		return nil
+	}
+	header := make(http.Header)
+	header.Set(metricsclient.PartHeader, fmt.Sprintf("%d/%d; upload=%s", index+1, count, id))
+	return header
+}
@@ -0,0 +1,89 @@
+package forwarder
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestSplitFamilies(t *testing.T) {
+	family := func(name string, series int) *clientmodel.MetricFamily {
+		f := &clientmodel.MetricFamily{Name: proto.String(name), Type: clientmodel.MetricType_GAUGE.Enum()}
+		for i := 0; i < series; i++ {
+			f.Metric = append(f.Metric, &clientmodel.Metric{
+				Label:       []*clientmodel.LabelPair{{Name: proto.String("instance"), Value: proto.String(fmt.Sprintf("instance-%d", i))}},
+				Gauge:       &clientmodel.Gauge{Value: proto.Float64(float64(i))},
+				TimestampMs: proto.Int64(1000),
+			})
+		}
+		return f
+	}
+	// size returns the size of the families encoded
+	size := func(families []*clientmodel.MetricFamily) int64 {
+		var n int64
+		for _, f := range families {
+			s := proto.Size(f)
+			n += int64(s + proto.SizeVarint(uint64(s)))
+		}
+		return n
+	}
+	// series returns the series of the families, in order
+	series := func(families ...[]*clientmodel.MetricFamily) []string {
+		var all []string
+		for _, part := range families {
+			for _, f := range part {
+				for _, m := range f.Metric {
+					all = append(all, f.GetName()+proto.CompactTextString(m))
+				}
+			}
+		}
+		sort.Strings(all)
+		return all
+	}
+	families := []*clientmodel.MetricFamily{family("a", 2), family("b", 40), family("c", 3), family("d", 1)}
+
+	if parts := splitFamilies(families, 0); len(parts) != 1 || !reflect.DeepEqual(parts[0], families) {
+		t.Errorf("want a single part without a limit, got %d parts", len(parts))
+	}
+
+	const maxBytes = 300
+	parts := splitFamilies(families, maxBytes)
+	if len(parts) < 3 {
+		t.Fatalf("want several parts, got %d", len(parts))
+	}
+	for i, part := range parts {
+		if n := size(part); n > maxBytes {
+			t.Errorf("want part %d of at most %d bytes, got %d", i, maxBytes, n)
+		}
+	}
+	if got, want := series(parts...), series(families); !reflect.DeepEqual(got, want) {
+		t.Errorf("want the parts to hold every series once\n%v\ngot\n%v", want, got)
+	}
+	// the families that fit are kept whole
+	for _, part := range parts {
+		for _, f := range part {
+			if f.GetName() != "b" && len(f.Metric) != len(familyNamed(families, f.GetName()).Metric) {
+				t.Errorf("want family %s kept whole, got %d series", f.GetName(), len(f.Metric))
+			}
+		}
+	}
+
+	// a series larger than the limit is sent alone
+	parts = splitFamilies([]*clientmodel.MetricFamily{family("a", 2)}, 10)
+	if len(parts) != 2 || len(parts[0][0].Metric) != 1 || len(parts[1][0].Metric) != 1 {
+		t.Errorf("want each series in a part of its own, got %v", parts)
+	}
+}
+
+func familyNamed(families []*clientmodel.MetricFamily, name string) *clientmodel.MetricFamily {
+	for _, f := range families {
+		if f.GetName() == name {
+			return f
+		}
+	}
+	return nil
+}
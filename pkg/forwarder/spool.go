@@ -0,0 +1,271 @@
+package forwarder
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+// Reasons a spooled payload is dropped before it is delivered.
+const (
+	spoolDropSize     = "size"
+	spoolDropAge      = "age"
+	spoolDropCorrupt  = "corrupt"
+	spoolDropWrite    = "write_error"
+	spoolDropRejected = "rejected"
+)
+
+const spoolSuffix = ".payload"
+
+var (
+	gaugeSpoolPayloads = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "federate_spool_payloads",
+		Help: "The number of payloads waiting in the spool to be uploaded.",
+	})
+	gaugeSpoolBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "federate_spool_bytes",
+		Help: "The size of the payloads waiting in the spool to be uploaded.",
+	})
+	counterSpoolDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federate_spool_dropped_payloads_total",
+		Help: "Tracks the number of payloads dropped from the spool without being uploaded, by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(gaugeSpoolPayloads, gaugeSpoolBytes, counterSpoolDropped)
+}
+
+// Spool is an on-disk queue of the payloads that could not be uploaded, so that they may be
+// delivered once the server can be reached again. Payloads keep the original timestamps of
+// their samples. The oldest payloads are dropped when the spool exceeds its size or they exceed
+// its age. Payloads that cannot be written or read back are dropped and counted, never failing
+// the caller. It is safe for concurrent use.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	nowFunc  func() time.Time
+
+	mu    sync.Mutex
+	files []spoolFile
+	bytes int64
+	seq   int
+}
+
+// spoolFile is a payload in the spool.
+type spoolFile struct {
+	name    string
+	size    int64
+	created time.Time
+}
+
+// NewSpool returns a spool of the payloads in dir, which is created if it does not exist. The
+// payloads left by a previous process are kept. If maxBytes or maxAge is 0, the spool is not
+// bounded by size or age.
+func NewSpool(dir string, maxBytes int64, maxAge time.Duration, nowFunc func() time.Time) (*Spool, error) {
+	if nowFunc == nil {
+		nowFunc = time.Now
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create spool directory: %v", err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read spool directory: %v", err)
+	}
+	s := &Spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge, nowFunc: nowFunc}
+	for _, fi := range entries {
+		name := fi.Name()
+		switch {
+		case fi.IsDir():
+		case strings.HasPrefix(name, "."):
+			// an incomplete write of a previous process
+			os.Remove(filepath.Join(dir, name))
+		case strings.HasSuffix(name, spoolSuffix):
+			created, ok := parseSpoolName(name)
+			if !ok {
+				log.Printf("warning: dropping spooled payload with an invalid name %s", name)
+				s.removeFile(name, spoolDropCorrupt)
+				continue
+			}
+			s.files = append(s.files, spoolFile{name: name, size: fi.Size(), created: created})
+			s.bytes += fi.Size()
+		}
+	}
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].name < s.files[j].name })
+	s.updateMetrics()
+	return s, nil
+}
+
+// Enqueue adds the families to the spool as the newest payload, dropping the oldest payloads
+// to stay within the size of the spool.
+func (s *Spool) Enqueue(families []*clientmodel.MetricFamily) {
+	buf := &bytes.Buffer{}
+	if err := metricsclient.Write(buf, families); err != nil {
+		log.Printf("error: unable to encode payload for the spool, dropping it: %v", err)
+		counterSpoolDropped.WithLabelValues(spoolDropWrite).Inc()
+		return
+	}
+	size := int64(buf.Len())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.updateMetrics()
+
+	if s.maxBytes > 0 && size > s.maxBytes {
+		log.Printf("warning: payload of %d bytes is larger than the spool, dropping it", size)
+		counterSpoolDropped.WithLabelValues(spoolDropSize).Inc()
+		return
+	}
+	now := s.nowFunc()
+	s.expire(now)
+	for s.maxBytes > 0 && s.bytes+size > s.maxBytes && len(s.files) > 0 {
+		s.removeOldest(spoolDropSize)
+	}
+
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", now.UnixNano(), s.seq%1000000, spoolSuffix)
+	tmp := filepath.Join(s.dir, "."+name)
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		os.Remove(tmp)
+		log.Printf("error: unable to write payload to the spool, dropping it: %v", err)
+		counterSpoolDropped.WithLabelValues(spoolDropWrite).Inc()
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp)
+		log.Printf("error: unable to write payload to the spool, dropping it: %v", err)
+		counterSpoolDropped.WithLabelValues(spoolDropWrite).Inc()
+		return
+	}
+	s.files = append(s.files, spoolFile{name: name, size: size, created: now})
+	s.bytes += size
+}
+
+// Take returns the payloads of the spool oldest first, so that they are sent along with the next
+// upload, as the server takes a single upload per interval. The payloads are taken as long as
+// they fit in maxBytes, unless it is 0, and the oldest one is taken in any case. They stay in the
+// spool until the returned function is called, with an empty reason once they are delivered, or
+// with the reason they are dropped for. Payloads that cannot be read back are dropped.
+func (s *Spool) Take(maxBytes int64) ([][]*clientmodel.MetricFamily, func(reason string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.updateMetrics()
+
+	s.expire(s.nowFunc())
+	var (
+		payloads [][]*clientmodel.MetricFamily
+		taken    []string
+		size     int64
+	)
+	for i := 0; i < len(s.files); i++ {
+		f := s.files[i]
+		if len(taken) > 0 && maxBytes > 0 && size+f.size > maxBytes {
+			break
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, f.name))
+		if err == nil {
+			var families []*clientmodel.MetricFamily
+			if families, err = metricsclient.Read(bytes.NewReader(data)); err == nil {
+				payloads = append(payloads, families)
+				taken = append(taken, f.name)
+				size += f.size
+				continue
+			}
+		}
+		log.Printf("error: spooled payload %s cannot be read, dropping it: %v", f.name, err)
+		s.remove(i, spoolDropCorrupt)
+		i--
+	}
+	return payloads, func(reason string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		defer s.updateMetrics()
+		for _, name := range taken {
+			// the payload may have been dropped to make room in the meantime
+			for i := range s.files {
+				if s.files[i].name == name {
+					s.remove(i, reason)
+					break
+				}
+			}
+		}
+	}
+}
+
+// Len returns the number of payloads in the spool.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files)
+}
+
+// expire drops the payloads older than the age of the spool. The caller must hold the lock.
+func (s *Spool) expire(now time.Time) {
+	if s.maxAge <= 0 {
+		return
+	}
+	for len(s.files) > 0 && now.Sub(s.files[0].created) > s.maxAge {
+		s.removeOldest(spoolDropAge)
+	}
+}
+
+// removeOldest removes the oldest payload, counting it as dropped for reason unless reason is
+// empty. The caller must hold the lock.
+func (s *Spool) removeOldest(reason string) {
+	s.remove(0, reason)
+}
+
+// remove removes the payload at i, counting it as dropped for reason unless reason is empty. The
+// caller must hold the lock.
+func (s *Spool) remove(i int, reason string) {
+	f := s.files[i]
+	s.files = append(s.files[:i], s.files[i+1:]...)
+	s.bytes -= f.size
+	s.removeFile(f.name, reason)
+}
+
+func (s *Spool) removeFile(name, reason string) {
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+		log.Printf("error: unable to remove spooled payload: %v", err)
+	}
+	if len(reason) > 0 {
+		counterSpoolDropped.WithLabelValues(reason).Inc()
+	}
+}
+
+func (s *Spool) updateMetrics() {
+	gaugeSpoolPayloads.Set(float64(len(s.files)))
+	gaugeSpoolBytes.Set(float64(s.bytes))
+}
+
+// parseSpoolName returns the time a payload was spooled from its name.
+func parseSpoolName(name string) (time.Time, bool) {
+	name = strings.TrimSuffix(name, spoolSuffix)
+	i := strings.IndexByte(name, '-')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(name[:i], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if _, err := strconv.Atoi(name[i+1:]); err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
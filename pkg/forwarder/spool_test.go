@@ -0,0 +1,234 @@
+package forwarder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+func TestSpool(t *testing.T) {
+	// payload returns a family with a sample at ts
+	payload := func(ts int64) []*clientmodel.MetricFamily {
+		return []*clientmodel.MetricFamily{{
+			Name:   proto.String("up"),
+			Type:   clientmodel.MetricType_GAUGE.Enum(),
+			Metric: []*clientmodel.Metric{{Gauge: &clientmodel.Gauge{Value: proto.Float64(1)}, TimestampMs: proto.Int64(ts)}},
+		}}
+	}
+	// timestamps returns the timestamps of the payloads
+	timestamps := func(payloads [][]*clientmodel.MetricFamily) []int64 {
+		var got []int64
+		for _, families := range payloads {
+			got = append(got, families[0].Metric[0].GetTimestampMs())
+		}
+		return got
+	}
+	// drain returns the timestamps of the payloads taken from the spool, removing them
+	drain := func(t *testing.T, s *Spool) []int64 {
+		payloads, done := s.Take(0)
+		done("")
+		return timestamps(payloads)
+	}
+	dropped := func(reason string) float64 {
+		m := &clientmodel.Metric{}
+		if err := counterSpoolDropped.WithLabelValues(reason).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	size := func() int64 {
+		buf := &countingWriter{}
+		if err := metricsclient.Write(buf, payload(1)); err != nil {
+			t.Fatal(err)
+		}
+		return buf.n
+	}()
+
+	t.Run("oldest first across restarts", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "spool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		s, err := NewSpool(dir, 0, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ts := int64(1); ts <= 3; ts++ {
+			s.Enqueue(payload(ts))
+		}
+		s, err = NewSpool(dir, 0, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := drain(t, s); !reflect.DeepEqual(got, []int64{1, 2, 3}) {
+			t.Errorf("want payloads 1, 2 and 3 in order, got %v", got)
+		}
+		if s.Len() != 0 {
+			t.Errorf("want an empty spool after draining, got %d payloads", s.Len())
+		}
+	})
+
+	t.Run("oldest dropped beyond the size", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "spool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		before := dropped(spoolDropSize)
+		s, err := NewSpool(dir, 2*size, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ts := int64(1); ts <= 3; ts++ {
+			s.Enqueue(payload(ts))
+		}
+		if got := dropped(spoolDropSize) - before; got != 1 {
+			t.Errorf("want 1 payload dropped for size, got %v", got)
+		}
+		if got := drain(t, s); !reflect.DeepEqual(got, []int64{2, 3}) {
+			t.Errorf("want payloads 2 and 3, got %v", got)
+		}
+	})
+
+	t.Run("expired payloads dropped", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "spool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		now := time.Unix(1000, 0)
+		before := dropped(spoolDropAge)
+		s, err := NewSpool(dir, 0, time.Hour, func() time.Time { return now })
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Enqueue(payload(1))
+		now = now.Add(30 * time.Minute)
+		s.Enqueue(payload(2))
+		now = now.Add(45 * time.Minute)
+		if got := drain(t, s); !reflect.DeepEqual(got, []int64{2}) {
+			t.Errorf("want payload 2, got %v", got)
+		}
+		if got := dropped(spoolDropAge) - before; got != 1 {
+			t.Errorf("want 1 payload dropped for age, got %v", got)
+		}
+	})
+
+	t.Run("corrupt payloads dropped", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "spool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		before := dropped(spoolDropCorrupt)
+		s, err := NewSpool(dir, 0, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Enqueue(payload(1))
+		s.Enqueue(payload(2))
+		files, err := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+		if err != nil || len(files) != 2 {
+			t.Fatalf("want 2 spooled payloads, got %v: %v", files, err)
+		}
+		if err := ioutil.WriteFile(files[0], []byte("not a payload"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if got := drain(t, s); !reflect.DeepEqual(got, []int64{2}) {
+			t.Errorf("want payload 2, got %v", got)
+		}
+		if got := dropped(spoolDropCorrupt) - before; got != 1 {
+			t.Errorf("want 1 corrupt payload dropped, got %v", got)
+		}
+	})
+
+	t.Run("write failures dropped", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "spool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := dropped(spoolDropWrite)
+		s, err := NewSpool(dir, 0, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.RemoveAll(dir)
+		s.Enqueue(payload(1))
+		if s.Len() != 0 {
+			t.Errorf("want no payload spooled, got %d", s.Len())
+		}
+		if got := dropped(spoolDropWrite) - before; got != 1 {
+			t.Errorf("want 1 payload dropped on write, got %v", got)
+		}
+	})
+
+	t.Run("take within budget", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "spool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		s, err := NewSpool(dir, 0, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ts := int64(1); ts <= 3; ts++ {
+			s.Enqueue(payload(ts))
+		}
+		payloads, done := s.Take(2 * size)
+		if got := timestamps(payloads); !reflect.DeepEqual(got, []int64{1, 2}) {
+			t.Fatalf("want the 2 oldest payloads, got %v", got)
+		}
+		done("")
+		payloads, _ = s.Take(1)
+		if got := timestamps(payloads); !reflect.DeepEqual(got, []int64{3}) {
+			t.Fatalf("want the oldest payload beyond the budget, got %v", got)
+		}
+	})
+
+	t.Run("failed send kept", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "spool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		before := dropped(spoolDropRejected)
+		s, err := NewSpool(dir, 0, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ts := int64(1); ts <= 3; ts++ {
+			s.Enqueue(payload(ts))
+		}
+		// the payloads are kept until they are delivered
+		if _, _ = s.Take(size); s.Len() != 3 {
+			t.Fatalf("want 3 payloads kept, got %d", s.Len())
+		}
+		_, done := s.Take(size)
+		done(spoolDropRejected)
+		if got := dropped(spoolDropRejected) - before; got != 1 {
+			t.Errorf("want 1 rejected payload dropped, got %v", got)
+		}
+		if got := drain(t, s); !reflect.DeepEqual(got, []int64{2, 3}) {
+			t.Errorf("want payloads 2 and 3 kept, got %v", got)
+		}
+	})
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
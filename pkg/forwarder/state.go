@@ -0,0 +1,101 @@
+package forwarder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// stateFileName is the name of the file in the state directory keeping the last upload.
+const stateFileName = "last-upload.json"
+
+// uploadState is the last successful upload, kept across restarts of the client.
+type uploadState struct {
+	// Time is when the upload succeeded.
+	Time time.Time `json:"time"`
+	// Hash identifies the metrics uploaded, as returned by payloadHash.
+	Hash string `json:"hash,omitempty"`
+}
+
+// loadState returns the last successful upload kept in dir, or nil if there is none. A state
+// file that cannot be read is ignored, as only the first upload after a restart depends on it.
+func loadState(dir string) *uploadState {
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("warning: unable to read the last upload state, ignoring it: %v", err)
+		return nil
+	}
+	state := &uploadState{}
+	if err := json.Unmarshal(data, state); err != nil || state.Time.IsZero() {
+		log.Printf("warning: the last upload state %s is corrupt, ignoring it", filepath.Join(dir, stateFileName))
+		return nil
+	}
+	return state
+}
+
+// saveState keeps the state of the last successful upload in dir. The file is replaced at once,
+// so that it is never left partially written.
+func saveState(dir string, state uploadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, stateFileName+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to write the last upload state: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write the last upload state: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write the last upload state: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, stateFileName)); err != nil {
+		return fmt.Errorf("unable to write the last upload state: %v", err)
+	}
+	return nil
+}
+
+// payloadHash returns a hash of the families, which is the same for families of the same
+// series, values and timestamps.
+func payloadHash(families []*clientmodel.MetricFamily) string {
+	h := sha256.New()
+	encoder := expfmt.NewEncoder(h, expfmt.FmtProtoDelim)
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		if err := encoder.Encode(family); err != nil {
+			return ""
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// uploaded records the successful upload of the families, keeping it in the state directory if
+// there is one. The caller must hold the lock.
+func (w *Worker) uploaded(families []*clientmodel.MetricFamily) {
+	now := time.Now()
+	gaugeLastSuccessfulUpload.Set(float64(now.UnixNano()) / 1e9)
+	w.restored = nil
+	if len(w.stateDir) == 0 {
+		return
+	}
+	if err := saveState(w.stateDir, uploadState{Time: now, Hash: payloadHash(families)}); err != nil {
+		log.Printf("error: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+func TestStateAcrossRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		mu      sync.Mutex
+		value   = 1
+		uploads []string
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/federate", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		fmt.Fprintf(w, "# TYPE up gauge\nup{job=\"a\"} %d 1000\n", value)
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		// the uploads are recorded by the header telling the last upload before a restart
+		uploads = append(uploads, req.Header.Get(metricsclient.LastUploadHeader))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	from, _ := url.Parse(ts.URL + "/federate")
+	to, _ := url.Parse(ts.URL + "/upload")
+	// start starts the client over the state directory, and returns the last upload time exposed
+	start := func() (*Worker, float64) {
+		gaugeLastSuccessfulUpload.Set(0)
+		w, err := New(Config{From: from, ToUpload: to, Interval: time.Minute, LimitBytes: 200 * 1024, StateDir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &clientmodel.Metric{}
+		if err := gaugeLastSuccessfulUpload.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return w, m.GetGauge().GetValue()
+	}
+	forward := func(w *Worker, want ...string) {
+		if err := w.forward(context.Background(), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if fmt.Sprintf("%q", uploads) != fmt.Sprintf("%q", want) {
+			t.Errorf("want uploads %q, got %q", want, uploads)
+		}
+		uploads = nil
+	}
+	setValue := func(v int) {
+		mu.Lock()
+		defer mu.Unlock()
+		value = v
+	}
+
+	w, last := start()
+	if last != 0 {
+		t.Errorf("want no last upload without a state, got %v", last)
+	}
+	forward(w, "")
+	forward(w, "")
+
+	// the metrics uploaded before the restart are not uploaded again
+	before := time.Now()
+	w, last = start()
+	if state := loadState(dir); state == nil || last != float64(state.Time.UnixNano())/1e9 {
+		t.Errorf("want the last upload of the state exposed, got %v", last)
+	} else if state.Time.After(before) {
+		t.Errorf("want the last upload before the restart, got %s", state.Time)
+	}
+	forward(w)
+	forward(w, "")
+
+	// new metrics are sent with the time of the last upload once
+	w, _ = start()
+	lastUpload := loadState(dir).Time.UTC().Format(time.RFC3339)
+	setValue(2)
+	forward(w, lastUpload)
+	forward(w, "")
+
+	// a corrupt state is ignored
+	if err := ioutil.WriteFile(filepath.Join(dir, stateFileName), []byte(`{"time": `), 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, last = start()
+	if last != 0 {
+		t.Errorf("want no last upload with a corrupt state, got %v", last)
+	}
+	forward(w, "")
+	if loadState(dir) == nil {
+		t.Errorf("want the state replaced")
+	}
+}
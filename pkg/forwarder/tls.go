@@ -0,0 +1,172 @@
+package forwarder
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsFileCheckInterval limits how often the TLS files of the server are checked for changes.
+const tlsFileCheckInterval = 10 * time.Second
+
+// tlsVersions are the versions of TLS accepted as the minimum version to the server.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsOptions are the TLS options of the connections to the server.
+type tlsOptions struct {
+	caFile             string
+	certFile           string
+	keyFile            string
+	minVersion         uint16
+	insecureSkipVerify bool
+}
+
+func newTLSOptions(cfg Config) (tlsOptions, error) {
+	o := tlsOptions{
+		caFile:             cfg.ToCAFile,
+		certFile:           cfg.ToCertFile,
+		keyFile:            cfg.ToKeyFile,
+		minVersion:         tls.VersionTLS12,
+		insecureSkipVerify: cfg.ToInsecureSkipVerify,
+	}
+	if (len(o.certFile) > 0) != (len(o.keyFile) > 0) {
+		return o, fmt.Errorf("a client certificate and key must both be specified or empty")
+	}
+	if len(cfg.ToTLSMinVersion) > 0 {
+		version, ok := tlsVersions[cfg.ToTLSMinVersion]
+		if !ok {
+			return o, fmt.Errorf("the minimum TLS version must be 1.0, 1.1, 1.2 or 1.3: %s", cfg.ToTLSMinVersion)
+		}
+		o.minVersion = version
+	}
+	return o, nil
+}
+
+// files returns the files the TLS configuration is loaded from.
+func (o tlsOptions) files() []string {
+	var files []string
+	for _, file := range []string{o.caFile, o.certFile, o.keyFile} {
+		if len(file) > 0 {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// config loads the TLS configuration of the options. The CA bundle verifies the server in
+// addition to the system roots.
+func (o tlsOptions) config() (*tls.Config, error) {
+	c := &tls.Config{MinVersion: o.minVersion, InsecureSkipVerify: o.insecureSkipVerify}
+	if len(o.caFile) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read system certificates: %v", err)
+		}
+		data, err := ioutil.ReadFile(o.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read to-ca-file: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in to-ca-file %s", o.caFile)
+		}
+		c.RootCAs = pool
+	}
+	if len(o.certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the client certificate: %v", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// reloadingTransport sends requests with a transport to the server whose TLS configuration is
+// loaded again when one of its files changes, checked at most every tlsFileCheckInterval.
+type reloadingTransport struct {
+	files []string
+	load  func() (*http.Transport, error)
+	nowFn func() time.Time
+
+	mu        sync.Mutex
+	transport *http.Transport
+	modTimes  []time.Time
+	checked   time.Time
+}
+
+func newReloadingTransport(files []string, load func() (*http.Transport, error)) (*reloadingTransport, error) {
+	t := &reloadingTransport{files: files, load: load, nowFn: time.Now}
+	modTimes, err := t.stat()
+	if err != nil {
+		return nil, err
+	}
+	if t.transport, err = load(); err != nil {
+		return nil, err
+	}
+	t.modTimes = modTimes
+	t.checked = t.nowFn()
+	return t, nil
+}
+
+func (t *reloadingTransport) stat() ([]time.Time, error) {
+	modTimes := make([]time.Time, 0, len(t.files))
+	for _, file := range t.files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read TLS file: %v", err)
+		}
+		modTimes = append(modTimes, fi.ModTime())
+	}
+	return modTimes, nil
+}
+
+// check loads the transport again if a file changed. If it cannot be loaded, the previous
+// transport continues to be used.
+func (t *reloadingTransport) check() *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.nowFn()
+	if now.Sub(t.checked) < tlsFileCheckInterval {
+		return t.transport
+	}
+	t.checked = now
+	modTimes, err := t.stat()
+	if err != nil {
+		log.Printf("error: unable to check the TLS files of the server, continuing with the previous configuration: %v", err)
+		return t.transport
+	}
+	changed := false
+	for i := range modTimes {
+		if !modTimes[i].Equal(t.modTimes[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return t.transport
+	}
+	transport, err := t.load()
+	if err != nil {
+		log.Printf("error: unable to reload the TLS files of the server, continuing with the previous configuration: %v", err)
+		return t.transport
+	}
+	log.Printf("reloaded the TLS files of the server")
+	t.transport.CloseIdleConnections()
+	t.transport, t.modTimes = transport, modTimes
+	return t.transport
+}
+
+func (t *reloadingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.check().RoundTrip(req)
+}
@@ -0,0 +1,210 @@
+package forwarder
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert returns a certificate signed by parent, or a CA if parent is nil.
+func newTestCert(t *testing.T, cn string, parent *testCert, serial int64) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// newTLSServer starts a server with a certificate of ca, requiring client certificates of ca
+// if mTLS is set.
+func newTLSServer(t *testing.T, ca *testCert, mTLS bool, maxVersion uint16) *httptest.Server {
+	serving := newTestCert(t, "server", ca, 2)
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	s.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	s.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serving.der}, PrivateKey: serving.key}},
+		MaxVersion:   maxVersion,
+	}
+	if mTLS {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		s.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		s.TLS.ClientCAs = pool
+	}
+	s.StartTLS()
+	return s
+}
+
+func TestToTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-client-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil, 1)
+	caFile, _ := ca.write(t, dir, "ca")
+	unknownFile, _ := newTestCert(t, "unknown", nil, 1).write(t, dir, "unknown")
+	certFile, keyFile := newTestCert(t, "cluster-1", ca, 3).write(t, dir, "client")
+
+	for _, tc := range []struct {
+		name       string
+		cfg        Config
+		mTLS       bool
+		maxVersion uint16
+		wantErr    bool
+	}{
+		{name: "trusted CA", cfg: Config{ToCAFile: caFile}},
+		{name: "unknown CA", cfg: Config{ToCAFile: unknownFile}, wantErr: true},
+		{name: "system roots", wantErr: true},
+		{name: "insecure skip verify", cfg: Config{ToInsecureSkipVerify: true}},
+		{name: "client certificate", cfg: Config{ToCAFile: caFile, ToCertFile: certFile, ToKeyFile: keyFile}, mTLS: true},
+		{name: "client certificate missing", cfg: Config{ToCAFile: caFile}, mTLS: true, wantErr: true},
+		{name: "minimum version", cfg: Config{ToCAFile: caFile, ToTLSMinVersion: "1.3"}, maxVersion: tls.VersionTLS12, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTLSServer(t, ca, tc.mTLS, tc.maxVersion)
+			defer s.Close()
+			rt, err := newToRoundTripper(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := (&http.Client{Transport: rt}).Get(s.URL)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err == nil {
+				resp.Body.Close()
+			}
+		})
+	}
+
+	for _, cfg := range []Config{
+		{ToCertFile: certFile},
+		{ToKeyFile: keyFile},
+		{ToTLSMinVersion: "1.4"},
+		{ToCAFile: keyFile},
+		{ToCAFile: filepath.Join(dir, "missing")},
+	} {
+		if _, err := newToRoundTripper(cfg); err == nil {
+			t.Errorf("want the TLS options %+v rejected", cfg)
+		}
+	}
+}
+
+func TestToTLSReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-client-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil, 1)
+	s := newTLSServer(t, ca, false, 0)
+	defer s.Close()
+
+	// the bundle trusts another CA until the CA of the server is added
+	caFile, _ := newTestCert(t, "previous", nil, 1).write(t, dir, "ca")
+	rt, err := newToRoundTripper(Config{ToCAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloading := rt.(*reloadingTransport)
+	now := time.Now()
+	reloading.nowFn = func() time.Time { return now }
+	c := &http.Client{Transport: rt}
+	if _, err := c.Get(s.URL); err == nil {
+		t.Fatal("want the server not trusted")
+	}
+
+	ca.write(t, dir, "ca")
+	modTime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(caFile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(s.URL); err == nil {
+		t.Fatal("want the bundle not checked before the check interval")
+	}
+	now = now.Add(tlsFileCheckInterval)
+	resp, err := c.Get(s.URL)
+	if err != nil {
+		t.Fatalf("want the server trusted after the bundle is reloaded, got %v", err)
+	}
+	resp.Body.Close()
+
+	// an invalid bundle keeps the previous one
+	if err := ioutil.WriteFile(caFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime = modTime.Add(time.Minute)
+	if err := os.Chtimes(caFile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(tlsFileCheckInterval)
+	resp, err = c.Get(s.URL)
+	if err != nil {
+		t.Fatalf("want the previous bundle kept, got %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,80 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/openshift/telemeter/pkg/audit"
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+// ClusterAccessPath is the path the ClusterAccess handler must be mounted at.
+const ClusterAccessPath = "/admin/cluster-access"
+
+// ClusterAccess serves the cluster access lists, and replaces them.
+type ClusterAccess struct {
+	// Audit records every attempt to replace the lists, by default to the standard logger.
+	Audit audit.Logger
+
+	access *authorize.ClusterAccess
+}
+
+// NewClusterAccess returns a handler for GET /admin/cluster-access listing the allowed and
+// denied clusters, and PUT /admin/cluster-access replacing them with a JSON authorize.AccessList.
+func NewClusterAccess(access *authorize.ClusterAccess) *ClusterAccess {
+	return &ClusterAccess{Audit: audit.NewStandardLogger(), access: access}
+}
+
+func (a *ClusterAccess) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		a.list(w)
+	case "PUT":
+		a.replace(w, req)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// replace replaces the access lists. Only admins with the delete role may do so, and every
+// attempt is audited.
+func (a *ClusterAccess) replace(w http.ResponseWriter, req *http.Request) {
+	client, ok := authorize.FromContext(req.Context())
+	if !ok || client.Labels[DeleteRoleLabel] != DeleteRole {
+		audit.Log(a.Audit, req, actor(client, ok), audit.ActionClusterAccess, "", audit.OutcomeDenied)
+		http.Error(w, "Changing cluster access requires the admin role", http.StatusForbidden)
+		return
+	}
+
+	var list authorize.AccessList
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1024*1024)).Decode(&list); err != nil {
+		http.Error(w, fmt.Sprintf("The body must be a JSON access list: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	target := fmt.Sprintf("allow=%s deny=%s", strings.Join(list.Allow, ","), strings.Join(list.Deny, ","))
+	if err := a.access.Replace(list); err != nil {
+		log.Printf("error: unable to replace cluster access lists: %v", err)
+		audit.Log(a.Audit, req, client.ID, audit.ActionClusterAccess, target, audit.OutcomeFailed)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit.Log(a.Audit, req, client.ID, audit.ActionClusterAccess, target, "replaced")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *ClusterAccess) list(w http.ResponseWriter) {
+	data, err := json.MarshalIndent(a.access.List(), "", "  ")
+	if err != nil {
+		log.Printf("marshaling cluster access lists failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		log.Printf("writing cluster access lists failed: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package admin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func TestClusterAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	access, err := authorize.NewClusterAccess(filepath.Join(dir, "access.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := authorize.NewClusterAccessHandler(access, "_id", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	h := NewClusterAccess(access)
+
+	uploads := func(cluster string, want int) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/upload", nil)
+		req = req.WithContext(authorize.WithClient(req.Context(), &authorize.Client{ID: "account", Labels: map[string]string{"_id": cluster}}))
+		w := httptest.NewRecorder()
+		upload.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("cluster %s: want status %d, got %d", cluster, want, w.Code)
+		}
+	}
+	replace := func(client *authorize.Client, body string, want int) {
+		t.Helper()
+		req := httptest.NewRequest("PUT", ClusterAccessPath, strings.NewReader(body))
+		if client != nil {
+			req = req.WithContext(authorize.WithClient(req.Context(), client))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("want status %d, got %d: %s", want, w.Code, w.Body.String())
+		}
+	}
+	admin := &authorize.Client{ID: "alice", Labels: map[string]string{DeleteRoleLabel: DeleteRole}}
+
+	uploads("cluster-1", http.StatusOK)
+	replace(nil, `{"deny":["cluster-1"]}`, http.StatusForbidden)
+	replace(&authorize.Client{ID: "bob"}, `{"deny":["cluster-1"]}`, http.StatusForbidden)
+	replace(admin, `deny`, http.StatusBadRequest)
+	uploads("cluster-1", http.StatusOK)
+
+	// the next upload of a denied cluster is rejected
+	replace(admin, `{"deny":["cluster-1"]}`, http.StatusNoContent)
+	uploads("cluster-1", http.StatusForbidden)
+	uploads("cluster-2", http.StatusOK)
+
+	// lifting the denial lets the cluster upload again
+	replace(admin, `{"allow":["cluster-1"]}`, http.StatusNoContent)
+	uploads("cluster-1", http.StatusOK)
+	uploads("cluster-2", http.StatusForbidden)
+
+	want := authorize.AccessList{Allow: []string{"cluster-1"}, Deny: []string{}}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", ClusterAccessPath, nil))
+	var got authorize.AccessList
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want access lists %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,90 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/openshift/telemeter/pkg/audit"
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+// ClusterBindingsPath is the path the ClusterBindings handler must be mounted at.
+const ClusterBindingsPath = "/admin/cluster-bindings"
+
+// ClusterBinding is the body of a request rebinding a cluster.
+type ClusterBinding struct {
+	// Account is the account the cluster is bound to. If empty, the cluster is unbound and
+	// bound again to the next account uploading for it.
+	Account string `json:"account"`
+}
+
+// ClusterBindings serves the accounts clusters are bound to, and rebinds clusters.
+type ClusterBindings struct {
+	// Audit records every attempt to rebind, by default to the standard logger.
+	Audit audit.Logger
+
+	registry authorize.ClusterRegistry
+}
+
+// NewClusterBindings returns a handler for GET /admin/cluster-bindings listing the account of
+// every bound cluster, and PUT /admin/cluster-bindings/<cluster> binding the cluster to the
+// account of a JSON ClusterBinding, for example after a cluster was reinstalled with a new
+// account.
+func NewClusterBindings(registry authorize.ClusterRegistry) *ClusterBindings {
+	return &ClusterBindings{Audit: audit.NewStandardLogger(), registry: registry}
+}
+
+func (b *ClusterBindings) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	cluster := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, ClusterBindingsPath), "/")
+	switch {
+	case req.Method == "GET" && len(cluster) == 0:
+		b.list(w)
+	case req.Method == "PUT" && len(cluster) > 0:
+		b.rebind(w, req, cluster)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// rebind binds the cluster to another account. Only admins with the delete role may do so,
+// and every attempt is audited.
+func (b *ClusterBindings) rebind(w http.ResponseWriter, req *http.Request, cluster string) {
+	client, ok := authorize.FromContext(req.Context())
+	if !ok || client.Labels[DeleteRoleLabel] != DeleteRole {
+		audit.Log(b.Audit, req, actor(client, ok), audit.ActionClusterRebind, cluster, audit.OutcomeDenied)
+		http.Error(w, "Rebinding clusters requires the admin role", http.StatusForbidden)
+		return
+	}
+
+	var binding ClusterBinding
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1024*1024)).Decode(&binding); err != nil {
+		http.Error(w, fmt.Sprintf("The body must be a JSON cluster binding: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	target := fmt.Sprintf("%s account=%s", cluster, binding.Account)
+	if err := b.registry.Bind(cluster, binding.Account); err != nil {
+		log.Printf("error: unable to rebind cluster %s: %v", cluster, err)
+		audit.Log(b.Audit, req, client.ID, audit.ActionClusterRebind, target, audit.OutcomeFailed)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit.Log(b.Audit, req, client.ID, audit.ActionClusterRebind, target, "rebound")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *ClusterBindings) list(w http.ResponseWriter) {
+	data, err := json.MarshalIndent(b.registry.Bindings(), "", "  ")
+	if err != nil {
+		log.Printf("marshaling cluster bindings failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		log.Printf("writing cluster bindings failed: %v", err)
+	}
+}
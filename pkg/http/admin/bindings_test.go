@@ -0,0 +1,88 @@
+package admin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func TestClusterBindings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-bindings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	registry, err := authorize.NewFileRegistry(filepath.Join(dir, "bindings.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := authorize.NewClusterBindingHandler(registry, "_id", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	h := NewClusterBindings(registry)
+
+	uploads := func(account, cluster string, want int) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/upload", nil)
+		req = req.WithContext(authorize.WithClient(req.Context(), &authorize.Client{ID: account, Labels: map[string]string{"_id": cluster}}))
+		w := httptest.NewRecorder()
+		upload.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("account %s: want status %d, got %d", account, want, w.Code)
+		}
+	}
+	rebind := func(client *authorize.Client, cluster, body string, want int) {
+		t.Helper()
+		req := httptest.NewRequest("PUT", ClusterBindingsPath+"/"+cluster, strings.NewReader(body))
+		if client != nil {
+			req = req.WithContext(authorize.WithClient(req.Context(), client))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("want status %d, got %d: %s", want, w.Code, w.Body.String())
+		}
+	}
+	admin := &authorize.Client{ID: "alice", Labels: map[string]string{DeleteRoleLabel: DeleteRole}}
+
+	// a reinstalled cluster uploads with a new account
+	uploads("old", "cluster-1", http.StatusOK)
+	uploads("new", "cluster-1", http.StatusConflict)
+	rebind(nil, "cluster-1", `{"account":"new"}`, http.StatusForbidden)
+	rebind(&authorize.Client{ID: "bob"}, "cluster-1", `{"account":"new"}`, http.StatusForbidden)
+	rebind(admin, "cluster-1", `new`, http.StatusBadRequest)
+	uploads("new", "cluster-1", http.StatusConflict)
+
+	rebind(admin, "cluster-1", `{"account":"new"}`, http.StatusNoContent)
+	uploads("new", "cluster-1", http.StatusOK)
+	uploads("old", "cluster-1", http.StatusConflict)
+
+	// unbinding lets the next account upload
+	uploads("other", "cluster-2", http.StatusOK)
+	rebind(admin, "cluster-2", `{}`, http.StatusNoContent)
+	uploads("new", "cluster-2", http.StatusOK)
+
+	// the bindings survive a restart
+	registry, err = authorize.NewFileRegistry(filepath.Join(dir, "bindings.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = NewClusterBindings(registry)
+	want := map[string]string{"cluster-1": "new", "cluster-2": "new"}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", ClusterBindingsPath, nil))
+	var got map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want bindings %v, got %v", want, got)
+	}
+}
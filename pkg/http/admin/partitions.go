@@ -0,0 +1,177 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/audit"
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/store"
+)
+
+const (
+	// PartitionsPath is the path the Partitions handler must be mounted at. Individual
+	// partitions are addressed below it.
+	PartitionsPath = "/admin/partitions"
+
+	// DeleteRoleLabel is the admin client label, and DeleteRole its value, required to delete partitions.
+	DeleteRoleLabel = "role"
+	DeleteRole      = "admin"
+
+	// defaultLimit is the number of partitions returned when no limit is requested.
+	defaultLimit = 100
+)
+
+// Partitions serves the partitions known to a store and how recently they were written,
+// and deletes partitions from the store chain.
+type Partitions struct {
+	// Audit records every attempt to delete a partition, by default to the standard logger.
+	Audit audit.Logger
+
+	lister store.PartitionLister
+	store  store.Store
+	nowFn  func() time.Time
+}
+
+// NewPartitions returns a handler for GET /admin/partitions listing the partitions of lister,
+// and DELETE /admin/partitions/{key} deleting a partition from s.
+func NewPartitions(lister store.PartitionLister, s store.Store) *Partitions {
+	return &Partitions{
+		Audit:  audit.NewStandardLogger(),
+		lister: lister,
+		store:  s,
+		nowFn:  time.Now,
+	}
+}
+
+// PartitionList is the response of a partition listing.
+type PartitionList struct {
+	// Total is the number of partitions matching the request before paging.
+	Total      int                    `json:"total"`
+	Partitions []store.PartitionStats `json:"partitions"`
+}
+
+func (p *Partitions) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, PartitionsPath), "/")
+	switch {
+	case len(key) == 0 && req.Method == "GET":
+		p.list(w, req)
+	case len(key) > 0 && req.Method == "DELETE":
+		p.delete(w, req, key)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// delete removes the partition from the store chain. Only admins with the delete role may do so,
+// and every attempt is audited.
+func (p *Partitions) delete(w http.ResponseWriter, req *http.Request, key string) {
+	client, ok := authorize.FromContext(req.Context())
+	if !ok || client.Labels[DeleteRoleLabel] != DeleteRole {
+		audit.Log(p.Audit, req, actor(client, ok), audit.ActionDeletePartition, key, audit.OutcomeDenied)
+		http.Error(w, "Deleting partitions requires the admin role", http.StatusForbidden)
+		return
+	}
+
+	err := store.DeleteMetrics(req.Context(), p.store, key)
+	switch err {
+	case nil:
+		audit.Log(p.Audit, req, client.ID, audit.ActionDeletePartition, key, "deleted")
+		w.WriteHeader(http.StatusNoContent)
+	case store.ErrDeletePending:
+		audit.Log(p.Audit, req, client.ID, audit.ActionDeletePartition, key, "accepted")
+		w.WriteHeader(http.StatusAccepted)
+	case store.ErrPartitionNotFound:
+		audit.Log(p.Audit, req, client.ID, audit.ActionDeletePartition, key, "not_found")
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		log.Printf("error: unable to delete partition %q: %v", key, err)
+		audit.Log(p.Audit, req, client.ID, audit.ActionDeletePartition, key, audit.OutcomeFailed)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// actor returns the ID of the client of an admin request, if it has one.
+func actor(client *authorize.Client, ok bool) string {
+	if !ok {
+		return audit.Anonymous
+	}
+	return client.ID
+}
+
+// list writes partitions ordered by key. The "stale_for" parameter restricts the result to
+// partitions that were not written within the given duration, and "limit" and "offset" page it.
+func (p *Partitions) list(w http.ResponseWriter, req *http.Request) {
+
+	q := req.URL.Query()
+	var staleFor time.Duration
+	if v := q.Get("stale_for"); len(v) > 0 {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, fmt.Sprintf("The 'stale_for' parameter must be a positive duration: %s", v), http.StatusBadRequest)
+			return
+		}
+		staleFor = d
+	}
+	limit, err := intParam(q.Get("limit"), defaultLimit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("The 'limit' parameter %v", err), http.StatusBadRequest)
+		return
+	}
+	offset, err := intParam(q.Get("offset"), 0)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("The 'offset' parameter %v", err), http.StatusBadRequest)
+		return
+	}
+
+	partitions := p.lister.Partitions()
+	if staleFor > 0 {
+		cutoff := p.nowFn().Add(-staleFor)
+		stale := partitions[:0]
+		for _, partition := range partitions {
+			if partition.LastWrite.Before(cutoff) {
+				stale = append(stale, partition)
+			}
+		}
+		partitions = stale
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].PartitionKey < partitions[j].PartitionKey })
+
+	list := PartitionList{Total: len(partitions), Partitions: []store.PartitionStats{}}
+	if offset < len(partitions) {
+		partitions = partitions[offset:]
+		if limit < len(partitions) {
+			partitions = partitions[:limit]
+		}
+		list.Partitions = partitions
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		log.Printf("marshaling partitions failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		log.Printf("writing partitions failed: %v", err)
+	}
+}
+
+// intParam parses a non-negative integer query parameter, returning def if it is unset.
+func intParam(v string, def int) (int, error) {
+	if len(v) == 0 {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("must be a non-negative integer: %s", v)
+	}
+	return i, nil
+}
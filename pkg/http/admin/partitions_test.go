@@ -0,0 +1,186 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/audit"
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/store"
+	"github.com/openshift/telemeter/pkg/store/forward"
+	"github.com/openshift/telemeter/pkg/store/memstore"
+	"github.com/openshift/telemeter/pkg/store/ratelimited"
+)
+
+type fakeLister []store.PartitionStats
+
+func (l fakeLister) Partitions() []store.PartitionStats {
+	// return a copy as the handler filters in place
+	return append([]store.PartitionStats(nil), l...)
+}
+
+func TestPartitions(t *testing.T) {
+	now := time.Unix(10000, 0)
+	lister := fakeLister{
+		{PartitionKey: "c", LastWrite: now.Add(-2 * time.Hour), Families: 1, Series: 1},
+		{PartitionKey: "a", LastWrite: now.Add(-time.Minute), Families: 2, Series: 4},
+		{PartitionKey: "d", LastWrite: now.Add(-45 * time.Minute), Families: 3, Series: 9},
+		{PartitionKey: "b", LastWrite: now.Add(-10 * time.Minute), Families: 4, Series: 16},
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		want     []string
+		total    int
+	}{
+		{name: "all", want: []string{"a", "b", "c", "d"}, total: 4},
+		{name: "stale", query: "?stale_for=30m", want: []string{"c", "d"}, total: 2},
+		{name: "stale longer", query: "?stale_for=1h", want: []string{"c"}, total: 1},
+		{name: "limit", query: "?limit=2", want: []string{"a", "b"}, total: 4},
+		{name: "offset", query: "?limit=2&offset=2", want: []string{"c", "d"}, total: 4},
+		{name: "offset past end", query: "?offset=10", want: []string{}, total: 4},
+		{name: "stale paged", query: "?stale_for=5m&limit=1&offset=1", want: []string{"c"}, total: 3},
+		{name: "invalid stale", query: "?stale_for=soon", wantCode: http.StatusBadRequest},
+		{name: "invalid limit", query: "?limit=-1", wantCode: http.StatusBadRequest},
+		{name: "invalid offset", query: "?offset=x", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPartitions(lister, nil)
+			p.nowFn = func() time.Time { return now }
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest("GET", "/admin/partitions"+tt.query, nil))
+
+			if tt.wantCode == 0 {
+				tt.wantCode = http.StatusOK
+			}
+			if w.Code != tt.wantCode {
+				t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var list PartitionList
+			if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, p := range list.Partitions {
+				got = append(got, p.PartitionKey)
+			}
+			if !reflect.DeepEqual(got, tt.want) || list.Total != tt.total {
+				t.Fatalf("want partitions %v of %d, got %v of %d", tt.want, tt.total, got, list.Total)
+			}
+		})
+	}
+}
+
+func TestPartitionsDelete(t *testing.T) {
+	admin := &authorize.Client{ID: "alice", Labels: map[string]string{DeleteRoleLabel: DeleteRole}}
+	reader := &authorize.Client{ID: "bob", Labels: map[string]string{}}
+	u, err := url.Parse("http://localhost:9090/api/v1/receive")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		client    *authorize.Client
+		forward   bool
+		partition string
+		wantCode  int
+		wantKeys  []string
+		wantAudit audit.Entry
+	}{
+		{
+			name: "delete", client: admin, partition: "cluster-1", wantCode: http.StatusNoContent, wantKeys: []string{"cluster-2"},
+			wantAudit: audit.Entry{Actor: "alice", Action: audit.ActionDeletePartition, Target: "cluster-1", Outcome: "deleted", RequestID: "req-1"},
+		},
+		{
+			name: "unknown", client: admin, partition: "cluster-3", wantCode: http.StatusNotFound, wantKeys: []string{"cluster-1", "cluster-2"},
+			wantAudit: audit.Entry{Actor: "alice", Action: audit.ActionDeletePartition, Target: "cluster-3", Outcome: "not_found", RequestID: "req-1"},
+		},
+		{
+			name: "forwarded", client: admin, forward: true, partition: "cluster-1", wantCode: http.StatusAccepted, wantKeys: []string{"cluster-2"},
+			wantAudit: audit.Entry{Actor: "alice", Action: audit.ActionDeletePartition, Target: "cluster-1", Outcome: "accepted", RequestID: "req-1"},
+		},
+		{
+			name: "without role", client: reader, partition: "cluster-1", wantCode: http.StatusForbidden, wantKeys: []string{"cluster-1", "cluster-2"},
+			wantAudit: audit.Entry{Actor: "bob", Action: audit.ActionDeletePartition, Target: "cluster-1", Outcome: audit.OutcomeDenied, RequestID: "req-1"},
+		},
+		{
+			name: "unauthenticated", partition: "cluster-1", wantCode: http.StatusForbidden, wantKeys: []string{"cluster-1", "cluster-2"},
+			wantAudit: audit.Entry{Actor: audit.Anonymous, Action: audit.ActionDeletePartition, Target: "cluster-1", Outcome: audit.OutcomeDenied, RequestID: "req-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := memstore.New(time.Hour)
+			for _, key := range []string{"cluster-1", "cluster-2"} {
+				name := "test"
+				ts := time.Now().UnixNano() / int64(time.Millisecond)
+				if err := ms.WriteMetrics(context.Background(), &store.PartitionedMetrics{
+					PartitionKey: key,
+					Families:     []*clientmodel.MetricFamily{{Name: &name, Metric: []*clientmodel.Metric{{TimestampMs: &ts}}}},
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var s store.Store = ratelimited.New(time.Minute, ms)
+			if tt.forward {
+				s = forward.New(u, ms)
+			}
+
+			req := httptest.NewRequest("DELETE", PartitionsPath+"/"+tt.partition, nil)
+			req.Header.Set("X-Request-Id", "req-1")
+			if tt.client != nil {
+				req = req.WithContext(authorize.WithClient(req.Context(), tt.client))
+			}
+			w := httptest.NewRecorder()
+			buf := &bytes.Buffer{}
+			p := NewPartitions(ms, s)
+			p.Audit = audit.NewLogger(buf)
+			p.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+			}
+
+			var entry audit.Entry
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatalf("expected a single audit entry, got %q: %v", buf.String(), err)
+			}
+			if entry.Time.IsZero() {
+				t.Fatal("expected the audit entry to be timestamped")
+			}
+			entry.Time = time.Time{}
+			if entry != tt.wantAudit {
+				t.Fatalf("want audit entry %+v, got %+v", tt.wantAudit, entry)
+			}
+
+			ps, err := ms.ReadMetrics(context.Background(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, p := range ps {
+				keys = append(keys, p.PartitionKey)
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Fatalf("want partitions %v, got %v", tt.wantKeys, keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package admin
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/openshift/telemeter/pkg/audit"
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/store/quota"
+)
+
+// QuotaPath is the path the Quota handler must be mounted at.
+const QuotaPath = "/admin/quota"
+
+// topConsumers is the number of clients listed by the Quota handler.
+const topConsumers = 20
+
+// Quota serves the clients consuming the most of their sample quota, and resets the usage
+// of clients.
+type Quota struct {
+	// Audit records every attempt to reset a quota, by default to the standard logger.
+	Audit audit.Logger
+
+	quota *quota.Store
+}
+
+// NewQuota returns a handler for GET /admin/quota listing the top consumers of the quota,
+// and DELETE /admin/quota?client=<id> resetting the usage of a client.
+func NewQuota(q *quota.Store) *Quota {
+	return &Quota{Audit: audit.NewStandardLogger(), quota: q}
+}
+
+func (q *Quota) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		q.list(w)
+	case "DELETE":
+		q.reset(w, req)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// reset forgets the usage of a client. Only admins with the delete role may do so, and every
+// attempt is audited.
+func (q *Quota) reset(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("client")
+	client, ok := authorize.FromContext(req.Context())
+	if !ok || client.Labels[DeleteRoleLabel] != DeleteRole {
+		audit.Log(q.Audit, req, actor(client, ok), audit.ActionResetQuota, id, audit.OutcomeDenied)
+		http.Error(w, "Resetting a quota requires the admin role", http.StatusForbidden)
+		return
+	}
+	if len(id) == 0 {
+		http.Error(w, "The 'client' parameter must be specified", http.StatusBadRequest)
+		return
+	}
+	q.quota.Reset(id)
+	audit.Log(q.Audit, req, client.ID, audit.ActionResetQuota, id, "reset")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (q *Quota) list(w http.ResponseWriter) {
+	data, err := json.MarshalIndent(struct {
+		Quota   int64         `json:"quota"`
+		Clients []quota.Usage `json:"clients"`
+	}{
+		Quota:   q.quota.Quota(),
+		Clients: q.quota.Top(topConsumers),
+	}, "", "  ")
+	if err != nil {
+		log.Printf("marshaling quota usage failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		log.Printf("writing quota usage failed: %v", err)
+	}
+}
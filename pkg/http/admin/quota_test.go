@@ -0,0 +1,83 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/audit"
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/store"
+	"github.com/openshift/telemeter/pkg/store/memstore"
+	"github.com/openshift/telemeter/pkg/store/quota"
+)
+
+func TestQuota(t *testing.T) {
+	q := quota.New(10, time.Hour, 10, memstore.New(time.Hour))
+	for key, n := range map[string]int{"a": 1, "b": 5} {
+		name := "test"
+		ts := time.Now().UnixNano() / int64(time.Millisecond)
+		family := &clientmodel.MetricFamily{Name: &name}
+		for i := 0; i < n; i++ {
+			family.Metric = append(family.Metric, &clientmodel.Metric{TimestampMs: &ts})
+		}
+		if err := q.WriteMetrics(context.Background(), &store.PartitionedMetrics{PartitionKey: key, Families: []*clientmodel.MetricFamily{family}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := &bytes.Buffer{}
+	h := NewQuota(q)
+	h.Audit = audit.NewLogger(buf)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", QuotaPath, nil))
+	if w.Code != http.StatusOK || strings.Index(w.Body.String(), `"b"`) > strings.Index(w.Body.String(), `"a"`) {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+
+	reset := func(client *authorize.Client, query string, want int, wantAudit *audit.Entry) {
+		t.Helper()
+		buf.Reset()
+		req := httptest.NewRequest("DELETE", QuotaPath+query, nil)
+		req.Header.Set("X-Request-Id", "req-1")
+		if client != nil {
+			req = req.WithContext(authorize.WithClient(req.Context(), client))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("want status %d, got %d: %s", want, w.Code, w.Body.String())
+		}
+		if wantAudit == nil {
+			return
+		}
+		var entry audit.Entry
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("expected a single audit entry, got %q: %v", buf.String(), err)
+		}
+		entry.Time = time.Time{}
+		if entry != *wantAudit {
+			t.Fatalf("want audit entry %+v, got %+v", *wantAudit, entry)
+		}
+	}
+	admin := &authorize.Client{ID: "alice", Labels: map[string]string{DeleteRoleLabel: DeleteRole}}
+
+	reset(nil, "?client=b", http.StatusForbidden, &audit.Entry{Actor: audit.Anonymous, Action: audit.ActionResetQuota, Target: "b", Outcome: audit.OutcomeDenied, RequestID: "req-1"})
+	reset(&authorize.Client{ID: "bob"}, "?client=b", http.StatusForbidden, &audit.Entry{Actor: "bob", Action: audit.ActionResetQuota, Target: "b", Outcome: audit.OutcomeDenied, RequestID: "req-1"})
+	reset(admin, "", http.StatusBadRequest, nil)
+	if top := q.Top(10); len(top) != 2 {
+		t.Fatalf("expected no usage to be reset, got %#v", top)
+	}
+
+	reset(admin, "?client=b", http.StatusNoContent, &audit.Entry{Actor: "alice", Action: audit.ActionResetQuota, Target: "b", Outcome: "reset", RequestID: "req-1"})
+	if top := q.Top(10); len(top) != 1 || top[0].Client != "a" {
+		t.Fatalf("unexpected usage after reset %#v", top)
+	}
+}
@@ -0,0 +1,84 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/openshift/telemeter/pkg/audit"
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+// RevocationsPath is the path the Revocations handler must be mounted at.
+const RevocationsPath = "/admin/revocations"
+
+// Revocations serves the revoked tokens and clusters, and revokes further ones.
+type Revocations struct {
+	// Audit records every attempt to revoke, by default to the standard logger.
+	Audit audit.Logger
+
+	revocations *authorize.Revocations
+}
+
+// NewRevocations returns a handler for GET /admin/revocations listing the revocations, and
+// POST /admin/revocations revoking the tokens and clusters of a JSON authorize.RevocationList.
+func NewRevocations(revocations *authorize.Revocations) *Revocations {
+	return &Revocations{Audit: audit.NewStandardLogger(), revocations: revocations}
+}
+
+func (r *Revocations) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		r.list(w)
+	case "POST":
+		r.revoke(w, req)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// revoke adds to the revocations. Only admins with the delete role may do so, and every
+// attempt is audited.
+func (r *Revocations) revoke(w http.ResponseWriter, req *http.Request) {
+	client, ok := authorize.FromContext(req.Context())
+	if !ok || client.Labels[DeleteRoleLabel] != DeleteRole {
+		audit.Log(r.Audit, req, actor(client, ok), audit.ActionRevoke, "", audit.OutcomeDenied)
+		http.Error(w, "Revoking requires the admin role", http.StatusForbidden)
+		return
+	}
+
+	var list authorize.RevocationList
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1024*1024)).Decode(&list); err != nil {
+		http.Error(w, fmt.Sprintf("The body must be a JSON revocation list: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(list.Tokens) == 0 && len(list.Clusters) == 0 {
+		http.Error(w, "At least one token or cluster must be revoked", http.StatusBadRequest)
+		return
+	}
+
+	target := fmt.Sprintf("tokens=%s clusters=%s", strings.Join(list.Tokens, ","), strings.Join(list.Clusters, ","))
+	if err := r.revocations.Revoke(list); err != nil {
+		log.Printf("error: unable to revoke: %v", err)
+		audit.Log(r.Audit, req, client.ID, audit.ActionRevoke, target, audit.OutcomeFailed)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit.Log(r.Audit, req, client.ID, audit.ActionRevoke, target, "revoked")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *Revocations) list(w http.ResponseWriter) {
+	data, err := json.MarshalIndent(r.revocations.List(), "", "  ")
+	if err != nil {
+		log.Printf("marshaling revocations failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		log.Printf("writing revocations failed: %v", err)
+	}
+}
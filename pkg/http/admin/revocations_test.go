@@ -0,0 +1,105 @@
+package admin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func TestRevocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-revocations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "revocations.json")
+
+	revocations, err := authorize.NewRevocations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := authorize.NewStaticAuthorizer(map[string]*authorize.Client{
+		"token-1": {ID: "account", Labels: map[string]string{"_id": "cluster-1"}, TokenID: "jti-1"},
+		"token-2": {ID: "account", Labels: map[string]string{"_id": "cluster-1"}, TokenID: "jti-2"},
+		"token-3": {ID: "account", Labels: map[string]string{"_id": "cluster-2"}, TokenID: "jti-3"},
+	})
+	upload := authorize.Middleware(authorize.TokenAuthorizer(
+		authorize.NewRevokingClientAuthorizer(revocations, "_id", tokens),
+	))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	h := NewRevocations(revocations)
+
+	uploads := func(token string, want int) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/upload", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		upload.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("token %s: want status %d, got %d", token, want, w.Code)
+		}
+		if want == http.StatusUnauthorized && !strings.Contains(w.Header().Get("WWW-Authenticate"), "revoked") {
+			t.Fatalf("token %s: expected the response to report the revocation, got %q", token, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+	revoke := func(client *authorize.Client, body string, want int) {
+		t.Helper()
+		req := httptest.NewRequest("POST", RevocationsPath, strings.NewReader(body))
+		if client != nil {
+			req = req.WithContext(authorize.WithClient(req.Context(), client))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("want status %d, got %d: %s", want, w.Code, w.Body.String())
+		}
+	}
+	admin := &authorize.Client{ID: "alice", Labels: map[string]string{DeleteRoleLabel: DeleteRole}}
+
+	uploads("token-1", http.StatusOK)
+	uploads("token-2", http.StatusOK)
+	uploads("token-3", http.StatusOK)
+
+	revoke(nil, `{"tokens":["jti-1"]}`, http.StatusForbidden)
+	revoke(&authorize.Client{ID: "bob"}, `{"tokens":["jti-1"]}`, http.StatusForbidden)
+	revoke(admin, `{}`, http.StatusBadRequest)
+	revoke(admin, `tokens`, http.StatusBadRequest)
+	uploads("token-1", http.StatusOK)
+
+	// the very next upload with a revoked token is rejected
+	revoke(admin, `{"tokens":["jti-1"]}`, http.StatusNoContent)
+	uploads("token-1", http.StatusUnauthorized)
+	uploads("token-2", http.StatusOK)
+
+	// revoking a cluster rejects all of its tokens
+	revoke(admin, `{"clusters":["cluster-1"]}`, http.StatusNoContent)
+	uploads("token-2", http.StatusUnauthorized)
+	uploads("token-3", http.StatusOK)
+
+	want := authorize.RevocationList{Tokens: []string{"jti-1"}, Clusters: []string{"cluster-1"}}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", RevocationsPath, nil))
+	var got authorize.RevocationList
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want revocations %v, got %v", want, got)
+	}
+
+	// revocations survive a restart
+	restarted, err := authorize.NewRevocations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.List(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want persisted revocations %v, got %v", want, got)
+	}
+}
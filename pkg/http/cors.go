@@ -0,0 +1,88 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSOptions configures the cross-origin requests accepted by NewCORSHandler.
+type CORSOptions struct {
+	// AllowedOrigins lists the origins allowed to make requests, or "*" for any origin.
+	AllowedOrigins []string
+	// AllowedMethods and AllowedHeaders are the methods and request headers
+	// a preflight request may ask for.
+	AllowedMethods []string
+	AllowedHeaders []string
+	// MaxAge is how long browsers may cache the result of a preflight request.
+	MaxAge time.Duration
+}
+
+type corsHandler struct {
+	opts    CORSOptions
+	origins map[string]struct{}
+	methods map[string]struct{}
+	any     bool
+	next    http.Handler
+}
+
+// NewCORSHandler returns a handler allowing cross-origin requests to next from the configured
+// origins. Preflight requests are answered without calling next, so they succeed without
+// credentials even when next requires authorization.
+func NewCORSHandler(opts CORSOptions, next http.Handler) http.Handler {
+	h := &corsHandler{
+		opts:    opts,
+		origins: make(map[string]struct{}),
+		methods: make(map[string]struct{}),
+		next:    next,
+	}
+	for _, origin := range opts.AllowedOrigins {
+		if origin == "*" {
+			h.any = true
+		}
+		h.origins[origin] = struct{}{}
+	}
+	for _, method := range opts.AllowedMethods {
+		h.methods[strings.ToUpper(method)] = struct{}{}
+	}
+	return h
+}
+
+func (h *corsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	origin := req.Header.Get("Origin")
+	if len(origin) == 0 {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+
+	preflight := req.Method == "OPTIONS" && len(req.Header.Get("Access-Control-Request-Method")) > 0
+	if _, ok := h.origins[origin]; !ok && !h.any {
+		if preflight {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// the browser withholds the response from the caller without the allow header
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+
+	if !preflight {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	if _, ok := h.methods[strings.ToUpper(req.Header.Get("Access-Control-Request-Method"))]; !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(h.opts.AllowedMethods, ", "))
+	if len(h.opts.AllowedHeaders) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(h.opts.AllowedHeaders, ", "))
+	}
+	if h.opts.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(h.opts.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,128 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORSHandler(t *testing.T) {
+	opts := CORSOptions{
+		AllowedOrigins: []string{"https://ui.example.com"},
+		AllowedMethods: []string{"GET", "DELETE"},
+		AllowedHeaders: []string{"Authorization"},
+		MaxAge:         10 * time.Minute,
+	}
+	// the wrapped handler stands in for one requiring authorization
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(req.Header.Get("Authorization")) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name        string
+		opts        CORSOptions
+		method      string
+		headers     map[string]string
+		wantCode    int
+		wantHeaders map[string]string
+	}{
+		{
+			name:        "same origin",
+			method:      "GET",
+			headers:     map[string]string{"Authorization": "Bearer a"},
+			wantCode:    http.StatusOK,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "", "Vary": ""},
+		},
+		{
+			name:     "preflight",
+			method:   "OPTIONS",
+			headers:  map[string]string{"Origin": "https://ui.example.com", "Access-Control-Request-Method": "DELETE", "Access-Control-Request-Headers": "authorization"},
+			wantCode: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":  "https://ui.example.com",
+				"Access-Control-Allow-Methods": "GET, DELETE",
+				"Access-Control-Allow-Headers": "Authorization",
+				"Access-Control-Max-Age":       "600",
+				"Vary":                         "Origin",
+			},
+		},
+		{
+			name:        "preflight of disallowed method",
+			method:      "OPTIONS",
+			headers:     map[string]string{"Origin": "https://ui.example.com", "Access-Control-Request-Method": "POST"},
+			wantCode:    http.StatusForbidden,
+			wantHeaders: map[string]string{"Access-Control-Allow-Methods": ""},
+		},
+		{
+			name:        "preflight from disallowed origin",
+			method:      "OPTIONS",
+			headers:     map[string]string{"Origin": "https://evil.example.com", "Access-Control-Request-Method": "GET"},
+			wantCode:    http.StatusForbidden,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Methods": ""},
+		},
+		{
+			name:        "request from allowed origin",
+			method:      "GET",
+			headers:     map[string]string{"Origin": "https://ui.example.com", "Authorization": "Bearer a"},
+			wantCode:    http.StatusOK,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "https://ui.example.com", "Access-Control-Allow-Methods": "", "Vary": "Origin"},
+		},
+		{
+			name:        "request from allowed origin is still authorized",
+			method:      "GET",
+			headers:     map[string]string{"Origin": "https://ui.example.com"},
+			wantCode:    http.StatusUnauthorized,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "https://ui.example.com"},
+		},
+		{
+			name:        "request from disallowed origin",
+			method:      "GET",
+			headers:     map[string]string{"Origin": "https://evil.example.com", "Authorization": "Bearer a"},
+			wantCode:    http.StatusOK,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "", "Vary": "Origin"},
+		},
+		{
+			name:        "any origin",
+			opts:        CORSOptions{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}},
+			method:      "OPTIONS",
+			headers:     map[string]string{"Origin": "https://other.example.com", "Access-Control-Request-Method": "GET"},
+			wantCode:    http.StatusNoContent,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "https://other.example.com", "Access-Control-Allow-Headers": "", "Access-Control-Max-Age": ""},
+		},
+		{
+			name:        "options without preflight is passed on",
+			method:      "OPTIONS",
+			headers:     map[string]string{"Origin": "https://ui.example.com"},
+			wantCode:    http.StatusUnauthorized,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "https://ui.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := opts
+			if tt.opts.AllowedOrigins != nil {
+				o = tt.opts
+			}
+			req := httptest.NewRequest(tt.method, "/federate", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			NewCORSHandler(o, next).ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("want code %d, got %d", tt.wantCode, w.Code)
+			}
+			for k, v := range tt.wantHeaders {
+				if got := w.Header().Get(k); got != v {
+					t.Errorf("want header %s %q, got %q", k, v, got)
+				}
+			}
+		})
+	}
+}
@@ -48,3 +48,20 @@ func NewInstrumentedHandler(handlerName string, next http.Handler) http.Handler
 		),
 	)
 }
+
+// StatusWriter records the status code of the response written through it.
+type StatusWriter struct {
+	http.ResponseWriter
+	Code int
+}
+
+// NewStatusWriter returns a StatusWriter of w, recording a status of 200 unless another
+// one is written.
+func NewStatusWriter(w http.ResponseWriter) *StatusWriter {
+	return &StatusWriter{ResponseWriter: w, Code: http.StatusOK}
+}
+
+func (w *StatusWriter) WriteHeader(code int) {
+	w.Code = code
+	w.ResponseWriter.WriteHeader(code)
+}
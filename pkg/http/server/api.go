@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// LabelValuesPrefix is the path prefix LabelValues is served under, as /api/v1/label/{name}/values.
+const LabelValuesPrefix = "/api/v1/label/"
+
+// apiResponse is the envelope of the Prometheus HTTP API.
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// LabelValues lists the values of a label across all stored series, sorted. The partition
+// key is included under PartitionLabel.
+func (s *Server) LabelValues(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeErrorWithStatus(w, req, http.StatusMethodNotAllowed, newError(CodeMethodNotAllowed, "only GET is allowed to this endpoint"))
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, LabelValuesPrefix)
+	if !strings.HasSuffix(name, "/values") {
+		http.NotFound(w, req)
+		return
+	}
+	name = strings.TrimSuffix(name, "/values")
+	if !model.LabelName(name).IsValid() {
+		writeErrorWithStatus(w, req, http.StatusBadRequest, newError(CodeInvalidParameter, "invalid label name %q", name))
+		return
+	}
+
+	ps, err := s.readPartitions(req.Context(), 0)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	seen := make(map[string]struct{})
+	for _, p := range ps {
+		for _, family := range p.Families {
+			if family == nil {
+				continue
+			}
+			for _, m := range family.Metric {
+				if m == nil {
+					continue
+				}
+				if v := s.seriesLabels(p.PartitionKey, family, m).Get(name); len(v) > 0 {
+					seen[v] = struct{}{}
+				}
+			}
+		}
+	}
+
+	values := make([]string, 0, len(seen))
+	for v := range seen {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	resp := apiResponse{Status: "success"}
+	if s.MaxLabelValues > 0 && len(values) > s.MaxLabelValues {
+		values, resp.Truncated = values[:s.MaxLabelValues], true
+	}
+	resp.Data = values
+	writeAPIResponse(w, resp)
+}
+
+// Series lists the label sets of the stored series matching any of the "match[]" selectors.
+// The partition key is included under PartitionLabel and may be matched on.
+func (s *Server) Series(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeErrorWithStatus(w, req, http.StatusMethodNotAllowed, newError(CodeMethodNotAllowed, "only GET is allowed to this endpoint"))
+		return
+	}
+	selectors := req.URL.Query()["match[]"]
+	if len(selectors) == 0 {
+		writeErrorWithStatus(w, req, http.StatusBadRequest, newError(CodeInvalidParameter, "at least one 'match[]' parameter is required"))
+		return
+	}
+	matcherSets := make([][]*labels.Matcher, 0, len(selectors))
+	for _, selector := range selectors {
+		matchers, err := promql.ParseMetricSelector(selector)
+		if err != nil {
+			writeErrorWithStatus(w, req, http.StatusBadRequest, newError(CodeInvalidParameter, "invalid 'match[]' parameter %q: %v", selector, err))
+			return
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+
+	ps, err := s.readPartitions(req.Context(), 0)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	seen := make(map[string]labels.Labels)
+	for _, p := range ps {
+		for _, family := range p.Families {
+			if family == nil {
+				continue
+			}
+			for _, m := range family.Metric {
+				if m == nil {
+					continue
+				}
+				ls := s.seriesLabels(p.PartitionKey, family, m)
+				for _, matchers := range matcherSets {
+					if matchLabels(ls, matchers) {
+						seen[ls.String()] = ls
+						break
+					}
+				}
+			}
+		}
+	}
+
+	series := make([]labels.Labels, 0, len(seen))
+	for _, ls := range seen {
+		series = append(series, ls)
+	}
+	sort.Slice(series, func(i, j int) bool { return labels.Compare(series[i], series[j]) < 0 })
+	resp := apiResponse{Status: "success"}
+	if s.MaxSeries > 0 && len(series) > s.MaxSeries {
+		series, resp.Truncated = series[:s.MaxSeries], true
+	}
+	resp.Data = series
+	writeAPIResponse(w, resp)
+}
+
+func writeAPIResponse(w http.ResponseWriter, resp apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("error writing API response: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func apiTestServer() *Server {
+	s := New(storeWithData(map[string][]*clientmodel.MetricFamily{
+		"cluster-1": {
+			labeledFamily("up", map[string]string{"job": "api"}, 1000),
+			labeledFamily("cpu", map[string]string{"job": "node"}, 1000),
+		},
+		"cluster-2": {
+			labeledFamily("up", map[string]string{"job": "etcd"}, 1000),
+			labeledFamily("memory", map[string]string{"_id": "override"}, 1000),
+		},
+	}), nil, nil, 10*time.Minute)
+	s.PartitionLabel = "_id"
+	return s
+}
+
+type testAPIResponse struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data"`
+	Truncated bool            `json:"truncated"`
+}
+
+func TestServer_LabelValues(t *testing.T) {
+	tests := []struct {
+		name          string
+		path          string
+		limit         int
+		wantStatus    int
+		wantValues    []string
+		wantTruncated bool
+	}{
+		{name: "label", path: "/api/v1/label/job/values", wantStatus: http.StatusOK, wantValues: []string{"api", "etcd", "node"}},
+		{name: "metric name", path: "/api/v1/label/__name__/values", wantStatus: http.StatusOK, wantValues: []string{"cpu", "memory", "up"}},
+		{name: "partition label", path: "/api/v1/label/_id/values", wantStatus: http.StatusOK, wantValues: []string{"cluster-1", "cluster-2", "override"}},
+		{name: "missing label", path: "/api/v1/label/missing/values", wantStatus: http.StatusOK, wantValues: []string{}},
+		{name: "truncated", path: "/api/v1/label/job/values", limit: 2, wantStatus: http.StatusOK, wantValues: []string{"api", "etcd"}, wantTruncated: true},
+		{name: "at limit", path: "/api/v1/label/job/values", limit: 3, wantStatus: http.StatusOK, wantValues: []string{"api", "etcd", "node"}},
+		{name: "invalid label", path: "/api/v1/label/a-b/values", wantStatus: http.StatusBadRequest},
+		{name: "unknown path", path: "/api/v1/label/job", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := apiTestServer()
+			s.MaxLabelValues = tt.limit
+			w := httptest.NewRecorder()
+			s.LabelValues(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var resp testAPIResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var values []string
+			if err := json.Unmarshal(resp.Data, &values); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != "success" || resp.Truncated != tt.wantTruncated {
+				t.Errorf("unexpected status %q or truncated %t", resp.Status, resp.Truncated)
+			}
+			if !reflect.DeepEqual(values, tt.wantValues) {
+				t.Errorf("LabelValues() = %v, want %v", values, tt.wantValues)
+			}
+		})
+	}
+}
+
+func TestServer_Series(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		limit         int
+		wantStatus    int
+		wantSeries    []map[string]string
+		wantTruncated bool
+	}{
+		{
+			name:       "metric name",
+			query:      "match[]=up",
+			wantStatus: http.StatusOK,
+			wantSeries: []map[string]string{
+				{"__name__": "up", "_id": "cluster-1", "job": "api"},
+				{"__name__": "up", "_id": "cluster-2", "job": "etcd"},
+			},
+		},
+		{
+			name:       "partition label",
+			query:      `match[]={_id="cluster-1"}`,
+			wantStatus: http.StatusOK,
+			wantSeries: []map[string]string{
+				{"__name__": "cpu", "_id": "cluster-1", "job": "node"},
+				{"__name__": "up", "_id": "cluster-1", "job": "api"},
+			},
+		},
+		{
+			name:       "regex and multiple selectors",
+			query:      `match[]=up{job=~"e.*"}&match[]=memory`,
+			wantStatus: http.StatusOK,
+			wantSeries: []map[string]string{
+				{"__name__": "memory", "_id": "override"},
+				{"__name__": "up", "_id": "cluster-2", "job": "etcd"},
+			},
+		},
+		{
+			name:       "overlapping selectors",
+			query:      `match[]=up&match[]={job="api"}`,
+			wantStatus: http.StatusOK,
+			wantSeries: []map[string]string{
+				{"__name__": "up", "_id": "cluster-1", "job": "api"},
+				{"__name__": "up", "_id": "cluster-2", "job": "etcd"},
+			},
+		},
+		{
+			name:          "truncated",
+			query:         `match[]={job!=""}`,
+			limit:         1,
+			wantStatus:    http.StatusOK,
+			wantSeries:    []map[string]string{{"__name__": "cpu", "_id": "cluster-1", "job": "node"}},
+			wantTruncated: true,
+		},
+		{name: "no match", query: "match[]=missing", wantStatus: http.StatusOK, wantSeries: []map[string]string{}},
+		{name: "missing selector", query: "", wantStatus: http.StatusBadRequest},
+		{name: "invalid selector", query: "match[]=up{", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := apiTestServer()
+			s.MaxSeries = tt.limit
+			w := httptest.NewRecorder()
+			s.Series(w, httptest.NewRequest("GET", "/api/v1/series?"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var resp testAPIResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var series []map[string]string
+			if err := json.Unmarshal(resp.Data, &series); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != "success" || resp.Truncated != tt.wantTruncated {
+				t.Errorf("unexpected status %q or truncated %t", resp.Status, resp.Truncated)
+			}
+			if !reflect.DeepEqual(series, tt.wantSeries) {
+				t.Errorf("Series() = %v, want %v", series, tt.wantSeries)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ChecksumHeader carries the hex encoded SHA-256 digest of an upload body as sent on the wire.
+// The RFC 3230 Digest header with a SHA-256 value is accepted as well.
+const ChecksumHeader = "X-Content-SHA256"
+
+// ErrChecksumMismatch is returned when the body of an upload does not match its declared digest.
+type ErrChecksumMismatch struct {
+	Expected string
+	Actual   string
+}
+
+func (e *ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("the SHA-256 digest of the body is %s, expected %s", e.Actual, e.Expected)
+}
+
+// uploadChecksum returns the SHA-256 digest declared by the headers of an upload,
+// or nil if there is none.
+func uploadChecksum(h http.Header) ([]byte, *Error) {
+	if v := h.Get(ChecksumHeader); len(v) > 0 {
+		sum, err := hex.DecodeString(v)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, newError(CodeInvalidChecksum, "the %s header must be a hex encoded SHA-256 digest", ChecksumHeader)
+		}
+		return sum, nil
+	}
+
+	for _, digest := range strings.Split(h.Get("Digest"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(digest), "=", 2)
+		if len(kv) != 2 || !strings.EqualFold(kv[0], "SHA-256") {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil || len(sum) != sha256.Size {
+			return nil, newError(CodeInvalidChecksum, "the SHA-256 value of the Digest header must be a base64 encoded digest")
+		}
+		return sum, nil
+	}
+	return nil, nil
+}
+
+// checksumReader hashes everything read from r, and fails with ErrChecksumMismatch
+// instead of returning io.EOF if the digest is not the expected one. This ensures
+// a corrupted upload is rejected before the decoder reports it was read in full.
+type checksumReader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected []byte
+}
+
+func newChecksumReader(r io.Reader, expected []byte) *checksumReader {
+	return &checksumReader{r: r, h: sha256.New(), expected: expected}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	if err == io.EOF {
+		if actual := c.h.Sum(nil); !bytes.Equal(actual, c.expected) {
+			return n, &ErrChecksumMismatch{Expected: hex.EncodeToString(c.expected), Actual: hex.EncodeToString(actual)}
+		}
+	}
+	return n, err
+}
+
+// verify reads the remainder of the body and returns ErrChecksumMismatch if the digest does
+// not match. It is used to tell corruption apart from invalid content when decoding fails.
+func (c *checksumReader) verify() error {
+	_, err := io.Copy(ioutil.Discard, c)
+	if _, ok := err.(*ErrChecksumMismatch); ok {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/store/memstore"
+)
+
+func TestServer_PostChecksum(t *testing.T) {
+	data := encodeFamilies([]*clientmodel.MetricFamily{family("test_1", 1000000, 1002000)})
+	compressed := snappy.Encode(nil, data)
+	sum := func(b []byte) []byte {
+		s := sha256.Sum256(b)
+		return s[:]
+	}
+	corrupt := func(b []byte) []byte {
+		c := append([]byte(nil), b...)
+		c[len(c)-1] ^= 0xff
+		return c
+	}
+
+	tests := []struct {
+		name      string
+		body      []byte
+		encoding  string
+		headers   map[string]string
+		wantCode  int
+		wantError string
+	}{
+		{name: "no checksum", body: data, wantCode: http.StatusOK},
+		{name: "checksum", body: data, headers: map[string]string{ChecksumHeader: hex.EncodeToString(sum(data))}, wantCode: http.StatusOK},
+		{name: "digest", body: data, headers: map[string]string{"Digest": "MD5=abc, SHA-256=" + base64.StdEncoding.EncodeToString(sum(data))}, wantCode: http.StatusOK},
+		{name: "compressed checksum", body: compressed, encoding: "snappy", headers: map[string]string{ChecksumHeader: hex.EncodeToString(sum(compressed))}, wantCode: http.StatusOK},
+		{name: "corrupted body", body: corrupt(data), headers: map[string]string{ChecksumHeader: hex.EncodeToString(sum(data))}, wantCode: http.StatusBadRequest, wantError: CodeChecksumMismatch},
+		{name: "corrupted digest", body: data, headers: map[string]string{"Digest": "SHA-256=" + base64.StdEncoding.EncodeToString(corrupt(sum(data)))}, wantCode: http.StatusBadRequest, wantError: CodeChecksumMismatch},
+		{name: "checksum of uncompressed body", body: compressed, encoding: "snappy", headers: map[string]string{ChecksumHeader: hex.EncodeToString(sum(data))}, wantCode: http.StatusBadRequest, wantError: CodeChecksumMismatch},
+		{name: "malformed checksum", body: data, headers: map[string]string{ChecksumHeader: "xyz"}, wantCode: http.StatusBadRequest, wantError: CodeInvalidChecksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := memstore.New(10 * time.Minute)
+			s := New(ms, testValidator{partitionKey: "cluster-1"}, nil, 10*time.Minute)
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+			if len(tt.encoding) > 0 {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			s.Post(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+			}
+			ps, err := ms.ReadMetrics(context.Background(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantCode == http.StatusOK {
+				if len(ps) != 1 {
+					t.Fatalf("expected the upload to be stored, got %d partitions", len(ps))
+				}
+				return
+			}
+			if len(ps) != 0 {
+				t.Fatalf("expected nothing to be stored, got %d partitions", len(ps))
+			}
+			var body Error
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != tt.wantError {
+				t.Fatalf("want error %s, got %s", tt.wantError, body.Code)
+			}
+		})
+	}
+}
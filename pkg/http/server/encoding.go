@@ -0,0 +1,61 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/openshift/telemeter/pkg/reader"
+)
+
+// Content encodings of uploads. Uploads without an encoding, or with identity, are read as is.
+const (
+	EncodingGzip   = "gzip"
+	EncodingSnappy = "snappy"
+)
+
+// acceptedEncodings lists the compressed encodings of uploads, as announced in the
+// Accept-Encoding header of responses rejecting other encodings.
+var acceptedEncodings = []string{EncodingGzip, EncodingSnappy}
+
+// isAcceptedEncoding returns true if uploads with the Content-Encoding can be read.
+func isAcceptedEncoding(encoding string) bool {
+	switch encoding {
+	case "", "identity", EncodingGzip, EncodingSnappy:
+		return true
+	}
+	return false
+}
+
+// newDecodingReader returns a reader decompressing r of the accepted encoding. If limit is
+// positive, reading more than limit decompressed bytes fails with reader.ErrTooLong.
+func newDecodingReader(encoding string, r io.Reader, limit int64) io.Reader {
+	switch encoding {
+	case EncodingSnappy:
+		return newSnappyReader(r, limit)
+	case EncodingGzip:
+		return &gzipReader{r: r, limit: limit}
+	}
+	return r
+}
+
+// gzipReader decompresses an upload with Content-Encoding gzip. The gzip header is read on the
+// first read, so that a malformed body fails like any other while decoding.
+type gzipReader struct {
+	r     io.Reader
+	limit int64
+	dec   io.Reader
+}
+
+func (g *gzipReader) Read(p []byte) (int, error) {
+	if g.dec == nil {
+		dec, err := gzip.NewReader(g.r)
+		if err != nil {
+			return 0, err
+		}
+		g.dec = dec
+		if g.limit > 0 {
+			g.dec = reader.LimitReader(dec, g.limit)
+		}
+	}
+	return g.dec.Read(p)
+}
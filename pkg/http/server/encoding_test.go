@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/store"
+	"github.com/openshift/telemeter/pkg/store/memstore"
+)
+
+func TestServer_PostEncoding(t *testing.T) {
+	data := encodeFamilies([]*clientmodel.MetricFamily{
+		family("test_1", 1000000, 1002000),
+		family("test_2", 1000000),
+	})
+	gzipped := func(data []byte) []byte {
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	post := func(s *Server, body []byte, encoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+		if len(encoding) > 0 {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		w := httptest.NewRecorder()
+		s.Post(w, req)
+		return w
+	}
+	stored := func(t *testing.T, body []byte, encoding string) []*store.PartitionedMetrics {
+		ms := memstore.New(10 * time.Minute)
+		s := New(ms, testValidator{partitionKey: "cluster-1"}, nil, 10*time.Minute)
+		if w := post(s, body, encoding); w.Code != http.StatusOK {
+			t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+		}
+		ps, err := ms.ReadMetrics(context.Background(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ps
+	}
+
+	want := stored(t, data, "")
+	for _, tt := range []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{name: "identity", encoding: "identity", body: data},
+		{name: "gzip", encoding: "gzip", body: gzipped(data)},
+		{name: "case insensitive", encoding: "GZIP", body: gzipped(data)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stored(t, tt.body, tt.encoding); !reflect.DeepEqual(got, want) {
+				t.Fatalf("want stored metrics %v, got %v", want, got)
+			}
+		})
+	}
+
+	t.Run("gzip over the uncompressed limit", func(t *testing.T) {
+		s := New(memstore.New(10*time.Minute), testValidator{partitionKey: "cluster-1"}, nil, 10*time.Minute)
+		s.MaxUncompressedBytes = int64(len(data) - 1)
+		w := post(s, gzipped(data), "gzip")
+		if w.Code != http.StatusInternalServerError || !bytes.Contains(w.Body.Bytes(), []byte(CodeTooLarge)) {
+			t.Fatalf("expected upload over the uncompressed limit to fail, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		ms := memstore.New(10 * time.Minute)
+		s := New(ms, testValidator{partitionKey: "cluster-1"}, nil, 10*time.Minute)
+		w := post(s, data, "br")
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Fatalf("want code %d, got %d: %s", http.StatusUnsupportedMediaType, w.Code, w.Body.String())
+		}
+		var body Error
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Code != CodeUnsupportedEncoding {
+			t.Errorf("want error %s, got %s: %s", CodeUnsupportedEncoding, body.Code, body.Message)
+		}
+		if got := w.Header().Get("Accept-Encoding"); got != "gzip, snappy" {
+			t.Errorf("want the accepted encodings announced, got %q", got)
+		}
+		if ps, _ := ms.ReadMetrics(context.Background(), 0); len(ps) > 0 {
+			t.Errorf("want nothing stored, got %v", ps)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/validate"
+)
+
+// ClientInfoMetric is the name of the metric recording the agent version reported in the
+// envelope of an upload. It is stored with the uploaded metrics and replaces any metric of
+// the same name sent by the client.
+const ClientInfoMetric = "telemeter_client_info"
+
+// maxEnvelopeBytes limits the size of an upload envelope, including the trailing newline.
+const maxEnvelopeBytes = 4096
+
+// body is a request body read through a buffer.
+type body struct {
+	io.Reader
+	io.Closer
+}
+
+// readEnvelope reads the envelope that starts an upload: a single line holding a JSON
+// encoded validate.Envelope. It returns the envelope and the raw line, which is covered
+// by the checksum of the upload.
+func readEnvelope(r *bufio.Reader) (*validate.Envelope, []byte, *Error) {
+	line, err := r.ReadSlice('\n')
+	switch {
+	case err == bufio.ErrBufferFull:
+		return nil, nil, newError(CodeInvalidEnvelope, "the upload envelope must be at most %d bytes", maxEnvelopeBytes)
+	case err != nil:
+		return nil, nil, newError(CodeInvalidEnvelope, "the upload must start with an envelope terminated by a newline: %v", err)
+	}
+
+	envelope := &validate.Envelope{}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(envelope); err != nil {
+		return nil, nil, newError(CodeInvalidEnvelope, "the upload envelope is not valid: %v", err)
+	}
+	if len(envelope.AgentVersion) == 0 {
+		return nil, nil, newError(CodeInvalidEnvelope, "the upload envelope must set 'agent_version'")
+	}
+	return envelope, append([]byte(nil), line...), nil
+}
+
+// clientInfoFamily returns the family recording the agent version of an upload.
+func clientInfoFamily(agentVersion string, now time.Time) *clientmodel.MetricFamily {
+	return &clientmodel.MetricFamily{
+		Name: proto.String(ClientInfoMetric),
+		Help: proto.String("Information about the agent that uploaded the metrics."),
+		Type: clientmodel.MetricType_GAUGE.Enum(),
+		Metric: []*clientmodel.Metric{{
+			Label:       []*clientmodel.LabelPair{{Name: proto.String("agent_version"), Value: proto.String(agentVersion)}},
+			Gauge:       &clientmodel.Gauge{Value: proto.Float64(1)},
+			TimestampMs: proto.Int64(now.UnixNano() / int64(time.Millisecond)),
+		}},
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/store/memstore"
+	"github.com/openshift/telemeter/pkg/validate"
+)
+
+// envelopeValidator records the envelope visible to validation.
+type envelopeValidator struct {
+	envelope *validate.Envelope
+}
+
+func (v *envelopeValidator) Validate(ctx context.Context, req *http.Request) (string, metricfamily.Transformer, error) {
+	v.envelope, _ = validate.EnvelopeFromContext(ctx)
+	return "cluster-1", nil, nil
+}
+
+func (v *envelopeValidator) ValidateUpload(ctx context.Context, client *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+	return families, nil
+}
+
+func TestServer_PostVersions(t *testing.T) {
+	data := encodeFamilies([]*clientmodel.MetricFamily{family("test_1", 1000000)})
+	text := familiesToText([]*clientmodel.MetricFamily{family("test_1", 1000000)})
+	envelope := func(s string) []byte { return []byte(s + "\n") }
+
+	tests := []struct {
+		name         string
+		v2           bool
+		contentType  string
+		body         []byte
+		wantCode     int
+		wantError    string
+		wantEnvelope *validate.Envelope
+		wantFamilies []string
+	}{
+		{name: "v1", contentType: string(expfmt.FmtProtoDelim), body: data, wantCode: http.StatusOK, wantFamilies: []string{"test_1"}},
+		{
+			name:         "v2",
+			v2:           true,
+			contentType:  string(expfmt.FmtProtoDelim),
+			body:         append(envelope(`{"agent_version":"4.1.0","scrape_timestamp":1000000}`), data...),
+			wantCode:     http.StatusOK,
+			wantEnvelope: &validate.Envelope{AgentVersion: "4.1.0", ScrapeTimestampMs: 1000000},
+			wantFamilies: []string{ClientInfoMetric, "test_1"},
+		},
+		{
+			name:         "v2 format from envelope",
+			v2:           true,
+			body:         append(envelope(`{"agent_version":"4.1.0","format":"text/plain; version=0.0.4"}`), text...),
+			wantCode:     http.StatusOK,
+			wantEnvelope: &validate.Envelope{AgentVersion: "4.1.0", Format: "text/plain; version=0.0.4"},
+			wantFamilies: []string{ClientInfoMetric, "test_1"},
+		},
+		{
+			name:         "v2 replaces uploaded info metric",
+			v2:           true,
+			contentType:  string(expfmt.FmtProtoDelim),
+			body:         append(envelope(`{"agent_version":"4.1.0"}`), encodeFamilies([]*clientmodel.MetricFamily{family(ClientInfoMetric, 1000000), family("test_1", 1000000)})...),
+			wantCode:     http.StatusOK,
+			wantEnvelope: &validate.Envelope{AgentVersion: "4.1.0"},
+			wantFamilies: []string{ClientInfoMetric, "test_1"},
+		},
+		{name: "v2 without envelope", v2: true, contentType: string(expfmt.FmtProtoDelim), body: data, wantCode: http.StatusBadRequest, wantError: CodeInvalidEnvelope},
+		{name: "v2 missing agent version", v2: true, contentType: string(expfmt.FmtProtoDelim), body: append(envelope(`{}`), data...), wantCode: http.StatusBadRequest, wantError: CodeInvalidEnvelope},
+		{name: "v2 unknown field", v2: true, contentType: string(expfmt.FmtProtoDelim), body: append(envelope(`{"agent_version":"1","other":1}`), data...), wantCode: http.StatusBadRequest, wantError: CodeInvalidEnvelope},
+		{name: "v2 envelope too large", v2: true, contentType: string(expfmt.FmtProtoDelim), body: append(envelope(`{"agent_version":"`+strings.Repeat("1", maxEnvelopeBytes)+`"}`), data...), wantCode: http.StatusBadRequest, wantError: CodeInvalidEnvelope},
+		{name: "v2 unsupported format", v2: true, body: append(envelope(`{"agent_version":"1","format":"application/json"}`), data...), wantCode: http.StatusUnsupportedMediaType, wantError: CodeUnsupportedContentType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := memstore.New(10 * time.Minute)
+			v := &envelopeValidator{}
+			s := New(ms, v, nil, 10*time.Minute)
+			s.nowFn = func() time.Time { return time.Unix(1000, 0) }
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(tt.body))
+			if len(tt.contentType) > 0 {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			if tt.v2 {
+				s.PostV2(w, req)
+			} else {
+				s.Post(w, req)
+			}
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+			}
+			if len(tt.wantError) > 0 {
+				var body Error
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatal(err)
+				}
+				if body.Code != tt.wantError {
+					t.Fatalf("want error %s, got %s: %s", tt.wantError, body.Code, body.Message)
+				}
+				return
+			}
+			if !reflect.DeepEqual(v.envelope, tt.wantEnvelope) {
+				t.Errorf("want envelope %+v, got %+v", tt.wantEnvelope, v.envelope)
+			}
+
+			ps, err := ms.ReadMetrics(context.Background(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range ps[0].Families {
+				names = append(names, f.GetName())
+				if f.GetName() != ClientInfoMetric {
+					continue
+				}
+				if len(f.Metric) != 1 || len(f.Metric[0].Label) != 1 || f.Metric[0].Label[0].GetValue() != tt.wantEnvelope.AgentVersion {
+					t.Errorf("unexpected info metric %v", f)
+				}
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.wantFamilies) {
+				t.Errorf("want families %v, got %v", tt.wantFamilies, names)
+			}
+		})
+	}
+}
+
+func TestServer_PostV2Checksum(t *testing.T) {
+	body := append([]byte(`{"agent_version":"4.1.0"}`+"\n"), encodeFamilies([]*clientmodel.MetricFamily{family("test_1", 1000000)})...)
+	sum := sha256.Sum256(body)
+
+	s := New(memstore.New(10*time.Minute), &envelopeValidator{}, nil, 10*time.Minute)
+	s.nowFn = func() time.Time { return time.Unix(1000, 0) }
+	req := httptest.NewRequest("POST", "/upload/v2", bytes.NewReader(body))
+	req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+	req.Header.Set(ChecksumHeader, hex.EncodeToString(sum[:]))
+	w := httptest.NewRecorder()
+	s.PostV2(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("the checksum must cover the envelope, got %d: %s", w.Code, w.Body.String())
+	}
+}
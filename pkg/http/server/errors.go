@@ -0,0 +1,319 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/reader"
+	"github.com/openshift/telemeter/pkg/store/quota"
+	"github.com/openshift/telemeter/pkg/store/ratelimited"
+	"github.com/openshift/telemeter/pkg/validate"
+)
+
+// RequestIDHeader is the header identifying a request in logs and error responses.
+// It is taken from the request if set by the caller or a proxy, and generated otherwise.
+const RequestIDHeader = "X-Request-Id"
+
+// PartHeader identifies the part of an upload the client split into several requests, as
+// "<index>/<count>; upload=<id>". The parts of an upload are stored together once all of them
+// have arrived, and failures of parts are logged with it, so that they can be told apart.
+const PartHeader = "X-Telemeter-Part"
+
+// ReportOnlyHeader lists the report-only validation rules that would have rejected the upload
+// or dropped some of its series, had they been enforced.
+const ReportOnlyHeader = "X-Telemeter-Report-Only"
+
+// Codes identifying the cause of an error response. They are stable and may be relied upon by clients.
+const (
+	CodeMethodNotAllowed       = "method_not_allowed"
+	CodeInvalidParameter       = "invalid_parameter"
+	CodeInvalidReadRequest     = "invalid_read_request"
+	CodeUnsupportedContentType = "unsupported_content_type"
+	CodeUnsupportedEncoding    = "unsupported_content_encoding"
+	CodeInvalidEnvelope        = "invalid_envelope"
+	CodeUnauthorized           = "unauthorized"
+	CodeMissingPartitionLabel  = "missing_partition_label"
+	CodeInvalidPartitionLabel  = "invalid_partition_label"
+	CodeMissingRequiredLabel   = "missing_required_label"
+	CodeMissingTimestamp       = "missing_timestamp"
+	CodeInconsistentType       = "inconsistent_metric_type"
+	CodeUnsortedSamples        = "unsorted_samples"
+	CodeSampleTooOld           = "sample_too_old"
+	CodeSampleInFuture         = "sample_in_future"
+	CodeLabelLimitExceeded     = "label_limit_exceeded"
+	CodeLabelConflict          = "label_conflict"
+	CodeTooLarge               = "too_large"
+	CodeInvalidChecksum        = "invalid_checksum"
+	CodeChecksumMismatch       = "checksum_mismatch"
+	CodeRateLimited            = "rate_limited"
+	CodeTooManyInFlight        = "too_many_in_flight"
+	CodeQuotaExceeded          = "quota_exceeded"
+	CodeTimeout                = "timeout"
+	CodeInvalidMetrics         = "invalid_metrics"
+	CodeSeriesDropped          = "series_dropped"
+	CodeTooManySamples         = "too_many_samples"
+	CodeNotAllowlisted         = "not_allowlisted"
+	CodeTooManySeries          = "too_many_series"
+	CodeDuplicateSeries        = "duplicate_series"
+	CodeEmptyUpload            = "empty_upload"
+	CodeCardinalityExceeded    = "cardinality_exceeded"
+)
+
+// Error is the body of all error responses.
+type Error struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestID string                 `json:"request_id"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// errorFor maps an error to the status code and body it is reported with.
+func errorFor(err error) (int, *Error) {
+	switch terr := err.(type) {
+	case *Error:
+		return http.StatusInternalServerError, terr
+	case *quota.ErrQuotaExceeded:
+		return http.StatusTooManyRequests, &Error{
+			Code:    CodeQuotaExceeded,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"quota": terr.Quota, "used": terr.Used, "reset": terr.Reset},
+		}
+	case *metricfamily.ErrFutureSample:
+		return http.StatusBadRequest, &Error{
+			Code:    CodeSampleInFuture,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"metric": terr.Name, "timestamp": terr.TimestampMs},
+		}
+	case *metricfamily.ErrLabelLimit:
+		details := map[string]interface{}{"metric": terr.Name, "type": terr.Type, "limit": terr.Limit}
+		if len(terr.Label) > 0 {
+			details["label"] = terr.Label
+		}
+		return http.StatusBadRequest, &Error{Code: CodeLabelLimitExceeded, Message: terr.Error(), Details: details}
+	case *metricfamily.ErrLabelConflict:
+		return http.StatusBadRequest, &Error{
+			Code:    CodeLabelConflict,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"metric": terr.Name, "label": terr.Label, "expected": terr.Expected, "actual": terr.Actual},
+		}
+	case *ErrSeriesDropped:
+		return http.StatusUnprocessableEntity, &Error{
+			Code:    CodeSeriesDropped,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"dropped": terr.Dropped, "series": terr.Series},
+		}
+	case *ErrTooManySamples:
+		return http.StatusRequestEntityTooLarge, &Error{
+			Code:    CodeTooManySamples,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"limit": terr.Limit},
+		}
+	case *ErrChecksumMismatch:
+		return http.StatusBadRequest, &Error{
+			Code:    CodeChecksumMismatch,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"expected": terr.Expected, "actual": terr.Actual},
+		}
+	case ratelimited.ErrWriteLimitReached:
+		return http.StatusTooManyRequests, &Error{Code: CodeRateLimited, Message: terr.Error()}
+	case *metricfamily.ErrSeriesOutOfOrder:
+		return http.StatusBadRequest, &Error{
+			Code:    CodeUnsortedSamples,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"series": terr.Series, "timestamp": terr.TimestampMs, "previous": terr.PreviousMs},
+		}
+	case *metricfamily.ErrInconsistentType:
+		return http.StatusBadRequest, &Error{
+			Code:    CodeInconsistentType,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"metric": terr.Name, "type": terr.Type.String()},
+		}
+	case *validate.ErrNotAllowlisted:
+		return http.StatusUnprocessableEntity, &Error{
+			Code:    CodeNotAllowlisted,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"metric": terr.Name, "metrics": terr.Names, "count": terr.Count, "truncated": terr.Count > len(terr.Names)},
+		}
+	case *validate.ErrRequirementsFailed:
+		failures := make([]map[string]string, 0, len(terr.Failures))
+		for _, f := range terr.Failures {
+			failures = append(failures, map[string]string{"label": f.Label, "reason": f.Reason})
+		}
+		return http.StatusBadRequest, &Error{
+			Code:    CodeMissingRequiredLabel,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"metric": terr.Name, "failures": failures},
+		}
+	case *metricfamily.ErrRequiredLabelMissing:
+		details := map[string]interface{}{"metric": terr.Name, "label": terr.Label, "expected": terr.Expected}
+		if terr.Actual != nil {
+			details["actual"] = *terr.Actual
+		}
+		return http.StatusBadRequest, &Error{
+			Code:    CodeMissingRequiredLabel,
+			Message: terr.Error(),
+			Details: details,
+		}
+	case *validate.ErrTooLarge:
+		return http.StatusRequestEntityTooLarge, &Error{
+			Code:    CodeTooLarge,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"limit": terr.Limit},
+		}
+	case *validate.ErrTooManySeries:
+		return http.StatusUnprocessableEntity, &Error{
+			Code:    CodeTooManySeries,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"limit": terr.Limit},
+		}
+	case *validate.ErrDuplicateSeries:
+		return http.StatusUnprocessableEntity, &Error{
+			Code:    CodeDuplicateSeries,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"series": terr.Series},
+		}
+	case *validate.ErrCardinalityExceeded:
+		return http.StatusTooManyRequests, &Error{
+			Code:    CodeCardinalityExceeded,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"budget": terr.Budget, "usage": terr.Usage},
+		}
+	case *validate.ErrInvalidPartitionKey:
+		return http.StatusBadRequest, &Error{
+			Code:    CodeInvalidPartitionLabel,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"label": terr.Label, "format": terr.Format},
+		}
+	case validate.ErrMissingPartitionKey:
+		return http.StatusInternalServerError, &Error{
+			Code:    CodeMissingPartitionLabel,
+			Message: terr.Error(),
+			Details: map[string]interface{}{"label": string(terr)},
+		}
+	}
+
+	if err == validate.ErrEmptyUpload {
+		return http.StatusBadRequest, &Error{Code: CodeEmptyUpload, Message: err.Error()}
+	}
+
+	code := CodeInvalidMetrics
+	switch err {
+	case validate.ErrNoClient:
+		code = CodeUnauthorized
+	case metricfamily.ErrNoTimestamp:
+		code = CodeMissingTimestamp
+	case metricfamily.ErrUnsorted:
+		code = CodeUnsortedSamples
+	case metricfamily.ErrTimestampTooOld:
+		code = CodeSampleTooOld
+	case reader.ErrTooLong:
+		code = CodeTooLarge
+	}
+	return http.StatusInternalServerError, &Error{Code: code, Message: err.Error()}
+}
+
+// requestID returns the ID of the request, generating a random one if the caller did not
+// provide it.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get(RequestIDHeader); len(id) > 0 {
+		return id
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	return hex.EncodeToString(b)
+}
+
+// uploadPart returns the part of an upload the request carries, formatted for logs, or false if
+// the upload is not split or the header is invalid.
+func uploadPart(req *http.Request) (string, bool) {
+	p, ok := requestPart(req)
+	if !ok {
+		return "", false
+	}
+	return p.String(), true
+}
+
+// writeError responds with the JSON error envelope for err.
+func writeError(w http.ResponseWriter, req *http.Request, err error) {
+	status, body := errorFor(err)
+	writeErrorWithStatus(w, req, status, body)
+}
+
+func writeErrorWithStatus(w http.ResponseWriter, req *http.Request, status int, body *Error) {
+	body.RequestID = requestID(req)
+	part, ok := uploadPart(req)
+	switch {
+	case ok:
+		log.Printf("error: request %s, part %s, failed with %s: %s", body.RequestID, part, body.Code, body.Message)
+	case status >= http.StatusInternalServerError:
+		log.Printf("error: request %s failed with %s: %s", body.RequestID, body.Code, body.Message)
+	}
+	writeErrorBody(w, status, body)
+}
+
+// writeUploadError responds with the JSON error envelope for err. Without a FailureLog,
+// failures are logged as by writeError. With one, every failure is logged, but identical
+// failures of a client are logged once per window, so that a fleet of misconfigured clients
+// cannot flood the log.
+func (s *Server) writeUploadError(w http.ResponseWriter, req *http.Request, err error) {
+	if s.FailureLog == nil {
+		writeError(w, req, err)
+		return
+	}
+	status, body := errorFor(err)
+	body.RequestID = requestID(req)
+	id := "unknown"
+	if client, ok := authorize.FromContext(req.Context()); ok {
+		id = client.ID
+	}
+	key := fmt.Sprintf("client=%s code=%s", id, body.Code)
+	if part, ok := uploadPart(req); ok {
+		s.FailureLog.Printf(key, "error: request %s of client %s, part %s, failed with %s: %s", body.RequestID, id, part, body.Code, body.Message)
+	} else {
+		s.FailureLog.Printf(key, "error: request %s of client %s failed with %s: %s", body.RequestID, id, body.Code, body.Message)
+	}
+	writeErrorBody(w, status, body)
+}
+
+func writeErrorBody(w http.ResponseWriter, status int, body *Error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("error marshaling error response: %v", err)
+		http.Error(w, body.Message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(RequestIDHeader, body.RequestID)
+	w.WriteHeader(status)
+	if _, err := w.Write(data); err != nil {
+		log.Printf("error writing error response: %v", err)
+	}
+}
+
+// newError returns an error that is reported with the given code.
+func newError(code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// retryAfter sets the Retry-After header for errors that expire at a known time.
+func retryAfter(w http.ResponseWriter, err error, now time.Time) {
+	if qerr, ok := err.(*quota.ErrQuotaExceeded); ok {
+		if retry := int64(qerr.Reset.Sub(now).Seconds()); retry > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+		}
+	}
+}
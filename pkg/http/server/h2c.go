@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// h2cPrefaceRemainder is the part of the HTTP/2 client preface that follows
+// the request line and headers parsed by net/http.
+const h2cPrefaceRemainder = "SM\r\n\r\n"
+
+type h2cHandler struct {
+	next http.Handler
+	s    *http2.Server
+}
+
+// NewH2CHandler returns a handler serving HTTP/2 without TLS to clients with prior knowledge,
+// and passing all other requests to next. The connection is served with the settings of the
+// http.Server that accepted it, so its timeouts apply to HTTP/2 streams as well.
+func NewH2CHandler(next http.Handler, s *http2.Server) http.Handler {
+	return &h2cHandler{next: next, s: s}
+}
+
+func (h *h2cHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "PRI" || req.URL.Path != "*" || req.Proto != "HTTP/2.0" {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+
+	conn, err := hijackH2C(w)
+	if err != nil {
+		log.Printf("error: unable to start h2c connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	base, _ := req.Context().Value(http.ServerContextKey).(*http.Server)
+	h.s.ServeConn(conn, &http2.ServeConnOpts{
+		BaseConfig: base,
+		Handler:    h.next,
+	})
+}
+
+// hijackH2C takes over the connection of a prior knowledge request and returns
+// it ready to be served by an http2.Server, which expects to read the full preface.
+func hijackH2C(w http.ResponseWriter) (net.Conn, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("connection does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	remainder := make([]byte, len(h2cPrefaceRemainder))
+	if _, err := io.ReadFull(rw.Reader, remainder); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !bytes.Equal(remainder, []byte(h2cPrefaceRemainder)) {
+		conn.Close()
+		return nil, fmt.Errorf("invalid HTTP/2 client preface")
+	}
+
+	return &h2cConn{
+		Conn:   conn,
+		reader: io.MultiReader(strings.NewReader(http2.ClientPreface), rw.Reader),
+		writer: rw.Writer,
+	}, nil
+}
+
+// h2cConn reads and writes through the buffers of a hijacked connection.
+type h2cConn struct {
+	net.Conn
+	reader io.Reader
+	writer *bufio.Writer
+}
+
+func (c *h2cConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *h2cConn) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.writer.Flush()
+}
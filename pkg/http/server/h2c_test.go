@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"golang.org/x/net/http2"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/store/memstore"
+	"github.com/openshift/telemeter/pkg/validate"
+)
+
+func TestH2CHandler(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := New(memstore.New(10*time.Minute), validate.New("cluster", 1024, 0, func() time.Time { return now }), nil, 10*time.Minute)
+	s.nowFn = func() time.Time { return now }
+
+	var protos []string
+	upload := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		protos = append(protos, req.Proto)
+		req = req.WithContext(authorize.WithClient(req.Context(), &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}}))
+		s.Post(w, req)
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: NewH2CHandler(upload, &http2.Server{}), ReadTimeout: 5 * time.Second}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	name, value := "cluster", "test"
+	var families []*clientmodel.MetricFamily
+	for i := 0; i < 100; i++ {
+		f := family(fmt.Sprintf("test_%d", i), 999000)
+		f.Type = clientmodel.MetricType_COUNTER.Enum()
+		f.Metric[0].Label = []*clientmodel.LabelPair{{Name: &name, Value: &value}}
+		families = append(families, f)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		body      []byte
+		wantCode  int
+		wantError string
+	}{
+		{name: "upload", body: encodeFamilies(families[:1]), wantCode: http.StatusOK},
+		{name: "too large", body: encodeFamilies(families), wantCode: http.StatusRequestEntityTooLarge, wantError: CodeTooLarge},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "http://"+l.Addr().String()+"/upload", bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.ProtoMajor != 2 {
+				t.Fatalf("expected an HTTP/2 response, got %s", resp.Proto)
+			}
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("unexpected code %d", resp.StatusCode)
+			}
+			if len(tt.wantError) == 0 {
+				return
+			}
+			var body Error
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != tt.wantError {
+				t.Fatalf("want error %s, got %s", tt.wantError, body.Code)
+			}
+		})
+	}
+
+	for _, proto := range protos {
+		if proto != "HTTP/2.0" {
+			t.Fatalf("expected uploads to be served over HTTP/2, got %s", proto)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+var inFlightRejections = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "telemeter_in_flight_rejections_total",
+	Help: "Uploads rejected because the client had too many uploads in flight.",
+})
+
+func init() {
+	prometheus.MustRegister(inFlightRejections)
+}
+
+// ClientLimiter limits the number of requests each authorized client may have in flight,
+// so that a single client retrying in parallel cannot occupy the server. Only clients with
+// requests in flight are tracked.
+type ClientLimiter struct {
+	limit int
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+// NewClientLimiter returns a limiter allowing limit concurrent requests per client.
+func NewClientLimiter(limit int) *ClientLimiter {
+	return &ClientLimiter{limit: limit, inFlight: make(map[string]int)}
+}
+
+// Handler returns a handler rejecting requests to next with 429 while the client already has
+// the maximum number in flight. Requests sharing a limiter count against the same limit, and
+// requests without an authorized client are not limited.
+func (l *ClientLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		client, ok := authorize.FromContext(req.Context())
+		if !ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if !l.acquire(client.ID) {
+			inFlightRejections.Inc()
+			writeErrorWithStatus(w, req, http.StatusTooManyRequests, newError(CodeTooManyInFlight, "at most %d uploads may be in flight per client", l.limit))
+			return
+		}
+		// released when the handler returns, panics or gives up on a disconnected client
+		defer l.release(client.ID)
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (l *ClientLimiter) acquire(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[id] >= l.limit {
+		return false
+	}
+	l.inFlight[id]++
+	return true
+}
+
+func (l *ClientLimiter) release(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[id] <= 1 {
+		delete(l.inFlight, id)
+		return
+	}
+	l.inFlight[id]--
+}
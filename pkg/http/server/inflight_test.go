@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func TestClientLimiter(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	l := NewClientLimiter(1)
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/slow":
+			started <- struct{}{}
+			<-release
+		case "/panic":
+			panic("upload failed")
+		}
+	}))
+	serve := func(client, path string) int {
+		req := httptest.NewRequest("POST", path, nil)
+		if len(client) > 0 {
+			req = req.WithContext(authorize.WithClient(req.Context(), &authorize.Client{ID: client}))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	done := make(chan int)
+	go func() { done <- serve("a", "/slow") }()
+	<-started
+
+	if code := serve("a", "/upload"); code != http.StatusTooManyRequests {
+		t.Errorf("want concurrent upload of the same client rejected, got %d", code)
+	}
+	if code := serve("b", "/upload"); code != http.StatusOK {
+		t.Errorf("want upload of another client accepted, got %d", code)
+	}
+	if code := serve("", "/upload"); code != http.StatusOK {
+		t.Errorf("want unauthorized request passed on, got %d", code)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("want slow upload accepted, got %d", code)
+	}
+	if code := serve("a", "/upload"); code != http.StatusOK {
+		t.Errorf("want upload accepted once the first completed, got %d", code)
+	}
+
+	func() {
+		defer func() { recover() }()
+		serve("a", "/panic")
+	}()
+	if code := serve("a", "/upload"); code != http.StatusOK {
+		t.Errorf("want upload accepted after a panic, got %d", code)
+	}
+	if len(l.inFlight) != 0 {
+		t.Errorf("want no clients tracked when idle, got %v", l.inFlight)
+	}
+}
+
+func TestClientLimiter_Disconnect(t *testing.T) {
+	l := NewClientLimiter(1)
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(w, req.WithContext(authorize.WithClient(req.Context(), &authorize.Client{ID: "a"})))
+	}))
+	defer srv.Close()
+
+	// a client giving up on its upload frees its slot
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("POST", srv.URL, nil)
+	reqCh := make(chan error)
+	go func() {
+		_, err := http.DefaultClient.Do(req.WithContext(ctx))
+		reqCh <- err
+	}()
+	for i := 0; ; i++ {
+		l.mu.Lock()
+		n := l.inFlight["a"]
+		l.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if i > 1000 {
+			t.Fatal("upload did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-reqCh
+
+	for i := 0; ; i++ {
+		l.mu.Lock()
+		n := len(l.inFlight)
+		l.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if i > 1000 {
+			t.Fatal("slot was not released after the client disconnected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/store"
+)
+
+// partTimeout is how long the parts of a split upload are kept waiting for the others.
+const partTimeout = 5 * time.Minute
+
+// uploadPartInfo identifies a request as a part of an upload the client split into several
+// requests with PartHeader.
+type uploadPartInfo struct {
+	index, count int
+	upload       string
+}
+
+func (p uploadPartInfo) String() string {
+	return fmt.Sprintf("%d/%d of upload %q", p.index, p.count, p.upload)
+}
+
+// requestPart returns the part of an upload the request carries, or false if the upload is not
+// split or the header is invalid.
+func requestPart(req *http.Request) (uploadPartInfo, bool) {
+	value := req.Header.Get(PartHeader)
+	if len(value) == 0 {
+		return uploadPartInfo{}, false
+	}
+	var p uploadPartInfo
+	if n, err := fmt.Sscanf(value, "%d/%d; upload=%s", &p.index, &p.count, &p.upload); err != nil || n != 3 {
+		return uploadPartInfo{}, false
+	}
+	if p.index < 1 || p.index > p.count || len(p.upload) > 64 {
+		return uploadPartInfo{}, false
+	}
+	return p, true
+}
+
+type partKeyType int
+
+const partKey partKeyType = iota
+
+// withPart returns a context carrying the part of a split upload the request is.
+func withPart(ctx context.Context, p uploadPartInfo) context.Context {
+	return context.WithValue(ctx, partKey, p)
+}
+
+// partFrom returns the part of a split upload set by withPart, or false if the upload is whole.
+func partFrom(ctx context.Context) (uploadPartInfo, bool) {
+	p, ok := ctx.Value(partKey).(uploadPartInfo)
+	return p, ok && p.count > 1
+}
+
+// partialUpload holds the parts of a split upload received so far.
+type partialUpload struct {
+	id      string
+	count   int
+	parts   map[int][]*clientmodel.MetricFamily
+	updated time.Time
+}
+
+// partAssembler collects the parts of split uploads, so that they are rate limited and stored
+// as a single upload once all of them have arrived. A partition has at most one upload being
+// assembled: the first part of a newer upload discards the parts of the previous one, which
+// the client gave up on.
+type partAssembler struct {
+	mu        sync.Mutex
+	uploads   map[string]*partialUpload
+	lastPrune time.Time
+}
+
+func newPartAssembler() *partAssembler {
+	return &partAssembler{uploads: make(map[string]*partialUpload)}
+}
+
+// add records the families of the part of an upload of the partition. Once every part has been
+// received, it returns the families of all parts and the upload, which is no longer kept.
+// Otherwise it returns nil. A nil assembler returns the families of every part at once.
+func (a *partAssembler) add(partitionKey string, p uploadPartInfo, families []*clientmodel.MetricFamily, now time.Time) ([]*clientmodel.MetricFamily, *partialUpload) {
+	if a == nil {
+		return families, &partialUpload{}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.prune(now)
+	u, ok := a.uploads[partitionKey]
+	if !ok || u.id != p.upload || u.count != p.count {
+		u = &partialUpload{id: p.upload, count: p.count, parts: make(map[int][]*clientmodel.MetricFamily, p.count)}
+		a.uploads[partitionKey] = u
+	}
+	u.parts[p.index] = families
+	u.updated = now
+	if len(u.parts) < u.count {
+		return nil, nil
+	}
+	delete(a.uploads, partitionKey)
+
+	var all []*clientmodel.MetricFamily
+	for i := 1; i <= u.count; i++ {
+		all = append(all, u.parts[i]...)
+	}
+	return metricfamily.Normalize(all), u
+}
+
+// restore keeps the parts of an upload whose write failed but the part at index, so that the
+// upload is stored once the client sends that part again. It is ignored if a newer upload of
+// the partition is being assembled.
+func (a *partAssembler) restore(partitionKey string, u *partialUpload, index int, now time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.uploads[partitionKey]; ok {
+		return
+	}
+	delete(u.parts, index)
+	u.updated = now
+	a.uploads[partitionKey] = u
+}
+
+// prune discards the uploads that were not completed within partTimeout. The caller must hold
+// the lock.
+func (a *partAssembler) prune(now time.Time) {
+	if now.Sub(a.lastPrune) < partTimeout {
+		return
+	}
+	a.lastPrune = now
+	for key, u := range a.uploads {
+		if now.Sub(u.updated) > partTimeout {
+			delete(a.uploads, key)
+		}
+	}
+}
+
+// storeUpload writes the families of an upload to the store. The parts of a split upload are
+// held until all of them have arrived, and written together then.
+func (s *Server) storeUpload(ctx context.Context, partitionKey string, families []*clientmodel.MetricFamily, info *clientmodel.MetricFamily) error {
+	p, split := partFrom(ctx)
+	var upload *partialUpload
+	if split {
+		if families, upload = s.parts.add(partitionKey, p, families, time.Now()); upload == nil {
+			return nil
+		}
+	}
+	if info != nil {
+		families = append(families, info)
+	}
+	if len(families) == 0 {
+		return nil
+	}
+	err := s.store.WriteMetrics(ctx, &store.PartitionedMetrics{
+		PartitionKey: partitionKey,
+		Families:     families,
+	})
+	if err != nil && split {
+		s.parts.restore(partitionKey, upload, p.index, time.Now())
+	}
+	return err
+}
+
+// rejected returns true if the upload failed with a status telling the client not to send it
+// again.
+func rejected(err error) bool {
+	switch status, _ := errorFor(err); status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/store"
+	"github.com/openshift/telemeter/pkg/store/memstore"
+	"github.com/openshift/telemeter/pkg/store/ratelimited"
+	"github.com/openshift/telemeter/pkg/validate"
+)
+
+func TestServer_PostSplitUpload(t *testing.T) {
+	now := time.Unix(1000, 0)
+	client := &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}}
+	part := func(name string, labeled bool) []byte {
+		f := family(name, 999000)
+		if labeled {
+			f.Metric[0].Label = append(f.Metric[0].Label, &clientmodel.LabelPair{Name: proto.String("cluster"), Value: proto.String("test")})
+		}
+		return encodeFamilies([]*clientmodel.MetricFamily{f})
+	}
+	type request struct {
+		part     string
+		body     []byte
+		wantCode int
+	}
+	for _, tt := range []struct {
+		name     string
+		requests []request
+		want     []string
+	}{
+		{
+			name: "complete",
+			requests: []request{
+				{part: "1/3; upload=a", body: part("test_1", true), wantCode: http.StatusOK},
+				{part: "3/3; upload=a", body: part("test_3", true), wantCode: http.StatusOK},
+				{part: "2/3; upload=a", body: part("test_2", true), wantCode: http.StatusOK},
+			},
+			want: []string{"test_1", "test_2", "test_3"},
+		},
+		{
+			name: "rejected part",
+			requests: []request{
+				{part: "1/2; upload=a", body: part("test_1", true), wantCode: http.StatusOK},
+				{part: "2/2; upload=a", body: part("test_2", false), wantCode: http.StatusBadRequest},
+			},
+			want: []string{"test_1"},
+		},
+		{
+			name: "superseded",
+			requests: []request{
+				{part: "1/2; upload=a", body: part("test_1", true), wantCode: http.StatusOK},
+				{part: "1/2; upload=b", body: part("test_2", true), wantCode: http.StatusOK},
+				{part: "2/2; upload=b", body: part("test_3", true), wantCode: http.StatusOK},
+			},
+			want: []string{"test_2", "test_3"},
+		},
+		{
+			name: "incomplete",
+			requests: []request{
+				{part: "1/2; upload=a", body: part("test_1", true), wantCode: http.StatusOK},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// the parts go through the store chain of the server, which takes one write per interval
+			ms := memstore.New(time.Hour)
+			s := New(ratelimited.New(time.Hour, ms), validate.New("cluster", 0, 0, func() time.Time { return now }), nil, time.Hour)
+			s.nowFn = func() time.Time { return now }
+			for _, r := range tt.requests {
+				req := httptest.NewRequest("POST", "/upload", bytes.NewReader(r.body))
+				req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+				req.Header.Set(PartHeader, r.part)
+				req = req.WithContext(authorize.WithClient(req.Context(), client))
+				w := httptest.NewRecorder()
+				s.Post(w, req)
+				if w.Code != r.wantCode {
+					t.Fatalf("part %s: want code %d, got %d: %s", r.part, r.wantCode, w.Code, w.Body.String())
+				}
+			}
+
+			ps, err := store.ReadPartitions(context.Background(), ms, 0, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range ps {
+				for _, f := range p.Families {
+					got = append(got, f.GetName())
+				}
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("want families %v stored, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/openshift/telemeter/pkg/reader"
+)
+
+// maxReadRequestBytes bounds remote read requests, compressed and decompressed, which hold
+// only the matchers and time ranges of their queries.
+const maxReadRequestBytes = 1024 * 1024
+
+// Read implements the Prometheus remote read protocol over the stored metrics, returning
+// the samples of every series matching each query within its time range. Counters, gauges
+// and untyped metrics are returned, histograms and summaries are not.
+func (s *Server) Read(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeErrorWithStatus(w, req, http.StatusMethodNotAllowed, newError(CodeMethodNotAllowed, "only POST is allowed to this endpoint"))
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(reader.LimitReader(req.Body, maxReadRequestBytes))
+	if err == reader.ErrTooLong {
+		writeErrorWithStatus(w, req, http.StatusRequestEntityTooLarge, newError(CodeTooLarge, "request exceeds %d bytes", maxReadRequestBytes))
+		return
+	}
+	if err != nil {
+		writeErrorWithStatus(w, req, http.StatusBadRequest, newError(CodeInvalidReadRequest, "unable to read request: %v", err))
+		return
+	}
+	if n, err := snappy.DecodedLen(compressed); err == nil && n > maxReadRequestBytes {
+		writeErrorWithStatus(w, req, http.StatusRequestEntityTooLarge, newError(CodeTooLarge, "decompressed request exceeds %d bytes", maxReadRequestBytes))
+		return
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		writeErrorWithStatus(w, req, http.StatusBadRequest, newError(CodeInvalidReadRequest, "request must be snappy compressed: %v", err))
+		return
+	}
+	var rr prompb.ReadRequest
+	if err := proto.Unmarshal(data, &rr); err != nil {
+		writeErrorWithStatus(w, req, http.StatusBadRequest, newError(CodeInvalidReadRequest, "request must be a ReadRequest: %v", err))
+		return
+	}
+
+	// only the samples after the earliest start of the queries are read
+	var minTimestampMs int64
+	queries := make([][]*labels.Matcher, 0, len(rr.Queries))
+	for i, q := range rr.Queries {
+		if i == 0 || q.StartTimestampMs < minTimestampMs {
+			minTimestampMs = q.StartTimestampMs
+		}
+		matchers, err := toMatchers(q.Matchers)
+		if err != nil {
+			writeErrorWithStatus(w, req, http.StatusBadRequest, newError(CodeInvalidReadRequest, "invalid matcher: %v", err))
+			return
+		}
+		queries = append(queries, matchers)
+	}
+
+	ps, err := s.readPartitions(req.Context(), minTimestampMs)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	resp := &prompb.ReadResponse{Results: make([]*prompb.QueryResult, 0, len(rr.Queries))}
+	for i, q := range rr.Queries {
+		series := make(map[string]*prompb.TimeSeries)
+		for _, p := range ps {
+			for _, family := range p.Families {
+				s.selectSeries(series, p.PartitionKey, family, queries[i], q.StartTimestampMs, q.EndTimestampMs)
+			}
+		}
+		result := &prompb.QueryResult{Timeseries: make([]*prompb.TimeSeries, 0, len(series))}
+		for _, ts := range series {
+			sort.Slice(ts.Samples, func(i, j int) bool { return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp })
+			result.Timeseries = append(result.Timeseries, ts)
+		}
+		sort.Slice(result.Timeseries, func(i, j int) bool {
+			return lessLabels(result.Timeseries[i].Labels, result.Timeseries[j].Labels)
+		})
+		resp.Results = append(resp.Results, result)
+	}
+
+	data, err = proto.Marshal(resp)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	if _, err := w.Write(snappy.Encode(nil, data)); err != nil {
+		log.Printf("error writing read response: %v", err)
+	}
+}
+
+func toMatchers(ms []*prompb.LabelMatcher) ([]*labels.Matcher, error) {
+	matchers := make([]*labels.Matcher, 0, len(ms))
+	for _, m := range ms {
+		var t labels.MatchType
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			t = labels.MatchEqual
+		case prompb.LabelMatcher_NEQ:
+			t = labels.MatchNotEqual
+		case prompb.LabelMatcher_RE:
+			t = labels.MatchRegexp
+		case prompb.LabelMatcher_NRE:
+			t = labels.MatchNotRegexp
+		default:
+			return nil, fmt.Errorf("unknown matcher type %d", m.Type)
+		}
+		matcher, err := labels.NewMatcher(t, m.Name, m.Value)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+	return matchers, nil
+}
+
+// selectSeries adds the samples of the family within [start, end] to the series matching
+// all matchers, keyed by their labels.
+func (s *Server) selectSeries(series map[string]*prompb.TimeSeries, partitionKey string, family *clientmodel.MetricFamily, matchers []*labels.Matcher, start, end int64) {
+	if family == nil {
+		return
+	}
+	for _, m := range family.Metric {
+		if m == nil || m.TimestampMs == nil || *m.TimestampMs < start || *m.TimestampMs > end {
+			continue
+		}
+		value, ok := sampleValue(family.GetType(), m)
+		if !ok {
+			continue
+		}
+		ls := s.seriesLabels(partitionKey, family, m)
+		if !matchLabels(ls, matchers) {
+			continue
+		}
+
+		key := ls.String()
+		ts, ok := series[key]
+		if !ok {
+			ts = &prompb.TimeSeries{Labels: make([]prompb.Label, 0, len(ls))}
+			for _, l := range ls {
+				ts.Labels = append(ts.Labels, prompb.Label{Name: l.Name, Value: l.Value})
+			}
+			series[key] = ts
+		}
+		ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: *m.TimestampMs, Value: value})
+	}
+}
+
+// seriesLabels returns the sorted labels of a metric, including its name and, if the server
+// has a PartitionLabel the metric does not already carry, the partition key.
+func (s *Server) seriesLabels(partitionKey string, family *clientmodel.MetricFamily, m *clientmodel.Metric) labels.Labels {
+	ls := make([]labels.Label, 0, len(m.Label)+2)
+	ls = append(ls, labels.Label{Name: labels.MetricName, Value: family.GetName()})
+	partitioned := len(s.PartitionLabel) == 0
+	for _, l := range m.Label {
+		ls = append(ls, labels.Label{Name: l.GetName(), Value: l.GetValue()})
+		partitioned = partitioned || l.GetName() == s.PartitionLabel
+	}
+	if !partitioned {
+		ls = append(ls, labels.Label{Name: s.PartitionLabel, Value: partitionKey})
+	}
+	return labels.New(ls...)
+}
+
+func sampleValue(t clientmodel.MetricType, m *clientmodel.Metric) (float64, bool) {
+	switch t {
+	case clientmodel.MetricType_COUNTER:
+		return m.GetCounter().GetValue(), m.Counter != nil
+	case clientmodel.MetricType_GAUGE:
+		return m.GetGauge().GetValue(), m.Gauge != nil
+	case clientmodel.MetricType_UNTYPED:
+		return m.GetUntyped().GetValue(), m.Untyped != nil
+	}
+	return 0, false
+}
+
+// matchLabels returns true if the labels satisfy every matcher. A label that is not
+// present is matched as the empty string.
+func matchLabels(ls labels.Labels, matchers []*labels.Matcher) bool {
+	for _, matcher := range matchers {
+		if !matcher.Matches(ls.Get(matcher.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func lessLabels(a, b []prompb.Label) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Name != b[i].Name {
+			return a[i].Name < b[i].Name
+		}
+		if a[i].Value != b[i].Value {
+			return a[i].Value < b[i].Value
+		}
+	}
+	return len(a) < len(b)
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func labeledFamily(name string, labels map[string]string, timestamps ...int64) *clientmodel.MetricFamily {
+	f := family(name, timestamps...)
+	for _, m := range f.Metric {
+		for k, v := range labels {
+			k, v := k, v
+			m.Label = append(m.Label, &clientmodel.LabelPair{Name: &k, Value: &v})
+		}
+	}
+	return f
+}
+
+func readRequest(t *testing.T, queries ...*prompb.Query) []byte {
+	data, err := proto.Marshal(&prompb.ReadRequest{Queries: queries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snappy.Encode(nil, data)
+}
+
+func series(samples []int64, labels ...string) *prompb.TimeSeries {
+	ts := &prompb.TimeSeries{}
+	for i := 0; i < len(labels); i += 2 {
+		ts.Labels = append(ts.Labels, prompb.Label{Name: labels[i], Value: labels[i+1]})
+	}
+	for _, s := range samples {
+		ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: s, Value: 1})
+	}
+	return ts
+}
+
+func TestServer_Read(t *testing.T) {
+	s := New(storeWithData(map[string][]*clientmodel.MetricFamily{
+		"cluster-1": {
+			labeledFamily("up", map[string]string{"cluster": "a", "job": "api"}, 1000, 2000, 3000),
+			labeledFamily("cpu", map[string]string{"cluster": "a"}, 2000),
+		},
+		"cluster-2": {
+			labeledFamily("up", map[string]string{"cluster": "b", "job": "etcd"}, 2000),
+		},
+	}), nil, nil, 10*time.Minute)
+
+	matcher := func(t prompb.LabelMatcher_Type, name, value string) *prompb.LabelMatcher {
+		return &prompb.LabelMatcher{Type: t, Name: name, Value: value}
+	}
+	tests := []struct {
+		name     string
+		matchers []*prompb.LabelMatcher
+		start    int64
+		end      int64
+		want     []*prompb.TimeSeries
+	}{
+		{
+			name:     "metric name",
+			matchers: []*prompb.LabelMatcher{matcher(prompb.LabelMatcher_EQ, "__name__", "up")},
+			start:    0, end: 5000,
+			want: []*prompb.TimeSeries{
+				series([]int64{1000, 2000, 3000}, "__name__", "up", "cluster", "a", "job", "api"),
+				series([]int64{2000}, "__name__", "up", "cluster", "b", "job", "etcd"),
+			},
+		},
+		{
+			name: "metric name and cluster",
+			matchers: []*prompb.LabelMatcher{
+				matcher(prompb.LabelMatcher_EQ, "__name__", "up"),
+				matcher(prompb.LabelMatcher_EQ, "cluster", "b"),
+			},
+			start: 0, end: 5000,
+			want: []*prompb.TimeSeries{
+				series([]int64{2000}, "__name__", "up", "cluster", "b", "job", "etcd"),
+			},
+		},
+		{
+			name:     "regex on cluster",
+			matchers: []*prompb.LabelMatcher{matcher(prompb.LabelMatcher_RE, "cluster", "a|c")},
+			start:    0, end: 5000,
+			want: []*prompb.TimeSeries{
+				series([]int64{2000}, "__name__", "cpu", "cluster", "a"),
+				series([]int64{1000, 2000, 3000}, "__name__", "up", "cluster", "a", "job", "api"),
+			},
+		},
+		{
+			name: "negative matchers",
+			matchers: []*prompb.LabelMatcher{
+				matcher(prompb.LabelMatcher_NEQ, "job", "api"),
+				matcher(prompb.LabelMatcher_NRE, "__name__", "c.*"),
+			},
+			start: 0, end: 5000,
+			want: []*prompb.TimeSeries{
+				series([]int64{2000}, "__name__", "up", "cluster", "b", "job", "etcd"),
+			},
+		},
+		{
+			name:     "absent label matches empty value",
+			matchers: []*prompb.LabelMatcher{matcher(prompb.LabelMatcher_EQ, "job", "")},
+			start:    0, end: 5000,
+			want: []*prompb.TimeSeries{
+				series([]int64{2000}, "__name__", "cpu", "cluster", "a"),
+			},
+		},
+		{
+			name:     "time range is inclusive",
+			matchers: []*prompb.LabelMatcher{matcher(prompb.LabelMatcher_EQ, "job", "api")},
+			start:    2000, end: 3000,
+			want: []*prompb.TimeSeries{
+				series([]int64{2000, 3000}, "__name__", "up", "cluster", "a", "job", "api"),
+			},
+		},
+		{
+			name:     "no match",
+			matchers: []*prompb.LabelMatcher{matcher(prompb.LabelMatcher_EQ, "__name__", "missing")},
+			start:    0, end: 5000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := readRequest(t, &prompb.Query{StartTimestampMs: tt.start, EndTimestampMs: tt.end, Matchers: tt.matchers})
+			w := httptest.NewRecorder()
+			s.Read(w, httptest.NewRequest("POST", "/api/v1/read", bytes.NewReader(body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/x-protobuf" {
+				t.Errorf("unexpected content type %q", got)
+			}
+
+			compressed, _ := ioutil.ReadAll(w.Body)
+			data, err := snappy.Decode(nil, compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resp prompb.ReadResponse
+			if err := proto.Unmarshal(data, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Results) != 1 {
+				t.Fatalf("expected one result, got %d", len(resp.Results))
+			}
+			if !reflect.DeepEqual(resp.Results[0].Timeseries, tt.want) {
+				t.Errorf("Read() = %v, want %v", resp.Results[0].Timeseries, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_ReadInvalid(t *testing.T) {
+	s := New(storeWithData(nil), nil, nil, 10*time.Minute)
+
+	tests := []struct {
+		name   string
+		method string
+		body   []byte
+		want   int
+	}{
+		{name: "get", method: "GET", want: http.StatusMethodNotAllowed},
+		{name: "not snappy", method: "POST", body: []byte("\xff\xff\xff"), want: http.StatusBadRequest},
+		{name: "not a read request", method: "POST", body: snappy.Encode(nil, []byte("\xff\xff\xff")), want: http.StatusBadRequest},
+		{name: "too large", method: "POST", body: make([]byte, maxReadRequestBytes+1), want: http.StatusRequestEntityTooLarge},
+		{name: "decompresses too large", method: "POST", body: snappy.Encode(nil, make([]byte, maxReadRequestBytes+1)), want: http.StatusRequestEntityTooLarge},
+		{
+			name:   "invalid regex",
+			method: "POST",
+			body: readRequest(t, &prompb.Query{Matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_RE, Name: "cluster", Value: "("},
+			}}),
+			want: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.Read(w, httptest.NewRequest(tt.method, "/api/v1/read", bytes.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Errorf("unexpected status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
@@ -1,48 +1,176 @@
 package server
 
 import (
+	"bufio"
 	"context"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/golang/snappy"
+	opentracing "github.com/opentracing/opentracing-go"
 	clientmodel "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/logthrottle"
 	"github.com/openshift/telemeter/pkg/metricfamily"
 	"github.com/openshift/telemeter/pkg/store"
-	"github.com/openshift/telemeter/pkg/store/ratelimited"
 	"github.com/openshift/telemeter/pkg/validate"
 )
 
+// Default limits of the introspection API responses.
+const (
+	defaultMaxLabelValues = 10000
+	defaultMaxSeries      = 10000
+)
+
+// defaultMaxReportedDrops is the default number of dropped series listed when rejecting partial uploads.
+const defaultMaxReportedDrops = 10
+
+// acceptedFormats lists the upload formats Post is able to decode.
+var acceptedFormats = []expfmt.Format{expfmt.FmtProtoDelim, expfmt.FmtText}
+
 type Server struct {
+	// Lenient disables strict Content-Type checking of uploads. When set,
+	// requests with a missing or unsupported Content-Type are decoded as
+	// text as they were before the check was introduced.
+	Lenient bool
+
+	// MaxUncompressedBytes limits the size of a compressed upload once decompressed.
+	// A zero value disables the limit.
+	MaxUncompressedBytes int64
+
+	// MaxSamplesPerUpload bounds the samples retained from a single upload, unless the
+	// authorized client carries its own limit. A zero value disables the limit.
+	MaxSamplesPerUpload int
+
+	// RejectPartialUploads responds with 422 instead of storing the rest of an upload if any
+	// series are dropped while validating or filtering it. Up to MaxReportedDrops of the
+	// dropped series are listed in the response.
+	RejectPartialUploads bool
+	MaxReportedDrops     int
+
+	// EnforceClientLabels sets the labels of the authorized client on every uploaded series,
+	// overwriting conflicting values. With RejectLabelConflicts, uploads with a conflicting
+	// value are rejected instead.
+	EnforceClientLabels  bool
+	RejectLabelConflicts bool
+
+	// FailureLog, if set, aggregates the logging of failed uploads by client and error code.
+	FailureLog *logthrottle.Logger
+
+	// PartitionLabel is the label the partition key is exposed as by the read and
+	// introspection APIs, for series that do not already carry it.
+	PartitionLabel string
+
+	// Partitioner, if set, derives the partition of uploads from the authorized client. The
+	// partition is set as the PartitionLabel of the client before validation, so that it is
+	// used as partition key, forwarded tenant and injected label alike.
+	Partitioner authorize.Partitioner
+
+	// MaxLabelValues and MaxSeries bound the responses of LabelValues and Series.
+	// Results beyond the limit are omitted and the response is marked truncated.
+	// A zero value disables the limit.
+	MaxLabelValues int
+	MaxSeries      int
+
 	maxSampleAge time.Duration
 	store        store.Store
 	transformer  metricfamily.Transformer
 	validator    validate.Validator
 	nowFn        func() time.Time
+	parts        *partAssembler
 }
 
 func New(store store.Store, validator validate.Validator, transformer metricfamily.Transformer, maxSampleAge time.Duration) *Server {
 	return &Server{
-		maxSampleAge: maxSampleAge,
-		store:        store,
-		transformer:  transformer,
-		validator:    validator,
-		nowFn:        time.Now,
+		MaxLabelValues:   defaultMaxLabelValues,
+		MaxSeries:        defaultMaxSeries,
+		MaxReportedDrops: defaultMaxReportedDrops,
+		maxSampleAge:     maxSampleAge,
+		store:            store,
+		transformer:      transformer,
+		validator:        validator,
+		nowFn:            time.Now,
+		parts:            newPartAssembler(),
 	}
 }
 
 func NewNonExpiring(store store.Store, validator validate.Validator, transformer metricfamily.Transformer, maxSampleAge time.Duration) *Server {
 	return &Server{
-		maxSampleAge: maxSampleAge,
-		store:        store,
-		transformer:  transformer,
-		validator:    validator,
-		nowFn:        nil,
+		MaxLabelValues:   defaultMaxLabelValues,
+		MaxSeries:        defaultMaxSeries,
+		MaxReportedDrops: defaultMaxReportedDrops,
+		maxSampleAge:     maxSampleAge,
+		store:            store,
+		transformer:      transformer,
+		validator:        validator,
+		nowFn:            nil,
+		parts:            newPartAssembler(),
+	}
+}
+
+// readFilter scopes the metrics returned by Get.
+type readFilter struct {
+	partitions []string
+	since      time.Time
+	names      map[string]struct{}
+}
+
+// parseReadFilter parses the "partition", "since" and "match[]" query parameters of a read.
+// The "since" parameter is either an RFC3339 timestamp or milliseconds since the epoch.
+func parseReadFilter(req *http.Request) (*readFilter, *Error) {
+	q := req.URL.Query()
+	f := &readFilter{}
+
+	for _, p := range q["partition"] {
+		if len(p) == 0 {
+			return nil, newError(CodeInvalidParameter, "the 'partition' parameter must not be empty")
+		}
+		f.partitions = append(f.partitions, p)
+	}
+
+	if since := q.Get("since"); len(since) > 0 {
+		if ms, err := strconv.ParseInt(since, 10, 64); err == nil {
+			f.since = time.Unix(0, ms*int64(time.Millisecond))
+		} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+			f.since = t
+		} else {
+			return nil, newError(CodeInvalidParameter, "the 'since' parameter must be an RFC3339 timestamp or milliseconds since the epoch: %q", since)
+		}
+	}
+
+	for _, name := range q["match[]"] {
+		if len(name) == 0 {
+			return nil, newError(CodeInvalidParameter, "the 'match[]' parameter must not be empty")
+		}
+		if f.names == nil {
+			f.names = make(map[string]struct{})
+		}
+		f.names[name] = struct{}{}
+	}
+
+	return f, nil
+}
+
+// minTimestampMs returns the earliest timestamp requested, or 0 if unbounded.
+func (f *readFilter) minTimestampMs() int64 {
+	if f.since.IsZero() {
+		return 0
+	}
+	return f.since.UnixNano() / int64(time.Millisecond)
+}
+
+// matches returns true if the family was requested.
+func (f *readFilter) matches(family *clientmodel.MetricFamily) bool {
+	if f.names == nil {
+		return true
 	}
+	_, ok := f.names[family.GetName()]
+	return ok
 }
 
 func (s *Server) Get(w http.ResponseWriter, req *http.Request) {
@@ -50,111 +178,385 @@ func (s *Server) Get(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	rf, ferr := parseReadFilter(req)
+	if ferr != nil {
+		writeErrorWithStatus(w, req, http.StatusBadRequest, ferr)
+		return
+	}
 	format := expfmt.Negotiate(req.Header)
 	encoder := expfmt.NewEncoder(w, format)
-	ctx := context.Background()
 
 	// samples older than 10 minutes must be ignored
-	var minTimeMs int64
+	minTimeMs := rf.minTimestampMs()
 	var filter metricfamily.MultiTransformer
 	if s.nowFn != nil {
 		filter.With(metricfamily.NewDropExpiredSamples(s.nowFn().Add(-s.maxSampleAge)))
+	}
+	if minTimeMs > 0 {
+		filter.With(metricfamily.NewDropExpiredSamples(rf.since))
+	}
+	if s.nowFn != nil || minTimeMs > 0 {
 		filter.With(metricfamily.TransformerFunc(metricfamily.PackMetrics))
 	}
 
-	ps, err := s.store.ReadMetrics(ctx, minTimeMs)
+	ps, err := s.readPartitions(req.Context(), minTimeMs, rf.partitions...)
 	if err != nil {
 		log.Printf("error reading metrics: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	var families []*clientmodel.MetricFamily
 	for _, p := range ps {
 		for _, family := range p.Families {
-			if family == nil {
+			if family == nil || !rf.matches(family) {
 				continue
 			}
 			if ok, err := filter.Transform(family); err != nil || !ok {
 				continue
 			}
-			if err := encoder.Encode(family); err != nil {
-				log.Printf("error encoding metrics family: %v", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				continue
-			}
+			families = append(families, family)
+		}
+	}
+
+	// families of the same name read from several partitions are encoded once
+	for _, family := range metricfamily.Normalize(families) {
+		if err := encoder.Encode(family); err != nil {
+			log.Printf("error encoding metrics family: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			continue
 		}
 	}
 }
 
+// Post stores an upload of metrics. It is served as /upload/v1, and as /upload for clients
+// predating versioned endpoints.
 func (s *Server) Post(w http.ResponseWriter, req *http.Request) {
+	s.post(w, req, false)
+}
+
+// PostV2 stores an upload of metrics preceded by a validate.Envelope, which is made available
+// to the validator through the request context. The agent version it reports is stored in
+// the ClientInfoMetric family alongside the metrics.
+func (s *Server) PostV2(w http.ResponseWriter, req *http.Request) {
+	s.post(w, req, true)
+}
+
+func (s *Server) post(w http.ResponseWriter, req *http.Request, withEnvelope bool) {
 	if req.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeErrorWithStatus(w, req, http.StatusMethodNotAllowed, newError(CodeMethodNotAllowed, "only POST is allowed to this endpoint"))
 		return
 	}
 	defer req.Body.Close()
 
-	ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+	if s.Partitioner != nil {
+		if client, ok := authorize.FromContext(req.Context()); ok {
+			partitioned, ok := authorize.WithPartition(client, s.PartitionLabel, s.Partitioner)
+			if !ok {
+				s.writeUploadError(w, req, validate.ErrMissingPartitionKey(s.PartitionLabel))
+				return
+			}
+			req = req.WithContext(authorize.WithClient(req.Context(), partitioned))
+		}
+	}
+
+	ctx := req.Context()
+	header := req.Header
+	var envelope *validate.Envelope
+	var envelopeLine []byte
+	if withEnvelope {
+		br := bufio.NewReaderSize(req.Body, maxEnvelopeBytes)
+		var eerr *Error
+		envelope, envelopeLine, eerr = readEnvelope(br)
+		if eerr != nil {
+			writeErrorWithStatus(w, req, http.StatusBadRequest, eerr)
+			return
+		}
+		req.Body = body{Reader: br, Closer: req.Body}
+		ctx = validate.WithEnvelope(ctx, envelope)
+		if len(envelope.Format) > 0 {
+			header = http.Header{"Content-Type": []string{envelope.Format}}
+		}
+	}
+
+	format, ferr := s.uploadFormat(header)
+	if ferr != nil {
+		writeErrorWithStatus(w, req, http.StatusUnsupportedMediaType, ferr)
+		return
+	}
+	encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+	if !isAcceptedEncoding(encoding) {
+		w.Header().Set("Accept-Encoding", strings.Join(acceptedEncodings, ", "))
+		writeErrorWithStatus(w, req, http.StatusUnsupportedMediaType, newError(CodeUnsupportedEncoding, "unsupported Content-Encoding %q, accepted encodings are: %s", encoding, strings.Join(acceptedEncodings, ", ")))
+		return
+	}
+
+	checksum, cerr := uploadChecksum(req.Header)
+	if cerr != nil {
+		writeErrorWithStatus(w, req, http.StatusBadRequest, cerr)
+		return
+	}
+
+	if p, ok := requestPart(req); ok {
+		ctx = withPart(ctx, p)
+	}
+	ctx, report := validate.WithReport(ctx)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	partitionKey, transforms, err := s.validator.Validate(ctx, req)
+	// the upload is validated with the same rules throughout, even if they are reloaded
+	validator := s.validator
+	if r, ok := validator.(validate.Reloadable); ok {
+		validator = r.Current()
+	}
+
+	// the validator bounds the size of the decoded body, while the checksum covers the body as
+	// sent, before decompression
+	var r io.Reader = req.Body
+	var cr *checksumReader
+	if checksum != nil {
+		cr = newChecksumReader(r, checksum)
+		cr.h.Write(envelopeLine)
+		r = cr
+	}
+	req.Body = body{Reader: newDecodingReader(encoding, r, s.MaxUncompressedBytes), Closer: req.Body}
+
+	span, validateCtx := startSpan(ctx, "validate")
+	partitionKey, transforms, err := s.validateRequest(validateCtx, validator, req)
+	span.Finish()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.writeUploadError(w, req, err)
 		return
 	}
 
+	var clientLabels map[string]string
+	maxSamples := s.MaxSamplesPerUpload
+	if client, ok := authorize.FromContext(req.Context()); ok {
+		clientLabels = client.Labels
+		if client.Limits.MaxSamplesPerUpload > 0 {
+			maxSamples = client.Limits.MaxSamplesPerUpload
+		}
+	}
+	// the labels of the authorizer replace those sent by the client
+	replaceLabels, err := metricfamily.NewLabelReplacer(clientLabels)
+	if err != nil {
+		log.Printf("error: the authorizer returned invalid client labels: %v", err)
+		s.writeUploadError(w, req, err)
+		return
+	}
+
+	var info *clientmodel.MetricFamily
+	if envelope != nil {
+		// the info metric carries the client labels and is timestamped by the validator
+		// like uploaded metrics
+		info = clientInfoFamily(envelope.AgentVersion, s.now())
+		validation := metricfamily.All(replaceLabels, transforms)
+		ok, err := validation.Transform(info)
+		if err != nil {
+			s.writeUploadError(w, req, err)
+			return
+		}
+		if !ok {
+			info = nil
+		}
+	}
+
 	var t metricfamily.MultiTransformer
-	t.With(transforms)
-	t.With(s.transformer)
+	maxDropped := 0
+	if s.RejectPartialUploads {
+		maxDropped = s.MaxReportedDrops
+	}
+	summary := newUploadSummary(maxDropped)
+	if s.EnforceClientLabels {
+		if s.RejectLabelConflicts {
+			t.With(metricfamily.NewStrictLabel(clientLabels))
+		} else {
+			t.With(replaceLabels)
+		}
+	}
+	t.With(summary.countDropped(DroppedInvalid, transforms))
+	t.With(summary.countDropped(DroppedFiltered, s.transformer))
 
 	// read the response into memory
-	format := expfmt.ResponseFormat(req.Header)
-	var r io.Reader = req.Body
-	if req.Header.Get("Content-Encoding") == "snappy" {
-		r = snappy.NewReader(r)
-	}
-	decoder := expfmt.NewDecoder(r, format)
+	decoder := expfmt.NewDecoder(req.Body, format)
 
-	errCh := make(chan error)
-	go func() { errCh <- s.decodeAndStoreMetrics(ctx, partitionKey, decoder, t) }()
+	// buffered so the decoder can exit if the request times out first
+	errCh := make(chan error, 1)
+	go func() {
+		span, ctx := startSpan(ctx, "store")
+		defer span.Finish()
+		err := s.decodeAndStoreMetrics(ctx, validator, partitionKey, decoder, t, maxSamples, summary, info)
+		if err != nil {
+			span.SetTag("error", true)
+		}
+		errCh <- err
+	}()
 
 	select {
 	case <-ctx.Done():
-		http.Error(w, "Timeout while storing metrics", http.StatusInternalServerError)
-		log.Printf("timeout processing incoming request")
+		s.writeUploadError(w, req, newError(CodeTimeout, "timeout while storing metrics"))
 		return
 	case err := <-errCh:
-		switch err {
-		case nil:
-			break
-		case ratelimited.ErrWriteLimitReached(partitionKey):
-			http.Error(w, err.Error(), http.StatusTooManyRequests)
-		default:
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if fired := report.Fired(); len(fired) > 0 {
+			w.Header().Set(ReportOnlyHeader, strings.Join(fired, ","))
+		}
+		if err != nil && cr != nil {
+			// a corrupted body is likely to fail decoding before the digest is checked
+			if cerr := cr.verify(); cerr != nil {
+				err = cerr
+			}
 		}
+		if err != nil {
+			if _, split := partFrom(ctx); split && rejected(err) {
+				// the client does not send a rejected part again, so the others are stored without it
+				if err := s.storeUpload(ctx, partitionKey, nil, nil); err != nil {
+					log.Printf("error: unable to store the upload of %s without its rejected part: %v", partitionKey, err)
+				}
+			}
+			retryAfter(w, err, s.now())
+			s.writeUploadError(w, req, err)
+			return
+		}
+		// the validator records the state of its checks once the upload is stored
+		if c, ok := transforms.(validate.Committer); ok {
+			c.Commit()
+		}
+		if summary.Series == 0 {
+			writeEmptyUpload(w, req, summary)
+			return
+		}
+		summary.NotAllowlisted = report.NotAllowlisted()
+		writeSummary(w, req, summary)
 		return
 	}
 }
 
-func (s *Server) decodeAndStoreMetrics(ctx context.Context, partitionKey string, decoder expfmt.Decoder, transformer metricfamily.Transformer) error {
+// readPartitions reads the partitions of the keys, or all partitions if none are given, that
+// the request may read. Requests restricted to a partition read at most that partition.
+func (s *Server) readPartitions(ctx context.Context, minTimestampMs int64, partitionKeys ...string) ([]*store.PartitionedMetrics, error) {
+	if partition, ok := authorize.ReadPartitionFromContext(ctx); ok {
+		requested := len(partitionKeys) == 0
+		for _, k := range partitionKeys {
+			requested = requested || k == partition
+		}
+		if !requested {
+			return nil, nil
+		}
+		partitionKeys = []string{partition}
+	}
+	return store.ReadPartitions(ctx, s.store, minTimestampMs, partitionKeys...)
+}
+
+// validateRequest returns the partition key of an upload and the transformer of its families,
+// if the validator checks requests. Otherwise the partition key is the PartitionLabel of the
+// client.
+func (s *Server) validateRequest(ctx context.Context, validator validate.Validator, req *http.Request) (string, metricfamily.Transformer, error) {
+	if v, ok := validator.(validate.RequestValidator); ok {
+		return v.Validate(ctx, req)
+	}
+	client, ok := authorize.FromContext(ctx)
+	if !ok {
+		return "", nil, validate.ErrNoClient
+	}
+	if len(client.Labels[s.PartitionLabel]) == 0 {
+		return "", nil, validate.ErrMissingPartitionKey(s.PartitionLabel)
+	}
+	return client.Labels[s.PartitionLabel], nil, nil
+}
+
+// startSpan starts a child of the span in ctx and returns a context holding it. If the
+// request is not traced, the returned span is a no-op.
+func startSpan(ctx context.Context, operation string) (opentracing.Span, context.Context) {
+	parent := opentracing.SpanFromContext(ctx)
+	if parent == nil {
+		return opentracing.NoopTracer{}.StartSpan(operation), ctx
+	}
+	span := parent.Tracer().StartSpan(operation, opentracing.ChildOf(parent.Context()))
+	return span, opentracing.ContextWithSpan(ctx, span)
+}
+
+func (s *Server) now() time.Time {
+	if s.nowFn == nil {
+		return time.Now()
+	}
+	return s.nowFn()
+}
+
+// uploadFormat returns the format declared by the Content-Type header of an upload.
+// An error is returned if the header is missing or names a format that cannot be decoded,
+// unless the server is lenient.
+func (s *Server) uploadFormat(h http.Header) (expfmt.Format, *Error) {
+	format := expfmt.ResponseFormat(h)
+	if format != expfmt.FmtUnknown || s.Lenient {
+		return format, nil
+	}
+
+	accepted := make([]string, 0, len(acceptedFormats))
+	for _, f := range acceptedFormats {
+		accepted = append(accepted, string(f))
+	}
+	var err *Error
+	if len(h.Get("Content-Type")) == 0 {
+		err = newError(CodeUnsupportedContentType, "missing Content-Type, accepted types are: %s", strings.Join(accepted, ", "))
+	} else {
+		err = newError(CodeUnsupportedContentType, "unsupported Content-Type %q, accepted types are: %s", h.Get("Content-Type"), strings.Join(accepted, ", "))
+	}
+	err.Details = map[string]interface{}{"accepted": accepted}
+	return format, err
+}
+
+// decodeAndStoreMetrics decodes one family at a time from the request, applying the
+// transformer to each before the next is read. Only families that survive the transformer
+// are retained, and the first error aborts decoding without consuming the rest of the body.
+// Uploads retaining more than maxSamples samples are rejected, unless it is zero.
+// The retained families are then validated together by the validator, and
+// those it keeps and their series are recorded in summary. If info is set, it is stored
+// in place of any uploaded family of the same name and is not counted in the summary.
+// Uploads without series left are not stored at all, unless they are a part of a split upload.
+func (s *Server) decodeAndStoreMetrics(ctx context.Context, validator validate.Validator, partitionKey string, decoder expfmt.Decoder, transformer metricfamily.Transformer, maxSamples int, summary *UploadSummary, info *clientmodel.MetricFamily) error {
 	families := make([]*clientmodel.MetricFamily, 0, 100)
+	count := metricfamily.NewCount(maxSamples, nil)
 	for {
 		family := &clientmodel.MetricFamily{}
-		families = append(families, family)
 		if err := decoder.Decode(family); err != nil {
 			if err == io.EOF {
 				break
 			}
 			return err
 		}
-	}
 
-	if err := metricfamily.Filter(families, transformer); err != nil {
-		return err
+		if info != nil && family.GetName() == info.GetName() {
+			continue
+		}
+
+		ok, err := transformer.Transform(family)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if _, err := count.Transform(family); err != nil {
+			return &ErrTooManySamples{Limit: maxSamples}
+		}
+		families = append(families, family)
+	}
+	if s.RejectPartialUploads && summary.dropped() > 0 {
+		return &ErrSeriesDropped{Dropped: summary.Dropped, Series: summary.droppedSeries}
+	}
+	if client, ok := authorize.FromContext(ctx); ok {
+		var err error
+		if families, err = validator.ValidateUpload(ctx, client, families); err != nil {
+			return err
+		}
 	}
 	families = metricfamily.Pack(families)
+	summary.Families = len(families)
+	summary.Series = metricfamily.MetricsCount(families)
+	summary.Samples = summary.Series
+	if _, split := partFrom(ctx); summary.Series == 0 && !split {
+		return nil
+	}
 
-	return s.store.WriteMetrics(ctx, &store.PartitionedMetrics{
-		PartitionKey: partitionKey,
-		Families:     families,
-	})
+	return s.storeUpload(ctx, partitionKey, families, info)
 }
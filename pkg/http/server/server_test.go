@@ -2,19 +2,47 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/authorize/jwt"
+	"github.com/openshift/telemeter/pkg/cache"
+	"github.com/openshift/telemeter/pkg/logthrottle"
+	"github.com/openshift/telemeter/pkg/metricfamily"
 	"github.com/openshift/telemeter/pkg/store"
+	"github.com/openshift/telemeter/pkg/store/forward"
 	"github.com/openshift/telemeter/pkg/store/memstore"
+	"github.com/openshift/telemeter/pkg/store/quota"
+	"github.com/openshift/telemeter/pkg/store/ratelimited"
 	"github.com/openshift/telemeter/pkg/validate"
+	"github.com/prometheus/client_golang/prometheus"
 	clientmodel "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/prompb"
 )
 
 func family(name string, timestamps ...int64) *clientmodel.MetricFamily {
@@ -50,6 +78,17 @@ func TestServer_Get(t *testing.T) {
 		validator validate.Validator
 		nowFn     func() time.Time
 	}
+	data := func() map[string][]*clientmodel.MetricFamily {
+		return map[string][]*clientmodel.MetricFamily{
+			"cluster-1": {
+				family("test_1", 1000000, 1002000, 1004000),
+				family("test_2", 1000000, 1002000, 1004000),
+			},
+			"cluster-2": {
+				family("test_3", 1100000),
+			},
+		}
+	}
 	tests := []struct {
 		name         string
 		fields       fields
@@ -68,15 +107,102 @@ func TestServer_Get(t *testing.T) {
 				}),
 				nowFn: func() time.Time { return time.Unix(1001+10*60, 0) },
 			},
-			req: &http.Request{
-				Method: "GET",
-			},
+			req: httptest.NewRequest("GET", "/federate", nil),
 			wantFamilies: []*clientmodel.MetricFamily{
 				family("test_1", 1002000, 1004000),
 				family("test_2", 1002000, 1004000),
 			},
 			wantCode: 200,
 		},
+		{
+			name:   "partition",
+			fields: fields{store: storeWithData(data())},
+			req:    httptest.NewRequest("GET", "/federate?partition=cluster-2", nil),
+			wantFamilies: []*clientmodel.MetricFamily{
+				family("test_3", 1100000),
+			},
+			wantCode: 200,
+		},
+		{
+			name:   "partition without partition reader",
+			fields: fields{store: struct{ store.Store }{storeWithData(data())}},
+			req:    httptest.NewRequest("GET", "/federate?partition=cluster-2&partition=cluster-3", nil),
+			wantFamilies: []*clientmodel.MetricFamily{
+				family("test_3", 1100000),
+			},
+			wantCode: 200,
+		},
+		{
+			name:   "since milliseconds",
+			fields: fields{store: storeWithData(data())},
+			req:    httptest.NewRequest("GET", "/federate?since=1003000", nil),
+			wantFamilies: []*clientmodel.MetricFamily{
+				family("test_1", 1004000),
+				family("test_2", 1004000),
+				family("test_3", 1100000),
+			},
+			wantCode: 200,
+		},
+		{
+			name:   "since RFC3339",
+			fields: fields{store: storeWithData(data())},
+			req:    httptest.NewRequest("GET", "/federate?since="+time.Unix(1005, 0).UTC().Format(time.RFC3339), nil),
+			wantFamilies: []*clientmodel.MetricFamily{
+				family("test_3", 1100000),
+			},
+			wantCode: 200,
+		},
+		{
+			name:   "match",
+			fields: fields{store: storeWithData(data())},
+			req:    httptest.NewRequest("GET", "/federate?match[]=test_2", nil),
+			wantFamilies: []*clientmodel.MetricFamily{
+				family("test_2", 1000000, 1002000, 1004000),
+			},
+			wantCode: 200,
+		},
+		{
+			name:   "combined",
+			fields: fields{store: storeWithData(data())},
+			req:    httptest.NewRequest("GET", "/federate?partition=cluster-1&since=1001000&match[]=test_1", nil),
+			wantFamilies: []*clientmodel.MetricFamily{
+				family("test_1", 1002000, 1004000),
+			},
+			wantCode: 200,
+		},
+		{
+			name:   "read partition",
+			fields: fields{store: storeWithData(data())},
+			req:    httptest.NewRequest("GET", "/federate", nil).WithContext(authorize.WithReadPartition(context.Background(), "cluster-2")),
+			wantFamilies: []*clientmodel.MetricFamily{
+				family("test_3", 1100000),
+			},
+			wantCode: 200,
+		},
+		{
+			name:     "read partition, other partition requested",
+			fields:   fields{store: storeWithData(data())},
+			req:      httptest.NewRequest("GET", "/federate?partition=cluster-1", nil).WithContext(authorize.WithReadPartition(context.Background(), "cluster-2")),
+			wantCode: 200,
+		},
+		{
+			name:     "invalid since",
+			fields:   fields{store: storeWithData(data())},
+			req:      httptest.NewRequest("GET", "/federate?since=yesterday", nil),
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "empty partition",
+			fields:   fields{store: storeWithData(data())},
+			req:      httptest.NewRequest("GET", "/federate?partition=", nil),
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "empty match",
+			fields:   fields{store: storeWithData(data())},
+			req:      httptest.NewRequest("GET", "/federate?match[]=", nil),
+			wantCode: http.StatusBadRequest,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -91,6 +217,16 @@ func TestServer_Get(t *testing.T) {
 			if w.Code != tt.wantCode {
 				t.Fatalf("unexpected code %d", w.Code)
 			}
+			if w.Code != http.StatusOK {
+				var body Error
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatal(err)
+				}
+				if body.Code != CodeInvalidParameter {
+					t.Fatalf("unexpected body %s", w.Body.String())
+				}
+				return
+			}
 			families, err := read(w.Body)
 			if err != nil {
 				t.Fatal(err)
@@ -104,26 +240,1422 @@ func TestServer_Get(t *testing.T) {
 	}
 }
 
-func familiesToText(families []*clientmodel.MetricFamily) string {
+type testValidator struct {
+	partitionKey string
+	transformer  metricfamily.Transformer
+}
+
+func (v testValidator) Validate(ctx context.Context, req *http.Request) (string, metricfamily.Transformer, error) {
+	return v.partitionKey, v.transformer, nil
+}
+
+func (v testValidator) ValidateUpload(ctx context.Context, client *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+	return families, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func encodeFamilies(families []*clientmodel.MetricFamily) []byte {
 	buf := &bytes.Buffer{}
+	encoder := expfmt.NewEncoder(buf, expfmt.FmtProtoDelim)
 	for _, f := range families {
-		_, _ = expfmt.MetricFamilyToText(buf, f)
+		if err := encoder.Encode(f); err != nil {
+			panic(err)
+		}
 	}
-	return buf.String()
+	return buf.Bytes()
 }
 
-func read(r io.Reader) ([]*clientmodel.MetricFamily, error) {
-	decoder := expfmt.NewDecoder(r, expfmt.FmtText)
-	families := make([]*clientmodel.MetricFamily, 0, 100)
-	for {
-		family := &clientmodel.MetricFamily{}
-		if err := decoder.Decode(family); err != nil {
-			if err == io.EOF {
-				break
+func largeUpload(bytes int) []byte {
+	var families []*clientmodel.MetricFamily
+	size := 0
+	for i := 0; size < bytes; i++ {
+		f := family(fmt.Sprintf("test_%d", i), 1000000, 1002000, 1004000)
+		families = append(families, f)
+		size += proto.Size(f)
+	}
+	return encodeFamilies(families)
+}
+
+func TestServer_PostStopsReadingOnError(t *testing.T) {
+	// The first family lacks timestamps, the rest of the upload must not be read.
+	data := append(encodeFamilies([]*clientmodel.MetricFamily{family("invalid", -1)}), largeUpload(1024*1024)...)
+	body := &countingReader{r: bytes.NewReader(data)}
+
+	s := New(memstore.New(10*time.Minute), testValidator{partitionKey: "cluster-1", transformer: metricfamily.NewErrorOnUnsorted(true)}, nil, 10*time.Minute)
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+	w := httptest.NewRecorder()
+	s.Post(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+	}
+	if body.n >= len(data)/2 {
+		t.Fatalf("expected decoding to stop early, read %d of %d bytes", body.n, len(data))
+	}
+}
+
+func TestServer_PostQuotaExceeded(t *testing.T) {
+	q := quota.New(1, time.Hour, 10, memstore.New(10*time.Minute))
+	s := New(q, testValidator{partitionKey: "cluster-1"}, nil, 10*time.Minute)
+	data := encodeFamilies([]*clientmodel.MetricFamily{family("test_1", 1000000)})
+
+	for i, wantCode := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(data))
+		req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+		w := httptest.NewRecorder()
+		s.Post(w, req)
+		if w.Code != wantCode {
+			t.Fatalf("upload %d: unexpected code %d: %s", i, w.Code, w.Body.String())
+		}
+		if wantCode != http.StatusTooManyRequests {
+			continue
+		}
+		var body Error
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Code != CodeQuotaExceeded || body.Details["quota"] != float64(1) || body.Details["used"] != float64(1) || body.Details["reset"] == nil {
+			t.Fatalf("unexpected body %s", w.Body.String())
+		}
+	}
+}
+
+func TestServer_PostFutureSamples(t *testing.T) {
+	now := time.Unix(1000, 0)
+	skew := int64(5 * 60 * 1000)
+
+	tests := []struct {
+		name      string
+		skew      time.Duration
+		clamp     bool
+		timestamp int64
+		wantCode  int
+		wantBody  string
+	}{
+		{name: "reject within skew", skew: 5 * time.Minute, timestamp: 1000000 + skew, wantCode: http.StatusOK},
+		{name: "reject past skew", skew: 5 * time.Minute, timestamp: 1000000 + skew + 1, wantCode: http.StatusBadRequest, wantBody: "metric test_1 has a sample with timestamp 1300001"},
+		{name: "clamp past skew", skew: 5 * time.Minute, clamp: true, timestamp: 1000000 + 2*skew, wantCode: http.StatusOK},
+		{name: "larger skew", skew: 10 * time.Minute, timestamp: 1000000 + 2*skew, wantCode: http.StatusOK},
+		{name: "disabled", timestamp: 1000000 + 100*skew, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := memstore.New(10 * time.Minute)
+			validator := validate.NewWithOptions("cluster", 0, 0, func() time.Time { return now }, validate.Options{MaxFutureSkew: tt.skew, ClampFutureSamples: tt.clamp})
+			s := New(store, validator, nil, 10*time.Minute)
+			s.nowFn = func() time.Time { return now }
+
+			f := family("test_1", tt.timestamp)
+			f.Metric[0].Label = []*clientmodel.LabelPair{{Name: proto.String("cluster"), Value: proto.String("test")}}
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(encodeFamilies([]*clientmodel.MetricFamily{f})))
+			req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+			req = req.WithContext(authorize.WithClient(req.Context(), &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}}))
+			w := httptest.NewRecorder()
+			s.Post(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
 			}
-			return nil, err
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Fatalf("unexpected body %q", w.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			ps, err := store.ReadMetrics(context.Background(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the validator stamps the stored samples with the time of the upload
+			if got := ps[0].Families[0].Metric[0].GetTimestampMs(); got != now.UnixNano()/int64(time.Millisecond) {
+				t.Fatalf("want the sample stored at %s, got %d", now, got)
+			}
+		})
+	}
+}
+
+func TestServer_PostDuplicates(t *testing.T) {
+	now := time.Unix(1000, 0)
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	// sample returns a sample of the series of the client at ts
+	sample := func(ts int64, value float64) *clientmodel.Metric {
+		return &clientmodel.Metric{
+			Label:       []*clientmodel.LabelPair{{Name: proto.String("cluster"), Value: proto.String("test")}},
+			Counter:     &clientmodel.Counter{Value: proto.Float64(value)},
+			TimestampMs: proto.Int64(ts),
+		}
+	}
+	// the series is sent twice at 999000, once in another family of the same name
+	body := encodeFamilies([]*clientmodel.MetricFamily{
+		{Name: proto.String("test_1"), Type: clientmodel.MetricType_COUNTER.Enum(), Metric: []*clientmodel.Metric{sample(998000, 1), sample(999000, 2)}},
+		{Name: proto.String("test_1"), Type: clientmodel.MetricType_COUNTER.Enum(), Metric: []*clientmodel.Metric{sample(999000, 3)}},
+	})
+
+	tests := []struct {
+		name     string
+		options  validate.Options
+		wantCode int
+		want     []string
+	}{
+		{name: "merged before the timestamps are overwritten", options: validate.Options{Duplicates: true}, wantCode: http.StatusOK, want: []string{fmt.Sprintf("%d=3", nowMs)}},
+		{name: "merged with the timestamps kept", options: validate.Options{Duplicates: true, KeepTimestamps: true}, wantCode: http.StatusOK, want: []string{"998000=1", "999000=3"}},
+		{name: "rejected", options: validate.Options{Duplicates: true, StrictDuplicates: true}, wantCode: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := memstore.New(10 * time.Minute)
+			s := New(store, validate.NewWithOptions("cluster", 0, 0, func() time.Time { return now }, tt.options), nil, 10*time.Minute)
+			s.nowFn = func() time.Time { return now }
+
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+			req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+			req = req.WithContext(authorize.WithClient(req.Context(), &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}}))
+			w := httptest.NewRecorder()
+			s.Post(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("want code %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			ps, err := store.ReadMetrics(context.Background(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range ps {
+				for _, f := range p.Families {
+					for _, m := range f.Metric {
+						got = append(got, fmt.Sprintf("%d=%v", m.GetTimestampMs(), m.GetCounter().GetValue()))
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want samples %v stored, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestServer_PostLimitBytes(t *testing.T) {
+	now := time.Unix(1000, 0)
+	f := family("test_1")
+	for i := 0; i < 100; i++ {
+		f.Metric = append(f.Metric, &clientmodel.Metric{
+			Label:       []*clientmodel.LabelPair{{Name: proto.String("cluster"), Value: proto.String("test")}, {Name: proto.String("instance"), Value: proto.String(fmt.Sprintf("instance-%d", i))}},
+			Counter:     &clientmodel.Counter{Value: proto.Float64(1)},
+			TimestampMs: proto.Int64(999000),
+		})
+	}
+	body := encodeFamilies([]*clientmodel.MetricFamily{f})
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(body)
+	gw.Close()
+	if gzipped.Len() >= len(body)/2 {
+		t.Fatalf("want the compressed body smaller than the limits, got %d of %d bytes", gzipped.Len(), len(body))
+	}
+
+	tests := []struct {
+		name     string
+		limit    int64
+		encoding string
+		body     []byte
+		wantCode int
+	}{
+		{name: "within the limit", limit: int64(len(body)) + 1, body: body, wantCode: http.StatusOK},
+		{name: "exactly the limit", limit: int64(len(body)), body: body, wantCode: http.StatusOK},
+		{name: "past the limit", limit: int64(len(body)) - 1, body: body, wantCode: http.StatusRequestEntityTooLarge},
+		{name: "compressed within the limit", limit: int64(len(body)), encoding: EncodingGzip, body: gzipped.Bytes(), wantCode: http.StatusOK},
+		// the limit applies to the decoded body, even if the compressed one is smaller
+		{name: "decoded past the limit", limit: int64(len(body)) - 1, encoding: EncodingGzip, body: gzipped.Bytes(), wantCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(memstore.New(10*time.Minute), validate.New("cluster", tt.limit, 0, func() time.Time { return now }), nil, 10*time.Minute)
+			s.nowFn = func() time.Time { return now }
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+			if len(tt.encoding) > 0 {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			req = req.WithContext(authorize.WithClient(req.Context(), &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}}))
+			w := httptest.NewRecorder()
+			s.Post(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("want code %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServer_PostErrorCodes(t *testing.T) {
+	now := time.Unix(1000, 0)
+	labels := map[string]string{"cluster": "test"}
+	withLabel := func(f *clientmodel.MetricFamily) *clientmodel.MetricFamily {
+		name, value := "cluster", "test"
+		for _, m := range f.Metric {
+			m.Label = append(m.Label, &clientmodel.LabelPair{Name: &name, Value: &value})
+		}
+		return f
+	}
+	counter := func(f *clientmodel.MetricFamily) *clientmodel.MetricFamily {
+		f.Type = clientmodel.MetricType_COUNTER.Enum()
+		return f
+	}
+	limited := ratelimited.New(time.Hour, memstore.New(time.Hour))
+	if err := limited.WriteMetrics(context.Background(), &store.PartitionedMetrics{PartitionKey: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	cardinalityCache, err := cache.NewMemory(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		client      *authorize.Client
+		validator   validate.Validator
+		store       store.Store
+		body        []byte
+		wantCode    int
+		wantError   string
+	}{
+		{name: "method", method: "GET", wantCode: http.StatusMethodNotAllowed, wantError: CodeMethodNotAllowed},
+		{name: "content type", contentType: "application/json", wantCode: http.StatusUnsupportedMediaType, wantError: CodeUnsupportedContentType},
+		{name: "no client", wantCode: http.StatusInternalServerError, wantError: CodeUnauthorized},
+		{name: "no partition label", client: &authorize.Client{ID: "test"}, wantCode: http.StatusInternalServerError, wantError: CodeMissingPartitionLabel},
+		{name: "missing required label", body: encodeFamilies([]*clientmodel.MetricFamily{family("test_1", 999000)}), wantCode: http.StatusBadRequest, wantError: CodeMissingRequiredLabel},
+		{name: "missing timestamp", body: encodeFamilies([]*clientmodel.MetricFamily{withLabel(family("test_1", -1))}), wantCode: http.StatusInternalServerError, wantError: CodeMissingTimestamp},
+		{name: "unsorted", body: encodeFamilies([]*clientmodel.MetricFamily{withLabel(family("test_1", 999000, 998000))}), wantCode: http.StatusInternalServerError, wantError: CodeUnsortedSamples},
+		{name: "too old", validator: validate.New("cluster", 0, time.Second, func() time.Time { return now }), body: encodeFamilies([]*clientmodel.MetricFamily{counter(withLabel(family("test_1", 1000)))}), wantCode: http.StatusInternalServerError, wantError: CodeSampleTooOld},
+		{name: "in future", validator: validate.NewWithOptions("cluster", 0, 0, func() time.Time { return now }, validate.Options{MaxFutureSkew: 5 * time.Minute}), body: encodeFamilies([]*clientmodel.MetricFamily{withLabel(family("test_1", 2000000))}), wantCode: http.StatusBadRequest, wantError: CodeSampleInFuture},
+		{name: "too large", validator: validate.New("cluster", 10, 0, func() time.Time { return now }), body: encodeFamilies([]*clientmodel.MetricFamily{withLabel(family("test_1", 999000))}), wantCode: http.StatusRequestEntityTooLarge, wantError: CodeTooLarge},
+		{name: "too many series", validator: validate.NewWithOptions("cluster", 0, 0, func() time.Time { return now }, validate.Options{MaxSeries: 1}), body: encodeFamilies([]*clientmodel.MetricFamily{withLabel(family("test_1", 999000)), withLabel(family("test_2", 999000))}), wantCode: http.StatusUnprocessableEntity, wantError: CodeTooManySeries},
+		{name: "duplicate series", validator: validate.NewWithOptions("cluster", 0, 0, func() time.Time { return now }, validate.Options{Duplicates: true, StrictDuplicates: true}), body: encodeFamilies([]*clientmodel.MetricFamily{withLabel(family("test_1", 998000, 999000))}), wantCode: http.StatusUnprocessableEntity, wantError: CodeDuplicateSeries},
+		{name: "cardinality exceeded", validator: validate.NewWithOptions("cluster", 0, 0, func() time.Time { return now }, validate.Options{Cardinality: validate.NewCardinalityBudget(1, time.Hour, cardinalityCache)}), body: encodeFamilies([]*clientmodel.MetricFamily{withLabel(family("test_1", 999000)), withLabel(family("test_2", 999000))}), wantCode: http.StatusTooManyRequests, wantError: CodeCardinalityExceeded},
+		{name: "rate limited", store: limited, body: encodeFamilies([]*clientmodel.MetricFamily{withLabel(family("test_1", 999000))}), wantCode: http.StatusTooManyRequests, wantError: CodeRateLimited},
+		{name: "quota exceeded", store: quota.New(0, time.Hour, 1, memstore.New(time.Hour)), body: encodeFamilies([]*clientmodel.MetricFamily{withLabel(family("test_1", 999000))}), wantCode: http.StatusTooManyRequests, wantError: CodeQuotaExceeded},
+		{name: "invalid metrics", body: []byte("garbage"), wantCode: http.StatusInternalServerError, wantError: CodeInvalidMetrics},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.method) == 0 {
+				tt.method = "POST"
+			}
+			if len(tt.contentType) == 0 {
+				tt.contentType = string(expfmt.FmtProtoDelim)
+			}
+			if tt.client == nil && tt.name != "no client" {
+				tt.client = &authorize.Client{ID: "test", Labels: labels}
+			}
+			if tt.validator == nil {
+				tt.validator = validate.New("cluster", 0, 0, func() time.Time { return now })
+			}
+			if tt.store == nil {
+				tt.store = memstore.New(time.Hour)
+			}
+
+			s := New(tt.store, tt.validator, nil, time.Hour)
+			s.nowFn = func() time.Time { return now }
+			req := httptest.NewRequest(tt.method, "/upload", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set(RequestIDHeader, "request-1")
+			if tt.client != nil {
+				req = req.WithContext(authorize.WithClient(req.Context(), tt.client))
+			}
+			w := httptest.NewRecorder()
+			s.Post(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Fatalf("unexpected content type %q", ct)
+			}
+			var body Error
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != tt.wantError || body.RequestID != "request-1" || len(body.Message) == 0 {
+				t.Fatalf("unexpected body %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	req := httptest.NewRequest("POST", "/upload", nil)
+	a, b := requestID(req), requestID(req)
+	if len(a) != 16 || a == b {
+		t.Fatalf("want random IDs, got %q and %q", a, b)
+	}
+	req.Header.Set(RequestIDHeader, "request-1")
+	if id := requestID(req); id != "request-1" {
+		t.Fatalf("want the ID of the caller, got %q", id)
+	}
+}
+
+func TestServer_PostEnforceLabels(t *testing.T) {
+	withLabels := func(f *clientmodel.MetricFamily, kv ...string) *clientmodel.MetricFamily {
+		for _, m := range f.Metric {
+			for i := 0; i < len(kv); i += 2 {
+				m.Label = append(m.Label, &clientmodel.LabelPair{Name: proto.String(kv[i]), Value: proto.String(kv[i+1])})
+			}
+		}
+		return f
+	}
+	now := time.Unix(1000, 0)
+
+	tests := []struct {
+		name       string
+		strict     bool
+		family     *clientmodel.MetricFamily
+		wantCode   int
+		wantError  string
+		wantLabels []string
+	}{
+		{
+			name:       "injected onto unlabeled series",
+			family:     family("test_1", 999000),
+			wantCode:   http.StatusOK,
+			wantLabels: []string{"cluster=test"},
+		},
+		{
+			name:       "conflicting value overwritten",
+			family:     withLabels(family("test_1", 999000), "a", "1", "cluster", "other"),
+			wantCode:   http.StatusOK,
+			wantLabels: []string{"a=1", "cluster=test"},
+		},
+		{
+			name:      "conflicting value rejected",
+			strict:    true,
+			family:    withLabels(family("test_1", 999000), "cluster", "other"),
+			wantCode:  http.StatusBadRequest,
+			wantError: CodeLabelConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := memstore.New(time.Hour)
+			s := New(ms, validate.New("cluster", 0, 0, func() time.Time { return now }), nil, time.Hour)
+			s.nowFn = func() time.Time { return now }
+			s.EnforceClientLabels = true
+			s.RejectLabelConflicts = tt.strict
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(encodeFamilies([]*clientmodel.MetricFamily{tt.family})))
+			req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+			req = req.WithContext(authorize.WithClient(req.Context(), &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}}))
+			w := httptest.NewRecorder()
+			s.Post(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+			}
+			if len(tt.wantError) > 0 {
+				var body Error
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatal(err)
+				}
+				if body.Code != tt.wantError {
+					t.Fatalf("unexpected body %s", w.Body.String())
+				}
+				return
+			}
+
+			ps, err := ms.ReadMetrics(context.Background(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var labels []string
+			for _, l := range ps[0].Families[0].Metric[0].Label {
+				labels = append(labels, l.GetName()+"="+l.GetValue())
+			}
+			if !reflect.DeepEqual(labels, tt.wantLabels) {
+				t.Fatalf("want labels %v, got %v", tt.wantLabels, labels)
+			}
+		})
+	}
+}
+
+func TestServer_PostPartitioner(t *testing.T) {
+	now := time.Unix(1000, 0)
+	client := &authorize.Client{
+		ID:     "account-1",
+		Labels: map[string]string{"cluster": "cluster-1", "account": "acme"},
+		Claims: map[string]string{"iss": "https://issuer.example.com", "org": "org-1"},
+	}
+
+	tests := []struct {
+		name        string
+		partitioner authorize.Partitioner
+		wantCode    int
+		wantKey     string
+	}{
+		{name: "authorizer label", wantCode: http.StatusOK, wantKey: "cluster-1"},
+		{name: "client id", partitioner: authorize.PartitionByID(), wantCode: http.StatusOK, wantKey: "account-1"},
+		{name: "client label", partitioner: authorize.PartitionByLabel("account"), wantCode: http.StatusOK, wantKey: "acme"},
+		{name: "token claim", partitioner: authorize.PartitionByClaim("org"), wantCode: http.StatusOK, wantKey: "org-1"},
+		{name: "issuer tenant", partitioner: authorize.PartitionByIssuer(map[string]string{"https://issuer.example.com": "tenant-1"}), wantCode: http.StatusOK, wantKey: "tenant-1"},
+		{name: "missing claim", partitioner: authorize.PartitionByClaim("tenant"), wantCode: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := memstore.New(time.Hour)
+			s := New(ms, validate.New("cluster", 0, 0, func() time.Time { return now }), nil, time.Hour)
+			s.nowFn = func() time.Time { return now }
+			s.EnforceClientLabels = true
+			s.PartitionLabel = "cluster"
+			s.Partitioner = tt.partitioner
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(encodeFamilies([]*clientmodel.MetricFamily{family("test_1", 999000)})))
+			req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+			req = req.WithContext(authorize.WithClient(req.Context(), client))
+			w := httptest.NewRecorder()
+			s.Post(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			ps, err := ms.ReadMetrics(context.Background(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ps) != 1 || ps[0].PartitionKey != tt.wantKey {
+				t.Fatalf("want partition %s, got %#v", tt.wantKey, ps)
+			}
+			for _, l := range ps[0].Families[0].Metric[0].Label {
+				if l.GetName() == "cluster" && l.GetValue() != tt.wantKey {
+					t.Fatalf("want the partition injected as label, got %s", l.GetValue())
+				}
+			}
+			if client.Labels["cluster"] != "cluster-1" {
+				t.Fatal("expected the authorized client to be left unchanged")
+			}
+		})
+	}
+}
+
+func TestServer_PostClientLimits(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := jwt.NewSigner("test", key)
+	token := func(cluster string, limits authorize.Limits) string {
+		token, err := signer.GenerateToken(jwt.Claims(cluster, map[string]string{"cluster": cluster}, nil, limits, 3600, []string{"federate"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	limited := token("cluster-1", authorize.Limits{UploadInterval: time.Hour, MaxSamplesPerUpload: 2})
+	unlimited := token("cluster-2", authorize.Limits{})
+
+	now := time.Unix(1000, 0)
+	s := New(ratelimited.New(0, memstore.New(time.Hour)), validate.New("cluster", 0, 0, func() time.Time { return now }), nil, time.Hour)
+	s.nowFn = func() time.Time { return now }
+	s.EnforceClientLabels = true
+	s.MaxSamplesPerUpload = 5
+	clients := jwt.NewClientAuthorizer("test", []crypto.PublicKey{key.Public()}, jwt.NewValidator([]string{"federate"}))
+	h := authorize.Middleware(authorize.TokenAuthorizer(clients))(http.HandlerFunc(s.Post))
+
+	upload := func(token string, samples int) *httptest.ResponseRecorder {
+		timestamps := make([]int64, samples)
+		for i := range timestamps {
+			timestamps[i] = 999000 + int64(i)
+		}
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(encodeFamilies([]*clientmodel.MetricFamily{family("test_1", timestamps...)})))
+		req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		samples  int
+		wantCode map[string]int
+	}{
+		{
+			name:     "above the limit of the token",
+			samples:  3,
+			wantCode: map[string]int{limited: http.StatusRequestEntityTooLarge, unlimited: http.StatusOK},
+		},
+		{
+			name:     "within the limits",
+			samples:  2,
+			wantCode: map[string]int{limited: http.StatusOK, unlimited: http.StatusOK},
+		},
+		{
+			name:     "within the interval of the token",
+			samples:  2,
+			wantCode: map[string]int{limited: http.StatusTooManyRequests, unlimited: http.StatusOK},
+		},
+		{
+			name:     "above the limit of the server",
+			samples:  6,
+			wantCode: map[string]int{limited: http.StatusRequestEntityTooLarge, unlimited: http.StatusRequestEntityTooLarge},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for token, want := range tt.wantCode {
+				w := upload(token, tt.samples)
+				if w.Code != want {
+					t.Fatalf("want code %d, got %d: %s", want, w.Code, w.Body.String())
+				}
+				if want == http.StatusRequestEntityTooLarge {
+					var body Error
+					if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+						t.Fatal(err)
+					}
+					if body.Code != CodeTooManySamples {
+						t.Fatalf("want code %s, got %s", CodeTooManySamples, body.Code)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestServer_PostFailureLog(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	failures := logthrottle.New(time.Hour, 10)
+	s := New(memstore.New(time.Hour), validate.New("cluster", 0, 0, time.Now), nil, time.Hour)
+	s.FailureLog = failures
+	for i := 0; i < 50; i++ {
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(nil))
+		req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+		req = req.WithContext(authorize.WithClient(req.Context(), &authorize.Client{ID: "client-1"}))
+		w := httptest.NewRecorder()
+		s.Post(w, req)
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "of client client-1 failed with "+CodeMissingPartitionLabel) {
+		t.Fatalf("want a single failure logged, got %q", lines)
+	}
+
+	// rejected uploads are throttled alike, and logged with their part
+	buf.Reset()
+	for i := 0; i < 50; i++ {
+		// the series lacks the label of the client
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(encodeFamilies([]*clientmodel.MetricFamily{family("test_1", 999000)})))
+		req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+		req.Header.Set(PartHeader, "1/2; upload=a")
+		req = req.WithContext(authorize.WithClient(req.Context(), &authorize.Client{ID: "client-2", Labels: map[string]string{"cluster": "test"}}))
+		w := httptest.NewRecorder()
+		s.Post(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+		}
+	}
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `of client client-2, part 1/2 of upload "a", failed with `) {
+		t.Fatalf("want a single rejection logged with its part, got %q", lines)
+	}
+}
+
+func TestServer_PostValidatorChain(t *testing.T) {
+	// the chain drops families of the name "dropped" and rejects uploads without families
+	validator := validate.Chain(
+		validate.ValidatorFunc(func(_ context.Context, _ *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+			var kept []*clientmodel.MetricFamily
+			for _, f := range families {
+				if f.GetName() != "dropped" {
+					kept = append(kept, f)
+				}
+			}
+			return kept, nil
+		}),
+		validate.ValidatorFunc(func(_ context.Context, _ *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+			if len(families) == 0 {
+				return nil, fmt.Errorf("no families")
+			}
+			return families, nil
+		}),
+	)
+
+	tests := []struct {
+		name      string
+		families  []*clientmodel.MetricFamily
+		wantCode  int
+		wantNames []string
+	}{
+		{name: "lenient validator filters", families: []*clientmodel.MetricFamily{family("kept", 1000), family("dropped", 1000)}, wantCode: http.StatusOK, wantNames: []string{"kept"}},
+		{name: "rejected", families: []*clientmodel.MetricFamily{family("dropped", 1000)}, wantCode: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := memstore.New(time.Hour)
+			s := New(ms, validator, nil, time.Hour)
+			s.PartitionLabel = "cluster"
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(encodeFamilies(tt.families)))
+			req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+			req = req.WithContext(authorize.WithClient(req.Context(), &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "cluster-1"}}))
+			w := httptest.NewRecorder()
+			s.Post(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("want code %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			ps, err := ms.ReadMetrics(context.Background(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, p := range ps {
+				if p.PartitionKey != "cluster-1" {
+					t.Errorf("want partition cluster-1, got %s", p.PartitionKey)
+				}
+				for _, f := range p.Families {
+					names = append(names, f.GetName())
+				}
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Fatalf("want families %v, got %v", tt.wantNames, names)
+			}
+		})
+	}
+}
+
+func TestServer_PostEmptyUpload(t *testing.T) {
+	now := time.Unix(1000, 0)
+	allowlist, err := validate.NewAllowlist([]string{"allowed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}}
+
+	tests := []struct {
+		name        string
+		reject      bool
+		families    []*clientmodel.MetricFamily
+		wantCode    int
+		wantError   string
+		wantWarning string
+	}{
+		{name: "accepted", wantCode: http.StatusNoContent, wantWarning: `299 - "the upload has no metrics to store"`},
+		{name: "accepted after filtering", families: []*clientmodel.MetricFamily{family("other", 999000)}, wantCode: http.StatusNoContent, wantWarning: `299 - "the upload has no metrics to store"`},
+		{name: "rejected", reject: true, wantCode: http.StatusBadRequest, wantError: CodeEmptyUpload},
+		{name: "rejected after filtering", reject: true, families: []*clientmodel.MetricFamily{family("other", 999000)}, wantCode: http.StatusBadRequest, wantError: CodeEmptyUpload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := memstore.New(time.Hour)
+			v := validate.NewWithOptions("cluster", 0, time.Hour, func() time.Time { return now }, validate.Options{Allowlist: allowlist, RejectEmptyUploads: tt.reject})
+			s := New(ms, v, nil, time.Hour)
+			s.nowFn = func() time.Time { return now }
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(encodeFamilies(tt.families)))
+			req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+			req = req.WithContext(authorize.WithClient(req.Context(), client))
+			w := httptest.NewRecorder()
+			s.Post(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("want code %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if len(tt.wantError) > 0 {
+				var body Error
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatal(err)
+				}
+				if body.Code != tt.wantError {
+					t.Errorf("want error %s, got %s: %s", tt.wantError, body.Code, body.Message)
+				}
+			} else if w.Body.Len() > 0 {
+				t.Errorf("want no body, got %s", w.Body.String())
+			}
+			if len(tt.wantWarning) > 0 && w.Header().Get("Warning") != tt.wantWarning {
+				t.Errorf("want warning %s, got %v", tt.wantWarning, w.Header()["Warning"])
+			}
+
+			ps, err := ms.ReadMetrics(context.Background(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ps) > 0 {
+				t.Errorf("want nothing stored, got %v", ps)
+			}
+		})
+	}
+}
+
+func TestServer_PostReportOnly(t *testing.T) {
+	now := time.Unix(1000, 0)
+	allowlist, err := validate.NewAllowlist([]string{"up"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}}
+	withLabel := func(f *clientmodel.MetricFamily) *clientmodel.MetricFamily {
+		f.Type = clientmodel.MetricType_COUNTER.Enum()
+		for _, m := range f.Metric {
+			m.Label = append(m.Label, &clientmodel.LabelPair{Name: proto.String("cluster"), Value: proto.String("test")})
+		}
+		return f
+	}
+	// the upload has a family that is not allowlisted and a duplicate series, which aborts the
+	// upload once found when enforced
+	body := encodeFamilies([]*clientmodel.MetricFamily{withLabel(family("other", 999000)), withLabel(family("up", 999000, 999000))})
+	// counts returns the values of the validation counters by name and label value
+	counts := func(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make(map[string]float64)
+		for _, f := range families {
+			for _, m := range f.Metric {
+				values[f.GetName()+"/"+m.Label[0].GetValue()] = m.GetCounter().GetValue()
+			}
+		}
+		return values
+	}
+	wantCounts := map[string]float64{
+		"telemeter_validation_rejections_total/" + validate.ReasonDuplicateSeries:    1,
+		"telemeter_validation_dropped_series_total/" + validate.ReasonNotAllowlisted: 1,
+	}
+
+	tests := []struct {
+		name       string
+		reportOnly []string
+		wantCode   int
+		wantReport string
+		wantNames  []string
+	}{
+		{name: "enforce", wantCode: http.StatusUnprocessableEntity},
+		{name: "report one rule", reportOnly: []string{validate.RuleDuplicates}, wantCode: http.StatusOK, wantReport: "duplicates", wantNames: []string{"up", "up"}},
+		{name: "report", reportOnly: []string{validate.RuleAllowlist, validate.RuleDuplicates}, wantCode: http.StatusOK, wantReport: "allowlist,duplicates", wantNames: []string{"other", "up", "up"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			ms := memstore.New(time.Hour)
+			v := validate.NewWithOptions("cluster", 0, time.Hour, func() time.Time { return now }, validate.Options{
+				Allowlist:        allowlist,
+				Duplicates:       true,
+				StrictDuplicates: true,
+				ReportOnly:       tt.reportOnly,
+				Metrics:          validate.NewMetrics(reg),
+			})
+			s := New(ms, v, nil, time.Hour)
+			s.nowFn = func() time.Time { return now }
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+			req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+			req = req.WithContext(authorize.WithClient(req.Context(), client))
+			w := httptest.NewRecorder()
+			s.Post(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("want code %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if got := w.Header().Get(ReportOnlyHeader); got != tt.wantReport {
+				t.Errorf("want report %q, got %q", tt.wantReport, got)
+			}
+			// the rules are counted alike whether they are enforced or not
+			if got := counts(t, reg); !reflect.DeepEqual(got, wantCounts) {
+				t.Errorf("want counts %v, got %v", wantCounts, got)
+			}
+
+			ps, err := ms.ReadMetrics(context.Background(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, p := range ps {
+				for _, f := range p.Families {
+					for range f.Metric {
+						names = append(names, f.GetName())
+					}
+				}
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("want stored series of %v, got %v", tt.wantNames, names)
+			}
+		})
+	}
+}
+
+func TestServer_PostValidationConfigReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "validation.json")
+	write := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"allow_metrics": ["up"], "strict_allowlist": true}`, time.Unix(100, 0))
+
+	now := time.Unix(1000, 0)
+	v, err := validate.NewConfigFile(path, "cluster", 0, time.Hour, func() time.Time { return now }, validate.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(memstore.New(time.Hour), v, nil, time.Hour)
+	s.nowFn = func() time.Time { return now }
+	client := &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}}
+	labeled := func(f *clientmodel.MetricFamily) *clientmodel.MetricFamily {
+		f.Type = clientmodel.MetricType_COUNTER.Enum()
+		f.Metric[0].Label = []*clientmodel.LabelPair{{Name: proto.String("cluster"), Value: proto.String("test")}}
+		return f
+	}
+	post := func() int {
+		body := encodeFamilies([]*clientmodel.MetricFamily{labeled(family("up", 999000)), labeled(family("other", 999000))})
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+		req = req.WithContext(authorize.WithClient(req.Context(), client))
+		w := httptest.NewRecorder()
+		s.Post(w, req)
+		return w.Code
+	}
+
+	if code := post(); code != http.StatusUnprocessableEntity {
+		t.Fatalf("want code %d, got %d", http.StatusUnprocessableEntity, code)
+	}
+	write(`{"allow_metrics": ["up", "other"]}`, time.Unix(200, 0))
+	if err := v.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if code := post(); code != http.StatusOK {
+		t.Fatalf("want code %d after reloading, got %d", http.StatusOK, code)
+	}
+	write(`{"allow_metrics": [`, time.Unix(300, 0))
+	if err := v.Reload(); err == nil {
+		t.Fatal("want the invalid config to be rejected")
+	}
+	if code := post(); code != http.StatusOK {
+		t.Fatalf("want code %d with the previous config, got %d", http.StatusOK, code)
+	}
+}
+
+func TestServer_PostInconsistentTypeForward(t *testing.T) {
+	received := make(chan *prompb.WriteRequest, 1)
+	receive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		compressed, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var wreq prompb.WriteRequest
+		if err := proto.Unmarshal(data, &wreq); err != nil {
+			t.Error(err)
+			return
+		}
+		received <- &wreq
+	}))
+	defer receive.Close()
+	u, err := url.Parse(receive.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the counter has a series with a gauge value only, as sent by corrupted clients
+	upload := func() []byte {
+		cluster, one, ts := "cluster-1", float64(1), time.Now().UnixNano()/int64(time.Millisecond)
+		label := func(value string) []*clientmodel.LabelPair {
+			return []*clientmodel.LabelPair{{Name: proto.String("cluster"), Value: &cluster}, {Name: proto.String("series"), Value: proto.String(value)}}
+		}
+		return encodeFamilies([]*clientmodel.MetricFamily{{
+			Name: proto.String("test_1"),
+			Type: clientmodel.MetricType_COUNTER.Enum(),
+			Metric: []*clientmodel.Metric{
+				{Label: label("gauge"), Gauge: &clientmodel.Gauge{Value: &one}, TimestampMs: &ts},
+				{Label: label("counter"), Counter: &clientmodel.Counter{Value: &one}, TimestampMs: &ts},
+			},
+		}})
+	}
+
+	tests := []struct {
+		name        string
+		validator   validate.Validator
+		wantCode    int
+		wantForward bool
+	}{
+		{name: "unvalidated series are skipped when forwarding", validator: testValidator{partitionKey: "cluster-1"}, wantCode: http.StatusOK, wantForward: true},
+		{name: "rejected", validator: validate.New("cluster", 0, 0, time.Now), wantCode: http.StatusBadRequest},
+		{name: "dropped", validator: validate.NewWithOptions("cluster", 0, 0, time.Now, validate.Options{DropInconsistentTypes: true}), wantCode: http.StatusOK, wantForward: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(forward.New(u, memstore.New(time.Hour)), tt.validator, nil, time.Hour)
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(upload()))
+			req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+			req = req.WithContext(authorize.WithClient(req.Context(), &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "cluster-1"}}))
+			w := httptest.NewRecorder()
+			s.Post(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("want code %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if !tt.wantForward {
+				return
+			}
+
+			select {
+			case wreq := <-received:
+				if len(wreq.Timeseries) != 1 {
+					t.Fatalf("want the counter series forwarded, got %v", wreq.Timeseries)
+				}
+				for _, l := range wreq.Timeseries[0].Labels {
+					if l.Name == "series" && l.Value != "counter" {
+						t.Fatalf("want the counter series forwarded, got %v", wreq.Timeseries)
+					}
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the upload to be forwarded")
+			}
+		})
+	}
+}
+
+func TestServer_PostSummary(t *testing.T) {
+	counter := func(f *clientmodel.MetricFamily) *clientmodel.MetricFamily {
+		f.Type = clientmodel.MetricType_COUNTER.Enum()
+		return f
+	}
+	whitelist, err := metricfamily.NewWhitelist([]string{`{__name__="kept"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := testValidator{partitionKey: "cluster-1", transformer: metricfamily.NewDropInvalidFederateSamples(time.Unix(0, 0))}
+
+	tests := []struct {
+		name        string
+		transformer metricfamily.Transformer
+		families    []*clientmodel.MetricFamily
+		want        UploadSummary
+	}{
+		{
+			name:     "all accepted",
+			families: []*clientmodel.MetricFamily{counter(family("kept", 1000000, 1001000)), counter(family("other", 1000000))},
+			want:     UploadSummary{Families: 2, Series: 3, Samples: 3, Dropped: map[string]int{DroppedInvalid: 0, DroppedFiltered: 0}},
+		},
+		{
+			name:     "invalid dropped",
+			families: []*clientmodel.MetricFamily{counter(family("kept", 1000000)), family("untyped", 1000000, 1001000)},
+			want:     UploadSummary{Families: 1, Series: 1, Samples: 1, Dropped: map[string]int{DroppedInvalid: 2, DroppedFiltered: 0}},
+		},
+		{
+			name:        "filtered and invalid dropped",
+			transformer: whitelist,
+			families:    []*clientmodel.MetricFamily{counter(family("kept", 1000000, 1001000)), counter(family("other", 1000000, 1001000, 1002000)), family("untyped", 1000000)},
+			want:        UploadSummary{Families: 1, Series: 2, Samples: 2, Dropped: map[string]int{DroppedInvalid: 1, DroppedFiltered: 3}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(memstore.New(10*time.Minute), validator, tt.transformer, 10*time.Minute)
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(encodeFamilies(tt.families)))
+			req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+			w := httptest.NewRecorder()
+			s.Post(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+			}
+			var got UploadSummary
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("want summary %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestServer_PostNotAllowlisted(t *testing.T) {
+	now := time.Unix(1000, 0)
+	allowlist, err := validate.NewAllowlist([]string{"up", "cluster:.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}}
+	labeled := func(f *clientmodel.MetricFamily) *clientmodel.MetricFamily {
+		f.Type = clientmodel.MetricType_COUNTER.Enum()
+		for _, m := range f.Metric {
+			m.Label = append(m.Label, &clientmodel.LabelPair{Name: proto.String("cluster"), Value: proto.String("test")})
+		}
+		return f
+	}
+	body := encodeFamilies([]*clientmodel.MetricFamily{
+		labeled(family("a", 999000)), labeled(family("up", 999000)), labeled(family("b", 999000)),
+		labeled(family("cluster:usage", 999000)), labeled(family("c", 999000)),
+	})
+
+	tests := []struct {
+		name        string
+		strict      bool
+		wantCode    int
+		wantDetails map[string]interface{}
+		wantSummary *validate.NotAllowlisted
+	}{
+		{
+			name:        "strict",
+			strict:      true,
+			wantCode:    http.StatusUnprocessableEntity,
+			wantDetails: map[string]interface{}{"metric": "a", "metrics": []interface{}{"a", "b"}, "count": float64(3), "truncated": true},
+		},
+		{
+			name:        "lenient",
+			wantCode:    http.StatusOK,
+			wantSummary: &validate.NotAllowlisted{Names: []string{"a", "b"}, Count: 3, Truncated: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validate.NewWithOptions("cluster", 0, time.Hour, func() time.Time { return now }, validate.Options{Allowlist: allowlist, StrictAllowlist: tt.strict, MaxNotAllowlisted: 2})
+			s := New(memstore.New(time.Hour), v, nil, time.Hour)
+			s.nowFn = func() time.Time { return now }
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+			req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+			req = req.WithContext(authorize.WithClient(req.Context(), client))
+			w := httptest.NewRecorder()
+			s.Post(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("want code %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if tt.wantDetails != nil {
+				var body Error
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatal(err)
+				}
+				if body.Code != CodeNotAllowlisted || !reflect.DeepEqual(body.Details, tt.wantDetails) {
+					t.Errorf("want error %s with details %v, got %s with %v", CodeNotAllowlisted, tt.wantDetails, body.Code, body.Details)
+				}
+				return
+			}
+			var summary UploadSummary
+			if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(summary.NotAllowlisted, tt.wantSummary) {
+				t.Errorf("want not allowlisted %+v, got %+v", tt.wantSummary, summary.NotAllowlisted)
+			}
+			if summary.Series != 2 {
+				t.Errorf("want the 2 allowlisted series stored, got %d", summary.Series)
+			}
+		})
+	}
+}
+
+func TestServer_PostDropped(t *testing.T) {
+	counter := func(f *clientmodel.MetricFamily) *clientmodel.MetricFamily {
+		f.Type = clientmodel.MetricType_COUNTER.Enum()
+		return f
+	}
+	whitelist, err := metricfamily.NewWhitelist([]string{`{__name__="kept"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := testValidator{partitionKey: "cluster-1", transformer: metricfamily.NewDropInvalidFederateSamples(time.Unix(0, 0))}
+	families := []*clientmodel.MetricFamily{
+		counter(family("kept", 1000000)),
+		counter(family("other", 1000000, 1001000)),
+		family("untyped", 1000000),
+	}
+
+	tests := []struct {
+		name         string
+		strict       bool
+		maxReported  int
+		families     []*clientmodel.MetricFamily
+		wantCode     int
+		wantWarnings []string
+		wantSeries   []interface{}
+	}{
+		{
+			name:     "nothing dropped",
+			families: families[:1],
+			wantCode: http.StatusOK,
+		},
+		{
+			name:         "lenient",
+			families:     families,
+			wantCode:     http.StatusOK,
+			wantWarnings: []string{`299 - "2 series dropped: filtered"`, `299 - "1 series dropped: invalid"`},
+		},
+		{
+			name:        "strict",
+			strict:      true,
+			maxReported: 10,
+			families:    families,
+			wantCode:    http.StatusUnprocessableEntity,
+			wantSeries:  []interface{}{"other{}", "other{}", "untyped{}"},
+		},
+		{
+			name:        "strict lists up to the maximum",
+			strict:      true,
+			maxReported: 1,
+			families:    families,
+			wantCode:    http.StatusUnprocessableEntity,
+			wantSeries:  []interface{}{"other{}"},
+		},
+		{
+			name:     "strict without drops",
+			strict:   true,
+			families: families[:1],
+			wantCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := memstore.New(10 * time.Minute)
+			s := New(ms, validator, whitelist, 10*time.Minute)
+			s.RejectPartialUploads = tt.strict
+			s.MaxReportedDrops = tt.maxReported
+			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(encodeFamilies(tt.families)))
+			req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+			w := httptest.NewRecorder()
+			s.Post(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+			}
+			if got := w.Header()["Warning"]; !reflect.DeepEqual(got, tt.wantWarnings) {
+				t.Fatalf("want warnings %q, got %q", tt.wantWarnings, got)
+			}
+			ps, err := ms.ReadMetrics(context.Background(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != http.StatusUnprocessableEntity {
+				return
+			}
+
+			if len(ps) != 0 {
+				t.Fatalf("want nothing stored from a rejected upload, got %v", ps)
+			}
+			var body Error
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != CodeSeriesDropped {
+				t.Fatalf("unexpected body %s", w.Body.String())
+			}
+			wantDropped := map[string]interface{}{DroppedInvalid: float64(1), DroppedFiltered: float64(2)}
+			if !reflect.DeepEqual(body.Details["dropped"], wantDropped) || !reflect.DeepEqual(body.Details["series"], tt.wantSeries) {
+				t.Fatalf("unexpected details %v", body.Details)
+			}
+		})
+	}
+}
+
+func BenchmarkServer_Post(b *testing.B) {
+	data := largeUpload(20 * 1024 * 1024)
+	for _, bm := range []struct {
+		name string
+		// buffered reads the whole body and keeps every decoded family until the upload is
+		// stored, as uploads were handled before decoding was streamed.
+		buffered bool
+	}{
+		{name: "streamed"},
+		{name: "buffered", buffered: true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			var decoded []*clientmodel.MetricFamily
+			expired := metricfamily.NewDropExpiredSamples(time.Unix(1003, 0))
+			transformer := expired
+			if bm.buffered {
+				transformer = metricfamily.TransformerFunc(func(family *clientmodel.MetricFamily) (bool, error) {
+					decoded = append(decoded, family)
+					return expired.Transform(family)
+				})
+			}
+			s := New(memstore.New(10*time.Minute), testValidator{partitionKey: "cluster-1", transformer: transformer}, nil, 10*time.Minute)
+
+			post := func() {
+				body := data
+				if bm.buffered {
+					body = append([]byte(nil), data...)
+				}
+				req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+				req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+				w := httptest.NewRecorder()
+				s.Post(w, req)
+				if w.Code != http.StatusOK {
+					b.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+				}
+				decoded = nil
+			}
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				post()
+			}
+			b.StopTimer()
+
+			// the peak of a single upload is measured apart, as it slows uploads down
+			peak := measurePeakHeap()
+			post()
+			b.Logf("peak heap of an upload of %d MiB: %d MiB", len(data)>>20, peak()>>20)
+		})
+	}
+}
+
+// measurePeakHeap samples the heap until the returned func is called, which returns the
+// highest heap allocation seen above the heap at the start. The garbage collector runs
+// frequently meanwhile, so that the peak is close to the memory held by the code measured.
+func measurePeakHeap() func() uint64 {
+	gcPercent := debug.SetGCPercent(5)
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	base := stats.HeapAlloc
+
+	stop, result := make(chan struct{}), make(chan uint64)
+	go func() {
+		var stats runtime.MemStats
+		var peak uint64
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > peak {
+				peak = stats.HeapAlloc
+			}
+			select {
+			case <-stop:
+				if peak < base {
+					peak = base
+				}
+				result <- peak - base
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() uint64 {
+		close(stop)
+		debug.SetGCPercent(gcPercent)
+		return <-result
+	}
+}
+
+func TestServer_PostContentType(t *testing.T) {
+	text := familiesToText([]*clientmodel.MetricFamily{family("test_1", 1000000)})
+
+	tests := []struct {
+		name        string
+		lenient     bool
+		contentType string
+		wantCode    int
+		wantBody    string
+	}{
+		{name: "strict text", contentType: string(expfmt.FmtText), wantCode: http.StatusOK},
+		{name: "strict wrong type", contentType: "application/json", wantCode: http.StatusUnsupportedMediaType, wantBody: "unsupported Content-Type"},
+		{name: "strict missing type", wantCode: http.StatusUnsupportedMediaType, wantBody: "missing Content-Type"},
+		{name: "lenient text", lenient: true, contentType: string(expfmt.FmtText), wantCode: http.StatusOK},
+		{name: "lenient wrong type", lenient: true, contentType: "application/json", wantCode: http.StatusOK},
+		{name: "lenient missing type", lenient: true, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(memstore.New(10*time.Minute), testValidator{partitionKey: "cluster-1"}, nil, 10*time.Minute)
+			s.Lenient = tt.lenient
+
+			req := httptest.NewRequest("POST", "/upload", strings.NewReader(text))
+			if len(tt.contentType) > 0 {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			s.Post(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Fatalf("unexpected body %q", w.Body.String())
+			}
+			if tt.wantCode == http.StatusUnsupportedMediaType && !strings.Contains(w.Body.String(), string(expfmt.FmtProtoDelim)) {
+				t.Fatalf("expected accepted types to be listed, got %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func familiesToText(families []*clientmodel.MetricFamily) string {
+	buf := &bytes.Buffer{}
+	for _, f := range families {
+		_, _ = expfmt.MetricFamilyToText(buf, f)
+	}
+	return buf.String()
+}
+
+func read(r io.Reader) ([]*clientmodel.MetricFamily, error) {
+	decoder := expfmt.NewDecoder(r, expfmt.FmtText)
+	families := make([]*clientmodel.MetricFamily, 0, 100)
+	for {
+		family := &clientmodel.MetricFamily{}
+		if err := decoder.Decode(family); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		families = append(families, family)
+	}
+	return families, nil
+}
+
+func TestUploadPart(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{value: ""},
+		{value: "2/3; upload=9f86d081", want: `2/3 of upload "9f86d081"`, ok: true},
+		{value: "4/3; upload=9f86d081"},
+		{value: "0/3; upload=9f86d081"},
+		{value: "2/3"},
+		{value: "2/3; upload=" + strings.Repeat("a", 65)},
+	} {
+		req := httptest.NewRequest("POST", "/upload", nil)
+		if len(tt.value) > 0 {
+			req.Header.Set(PartHeader, tt.value)
+		}
+		got, ok := uploadPart(req)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%q: want %q, %t, got %q, %t", tt.value, tt.want, tt.ok, got, ok)
 		}
-		families = append(families, family)
 	}
-	return families, nil
 }
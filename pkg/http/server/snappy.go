@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+
+	"github.com/openshift/telemeter/pkg/reader"
+)
+
+// snappyStreamHeader is the stream identifier chunk that starts every framed snappy stream.
+const snappyStreamHeader = "\xff\x06\x00\x00sNaPpY"
+
+// snappyReader decompresses an upload with Content-Encoding snappy. Both the framed stream
+// format and a single snappy block are accepted, and the format is detected on the first read.
+type snappyReader struct {
+	r     *bufio.Reader
+	limit int64
+	dec   io.Reader
+}
+
+// newSnappyReader returns a reader decompressing r. If limit is positive, reading more than
+// limit decompressed bytes fails with reader.ErrTooLong.
+func newSnappyReader(r io.Reader, limit int64) io.Reader {
+	return &snappyReader{r: bufio.NewReader(r), limit: limit}
+}
+
+func (s *snappyReader) Read(p []byte) (int, error) {
+	if s.dec == nil {
+		dec, err := s.decoder()
+		if err != nil {
+			return 0, err
+		}
+		s.dec = dec
+	}
+	return s.dec.Read(p)
+}
+
+func (s *snappyReader) decoder() (io.Reader, error) {
+	header, err := s.r.Peek(len(snappyStreamHeader))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(header) == snappyStreamHeader {
+		var dec io.Reader = snappy.NewReader(s.r)
+		if s.limit > 0 {
+			dec = reader.LimitReader(dec, s.limit)
+		}
+		return dec, nil
+	}
+
+	// a block must be read in full before it can be decoded, and cannot be larger than the
+	// encoding of limit bytes
+	var r io.Reader = s.r
+	if s.limit > 0 {
+		r = reader.LimitReader(r, int64(snappy.MaxEncodedLen(int(s.limit))))
+	}
+	block, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	n, err := snappy.DecodedLen(block)
+	if err != nil {
+		return nil, err
+	}
+	if s.limit > 0 && int64(n) > s.limit {
+		return nil, reader.ErrTooLong
+	}
+	data, err := snappy.Decode(nil, block)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
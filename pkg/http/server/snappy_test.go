@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/store"
+	"github.com/openshift/telemeter/pkg/store/memstore"
+)
+
+func snappyFramed(data []byte) []byte {
+	buf := &bytes.Buffer{}
+	w := snappy.NewBufferedWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		panic(err)
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestServer_PostSnappy(t *testing.T) {
+	data := encodeFamilies([]*clientmodel.MetricFamily{
+		family("test_1", 1000000, 1002000),
+		family("test_2", 1000000),
+	})
+
+	post := func(t *testing.T, s *Server, body []byte, encoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+		if len(encoding) > 0 {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		w := httptest.NewRecorder()
+		s.Post(w, req)
+		return w
+	}
+
+	stored := func(t *testing.T, body []byte, encoding string) []*store.PartitionedMetrics {
+		ms := memstore.New(10 * time.Minute)
+		s := New(ms, testValidator{partitionKey: "cluster-1"}, nil, 10*time.Minute)
+		if w := post(t, s, body, encoding); w.Code != http.StatusOK {
+			t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+		}
+		ps, err := ms.ReadMetrics(context.Background(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ps
+	}
+
+	want := stored(t, data, "")
+	for _, tt := range []struct {
+		name string
+		body []byte
+	}{
+		{name: "framed", body: snappyFramed(data)},
+		{name: "block", body: snappy.Encode(nil, data)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stored(t, tt.body, "snappy"); !reflect.DeepEqual(got, want) {
+				t.Fatalf("want stored metrics %v, got %v", want, got)
+			}
+
+			s := New(memstore.New(10*time.Minute), testValidator{partitionKey: "cluster-1"}, nil, 10*time.Minute)
+			s.MaxUncompressedBytes = int64(len(data) - 1)
+			w := post(t, s, tt.body, "snappy")
+			if w.Code != http.StatusInternalServerError || !bytes.Contains(w.Body.Bytes(), []byte(CodeTooLarge)) {
+				t.Fatalf("expected upload over the uncompressed limit to fail, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/validate"
+)
+
+// Reasons series are dropped from an upload, as reported in UploadSummary.Dropped.
+const (
+	// DroppedInvalid counts series discarded while validating the upload.
+	DroppedInvalid = "invalid"
+	// DroppedFiltered counts series removed by the server's transformers, such as the whitelist.
+	DroppedFiltered = "filtered"
+)
+
+// UploadSummary is returned to the client when an upload is stored. It describes how much
+// of the payload was retained. Every series in an upload carries a single sample, so
+// Samples matches Series.
+type UploadSummary struct {
+	Families int            `json:"families"`
+	Series   int            `json:"series"`
+	Samples  int            `json:"samples"`
+	Dropped  map[string]int `json:"dropped"`
+	// NotAllowlisted lists the metrics dropped as not allowlisted, if any.
+	NotAllowlisted *validate.NotAllowlisted `json:"not_allowlisted,omitempty"`
+
+	// droppedSeries holds up to maxDroppedSeries of the dropped series.
+	droppedSeries    []string
+	maxDroppedSeries int
+}
+
+// newUploadSummary returns an empty summary recording up to maxDroppedSeries of the dropped series.
+func newUploadSummary(maxDroppedSeries int) *UploadSummary {
+	return &UploadSummary{
+		Dropped: map[string]int{
+			DroppedInvalid:  0,
+			DroppedFiltered: 0,
+		},
+		maxDroppedSeries: maxDroppedSeries,
+	}
+}
+
+// dropped returns the total number of series dropped.
+func (u *UploadSummary) dropped() int {
+	total := 0
+	for _, n := range u.Dropped {
+		total += n
+	}
+	return total
+}
+
+// countDropped wraps a transformer and records the series it discards under reason.
+func (u *UploadSummary) countDropped(reason string, t metricfamily.Transformer) metricfamily.Transformer {
+	if t == nil {
+		return nil
+	}
+	return metricfamily.TransformerFunc(func(family *clientmodel.MetricFamily) (bool, error) {
+		before := seriesCount(family)
+		var metrics []*clientmodel.Metric
+		if len(u.droppedSeries) < u.maxDroppedSeries {
+			metrics = append(metrics, family.Metric...)
+		}
+		ok, err := t.Transform(family)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			u.Dropped[reason] += before
+			u.recordDropped(family.GetName(), metrics, nil)
+			return false, nil
+		}
+		u.Dropped[reason] += before - seriesCount(family)
+		if before != seriesCount(family) {
+			u.recordDropped(family.GetName(), metrics, family.Metric)
+		}
+		return true, nil
+	})
+}
+
+// recordDropped records the metrics that are not retained, up to the limit of the summary.
+func (u *UploadSummary) recordDropped(name string, metrics, retained []*clientmodel.Metric) {
+	kept := make(map[*clientmodel.Metric]struct{}, len(retained))
+	for _, m := range retained {
+		kept[m] = struct{}{}
+	}
+	for _, m := range metrics {
+		if len(u.droppedSeries) >= u.maxDroppedSeries {
+			return
+		}
+		if _, ok := kept[m]; ok || m == nil {
+			continue
+		}
+		u.droppedSeries = append(u.droppedSeries, seriesString(name, m))
+	}
+}
+
+// seriesString formats a series as its name and labels.
+func seriesString(name string, m *clientmodel.Metric) string {
+	labels := make([]string, 0, len(m.Label))
+	for _, l := range m.Label {
+		labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+	}
+	return name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// seriesCount returns the number of non-nil metrics in the family.
+func seriesCount(family *clientmodel.MetricFamily) int {
+	count := 0
+	for _, m := range family.Metric {
+		if m != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// ErrSeriesDropped is returned when series are dropped from an upload by a server that does
+// not accept partial uploads.
+type ErrSeriesDropped struct {
+	Dropped map[string]int
+	// Series lists some of the dropped series.
+	Series []string
+}
+
+func (e *ErrSeriesDropped) Error() string {
+	total := 0
+	for _, n := range e.Dropped {
+		total += n
+	}
+	return fmt.Sprintf("%d series of the upload would be dropped, and partial uploads are not accepted", total)
+}
+
+// ErrTooManySamples is returned when an upload retains more samples than the client may
+// upload at once.
+type ErrTooManySamples struct {
+	Limit int
+}
+
+func (e *ErrTooManySamples) Error() string {
+	return fmt.Sprintf("the upload exceeds the limit of %d samples", e.Limit)
+}
+
+// writeEmptyUpload responds with 204 to an upload that had no series to store, with a
+// Warning header telling the client why, so that broken federation rules do not go unnoticed.
+func writeEmptyUpload(w http.ResponseWriter, req *http.Request, summary *UploadSummary) {
+	w.Header().Set(RequestIDHeader, requestID(req))
+	w.Header().Add("Warning", `299 - "the upload has no metrics to store"`)
+	writeDroppedWarnings(w, summary)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeDroppedWarnings adds a Warning header for each reason series were dropped for, so
+// that clients learn their data was not retained in full.
+func writeDroppedWarnings(w http.ResponseWriter, summary *UploadSummary) {
+	reasons := make([]string, 0, len(summary.Dropped))
+	for reason, n := range summary.Dropped {
+		if n > 0 {
+			reasons = append(reasons, reason)
+		}
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		w.Header().Add("Warning", fmt.Sprintf("299 - \"%d series dropped: %s\"", summary.Dropped[reason], reason))
+	}
+}
+
+func writeSummary(w http.ResponseWriter, req *http.Request, summary *UploadSummary) {
+	data, err := json.Marshal(summary)
+	if err != nil {
+		log.Printf("error marshaling upload summary: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(RequestIDHeader, requestID(req))
+	writeDroppedWarnings(w, summary)
+	if _, err := w.Write(data); err != nil {
+		log.Printf("error writing upload summary: %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// Timeouts bounds the time an http.Server spends on a connection, so that slow or stalled
+// clients cannot hold connections and handlers open indefinitely. A zero value leaves the
+// corresponding timeout disabled.
+type Timeouts struct {
+	// Read limits reading a request, including its body.
+	Read time.Duration
+	// ReadHeader limits reading the request headers. It defaults to Read if zero.
+	ReadHeader time.Duration
+	// Write limits the time from the end of reading the request headers to the end of
+	// writing the response. It must exceed the time taken to stream the largest response.
+	Write time.Duration
+	// Idle limits how long a keep-alive connection waits for the next request.
+	Idle time.Duration
+}
+
+// Apply sets the timeouts of s.
+func (t Timeouts) Apply(s *http.Server) {
+	s.ReadTimeout = t.Read
+	s.ReadHeaderTimeout = t.ReadHeader
+	s.WriteTimeout = t.Write
+	s.IdleTimeout = t.Idle
+}
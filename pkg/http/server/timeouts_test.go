@@ -0,0 +1,49 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/store/memstore"
+)
+
+func TestTimeouts_StalledBody(t *testing.T) {
+	s := New(memstore.New(10*time.Minute), testValidator{partitionKey: "cluster-1"}, nil, 10*time.Minute)
+	done := make(chan struct{})
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer close(done)
+		s.Post(w, req)
+	}))
+	Timeouts{Read: 200 * time.Millisecond, Write: time.Second, Idle: time.Second}.Apply(srv.Config)
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// declare a body that is never sent in full
+	body := encodeFamilies(nil)
+	fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: test\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n", expfmt.FmtProtoDelim, len(body)+1024)
+	conn.Write(body)
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the handler did not exit after the read timeout")
+	}
+
+	// the connection is closed once the handler gives up on the body
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("the connection was not closed: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateCheckInterval limits how often the certificate files are checked for changes.
+const certificateCheckInterval = 10 * time.Second
+
+// TLSOptions configures TLS termination by the server.
+type TLSOptions struct {
+	// CertFile and KeyFile are the paths to the serving certificate and key.
+	// They are reloaded when changed on disk or when Reload is called.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is the path to a CA bundle used to verify client certificates.
+	// Clients presenting a certificate that is not signed by it are rejected.
+	ClientCAFile string
+	// RequireClientCert rejects clients that do not present a verified certificate.
+	RequireClientCert bool
+}
+
+// CertificateReloader serves a certificate and key pair from disk, picking up changes to the files.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// NewCertificateReloader loads the given certificate and key pair.
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the certificate and key pair from disk.
+func (r *CertificateReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reload()
+}
+
+func (r *CertificateReloader) reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load certificate: %v", err)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+func (r *CertificateReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return latest, fmt.Errorf("unable to read certificate: %v", err)
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate implements the tls.Config GetCertificate callback.
+// The files are checked for changes at most every certificateCheckInterval.
+// If reloading fails the previous certificate continues to be served.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.checked) >= certificateCheckInterval {
+		r.checked = now
+		if modTime, err := r.lastModified(); err == nil && !modTime.Equal(r.modTime) {
+			if err := r.reload(); err != nil {
+				log.Printf("error: unable to reload certificate, continuing with the previous one: %v", err)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// TLSConfig returns a TLS configuration for the given options along with the reloader
+// serving its certificate.
+func TLSConfig(o TLSOptions) (*tls.Config, *CertificateReloader, error) {
+	r, err := NewCertificateReloader(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+
+	if len(o.ClientCAFile) > 0 {
+		data, err := ioutil.ReadFile(o.ClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, nil, fmt.Errorf("no certificates found in client CA file %s", o.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if o.RequireClientCert {
+		if cfg.ClientCAs == nil {
+			return nil, nil, fmt.Errorf("a client CA file is required to verify client certificates")
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, r, nil
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert, serial int64) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil, 1)
+	caFile, _ := ca.write(t, dir, "ca")
+	serving := newTestCert(t, "server", ca, 2)
+	certFile, keyFile := serving.write(t, dir, "server")
+	client := newTestCert(t, "cluster-1", ca, 3)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	for _, tc := range []struct {
+		name       string
+		require    bool
+		clientCert bool
+		wantErr    bool
+		wantCN     string
+	}{
+		{name: "verification not required, no certificate", wantCN: ""},
+		{name: "verification not required, certificate", clientCert: true, wantCN: "cluster-1"},
+		{name: "verification required, no certificate", require: true, wantErr: true},
+		{name: "verification required, certificate", require: true, clientCert: true, wantCN: "cluster-1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _, err := TLSConfig(TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, RequireClientCert: tc.require})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotCN string
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &http.Server{
+				Handler: authorize.NewCertificateHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					if cert, ok := authorize.CertificateFromContext(req.Context()); ok {
+						gotCN = cert.Subject.CommonName
+					}
+				})),
+				TLSConfig: cfg,
+				ErrorLog:  log.New(ioutil.Discard, "", 0),
+			}
+			go s.ServeTLS(l, "", "")
+			defer s.Close()
+
+			clientCfg := &tls.Config{RootCAs: roots}
+			if tc.clientCert {
+				clientCfg.Certificates = []tls.Certificate{client.tlsCertificate()}
+			}
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCfg}}
+			resp, err := c.Get("https://" + l.Addr().String())
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			if gotCN != tc.wantCN {
+				t.Fatalf("want client CN %q, got %q", tc.wantCN, gotCN)
+			}
+		})
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil, 1)
+	certFile, keyFile := newTestCert(t, "first", ca, 2).write(t, dir, "server")
+
+	r, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := newTestCert(t, "second", ca, 3)
+	second.write(t, dir, "server")
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cert.Certificate[0]) != string(second.der) {
+		t.Fatalf("expected the reloaded certificate to be served")
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	telemeter_http "github.com/openshift/telemeter/pkg/http"
+	"github.com/openshift/telemeter/pkg/store/forward"
+	"github.com/openshift/telemeter/pkg/store/memstore"
+)
+
+const testSpanHeader = "X-Test-Span-Id"
+
+// recordingTracer keeps finished spans in memory.
+type recordingTracer struct {
+	mu       sync.Mutex
+	nextID   int
+	finished []*recordedSpan
+}
+
+type recordedContext struct{ id int }
+
+func (recordedContext) ForeachBaggageItem(func(k, v string) bool) {}
+
+type recordedSpan struct {
+	tracer    *recordingTracer
+	operation string
+	ctx       recordedContext
+	parent    int
+	tags      map[string]interface{}
+}
+
+func (t *recordingTracer) StartSpan(operation string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	var o opentracing.StartSpanOptions
+	for _, opt := range opts {
+		opt.Apply(&o)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	span := &recordedSpan{tracer: t, operation: operation, ctx: recordedContext{id: t.nextID}, tags: make(map[string]interface{})}
+	for _, ref := range o.References {
+		span.parent = ref.ReferencedContext.(recordedContext).id
+	}
+	return span
+}
+
+func (t *recordingTracer) Inject(sc opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	carrier.(opentracing.HTTPHeadersCarrier).Set(testSpanHeader, strconv.Itoa(sc.(recordedContext).id))
+	return nil
+}
+
+func (t *recordingTracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	id, err := strconv.Atoi(http.Header(carrier.(opentracing.HTTPHeadersCarrier)).Get(testSpanHeader))
+	if err != nil {
+		return nil, opentracing.ErrSpanContextNotFound
+	}
+	return recordedContext{id: id}, nil
+}
+
+func (t *recordingTracer) spans() map[string]*recordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	spans := make(map[string]*recordedSpan)
+	for _, s := range t.finished {
+		spans[s.operation] = s
+	}
+	return spans
+}
+
+func (s *recordedSpan) Finish() { s.FinishWithOptions(opentracing.FinishOptions{}) }
+func (s *recordedSpan) FinishWithOptions(opentracing.FinishOptions) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.finished = append(s.tracer.finished, s)
+}
+func (s *recordedSpan) Context() opentracing.SpanContext { return s.ctx }
+func (s *recordedSpan) SetOperationName(operation string) opentracing.Span {
+	s.operation = operation
+	return s
+}
+func (s *recordedSpan) SetTag(key string, value interface{}) opentracing.Span {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tags[key] = value
+	return s
+}
+func (s *recordedSpan) LogFields(...log.Field)                         {}
+func (s *recordedSpan) LogKV(...interface{})                           {}
+func (s *recordedSpan) SetBaggageItem(string, string) opentracing.Span { return s }
+func (s *recordedSpan) BaggageItem(string) string                      { return "" }
+func (s *recordedSpan) Tracer() opentracing.Tracer                     { return s.tracer }
+func (s *recordedSpan) LogEvent(string)                                {}
+func (s *recordedSpan) LogEventWithPayload(string, interface{})        {}
+func (s *recordedSpan) Log(opentracing.LogData)                        {}
+
+type tokenAuthorizer struct{}
+
+func (tokenAuthorizer) AuthorizeClient(token string) (*authorize.Client, bool, error) {
+	return &authorize.Client{ID: token}, true, nil
+}
+
+func TestServer_PostTracing(t *testing.T) {
+	tracer := &recordingTracer{}
+	received := make(chan string, 1)
+	receive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Get(testSpanHeader)
+	}))
+	defer receive.Close()
+	u, err := url.Parse(receive.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(forward.New(u, memstore.New(10*time.Minute)), testValidator{partitionKey: "cluster-1"}, nil, 10*time.Minute)
+	s.nowFn = func() time.Time { return time.Unix(1000, 0) }
+	h := telemeter_http.NewTracingHandler(tracer, "upload",
+		authorize.Middleware(authorize.TokenAuthorizer(tokenAuthorizer{}))(http.HandlerFunc(s.Post)),
+	)
+
+	f := family("test_1", 1000000)
+	f.Type = clientmodel.MetricType_COUNTER.Enum()
+	body := encodeFamilies([]*clientmodel.MetricFamily{f})
+	req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+	req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+	req.Header.Set("Authorization", "Bearer client-1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+	}
+
+	var propagated string
+	select {
+	case propagated = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upload was not forwarded")
+	}
+	var spans map[string]*recordedSpan
+	for i := 0; i < 100; i++ {
+		if spans = tracer.spans(); len(spans) == 4 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	upload, validate, store, fwd := spans["upload"], spans["validate"], spans["store"], spans["forward"]
+	if upload == nil || validate == nil || store == nil || fwd == nil {
+		t.Fatalf("missing spans, got %v", spans)
+	}
+	if upload.parent != 0 || validate.parent != upload.ctx.id || store.parent != upload.ctx.id || fwd.parent != store.ctx.id {
+		t.Errorf("unexpected span relationships: upload=%d validate=%d->%d store=%d->%d forward=%d->%d",
+			upload.ctx.id, validate.ctx.id, validate.parent, store.ctx.id, store.parent, fwd.ctx.id, fwd.parent)
+	}
+	if propagated != strconv.Itoa(fwd.ctx.id) {
+		t.Errorf("want forward span %d propagated to the receive endpoint, got %q", fwd.ctx.id, propagated)
+	}
+	if upload.tags["client.id"] != "client-1" || upload.tags["http.request_content_length"] != int64(len(body)) || upload.tags["http.status_code"] != http.StatusOK {
+		t.Errorf("unexpected upload span tags %v", upload.tags)
+	}
+	if fwd.tags["http.status_code"] != http.StatusOK {
+		t.Errorf("unexpected forward span tags %v", fwd.tags)
+	}
+}
+
+func TestTracingHandler_Parent(t *testing.T) {
+	tracer := &recordingTracer{}
+	h := telemeter_http.NewTracingHandler(tracer, "read", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	req := httptest.NewRequest("GET", "/federate", nil)
+	req.Header.Set(testSpanHeader, "42")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	span := tracer.spans()["read"]
+	if span == nil || span.parent != 42 {
+		t.Fatalf("want span with the propagated parent, got %+v", span)
+	}
+	if span.tags["error"] != true || span.tags["http.status_code"] != http.StatusInternalServerError {
+		t.Errorf("unexpected tags %v", span.tags)
+	}
+}
@@ -0,0 +1,33 @@
+package http
+
+import (
+	"net/http"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// NewTracingHandler returns a handler starting a span named operation for each request to next,
+// as a child of the span propagated in the request headers if any. Handlers may add children
+// to the span found in the request context. The opentracing.NoopTracer disables tracing.
+func NewTracingHandler(tracer opentracing.Tracer, operation string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var opts []opentracing.StartSpanOption
+		if parent, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header)); err == nil {
+			opts = append(opts, opentracing.ChildOf(parent))
+		}
+		span := tracer.StartSpan(operation, opts...)
+		defer span.Finish()
+		span.SetTag("http.method", req.Method)
+		span.SetTag("http.url", req.URL.Path)
+		if req.ContentLength >= 0 {
+			span.SetTag("http.request_content_length", req.ContentLength)
+		}
+
+		sw := NewStatusWriter(w)
+		next.ServeHTTP(sw, req.WithContext(opentracing.ContextWithSpan(req.Context(), span)))
+		span.SetTag("http.status_code", sw.Code)
+		if sw.Code >= http.StatusInternalServerError {
+			span.SetTag("error", true)
+		}
+	})
+}
@@ -0,0 +1,242 @@
+package idempotency
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/cache"
+)
+
+// Header is the request header carrying a client chosen key for an upload.
+const Header = "Idempotency-Key"
+
+// ReplayedHeader is set on responses answered from the cache instead of handling the request.
+const ReplayedHeader = "Idempotent-Replayed"
+
+// maxBodyBytes bounds the response bodies remembered, larger responses are not cached.
+const maxBodyBytes = 64 * 1024
+
+var (
+	cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "telemeter_idempotency_cache_hits_total",
+		Help: "Tracks the number of repeated uploads answered from the idempotency cache.",
+	})
+	cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "telemeter_idempotency_cache_misses_total",
+		Help: "Tracks the number of uploads not found in the idempotency cache.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(cacheHits, cacheMisses)
+}
+
+// response is a successful response remembered for a key.
+type response struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+type entry struct {
+	response response
+	expires  time.Time
+}
+
+// Cache remembers the successful responses of recent requests per client and key, and tracks
+// the requests being handled, so that a retry waits for the request it repeats.
+type Cache struct {
+	ttl   time.Duration
+	nowFn func() time.Time
+
+	// shared holds the responses instead of lru if set
+	shared cache.Cache
+
+	mu       sync.Mutex
+	lru      *simplelru.LRU
+	inFlight map[string]chan struct{}
+}
+
+// NewCache returns a cache remembering up to size responses for the given TTL.
+func NewCache(size int, ttl time.Duration) (*Cache, error) {
+	lru, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{
+		ttl:      ttl,
+		nowFn:    time.Now,
+		lru:      lru,
+		inFlight: make(map[string]chan struct{}),
+	}, nil
+}
+
+// NewSharedCache returns a cache like NewCache that remembers responses in shared, so that a
+// retry of a completed request is answered by any server sharing it. Retries of a request
+// still being handled only wait for it on the same server.
+func NewSharedCache(shared cache.Cache, ttl time.Duration) *Cache {
+	return &Cache{
+		ttl:      ttl,
+		nowFn:    time.Now,
+		shared:   shared,
+		inFlight: make(map[string]chan struct{}),
+	}
+}
+
+func (c *Cache) get(key string) (response, bool) {
+	if c.shared != nil {
+		value, ok, err := c.shared.Get("idempotency/" + key)
+		if err != nil || !ok {
+			return response{}, false
+		}
+		var r response
+		if err := json.Unmarshal(value, &r); err != nil {
+			return response{}, false
+		}
+		return r, true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return response{}, false
+	}
+	e := v.(entry)
+	if !c.nowFn().Before(e.expires) {
+		c.lru.Remove(key)
+		return response{}, false
+	}
+	return e.response, true
+}
+
+func (c *Cache) add(key string, r response) {
+	if c.shared != nil {
+		data, err := json.Marshal(r)
+		if err == nil {
+			c.shared.Set("idempotency/"+key, data, c.ttl)
+		}
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Add(key, entry{response: r, expires: c.nowFn().Add(c.ttl)})
+}
+
+// acquire marks the request of key as being handled and returns true, or returns false and a
+// channel closed once the request handling it is done.
+func (c *Cache) acquire(key string) (<-chan struct{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if done, ok := c.inFlight[key]; ok {
+		return done, false
+	}
+	c.inFlight[key] = make(chan struct{})
+	return nil, true
+}
+
+// release marks the request of key as handled, waking up its retries.
+func (c *Cache) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.inFlight[key])
+	delete(c.inFlight, key)
+}
+
+// key returns the cache key of the request, or false if the request has no Idempotency-Key.
+func key(req *http.Request) (string, bool) {
+	key := req.Header.Get(Header)
+	if len(key) == 0 {
+		return "", false
+	}
+	var id string
+	if client, ok := authorize.FromContext(req.Context()); ok {
+		id = client.ID
+	}
+	return id + "\x00" + key, true
+}
+
+// responseRecorder records the status and the beginning of the body of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *responseRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body.Len()+len(data) > maxBodyBytes {
+		w.truncated = true
+	} else {
+		w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// NewHandler deduplicates retried requests. A request repeating the Idempotency-Key of a
+// successful request of the same client within the cache TTL is answered with the original
+// response without being passed to next. A retry arriving while the request it repeats is
+// handled waits for it. Only successful responses are remembered, so that the client may retry
+// requests that failed or were throttled. Requests without a key are passed to next as they are.
+func NewHandler(c *Cache, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key, ok := key(req)
+		if !ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		for {
+			if r, ok := c.get(key); ok {
+				cacheHits.Inc()
+				if len(r.ContentType) > 0 {
+					w.Header().Set("Content-Type", r.ContentType)
+				}
+				w.Header().Set(ReplayedHeader, "true")
+				w.WriteHeader(r.Status)
+				w.Write(r.Body)
+				return
+			}
+			done, ok := c.acquire(key)
+			if ok {
+				break
+			}
+			select {
+			case <-done:
+			case <-req.Context().Done():
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		defer c.release(key)
+		cacheMisses.Inc()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status/100 == 2 && !rec.truncated {
+			c.add(key, response{Status: rec.status, ContentType: w.Header().Get("Content-Type"), Body: rec.body.Bytes()})
+		}
+	})
+}
@@ -0,0 +1,205 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/http/server"
+	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/store"
+)
+
+type countingStore struct {
+	writes int
+}
+
+func (s *countingStore) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*store.PartitionedMetrics, error) {
+	return nil, nil
+}
+
+func (s *countingStore) WriteMetrics(context.Context, *store.PartitionedMetrics) error {
+	s.writes++
+	return nil
+}
+
+type testValidator struct{}
+
+func (testValidator) Validate(ctx context.Context, req *http.Request) (string, metricfamily.Transformer, error) {
+	return "cluster-1", nil, nil
+}
+
+func (testValidator) ValidateUpload(ctx context.Context, client *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+	return families, nil
+}
+
+func upload(name string) []byte {
+	one, ts := float64(1), int64(1000)
+	buf := &bytes.Buffer{}
+	family := &clientmodel.MetricFamily{Name: &name, Metric: []*clientmodel.Metric{{Counter: &clientmodel.Counter{Value: &one}, TimestampMs: &ts}}}
+	if err := expfmt.NewEncoder(buf, expfmt.FmtProtoDelim).Encode(family); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandler(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	for _, tc := range []struct {
+		name       string
+		bodies     [][]byte
+		keys       []string
+		clients    []string
+		advance    time.Duration
+		wantWrites int
+	}{
+		{
+			name:       "requests without a key are not deduplicated",
+			bodies:     [][]byte{upload("a"), upload("a")},
+			wantWrites: 2,
+		},
+		{
+			name:       "identical keys are deduplicated",
+			bodies:     [][]byte{upload("a"), upload("b")},
+			keys:       []string{"1", "1"},
+			wantWrites: 1,
+		},
+		{
+			name:       "keys are scoped by client",
+			bodies:     [][]byte{upload("a"), upload("a")},
+			keys:       []string{"1", "1"},
+			clients:    []string{"x", "y"},
+			wantWrites: 2,
+		},
+		{
+			name:       "expired entries are not deduplicated",
+			bodies:     [][]byte{upload("a"), upload("a")},
+			keys:       []string{"1", "1"},
+			advance:    2 * time.Minute,
+			wantWrites: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &countingStore{}
+			c, err := NewCache(10, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.nowFn = func() time.Time { return now }
+			h := NewHandler(c, http.HandlerFunc(server.New(s, testValidator{}, nil, time.Hour).Post))
+
+			for i, body := range tc.bodies {
+				now = now.Add(tc.advance)
+				req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+				req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+				if len(tc.keys) > 0 {
+					req.Header.Set(Header, tc.keys[i])
+				}
+				if len(tc.clients) > 0 {
+					req = req.WithContext(authorize.WithClient(req.Context(), &authorize.Client{ID: tc.clients[i]}))
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+				}
+			}
+			if s.writes != tc.wantWrites {
+				t.Fatalf("want %d writes, got %d", tc.wantWrites, s.writes)
+			}
+		})
+	}
+}
+
+func TestHandlerResponses(t *testing.T) {
+	c, err := NewCache(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int
+	status := http.StatusTooManyRequests
+	h := NewHandler(c, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"call":%d}`, calls)
+	}))
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/upload", nil)
+		req.Header.Set(Header, "1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// throttled requests are passed on when retried
+	for i := 1; i <= 2; i++ {
+		if w := send(); w.Code != http.StatusTooManyRequests || calls != i {
+			t.Fatalf("want the throttled request handled, got %d after %d calls", w.Code, calls)
+		}
+	}
+
+	// the response of a successful request is replayed
+	status = http.StatusOK
+	want := send().Body.String()
+	w := send()
+	if calls != 3 || w.Code != http.StatusOK || w.Body.String() != want || w.Header().Get("Content-Type") != "application/json" || w.Header().Get(ReplayedHeader) != "true" {
+		t.Fatalf("want the response %s replayed, got %d %s after %d calls", want, w.Code, w.Body.String(), calls)
+	}
+}
+
+func TestHandlerInFlight(t *testing.T) {
+	c, err := NewCache(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	started, release := make(chan struct{}), make(chan struct{})
+	h := NewHandler(c, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		w.Write([]byte("stored"))
+	}))
+
+	var wg sync.WaitGroup
+	codes := make([]*httptest.ResponseRecorder, 2)
+	for i := range codes {
+		if i == 1 {
+			<-started
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/upload", nil)
+			req.Header.Set(Header, "1")
+			codes[i] = httptest.NewRecorder()
+			h.ServeHTTP(codes[i], req)
+		}(i)
+	}
+	// the retry waits for the request it repeats
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("want the request handled once, got %d", n)
+	}
+	for _, w := range codes {
+		if w.Code != http.StatusOK || w.Body.String() != "stored" {
+			t.Errorf("want the response of the request, got %d %s", w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Package logthrottle aggregates repeated log messages, so that a burst of identical
+// failures is logged once followed by a summary of how often it was repeated.
+package logthrottle
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	start      time.Time
+	suppressed int
+}
+
+// Logger logs the first message of each key once per window and counts the rest. Only keys
+// seen in the current window are tracked, up to a maximum, so memory use is bounded.
+type Logger struct {
+	window  time.Duration
+	maxKeys int
+	logf    func(format string, args ...interface{})
+	nowFn   func() time.Time
+
+	mu       sync.Mutex
+	entries  map[string]*entry
+	overflow *entry
+}
+
+// New returns a Logger logging through log.Printf, tracking at most maxKeys keys per window.
+// Messages of further keys are logged as a single summary.
+func New(window time.Duration, maxKeys int) *Logger {
+	return &Logger{
+		window:  window,
+		maxKeys: maxKeys,
+		logf:    log.Printf,
+		nowFn:   time.Now,
+		entries: make(map[string]*entry),
+	}
+}
+
+// Printf logs the message unless one with the same key was logged within the window.
+func (l *Logger) Printf(key, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.nowFn()
+	if e, ok := l.entries[key]; ok {
+		if now.Sub(e.start) < l.window {
+			e.suppressed++
+			return
+		}
+		l.summarize(key, e)
+		delete(l.entries, key)
+	}
+	if len(l.entries) >= l.maxKeys {
+		if l.overflow == nil {
+			l.overflow = &entry{start: now}
+		}
+		l.overflow.suppressed++
+		return
+	}
+
+	l.entries[key] = &entry{start: now}
+	l.logf(format, args...)
+}
+
+// Flush logs a summary for every key whose window has ended and stops tracking it.
+func (l *Logger) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.nowFn()
+	keys := make([]string, 0, len(l.entries))
+	for key, e := range l.entries {
+		if now.Sub(e.start) >= l.window {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		l.summarize(key, l.entries[key])
+		delete(l.entries, key)
+	}
+	if l.overflow != nil && now.Sub(l.overflow.start) >= l.window {
+		l.logf("suppressed %d messages for further keys in the last %s", l.overflow.suppressed, l.window)
+		l.overflow = nil
+	}
+}
+
+// Run flushes the logger every window until stop is closed.
+func (l *Logger) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(l.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.Flush()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (l *Logger) summarize(key string, e *entry) {
+	if e.suppressed == 0 {
+		return
+	}
+	l.logf("suppressed %d repeated messages for %s in the last %s", e.suppressed, key, l.window)
+}
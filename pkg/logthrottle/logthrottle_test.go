@@ -0,0 +1,95 @@
+package logthrottle
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testLogger(window time.Duration, maxKeys int) (*Logger, *time.Time, func() []string) {
+	now := time.Unix(1000, 0)
+	var mu sync.Mutex
+	var lines []string
+	l := New(window, maxKeys)
+	l.nowFn = func() time.Time { return now }
+	l.logf = func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	return l, &now, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), lines...)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	l, now, lines := testLogger(time.Minute, 10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Printf("client=a code=missing_label", "error: client a is missing a label")
+		}()
+	}
+	wg.Wait()
+	l.Printf("client=b code=missing_label", "error: client b is missing a label")
+
+	l.Flush()
+	want := []string{"error: client a is missing a label", "error: client b is missing a label"}
+	if got := lines(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %q before the window ends, got %q", want, got)
+	}
+
+	*now = now.Add(time.Minute)
+	l.Flush()
+	want = append(want, "suppressed 99 repeated messages for client=a code=missing_label in the last 1m0s")
+	if got := lines(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+
+	// the next window logs the message again
+	l.Printf("client=a code=missing_label", "error: client a is missing a label")
+	want = append(want, "error: client a is missing a label")
+	if got := lines(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestLogger_NextWindowWithoutFlush(t *testing.T) {
+	l, now, lines := testLogger(time.Minute, 10)
+	l.Printf("a", "first")
+	l.Printf("a", "second")
+	*now = now.Add(2 * time.Minute)
+	l.Printf("a", "third")
+
+	want := []string{"first", "suppressed 1 repeated messages for a in the last 1m0s", "third"}
+	if got := lines(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestLogger_MaxKeys(t *testing.T) {
+	l, now, lines := testLogger(time.Minute, 2)
+	for i := 0; i < 5; i++ {
+		l.Printf(fmt.Sprintf("client=%d", i), "client %d failed", i)
+	}
+	if len(l.entries) != 2 {
+		t.Fatalf("want at most 2 tracked keys, got %d", len(l.entries))
+	}
+
+	*now = now.Add(time.Minute)
+	l.Flush()
+	want := []string{"client 0 failed", "client 1 failed", "suppressed 3 messages for further keys in the last 1m0s"}
+	if got := lines(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	if len(l.entries) != 0 || l.overflow != nil {
+		t.Fatalf("want nothing tracked after the window, got %v", l.entries)
+	}
+}
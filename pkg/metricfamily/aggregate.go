@@ -0,0 +1,243 @@
+package metricfamily
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// AggregationRule records an aggregation of the series of a metric as a new metric, like a
+// Prometheus recording rule.
+type AggregationRule struct {
+	// Record is the name of the metric of the aggregated series.
+	Record string `json:"record"`
+	// Expr aggregates the series of a metric selector with sum, count, min, max or avg, grouped
+	// by or without labels, as in `sum by (namespace) (container_memory_usage_bytes)`.
+	Expr string `json:"expr"`
+	// KeepInputs keeps the aggregated series, which are otherwise dropped.
+	KeepInputs bool `json:"keep_inputs"`
+}
+
+type aggregation struct {
+	record     string
+	op         string
+	name       string
+	matchers   []*labels.Matcher
+	grouping   []string
+	without    bool
+	keepInputs bool
+}
+
+// Aggregator evaluates aggregation rules over metric families.
+type Aggregator struct {
+	aggregations []aggregation
+}
+
+// NewAggregator returns an aggregator of the rules, or an error if a rule is not an
+// aggregation of a metric selector it supports.
+func NewAggregator(rules []AggregationRule) (*Aggregator, error) {
+	a := &Aggregator{}
+	records := make(map[string]struct{})
+	for _, rule := range rules {
+		if !model.IsValidMetricName(model.LabelValue(rule.Record)) {
+			return nil, fmt.Errorf("aggregation rule %q must record a valid metric name", rule.Record)
+		}
+		if _, ok := records[rule.Record]; ok {
+			return nil, fmt.Errorf("aggregation rule %q is recorded more than once", rule.Record)
+		}
+		records[rule.Record] = struct{}{}
+
+		expr, err := promql.ParseExpr(rule.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("aggregation rule %q is invalid: %v", rule.Record, err)
+		}
+		agg, ok := expr.(*promql.AggregateExpr)
+		if !ok {
+			return nil, fmt.Errorf("aggregation rule %q must be an aggregation: %s", rule.Record, rule.Expr)
+		}
+		op := agg.Op.String()
+		switch op {
+		case "sum", "count", "min", "max", "avg":
+		default:
+			return nil, fmt.Errorf("aggregation rule %q must use sum, count, min, max or avg: %s", rule.Record, op)
+		}
+		selector, ok := agg.Expr.(*promql.VectorSelector)
+		if !ok || len(selector.Name) == 0 || selector.Offset != 0 {
+			return nil, fmt.Errorf("aggregation rule %q must aggregate a metric selector without offset: %s", rule.Record, agg.Expr)
+		}
+		grouping := append([]string(nil), agg.Grouping...)
+		sort.Strings(grouping)
+		a.aggregations = append(a.aggregations, aggregation{
+			record:     rule.Record,
+			op:         op,
+			name:       selector.Name,
+			matchers:   selector.LabelMatchers,
+			grouping:   grouping,
+			without:    agg.Without,
+			keepInputs: rule.KeepInputs,
+		})
+	}
+	return a, nil
+}
+
+// group is the state of the aggregation of the series of a group.
+type group struct {
+	labels    []*clientmodel.LabelPair
+	sum       float64
+	count     float64
+	min       float64
+	max       float64
+	timestamp int64
+}
+
+// Aggregate returns the families with a family of aggregated series appended for each rule
+// matching series. Series of counters, gauges and untyped metrics are aggregated, and dropped
+// unless a rule aggregating them keeps its inputs. Aggregated series have the latest timestamp
+// of their inputs, and sums of counters are counters, while other aggregations are gauges.
+func (a *Aggregator) Aggregate(families []*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	if a == nil || len(a.aggregations) == 0 {
+		return families
+	}
+	var results []*clientmodel.MetricFamily
+	consumed := make(map[*clientmodel.Metric]struct{})
+	for _, agg := range a.aggregations {
+		groups := make(map[string]*group)
+		var counters bool
+		for _, family := range families {
+			if family == nil || family.GetName() != agg.name {
+				continue
+			}
+			counters = family.GetType() == clientmodel.MetricType_COUNTER
+			for _, m := range family.Metric {
+				if m == nil || !match(agg.name, m, agg.matchers...) {
+					continue
+				}
+				value, ok := sampleValue(m)
+				if !ok {
+					continue
+				}
+				if !agg.keepInputs {
+					consumed[m] = struct{}{}
+				}
+				key, groupLabels := agg.group(m)
+				g, ok := groups[key]
+				if !ok {
+					g = &group{labels: groupLabels, min: value, max: value}
+					groups[key] = g
+				}
+				g.sum += value
+				g.count++
+				g.min = math.Min(g.min, value)
+				g.max = math.Max(g.max, value)
+				if m.GetTimestampMs() > g.timestamp {
+					g.timestamp = m.GetTimestampMs()
+				}
+			}
+		}
+		if len(groups) == 0 {
+			continue
+		}
+		results = append(results, agg.family(groups, counters))
+	}
+
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		for i, m := range family.Metric {
+			if _, ok := consumed[m]; ok {
+				family.Metric[i] = nil
+			}
+		}
+		PackMetrics(family)
+	}
+	return append(Pack(families), results...)
+}
+
+// group returns the key of the group of the series, and the labels of the group.
+func (agg aggregation) group(m *clientmodel.Metric) (string, []*clientmodel.LabelPair) {
+	var key strings.Builder
+	var pairs []*clientmodel.LabelPair
+	for _, pair := range m.Label {
+		if pair == nil || len(pair.GetValue()) == 0 {
+			continue
+		}
+		i := sort.SearchStrings(agg.grouping, pair.GetName())
+		grouped := i < len(agg.grouping) && agg.grouping[i] == pair.GetName()
+		if grouped == agg.without {
+			continue
+		}
+		pairs = append(pairs, &clientmodel.LabelPair{Name: proto.String(pair.GetName()), Value: proto.String(pair.GetValue())})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+	for _, pair := range pairs {
+		key.WriteString(pair.GetName())
+		key.WriteByte(0xff)
+		key.WriteString(pair.GetValue())
+		key.WriteByte(0xff)
+	}
+	return key.String(), pairs
+}
+
+// family returns the family of the aggregated series of the groups, sorted by labels.
+func (agg aggregation) family(groups map[string]*group, counters bool) *clientmodel.MetricFamily {
+	family := &clientmodel.MetricFamily{
+		Name: proto.String(agg.record),
+		Type: clientmodel.MetricType_GAUGE.Enum(),
+	}
+	if counters && agg.op == "sum" {
+		family.Type = clientmodel.MetricType_COUNTER.Enum()
+	}
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		g := groups[key]
+		var value float64
+		switch agg.op {
+		case "sum":
+			value = g.sum
+		case "count":
+			value = g.count
+		case "min":
+			value = g.min
+		case "max":
+			value = g.max
+		case "avg":
+			value = g.sum / g.count
+		}
+		m := &clientmodel.Metric{Label: g.labels}
+		if g.timestamp != 0 {
+			m.TimestampMs = proto.Int64(g.timestamp)
+		}
+		if family.GetType() == clientmodel.MetricType_COUNTER {
+			m.Counter = &clientmodel.Counter{Value: proto.Float64(value)}
+		} else {
+			m.Gauge = &clientmodel.Gauge{Value: proto.Float64(value)}
+		}
+		family.Metric = append(family.Metric, m)
+	}
+	return family
+}
+
+// sampleValue returns the value of a series of a counter, gauge or untyped metric.
+func sampleValue(m *clientmodel.Metric) (float64, bool) {
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue(), true
+	case m.Gauge != nil:
+		return m.Gauge.GetValue(), true
+	case m.Untyped != nil:
+		return m.Untyped.GetValue(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,193 @@
+package metricfamily
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestAggregate(t *testing.T) {
+	// series returns a series with the value and labels of the form name=value
+	series := func(value float64, ts int64, labels ...string) *clientmodel.Metric {
+		m := &clientmodel.Metric{Gauge: &clientmodel.Gauge{Value: proto.Float64(value)}, TimestampMs: proto.Int64(ts)}
+		for _, l := range labels {
+			parts := strings.SplitN(l, "=", 2)
+			m.Label = append(m.Label, &clientmodel.LabelPair{Name: proto.String(parts[0]), Value: proto.String(parts[1])})
+		}
+		return m
+	}
+	input := func() []*clientmodel.MetricFamily {
+		return []*clientmodel.MetricFamily{
+			{
+				Name: proto.String("memory_bytes"),
+				Type: clientmodel.MetricType_GAUGE.Enum(),
+				Metric: []*clientmodel.Metric{
+					series(1, 1000, "namespace=a", "pod=a-1"),
+					series(3, 2000, "namespace=a", "pod=a-2"),
+					series(10, 1000, "namespace=b", "pod=b-1"),
+					series(4, 1000, "pod=none"),
+				},
+			},
+			{
+				Name: proto.String("requests_total"),
+				Type: clientmodel.MetricType_COUNTER.Enum(),
+				Metric: []*clientmodel.Metric{
+					{Counter: &clientmodel.Counter{Value: proto.Float64(5)}, Label: series(0, 0, "code=200", "job=api").Label},
+					{Counter: &clientmodel.Counter{Value: proto.Float64(2)}, Label: series(0, 0, "code=500", "job=api").Label},
+				},
+			},
+			{
+				Name:   proto.String("up"),
+				Type:   clientmodel.MetricType_GAUGE.Enum(),
+				Metric: []*clientmodel.Metric{series(1, 1000, "job=api")},
+			},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		rules []AggregationRule
+		want  []string
+	}{
+		{
+			name:  "sum by",
+			rules: []AggregationRule{{Record: "namespace:memory_bytes:sum", Expr: "sum by (namespace) (memory_bytes)"}},
+			want: []string{
+				"namespace:memory_bytes:sum{namespace=a} 4 @2000",
+				"namespace:memory_bytes:sum{} 4 @1000",
+				"namespace:memory_bytes:sum{namespace=b} 10 @1000",
+				"counter requests_total{code=200,job=api} 5",
+				"counter requests_total{code=500,job=api} 2",
+				"up{job=api} 1 @1000",
+			},
+		},
+		{
+			name: "count, min, max and avg",
+			rules: []AggregationRule{
+				{Record: "count", Expr: "count by (namespace) (memory_bytes)", KeepInputs: true},
+				{Record: "min", Expr: "min(memory_bytes)", KeepInputs: true},
+				{Record: "max", Expr: "max(memory_bytes)", KeepInputs: true},
+				{Record: "avg", Expr: "avg without (pod) (memory_bytes)", KeepInputs: true},
+			},
+			want: []string{
+				"avg{namespace=a} 2 @2000",
+				"avg{} 4 @1000",
+				"avg{namespace=b} 10 @1000",
+				"count{namespace=a} 2 @2000",
+				"count{} 1 @1000",
+				"count{namespace=b} 1 @1000",
+				"max{} 10 @2000",
+				"memory_bytes{namespace=a,pod=a-1} 1 @1000",
+				"memory_bytes{namespace=a,pod=a-2} 3 @2000",
+				"memory_bytes{namespace=b,pod=b-1} 10 @1000",
+				"memory_bytes{pod=none} 4 @1000",
+				"min{} 1 @2000",
+				"counter requests_total{code=200,job=api} 5",
+				"counter requests_total{code=500,job=api} 2",
+				"up{job=api} 1 @1000",
+			},
+		},
+		{
+			name:  "selected series",
+			rules: []AggregationRule{{Record: "a:memory_bytes:sum", Expr: `sum(memory_bytes{namespace="a"})`}},
+			want: []string{
+				"a:memory_bytes:sum{} 4 @2000",
+				"memory_bytes{namespace=b,pod=b-1} 10 @1000",
+				"memory_bytes{pod=none} 4 @1000",
+				"counter requests_total{code=200,job=api} 5",
+				"counter requests_total{code=500,job=api} 2",
+				"up{job=api} 1 @1000",
+			},
+		},
+		{
+			name:  "sum of counters",
+			rules: []AggregationRule{{Record: "job:requests_total:sum", Expr: "sum by (job) (requests_total)"}},
+			want: []string{
+				"counter job:requests_total:sum{job=api} 7",
+				"memory_bytes{namespace=a,pod=a-1} 1 @1000",
+				"memory_bytes{namespace=a,pod=a-2} 3 @2000",
+				"memory_bytes{namespace=b,pod=b-1} 10 @1000",
+				"memory_bytes{pod=none} 4 @1000",
+				"up{job=api} 1 @1000",
+			},
+		},
+		{
+			name: "inputs kept by one rule and dropped by another",
+			rules: []AggregationRule{
+				{Record: "up:sum", Expr: "sum(up)", KeepInputs: true},
+				{Record: "up:count", Expr: "count(up)"},
+				{Record: "missing:sum", Expr: "sum(missing)"},
+			},
+			want: []string{
+				"memory_bytes{namespace=a,pod=a-1} 1 @1000",
+				"memory_bytes{namespace=a,pod=a-2} 3 @2000",
+				"memory_bytes{namespace=b,pod=b-1} 10 @1000",
+				"memory_bytes{pod=none} 4 @1000",
+				"counter requests_total{code=200,job=api} 5",
+				"counter requests_total{code=500,job=api} 2",
+				"up:count{} 1 @1000",
+				"up:sum{} 1 @1000",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewAggregator(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, family := range a.Aggregate(input()) {
+				for _, m := range family.Metric {
+					got = append(got, formatSeries(family, m))
+				}
+			}
+			// the order of families is not kept
+			sort.Strings(got)
+			sort.Strings(tt.want)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want\n%s\ngot\n%s", strings.Join(tt.want, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+}
+
+func TestNewAggregatorInvalid(t *testing.T) {
+	for _, rule := range []AggregationRule{
+		{Record: "invalid name", Expr: "sum(up)"},
+		{Record: "up:sum", Expr: "sum(up"},
+		{Record: "up:sum", Expr: "up"},
+		{Record: "up:sum", Expr: "topk(1, up)"},
+		{Record: "up:sum", Expr: "sum(rate(up[5m]))"},
+		{Record: "up:sum", Expr: "sum(up offset 5m)"},
+	} {
+		if _, err := NewAggregator([]AggregationRule{rule}); err == nil {
+			t.Errorf("want rule %s: %s rejected", rule.Record, rule.Expr)
+		}
+	}
+	if _, err := NewAggregator([]AggregationRule{{Record: "up:sum", Expr: "sum(up)"}, {Record: "up:sum", Expr: "count(up)"}}); err == nil {
+		t.Error("want rules recording the same metric rejected")
+	}
+}
+
+// formatSeries formats a series as name{labels} value @timestamp, prefixed with the type of
+// the family if it is a counter.
+func formatSeries(family *clientmodel.MetricFamily, m *clientmodel.Metric) string {
+	var labels []string
+	for _, pair := range m.Label {
+		labels = append(labels, pair.GetName()+"="+pair.GetValue())
+	}
+	s := fmt.Sprintf("%s{%s} %v", family.GetName(), strings.Join(labels, ","), m.GetGauge().GetValue()+m.GetCounter().GetValue())
+	if family.GetType() == clientmodel.MetricType_COUNTER {
+		s = "counter " + s
+	}
+	if m.TimestampMs != nil {
+		s += fmt.Sprintf(" @%d", m.GetTimestampMs())
+	}
+	return s
+}
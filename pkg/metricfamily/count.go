@@ -1,16 +1,62 @@
 package metricfamily
 
-import clientmodel "github.com/prometheus/client_model/go"
+import (
+	"fmt"
 
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// ErrSeriesLimit is returned by a Count once more series than its limit went through it.
+type ErrSeriesLimit struct {
+	Limit int
+}
+
+func (e *ErrSeriesLimit) Error() string {
+	return fmt.Sprintf("more than %d series", e.Limit)
+}
+
+// Count is a transformer tallying the families and series going through it. The zero value
+// only counts.
 type Count struct {
 	families int
 	metrics  int
+
+	limit   int
+	counter prometheus.Counter
+}
+
+// NewCount returns a Count failing with *ErrSeriesLimit once the running count of series
+// exceeds limitSeries, unless it is not positive, in which case it only counts. The series of
+// every family are added to counter, if set, including those of the family going over the
+// limit. A Count keeps a running count, so that one is needed for every set of families.
+func NewCount(limitSeries int, counter prometheus.Counter) *Count {
+	return &Count{limit: limitSeries, counter: counter}
 }
 
+// Families returns the number of families counted.
+func (t *Count) Families() int { return t.families }
+
+// Metrics returns the number of series counted, skipping nil metrics.
 func (t *Count) Metrics() int { return t.metrics }
 
 func (t *Count) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	if family == nil {
+		return false, nil
+	}
+	n := 0
+	for _, m := range family.Metric {
+		if m != nil {
+			n++
+		}
+	}
 	t.families++
-	t.metrics += len(family.Metric)
+	t.metrics += n
+	if t.counter != nil {
+		t.counter.Add(float64(n))
+	}
+	if t.limit > 0 && t.metrics > t.limit {
+		return false, &ErrSeriesLimit{Limit: t.limit}
+	}
 	return true, nil
 }
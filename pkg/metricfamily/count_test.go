@@ -0,0 +1,51 @@
+package metricfamily
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestCount(t *testing.T) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_series_total"})
+	counterValue := func() float64 {
+		m := &clientmodel.Metric{}
+		if err := counter.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+
+	count := NewCount(5, counter)
+	withNil := family("B", 3, 4)
+	withNil.Metric = append(withNil.Metric, nil)
+	for _, f := range []*clientmodel.MetricFamily{family("A", 1, 2), nil, withNil, family("C", 5)} {
+		if ok, err := count.Transform(f); err != nil || ok != (f != nil) {
+			t.Fatalf("want %s kept up to the limit, got %t, %v", f.GetName(), ok, err)
+		}
+	}
+	if count.Families() != 3 || count.Metrics() != 5 || counterValue() != 5 {
+		t.Errorf("want 3 families and 5 series counted, got %d, %d and %v", count.Families(), count.Metrics(), counterValue())
+	}
+
+	// the series going over the limit are counted before failing
+	ok, err := count.Transform(family("D", 6))
+	if e, isLimit := err.(*ErrSeriesLimit); ok || !isLimit || e.Limit != 5 {
+		t.Fatalf("want *ErrSeriesLimit over the limit, got %t, %v", ok, err)
+	}
+	if count.Metrics() != 6 || counterValue() != 6 {
+		t.Errorf("want 6 series counted, got %d and %v", count.Metrics(), counterValue())
+	}
+
+	// without a limit, series are only counted
+	count = NewCount(0, nil)
+	for i := 0; i < 3; i++ {
+		if ok, err := count.Transform(family("A", 1, 2, 3)); !ok || err != nil {
+			t.Fatalf("want the family kept, got %t, %v", ok, err)
+		}
+	}
+	if count.Metrics() != 9 {
+		t.Errorf("want 9 series counted, got %d", count.Metrics())
+	}
+}
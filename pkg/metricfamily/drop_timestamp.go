@@ -17,3 +17,9 @@ func DropTimestamp(family *clientmodel.MetricFamily) (bool, error) {
 
 	return true, nil
 }
+
+// DropTimestamps returns a transformer that removes the timestamps from metrics, so that they
+// are stamped with the time they are received instead of the time reported by the client.
+func DropTimestamps() TransformerFunc {
+	return DropTimestamp
+}
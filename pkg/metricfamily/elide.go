@@ -1,34 +1,68 @@
 package metricfamily
 
 import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
 	prom "github.com/prometheus/client_model/go"
 )
 
+var elidedLabels = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "telemeter_elided_labels_total",
+	Help: "Tracks the number of labels elided from incoming series, by label.",
+}, []string{"label"})
+
+var elideMergedSeries = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "telemeter_elide_merged_series_total",
+	Help: "Tracks the number of series merged into another because they were identical once labels were elided.",
+})
+
+func init() {
+	prometheus.MustRegister(elidedLabels, elideMergedSeries)
+}
+
 type elide struct {
-	labelSet map[string]struct{}
+	labelSet       map[string]struct{}
+	keepTimestamps bool
 }
 
-// NewElide creates a new elide transformer for the given metrics.
-func NewElide(labels ...string) *elide {
+// NewElide creates a new elide transformer for the given metrics. If keepTimestamps is set,
+// only samples with the same timestamp are merged, as the samples a series has at other times
+// are all stored.
+func NewElide(keepTimestamps bool, labels ...string) *elide {
 	labelSet := make(map[string]struct{})
 	for i := range labels {
 		labelSet[labels[i]] = struct{}{}
 	}
 
-	return &elide{labelSet}
+	return &elide{labelSet: labelSet, keepTimestamps: keepTimestamps}
 }
 
 // Transform filters label pairs in the given metrics family,
-// eliding labels.
+// eliding labels. Series that become identical to another because
+// of it are merged into the first of them, keeping the newest sample.
+// Series that were identical before are left to duplicate detection.
 func (t *elide) Transform(family *prom.MetricFamily) (bool, error) {
 	if family == nil || len(family.Metric) == 0 {
 		return true, nil
 	}
 
+	var changed map[*prom.Metric]bool
 	for i := range family.Metric {
+		if family.Metric[i] == nil {
+			continue
+		}
 		var filtered []*prom.LabelPair
 		for j := range family.Metric[i].Label {
-			if _, elide := t.labelSet[family.Metric[i].Label[j].GetName()]; elide {
+			name := family.Metric[i].Label[j].GetName()
+			if _, elide := t.labelSet[name]; elide {
+				elidedLabels.WithLabelValues(name).Inc()
+				if changed == nil {
+					changed = make(map[*prom.Metric]bool)
+				}
+				changed[family.Metric[i]] = true
 				continue
 			}
 			filtered = append(filtered, family.Metric[i].Label[j])
@@ -36,5 +70,53 @@ func (t *elide) Transform(family *prom.MetricFamily) (bool, error) {
 		family.Metric[i].Label = filtered
 	}
 
+	if changed != nil {
+		t.mergeElidedSeries(family, changed)
+	}
 	return true, nil
 }
+
+// mergeElidedSeries replaces series with the same labels, at least one of which was changed by
+// elision, by the first of them, holding the sample with the newest timestamp.
+func (t *elide) mergeElidedSeries(family *prom.MetricFamily, changed map[*prom.Metric]bool) {
+	first := make(map[string]int, len(family.Metric))
+	merged := family.Metric[:0]
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		key := seriesKey(m.Label)
+		if t.keepTimestamps {
+			key += "\xfd" + strconv.FormatInt(m.GetTimestampMs(), 10)
+		}
+		i, ok := first[key]
+		if !ok {
+			first[key] = len(merged)
+			merged = append(merged, m)
+			continue
+		}
+		if !changed[m] && !changed[merged[i]] {
+			merged = append(merged, m)
+			continue
+		}
+		elideMergedSeries.Inc()
+		if m.GetTimestampMs() >= merged[i].GetTimestampMs() {
+			changed[m] = true
+			merged[i] = m
+		}
+	}
+	for i := len(merged); i < len(family.Metric); i++ {
+		family.Metric[i] = nil
+	}
+	family.Metric = merged
+}
+
+// seriesKey identifies the series of the labels, regardless of their order.
+func seriesKey(labels []*prom.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.GetName()+"\xff"+l.GetValue())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xfe")
+}
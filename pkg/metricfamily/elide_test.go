@@ -99,6 +99,25 @@ func TestElide(t *testing.T) {
 		}
 	}
 
+	hasTimestamps := func(want ...int64) checkFunc {
+		return func(family *prom.MetricFamily, _ bool, _ error) error {
+			for i := range family.Metric {
+				if got := family.Metric[i].GetTimestampMs(); got != want[i] {
+					return fmt.Errorf("want m.Metric[%v].TimestampMs=%v, got %v", i, want[i], got)
+				}
+			}
+			return nil
+		}
+	}
+
+	sample := func(ts int64, labels ...string) *prom.Metric {
+		var labelPairs []*prom.LabelPair
+		for i := 0; i < len(labels); i += 2 {
+			labelPairs = append(labelPairs, &prom.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+		}
+		return &prom.Metric{Label: labelPairs, TimestampMs: proto.Int64(ts)}
+	}
+
 	metricWithLabels := func(labels ...string) *prom.Metric {
 		var labelPairs []*prom.LabelPair
 		for _, l := range labels {
@@ -116,7 +135,7 @@ func TestElide(t *testing.T) {
 		{
 			name:   "nil family",
 			family: nil,
-			elide:  NewElide("elide"),
+			elide:  NewElide(false, "elide"),
 			checks: []checkFunc{
 				isOK(true),
 				hasErr(nil),
@@ -126,7 +145,7 @@ func TestElide(t *testing.T) {
 		{
 			name:   "empty family",
 			family: family(),
-			elide:  NewElide("elide"),
+			elide:  NewElide(false, "elide"),
 			checks: []checkFunc{
 				isOK(true),
 				hasErr(nil),
@@ -136,7 +155,7 @@ func TestElide(t *testing.T) {
 		{
 			name:   "one elide one retain",
 			family: family(metricWithLabels("retain", "elide")),
-			elide:  NewElide("elide"),
+			elide:  NewElide(false, "elide"),
 			checks: []checkFunc{
 				isOK(true),
 				hasErr(nil),
@@ -149,7 +168,7 @@ func TestElide(t *testing.T) {
 		{
 			name:   "no match",
 			family: family(metricWithLabels("retain")),
-			elide:  NewElide("elide"),
+			elide:  NewElide(false, "elide"),
 			checks: []checkFunc{
 				isOK(true),
 				hasErr(nil),
@@ -162,7 +181,7 @@ func TestElide(t *testing.T) {
 		{
 			name:   "single match",
 			family: family(metricWithLabels("elide")),
-			elide:  NewElide("elide"),
+			elide:  NewElide(false, "elide"),
 			checks: []checkFunc{
 				isOK(true),
 				hasErr(nil),
@@ -176,7 +195,7 @@ func TestElide(t *testing.T) {
 			family: family(
 				metricWithLabels("elide1", "elide2", "retain1", "retain2"),
 			),
-			elide: NewElide("elide1", "elide2"),
+			elide: NewElide(false, "elide1", "elide2"),
 			checks: []checkFunc{
 				isOK(true),
 				hasErr(nil),
@@ -193,7 +212,7 @@ func TestElide(t *testing.T) {
 			family: family(
 				metricWithLabels("retain1", "retain2"),
 			),
-			elide: NewElide(),
+			elide: NewElide(false),
 			checks: []checkFunc{
 				isOK(true),
 				hasErr(nil),
@@ -203,6 +222,70 @@ func TestElide(t *testing.T) {
 				hasLabels(true, "retain2"),
 			},
 		},
+		{
+			name: "merge identical series keeping the newest sample",
+			family: family(
+				sample(2, "instance", "a", "job", "x"),
+				sample(1, "job", "y"),
+				sample(3, "job", "x", "instance", "b"),
+				sample(1, "instance", "c", "job", "x"),
+			),
+			elide: NewElide(false, "instance"),
+			checks: []checkFunc{
+				isOK(true),
+				hasErr(nil),
+				hasMetricCount(2),
+				hasLabelCount(1, 1),
+				hasLabels(false, "instance"),
+				hasLabels(true, "job"),
+				hasTimestamps(3, 1),
+			},
+		},
+		{
+			name: "series differing by retained labels are not merged",
+			family: family(
+				sample(1, "instance", "a", "job", "x"),
+				sample(2, "instance", "a", "job", "y"),
+			),
+			elide: NewElide(false, "instance"),
+			checks: []checkFunc{
+				isOK(true),
+				hasErr(nil),
+				hasMetricCount(2),
+				hasTimestamps(1, 2),
+			},
+		},
+		{
+			name: "series identical before elision are not merged",
+			family: family(
+				sample(1, "instance", "a", "job", "x"),
+				sample(2, "job", "y"),
+				sample(3, "job", "y"),
+			),
+			elide: NewElide(false, "instance"),
+			checks: []checkFunc{
+				isOK(true),
+				hasErr(nil),
+				hasMetricCount(3),
+				hasTimestamps(1, 2, 3),
+			},
+		},
+		{
+			name: "series at different timestamps are kept with keep timestamps",
+			family: family(
+				sample(1, "instance", "a", "job", "x"),
+				sample(2, "instance", "b", "job", "x"),
+				sample(2, "instance", "c", "job", "x"),
+				sample(1, "job", "x"),
+			),
+			elide: NewElide(true, "instance"),
+			checks: []checkFunc{
+				isOK(true),
+				hasErr(nil),
+				hasMetricCount(2),
+				hasTimestamps(1, 2),
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			ok, err := tc.elide.Transform(tc.family)
@@ -1,12 +1,27 @@
 package metricfamily
 
-import clientmodel "github.com/prometheus/client_model/go"
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+)
 
+var droppedEmptyFamilies = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "telemeter_dropped_empty_families_total",
+	Help: "Metric families dropped because none of their metrics were left.",
+})
+
+func init() {
+	prometheus.MustRegister(droppedEmptyFamilies)
+}
+
+// DropEmptyFamilies is a transformer that drops families without metrics. It is applied by
+// Filter after the transformer of the pipeline.
 func DropEmptyFamilies(family *clientmodel.MetricFamily) (bool, error) {
 	for _, m := range family.Metric {
 		if m != nil {
 			return true, nil
 		}
 	}
+	droppedEmptyFamilies.Inc()
 	return false, nil
 }
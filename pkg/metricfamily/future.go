@@ -0,0 +1,74 @@
+package metricfamily
+
+import (
+	"fmt"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// ErrFutureSample is returned when a sample has a timestamp too far in the future.
+type ErrFutureSample struct {
+	Name        string
+	TimestampMs int64
+}
+
+func (e *ErrFutureSample) Error() string {
+	return fmt.Sprintf("metric %s has a sample with timestamp %d in the future, check clock skew", e.Name, e.TimestampMs)
+}
+
+type futureSamples struct {
+	max   int64
+	clamp bool
+}
+
+// NewErrorOnFutureSamples returns a Transformer that errors on samples with a timestamp after max.
+func NewErrorOnFutureSamples(max time.Time) Transformer {
+	return &futureSamples{
+		max: max.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// NewClampFutureSamples returns a Transformer that sets timestamps after max to max.
+func NewClampFutureSamples(max time.Time) Transformer {
+	return &futureSamples{
+		max:   max.UnixNano() / int64(time.Millisecond),
+		clamp: true,
+	}
+}
+
+func (t *futureSamples) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	for _, m := range family.Metric {
+		if m == nil || m.TimestampMs == nil || *m.TimestampMs <= t.max {
+			continue
+		}
+		if !t.clamp {
+			return false, &ErrFutureSample{Name: family.GetName(), TimestampMs: *m.TimestampMs}
+		}
+		max := t.max
+		m.TimestampMs = &max
+	}
+	return true, nil
+}
+
+type expiredSamples struct {
+	min int64
+}
+
+// NewClampExpiredSamples returns a Transformer that sets timestamps before min to min.
+func NewClampExpiredSamples(min time.Time) Transformer {
+	return &expiredSamples{
+		min: min.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+func (t *expiredSamples) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	for _, m := range family.Metric {
+		if m == nil || m.TimestampMs == nil || *m.TimestampMs >= t.min {
+			continue
+		}
+		min := t.min
+		m.TimestampMs = &min
+	}
+	return true, nil
+}
@@ -0,0 +1,67 @@
+package metricfamily
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestFutureSamples(t *testing.T) {
+	max := time.Unix(100, 0)
+
+	tests := []struct {
+		name        string
+		transformer Transformer
+		family      *clientmodel.MetricFamily
+		want        *clientmodel.MetricFamily
+		wantErr     error
+	}{
+		{
+			name:        "reject within skew",
+			transformer: NewErrorOnFutureSamples(max),
+			family:      family("A", 99000, 100000),
+			want:        family("A", 99000, 100000),
+		},
+		{
+			name:        "reject past skew",
+			transformer: NewErrorOnFutureSamples(max),
+			family:      family("A", 99000, 100001),
+			want:        family("A", 99000, 100001),
+			wantErr:     &ErrFutureSample{Name: "A", TimestampMs: 100001},
+		},
+		{
+			name:        "clamp within skew",
+			transformer: NewClampFutureSamples(max),
+			family:      family("A", 99000, 100000),
+			want:        family("A", 99000, 100000),
+		},
+		{
+			name:        "clamp past skew",
+			transformer: NewClampFutureSamples(max),
+			family:      family("A", 99000, 100001, 200000),
+			want:        family("A", 99000, 100000, 100000),
+		},
+		{
+			name:        "clamp expired",
+			transformer: NewClampExpiredSamples(max),
+			family:      family("A", 99999, 100000, 200000),
+			want:        family("A", 100000, 100000, 200000),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := tt.transformer.Transform(tt.family)
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("want err %v, got %v", tt.wantErr, err)
+			}
+			if ok != (tt.wantErr == nil) {
+				t.Fatalf("unexpected ok %t", ok)
+			}
+			if !reflect.DeepEqual(tt.family, tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, tt.family)
+			}
+		})
+	}
+}
@@ -7,6 +7,12 @@ import (
 	clientmodel "github.com/prometheus/client_model/go"
 )
 
+var (
+	ErrMetricNameTooLong = fmt.Errorf("metrics_name cannot be longer than 255 characters")
+	ErrLabelNameTooLong  = fmt.Errorf("label_name cannot be longer than 255 characters")
+	ErrLabelValueTooLong = fmt.Errorf("label_value cannot be longer than 255 characters")
+)
+
 type errorInvalidFederateSamples struct {
 	min int64
 }
@@ -23,7 +29,7 @@ func (t *errorInvalidFederateSamples) Transform(family *clientmodel.MetricFamily
 		return false, nil
 	}
 	if len(name) > 255 {
-		return false, fmt.Errorf("metrics_name cannot be longer than 255 characters")
+		return false, ErrMetricNameTooLong
 	}
 	if family.Type == nil {
 		return false, nil
@@ -44,10 +50,10 @@ func (t *errorInvalidFederateSamples) Transform(family *clientmodel.MetricFamily
 		}
 		for _, label := range m.Label {
 			if label.Name == nil || len(*label.Name) == 0 || len(*label.Name) > 255 {
-				return false, fmt.Errorf("label_name cannot be longer than 255 characters")
+				return false, ErrLabelNameTooLong
 			}
 			if label.Value == nil || len(*label.Value) > 255 {
-				return false, fmt.Errorf("label_value cannot be longer than 255 characters")
+				return false, ErrLabelValueTooLong
 			}
 		}
 		if m.TimestampMs == nil {
@@ -1,30 +1,68 @@
 package metricfamily
 
 import (
+	"fmt"
+	"sort"
 	"sync"
 
+	"github.com/prometheus/client_golang/prometheus"
 	clientmodel "github.com/prometheus/client_model/go"
 )
 
+var enforcedLabelOverwrites = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "telemeter_enforced_label_overwrites_total",
+	Help: "Series whose value of an enforced label was overwritten because it conflicted.",
+})
+
+func init() {
+	prometheus.MustRegister(enforcedLabelOverwrites)
+}
+
+// ErrLabelConflict is returned when a series carries a different value for an enforced label.
+type ErrLabelConflict struct {
+	Name     string
+	Label    string
+	Expected string
+	Actual   string
+}
+
+func (e *ErrLabelConflict) Error() string {
+	return fmt.Sprintf("metric %s has a series with label %s=%q instead of %q", e.Name, e.Label, e.Actual, e.Expected)
+}
+
 type LabelRetriever interface {
 	Labels() (map[string]string, error)
 }
 
 type label struct {
-	labels    map[string]*clientmodel.LabelPair
+	labels    map[string]string
 	retriever LabelRetriever
+	strict    bool
 	mu        sync.Mutex
 }
 
+// NewLabel returns a Transformer that sets the given labels, and those of the retriever once
+// resolved, on every series, keeping the labels of series sorted. A series carrying a
+// different value for one of the labels has it overwritten.
 func NewLabel(labels map[string]string, retriever LabelRetriever) Transformer {
-	pairs := make(map[string]*clientmodel.LabelPair)
+	return newLabel(labels, retriever, false)
+}
+
+// NewStrictLabel returns a Transformer like NewLabel that rejects a series carrying a different
+// value for one of the labels with ErrLabelConflict instead of overwriting it.
+func NewStrictLabel(labels map[string]string) Transformer {
+	return newLabel(labels, nil, true)
+}
+
+func newLabel(labels map[string]string, retriever LabelRetriever, strict bool) *label {
+	copied := make(map[string]string, len(labels))
 	for k, v := range labels {
-		name, value := k, v
-		pairs[k] = &clientmodel.LabelPair{Name: &name, Value: &value}
+		copied[k] = v
 	}
 	return &label{
-		labels:    pairs,
+		labels:    copied,
 		retriever: retriever,
+		strict:    strict,
 	}
 }
 
@@ -39,36 +77,56 @@ func (t *label) Transform(family *clientmodel.MetricFamily) (bool, error) {
 		}
 		t.retriever = nil
 		for k, v := range added {
-			name, value := k, v
-			t.labels[k] = &clientmodel.LabelPair{Name: &name, Value: &value}
+			t.labels[k] = v
 		}
 	}
 	for _, m := range family.Metric {
-		m.Label = appendLabels(m.Label, t.labels)
-	}
-	return true, nil
-}
-
-func appendLabels(existing []*clientmodel.LabelPair, overrides map[string]*clientmodel.LabelPair) []*clientmodel.LabelPair {
-	var found []string
-	for i, pair := range existing {
-		name := pair.GetName()
-		if value, ok := overrides[name]; ok {
-			existing[i] = value
-			found = append(found, name)
+		if m == nil {
+			continue
 		}
-	}
-	for k, v := range overrides {
-		if !contains(found, k) {
-			existing = append(existing, v)
+		found := 0
+		overwritten := false
+		for _, pair := range m.Label {
+			if pair == nil {
+				continue
+			}
+			expected, ok := t.labels[pair.GetName()]
+			if !ok {
+				continue
+			}
+			found++
+			if pair.GetValue() == expected {
+				continue
+			}
+			if t.strict {
+				return false, &ErrLabelConflict{Name: family.GetName(), Label: pair.GetName(), Expected: expected, Actual: pair.GetValue()}
+			}
+			value := expected
+			pair.Value = &value
+			overwritten = true
+		}
+		if overwritten {
+			enforcedLabelOverwrites.Inc()
 		}
+		if found == len(t.labels) {
+			continue
+		}
+
+		for k, v := range t.labels {
+			if hasLabel(m.Label, k) {
+				continue
+			}
+			name, value := k, v
+			m.Label = append(m.Label, &clientmodel.LabelPair{Name: &name, Value: &value})
+		}
+		sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
 	}
-	return existing
+	return true, nil
 }
 
-func contains(values []string, s string) bool {
-	for _, v := range values {
-		if s == v {
+func hasLabel(pairs []*clientmodel.LabelPair, name string) bool {
+	for _, pair := range pairs {
+		if pair.GetName() == name {
 			return true
 		}
 	}
@@ -0,0 +1,104 @@
+package metricfamily
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestLabel(t *testing.T) {
+	labels := func(kv ...string) []*clientmodel.LabelPair {
+		var pairs []*clientmodel.LabelPair
+		for i := 0; i < len(kv); i += 2 {
+			pairs = append(pairs, &clientmodel.LabelPair{Name: proto.String(kv[i]), Value: proto.String(kv[i+1])})
+		}
+		return pairs
+	}
+	enforced := map[string]string{"cluster": "a", "account": "x"}
+
+	tests := []struct {
+		name    string
+		strict  bool
+		family  *clientmodel.MetricFamily
+		want    *clientmodel.MetricFamily
+		wantErr error
+	}{
+		{
+			name:   "injected onto unlabeled series",
+			family: familyWithLabels("A", nil, labels("job", "b")),
+			want:   familyWithLabels("A", labels("account", "x", "cluster", "a"), labels("account", "x", "cluster", "a", "job", "b")),
+		},
+		{
+			name:   "matching values are kept",
+			family: familyWithLabels("A", labels("account", "x", "cluster", "a", "job", "b")),
+			want:   familyWithLabels("A", labels("account", "x", "cluster", "a", "job", "b")),
+		},
+		{
+			name:   "conflicting values are overwritten",
+			family: familyWithLabels("A", labels("cluster", "b", "job", "b")),
+			want:   familyWithLabels("A", labels("account", "x", "cluster", "a", "job", "b")),
+		},
+		{
+			name:   "strict injects missing labels",
+			strict: true,
+			family: familyWithLabels("A", labels("cluster", "a")),
+			want:   familyWithLabels("A", labels("account", "x", "cluster", "a")),
+		},
+		{
+			name:    "strict rejects conflicting values",
+			strict:  true,
+			family:  familyWithLabels("A", labels("cluster", "b")),
+			want:    familyWithLabels("A", labels("cluster", "b")),
+			wantErr: &ErrLabelConflict{Name: "A", Label: "cluster", Expected: "a", Actual: "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transformer := NewLabel(enforced, nil)
+			if tt.strict {
+				transformer = NewStrictLabel(enforced)
+			}
+			ok, err := transformer.Transform(tt.family)
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("want err %v, got %v", tt.wantErr, err)
+			}
+			if ok != (tt.wantErr == nil) {
+				t.Fatalf("unexpected ok %t", ok)
+			}
+			if !reflect.DeepEqual(tt.family, tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, tt.family)
+			}
+		})
+	}
+}
+
+type labelRetrieverFunc func() (map[string]string, error)
+
+func (f labelRetrieverFunc) Labels() (map[string]string, error) { return f() }
+
+func TestLabelRetriever(t *testing.T) {
+	calls := 0
+	transformer := NewLabel(map[string]string{"cluster": "a"}, labelRetrieverFunc(func() (map[string]string, error) {
+		calls++
+		return map[string]string{"account": "x"}, nil
+	}))
+	for i := 0; i < 2; i++ {
+		family := familyWithLabels("A", []*clientmodel.LabelPair{{Name: proto.String("job"), Value: proto.String("b")}})
+		if ok, err := transformer.Transform(family); !ok || err != nil {
+			t.Fatalf("unexpected result %t %v", ok, err)
+		}
+		want := familyWithLabels("A", []*clientmodel.LabelPair{
+			{Name: proto.String("account"), Value: proto.String("x")},
+			{Name: proto.String("cluster"), Value: proto.String("a")},
+			{Name: proto.String("job"), Value: proto.String("b")},
+		})
+		if !reflect.DeepEqual(family, want) {
+			t.Fatalf("want %v, got %v", want, family)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected the labels to be retrieved once, got %d calls", calls)
+	}
+}
@@ -0,0 +1,107 @@
+package metricfamily
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// Actions anonymizing the values of a label.
+const (
+	// LabelActionHash replaces values with a truncated hex HMAC-SHA256 of the value.
+	LabelActionHash = "hash"
+	// LabelActionRedact replaces values with RedactedValue.
+	LabelActionRedact = "redact"
+	// LabelActionDrop removes the label.
+	LabelActionDrop = "drop"
+)
+
+// RedactedValue replaces the values of redacted labels.
+const RedactedValue = "redacted"
+
+// hashedValueBytes is the number of bytes of the HMAC kept in hashed values.
+const hashedValueBytes = 8
+
+// ParseLabelAction parses a label action of the form name=action.
+func ParseLabelAction(s string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return "", "", fmt.Errorf("label actions must be of the form name=action: %s", s)
+	}
+	switch parts[1] {
+	case LabelActionHash, LabelActionRedact, LabelActionDrop:
+	default:
+		return "", "", fmt.Errorf("the action of label %s must be one of %s, %s or %s: %s", parts[0], LabelActionHash, LabelActionRedact, LabelActionDrop, parts[1])
+	}
+	return parts[0], parts[1], nil
+}
+
+type labelActions struct {
+	actions map[string]string
+	secret  []byte
+}
+
+// NewLabelActions returns a transformer applying the actions to the values of the labels of
+// every series. Hashes are keyed by secret, so that the same values are hashed alike while the
+// secret is unchanged and cannot be recovered by whoever does not know it. Empty values are
+// left empty. Series that become identical are not merged.
+func NewLabelActions(actions map[string]string, secret []byte) (Transformer, error) {
+	if len(actions) == 0 {
+		return nil, nil
+	}
+	for name, action := range actions {
+		switch action {
+		case LabelActionHash:
+			if len(secret) == 0 {
+				return nil, fmt.Errorf("hashing label %s requires a secret", name)
+			}
+		case LabelActionRedact, LabelActionDrop:
+		default:
+			return nil, fmt.Errorf("unknown action %q of label %s", action, name)
+		}
+	}
+	return &labelActions{actions: actions, secret: secret}, nil
+}
+
+func (t *labelActions) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	if family == nil {
+		return false, nil
+	}
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		labels := m.Label[:0]
+		for _, pair := range m.Label {
+			if pair == nil {
+				continue
+			}
+			action, ok := t.actions[pair.GetName()]
+			switch {
+			case !ok:
+			case action == LabelActionDrop:
+				continue
+			case len(pair.GetValue()) == 0:
+			case action == LabelActionRedact:
+				v := RedactedValue
+				pair.Value = &v
+			case action == LabelActionHash:
+				v := t.hash(pair.GetValue())
+				pair.Value = &v
+			}
+			labels = append(labels, pair)
+		}
+		m.Label = labels
+	}
+	return true, nil
+}
+
+func (t *labelActions) hash(value string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:hashedValueBytes])
+}
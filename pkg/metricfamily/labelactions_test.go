@@ -0,0 +1,145 @@
+package metricfamily
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestLabelActions(t *testing.T) {
+	labels := func(kv ...string) []*clientmodel.LabelPair {
+		var pairs []*clientmodel.LabelPair
+		for i := 0; i < len(kv); i += 2 {
+			pairs = append(pairs, &clientmodel.LabelPair{Name: proto.String(kv[i]), Value: proto.String(kv[i+1])})
+		}
+		return pairs
+	}
+	secret := []byte("s3cr3t")
+	hashed := func(value string) string {
+		return (&labelActions{secret: secret}).hash(value)
+	}
+
+	tests := []struct {
+		name    string
+		actions map[string]string
+		family  *clientmodel.MetricFamily
+		want    *clientmodel.MetricFamily
+	}{
+		{
+			name:    "hash",
+			actions: map[string]string{"host": LabelActionHash},
+			family:  familyWithLabels("A", labels("host", "node-1.example.com", "job", "api"), labels("host", "node-2.example.com")),
+			want:    familyWithLabels("A", labels("host", hashed("node-1.example.com"), "job", "api"), labels("host", hashed("node-2.example.com"))),
+		},
+		{
+			name:    "redact",
+			actions: map[string]string{"namespace": LabelActionRedact},
+			family:  familyWithLabels("A", labels("namespace", "customer-billing", "job", "api")),
+			want:    familyWithLabels("A", labels("namespace", RedactedValue, "job", "api")),
+		},
+		{
+			name:    "drop",
+			actions: map[string]string{"pod": LabelActionDrop},
+			family:  familyWithLabels("A", labels("job", "api", "pod", "api-1"), labels("pod", "")),
+			want:    familyWithLabels("A", labels("job", "api"), labels()),
+		},
+		{
+			name:    "empty values are kept",
+			actions: map[string]string{"host": LabelActionHash, "namespace": LabelActionRedact},
+			family:  familyWithLabels("A", labels("host", "", "namespace", "")),
+			want:    familyWithLabels("A", labels("host", "", "namespace", "")),
+		},
+		{
+			name:    "other labels are kept",
+			actions: map[string]string{"host": LabelActionHash, "namespace": LabelActionRedact, "pod": LabelActionDrop},
+			family:  familyWithLabels("A", labels("job", "api", "instance", "10.0.0.1")),
+			want:    familyWithLabels("A", labels("job", "api", "instance", "10.0.0.1")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transformer, err := NewLabelActions(tt.actions, secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok, err := transformer.Transform(tt.family); !ok || err != nil {
+				t.Fatalf("want the family kept, got %t, %v", ok, err)
+			}
+			for i := range tt.want.Metric {
+				if tt.want.Metric[i].Label == nil {
+					tt.want.Metric[i].Label = []*clientmodel.LabelPair{}
+				}
+			}
+			if !reflect.DeepEqual(tt.family, tt.want) {
+				t.Errorf("want %v, got %v", tt.want, tt.family)
+			}
+		})
+	}
+}
+
+func TestLabelActionsHash(t *testing.T) {
+	hash := func(secret, value string) string {
+		transformer, err := NewLabelActions(map[string]string{"host": LabelActionHash}, []byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		family := familyWithLabels("A", []*clientmodel.LabelPair{{Name: proto.String("host"), Value: proto.String(value)}})
+		transformer.Transform(family)
+		return family.Metric[0].Label[0].GetValue()
+	}
+
+	// hashes are deterministic per secret so that series can be joined
+	if a, b := hash("secret-1", "node-1"), hash("secret-1", "node-1"); a != b {
+		t.Errorf("want the same hash of the same value, got %s and %s", a, b)
+	}
+	if a, b := hash("secret-1", "node-1"), hash("secret-1", "node-2"); a == b {
+		t.Errorf("want different hashes of different values, got %s", a)
+	}
+	if a, b := hash("secret-1", "node-1"), hash("secret-2", "node-1"); a == b {
+		t.Errorf("want different hashes with different secrets, got %s", a)
+	}
+
+	// the hash reveals neither the secret nor the value, and is not a plain salted digest
+	h := hash("secret-1", "node-1")
+	if len(h) != 2*hashedValueBytes {
+		t.Errorf("want a hash of %d hex characters, got %q", 2*hashedValueBytes, h)
+	}
+	if _, err := hex.DecodeString(h); err != nil {
+		t.Errorf("want a hex hash, got %q", h)
+	}
+	if strings.Contains(h, "secret-1") || strings.Contains(h, "node-1") {
+		t.Errorf("want the hash not to contain its inputs, got %q", h)
+	}
+	for _, input := range []string{"node-1", "secret-1node-1", "node-1secret-1"} {
+		sum := sha256.Sum256([]byte(input))
+		if h == hex.EncodeToString(sum[:hashedValueBytes]) {
+			t.Errorf("want a keyed hash, got the digest of %q", input)
+		}
+	}
+}
+
+func TestNewLabelActions(t *testing.T) {
+	if transformer, err := NewLabelActions(nil, nil); transformer != nil || err != nil {
+		t.Errorf("want no transformer without actions, got %v, %v", transformer, err)
+	}
+	if _, err := NewLabelActions(map[string]string{"host": LabelActionHash}, nil); err == nil {
+		t.Error("want an error hashing without a secret")
+	}
+	if _, err := NewLabelActions(map[string]string{"host": "encrypt"}, []byte("secret")); err == nil {
+		t.Error("want an error for an unknown action")
+	}
+
+	for _, s := range []string{"host", "=hash", "host=encrypt"} {
+		if _, _, err := ParseLabelAction(s); err == nil {
+			t.Errorf("%q: want an error", s)
+		}
+	}
+	if name, action, err := ParseLabelAction("host=hash"); name != "host" || action != LabelActionHash || err != nil {
+		t.Errorf("unexpected label action %s, %s, %v", name, action, err)
+	}
+}
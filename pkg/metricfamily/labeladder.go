@@ -0,0 +1,63 @@
+package metricfamily
+
+import (
+	"fmt"
+	"sort"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+type labelAdder struct {
+	labels map[string]string
+}
+
+// NewLabelAdder returns a Transformer that adds the given labels to every series that does not
+// carry them already, keeping the labels of series sorted. Series keep their own values of the
+// labels. An error is returned if a label name is invalid.
+func NewLabelAdder(labels map[string]string) (Transformer, error) {
+	if err := validLabelNames(labels); err != nil {
+		return nil, err
+	}
+	return &labelAdder{labels: labels}, nil
+}
+
+// NewLabelReplacer returns a Transformer that sets the given labels on every series, overwriting
+// the values series carry for them, and keeping the labels of series sorted. An error is
+// returned if a label name is invalid.
+func NewLabelReplacer(labels map[string]string) (Transformer, error) {
+	if err := validLabelNames(labels); err != nil {
+		return nil, err
+	}
+	return NewLabel(labels, nil), nil
+}
+
+func (t *labelAdder) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		added := false
+		for k, v := range t.labels {
+			if hasLabel(m.Label, k) {
+				continue
+			}
+			name, value := k, v
+			m.Label = append(m.Label, &clientmodel.LabelPair{Name: &name, Value: &value})
+			added = true
+		}
+		if added {
+			sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+		}
+	}
+	return true, nil
+}
+
+func validLabelNames(labels map[string]string) error {
+	for name := range labels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	return nil
+}
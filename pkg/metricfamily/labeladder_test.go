@@ -0,0 +1,78 @@
+package metricfamily
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestLabelAdderAndReplacer(t *testing.T) {
+	labels := func(kv ...string) []*clientmodel.LabelPair {
+		var pairs []*clientmodel.LabelPair
+		for i := 0; i < len(kv); i += 2 {
+			pairs = append(pairs, &clientmodel.LabelPair{Name: proto.String(kv[i]), Value: proto.String(kv[i+1])})
+		}
+		return pairs
+	}
+	added := map[string]string{"cluster": "a", "account": "x"}
+
+	tests := []struct {
+		name        string
+		family      *clientmodel.MetricFamily
+		wantAdded   *clientmodel.MetricFamily
+		wantReplace *clientmodel.MetricFamily
+	}{
+		{
+			name:        "added to series in order",
+			family:      familyWithLabels("A", nil, labels("job", "b"), labels("b", "c", "zone", "d")),
+			wantAdded:   familyWithLabels("A", labels("account", "x", "cluster", "a"), labels("account", "x", "cluster", "a", "job", "b"), labels("account", "x", "b", "c", "cluster", "a", "zone", "d")),
+			wantReplace: familyWithLabels("A", labels("account", "x", "cluster", "a"), labels("account", "x", "cluster", "a", "job", "b"), labels("account", "x", "b", "c", "cluster", "a", "zone", "d")),
+		},
+		{
+			name:        "pre-existing labels",
+			family:      familyWithLabels("A", labels("cluster", "b", "job", "b"), labels("account", "x", "cluster", "a")),
+			wantAdded:   familyWithLabels("A", labels("account", "x", "cluster", "b", "job", "b"), labels("account", "x", "cluster", "a")),
+			wantReplace: familyWithLabels("A", labels("account", "x", "cluster", "a", "job", "b"), labels("account", "x", "cluster", "a")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adder, err := NewLabelAdder(added)
+			if err != nil {
+				t.Fatal(err)
+			}
+			replacer, err := NewLabelReplacer(added)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range []struct {
+				name        string
+				transformer Transformer
+				want        *clientmodel.MetricFamily
+			}{
+				{name: "adder", transformer: adder, want: tt.wantAdded},
+				{name: "replacer", transformer: replacer, want: tt.wantReplace},
+			} {
+				family := proto.Clone(tt.family).(*clientmodel.MetricFamily)
+				ok, err := c.transformer.Transform(family)
+				if !ok || err != nil {
+					t.Fatalf("%s: want the family kept, got %t, %v", c.name, ok, err)
+				}
+				if !reflect.DeepEqual(family, c.want) {
+					t.Errorf("%s: want %v, got %v", c.name, c.want, family)
+				}
+			}
+		})
+	}
+
+	for _, name := range []string{"", "1cluster", "cluster-name", "cluster name"} {
+		if _, err := NewLabelAdder(map[string]string{"account": "x", name: "a"}); err == nil {
+			t.Errorf("want label name %q rejected by the adder", name)
+		}
+		if _, err := NewLabelReplacer(map[string]string{"account": "x", name: "a"}); err == nil {
+			t.Errorf("want label name %q rejected by the replacer", name)
+		}
+	}
+}
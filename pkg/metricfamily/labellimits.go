@@ -0,0 +1,153 @@
+package metricfamily
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// Kinds of label limit violations, as reported by ErrLabelLimit and counted by type.
+const (
+	LabelLimitCount       = "count"
+	LabelLimitNameLength  = "name_length"
+	LabelLimitValueLength = "value_length"
+	LabelLimitSeriesSize  = "series_size"
+	LabelLimitInvalidUTF8 = "invalid_utf8"
+)
+
+var labelLimitViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "telemeter_label_limit_violations_total",
+	Help: "Series exceeding the label limits, by type of violation. Truncated values are counted as well.",
+}, []string{"type"})
+
+func init() {
+	prometheus.MustRegister(labelLimitViolations)
+}
+
+// ErrLabelLimit is returned when a series exceeds a label limit.
+type ErrLabelLimit struct {
+	Type  string
+	Name  string
+	Label string
+	Limit int
+}
+
+func (e *ErrLabelLimit) Error() string {
+	switch e.Type {
+	case LabelLimitCount:
+		return fmt.Sprintf("metric %s has a series with more than %d labels", e.Name, e.Limit)
+	case LabelLimitNameLength:
+		return fmt.Sprintf("metric %s has a label name %q longer than %d bytes", e.Name, e.Label, e.Limit)
+	case LabelLimitSeriesSize:
+		return fmt.Sprintf("metric %s has a series with labels larger than %d bytes", e.Name, e.Limit)
+	case LabelLimitInvalidUTF8:
+		return fmt.Sprintf("metric %s has a value of label %q that is not valid UTF-8", e.Name, e.Label)
+	default:
+		return fmt.Sprintf("metric %s has a value of label %q longer than %d bytes", e.Name, e.Label, e.Limit)
+	}
+}
+
+// LabelLimits bounds the labels of each series. A zero value disables the corresponding limit.
+type LabelLimits struct {
+	// MaxLabels is the maximum number of labels of a series, including the metric name.
+	MaxLabels int
+	// MaxNameLength and MaxValueLength are the maximum lengths of label names and values in bytes.
+	MaxNameLength  int
+	MaxValueLength int
+	// MaxSeriesSize is the maximum size in bytes of the names and values of all labels of a
+	// series, including the metric name.
+	MaxSeriesSize int
+	// ValidateUTF8 rejects series with label values that are not valid UTF-8.
+	ValidateUTF8 bool
+	// TruncateValues shortens label values to at most MaxValueLength bytes without splitting a
+	// character, and cuts invalid UTF-8 values
+	// before their first invalid byte, instead of rejecting the series. The series size is
+	// checked after truncation.
+	TruncateValues bool
+}
+
+// Enabled returns true if any limit is set.
+func (l LabelLimits) Enabled() bool {
+	return l.MaxLabels > 0 || l.MaxNameLength > 0 || l.MaxValueLength > 0 || l.MaxSeriesSize > 0 || l.ValidateUTF8
+}
+
+type labelLimits struct {
+	limits LabelLimits
+}
+
+// NewLabelLimits returns a Transformer that errors on series exceeding the limits, or truncates
+// label values that are too long if the limits allow it.
+func NewLabelLimits(limits LabelLimits) Transformer {
+	return &labelLimits{limits: limits}
+}
+
+func (t *labelLimits) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	l := t.limits
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		if l.MaxLabels > 0 && len(m.Label)+1 > l.MaxLabels {
+			labelLimitViolations.WithLabelValues(LabelLimitCount).Inc()
+			return false, &ErrLabelLimit{Type: LabelLimitCount, Name: family.GetName(), Limit: l.MaxLabels}
+		}
+		size := len(family.GetName())
+		for _, label := range m.Label {
+			if l.MaxNameLength > 0 && len(label.GetName()) > l.MaxNameLength {
+				labelLimitViolations.WithLabelValues(LabelLimitNameLength).Inc()
+				return false, &ErrLabelLimit{Type: LabelLimitNameLength, Name: family.GetName(), Label: label.GetName(), Limit: l.MaxNameLength}
+			}
+			if l.ValidateUTF8 && !utf8.ValidString(label.GetValue()) {
+				labelLimitViolations.WithLabelValues(LabelLimitInvalidUTF8).Inc()
+				if !l.TruncateValues {
+					return false, &ErrLabelLimit{Type: LabelLimitInvalidUTF8, Name: family.GetName(), Label: label.GetName()}
+				}
+				value := truncateInvalid(label.GetValue())
+				label.Value = &value
+			}
+			size += len(label.GetName())
+			if l.MaxValueLength <= 0 || len(label.GetValue()) <= l.MaxValueLength {
+				continue
+			}
+			labelLimitViolations.WithLabelValues(LabelLimitValueLength).Inc()
+			if !l.TruncateValues {
+				return false, &ErrLabelLimit{Type: LabelLimitValueLength, Name: family.GetName(), Label: label.GetName(), Limit: l.MaxValueLength}
+			}
+			value := truncateBytes(label.GetValue(), l.MaxValueLength)
+			label.Value = &value
+		}
+		for _, label := range m.Label {
+			size += len(label.GetValue())
+		}
+		if l.MaxSeriesSize > 0 && size > l.MaxSeriesSize {
+			labelLimitViolations.WithLabelValues(LabelLimitSeriesSize).Inc()
+			return false, &ErrLabelLimit{Type: LabelLimitSeriesSize, Name: family.GetName(), Limit: l.MaxSeriesSize}
+		}
+	}
+	return true, nil
+}
+
+// truncateInvalid returns s up to its first byte that is not valid UTF-8.
+func truncateInvalid(s string) string {
+	for pos, r := range s {
+		if r == utf8.RuneError {
+			if _, n := utf8.DecodeRuneInString(s[pos:]); n == 1 {
+				return s[:pos]
+			}
+		}
+	}
+	return s
+}
+
+// truncateBytes returns at most the first n bytes of s, cut at the start of a character.
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
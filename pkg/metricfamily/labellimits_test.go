@@ -0,0 +1,143 @@
+package metricfamily
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestLabelLimits(t *testing.T) {
+	labels := func(kv ...string) []*clientmodel.LabelPair {
+		var pairs []*clientmodel.LabelPair
+		for i := 0; i < len(kv); i += 2 {
+			pairs = append(pairs, &clientmodel.LabelPair{Name: proto.String(kv[i]), Value: proto.String(kv[i+1])})
+		}
+		return pairs
+	}
+
+	tests := []struct {
+		name    string
+		limits  LabelLimits
+		family  *clientmodel.MetricFamily
+		want    *clientmodel.MetricFamily
+		wantErr error
+	}{
+		{
+			name:   "within limits",
+			limits: LabelLimits{MaxLabels: 3, MaxNameLength: 3, MaxValueLength: 3},
+			family: familyWithLabels("A", labels("a", "1", "bbb", "222")),
+			want:   familyWithLabels("A", labels("a", "1", "bbb", "222")),
+		},
+		{
+			name:    "too many labels including the name",
+			limits:  LabelLimits{MaxLabels: 2},
+			family:  familyWithLabels("A", labels("a", "1"), labels("a", "1", "b", "2")),
+			want:    familyWithLabels("A", labels("a", "1"), labels("a", "1", "b", "2")),
+			wantErr: &ErrLabelLimit{Type: LabelLimitCount, Name: "A", Limit: 2},
+		},
+		{
+			name:    "name too long",
+			limits:  LabelLimits{MaxNameLength: 3},
+			family:  familyWithLabels("A", labels("abcd", "1")),
+			want:    familyWithLabels("A", labels("abcd", "1")),
+			wantErr: &ErrLabelLimit{Type: LabelLimitNameLength, Name: "A", Label: "abcd", Limit: 3},
+		},
+		{
+			name:    "value too long",
+			limits:  LabelLimits{MaxValueLength: 3},
+			family:  familyWithLabels("A", labels("a", "1234")),
+			want:    familyWithLabels("A", labels("a", "1234")),
+			wantErr: &ErrLabelLimit{Type: LabelLimitValueLength, Name: "A", Label: "a", Limit: 3},
+		},
+		{
+			name:    "value length counts bytes",
+			limits:  LabelLimits{MaxValueLength: 4},
+			family:  familyWithLabels("A", labels("a", "äöü")),
+			want:    familyWithLabels("A", labels("a", "äöü")),
+			wantErr: &ErrLabelLimit{Type: LabelLimitValueLength, Name: "A", Label: "a", Limit: 4},
+		},
+		{
+			name:    "name length counts bytes",
+			limits:  LabelLimits{MaxNameLength: 3},
+			family:  familyWithLabels("A", labels("äö", "1")),
+			want:    familyWithLabels("A", labels("äö", "1")),
+			wantErr: &ErrLabelLimit{Type: LabelLimitNameLength, Name: "A", Label: "äö", Limit: 3},
+		},
+		{
+			name:   "value truncated",
+			limits: LabelLimits{MaxValueLength: 3, TruncateValues: true},
+			family: familyWithLabels("A", labels("a", "1234", "b", "äöüß", "c", "12")),
+			want:   familyWithLabels("A", labels("a", "123", "b", "ä", "c", "12")),
+		},
+		{
+			name:   "truncation keeps multi-byte characters at the boundary whole",
+			limits: LabelLimits{MaxValueLength: 6, TruncateValues: true},
+			family: familyWithLabels("A", labels("a", "a日本", "b", "日本語", "c", "a")),
+			want:   familyWithLabels("A", labels("a", "a日", "b", "日本", "c", "a")),
+		},
+		{
+			name:    "invalid UTF-8 value",
+			limits:  LabelLimits{ValidateUTF8: true},
+			family:  familyWithLabels("A", labels("a", "1", "b", "ä\xc3")),
+			want:    familyWithLabels("A", labels("a", "1", "b", "ä\xc3")),
+			wantErr: &ErrLabelLimit{Type: LabelLimitInvalidUTF8, Name: "A", Label: "b"},
+		},
+		{
+			name:   "invalid UTF-8 value truncated before the invalid byte",
+			limits: LabelLimits{ValidateUTF8: true, MaxValueLength: 3, TruncateValues: true},
+			family: familyWithLabels("A", labels("a", "日\xe6\x97本語", "b", "\xff")),
+			want:   familyWithLabels("A", labels("a", "日", "b", "")),
+		},
+		{
+			name:   "series size within limit",
+			limits: LabelLimits{MaxSeriesSize: 8},
+			family: familyWithLabels("A", labels("a", "1", "b", "äö")),
+			want:   familyWithLabels("A", labels("a", "1", "b", "äö")),
+		},
+		{
+			name:    "series size counts bytes including the metric name",
+			limits:  LabelLimits{MaxSeriesSize: 8},
+			family:  familyWithLabels("A", labels("a", "1"), labels("a", "1", "b", "äöü")),
+			want:    familyWithLabels("A", labels("a", "1"), labels("a", "1", "b", "äöü")),
+			wantErr: &ErrLabelLimit{Type: LabelLimitSeriesSize, Name: "A", Limit: 8},
+		},
+		{
+			name:   "series size checked after truncation",
+			limits: LabelLimits{MaxValueLength: 2, MaxSeriesSize: 8, TruncateValues: true},
+			family: familyWithLabels("A", labels("a", "1", "b", "äöü")),
+			want:   familyWithLabels("A", labels("a", "1", "b", "ä")),
+		},
+		{
+			name:    "truncation does not apply to names",
+			limits:  LabelLimits{MaxNameLength: 3, MaxValueLength: 3, TruncateValues: true},
+			family:  familyWithLabels("A", labels(strings.Repeat("a", 4), "1")),
+			want:    familyWithLabels("A", labels(strings.Repeat("a", 4), "1")),
+			wantErr: &ErrLabelLimit{Type: LabelLimitNameLength, Name: "A", Label: "aaaa", Limit: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := NewLabelLimits(tt.limits).Transform(tt.family)
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("want err %v, got %v", tt.wantErr, err)
+			}
+			if ok != (tt.wantErr == nil) {
+				t.Fatalf("unexpected ok %t", ok)
+			}
+			if !reflect.DeepEqual(tt.family, tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, tt.family)
+			}
+			for _, m := range tt.family.Metric {
+				for _, label := range m.Label {
+					if tt.limits.ValidateUTF8 && tt.limits.TruncateValues && !utf8.ValidString(label.GetValue()) {
+						t.Fatalf("want valid UTF-8 after truncation, got %q", label.GetValue())
+					}
+				}
+			}
+		})
+	}
+}
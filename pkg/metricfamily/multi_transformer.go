@@ -4,6 +4,16 @@ import (
 	clientmodel "github.com/prometheus/client_model/go"
 )
 
+// All returns a transformer applying the transformers in order, which stops at the first of
+// them that drops the family or fails. Nil transformers are skipped.
+func All(transformers ...Transformer) Transformer {
+	var t MultiTransformer
+	for _, transformer := range transformers {
+		t.With(transformer)
+	}
+	return t
+}
+
 type MultiTransformer struct {
 	transformers []Transformer
 	builderFuncs []func() Transformer
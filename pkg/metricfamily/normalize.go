@@ -0,0 +1,90 @@
+package metricfamily
+
+import (
+	"sort"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// Normalize returns the families in a deterministic order: families sorted by name, the metrics
+// of a family sorted by label set and the labels of a metric sorted by name. Families of the
+// same name are merged into one, keeping the help and type of the first occurrence, and those
+// whose type differs from the first occurrence are dropped. Nil and empty families and nil
+// metrics are removed. The returned families are copies, so the metrics
+// of the passed families are left in place, but the labels of their metrics are sorted.
+func Normalize(families []*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	result := make([]*clientmodel.MetricFamily, 0, len(families))
+	byName := make(map[string]*clientmodel.MetricFamily, len(families))
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		dst, ok := byName[family.GetName()]
+		if !ok {
+			dst = &clientmodel.MetricFamily{
+				Name:   family.Name,
+				Help:   family.Help,
+				Type:   family.Type,
+				Metric: make([]*clientmodel.Metric, 0, len(family.Metric)),
+			}
+			byName[family.GetName()] = dst
+			result = append(result, dst)
+		} else if dst.GetType() != family.GetType() {
+			continue
+		}
+		dst.Metric = append(dst.Metric, family.Metric...)
+	}
+	for _, family := range result {
+		NormalizeFamily(family)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	return Pack(result)
+}
+
+// NormalizeFamily is the transformer form of Normalize for a single family, removing nil
+// metrics, sorting the labels of the metrics by name and the metrics by label set. The sort is
+// stable, so the samples of a series keep their order. Families left empty are dropped.
+func NormalizeFamily(family *clientmodel.MetricFamily) (bool, error) {
+	if ok, _ := PackMetrics(family); !ok {
+		return false, nil
+	}
+	for _, m := range family.Metric {
+		for i := 1; i < len(m.Label); i++ {
+			if m.Label[i-1].GetName() > m.Label[i].GetName() {
+				sort.Sort(LabelPairsByName(m.Label))
+				break
+			}
+		}
+	}
+	sort.SliceStable(family.Metric, func(i, j int) bool {
+		return compareLabels(family.Metric[i].Label, family.Metric[j].Label) < 0
+	})
+	return true, nil
+}
+
+// LabelPairsByName sorts label pairs by name.
+type LabelPairsByName []*clientmodel.LabelPair
+
+func (l LabelPairsByName) Len() int           { return len(l) }
+func (l LabelPairsByName) Less(i, j int) bool { return l[i].GetName() < l[j].GetName() }
+func (l LabelPairsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// compareLabels compares two label sets sorted by name, pair by pair on name and then value,
+// with a set ordered before the sets it is a prefix of.
+func compareLabels(a, b []*clientmodel.LabelPair) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if an, bn := a[i].GetName(), b[i].GetName(); an != bn {
+			if an < bn {
+				return -1
+			}
+			return 1
+		}
+		if av, bv := a[i].GetValue(), b[i].GetValue(); av != bv {
+			if av < bv {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
@@ -0,0 +1,185 @@
+package metricfamily
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// parseText returns the families of a text exposition, in no particular order.
+func parseText(t testing.TB, text string) []*clientmodel.MetricFamily {
+	var families []*clientmodel.MetricFamily
+	decoder := expfmt.NewDecoder(bytes.NewBufferString(text), expfmt.FmtText)
+	for {
+		family := &clientmodel.MetricFamily{}
+		if err := decoder.Decode(family); err != nil {
+			if err.Error() == "EOF" {
+				return families
+			}
+			t.Fatal(err)
+		}
+		families = append(families, family)
+	}
+}
+
+// encodeText returns the families in the text exposition format.
+func encodeText(t testing.TB, families []*clientmodel.MetricFamily) string {
+	buf := &bytes.Buffer{}
+	encoder := expfmt.NewEncoder(buf, expfmt.FmtText)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.String()
+}
+
+func TestNormalize(t *testing.T) {
+	first := parseText(t, `# HELP b first help
+# TYPE b gauge
+b{job="y",instance="2"} 1 1000
+b{job="x"} 2 1000
+b{job="y",instance="1"} 3 1000
+`)[0]
+	a := parseText(t, `# TYPE a counter
+a{job="x"} 4 1000
+a 5 1000
+`)[0]
+	// more families named b, as read from other partitions, the one of another type dropped
+	b := parseText(t, `# HELP b second help
+# TYPE b gauge
+b{instance="1",job="y"} 6 2000
+b{instance="0"} 7 2000
+`)[0]
+	conflict := parseText(t, `# TYPE b counter
+b{instance="0"} 8 2000
+`)[0]
+	// labels are decoded sorted, so that they are shuffled by hand
+	first.Metric[0].Label[0], first.Metric[0].Label[1] = first.Metric[0].Label[1], first.Metric[0].Label[0]
+	a.Metric = append(a.Metric, nil)
+	families := []*clientmodel.MetricFamily{first, a, nil, b, conflict, {Name: proto.String("empty")}}
+
+	got := Normalize(families)
+	want := `# TYPE a counter
+a 5 1000
+a{job="x"} 4 1000
+# HELP b first help
+# TYPE b gauge
+b{instance="0"} 7 2000
+b{instance="1",job="y"} 3 1000
+b{instance="1",job="y"} 6 2000
+b{instance="2",job="y"} 1 1000
+b{job="x"} 2 1000
+`
+	if text := encodeText(t, got); text != want {
+		t.Errorf("want\n%s\ngot\n%s", want, text)
+	}
+	if len(families[0].Metric) != 3 || families[0].GetType() != clientmodel.MetricType_GAUGE {
+		t.Errorf("want the passed families left in place, got %v", families[0])
+	}
+}
+
+func TestNormalizeDeterministic(t *testing.T) {
+	input := parseText(t, `# TYPE c gauge
+c{job="a",pod="1"} 1 1000
+c{job="a",pod="2"} 2 1000
+c{job="b"} 3 1000
+c{pod="1"} 4 1000
+# TYPE d counter
+d{job="a"} 5 1000
+d{job="a"} 6 2000
+d{job="a"} 7 3000
+d{job="b"} 8 1000
+`)
+	want := encodeText(t, Normalize(input))
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		families := parseText(t, want)
+		// the series are shuffled keeping the order of the samples of a series, and so are
+		// the families and the labels
+		for _, family := range families {
+			var series [][]*clientmodel.Metric
+			for _, m := range family.Metric {
+				if n := len(series); n > 0 && compareLabels(series[n-1][0].Label, m.Label) == 0 {
+					series[n-1] = append(series[n-1], m)
+					continue
+				}
+				series = append(series, []*clientmodel.Metric{m})
+			}
+			r.Shuffle(len(series), func(i, j int) { series[i], series[j] = series[j], series[i] })
+			family.Metric = family.Metric[:0]
+			for _, samples := range series {
+				for _, m := range samples {
+					r.Shuffle(len(m.Label), func(i, j int) { m.Label[i], m.Label[j] = m.Label[j], m.Label[i] })
+				}
+				family.Metric = append(family.Metric, samples...)
+			}
+		}
+		r.Shuffle(len(families), func(i, j int) { families[i], families[j] = families[j], families[i] })
+
+		if got := encodeText(t, Normalize(families)); got != want {
+			t.Fatalf("want\n%s\ngot\n%s", want, got)
+		}
+	}
+}
+
+func TestNormalizeFamily(t *testing.T) {
+	empty := &clientmodel.MetricFamily{Name: proto.String("a"), Metric: []*clientmodel.Metric{nil}}
+	if ok, err := NormalizeFamily(empty); ok || err != nil {
+		t.Errorf("want a family without metrics dropped, got %t, %v", ok, err)
+	}
+
+	family := parseText(t, `# TYPE a gauge
+a{job="b"} 1 1000
+a{job="a"} 2 1000
+`)[0]
+	family.Metric = append(family.Metric, nil)
+	if ok, err := NormalizeFamily(family); !ok || err != nil {
+		t.Fatalf("want the family kept, got %t, %v", ok, err)
+	}
+	want := `# TYPE a gauge
+a{job="a"} 2 1000
+a{job="b"} 1 1000
+`
+	if got := encodeText(t, []*clientmodel.MetricFamily{family}); got != want {
+		t.Errorf("want\n%s\ngot\n%s", want, got)
+	}
+}
+
+func BenchmarkNormalize(b *testing.B) {
+	const familyCount, seriesCount = 100, 100
+	r := rand.New(rand.NewSource(1))
+	upload := func() []*clientmodel.MetricFamily {
+		families := make([]*clientmodel.MetricFamily, 0, familyCount)
+		for _, i := range r.Perm(familyCount) {
+			f := &clientmodel.MetricFamily{Name: proto.String(fmt.Sprintf("metric_%d", i)), Type: clientmodel.MetricType_GAUGE.Enum()}
+			for _, j := range r.Perm(seriesCount) {
+				f.Metric = append(f.Metric, &clientmodel.Metric{
+					Label: []*clientmodel.LabelPair{
+						{Name: proto.String("job"), Value: proto.String("job")},
+						{Name: proto.String("instance"), Value: proto.String(fmt.Sprintf("instance-%d", j))},
+						{Name: proto.String("cluster"), Value: proto.String("cluster-1")},
+					},
+					Gauge:       &clientmodel.Gauge{Value: proto.Float64(1)},
+					TimestampMs: proto.Int64(1),
+				})
+			}
+			families = append(families, f)
+		}
+		return families
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		families := upload()
+		b.StartTimer()
+		Normalize(families)
+	}
+}
@@ -0,0 +1,99 @@
+package metricfamily
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// ErrSeriesOutOfOrder is returned when a sample of a series is older than a previous sample of
+// the same series by more than the tolerance.
+type ErrSeriesOutOfOrder struct {
+	Series      string
+	TimestampMs int64
+	PreviousMs  int64
+}
+
+func (e *ErrSeriesOutOfOrder) Error() string {
+	return fmt.Sprintf("series %s has a sample at %d after a sample at %d", e.Series, e.TimestampMs, e.PreviousMs)
+}
+
+type sortSeriesSamples struct {
+	strict    bool
+	tolerance int64
+}
+
+// NewSortSeriesSamples returns a transformer sorting the samples of each series of a family by
+// timestamp. The sort is stable and the samples of a series take the positions the series had,
+// so that the order of series is kept. If strict is set, samples older than a previous sample of
+// their series by more than tolerance fail with *ErrSeriesOutOfOrder. Samples without a
+// timestamp fail with ErrNoTimestamp.
+func NewSortSeriesSamples(strict bool, tolerance time.Duration) Transformer {
+	return &sortSeriesSamples{strict: strict, tolerance: int64(tolerance / time.Millisecond)}
+}
+
+func (t *sortSeriesSamples) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	// families are usually sorted as a whole, which sorts every series
+	var last int64
+	sorted := true
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		if m.TimestampMs == nil {
+			return false, ErrNoTimestamp
+		}
+		if *m.TimestampMs < last {
+			sorted = false
+		}
+		last = *m.TimestampMs
+	}
+	if sorted {
+		return true, nil
+	}
+
+	positions := make(map[string][]int)
+	newest := make(map[string]int64)
+	for i, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		key := seriesKey(m.Label)
+		p, ok := positions[key]
+		if previous := newest[key]; ok && t.strict && previous-*m.TimestampMs > t.tolerance {
+			return false, &ErrSeriesOutOfOrder{Series: SeriesString(family.GetName(), m.Label), TimestampMs: *m.TimestampMs, PreviousMs: previous}
+		}
+		positions[key] = append(p, i)
+		if !ok || *m.TimestampMs > newest[key] {
+			newest[key] = *m.TimestampMs
+		}
+	}
+
+	for _, p := range positions {
+		if len(p) < 2 {
+			continue
+		}
+		samples := make([]*clientmodel.Metric, len(p))
+		for i, pos := range p {
+			samples[i] = family.Metric[pos]
+		}
+		sort.SliceStable(samples, func(i, j int) bool { return *samples[i].TimestampMs < *samples[j].TimestampMs })
+		for i, pos := range p {
+			family.Metric[pos] = samples[i]
+		}
+	}
+	return true, nil
+}
+
+// SeriesString returns the series in the Prometheus text format, with sorted labels.
+func SeriesString(name string, labels []*clientmodel.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
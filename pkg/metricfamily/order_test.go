@@ -0,0 +1,105 @@
+package metricfamily
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestSortSeriesSamples(t *testing.T) {
+	// sample returns a sample of the series at ts with the value v
+	sample := func(series string, ts int64, v float64) *clientmodel.Metric {
+		return &clientmodel.Metric{
+			Label:       []*clientmodel.LabelPair{{Name: proto.String("series"), Value: proto.String(series)}},
+			Gauge:       &clientmodel.Gauge{Value: proto.Float64(v)},
+			TimestampMs: proto.Int64(ts),
+		}
+	}
+	family := func(metrics ...*clientmodel.Metric) *clientmodel.MetricFamily {
+		return &clientmodel.MetricFamily{Name: proto.String("A"), Type: clientmodel.MetricType_GAUGE.Enum(), Metric: metrics}
+	}
+	// samples returns the samples of the family as series@ts=v
+	samples := func(family *clientmodel.MetricFamily) []string {
+		var s []string
+		for _, m := range family.Metric {
+			s = append(s, fmt.Sprintf("%s@%d=%v", m.Label[0].GetValue(), m.GetTimestampMs(), m.GetGauge().GetValue()))
+		}
+		return s
+	}
+
+	tests := []struct {
+		name      string
+		strict    bool
+		tolerance time.Duration
+		family    *clientmodel.MetricFamily
+		want      []string
+		wantErr   error
+	}{
+		{
+			name:   "sorted",
+			family: family(sample("a", 1, 1), sample("b", 1, 2), sample("a", 2, 3), sample("b", 3, 4)),
+			want:   []string{"a@1=1", "b@1=2", "a@2=3", "b@3=4"},
+		},
+		{
+			name:   "sorted series interleaved out of family order",
+			family: family(sample("a", 2, 1), sample("b", 1, 2), sample("a", 3, 3), sample("b", 2, 4)),
+			want:   []string{"a@2=1", "b@1=2", "a@3=3", "b@2=4"},
+		},
+		{
+			name:   "shuffled series",
+			family: family(sample("a", 3, 1), sample("a", 1, 2), sample("a", 4, 3), sample("a", 2, 4)),
+			want:   []string{"a@1=2", "a@2=4", "a@3=1", "a@4=3"},
+		},
+		{
+			name:   "series keep their positions",
+			family: family(sample("a", 2, 1), sample("b", 5, 2), sample("a", 1, 3), sample("c", 1, 4), sample("b", 4, 5)),
+			want:   []string{"a@1=3", "b@4=5", "a@2=1", "c@1=4", "b@5=2"},
+		},
+		{
+			name:   "stable for equal timestamps",
+			family: family(sample("a", 2, 1), sample("a", 1, 2), sample("a", 2, 3), sample("a", 1, 4)),
+			want:   []string{"a@1=2", "a@1=4", "a@2=1", "a@2=3"},
+		},
+		{
+			name:      "strict within the tolerance",
+			strict:    true,
+			tolerance: 10 * time.Millisecond,
+			family:    family(sample("a", 20, 1), sample("a", 10, 2)),
+			want:      []string{"a@10=2", "a@20=1"},
+		},
+		{
+			name:      "strict beyond the tolerance",
+			strict:    true,
+			tolerance: 10 * time.Millisecond,
+			family:    family(sample("a", 20, 1), sample("b", 1, 2), sample("a", 30, 3), sample("a", 19, 4)),
+			want:      []string{"a@20=1", "b@1=2", "a@30=3", "a@19=4"},
+			wantErr:   &ErrSeriesOutOfOrder{Series: `A{series="a"}`, TimestampMs: 19, PreviousMs: 30},
+		},
+		{
+			name:    "missing timestamp",
+			family:  family(sample("a", 1, 1), &clientmodel.Metric{Gauge: &clientmodel.Gauge{Value: proto.Float64(2)}}),
+			wantErr: ErrNoTimestamp,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := NewSortSeriesSamples(tt.strict, tt.tolerance).Transform(tt.family)
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+			if ok != (err == nil) {
+				t.Errorf("want family kept %t, got %t", err == nil, ok)
+			}
+			if tt.want == nil {
+				return
+			}
+			if got := samples(tt.family); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want samples %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -30,10 +30,14 @@ func init() {
 func OverwriteTimestamps(now func() time.Time) TransformerFunc {
 	return func(family *client.MetricFamily) (bool, error) {
 		timestamp := now().Unix() * 1000
-		for i, m := range family.Metric {
-			observeDrift(now, m.GetTimestampMs())
-
-			family.Metric[i].TimestampMs = &timestamp
+		for _, m := range family.Metric {
+			if m == nil {
+				continue
+			}
+			if m.TimestampMs != nil {
+				observeDrift(now, m.GetTimestampMs())
+			}
+			m.TimestampMs = &timestamp
 		}
 		return true, nil
 	}
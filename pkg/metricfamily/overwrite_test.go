@@ -0,0 +1,41 @@
+package metricfamily
+
+import (
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestOverwriteTimestamps(t *testing.T) {
+	now := time.Unix(1000, 0)
+	for _, transformer := range []Transformer{
+		OverwriteTimestamps(func() time.Time { return now }),
+		All(DropTimestamps(), OverwriteTimestamps(func() time.Time { return now })),
+	} {
+		f := family("A", 1, 2000*1000)
+		f.Metric = append(f.Metric, nil, &clientmodel.Metric{})
+		ok, err := transformer.Transform(f)
+		if !ok || err != nil {
+			t.Fatalf("want the family kept, got %t, %v", ok, err)
+		}
+		for i, m := range f.Metric {
+			if m == nil {
+				continue
+			}
+			if m.GetTimestampMs() != 1000*1000 {
+				t.Errorf("want metric %d stamped with now, got %d", i, m.GetTimestampMs())
+			}
+		}
+	}
+
+	f := family("A", 1, 2)
+	if ok, err := DropTimestamps().Transform(f); !ok || err != nil {
+		t.Fatalf("want the family kept, got %t, %v", ok, err)
+	}
+	for i, m := range f.Metric {
+		if m.TimestampMs != nil {
+			t.Errorf("want the timestamp of metric %d dropped, got %d", i, m.GetTimestampMs())
+		}
+	}
+}
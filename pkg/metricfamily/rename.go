@@ -1,6 +1,12 @@
 package metricfamily
 
-import clientmodel "github.com/prometheus/client_model/go"
+import (
+	"fmt"
+	"sort"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
 
 type RenameMetrics struct {
 	Names map[string]string
@@ -15,3 +21,70 @@ func (m RenameMetrics) Transform(family *clientmodel.MetricFamily) (bool, error)
 	}
 	return true, nil
 }
+
+// Renamer renames metric families, so that metrics keep the names dashboards expect after
+// exporters renamed them.
+type Renamer struct {
+	names   map[string]string
+	targets map[string]struct{}
+}
+
+// NewRenamer returns a Renamer renaming the families named as the keys of names to the values,
+// or nil if there are no names. An error is returned if a new name is not a valid metric name.
+func NewRenamer(names map[string]string) (*Renamer, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	r := &Renamer{names: names, targets: make(map[string]struct{}, len(names))}
+	for from, to := range names {
+		if !model.IsValidMetricName(model.LabelValue(to)) {
+			return nil, fmt.Errorf("metric %s cannot be renamed to the invalid metric name %q", from, to)
+		}
+		r.targets[to] = struct{}{}
+	}
+	return r, nil
+}
+
+// Transform renames the family. A family renamed to the name of another family is not merged
+// into it, as Rename does.
+func (r *Renamer) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	return RenameMetrics{Names: r.names}.Transform(family)
+}
+
+// Rename renames the families, and merges the families renamed to the name of another family
+// of the slice into the first of them, in timestamp order. Families whose type differs from the
+// one they would be merged into are dropped. The returned slice has no nil families.
+func (r *Renamer) Rename(families []*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	if r == nil {
+		return families
+	}
+	index := make(map[string]int)
+	merged := make(map[int]struct{})
+	renamed := make([]*clientmodel.MetricFamily, 0, len(families))
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		r.Transform(family)
+		name := family.GetName()
+		if _, ok := r.targets[name]; !ok {
+			renamed = append(renamed, family)
+			continue
+		}
+		i, ok := index[name]
+		if !ok {
+			index[name] = len(renamed)
+			renamed = append(renamed, family)
+			continue
+		}
+		if renamed[i].GetType() != family.GetType() {
+			continue
+		}
+		renamed[i].Metric = append(renamed[i].Metric, family.Metric...)
+		merged[i] = struct{}{}
+	}
+	for i := range merged {
+		sort.Stable(MetricsByTimestamp(renamed[i].Metric))
+	}
+	return renamed
+}
@@ -0,0 +1,85 @@
+package metricfamily
+
+import (
+	"fmt"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestRenamer(t *testing.T) {
+	gauge, counter := clientmodel.MetricType_GAUGE, clientmodel.MetricType_COUNTER
+	typed := func(f *clientmodel.MetricFamily, typ clientmodel.MetricType) *clientmodel.MetricFamily {
+		f.Type = &typ
+		return f
+	}
+	// format returns the names and timestamps of the families
+	format := func(families []*clientmodel.MetricFamily) string {
+		var s []string
+		for _, f := range families {
+			var timestamps []int64
+			for _, m := range f.Metric {
+				timestamps = append(timestamps, m.GetTimestampMs())
+			}
+			s = append(s, fmt.Sprintf("%s%v", f.GetName(), timestamps))
+		}
+		return fmt.Sprint(s)
+	}
+	r, err := NewRenamer(map[string]string{"cluster_version_capability": "cluster:capability", "ALERTS": "alerts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		families []*clientmodel.MetricFamily
+		want     string
+	}{
+		{
+			name:     "rename",
+			families: []*clientmodel.MetricFamily{typed(family("cluster_version_capability", 1, 2), gauge), typed(family("up", 1), gauge)},
+			want:     "[cluster:capability[1 2] up[1]]",
+		},
+		{
+			name: "merged into the family of the new name",
+			families: []*clientmodel.MetricFamily{
+				typed(family("cluster:capability", 2, 4), gauge),
+				typed(family("up", 1), gauge),
+				nil,
+				typed(family("cluster_version_capability", 1, 3), gauge),
+			},
+			want: "[cluster:capability[1 2 3 4] up[1]]",
+		},
+		{
+			name: "merged into the renamed family",
+			families: []*clientmodel.MetricFamily{
+				typed(family("ALERTS", 2), gauge),
+				typed(family("alerts", 1), gauge),
+			},
+			want: "[alerts[1 2]]",
+		},
+		{
+			name: "conflicting types",
+			families: []*clientmodel.MetricFamily{
+				typed(family("cluster:capability", 2), gauge),
+				typed(family("cluster_version_capability", 1), counter),
+			},
+			want: "[cluster:capability[2]]",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := format(r.Rename(tt.families)); got != tt.want {
+				t.Errorf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	if r, err := NewRenamer(nil); r != nil || err != nil {
+		t.Errorf("want no renamer without names, got %v, %v", r, err)
+	}
+	for _, name := range []string{"", "cluster-capability", "1cluster", "cluster capability"} {
+		if _, err := NewRenamer(map[string]string{"cluster_version_capability": name}); err == nil {
+			t.Errorf("want renaming to %q rejected", name)
+		}
+	}
+}
@@ -2,42 +2,108 @@ package metricfamily
 
 import (
 	"fmt"
+	"sort"
 
+	"github.com/prometheus/client_golang/prometheus"
 	clientmodel "github.com/prometheus/client_model/go"
 )
 
+var droppedMissingRequiredLabels = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "telemeter_dropped_missing_required_labels_total",
+	Help: "Series dropped because they lack a required label or carry another value for it.",
+})
+
+func init() {
+	prometheus.MustRegister(droppedMissingRequiredLabels)
+}
+
+// ErrRequiredLabelMissing is returned when a series of a family lacks a required label, or
+// carries another value than the expected one for it, in which case Actual is set.
+type ErrRequiredLabelMissing struct {
+	Name     string
+	Label    string
+	Expected string
+	Actual   *string
+}
+
+func (e *ErrRequiredLabelMissing) Error() string {
+	switch {
+	case e.Actual != nil:
+		return fmt.Sprintf("metric %s has a series with label %s=%q instead of %q", e.Name, e.Label, *e.Actual, e.Expected)
+	case len(e.Expected) > 0:
+		return fmt.Sprintf("metric %s has a series without the required label %s=%q", e.Name, e.Label, e.Expected)
+	}
+	return fmt.Sprintf("metric %s has a series without the required label %s", e.Name, e.Label)
+}
+
 type requireLabel struct {
-	labels map[string]string
+	// names are the names of the labels in order, so that the first missing one is reported
+	// consistently.
+	names   []string
+	labels  map[string]string
+	lenient bool
 }
 
+// NewRequiredLabels returns a Transformer that rejects families with a series lacking one of
+// the labels with *ErrRequiredLabelMissing. Series must carry the value of the label, unless it
+// is empty, in which case any value is accepted.
 func NewRequiredLabels(labels map[string]string) Transformer {
-	return requireLabel{labels: labels}
+	return newRequiredLabels(labels, false)
 }
 
-var (
-	ErrRequiredLabelMissing = fmt.Errorf("a required label is missing from the metric")
-)
+// NewLenientRequiredLabels returns a Transformer that drops the series lacking one of the
+// labels, or carrying another value for it, instead of rejecting the family as
+// NewRequiredLabels does. Families left without series are dropped.
+func NewLenientRequiredLabels(labels map[string]string) Transformer {
+	return newRequiredLabels(labels, true)
+}
+
+func newRequiredLabels(labels map[string]string, lenient bool) requireLabel {
+	t := requireLabel{labels: labels, lenient: lenient}
+	for name := range labels {
+		t.names = append(t.names, name)
+	}
+	sort.Strings(t.names)
+	return t
+}
 
 func (t requireLabel) Transform(family *clientmodel.MetricFamily) (bool, error) {
-	for k, v := range t.labels {
-	Metrics:
-		for _, m := range family.Metric {
-			if m == nil {
+	for i, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		err := t.check(family.GetName(), m)
+		if err == nil {
+			continue
+		}
+		if !t.lenient {
+			return false, err
+		}
+		droppedMissingRequiredLabels.Inc()
+		family.Metric[i] = nil
+	}
+	if t.lenient {
+		return PackMetrics(family)
+	}
+	return true, nil
+}
+
+// check returns an error if the series lacks one of the labels.
+func (t requireLabel) check(name string, m *clientmodel.Metric) error {
+Labels:
+	for _, k := range t.names {
+		v := t.labels[k]
+		for _, label := range m.Label {
+			if label == nil || label.GetName() != k {
 				continue
 			}
-			for _, label := range m.Label {
-				if label == nil {
-					continue
-				}
-				if label.GetName() == k {
-					if label.GetValue() != v {
-						return false, fmt.Errorf("expected label %s to have value %s instead of %s", label.GetName(), v, label.GetValue())
-					}
-					continue Metrics
-				}
+			if len(v) > 0 && label.GetValue() != v {
+				actual := label.GetValue()
+				return &ErrRequiredLabelMissing{Name: name, Label: k, Expected: v, Actual: &actual}
 			}
-			return false, ErrRequiredLabelMissing
+			continue Labels
 		}
+		return &ErrRequiredLabelMissing{Name: name, Label: k, Expected: v}
 	}
-	return true, nil
+	return nil
 }
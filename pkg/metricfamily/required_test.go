@@ -0,0 +1,87 @@
+package metricfamily
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestRequiredLabels(t *testing.T) {
+	labels := func(kv ...string) []*clientmodel.LabelPair {
+		var pairs []*clientmodel.LabelPair
+		for i := 0; i < len(kv); i += 2 {
+			pairs = append(pairs, &clientmodel.LabelPair{Name: proto.String(kv[i]), Value: proto.String(kv[i+1])})
+		}
+		return pairs
+	}
+	required := map[string]string{"cluster": "a", "account": ""}
+
+	tests := []struct {
+		name        string
+		family      *clientmodel.MetricFamily
+		wantErr     error
+		wantLenient *clientmodel.MetricFamily
+	}{
+		{
+			name:        "all labels",
+			family:      familyWithLabels("A", labels("account", "x", "cluster", "a"), labels("account", "y", "cluster", "a", "job", "b")),
+			wantLenient: familyWithLabels("A", labels("account", "x", "cluster", "a"), labels("account", "y", "cluster", "a", "job", "b")),
+		},
+		{
+			name:        "missing label",
+			family:      familyWithLabels("A", labels("account", "x", "cluster", "a"), labels("cluster", "a")),
+			wantErr:     &ErrRequiredLabelMissing{Name: "A", Label: "account"},
+			wantLenient: familyWithLabels("A", labels("account", "x", "cluster", "a")),
+		},
+		{
+			name:        "missing label with a value",
+			family:      familyWithLabels("A", labels("account", "x"), labels("account", "x", "cluster", "a")),
+			wantErr:     &ErrRequiredLabelMissing{Name: "A", Label: "cluster", Expected: "a"},
+			wantLenient: familyWithLabels("A", labels("account", "x", "cluster", "a")),
+		},
+		{
+			name:        "other value",
+			family:      familyWithLabels("A", labels("account", "x", "cluster", "b")),
+			wantErr:     &ErrRequiredLabelMissing{Name: "A", Label: "cluster", Expected: "a", Actual: proto.String("b")},
+			wantLenient: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := NewRequiredLabels(required).Transform(proto.Clone(tt.family).(*clientmodel.MetricFamily))
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Errorf("want err %v, got %v", tt.wantErr, err)
+			}
+			if ok != (tt.wantErr == nil) {
+				t.Errorf("unexpected ok %t", ok)
+			}
+
+			family := proto.Clone(tt.family).(*clientmodel.MetricFamily)
+			ok, err = NewLenientRequiredLabels(required).Transform(family)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (tt.wantLenient != nil) {
+				t.Fatalf("lenient: unexpected ok %t", ok)
+			}
+			if ok && !reflect.DeepEqual(family, tt.wantLenient) {
+				t.Errorf("lenient: want %v, got %v", tt.wantLenient, family)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		err  *ErrRequiredLabelMissing
+		want string
+	}{
+		{err: &ErrRequiredLabelMissing{Name: "A", Label: "account"}, want: "metric A has a series without the required label account"},
+		{err: &ErrRequiredLabelMissing{Name: "A", Label: "cluster", Expected: "a"}, want: `metric A has a series without the required label cluster="a"`},
+		{err: &ErrRequiredLabelMissing{Name: "A", Label: "cluster", Expected: "a", Actual: proto.String("b")}, want: `metric A has a series with label cluster="b" instead of "a"`},
+	} {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("want %q, got %q", tt.want, got)
+		}
+	}
+}
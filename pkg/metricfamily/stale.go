@@ -0,0 +1,45 @@
+package metricfamily
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/pkg/value"
+)
+
+var droppedStaleSamples = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "telemeter_dropped_stale_samples_total",
+	Help: "Samples dropped because their value is the staleness marker of Prometheus.",
+})
+
+func init() {
+	prometheus.MustRegister(droppedStaleSamples)
+}
+
+// DropStaleSamples is a transformer that drops the metrics whose value is the staleness marker
+// Prometheus sets when a series disappears, which is a NaN of a specific bit pattern. Other NaN
+// values are kept. Summaries and histograms are stale if their sum is. The emptied family is
+// dropped.
+func DropStaleSamples(family *clientmodel.MetricFamily) (bool, error) {
+	for i, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		var v float64
+		switch {
+		case m.Summary != nil:
+			v = m.Summary.GetSampleSum()
+		case m.Histogram != nil:
+			v = m.Histogram.GetSampleSum()
+		default:
+			var ok bool
+			if v, ok = sampleValue(m); !ok {
+				continue
+			}
+		}
+		if value.IsStaleNaN(v) {
+			droppedStaleSamples.Inc()
+			family.Metric[i] = nil
+		}
+	}
+	return PackMetrics(family)
+}
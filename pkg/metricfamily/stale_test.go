@@ -0,0 +1,70 @@
+package metricfamily
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/pkg/value"
+)
+
+func TestDropStaleSamples(t *testing.T) {
+	stale := math.Float64frombits(value.StaleNaN)
+	nan := math.NaN()
+	if value.IsStaleNaN(nan) {
+		t.Fatal("want a NaN other than the staleness marker")
+	}
+	counterValue := func(c prometheus.Counter) float64 {
+		m := &clientmodel.Metric{}
+		if err := c.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	gauge := func(v float64) *clientmodel.Metric {
+		return &clientmodel.Metric{Gauge: &clientmodel.Gauge{Value: &v}}
+	}
+	name := "A"
+
+	before := counterValue(droppedStaleSamples)
+	family := &clientmodel.MetricFamily{Name: &name, Metric: []*clientmodel.Metric{
+		gauge(1),
+		gauge(stale),
+		gauge(nan),
+		{Counter: &clientmodel.Counter{Value: &stale}},
+		{Summary: &clientmodel.Summary{SampleSum: &stale}},
+		{Histogram: &clientmodel.Histogram{SampleSum: &nan}},
+		nil,
+	}}
+	ok, err := DropStaleSamples(family)
+	if !ok || err != nil {
+		t.Fatalf("want the family kept, got %t, %v", ok, err)
+	}
+	if len(family.Metric) != 3 || family.Metric[0].Gauge.GetValue() != 1 || !math.IsNaN(family.Metric[1].Gauge.GetValue()) || family.Metric[2].Histogram == nil {
+		t.Errorf("want only the stale metrics dropped, got %v", family.Metric)
+	}
+	if got := counterValue(droppedStaleSamples) - before; got != 3 {
+		t.Errorf("want 3 stale samples counted, got %v", got)
+	}
+
+	// a family of stale metrics only is dropped, and counted as empty by Filter
+	before = counterValue(droppedEmptyFamilies)
+	families := []*clientmodel.MetricFamily{
+		{Name: &name, Metric: []*clientmodel.Metric{gauge(stale)}},
+		{Name: &name, Metric: []*clientmodel.Metric{gauge(1)}},
+	}
+	if ok, _ := DropStaleSamples(families[0]); ok {
+		t.Errorf("want the stale family dropped")
+	}
+	families[0].Metric = []*clientmodel.Metric{nil}
+	if err := Filter(families, TransformerFunc(func(*clientmodel.MetricFamily) (bool, error) { return true, nil })); err != nil {
+		t.Fatal(err)
+	}
+	if families[0] != nil || families[1] == nil {
+		t.Errorf("want only the empty family dropped, got %v", families)
+	}
+	if got := counterValue(droppedEmptyFamilies) - before; got != 1 {
+		t.Errorf("want 1 empty family counted, got %v", got)
+	}
+}
@@ -27,12 +27,22 @@ func MetricsCount(families []*clientmodel.MetricFamily) int {
 	return count
 }
 
+// Filter applies the filter to each family in place, setting the families it drops to nil,
+// along with those it leaves without metrics, so that they can be removed with Pack. Nil
+// families are skipped, and the families left empty are counted as dropped by DropEmptyFamilies.
+// It stops at the first error.
 func Filter(families []*clientmodel.MetricFamily, filter Transformer) error {
 	for i, family := range families {
+		if family == nil {
+			continue
+		}
 		ok, err := filter.Transform(family)
 		if err != nil {
 			return err
 		}
+		if ok {
+			ok, _ = DropEmptyFamilies(family)
+		}
 		if !ok {
 			families[i] = nil
 		}
@@ -1,7 +1,9 @@
 package metricfamily
 
 import (
+	"errors"
 	"reflect"
+	"strings"
 	"testing"
 
 	clientmodel "github.com/prometheus/client_model/go"
@@ -115,3 +117,92 @@ func TestMergeSort(t *testing.T) {
 	}
 
 }
+
+func TestAll(t *testing.T) {
+	errFailed := errors.New("failed")
+	// step returns a transformer appending name to the family name, and returning ok and err
+	step := func(name string, ok bool, err error) Transformer {
+		return TransformerFunc(func(family *clientmodel.MetricFamily) (bool, error) {
+			n := family.GetName() + name
+			family.Name = &n
+			return ok, err
+		})
+	}
+	tests := []struct {
+		name         string
+		transformers []Transformer
+		want         string
+		wantOk       bool
+		wantErr      error
+	}{
+		{name: "none", want: "", wantOk: true},
+		{name: "order", transformers: []Transformer{step("a", true, nil), nil, step("b", true, nil), step("c", true, nil)}, want: "abc", wantOk: true},
+		{name: "dropped", transformers: []Transformer{step("a", true, nil), step("b", false, nil), step("c", true, nil)}, want: "ab"},
+		{name: "error", transformers: []Transformer{step("a", true, nil), step("b", true, errFailed), step("c", true, nil)}, want: "ab", wantErr: errFailed},
+		{name: "nested", transformers: []Transformer{All(step("a", true, nil), step("b", true, nil)), step("c", true, nil)}, want: "abc", wantOk: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &clientmodel.MetricFamily{}
+			ok, err := All(tt.transformers...).Transform(f)
+			if err != tt.wantErr {
+				t.Errorf("want error %v, got %v", tt.wantErr, err)
+			}
+			if ok != tt.wantOk {
+				t.Errorf("want ok %t, got %t", tt.wantOk, ok)
+			}
+			if f.GetName() != tt.want {
+				t.Errorf("want the transformers applied as %q, got %q", tt.want, f.GetName())
+			}
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	// dropOdd drops the metrics with odd timestamps, and the families named drop
+	dropOdd := TransformerFunc(func(family *clientmodel.MetricFamily) (bool, error) {
+		if family.GetName() == "drop" {
+			return false, nil
+		}
+		for i, m := range family.Metric {
+			if m.GetTimestampMs()%2 == 1 {
+				family.Metric[i] = nil
+			}
+		}
+		return true, nil
+	})
+	families := []*clientmodel.MetricFamily{family("A", 1, 2), nil, family("B", 1, 3), family("drop", 2), family("C")}
+	if err := Filter(families, All(dropOdd, TransformerFunc(PackMetrics))); err != nil {
+		t.Fatal(err)
+	}
+	got := Pack(families)
+	if want := []*clientmodel.MetricFamily{family("A", 2)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	// families left without metrics are pruned even if they are not packed
+	families = []*clientmodel.MetricFamily{family("A", 1, 3), family("B", 1, 2)}
+	if err := Filter(families, dropOdd); err != nil {
+		t.Fatal(err)
+	}
+	if families[0] != nil || families[1] == nil {
+		t.Errorf("want only the family without metrics pruned, got %v", families)
+	}
+
+	// the first error is returned
+	families = []*clientmodel.MetricFamily{family("A", 1), family("fail", 1), family("B", 1)}
+	err := Filter(families, TransformerFunc(func(family *clientmodel.MetricFamily) (bool, error) {
+		if family.GetName() == "fail" {
+			return false, errors.New("failed " + family.GetName())
+		}
+		name := strings.ToLower(family.GetName())
+		family.Name = &name
+		return true, nil
+	}))
+	if err == nil || err.Error() != "failed fail" {
+		t.Errorf("want the error of the transformer, got %v", err)
+	}
+	if families[0].GetName() != "a" || families[2].GetName() != "B" {
+		t.Errorf("want the families after the error untouched, got %v", families)
+	}
+}
@@ -0,0 +1,67 @@
+package metricfamily
+
+import (
+	"fmt"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// ErrInconsistentType is returned when a series lacks the value of the type of its family.
+type ErrInconsistentType struct {
+	Name string
+	Type clientmodel.MetricType
+}
+
+func (e *ErrInconsistentType) Error() string {
+	return fmt.Sprintf("metric %s of type %s has series without a %s value", e.Name, e.Type, strings.ToLower(e.Type.String()))
+}
+
+type errorOnInconsistentTypes struct {
+	drop bool
+}
+
+// NewErrorOnInconsistentTypes returns a transformer failing with *ErrInconsistentType on
+// series that do not have the value of the declared type of their family set, or dropping them
+// if drop is set. Families without a type are counters. Unknown types are left to other checks.
+func NewErrorOnInconsistentTypes(drop bool) Transformer {
+	return &errorOnInconsistentTypes{drop: drop}
+}
+
+func (t *errorOnInconsistentTypes) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	if _, ok := clientmodel.MetricType_name[int32(family.GetType())]; !ok {
+		return true, nil
+	}
+	dropped := false
+	for i, m := range family.Metric {
+		if m == nil || HasTypedValue(family.GetType(), m) {
+			continue
+		}
+		if !t.drop {
+			return false, &ErrInconsistentType{Name: family.GetName(), Type: family.GetType()}
+		}
+		family.Metric[i] = nil
+		dropped = true
+	}
+	if dropped {
+		return PackMetrics(family)
+	}
+	return true, nil
+}
+
+// HasTypedValue returns true if the series has the value of the type set.
+func HasTypedValue(typ clientmodel.MetricType, m *clientmodel.Metric) bool {
+	switch typ {
+	case clientmodel.MetricType_COUNTER:
+		return m.Counter != nil && m.Counter.Value != nil
+	case clientmodel.MetricType_GAUGE:
+		return m.Gauge != nil && m.Gauge.Value != nil
+	case clientmodel.MetricType_UNTYPED:
+		return m.Untyped != nil && m.Untyped.Value != nil
+	case clientmodel.MetricType_SUMMARY:
+		return m.Summary != nil
+	case clientmodel.MetricType_HISTOGRAM:
+		return m.Histogram != nil
+	}
+	return false
+}
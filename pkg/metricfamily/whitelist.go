@@ -1,44 +1,67 @@
 package metricfamily
 
 import (
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
 	clientmodel "github.com/prometheus/client_model/go"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
 )
 
-type whitelist [][]*labels.Matcher
+var whitelistSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "telemeter_whitelist_samples_total",
+	Help: "Samples checked against the whitelist, by the index of the first selector they matched, or none for those dropped as they matched none.",
+}, []string{"selector"})
+
+func init() {
+	prometheus.MustRegister(whitelistSamples)
+}
+
+type whitelist struct {
+	matchsets [][]*labels.Matcher
+	// matched counts the samples matching each matchset, and dropped those matching none.
+	matched []prometheus.Counter
+	dropped prometheus.Counter
+}
 
 // NewWhitelist returns a Transformer that checks if at least one
 // rule in the whitelist is true.
 // This Transformer will nil metrics within a metric family that do not match a rule.
-// Each given rule is transformed into a matchset. Matchsets are OR-ed.
-// Individual matchers within a matchset are AND-ed, as in PromQL.
+// Each given rule is a PromQL vector selector, such as up{job="apiserver"}, transformed into a
+// matchset. Matchsets are OR-ed.
+// Individual matchers within a matchset are AND-ed, as in PromQL, and a label a metric does not
+// have matches as the empty value. A rule that cannot be parsed fails construction.
 func NewWhitelist(rules []string) (Transformer, error) {
-	var ms [][]*labels.Matcher
+	t := &whitelist{dropped: whitelistSamples.WithLabelValues("none")}
 	for i := range rules {
 		matchers, err := promql.ParseMetricSelector(rules[i])
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("selector %d %q is invalid: %v", i, rules[i], err)
 		}
-		ms = append(ms, matchers)
+		t.matchsets = append(t.matchsets, matchers)
+		t.matched = append(t.matched, whitelistSamples.WithLabelValues(strconv.Itoa(i)))
 	}
-	return whitelist(ms), nil
+	return t, nil
 }
 
 // Transform implements the Transformer interface.
-func (t whitelist) Transform(family *clientmodel.MetricFamily) (bool, error) {
+func (t *whitelist) Transform(family *clientmodel.MetricFamily) (bool, error) {
 	var ok bool
 Metric:
 	for i, m := range family.Metric {
 		if m == nil {
 			continue
 		}
-		for _, matchset := range t {
+		for j, matchset := range t.matchsets {
 			if match(family.GetName(), m, matchset...) {
+				t.matched[j].Inc()
 				ok = true
 				continue Metric
 			}
 		}
+		t.dropped.Inc()
 		family.Metric[i] = nil
 	}
 	return ok, nil
@@ -46,18 +69,26 @@ Metric:
 
 // match checks whether every Matcher matches a given metric.
 func match(name string, metric *clientmodel.Metric, matchers ...*labels.Matcher) bool {
-Matcher:
 	for _, m := range matchers {
-		if m.Name == "__name__" && m.Matches(name) {
+		if m.Name == labels.MetricName {
+			if !m.Matches(name) {
+				return false
+			}
 			continue
 		}
-		for _, label := range metric.Label {
-			if label == nil || m.Name != label.GetName() || !m.Matches(label.GetValue()) {
-				continue
-			}
-			continue Matcher
+		if !m.Matches(labelValue(metric, m.Name)) {
+			return false
 		}
-		return false
 	}
 	return true
 }
+
+// labelValue returns the value of the label of the metric, or the empty value if it has none.
+func labelValue(metric *clientmodel.Metric, name string) string {
+	for _, label := range metric.Label {
+		if label != nil && label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
@@ -204,3 +204,72 @@ func mustMakeWhitelist(t *testing.T, rules []string) Transformer {
 	}
 	return w
 }
+
+func TestWhitelistSelectors(t *testing.T) {
+	pair := func(name, value string) *clientmodel.LabelPair {
+		return &clientmodel.LabelPair{Name: &name, Value: &value}
+	}
+	up := familyWithLabels("up",
+		[]*clientmodel.LabelPair{pair("job", "apiserver")},
+		[]*clientmodel.LabelPair{pair("job", "etcd")},
+		[]*clientmodel.LabelPair{pair("job", "kubelet"), pair("type", "failure")},
+		nil,
+	)
+
+	for _, tc := range []struct {
+		name  string
+		rules []string
+		// kept are the indexes of the metrics of up kept
+		kept []int
+	}{
+		{name: "equality", rules: []string{`up{job="apiserver"}`}, kept: []int{0}},
+		{name: "inequality", rules: []string{`up{job!="apiserver"}`}, kept: []int{1, 2, 3}},
+		{name: "regex", rules: []string{`up{job=~"api.*|etcd"}`}, kept: []int{0, 1}},
+		{name: "negative regex", rules: []string{`{__name__="up",job!~"api.*|etcd"}`}, kept: []int{2, 3}},
+		{name: "missing labels match the empty value", rules: []string{`up{type!="failure"}`}, kept: []int{0, 1, 3}},
+		{name: "other metric", rules: []string{`down{job="apiserver"}`}},
+		{name: "any selector", rules: []string{`up{job="etcd"}`, `up{type="failure"}`}, kept: []int{1, 2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := copyMetric(up)
+			ok, err := mustMakeWhitelist(t, tc.rules).Transform(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (len(tc.kept) > 0) {
+				t.Errorf("want ok %t, got %t", len(tc.kept) > 0, ok)
+			}
+			var kept []int
+			for i, m := range f.Metric {
+				if m != nil {
+					kept = append(kept, i)
+				}
+			}
+			if fmt.Sprint(kept) != fmt.Sprint(tc.kept) {
+				t.Errorf("want metrics %v kept, got %v", tc.kept, kept)
+			}
+		})
+	}
+
+	// samples are counted by the first selector they match
+	counter := func(selector string) float64 {
+		m := &clientmodel.Metric{}
+		if err := whitelistSamples.WithLabelValues(selector).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	first, second, none := counter("0"), counter("1"), counter("none")
+	if _, err := mustMakeWhitelist(t, []string{`up{job=~"etcd|kubelet"}`, `up{job="kubelet"}`}).Transform(copyMetric(up)); err != nil {
+		t.Fatal(err)
+	}
+	if got := []float64{counter("0") - first, counter("1") - second, counter("none") - none}; fmt.Sprint(got) != "[2 0 2]" {
+		t.Errorf("want 2 samples of the first selector and 2 dropped, got %v", got)
+	}
+
+	for _, rules := range [][]string{{`up{job="apiserver"`}, {`up`, `up{job=}`}, {`rate(up[5m])`}} {
+		if _, err := NewWhitelist(rules); err == nil {
+			t.Errorf("want rules %q rejected", rules)
+		}
+	}
+}
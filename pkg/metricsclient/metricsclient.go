@@ -2,7 +2,10 @@ package metricsclient
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,6 +14,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/snappy"
@@ -38,11 +42,54 @@ func init() {
 	)
 }
 
+// PartHeader identifies the part of an upload split into several requests, as
+// "<index>/<count>; upload=<id>", where the index starts at 1 and the ID is shared by the parts.
+const PartHeader = "X-Telemeter-Part"
+
+// LastUploadHeader is sent with the first upload after the client restarted, as the RFC 3339
+// time of its last successful upload before the restart, so that the gap in the metrics can be
+// told apart from an outage.
+const LastUploadHeader = "X-Telemeter-Last-Upload"
+
+// Content encodings of the metrics sent.
+const (
+	EncodingSnappy   = "snappy"
+	EncodingGzip     = "gzip"
+	EncodingIdentity = "identity"
+)
+
+// errUnsupportedEncoding is returned by send when the server does not accept the encoding.
+var errUnsupportedEncoding = errors.New("gateway server does not accept the content encoding")
+
+// errNotFound is returned by post when the server has no such endpoint.
+type errNotFound struct {
+	message string
+}
+
+func (e *errNotFound) Error() string {
+	return e.message
+}
+
 type Client struct {
 	client      *http.Client
 	maxBytes    int64
 	timeout     time.Duration
 	metricsName string
+
+	// Encoding compresses the metrics sent, snappy by default. If the server does not accept
+	// it, metrics are sent uncompressed from then on.
+	Encoding     string
+	lock         sync.Mutex
+	uncompressed bool
+}
+
+// IsEncoding returns true if encoding is one of the content encodings metrics are sent with.
+func IsEncoding(encoding string) bool {
+	switch encoding {
+	case EncodingSnappy, EncodingGzip, EncodingIdentity:
+		return true
+	}
+	return false
 }
 
 func New(client *http.Client, maxBytes int64, timeout time.Duration, metricsName string) *Client {
@@ -106,9 +153,114 @@ func (c *Client) Retrieve(ctx context.Context, req *http.Request) ([]*clientmode
 	return families, nil
 }
 
+// ErrRejected is returned by Send when the server refused the metrics sent, which fails the same
+// way if they are sent again.
+type ErrRejected struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ErrRejected) Error() string {
+	return e.Message
+}
+
+// ErrUnavailable is returned by Send when the server failed to store the metrics sent, with a
+// 5xx status code, which may succeed if they are sent again.
+type ErrUnavailable struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ErrUnavailable) Error() string {
+	return e.Message
+}
+
+// ErrRateLimited is returned by Send when the server asks to send later. RetryAfter is how long
+// the server asked to wait, or 0 if it did not say. Reason is the code of the error the server
+// responded with, such as rate_limited or quota_exceeded, if any.
+type ErrRateLimited struct {
+	RetryAfter time.Duration
+	Reason     string
+	Message    string
+}
+
+func (e *ErrRateLimited) Error() string {
+	return e.Message
+}
+
+// rateLimitBody is the part of the error body of a rate limited upload telling why, and for an
+// exceeded quota when it resets.
+type rateLimitBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details struct {
+		Reset time.Time `json:"reset"`
+	} `json:"details"`
+}
+
+// rateLimited returns the error of a rate limited upload. The delay is that of the Retry-After
+// header, or else the time left until the quota resets.
+func rateLimited(resp *http.Response, now time.Time) *ErrRateLimited {
+	err := &ErrRateLimited{
+		RetryAfter: retryAfter(resp.Header.Get("Retry-After"), now),
+		Message:    fmt.Sprintf("gateway server rate limited the upload: %s", resp.Request.URL),
+	}
+	var body rateLimitBody
+	if data, rerr := ioutil.ReadAll(io.LimitReader(resp.Body, 4*1024)); rerr == nil && json.Unmarshal(data, &body) == nil {
+		err.Reason = body.Code
+		if len(body.Message) > 0 {
+			err.Message = fmt.Sprintf("gateway server rate limited the upload: %s: %s", body.Message, resp.Request.URL)
+		}
+		if err.RetryAfter == 0 && body.Details.Reset.After(now) {
+			err.RetryAfter = body.Details.Reset.Sub(now)
+		}
+	}
+	return err
+}
+
+// retryAfter parses the value of a Retry-After header, in seconds or as an HTTP date. It
+// returns 0 if the value is empty or invalid.
+func retryAfter(value string, now time.Time) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
 func (c *Client) Send(ctx context.Context, req *http.Request, families []*clientmodel.MetricFamily) error {
+	c.lock.Lock()
+	encoding := c.Encoding
+	if len(encoding) == 0 {
+		encoding = EncodingSnappy
+	}
+	if c.uncompressed {
+		encoding = EncodingIdentity
+	}
+	c.lock.Unlock()
+
+	err := c.send(ctx, req, families, encoding)
+	if err != errUnsupportedEncoding {
+		return err
+	}
+	if encoding == EncodingIdentity {
+		return fmt.Errorf("gateway server does not accept uncompressed metrics: %s", req.URL)
+	}
+	log.Printf("warning: gateway server does not accept %s compressed metrics, sending them uncompressed", encoding)
+	c.lock.Lock()
+	c.uncompressed = true
+	c.lock.Unlock()
+	return c.send(ctx, req, families, EncodingIdentity)
+}
+
+func (c *Client) send(ctx context.Context, req *http.Request, families []*clientmodel.MetricFamily, encoding string) error {
 	buf := &bytes.Buffer{}
-	if err := Write(buf, families); err != nil {
+	if err := encode(buf, families, encoding); err != nil {
 		return err
 	}
 
@@ -116,8 +268,22 @@ func (c *Client) Send(ctx context.Context, req *http.Request, families []*client
 		req.Header = make(http.Header)
 	}
 	req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
-	req.Header.Set("Content-Encoding", "snappy")
-	req.Body = ioutil.NopCloser(buf)
+	if encoding == EncodingIdentity {
+		req.Header.Del("Content-Encoding")
+	} else {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	return c.post(ctx, req, buf.Bytes())
+}
+
+// post sends the request with the body, and returns the error the server responded with, if any.
+func (c *Client) post(ctx context.Context, req *http.Request, body []byte) error {
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	// allow the request to be sent again, such as after refreshing the token
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
 
 	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	req = req.WithContext(ctx)
@@ -134,22 +300,42 @@ func (c *Client) Send(ctx context.Context, req *http.Request, families []*client
 		switch resp.StatusCode {
 		case http.StatusOK:
 			gaugeRequestSend.WithLabelValues(c.metricsName, "200").Inc()
+		case http.StatusNoContent:
+			// the server had nothing to store, usually because every metric was filtered out
+			gaugeRequestSend.WithLabelValues(c.metricsName, "204").Inc()
+			log.Printf("warning: gateway server stored none of the metrics sent: %s", resp.Header.Get("Warning"))
 		case http.StatusUnauthorized:
 			gaugeRequestSend.WithLabelValues(c.metricsName, "401").Inc()
 			return fmt.Errorf("gateway server requires authentication: %s", resp.Request.URL)
 		case http.StatusForbidden:
 			gaugeRequestSend.WithLabelValues(c.metricsName, "403").Inc()
 			return fmt.Errorf("gateway server forbidden: %s", resp.Request.URL)
+		case http.StatusUnsupportedMediaType:
+			gaugeRequestSend.WithLabelValues(c.metricsName, "415").Inc()
+			return errUnsupportedEncoding
+		case http.StatusTooManyRequests:
+			gaugeRequestSend.WithLabelValues(c.metricsName, "429").Inc()
+			return rateLimited(resp, time.Now())
 		case http.StatusBadRequest:
 			gaugeRequestSend.WithLabelValues(c.metricsName, "400").Inc()
-			return fmt.Errorf("gateway server bad request: %s", resp.Request.URL)
+			return &ErrRejected{StatusCode: resp.StatusCode, Message: fmt.Sprintf("gateway server bad request: %s", resp.Request.URL)}
 		default:
 			gaugeRequestSend.WithLabelValues(c.metricsName, strconv.Itoa(resp.StatusCode)).Inc()
 			body, _ := ioutil.ReadAll(resp.Body)
 			if len(body) > 1024 {
 				body = body[:1024]
 			}
-			return fmt.Errorf("gateway server reported unexpected error code: %d: %s", resp.StatusCode, string(body))
+			message := fmt.Sprintf("gateway server reported unexpected error code: %d: %s", resp.StatusCode, string(body))
+			switch resp.StatusCode {
+			case http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+				return &ErrRejected{StatusCode: resp.StatusCode, Message: message}
+			case http.StatusNotFound:
+				return &errNotFound{message: message}
+			}
+			if resp.StatusCode >= 500 {
+				return &ErrUnavailable{StatusCode: resp.StatusCode, Message: message}
+			}
+			return errors.New(message)
 		}
 
 		return nil
@@ -173,6 +359,36 @@ func Read(r io.Reader) ([]*clientmodel.MetricFamily, error) {
 	return families, nil
 }
 
+// encode writes the families in the protobuf delimited format compressed with encoding.
+func encode(w io.Writer, families []*clientmodel.MetricFamily, encoding string) error {
+	switch encoding {
+	case EncodingSnappy:
+		return Write(w, families)
+	case EncodingGzip:
+		compress := gzip.NewWriter(w)
+		if err := writeFamilies(compress, families); err != nil {
+			return err
+		}
+		return compress.Close()
+	case EncodingIdentity:
+		return writeFamilies(w, families)
+	}
+	return fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+func writeFamilies(w io.Writer, families []*clientmodel.MetricFamily) error {
+	encoder := expfmt.NewEncoder(w, expfmt.FmtProtoDelim)
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		if err := encoder.Encode(family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func Write(w io.Writer, families []*clientmodel.MetricFamily) error {
 	// output the filtered set
 	compress := snappy.NewBufferedWriter(w)
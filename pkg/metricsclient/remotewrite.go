@@ -0,0 +1,141 @@
+package metricsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// ErrRemoteWriteUnsupported is returned by SendRemoteWrite when the server has no remote-write
+// endpoint at the URL of the request, or does not accept remote-write requests there.
+var ErrRemoteWriteUnsupported = errors.New("gateway server does not accept remote-write requests")
+
+// SendRemoteWrite sends the families as a snappy compressed Prometheus remote-write request.
+// Series without a timestamp are sent with the current time.
+func (c *Client) SendRemoteWrite(ctx context.Context, req *http.Request, families []*clientmodel.MetricFamily) error {
+	data, err := proto.Marshal(WriteRequest(families, time.Now()))
+	if err != nil {
+		return fmt.Errorf("unable to encode the remote-write request: %v", err)
+	}
+
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", EncodingSnappy)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	err = c.post(ctx, req, snappy.Encode(nil, data))
+	if _, ok := err.(*errNotFound); ok || err == errUnsupportedEncoding {
+		return ErrRemoteWriteUnsupported
+	}
+	return err
+}
+
+// WriteRequest converts the families to a remote-write request. Series are named after their
+// family, and summaries and histograms are expanded into the series Prometheus scrapes them as.
+// The samples of a series are sent in timestamp order, with now for those without a timestamp.
+func WriteRequest(families []*clientmodel.MetricFamily, now time.Time) *prompb.WriteRequest {
+	w := &writeRequest{index: make(map[string]int), now: now.UnixNano() / int64(time.Millisecond)}
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		name := family.GetName()
+		for _, m := range family.Metric {
+			if m == nil {
+				continue
+			}
+			switch {
+			case m.Counter != nil:
+				w.add(name, m, m.Counter.GetValue())
+			case m.Gauge != nil:
+				w.add(name, m, m.Gauge.GetValue())
+			case m.Untyped != nil:
+				w.add(name, m, m.Untyped.GetValue())
+			case m.Summary != nil:
+				for _, q := range m.Summary.Quantile {
+					w.add(name, m, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				w.add(name+"_sum", m, m.Summary.GetSampleSum())
+				w.add(name+"_count", m, float64(m.Summary.GetSampleCount()))
+			case m.Histogram != nil:
+				infSeen := false
+				for _, b := range m.Histogram.Bucket {
+					if math.IsInf(b.GetUpperBound(), +1) {
+						infSeen = true
+					}
+					w.add(name+"_bucket", m, float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				if !infSeen {
+					w.add(name+"_bucket", m, float64(m.Histogram.GetSampleCount()), "le", "+Inf")
+				}
+				w.add(name+"_sum", m, m.Histogram.GetSampleSum())
+				w.add(name+"_count", m, float64(m.Histogram.GetSampleCount()))
+			}
+		}
+	}
+	for i := range w.req.Timeseries {
+		samples := w.req.Timeseries[i].Samples
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+	}
+	return &w.req
+}
+
+// writeRequest builds a remote-write request, with the samples of a series kept together.
+type writeRequest struct {
+	req   prompb.WriteRequest
+	index map[string]int
+	now   int64
+}
+
+// add adds a sample of the series of m named name, with the extra label, if any.
+func (w *writeRequest) add(name string, m *clientmodel.Metric, value float64, extra ...string) {
+	labels := make([]prompb.Label, 0, len(m.Label)+2)
+	labels = append(labels, prompb.Label{Name: "__name__", Value: name})
+	for _, pair := range m.Label {
+		if pair == nil || len(pair.GetValue()) == 0 {
+			continue
+		}
+		labels = append(labels, prompb.Label{Name: pair.GetName(), Value: pair.GetValue()})
+	}
+	if len(extra) == 2 {
+		labels = append(labels, prompb.Label{Name: extra[0], Value: extra[1]})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+	var key strings.Builder
+	for _, l := range labels {
+		key.WriteString(l.Name)
+		key.WriteByte(0xff)
+		key.WriteString(l.Value)
+		key.WriteByte(0xff)
+	}
+	timestamp := w.now
+	if m.TimestampMs != nil {
+		timestamp = m.GetTimestampMs()
+	}
+	sample := prompb.Sample{Value: value, Timestamp: timestamp}
+	i, ok := w.index[key.String()]
+	if !ok {
+		i = len(w.req.Timeseries)
+		w.index[key.String()] = i
+		w.req.Timeseries = append(w.req.Timeseries, prompb.TimeSeries{Labels: labels})
+	}
+	w.req.Timeseries[i].Samples = append(w.req.Timeseries[i].Samples, sample)
+}
+
+// formatFloat formats the value of a quantile or le label as Prometheus does.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -31,7 +31,8 @@ func LimitReader(r io.Reader, n int64) io.Reader { return &LimitedReader{r, n} }
 // A LimitedReader reads from R but limits the amount of
 // data returned to just N bytes. Each call to Read
 // updates N to reflect the new amount remaining.
-// Read returns ErrTooLong when N <= 0 or when the underlying R returns EOF.
+// Read returns ErrTooLong once N <= 0 and the underlying R has more to read, so that data
+// of exactly N bytes is read in full.
 type LimitedReader struct {
 	R io.Reader // underlying reader
 	N int64     // max bytes remaining
@@ -39,7 +40,12 @@ type LimitedReader struct {
 
 func (l *LimitedReader) Read(p []byte) (n int, err error) {
 	if l.N <= 0 {
-		return 0, ErrTooLong
+		// read one byte past the limit to tell the end of the data from data too long
+		var b [1]byte
+		if n, err = l.R.Read(b[:]); n > 0 {
+			return 0, ErrTooLong
+		}
+		return 0, err
 	}
 	if int64(len(p)) > l.N {
 		p = p[0:l.N]
@@ -1,16 +1,32 @@
 package receive
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
 	"time"
 
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+
 	"github.com/openshift/telemeter/pkg/authorize"
 )
 
 const forwardTimeout = 5 * time.Second
 
+// maxRequestBytes bounds the remote-write requests read into memory to attach labels, and
+// maxDecodedBytes their size once decompressed.
+const (
+	maxRequestBytes = 32 * 1024 * 1024
+	maxDecodedBytes = 128 * 1024 * 1024
+)
+
 // ClusterAuthorizer authorizes a cluster by its token and id, returning a subject or error
 type ClusterAuthorizer interface {
 	AuthorizeCluster(token, cluster string) (subject string, err error)
@@ -44,7 +60,18 @@ func (h *Handler) Receive(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), forwardTimeout)
 	defer cancel()
 
-	req, err := http.NewRequest(http.MethodPost, h.ForwardURL, r.Body)
+	var body io.Reader = r.Body
+	if client, ok := authorize.FromContext(r.Context()); ok && len(client.Labels) > 0 {
+		data, err := enforceLabels(io.LimitReader(r.Body, maxRequestBytes+1), client.Labels)
+		if err != nil {
+			log.Printf("failed to attach client labels: %v\n", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.ForwardURL, body)
 	if err != nil {
 		log.Printf("failed to create forward request: %v\n", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -66,3 +93,54 @@ func (h *Handler) Receive(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// enforceLabels sets the labels on every series of the snappy compressed remote-write request,
+// overwriting values sent by the client, and returns the compressed request.
+func enforceLabels(r io.Reader, labels map[string]string) ([]byte, error) {
+	compressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) > maxRequestBytes {
+		return nil, fmt.Errorf("request exceeds %d bytes", maxRequestBytes)
+	}
+	// the decoded length is read from the header, before memory is allocated for it
+	n, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress request: %v", err)
+	}
+	if n > maxDecodedBytes {
+		return nil, fmt.Errorf("decompressed request exceeds %d bytes", maxDecodedBytes)
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress request: %v", err)
+	}
+	var wreq prompb.WriteRequest
+	if err := proto.Unmarshal(data, &wreq); err != nil {
+		return nil, fmt.Errorf("unable to parse request: %v", err)
+	}
+
+	for i := range wreq.Timeseries {
+		ts := &wreq.Timeseries[i]
+		set := make(map[string]bool, len(labels))
+		for j := range ts.Labels {
+			if value, ok := labels[ts.Labels[j].Name]; ok {
+				ts.Labels[j].Value = value
+				set[ts.Labels[j].Name] = true
+			}
+		}
+		for name, value := range labels {
+			if !set[name] {
+				ts.Labels = append(ts.Labels, prompb.Label{Name: name, Value: value})
+			}
+		}
+		sort.Slice(ts.Labels, func(a, b int) bool { return ts.Labels[a].Name < ts.Labels[b].Name })
+	}
+
+	data, err = proto.Marshal(&wreq)
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, data), nil
+}
@@ -0,0 +1,125 @@
+package receive
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func TestReceiveClientLabels(t *testing.T) {
+	// the authorization service returns the attributes of the account
+	authorizer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"account_id":"account-1","labels":{"account_id":"account-1","support-level":"premium","__name__":"spoofed"}}`))
+	}))
+	defer authorizer.Close()
+
+	forwarded := make(chan prompb.WriteRequest, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		compressed, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var wreq prompb.WriteRequest
+		if err := proto.Unmarshal(data, &wreq); err != nil {
+			t.Error(err)
+			return
+		}
+		forwarded <- wreq
+	}))
+	defer receiver.Close()
+
+	u, err := url.Parse(authorizer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := authorize.NewHandler(http.DefaultClient, u, "", http.HandlerFunc(NewHandler(receiver.URL).Receive))
+
+	// the client claims to belong to another account
+	data, err := proto.Marshal(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels: []prompb.Label{
+			{Name: "__name__", Value: "up"},
+			{Name: "account_id", Value: "account-2"},
+		},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/metrics/v1/receive", bytes.NewReader(snappy.Encode(nil, data)))
+	req.Header.Set("Authorization", `Bearer {"cluster_id":"cluster-1"}`)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	want := []prompb.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "account_id", Value: "account-1"},
+		{Name: "support_level", Value: "premium"},
+	}
+	wreq := <-forwarded
+	if len(wreq.Timeseries) != 1 || !reflect.DeepEqual(wreq.Timeseries[0].Labels, want) {
+		t.Fatalf("want forwarded labels %v, got %v", want, wreq.Timeseries)
+	}
+}
+
+func TestReceiveLimits(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Error("unexpected forwarded request")
+	}))
+	defer receiver.Close()
+
+	t.Run("decoded size", func(t *testing.T) {
+		// a snappy block header claiming a decoded length past the limit
+		var header [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(header[:], maxDecodedBytes+1)
+		req := httptest.NewRequest("POST", "/metrics/v1/receive", bytes.NewReader(header[:n]))
+		ctx := context.WithValue(req.Context(), authorize.TenantKey, "cluster-1")
+		ctx = authorize.WithClient(ctx, &authorize.Client{ID: "cluster-1", Labels: map[string]string{"account_id": "account-1"}})
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+		NewHandler(receiver.URL).Receive(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("want status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("invalid authorization response", func(t *testing.T) {
+		authorizer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(`{"labels":`))
+		}))
+		defer authorizer.Close()
+		u, err := url.Parse(authorizer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := authorize.NewHandler(http.DefaultClient, u, "", http.HandlerFunc(NewHandler(receiver.URL).Receive))
+		req := httptest.NewRequest("POST", "/metrics/v1/receive", bytes.NewReader(nil))
+		req.Header.Set("Authorization", `Bearer {"cluster_id":"cluster-1"}`)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusBadGateway {
+			t.Fatalf("want status 502, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
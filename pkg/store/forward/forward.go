@@ -12,10 +12,12 @@ import (
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus"
 	clientmodel "github.com/prometheus/client_model/go"
 	"github.com/prometheus/prometheus/prompb"
 
+	"github.com/openshift/telemeter/pkg/metricfamily"
 	"github.com/openshift/telemeter/pkg/store"
 )
 
@@ -41,6 +43,10 @@ var (
 		Name: "telemeter_forward_overwritten_timestamps_total",
 		Help: "Total number of timestamps that were overwritten",
 	})
+	skippedSeries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "telemeter_forward_skipped_series_total",
+		Help: "Total number of series not forwarded because they lack the value of their type",
+	})
 )
 
 func init() {
@@ -48,6 +54,7 @@ func init() {
 	prometheus.MustRegister(forwardErrors)
 	prometheus.MustRegister(forwardDuration)
 	prometheus.MustRegister(overwrittenTimestamps)
+	prometheus.MustRegister(skippedSeries)
 }
 
 type Store struct {
@@ -68,15 +75,40 @@ func (s *Store) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*store
 	return s.next.ReadMetrics(ctx, minTimestampMs)
 }
 
+func (s *Store) ReadPartitions(ctx context.Context, minTimestampMs int64, partitionKeys ...string) ([]*store.PartitionedMetrics, error) {
+	return store.ReadPartitions(ctx, s.next, minTimestampMs, partitionKeys...)
+}
+
+// DeleteMetrics deletes the partition from the next store. Data already forwarded
+// cannot be deleted from here, so ErrDeletePending is returned on success.
+func (s *Store) DeleteMetrics(ctx context.Context, partitionKey string) error {
+	if err := store.DeleteMetrics(ctx, s.next, partitionKey); err != nil {
+		return err
+	}
+	return store.ErrDeletePending
+}
+
 func (s *Store) WriteMetrics(ctx context.Context, p *store.PartitionedMetrics) error {
 	if p == nil {
 		return nil
 	}
 
+	// the request is traced as a child of the write, even though it outlives it
+	var span opentracing.Span
+	if parent := opentracing.SpanFromContext(ctx); parent != nil {
+		span = parent.Tracer().StartSpan("forward", opentracing.ChildOf(parent.Context()))
+	} else {
+		span = opentracing.NoopTracer{}.StartSpan("forward")
+	}
+
+	// the families are normalized before the write returns, as the next store may keep them
+	normalized := &store.PartitionedMetrics{PartitionKey: p.PartitionKey, Families: metricfamily.Normalize(p.Families)}
+
 	go func() {
+		defer span.Finish()
 		// Run in a func to catch all transient errors
 		err := func() error {
-			timeseries, err := convertToTimeseries(p, time.Now())
+			timeseries, err := convertToTimeseries(normalized, time.Now())
 			if err != nil {
 				return err
 			}
@@ -102,6 +134,9 @@ func (s *Store) WriteMetrics(ctx context.Context, p *store.PartitionedMetrics) e
 				return err
 			}
 			req.Header.Add("THANOS-TENANT", p.PartitionKey)
+			if err := span.Tracer().Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header)); err != nil {
+				log.Printf("unable to propagate trace to the receive endpoint: %v", err)
+			}
 
 			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 			defer cancel()
@@ -114,6 +149,7 @@ func (s *Store) WriteMetrics(ctx context.Context, p *store.PartitionedMetrics) e
 				return err
 			}
 
+			span.SetTag("http.status_code", resp.StatusCode)
 			forwardDuration.
 				WithLabelValues(fmt.Sprintf("%d", resp.StatusCode)).
 				Observe(time.Since(begin).Seconds())
@@ -139,6 +175,7 @@ func (s *Store) WriteMetrics(ctx context.Context, p *store.PartitionedMetrics) e
 			return nil
 		}()
 		if err != nil {
+			span.SetTag("error", true)
 			forwardErrors.Inc()
 			log.Printf("forwarding error: %v", err)
 		}
@@ -147,44 +184,68 @@ func (s *Store) WriteMetrics(ctx context.Context, p *store.PartitionedMetrics) e
 	return s.next.WriteMetrics(ctx, p)
 }
 
+// convertToTimeseries converts the families to remote write series. Series lacking the value of
+// the type of their family are skipped, as they cannot be converted. Series without a timestamp,
+// as left by metricfamily.DropTimestamps, are stamped with now, and timestamps after now are
+// overwritten with it.
 func convertToTimeseries(p *store.PartitionedMetrics, now time.Time) ([]prompb.TimeSeries, error) {
 	var timeseries []prompb.TimeSeries
 
 	timestamp := now.UnixNano() / int64(time.Millisecond)
 	for _, f := range p.Families {
+		if f == nil {
+			continue
+		}
+		switch f.GetType() {
+		case clientmodel.MetricType_COUNTER, clientmodel.MetricType_GAUGE, clientmodel.MetricType_UNTYPED:
+		default:
+			return nil, fmt.Errorf("metric type %s not supported", f.GetType().String())
+		}
 		for _, m := range f.Metric {
+			if m == nil {
+				continue
+			}
+			if !metricfamily.HasTypedValue(f.GetType(), m) {
+				skippedSeries.Inc()
+				continue
+			}
 			var ts prompb.TimeSeries
 
 			labelpairs := []prompb.Label{{
 				Name:  nameLabelName,
-				Value: *f.Name,
+				Value: f.GetName(),
 			}}
 
 			for _, l := range m.Label {
+				if l == nil {
+					continue
+				}
 				labelpairs = append(labelpairs, prompb.Label{
-					Name:  *l.Name,
-					Value: *l.Value,
+					Name:  l.GetName(),
+					Value: l.GetValue(),
 				})
 			}
 
+			// Samples without a timestamp are stamped on receipt, and samples in the future are
+			// overwritten.
 			s := prompb.Sample{
-				Timestamp: *m.TimestampMs,
+				Timestamp: timestamp,
 			}
-			// If the sample is in the future, overwrite it.
-			if *m.TimestampMs > timestamp {
-				s.Timestamp = timestamp
+			switch {
+			case m.TimestampMs == nil:
+			case *m.TimestampMs > timestamp:
 				overwrittenTimestamps.Inc()
+			default:
+				s.Timestamp = *m.TimestampMs
 			}
 
-			switch *f.Type {
+			switch f.GetType() {
 			case clientmodel.MetricType_COUNTER:
-				s.Value = *m.Counter.Value
+				s.Value = m.Counter.GetValue()
 			case clientmodel.MetricType_GAUGE:
-				s.Value = *m.Gauge.Value
+				s.Value = m.Gauge.GetValue()
 			case clientmodel.MetricType_UNTYPED:
-				s.Value = *m.Untyped.Value
-			default:
-				return nil, fmt.Errorf("metric type %s not supported", f.Type.String())
+				s.Value = m.Untyped.GetValue()
 			}
 
 			ts.Labels = append(ts.Labels, labelpairs...)
@@ -5,9 +5,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	clientmodel "github.com/prometheus/client_model/go"
 	"github.com/prometheus/prometheus/prompb"
 
+	"github.com/openshift/telemeter/pkg/metricfamily"
 	"github.com/openshift/telemeter/pkg/store"
 )
 
@@ -151,6 +153,47 @@ func Test_convertToTimeseries(t *testing.T) {
 			Labels:  []prompb.Label{{Name: nameLabelName, Value: barMetricName}, {Name: barLabelName, Value: barLabelValue1}},
 			Samples: []prompb.Sample{{Value: value42, Timestamp: nowTimestamp}},
 		}},
+	}, {
+		name: "series without the value of their type are skipped, and those without a timestamp stamped",
+		in: &store.PartitionedMetrics{
+			PartitionKey: "foo",
+			Families: []*clientmodel.MetricFamily{{
+				Name: &fooMetricName,
+				Help: &fooHelp,
+				Type: &counter,
+				Metric: []*clientmodel.Metric{{
+					Label:       []*clientmodel.LabelPair{{Name: &fooLabelName, Value: &fooLabelValue1}},
+					Gauge:       &clientmodel.Gauge{Value: &value42},
+					TimestampMs: &timestamp,
+				}, {
+					Label:       []*clientmodel.LabelPair{{Name: &fooLabelName, Value: &fooLabelValue2}},
+					Counter:     &clientmodel.Counter{},
+					TimestampMs: &timestamp,
+				}, {
+					Label:   []*clientmodel.LabelPair{{Name: &fooLabelName, Value: &fooLabelValue2}},
+					Counter: &clientmodel.Counter{Value: &value42},
+				}, nil, {
+					Label:       []*clientmodel.LabelPair{{Name: &fooLabelName, Value: &fooLabelValue2}},
+					Counter:     &clientmodel.Counter{Value: &value50},
+					TimestampMs: &timestamp,
+				}},
+			}, {
+				Name: &barMetricName,
+				Help: &barHelp,
+				Metric: []*clientmodel.Metric{{
+					Label:       []*clientmodel.LabelPair{{Name: &barLabelName, Value: &barLabelValue1}},
+					Untyped:     &clientmodel.Untyped{Value: &value42},
+					TimestampMs: &timestamp,
+				}},
+			}},
+		},
+		want: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: nameLabelName, Value: fooMetricName}, {Name: fooLabelName, Value: fooLabelValue2}},
+			Samples: []prompb.Sample{{Value: value42, Timestamp: nowTimestamp}},
+		}, {
+			Labels:  []prompb.Label{{Name: nameLabelName, Value: fooMetricName}, {Name: fooLabelName, Value: fooLabelValue2}},
+			Samples: []prompb.Sample{{Value: value50, Timestamp: nowTimestamp}},
+		}},
 	}}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -165,6 +208,107 @@ func Test_convertToTimeseries(t *testing.T) {
 	}
 }
 
+func Test_convertToTimeseriesRenamed(t *testing.T) {
+	gauge := clientmodel.MetricType_GAUGE
+	oldName, newName := "cluster_version_capability", "cluster:capability"
+	value := 1.0
+	now := time.Now()
+	timestamp := now.Add(-time.Minute).UnixNano() / int64(time.Millisecond)
+
+	renamer, err := metricfamily.NewRenamer(map[string]string{oldName: newName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := renamer.Rename([]*clientmodel.MetricFamily{{
+		Name:   &oldName,
+		Type:   &gauge,
+		Metric: []*clientmodel.Metric{{Gauge: &clientmodel.Gauge{Value: &value}, TimestampMs: &timestamp}},
+	}})
+	out, err := convertToTimeseries(&store.PartitionedMetrics{PartitionKey: "foo", Families: families}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: nameLabelName, Value: newName}},
+		Samples: []prompb.Sample{{Value: value, Timestamp: timestamp}},
+	}}
+	if ok, err := timeseriesEqual(want, out); !ok {
+		t.Errorf("timeseries don't match: %v", err)
+	}
+}
+
+func Test_convertToTimeseriesTimestamps(t *testing.T) {
+	gauge := clientmodel.MetricType_GAUGE
+	name := "foo_metric"
+	value := 42.0
+	now := time.Now()
+	nowTimestamp := now.UnixNano() / int64(time.Millisecond)
+	received := now.Add(-time.Minute)
+	past := received.Add(-time.Hour).Unix() * 1000
+	future := now.Add(time.Hour).Unix() * 1000
+
+	for _, tt := range []struct {
+		name        string
+		transformer metricfamily.Transformer
+		want        []int64
+		overwritten float64
+	}{
+		{
+			name: "client timestamps",
+			// past timestamps are kept, and future ones overwritten
+			want:        []int64{past, nowTimestamp},
+			overwritten: 1,
+		},
+		{
+			name:        "dropped timestamps",
+			transformer: metricfamily.DropTimestamps(),
+			want:        []int64{nowTimestamp, nowTimestamp},
+		},
+		{
+			name:        "overwritten timestamps",
+			transformer: metricfamily.OverwriteTimestamps(func() time.Time { return received }),
+			want:        []int64{received.Unix() * 1000, received.Unix() * 1000},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			family := &clientmodel.MetricFamily{Name: &name, Type: &gauge}
+			for _, ts := range []int64{past, future} {
+				ts := ts
+				family.Metric = append(family.Metric, &clientmodel.Metric{Gauge: &clientmodel.Gauge{Value: &value}, TimestampMs: &ts})
+			}
+			if tt.transformer != nil {
+				if _, err := tt.transformer.Transform(family); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before := counterValue(t, overwrittenTimestamps)
+			out, err := convertToTimeseries(&store.PartitionedMetrics{PartitionKey: "foo", Families: []*clientmodel.MetricFamily{family}}, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []int64
+			for _, ts := range out {
+				got = append(got, ts.Samples[0].Timestamp)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("want timestamps %v, got %v", tt.want, got)
+			}
+			// only the future timestamps reported by the client are overwritten
+			if got := counterValue(t, overwrittenTimestamps) - before; got != tt.overwritten {
+				t.Errorf("want %v timestamps overwritten, got %v", tt.overwritten, got)
+			}
+		})
+	}
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	m := &clientmodel.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
 func timeseriesEqual(t1 []prompb.TimeSeries, t2 []prompb.TimeSeries) (bool, error) {
 	if len(t1) != len(t2) {
 		return false, fmt.Errorf("timeseries don't match amount of series: %d != %d", len(t1), len(t2))
@@ -0,0 +1,149 @@
+package lastupload
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/telemeter/pkg/store"
+)
+
+var (
+	staleDesc = prometheus.NewDesc(
+		"telemeter_clusters_stale",
+		"The number of clusters that have not uploaded within the threshold.",
+		[]string{"threshold"}, nil,
+	)
+	lastUploadDesc = prometheus.NewDesc(
+		"telemeter_cluster_last_upload_timestamp_seconds",
+		"The time of the last successful upload of a watched cluster.",
+		[]string{"cluster"}, nil,
+	)
+)
+
+// Store records the time of the last successful write of every partition and exposes
+// how many partitions are stale as metrics. Only watched partitions get a series of
+// their own, keeping the cardinality of the metrics bounded by the configuration.
+type Store struct {
+	next       store.Store
+	ttl        time.Duration
+	retention  time.Duration
+	thresholds []time.Duration
+	watched    map[string]struct{}
+
+	mu    sync.Mutex
+	last  map[string]time.Time
+	nowFn func() time.Time
+	// swept is when expired partitions were last removed.
+	swept time.Time
+}
+
+// New returns a store tracking writes to next, whose metrics expire after ttl. Partitions
+// that have not been written within ttl past the longest threshold, so that their metrics
+// expired and they were counted as stale for every threshold, are forgotten. They are removed
+// while collecting, and as partitions are written, at most once per ttl.
+func New(ttl time.Duration, thresholds []time.Duration, watched []string, next store.Store) *Store {
+	sorted := append([]time.Duration(nil), thresholds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	w := make(map[string]struct{}, len(watched))
+	for _, id := range watched {
+		w[id] = struct{}{}
+	}
+	retention := ttl
+	if len(sorted) > 0 {
+		retention += sorted[len(sorted)-1]
+	}
+	return &Store{
+		next:       next,
+		ttl:        ttl,
+		retention:  retention,
+		thresholds: sorted,
+		watched:    w,
+		last:       make(map[string]time.Time),
+		nowFn:      time.Now,
+	}
+}
+
+func (s *Store) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*store.PartitionedMetrics, error) {
+	return s.next.ReadMetrics(ctx, minTimestampMs)
+}
+
+func (s *Store) ReadPartitions(ctx context.Context, minTimestampMs int64, partitionKeys ...string) ([]*store.PartitionedMetrics, error) {
+	return store.ReadPartitions(ctx, s.next, minTimestampMs, partitionKeys...)
+}
+
+func (s *Store) WriteMetrics(ctx context.Context, p *store.PartitionedMetrics) error {
+	if err := s.next.WriteMetrics(ctx, p); err != nil {
+		return err
+	}
+	if p == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.nowFn()
+	s.last[p.PartitionKey] = now
+	s.expire(now)
+	return nil
+}
+
+// expire removes the partitions not written within the retention unless it did so within the
+// ttl of the metrics. The caller must hold the lock.
+func (s *Store) expire(now time.Time) {
+	if s.ttl == 0 || now.Sub(s.swept) < s.ttl {
+		return
+	}
+	s.swept = now
+	for id, last := range s.last {
+		if now.Sub(last) > s.retention {
+			delete(s.last, id)
+		}
+	}
+}
+
+func (s *Store) DeleteMetrics(ctx context.Context, partitionKey string) error {
+	err := store.DeleteMetrics(ctx, s.next, partitionKey)
+	if err == nil || err == store.ErrDeletePending {
+		s.mu.Lock()
+		delete(s.last, partitionKey)
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Describe implements prometheus.Collector.
+func (s *Store) Describe(ch chan<- *prometheus.Desc) {
+	ch <- staleDesc
+	ch <- lastUploadDesc
+}
+
+// Collect implements prometheus.Collector. Expired partitions are removed while collecting.
+func (s *Store) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.nowFn()
+	stale := make([]int, len(s.thresholds))
+	for id, last := range s.last {
+		age := now.Sub(last)
+		if s.retention > 0 && age > s.retention {
+			delete(s.last, id)
+			continue
+		}
+		for i, threshold := range s.thresholds {
+			if age > threshold {
+				stale[i]++
+			}
+		}
+		if _, ok := s.watched[id]; ok {
+			ch <- prometheus.MustNewConstMetric(lastUploadDesc, prometheus.GaugeValue, float64(last.UnixNano())/1e9, id)
+		}
+	}
+	for i, threshold := range s.thresholds {
+		ch <- prometheus.MustNewConstMetric(staleDesc, prometheus.GaugeValue, float64(stale[i]), threshold.String())
+	}
+}
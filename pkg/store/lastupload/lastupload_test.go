@@ -0,0 +1,139 @@
+package lastupload
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/telemeter/pkg/store"
+	"github.com/openshift/telemeter/pkg/store/memstore"
+)
+
+// gather returns the value of every series collected from s, keyed by metric name and label value.
+func gather(t *testing.T, s *Store) map[string]float64 {
+	t.Helper()
+	r := prometheus.NewRegistry()
+	if err := r.Register(s); err != nil {
+		t.Fatal(err)
+	}
+	families, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.Metric {
+			got[f.GetName()+"/"+m.Label[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+	return got
+}
+
+func TestCollect(t *testing.T) {
+	now := time.Unix(100000, 0)
+	// partitions are forgotten 6h after their last write
+	s := New(5*time.Hour, []time.Duration{time.Hour, 10 * time.Minute}, []string{"watched"}, memstore.New(5*time.Hour))
+	s.nowFn = func() time.Time { return now }
+
+	for _, id := range []string{"a", "b", "watched"} {
+		if err := s.WriteMetrics(context.Background(), &store.PartitionedMetrics{PartitionKey: id}); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(30 * time.Minute)
+	}
+	// a was written 90m ago, b 60m ago and watched 30m ago
+
+	for _, tt := range []struct {
+		name    string
+		advance time.Duration
+		want    map[string]float64
+	}{
+		{
+			name: "initial",
+			want: map[string]float64{
+				"telemeter_clusters_stale/10m0s":                          3,
+				"telemeter_clusters_stale/1h0m0s":                         1,
+				"telemeter_cluster_last_upload_timestamp_seconds/watched": 103600,
+			},
+		},
+		{
+			name:    "after an hour",
+			advance: time.Hour,
+			want: map[string]float64{
+				"telemeter_clusters_stale/10m0s":                          3,
+				"telemeter_clusters_stale/1h0m0s":                         3,
+				"telemeter_cluster_last_upload_timestamp_seconds/watched": 103600,
+			},
+		},
+		{
+			name:    "a expired",
+			advance: 4 * time.Hour,
+			want: map[string]float64{
+				"telemeter_clusters_stale/10m0s":                          2,
+				"telemeter_clusters_stale/1h0m0s":                         2,
+				"telemeter_cluster_last_upload_timestamp_seconds/watched": 103600,
+			},
+		},
+		{
+			name:    "all expired",
+			advance: 2 * time.Hour,
+			want: map[string]float64{
+				"telemeter_clusters_stale/10m0s":  0,
+				"telemeter_clusters_stale/1h0m0s": 0,
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.advance)
+			if got := gather(t, s); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWriteMetricsRefreshes(t *testing.T) {
+	now := time.Unix(100000, 0)
+	s := New(time.Hour, []time.Duration{10 * time.Minute}, nil, memstore.New(time.Hour))
+	s.nowFn = func() time.Time { return now }
+
+	p := &store.PartitionedMetrics{PartitionKey: "a"}
+	if err := s.WriteMetrics(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(20 * time.Minute)
+	if got := gather(t, s)["telemeter_clusters_stale/10m0s"]; got != 1 {
+		t.Fatalf("want 1 stale cluster, got %v", got)
+	}
+	if err := s.WriteMetrics(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if got := gather(t, s)["telemeter_clusters_stale/10m0s"]; got != 0 {
+		t.Fatalf("want no stale clusters, got %v", got)
+	}
+}
+
+func TestWriteMetricsExpires(t *testing.T) {
+	now := time.Unix(100000, 0)
+	s := New(time.Hour, []time.Duration{10 * time.Minute}, nil, memstore.New(time.Hour))
+	s.nowFn = func() time.Time { return now }
+
+	for _, id := range []string{"a", "b"} {
+		if err := s.WriteMetrics(context.Background(), &store.PartitionedMetrics{PartitionKey: id}); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Hour)
+	}
+	// a was written 2h ago, past the ttl and the threshold, and is removed without collecting
+	if err := s.WriteMetrics(context.Background(), &store.PartitionedMetrics{PartitionKey: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.last["a"]; ok || len(s.last) != 2 {
+		t.Fatalf("want the expired partition to be removed on write, got %v", s.last)
+	}
+}
@@ -2,7 +2,10 @@ package memstore
 
 import (
 	"context"
+	"encoding/json"
+	"log"
 	"math"
+	"net/http"
 	"sync"
 	"time"
 
@@ -44,20 +47,24 @@ func init() {
 }
 
 type clusterMetricSlice struct {
-	newest   int64
-	families []*clientmodel.MetricFamily
+	newest    int64
+	lastWrite time.Time
+	bytes     int
+	families  []*clientmodel.MetricFamily
 }
 
 type memoryStore struct {
 	ttl   time.Duration
 	mu    sync.RWMutex
 	store map[string]*clusterMetricSlice
+	nowFn func() time.Time
 }
 
 func New(ttl time.Duration) *memoryStore {
 	return &memoryStore{
 		ttl:   ttl,
 		store: make(map[string]*clusterMetricSlice),
+		nowFn: time.Now,
 	}
 }
 
@@ -104,25 +111,56 @@ func (s *memoryStore) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]
 	result := make([]*store.PartitionedMetrics, 0, len(s.store))
 
 	for partitionKey, slice := range s.store {
-		if slice.newest < minTimestampMs {
-			continue
+		if p := slice.read(partitionKey, minTimestampMs); p != nil {
+			result = append(result, p)
 		}
+	}
 
-		families := make([]*clientmodel.MetricFamily, 0, len(slice.families))
+	return result, nil
+}
 
-		for i := range slice.families {
-			families = append(families, proto.Clone(slice.families[i]).(*clientmodel.MetricFamily))
-		}
+// ReadPartitions implements store.PartitionReader, looking up only the requested partitions.
+func (s *memoryStore) ReadPartitions(ctx context.Context, minTimestampMs int64, partitionKeys ...string) ([]*store.PartitionedMetrics, error) {
+	if len(partitionKeys) == 0 {
+		return s.ReadMetrics(ctx, minTimestampMs)
+	}
 
-		result = append(result, &store.PartitionedMetrics{
-			PartitionKey: partitionKey,
-			Families:     families,
-		})
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]*store.PartitionedMetrics, 0, len(partitionKeys))
+
+	for _, partitionKey := range partitionKeys {
+		slice, ok := s.store[partitionKey]
+		if !ok {
+			continue
+		}
+		if p := slice.read(partitionKey, minTimestampMs); p != nil {
+			result = append(result, p)
+		}
 	}
 
 	return result, nil
 }
 
+// read returns a copy of the families in the slice, or nil if the newest sample is older than minTimestampMs.
+func (slice *clusterMetricSlice) read(partitionKey string, minTimestampMs int64) *store.PartitionedMetrics {
+	if slice.newest < minTimestampMs {
+		return nil
+	}
+
+	families := make([]*clientmodel.MetricFamily, 0, len(slice.families))
+
+	for i := range slice.families {
+		families = append(families, proto.Clone(slice.families[i]).(*clientmodel.MetricFamily))
+	}
+
+	return &store.PartitionedMetrics{
+		PartitionKey: partitionKey,
+		Families:     families,
+	}
+}
+
 func (s *memoryStore) WriteMetrics(ctx context.Context, p *store.PartitionedMetrics) error {
 	if p == nil || len(p.Families) == 0 {
 		return nil
@@ -149,6 +187,8 @@ func (s *memoryStore) WriteMetrics(ctx context.Context, p *store.PartitionedMetr
 	}
 
 	m.families = p.Families
+	m.lastWrite = s.nowFn()
+	m.bytes = approximateSize(p.Families)
 
 	partitions.Set(float64(len(s.store)))
 	families.WithLabelValues(p.PartitionKey).Set(float64(len(p.Families)))
@@ -156,3 +196,110 @@ func (s *memoryStore) WriteMetrics(ctx context.Context, p *store.PartitionedMetr
 
 	return nil
 }
+
+// DeleteMetrics implements store.Deleter, removing all data of the partition.
+func (s *memoryStore) DeleteMetrics(ctx context.Context, partitionKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.store[partitionKey]; !ok {
+		return store.ErrPartitionNotFound
+	}
+	delete(s.store, partitionKey)
+	families.DeleteLabelValues(partitionKey)
+	partitions.Set(float64(len(s.store)))
+	return nil
+}
+
+// Stats describes the contents of the store.
+type Stats struct {
+	Partitions int `json:"partitions"`
+	Families   int `json:"families"`
+	Metrics    int `json:"metrics"`
+	// OldestMs and NewestMs are the bounds of the newest sample timestamps across partitions.
+	OldestMs int64 `json:"oldest_ms"`
+	NewestMs int64 `json:"newest_ms"`
+}
+
+// Stats returns a snapshot of the number of partitions, families and metrics held in memory.
+func (s *memoryStore) Stats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := Stats{Partitions: len(s.store)}
+	first := true
+	for _, slice := range s.store {
+		stats.Families += len(slice.families)
+		stats.Metrics += metricfamily.MetricsCount(slice.families)
+		if first || slice.newest < stats.OldestMs {
+			stats.OldestMs = slice.newest
+		}
+		if first || slice.newest > stats.NewestMs {
+			stats.NewestMs = slice.newest
+		}
+		first = false
+	}
+	return stats
+}
+
+// approximateSize estimates the memory used by families from their names, labels and values.
+// proto.Size is avoided as it caches the size in the messages, which are shared with the caller.
+func approximateSize(families []*clientmodel.MetricFamily) int {
+	size := 0
+	for _, f := range families {
+		size += len(f.GetName()) + len(f.GetHelp())
+		for _, m := range f.Metric {
+			if m == nil {
+				continue
+			}
+			// the timestamp and a single value
+			size += 16
+			for _, l := range m.Label {
+				size += len(l.GetName()) + len(l.GetValue())
+			}
+			if h := m.GetHistogram(); h != nil {
+				size += 16 * len(h.Bucket)
+			}
+			if sm := m.GetSummary(); sm != nil {
+				size += 16 * len(sm.Quantile)
+			}
+		}
+	}
+	return size
+}
+
+// Partitions implements store.PartitionLister, describing every stored partition.
+func (s *memoryStore) Partitions() []store.PartitionStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]store.PartitionStats, 0, len(s.store))
+	for partitionKey, slice := range s.store {
+		result = append(result, store.PartitionStats{
+			PartitionKey: partitionKey,
+			LastWrite:    slice.lastWrite,
+			Families:     len(slice.families),
+			Series:       metricfamily.MetricsCount(slice.families),
+			Bytes:        slice.bytes,
+		})
+	}
+	return result
+}
+
+// ServeHTTP exposes the store Stats as JSON.
+func (s *memoryStore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := json.MarshalIndent(s.Stats(), "", "  ")
+	if err != nil {
+		log.Printf("marshaling store stats failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		log.Printf("writing store stats failed: %v", err)
+	}
+}
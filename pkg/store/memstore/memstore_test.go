@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"sort"
 	"strconv"
 	"testing"
 	"time"
@@ -254,6 +255,69 @@ func TestReadWriteMetrics(t *testing.T) {
 	}
 }
 
+func TestStats(t *testing.T) {
+	s := New(time.Minute)
+	if got, want := s.Stats(), (Stats{}); got != want {
+		t.Fatalf("want stats %+v, got %+v", want, got)
+	}
+
+	start := time.Unix(1000, 0)
+	for i, key := range []string{"foo", "bar"} {
+		p := partitionedMetrics{
+			partitionKey: key,
+			start:        start.Add(time.Duration(i) * time.Minute),
+			span:         time.Minute,
+			families:     2 + i,
+			values:       3,
+		}.build()
+		if err := s.WriteMetrics(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := Stats{Partitions: 2, Families: 5, Metrics: 15, OldestMs: 1060000, NewestMs: 1120000}
+	if got := s.Stats(); got != want {
+		t.Fatalf("want stats %+v, got %+v", want, got)
+	}
+}
+
+func TestPartitions(t *testing.T) {
+	s := New(time.Hour)
+	start := time.Unix(1000, 0)
+	for i, key := range []string{"foo", "bar"} {
+		now := start.Add(time.Duration(i) * time.Minute)
+		s.nowFn = func() time.Time { return now }
+		p := partitionedMetrics{
+			partitionKey: key,
+			start:        start,
+			span:         time.Minute,
+			families:     1 + i,
+			values:       2,
+		}.build()
+		if err := s.WriteMetrics(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := s.Partitions()
+	sort.Slice(got, func(i, j int) bool { return got[i].PartitionKey < got[j].PartitionKey })
+	if len(got) != 2 {
+		t.Fatalf("want 2 partitions, got %d", len(got))
+	}
+	for i, want := range []store.PartitionStats{
+		{PartitionKey: "bar", LastWrite: start.Add(time.Minute), Families: 2, Series: 4},
+		{PartitionKey: "foo", LastWrite: start, Families: 1, Series: 2},
+	} {
+		if got[i].Bytes == 0 {
+			t.Errorf("want %s to have a size", want.PartitionKey)
+		}
+		got[i].Bytes = 0
+		if got[i] != want {
+			t.Errorf("want partition %+v, got %+v", want, got[i])
+		}
+	}
+}
+
 type partitionedMetrics struct {
 	partitionKey     string
 	start            time.Time
@@ -0,0 +1,197 @@
+package quota
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/store"
+)
+
+// ErrQuotaExceeded is returned when a write would exceed the sample quota of a client.
+type ErrQuotaExceeded struct {
+	Client string    `json:"-"`
+	Quota  int64     `json:"quota"`
+	Used   int64     `json:"used"`
+	Reset  time.Time `json:"reset"`
+}
+
+func (e *ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("sample quota of %d reached for client %q, resets at %s", e.Quota, e.Client, e.Reset.Format(time.RFC3339))
+}
+
+type usage struct {
+	id    string
+	start time.Time
+	used  int64
+	elem  *list.Element
+}
+
+// Usage describes the samples consumed by a client in the current window.
+type Usage struct {
+	Client string    `json:"client"`
+	Used   int64     `json:"used"`
+	Reset  time.Time `json:"reset"`
+}
+
+// Store limits the number of samples each client may write within a window.
+type Store struct {
+	quota      int64
+	window     time.Duration
+	maxClients int
+	next       store.Store
+	nowFn      func() time.Time
+
+	mu    sync.Mutex // protects fields below
+	usage map[string]*usage
+	// order holds the usage of clients by the start of their window, oldest first
+	order *list.List
+}
+
+// New returns a store that wraps next and limits the number of samples each client
+// may write within a fixed window starting at its first write.
+// At most maxClients are tracked; when full, the client whose window started first is forgotten.
+// Clients are identified by the authorized client in the write context,
+// falling back to the partition key.
+func New(quota int64, window time.Duration, maxClients int, next store.Store) *Store {
+	return &Store{
+		quota:      quota,
+		window:     window,
+		maxClients: maxClients,
+		next:       next,
+		nowFn:      time.Now,
+		usage:      make(map[string]*usage),
+		order:      list.New(),
+	}
+}
+
+func (s *Store) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*store.PartitionedMetrics, error) {
+	return s.next.ReadMetrics(ctx, minTimestampMs)
+}
+
+func (s *Store) ReadPartitions(ctx context.Context, minTimestampMs int64, partitionKeys ...string) ([]*store.PartitionedMetrics, error) {
+	return store.ReadPartitions(ctx, s.next, minTimestampMs, partitionKeys...)
+}
+
+func (s *Store) DeleteMetrics(ctx context.Context, partitionKey string) error {
+	return store.DeleteMetrics(ctx, s.next, partitionKey)
+}
+
+func (s *Store) WriteMetrics(ctx context.Context, p *store.PartitionedMetrics) error {
+	if p == nil {
+		return nil
+	}
+
+	id := p.PartitionKey
+	if client, ok := authorize.FromContext(ctx); ok && len(client.ID) > 0 {
+		id = client.ID
+	}
+
+	n := int64(metricfamily.MetricsCount(p.Families))
+	if err := s.reserve(id, n, s.nowFn()); err != nil {
+		return err
+	}
+
+	if err := s.next.WriteMetrics(ctx, p); err != nil {
+		s.release(id, n)
+		return err
+	}
+	return nil
+}
+
+// reserve accounts n samples to the given client unless doing so would exceed the quota.
+func (s *Store) reserve(id string, n int64, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.usage[id]
+	if ok && !now.Before(u.start.Add(s.window)) {
+		// the window restarts as the newest
+		u.start, u.used = now, 0
+		s.order.MoveToBack(u.elem)
+	}
+	if !ok {
+		if s.maxClients > 0 && len(s.usage) >= s.maxClients {
+			s.evict()
+		}
+		u = &usage{id: id, start: now}
+		u.elem = s.order.PushBack(u)
+		s.usage[id] = u
+	}
+
+	if u.used+n > s.quota {
+		return &ErrQuotaExceeded{
+			Client: id,
+			Quota:  s.quota,
+			Used:   u.used,
+			Reset:  u.start.Add(s.window),
+		}
+	}
+	u.used += n
+	return nil
+}
+
+func (s *Store) release(id string, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.usage[id]; ok {
+		u.used -= n
+		if u.used < 0 {
+			u.used = 0
+		}
+	}
+}
+
+// evict forgets the client with the oldest window. It must be called with the lock held.
+func (s *Store) evict() {
+	if oldest := s.order.Front(); oldest != nil {
+		delete(s.usage, s.order.Remove(oldest).(*usage).id)
+	}
+}
+
+// Quota returns the number of samples each client may write within a window.
+func (s *Store) Quota() int64 {
+	return s.quota
+}
+
+// Reset forgets the usage of the given client.
+func (s *Store) Reset(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.usage[id]; ok {
+		s.order.Remove(u.elem)
+		delete(s.usage, id)
+	}
+}
+
+// Top returns up to n clients with the highest usage in their current window.
+func (s *Store) Top(n int) []Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.nowFn()
+	result := make([]Usage, 0, len(s.usage))
+	for id, u := range s.usage {
+		reset := u.start.Add(s.window)
+		if !now.Before(reset) {
+			continue
+		}
+		result = append(result, Usage{Client: id, Used: u.used, Reset: reset})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Used == result[j].Used {
+			return result[i].Client < result[j].Client
+		}
+		return result[i].Used > result[j].Used
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
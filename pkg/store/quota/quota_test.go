@@ -0,0 +1,114 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/store"
+)
+
+type testStore struct {
+	err    error
+	writes int
+}
+
+func (s *testStore) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*store.PartitionedMetrics, error) {
+	return nil, nil
+}
+
+func (s *testStore) WriteMetrics(context.Context, *store.PartitionedMetrics) error {
+	s.writes++
+	return s.err
+}
+
+func samples(partitionKey string, n int) *store.PartitionedMetrics {
+	family := &clientmodel.MetricFamily{}
+	for i := 0; i < n; i++ {
+		family.Metric = append(family.Metric, &clientmodel.Metric{})
+	}
+	return &store.PartitionedMetrics{PartitionKey: partitionKey, Families: []*clientmodel.MetricFamily{family}}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	now := time.Time{}.Add(time.Hour)
+	next := &testStore{}
+	s := New(10, 24*time.Hour, 10, next)
+	s.nowFn = func() time.Time { return now }
+	ctx := authorize.WithClient(context.Background(), &authorize.Client{ID: "a"})
+
+	for _, tc := range []struct {
+		name      string
+		advance   time.Duration
+		samples   int
+		wantUsed  int64
+		wantQuota bool
+	}{
+		{name: "first write succeeds", samples: 6, wantUsed: 6},
+		{name: "write up to the quota succeeds", advance: time.Hour, samples: 4, wantUsed: 10},
+		{name: "write over the quota fails", advance: time.Hour, samples: 1, wantUsed: 10, wantQuota: true},
+		{name: "write after the window succeeds", advance: 22 * time.Hour, samples: 3, wantUsed: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now = now.Add(tc.advance)
+			err := s.WriteMetrics(ctx, samples("cluster", tc.samples))
+			qerr, ok := err.(*ErrQuotaExceeded)
+			if ok != tc.wantQuota {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if ok && (qerr.Quota != 10 || qerr.Used != 10 || !qerr.Reset.Equal(time.Time{}.Add(25*time.Hour))) {
+				t.Fatalf("unexpected quota error %#v", qerr)
+			}
+			if top := s.Top(1); len(top) != 1 || top[0].Client != "a" || top[0].Used != tc.wantUsed {
+				t.Fatalf("unexpected usage %#v", top)
+			}
+		})
+	}
+}
+
+func TestWriteMetricsFailureReleasesQuota(t *testing.T) {
+	next := &testStore{err: errors.New("failed")}
+	s := New(10, time.Hour, 10, next)
+
+	if err := s.WriteMetrics(context.Background(), samples("cluster", 5)); err != next.err {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if top := s.Top(1); len(top) != 1 || top[0].Client != "cluster" || top[0].Used != 0 {
+		t.Fatalf("unexpected usage %#v", top)
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	now := time.Time{}
+	s := New(10, time.Hour, 2, &testStore{})
+	s.nowFn = func() time.Time { return now }
+
+	for _, key := range []string{"a", "b", "c"} {
+		now = now.Add(time.Minute)
+		if err := s.WriteMetrics(context.Background(), samples(key, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	top := s.Top(10)
+	if len(top) != 2 || top[0].Client != "b" || top[1].Client != "c" {
+		t.Fatalf("expected the oldest client to be evicted, got %#v", top)
+	}
+
+	// a restarted window is the newest
+	s = New(10, 2*time.Minute, 2, &testStore{})
+	s.nowFn = func() time.Time { return now }
+	for _, key := range []string{"a", "b", "a", "c"} {
+		now = now.Add(time.Minute)
+		if err := s.WriteMetrics(context.Background(), samples(key, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	top = s.Top(10)
+	if len(top) != 2 || top[0].Client != "a" || top[1].Client != "c" {
+		t.Fatalf("expected the client with the oldest window to be evicted, got %#v", top)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/cache"
 	"github.com/openshift/telemeter/pkg/store"
 	"golang.org/x/time/rate"
 )
@@ -16,16 +18,40 @@ func (e ErrWriteLimitReached) Error() string {
 	return fmt.Sprintf("write limit reached for key %q", string(e))
 }
 
+type intervalKeyType int
+
+const intervalKey intervalKeyType = iota
+
+// WithInterval returns a context whose writes are limited to the given interval instead of the
+// interval of the store, for instance to apply the limits of a client to forwarded writes.
+func WithInterval(ctx context.Context, interval time.Duration) context.Context {
+	return context.WithValue(ctx, intervalKey, interval)
+}
+
+// Interval returns the interval writes with the context are limited to, set by WithInterval or
+// by the limits of the client in the context, or zero if the interval of the store applies.
+func Interval(ctx context.Context) time.Duration {
+	if interval, ok := ctx.Value(intervalKey).(time.Duration); ok {
+		return interval
+	}
+	if client, ok := authorize.FromContext(ctx); ok {
+		return client.Limits.UploadInterval
+	}
+	return 0
+}
+
 type lstore struct {
 	limit time.Duration
 	next  store.Store
+	cache cache.Cache
 
 	mu    sync.RWMutex // protects fields below
 	store map[string]*rate.Limiter
 }
 
 // New returns a store that wraps next and limits writes to it.
-// Writes can happen at most at intervals specified by limit per partition key.
+// Writes can happen at most at intervals specified by limit per partition key,
+// or by the Interval of the context of the write if it has one.
 func New(limit time.Duration, next store.Store) *lstore {
 	return &lstore{
 		limit: limit,
@@ -34,10 +60,30 @@ func New(limit time.Duration, next store.Store) *lstore {
 	}
 }
 
+// NewShared returns a store like New whose writes are counted in c, so that stores sharing c
+// limit writes together. As with New, a partition may write once per interval measured from
+// its last accepted write: the first write creates a counter that expires after the interval,
+// and every write while it exists is rejected. Rejected writes do not extend the interval, and
+// a changed interval applies once the counter expired. If c fails, writes are limited by this
+// store alone, which does not know of the writes accepted by other stores.
+func NewShared(limit time.Duration, c cache.Cache, next store.Store) *lstore {
+	s := New(limit, next)
+	s.cache = c
+	return s
+}
+
 func (s *lstore) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*store.PartitionedMetrics, error) {
 	return s.next.ReadMetrics(ctx, minTimestampMs)
 }
 
+func (s *lstore) ReadPartitions(ctx context.Context, minTimestampMs int64, partitionKeys ...string) ([]*store.PartitionedMetrics, error) {
+	return store.ReadPartitions(ctx, s.next, minTimestampMs, partitionKeys...)
+}
+
+func (s *lstore) DeleteMetrics(ctx context.Context, partitionKey string) error {
+	return store.DeleteMetrics(ctx, s.next, partitionKey)
+}
+
 func (s *lstore) WriteMetrics(ctx context.Context, p *store.PartitionedMetrics) error {
 	return s.writeMetrics(ctx, p, time.Now())
 }
@@ -47,21 +93,38 @@ func (s *lstore) writeMetrics(ctx context.Context, p *store.PartitionedMetrics,
 		return nil
 	}
 
-	if limiter := s.limiter(p.PartitionKey); !limiter.AllowN(now, 1) {
+	limit := s.limit
+	if interval := Interval(ctx); interval > 0 {
+		limit = interval
+	}
+	if s.cache != nil {
+		// the first write creates the counter, all others are rejected until it expires
+		n, err := s.cache.Incr("ratelimit/"+p.PartitionKey, limit)
+		if err == nil {
+			if n > 1 {
+				return ErrWriteLimitReached(p.PartitionKey)
+			}
+			return s.next.WriteMetrics(ctx, p)
+		}
+	}
+	if limiter := s.limiter(p.PartitionKey, limit, now); !limiter.AllowN(now, 1) {
 		return ErrWriteLimitReached(p.PartitionKey)
 	}
 
 	return s.next.WriteMetrics(ctx, p)
 }
 
-func (s *lstore) limiter(partitionKey string) *rate.Limiter {
+// limiter returns the limiter of the partition, adjusted to allow a write every limit.
+func (s *lstore) limiter(partitionKey string, limit time.Duration, now time.Time) *rate.Limiter {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	limiter, ok := s.store[partitionKey]
 	if !ok {
-		limiter = rate.NewLimiter(rate.Every(s.limit), 1)
+		limiter = rate.NewLimiter(rate.Every(limit), 1)
 		s.store[partitionKey] = limiter
+	} else if limiter.Limit() != rate.Every(limit) {
+		limiter.SetLimitAt(now, rate.Every(limit))
 	}
 
 	return limiter
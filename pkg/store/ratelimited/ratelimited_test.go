@@ -2,9 +2,12 @@ package ratelimited
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/cache"
 	"github.com/openshift/telemeter/pkg/store"
 )
 
@@ -89,3 +92,86 @@ func TestWriteMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteMetricsClientLimits(t *testing.T) {
+	var (
+		s    = New(time.Minute, &testStore{})
+		now  = time.Time{}.Add(time.Hour)
+		fast = authorize.WithClient(context.Background(), &authorize.Client{ID: "a", Limits: authorize.Limits{UploadInterval: 10 * time.Second}})
+		slow = authorize.WithClient(context.Background(), &authorize.Client{ID: "b", Limits: authorize.Limits{UploadInterval: 5 * time.Minute}})
+		none = authorize.WithClient(context.Background(), &authorize.Client{ID: "c"})
+	)
+
+	for _, tc := range []struct {
+		name        string
+		advance     time.Duration
+		ctx         context.Context
+		metrics     *store.PartitionedMetrics
+		expectedErr error
+	}{
+		{name: "first write of a fast client succeeds", ctx: fast, metrics: &store.PartitionedMetrics{PartitionKey: "a"}},
+		{name: "first write of a slow client succeeds", ctx: slow, metrics: &store.PartitionedMetrics{PartitionKey: "b"}},
+		{name: "first write of a client without limits succeeds", ctx: none, metrics: &store.PartitionedMetrics{PartitionKey: "c"}},
+		{name: "fast client may write after its interval", advance: 10 * time.Second, ctx: fast, metrics: &store.PartitionedMetrics{PartitionKey: "a"}},
+		{name: "client without limits uses the global interval", ctx: none, metrics: &store.PartitionedMetrics{PartitionKey: "c"}, expectedErr: ErrWriteLimitReached("c")},
+		{name: "slow client may not write after the global interval", advance: 50 * time.Second, ctx: slow, metrics: &store.PartitionedMetrics{PartitionKey: "b"}, expectedErr: ErrWriteLimitReached("b")},
+		{name: "client without limits may write after the global interval", ctx: none, metrics: &store.PartitionedMetrics{PartitionKey: "c"}},
+		{name: "slow client may write after its interval", advance: 4 * time.Minute, ctx: slow, metrics: &store.PartitionedMetrics{PartitionKey: "b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now = now.Add(tc.advance)
+
+			if got := s.writeMetrics(tc.ctx, tc.metrics, now); got != tc.expectedErr {
+				t.Errorf("expected err %v, got %v", tc.expectedErr, got)
+			}
+		})
+	}
+}
+
+type failingCache struct{}
+
+func (failingCache) Get(string) ([]byte, bool, error)           { return nil, false, errors.New("down") }
+func (failingCache) Set(string, []byte, time.Duration) error    { return errors.New("down") }
+func (failingCache) Incr(string, time.Duration) (int64, error)  { return 0, errors.New("down") }
+func (failingCache) Append(string, []byte, time.Duration) error { return errors.New("down") }
+
+func TestWriteMetricsShared(t *testing.T) {
+	shared, err := cache.NewMemory(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		// two servers sharing a cache
+		a   = NewShared(time.Minute, shared, &testStore{})
+		b   = NewShared(time.Minute, shared, &testStore{})
+		ctx = context.Background()
+		now = time.Time{}.Add(time.Hour)
+	)
+
+	for _, tc := range []struct {
+		name        string
+		s           *lstore
+		metrics     *store.PartitionedMetrics
+		expectedErr error
+	}{
+		{name: "first write succeeds", s: a, metrics: &store.PartitionedMetrics{PartitionKey: "a"}},
+		{name: "write to the other server fails", s: b, metrics: &store.PartitionedMetrics{PartitionKey: "a"}, expectedErr: ErrWriteLimitReached("a")},
+		{name: "write to the same server fails", s: a, metrics: &store.PartitionedMetrics{PartitionKey: "a"}, expectedErr: ErrWriteLimitReached("a")},
+		{name: "write of another partition to the other server succeeds", s: b, metrics: &store.PartitionedMetrics{PartitionKey: "b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.s.writeMetrics(ctx, tc.metrics, now); got != tc.expectedErr {
+				t.Errorf("expected err %v, got %v", tc.expectedErr, got)
+			}
+		})
+	}
+
+	// a failing cache falls back to the limits of the server
+	s := NewShared(time.Minute, failingCache{}, &testStore{})
+	if err := s.writeMetrics(ctx, &store.PartitionedMetrics{PartitionKey: "a"}, now); err != nil {
+		t.Fatalf("expected write to succeed, got %v", err)
+	}
+	if err := s.writeMetrics(ctx, &store.PartitionedMetrics{PartitionKey: "a"}, now); err != ErrWriteLimitReached("a") {
+		t.Fatalf("expected write limit, got %v", err)
+	}
+}
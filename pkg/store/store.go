@@ -2,6 +2,8 @@ package store
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	clientmodel "github.com/prometheus/client_model/go"
 )
@@ -15,3 +17,76 @@ type Store interface {
 	ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*PartitionedMetrics, error)
 	WriteMetrics(context.Context, *PartitionedMetrics) error
 }
+
+// PartitionReader is implemented by stores that can read a subset of partitions
+// without loading all of them.
+type PartitionReader interface {
+	ReadPartitions(ctx context.Context, minTimestampMs int64, partitionKeys ...string) ([]*PartitionedMetrics, error)
+}
+
+// ReadPartitions reads the given partitions from s, or all partitions if none are given.
+// The read is delegated to s if it implements PartitionReader, otherwise all partitions
+// are read and filtered.
+func ReadPartitions(ctx context.Context, s Store, minTimestampMs int64, partitionKeys ...string) ([]*PartitionedMetrics, error) {
+	if len(partitionKeys) == 0 {
+		return s.ReadMetrics(ctx, minTimestampMs)
+	}
+	if r, ok := s.(PartitionReader); ok {
+		return r.ReadPartitions(ctx, minTimestampMs, partitionKeys...)
+	}
+
+	ps, err := s.ReadMetrics(ctx, minTimestampMs)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]struct{}, len(partitionKeys))
+	for _, k := range partitionKeys {
+		keys[k] = struct{}{}
+	}
+	filtered := ps[:0]
+	for _, p := range ps {
+		if _, ok := keys[p.PartitionKey]; ok {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered, nil
+}
+
+// PartitionStats describes the data held for a partition.
+type PartitionStats struct {
+	PartitionKey string    `json:"partition"`
+	LastWrite    time.Time `json:"last_write"`
+	Families     int       `json:"families"`
+	Series       int       `json:"series"`
+	// Bytes is the approximate size of the stored families.
+	Bytes int `json:"bytes"`
+}
+
+// PartitionLister is implemented by stores that can describe the partitions they hold.
+type PartitionLister interface {
+	Partitions() []PartitionStats
+}
+
+// ErrPartitionNotFound is returned when deleting a partition that is not stored.
+var ErrPartitionNotFound = fmt.Errorf("partition not found")
+
+// ErrDeletePending is returned when a partition was deleted locally but copies held
+// elsewhere, such as by a remote write endpoint, can only be removed asynchronously.
+var ErrDeletePending = fmt.Errorf("partition deleted locally, remote copies are removed asynchronously")
+
+// ErrDeleteUnsupported is returned when a store in the chain cannot delete partitions.
+var ErrDeleteUnsupported = fmt.Errorf("store does not support deleting partitions")
+
+// Deleter is implemented by stores that can remove all data of a partition.
+type Deleter interface {
+	DeleteMetrics(ctx context.Context, partitionKey string) error
+}
+
+// DeleteMetrics deletes a partition from s if it implements Deleter.
+func DeleteMetrics(ctx context.Context, s Store, partitionKey string) error {
+	d, ok := s.(Deleter)
+	if !ok {
+		return ErrDeleteUnsupported
+	}
+	return d.DeleteMetrics(ctx, partitionKey)
+}
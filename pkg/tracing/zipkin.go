@@ -0,0 +1,378 @@
+// Package tracing implements an opentracing.Tracer exporting its spans to a collector
+// accepting the Zipkin v2 JSON format, such as Zipkin, Jaeger or the OpenTelemetry
+// collector. The trace context is propagated in B3 headers.
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+)
+
+// maxQueuedSpans bounds the finished spans waiting to be exported, further spans are dropped.
+const maxQueuedSpans = 10000
+
+const (
+	traceIDHeader  = "X-B3-TraceId"
+	spanIDHeader   = "X-B3-SpanId"
+	parentIDHeader = "X-B3-ParentSpanId"
+	sampledHeader  = "X-B3-Sampled"
+)
+
+// Zipkin is a tracer exporting the spans of sampled traces to a Zipkin v2 endpoint. Spans are
+// queued when finished and exported in batches by Run or Flush.
+type Zipkin struct {
+	serviceName string
+	endpoint    *url.URL
+	client      *http.Client
+	sampleRatio float64
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	queue   []zipkinSpan
+	dropped int
+}
+
+// NewZipkin returns a tracer exporting spans to endpoint, such as
+// http://zipkin:9411/api/v2/spans, as serviceName. A sampleRatio of the traces started by the
+// tracer are exported, traces propagated from a caller keep the sampling decision of the caller.
+func NewZipkin(serviceName string, endpoint *url.URL, client *http.Client, sampleRatio float64) *Zipkin {
+	return &Zipkin{
+		serviceName: serviceName,
+		endpoint:    endpoint,
+		client:      client,
+		sampleRatio: sampleRatio,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Run exports the queued spans every interval until stop is closed. Spans finished after the
+// last export are only exported by a call to Flush.
+func (t *Zipkin) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.Flush(); err != nil {
+				log.Printf("error exporting spans: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Flush exports the queued spans. Spans that failed to be exported are dropped.
+func (t *Zipkin) Flush() error {
+	t.mu.Lock()
+	spans, dropped := t.queue, t.dropped
+	t.queue, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		log.Printf("dropped %d spans exceeding the export queue", dropped)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(spans)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.endpoint.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to export %d spans: %v", len(spans), err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unable to export %d spans: %s", len(spans), resp.Status)
+	}
+	return nil
+}
+
+func (t *Zipkin) nextID() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		if id := t.rand.Uint64(); id != 0 {
+			return id
+		}
+	}
+}
+
+func (t *Zipkin) sample() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rand.Float64() < t.sampleRatio
+}
+
+func (t *Zipkin) enqueue(s zipkinSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) >= maxQueuedSpans {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, s)
+}
+
+// StartSpan implements opentracing.Tracer. A span referencing a span of this tracer joins
+// its trace, any other span starts a new trace.
+func (t *Zipkin) StartSpan(operation string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	var o opentracing.StartSpanOptions
+	for _, opt := range opts {
+		opt.Apply(&o)
+	}
+	s := &span{
+		tracer:    t,
+		operation: operation,
+		start:     o.StartTime,
+		tags:      make(map[string]string),
+	}
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+	for _, ref := range o.References {
+		if parent, ok := ref.ReferencedContext.(spanContext); ok {
+			s.ctx.traceID, s.ctx.sampled = parent.traceID, parent.sampled
+			s.parentID = parent.spanID
+			break
+		}
+	}
+	if s.ctx.traceID == 0 {
+		s.ctx.traceID, s.ctx.sampled = t.nextID(), t.sample()
+	}
+	s.ctx.spanID = t.nextID()
+	for k, v := range o.Tags {
+		s.SetTag(k, v)
+	}
+	return s
+}
+
+// Inject implements opentracing.Tracer, writing the B3 headers of the span to HTTP headers
+// or a text map.
+func (t *Zipkin) Inject(sc opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	ctx, ok := sc.(spanContext)
+	if !ok {
+		return opentracing.ErrInvalidSpanContext
+	}
+	if format != opentracing.HTTPHeaders && format != opentracing.TextMap {
+		return opentracing.ErrUnsupportedFormat
+	}
+	w, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+	w.Set(traceIDHeader, formatID(ctx.traceID))
+	w.Set(spanIDHeader, formatID(ctx.spanID))
+	if ctx.sampled {
+		w.Set(sampledHeader, "1")
+	} else {
+		w.Set(sampledHeader, "0")
+	}
+	return nil
+}
+
+// Extract implements opentracing.Tracer, reading B3 headers from HTTP headers or a text map.
+// Only the lower 64 bits of a 128 bit trace ID are kept.
+func (t *Zipkin) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	if format != opentracing.HTTPHeaders && format != opentracing.TextMap {
+		return nil, opentracing.ErrUnsupportedFormat
+	}
+	r, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return nil, opentracing.ErrInvalidCarrier
+	}
+	var traceID, spanID, sampled string
+	if err := r.ForeachKey(func(k, v string) error {
+		switch strings.ToLower(k) {
+		case strings.ToLower(traceIDHeader):
+			traceID = v
+		case strings.ToLower(spanIDHeader):
+			spanID = v
+		case strings.ToLower(sampledHeader):
+			sampled = v
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(traceID) == 0 && len(spanID) == 0 {
+		return nil, opentracing.ErrSpanContextNotFound
+	}
+	if len(traceID) > 16 {
+		traceID = traceID[len(traceID)-16:]
+	}
+	ctx := spanContext{sampled: sampled == "1" || sampled == "true"}
+	var err error
+	if ctx.traceID, err = strconv.ParseUint(traceID, 16, 64); err != nil || ctx.traceID == 0 {
+		return nil, opentracing.ErrSpanContextCorrupted
+	}
+	if ctx.spanID, err = strconv.ParseUint(spanID, 16, 64); err != nil || ctx.spanID == 0 {
+		return nil, opentracing.ErrSpanContextCorrupted
+	}
+	return ctx, nil
+}
+
+func formatID(id uint64) string {
+	return fmt.Sprintf("%016x", id)
+}
+
+type spanContext struct {
+	traceID uint64
+	spanID  uint64
+	sampled bool
+}
+
+// ForeachBaggageItem implements opentracing.SpanContext. Baggage is not supported.
+func (spanContext) ForeachBaggageItem(func(k, v string) bool) {}
+
+type span struct {
+	tracer   *Zipkin
+	ctx      spanContext
+	parentID uint64
+	start    time.Time
+
+	mu          sync.Mutex
+	operation   string
+	tags        map[string]string
+	annotations []zipkinAnnotation
+	finished    bool
+}
+
+func (s *span) Finish() {
+	s.FinishWithOptions(opentracing.FinishOptions{})
+}
+
+func (s *span) FinishWithOptions(opts opentracing.FinishOptions) {
+	finish := opts.FinishTime
+	if finish.IsZero() {
+		finish = time.Now()
+	}
+	for _, record := range opts.LogRecords {
+		s.LogFields(record.Fields...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished || !s.ctx.sampled {
+		s.finished = true
+		return
+	}
+	s.finished = true
+
+	zs := zipkinSpan{
+		TraceID:       formatID(s.ctx.traceID),
+		ID:            formatID(s.ctx.spanID),
+		Name:          s.operation,
+		Timestamp:     s.start.UnixNano() / int64(time.Microsecond),
+		Duration:      int64(finish.Sub(s.start) / time.Microsecond),
+		LocalEndpoint: zipkinEndpoint{ServiceName: s.tracer.serviceName},
+		Annotations:   s.annotations,
+	}
+	if s.parentID != 0 {
+		zs.ParentID = formatID(s.parentID)
+	}
+	if kind, ok := s.tags["span.kind"]; ok {
+		zs.Kind = strings.ToUpper(kind)
+	}
+	if len(s.tags) > 0 {
+		zs.Tags = s.tags
+	}
+	s.tracer.enqueue(zs)
+}
+
+func (s *span) Context() opentracing.SpanContext { return s.ctx }
+
+func (s *span) SetOperationName(operation string) opentracing.Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.operation = operation
+	return s
+}
+
+func (s *span) SetTag(key string, value interface{}) opentracing.Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tags[key] = fmt.Sprint(value)
+	return s
+}
+
+func (s *span) LogFields(fields ...otlog.Field) {
+	values := make([]string, 0, len(fields))
+	for _, f := range fields {
+		values = append(values, f.Key()+"="+fmt.Sprint(f.Value()))
+	}
+	s.annotate(strings.Join(values, " "))
+}
+
+func (s *span) LogKV(alternatingKeyValues ...interface{}) {
+	fields, err := otlog.InterleavedKVToFields(alternatingKeyValues...)
+	if err != nil {
+		s.annotate(fmt.Sprint(alternatingKeyValues...))
+		return
+	}
+	s.LogFields(fields...)
+}
+
+func (s *span) annotate(value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.annotations = append(s.annotations, zipkinAnnotation{Timestamp: time.Now().UnixNano() / int64(time.Microsecond), Value: value})
+}
+
+func (s *span) SetBaggageItem(key, value string) opentracing.Span { return s }
+func (s *span) BaggageItem(key string) string                     { return "" }
+func (s *span) Tracer() opentracing.Tracer                        { return s.tracer }
+func (s *span) LogEvent(event string)                             { s.annotate(event) }
+
+func (s *span) LogEventWithPayload(event string, payload interface{}) {
+	s.annotate(fmt.Sprintf("%s %v", event, payload))
+}
+
+func (s *span) Log(data opentracing.LogData) {
+	s.LogEventWithPayload(data.Event, data.Payload)
+}
+
+// zipkinSpan is a span in the Zipkin v2 JSON format.
+type zipkinSpan struct {
+	TraceID       string             `json:"traceId"`
+	ID            string             `json:"id"`
+	ParentID      string             `json:"parentId,omitempty"`
+	Name          string             `json:"name"`
+	Kind          string             `json:"kind,omitempty"`
+	Timestamp     int64              `json:"timestamp"`
+	Duration      int64              `json:"duration"`
+	LocalEndpoint zipkinEndpoint     `json:"localEndpoint"`
+	Tags          map[string]string  `json:"tags,omitempty"`
+	Annotations   []zipkinAnnotation `json:"annotations,omitempty"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+type zipkinAnnotation struct {
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
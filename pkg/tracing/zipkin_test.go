@@ -0,0 +1,141 @@
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+type collector struct {
+	mu       sync.Mutex
+	requests int
+	spans    []zipkinSpan
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var spans []zipkinSpan
+	if err := json.NewDecoder(req.Body).Decode(&spans); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+	c.spans = append(c.spans, spans...)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func newTestTracer(t *testing.T, sampleRatio float64) (*Zipkin, *collector, func()) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	u, err := url.Parse(srv.URL + "/api/v2/spans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewZipkin("telemeter-server", u, srv.Client(), sampleRatio), c, srv.Close
+}
+
+func TestZipkin(t *testing.T) {
+	tracer, c, done := newTestTracer(t, 1)
+	defer done()
+
+	root := tracer.StartSpan("upload", opentracing.Tag{Key: "span.kind", Value: "server"})
+	root.SetTag("http.status_code", 200)
+	root.LogKV("event", "validated")
+
+	// the trace continues in another process
+	h := http.Header{}
+	if err := tracer.Inject(root.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(h)); err != nil {
+		t.Fatal(err)
+	}
+	parent, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := tracer.StartSpan("forward", opentracing.ChildOf(parent))
+	child.Finish()
+	root.Finish()
+	root.Finish()
+
+	if err := tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if c.requests != 1 || len(c.spans) != 2 {
+		t.Fatalf("expected 2 spans in a single request, got %d in %d", len(c.spans), c.requests)
+	}
+	forward, upload := c.spans[0], c.spans[1]
+	if upload.Name != "upload" || forward.Name != "forward" {
+		t.Fatalf("unexpected spans: %#v", c.spans)
+	}
+	if forward.TraceID != upload.TraceID || forward.ParentID != upload.ID || len(upload.ParentID) != 0 {
+		t.Errorf("expected forward to be a child of upload: %#v", c.spans)
+	}
+	if upload.Kind != "SERVER" || upload.Tags["http.status_code"] != "200" || upload.LocalEndpoint.ServiceName != "telemeter-server" {
+		t.Errorf("unexpected upload span: %#v", upload)
+	}
+	if len(upload.Annotations) != 1 || upload.Annotations[0].Value != "event=validated" {
+		t.Errorf("unexpected annotations: %#v", upload.Annotations)
+	}
+
+	// nothing is left to export
+	if err := tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if c.requests != 1 {
+		t.Errorf("expected no further export, got %d requests", c.requests)
+	}
+}
+
+func TestZipkinSampling(t *testing.T) {
+	tracer, c, done := newTestTracer(t, 0)
+	defer done()
+
+	tracer.StartSpan("unsampled").Finish()
+
+	// the decision of the caller is kept
+	h := http.Header{}
+	h.Set(traceIDHeader, "463ac35c9f6413ad48485a3953bb6124")
+	h.Set(spanIDHeader, "a2fb4a1d1a96d312")
+	h.Set(sampledHeader, "1")
+	parent, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer.StartSpan("sampled", opentracing.ChildOf(parent)).Finish()
+
+	if err := tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.spans) != 1 {
+		t.Fatalf("expected only the sampled span, got %#v", c.spans)
+	}
+	if s := c.spans[0]; s.Name != "sampled" || s.TraceID != "48485a3953bb6124" || s.ParentID != "a2fb4a1d1a96d312" {
+		t.Errorf("unexpected span: %#v", s)
+	}
+}
+
+func TestZipkinExtract(t *testing.T) {
+	tracer := NewZipkin("telemeter-server", nil, nil, 1)
+	for name, tt := range map[string]struct {
+		headers map[string]string
+		want    error
+	}{
+		"missing": {want: opentracing.ErrSpanContextNotFound},
+		"invalid": {headers: map[string]string{traceIDHeader: "xyz", spanIDHeader: "a2fb4a1d1a96d312"}, want: opentracing.ErrSpanContextCorrupted},
+		"zero":    {headers: map[string]string{traceIDHeader: "0", spanIDHeader: "a2fb4a1d1a96d312"}, want: opentracing.ErrSpanContextCorrupted},
+		"valid":   {headers: map[string]string{traceIDHeader: "48485a3953bb6124", spanIDHeader: "a2fb4a1d1a96d312"}},
+	} {
+		h := http.Header{}
+		for k, v := range tt.headers {
+			h.Set(k, v)
+		}
+		if _, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(h)); err != tt.want {
+			t.Errorf("%s: expected %v, got %v", name, tt.want, err)
+		}
+	}
+}
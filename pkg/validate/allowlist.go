@@ -0,0 +1,233 @@
+package validate
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/metricfamily"
+)
+
+// otherMetrics is the metric label of drops beyond the names tracked by an allowlist.
+const otherMetrics = "other"
+
+var allowlistDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "telemeter_validation_allowlist_drops_total",
+	Help: "Tracks the number of series dropped because their metric is not allowlisted, by metric. Only as many metrics are tracked as the allowlist has rules, the rest are counted as other.",
+}, []string{"metric"})
+
+func init() {
+	prometheus.MustRegister(allowlistDrops)
+}
+
+// DefaultMaxNotAllowlisted is the number of metrics that are not allowlisted listed by
+// validators, unless configured otherwise.
+const DefaultMaxNotAllowlisted = 10
+
+// ErrNotAllowlisted is returned for metric families not matched by a strict allowlist. Name is
+// the first metric that is not allowlisted. Names lists up to the limit of the validator of them,
+// in the order they were uploaded, and Count is the number of distinct metrics.
+type ErrNotAllowlisted struct {
+	Name  string
+	Names []string
+	Count int
+}
+
+func (e *ErrNotAllowlisted) Error() string {
+	if e.Count <= 1 {
+		return fmt.Sprintf("metric %s is not allowlisted", e.Name)
+	}
+	return fmt.Sprintf("%d metrics are not allowlisted, including %s", e.Count, strings.Join(e.Names, ", "))
+}
+
+// NotAllowlisted lists the metrics of an upload that are not allowlisted. Names holds up to
+// the limit of the validator of them, in the order they were uploaded, and Count is the
+// number of distinct metrics. Truncated is set if Names does not list them all.
+type NotAllowlisted struct {
+	Names     []string `json:"names"`
+	Count     int      `json:"count"`
+	Truncated bool     `json:"truncated"`
+}
+
+// metricNames collects the distinct metric names of an upload, listing up to max of them.
+type metricNames struct {
+	max   int
+	names []string
+	seen  map[string]struct{}
+}
+
+func (n *metricNames) add(name string) {
+	if _, ok := n.seen[name]; ok {
+		return
+	}
+	if n.seen == nil {
+		n.seen = make(map[string]struct{})
+	}
+	n.seen[name] = struct{}{}
+	if len(n.names) < n.max {
+		n.names = append(n.names, name)
+	}
+}
+
+func (n *metricNames) notAllowlisted() *NotAllowlisted {
+	if len(n.seen) == 0 {
+		return nil
+	}
+	return &NotAllowlisted{Names: n.names, Count: len(n.seen), Truncated: len(n.seen) > len(n.names)}
+}
+
+// Allowlist matches the names of the metrics a validator accepts.
+type Allowlist struct {
+	rules    []string
+	names    map[string]struct{}
+	patterns []*regexp.Regexp
+	// deny matches the names that are not accepted even if a rule matches them.
+	deny *Allowlist
+
+	mu      sync.Mutex
+	tracked map[string]struct{}
+}
+
+// NewAllowlist returns an allowlist of the rules. A rule that is a valid metric name matches
+// that name exactly, any other rule is a regular expression matching entire names. An empty
+// allowlist accepts every metric.
+func NewAllowlist(rules []string) (*Allowlist, error) {
+	a := &Allowlist{rules: rules, names: make(map[string]struct{}), tracked: make(map[string]struct{})}
+	for _, rule := range rules {
+		if model.IsValidMetricName(model.LabelValue(rule)) {
+			a.names[rule] = struct{}{}
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + rule + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowlist rule %q: %v", rule, err)
+		}
+		a.patterns = append(a.patterns, re)
+	}
+	return a, nil
+}
+
+// Override returns a copy of the allowlist that also accepts the metrics matched by the rules
+// to add, unless the allowlist is empty, and that rejects those matched by the rules to remove.
+func (a *Allowlist) Override(add, remove []string) (*Allowlist, error) {
+	var rules []string
+	if a != nil && len(a.rules) > 0 {
+		rules = append(append(rules, a.rules...), add...)
+	}
+	o, err := NewAllowlist(rules)
+	if err != nil {
+		return nil, err
+	}
+	if len(remove) > 0 {
+		if o.deny, err = NewAllowlist(remove); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// Allows returns true if the metric name is matched by a rule, or the allowlist is empty, and
+// it is not removed.
+func (a *Allowlist) Allows(name string) bool {
+	if a == nil {
+		return true
+	}
+	if a.deny != nil && a.deny.matches(name) {
+		return false
+	}
+	return len(a.rules) == 0 || a.matches(name)
+}
+
+func (a *Allowlist) matches(name string) bool {
+	if _, ok := a.names[name]; ok {
+		return true
+	}
+	for _, re := range a.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropped counts the series of a family that is not allowlisted. Drops are counted by metric
+// for the first names seen, up to the number of rules, so that hostile clients cannot create
+// unbounded series.
+func (a *Allowlist) dropped(name string, series int) {
+	limit := len(a.rules)
+	if a.deny != nil {
+		limit += len(a.deny.rules)
+	}
+	a.mu.Lock()
+	if _, ok := a.tracked[name]; !ok {
+		if len(a.tracked) < limit {
+			a.tracked[name] = struct{}{}
+		} else {
+			name = otherMetrics
+		}
+	}
+	a.mu.Unlock()
+	allowlistDrops.WithLabelValues(name).Add(float64(series))
+}
+
+// RejectNotAllowlisted returns a validator failing uploads with families that are not
+// allowlisted with *ErrNotAllowlisted, listing up to max of their metrics. It returns nil for a
+// nil allowlist.
+func RejectNotAllowlisted(a *Allowlist, max int) Validator {
+	if a == nil {
+		return nil
+	}
+	return ValidatorFunc(func(_ context.Context, _ *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+		var first string
+		names := metricNames{max: max}
+		for _, family := range families {
+			if family == nil || a.Allows(family.GetName()) {
+				continue
+			}
+			if len(first) == 0 {
+				first = family.GetName()
+			}
+			a.dropped(family.GetName(), len(family.Metric))
+			names.add(family.GetName())
+		}
+		if len(first) == 0 {
+			return families, nil
+		}
+		return nil, &ErrNotAllowlisted{Name: first, Names: names.names, Count: len(names.seen)}
+	})
+}
+
+// uploadTransformer returns a transformer dropping the families that are not allowlisted,
+// recording their metrics in the report, if any.
+func (a *Allowlist) uploadTransformer(report *Report, max int) metricfamily.Transformer {
+	return metricfamily.TransformerFunc(func(family *clientmodel.MetricFamily) (bool, error) {
+		if a.Allows(family.GetName()) {
+			return true, nil
+		}
+		a.dropped(family.GetName(), len(family.Metric))
+		report.dropNotAllowlisted(family.GetName(), max)
+		return false, nil
+	})
+}
+
+// Transformer returns a transformer dropping the families that are not allowlisted, or
+// failing with *ErrNotAllowlisted if strict.
+func (a *Allowlist) Transformer(strict bool) metricfamily.Transformer {
+	return metricfamily.TransformerFunc(func(family *clientmodel.MetricFamily) (bool, error) {
+		if a.Allows(family.GetName()) {
+			return true, nil
+		}
+		a.dropped(family.GetName(), len(family.Metric))
+		if strict {
+			return false, &ErrNotAllowlisted{Name: family.GetName()}
+		}
+		return false, nil
+	})
+}
@@ -0,0 +1,186 @@
+package validate
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func family(name string, series int) *clientmodel.MetricFamily {
+	f := &clientmodel.MetricFamily{Name: proto.String(name), Type: clientmodel.MetricType_GAUGE.Enum()}
+	for i := 0; i < series; i++ {
+		f.Metric = append(f.Metric, &clientmodel.Metric{
+			Label:       []*clientmodel.LabelPair{{Name: proto.String("cluster"), Value: proto.String("cluster-1")}},
+			Gauge:       &clientmodel.Gauge{Value: proto.Float64(1)},
+			TimestampMs: proto.Int64(1000),
+		})
+	}
+	return f
+}
+
+func dropCount(t *testing.T, metric string) float64 {
+	t.Helper()
+	var m clientmodel.Metric
+	if err := allowlistDrops.WithLabelValues(metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestAllowlist(t *testing.T) {
+	a, err := NewAllowlist([]string{"up", "cluster:.*", "node_(cpu|memory)_.+"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"up":                 true,
+		"up_total":           false,
+		"cluster:usage":      true,
+		"cluster_usage":      false,
+		"node_cpu_seconds":   true,
+		"node_memory_bytes":  true,
+		"node_disk_bytes":    false,
+		"xnode_cpu_seconds":  false,
+		"node_cpu_":          false,
+		"go_goroutines":      false,
+		"cluster:usage:rate": true,
+	} {
+		if got := a.Allows(name); got != want {
+			t.Errorf("%s: want allowed %t, got %t", name, want, got)
+		}
+	}
+
+	empty, err := NewAllowlist(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !empty.Allows("anything") || !(*Allowlist)(nil).Allows("anything") {
+		t.Error("want an empty allowlist to accept every metric")
+	}
+
+	if _, err := NewAllowlist([]string{"node_(cpu"}); err == nil {
+		t.Error("want an invalid regular expression to be rejected")
+	}
+}
+
+func TestValidateAllowlist(t *testing.T) {
+	now := time.Unix(1, 0)
+	tests := []struct {
+		name               string
+		strict             bool
+		max                int
+		families           []*clientmodel.MetricFamily
+		wantNames          []string
+		wantNotAllowlisted *NotAllowlisted
+		wantErr            error
+	}{
+		{
+			name:      "allowlisted families are kept",
+			families:  []*clientmodel.MetricFamily{family("up", 1), family("cluster:usage", 1)},
+			wantNames: []string{"up", "cluster:usage"},
+		},
+		{
+			name:               "lenient mode strips other families",
+			families:           []*clientmodel.MetricFamily{family("up", 1), family("go_goroutines", 2)},
+			wantNames:          []string{"up"},
+			wantNotAllowlisted: &NotAllowlisted{Names: []string{"go_goroutines"}, Count: 1},
+		},
+		{
+			name:               "lenient mode lists distinct metrics up to the limit",
+			max:                2,
+			families:           []*clientmodel.MetricFamily{family("a", 1), family("up", 1), family("b", 1), family("a", 1), family("cluster:usage", 1), family("c", 1)},
+			wantNames:          []string{"up", "cluster:usage"},
+			wantNotAllowlisted: &NotAllowlisted{Names: []string{"a", "b"}, Count: 3, Truncated: true},
+		},
+		{
+			name:     "strict mode rejects other families",
+			strict:   true,
+			families: []*clientmodel.MetricFamily{family("up", 1), family("go_goroutines", 2)},
+			wantErr:  &ErrNotAllowlisted{Name: "go_goroutines", Names: []string{"go_goroutines"}, Count: 1},
+		},
+		{
+			name:     "strict mode lists distinct metrics up to the limit",
+			strict:   true,
+			max:      2,
+			families: []*clientmodel.MetricFamily{family("a", 1), family("up", 1), family("b", 1), family("a", 1), family("cluster:usage", 1), family("c", 1)},
+			wantErr:  &ErrNotAllowlisted{Name: "a", Names: []string{"a", "b"}, Count: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowlist, err := NewAllowlist([]string{"up", "cluster:.*"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := NewWithOptions("cluster", 0, 0, func() time.Time { return now }, Options{Allowlist: allowlist, StrictAllowlist: tt.strict, MaxNotAllowlisted: tt.max})
+
+			req := httptest.NewRequest("POST", "/upload", nil)
+			client := &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "cluster-1"}}
+			ctx, report := WithReport(authorize.WithClient(context.Background(), client))
+			_, transforms, err := v.Validate(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kept []*clientmodel.MetricFamily
+			for _, f := range tt.families {
+				ok, err := transforms.Transform(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok {
+					kept = append(kept, f)
+				}
+			}
+			kept, err = v.ValidateUpload(ctx, client, kept)
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			var names []string
+			for _, f := range kept {
+				names = append(names, f.GetName())
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("want families %v, got %v", tt.wantNames, names)
+			}
+			if got := report.NotAllowlisted(); !reflect.DeepEqual(got, tt.wantNotAllowlisted) {
+				t.Errorf("want not allowlisted %+v, got %+v", tt.wantNotAllowlisted, got)
+			}
+		})
+	}
+}
+
+func TestAllowlistDropCounter(t *testing.T) {
+	// two rules track the drops of two metrics
+	a, err := NewAllowlist([]string{"up", "cluster:.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := map[string]float64{}
+	for _, name := range []string{"drop_a", "drop_b", "drop_c", otherMetrics} {
+		before[name] = dropCount(t, name)
+	}
+
+	transform := a.Transformer(false)
+	for _, f := range []*clientmodel.MetricFamily{family("drop_a", 2), family("drop_b", 1), family("drop_c", 3), family("drop_a", 1), family("up", 5)} {
+		if _, err := transform.Transform(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]float64{"drop_a": 3, "drop_b": 1, "drop_c": 0, otherMetrics: 3}
+	for name, n := range want {
+		if got := dropCount(t, name) - before[name]; got != n {
+			t.Errorf("%s: want %v dropped series, got %v", name, n, got)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package validate
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/cache"
+)
+
+// cardinalityBuckets is the number of buckets the window of a cardinality budget slides by.
+const cardinalityBuckets = 6
+
+// ErrCardinalityExceeded is returned when an upload would take the distinct series of a
+// partition over its budget.
+type ErrCardinalityExceeded struct {
+	PartitionKey string
+	Budget       int
+	Usage        int
+}
+
+func (e *ErrCardinalityExceeded) Error() string {
+	return fmt.Sprintf("partition %s would exceed its budget of %d distinct series, %d are in use", e.PartitionKey, e.Budget, e.Usage)
+}
+
+// Committer is implemented by the transformers of uploads that record state once the upload
+// is stored. Commit must not be called if the upload failed.
+type Committer interface {
+	Commit()
+}
+
+// CardinalityBudget bounds the distinct series a partition uploads within a rolling window.
+// The series seen are recorded in a cache as hashes appended to buckets of a fraction of the
+// window, so that servers sharing the cache share the budget without overwriting the series
+// recorded by each other.
+type CardinalityBudget struct {
+	budget int
+	window time.Duration
+	cache  cache.Cache
+	nowFn  func() time.Time
+}
+
+// NewCardinalityBudget returns a budget of distinct series per partition within window, whose
+// state is held by c.
+func NewCardinalityBudget(budget int, window time.Duration, c cache.Cache) *CardinalityBudget {
+	return &CardinalityBudget{budget: budget, window: window, cache: c, nowFn: time.Now}
+}
+
+func (b *CardinalityBudget) bucketDuration() time.Duration {
+	return b.window / cardinalityBuckets
+}
+
+func (b *CardinalityBudget) key(partitionKey string, bucket int64) string {
+	return "cardinality/" + partitionKey + "/" + strconv.FormatInt(bucket, 10)
+}
+
+// upload tracks the series of a single upload of a partition.
+type upload struct {
+	budget       *CardinalityBudget
+	partitionKey string
+	bucket       int64
+
+	loaded   bool
+	seen     map[uint64]struct{}
+	current  map[uint64]struct{}
+	added    int
+	recorded []uint64
+}
+
+// newUpload returns the tracker of an upload. The state of the window is loaded by the first
+// family.
+func (b *CardinalityBudget) newUpload(partitionKey string) *upload {
+	return &upload{budget: b, partitionKey: partitionKey, bucket: b.nowFn().UnixNano() / int64(b.bucketDuration())}
+}
+
+// load reads the buckets of the window. Buckets that cannot be read are skipped, so that a
+// failing cache does not block uploads.
+func (u *upload) load() {
+	u.loaded = true
+	u.seen = make(map[uint64]struct{})
+	u.current = make(map[uint64]struct{})
+	for i := int64(0); i < cardinalityBuckets; i++ {
+		data, ok, err := u.budget.cache.Get(u.budget.key(u.partitionKey, u.bucket-i))
+		if err != nil {
+			log.Printf("error: unable to read the cardinality of %s: %v", u.partitionKey, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		for len(data) >= 8 {
+			h := binary.BigEndian.Uint64(data)
+			data = data[8:]
+			u.seen[h] = struct{}{}
+			if i == 0 {
+				u.current[h] = struct{}{}
+			}
+		}
+	}
+}
+
+// Transform fails with *ErrCardinalityExceeded once the series of the upload not yet seen in
+// the window would take the partition over its budget.
+func (u *upload) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	if !u.loaded {
+		u.load()
+	}
+	usage := len(u.seen) - u.added
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		h := seriesHash(family.GetName(), m.Label)
+		if _, ok := u.seen[h]; !ok {
+			if len(u.seen)+1 > u.budget.budget {
+				return false, &ErrCardinalityExceeded{PartitionKey: u.partitionKey, Budget: u.budget.budget, Usage: usage}
+			}
+			u.seen[h] = struct{}{}
+			u.added++
+		}
+		// series are recorded in the current bucket to keep them in the window
+		if _, ok := u.current[h]; !ok {
+			u.current[h] = struct{}{}
+			u.recorded = append(u.recorded, h)
+		}
+	}
+	return true, nil
+}
+
+// Commit appends the series of the upload missing from the current bucket to it.
+func (u *upload) Commit() {
+	if len(u.recorded) == 0 {
+		return
+	}
+	data := make([]byte, 8*len(u.recorded))
+	for i, h := range u.recorded {
+		binary.BigEndian.PutUint64(data[8*i:], h)
+	}
+	// the bucket is read until the window slid past its end
+	ttl := u.budget.window + u.budget.bucketDuration()
+	if err := u.budget.cache.Append(u.budget.key(u.partitionKey, u.bucket), data, ttl); err != nil {
+		log.Printf("error: unable to record the cardinality of %s: %v", u.partitionKey, err)
+	}
+}
+
+// seriesHash identifies a series by its name and labels, regardless of the order of labels.
+func seriesHash(name string, labels []*clientmodel.LabelPair) uint64 {
+	sorted := make([]*clientmodel.LabelPair, 0, len(labels))
+	for _, l := range labels {
+		if l != nil {
+			sorted = append(sorted, l)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	for _, l := range sorted {
+		h.Write([]byte{0xff})
+		h.Write([]byte(l.GetName()))
+		h.Write([]byte{0xfe})
+		h.Write([]byte(l.GetValue()))
+	}
+	return h.Sum64()
+}
@@ -0,0 +1,105 @@
+package validate
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/cache"
+	"github.com/openshift/telemeter/pkg/metricfamily"
+)
+
+func TestCardinalityBudget(t *testing.T) {
+	c, err := cache.NewMemory(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	budget := NewCardinalityBudget(3, 6*time.Minute, c)
+	now := time.Unix(3600, 0)
+	budget.nowFn = func() time.Time { return now }
+	v := NewWithOptions("cluster", 0, 0, func() time.Time { return now }, Options{Cardinality: budget})
+
+	// validate returns the transformer of an upload of the instance label values, and whether
+	// the series passed
+	validate := func(cluster string, instances ...string) (metricfamily.Transformer, error) {
+		f := &clientmodel.MetricFamily{Name: proto.String("up"), Type: clientmodel.MetricType_GAUGE.Enum()}
+		for _, instance := range instances {
+			f.Metric = append(f.Metric, &clientmodel.Metric{
+				Label: []*clientmodel.LabelPair{
+					{Name: proto.String("instance"), Value: proto.String(instance)},
+					{Name: proto.String("cluster"), Value: proto.String(cluster)},
+				},
+				Gauge:       &clientmodel.Gauge{Value: proto.Float64(1)},
+				TimestampMs: proto.Int64(1000),
+			})
+		}
+		req := httptest.NewRequest("POST", "/upload", nil)
+		ctx := authorize.WithClient(context.Background(), &authorize.Client{ID: cluster, Labels: map[string]string{"cluster": cluster}})
+		_, transforms, err := v.Validate(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = transforms.Transform(f)
+		return transforms, err
+	}
+	// upload commits the series of an upload if they passed
+	upload := func(cluster string, instances ...string) error {
+		transforms, err := validate(cluster, instances...)
+		if err != nil {
+			return err
+		}
+		transforms.(Committer).Commit()
+		return nil
+	}
+
+	steps := []struct {
+		advance   time.Duration
+		cluster   string
+		instances []string
+		wantErr   error
+	}{
+		{cluster: "a", instances: []string{"1", "2"}},
+		// series already seen do not count again
+		{advance: time.Minute, cluster: "a", instances: []string{"1", "2", "3"}},
+		{advance: time.Minute, cluster: "a", instances: []string{"4"}, wantErr: &ErrCardinalityExceeded{PartitionKey: "a", Budget: 3, Usage: 3}},
+		// other partitions have their own budget
+		{cluster: "b", instances: []string{"4", "5", "6"}},
+		// the rejected upload was not recorded
+		{advance: time.Minute, cluster: "a", instances: []string{"3"}},
+		{cluster: "a", instances: []string{"4", "5"}, wantErr: &ErrCardinalityExceeded{PartitionKey: "a", Budget: 3, Usage: 3}},
+		// series 1 and 2 were last seen 5 minutes ago and are still in the window
+		{advance: 3 * time.Minute, cluster: "a", instances: []string{"4", "5"}, wantErr: &ErrCardinalityExceeded{PartitionKey: "a", Budget: 3, Usage: 3}},
+		// after 7 minutes they left it, while 3 was seen since
+		{advance: 2 * time.Minute, cluster: "a", instances: []string{"4", "5"}},
+		// once the window slid past all uploads, the budget is available again
+		{advance: 7 * time.Minute, cluster: "a", instances: []string{"7", "8", "9"}},
+	}
+	for i, step := range steps {
+		now = now.Add(step.advance)
+		if err := upload(step.cluster, step.instances...); !reflect.DeepEqual(err, step.wantErr) {
+			t.Fatalf("%d: want error %v, got %v", i, step.wantErr, err)
+		}
+	}
+
+	// concurrent uploads of a partition record the series of both
+	first, err := validate("c", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := validate("c", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.(Committer).Commit()
+	second.(Committer).Commit()
+	want := &ErrCardinalityExceeded{PartitionKey: "c", Budget: 3, Usage: 2}
+	if err := upload("c", "3", "4"); !reflect.DeepEqual(err, want) {
+		t.Fatalf("want error %v, got %v", want, err)
+	}
+}
@@ -0,0 +1,95 @@
+package validate
+
+import (
+	"context"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/metricfamily"
+)
+
+// ValidatorFunc is a function implementing Validator.
+type ValidatorFunc func(ctx context.Context, client *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error)
+
+// ValidateUpload implements Validator.
+func (f ValidatorFunc) ValidateUpload(ctx context.Context, client *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+	return f(ctx, client, families)
+}
+
+type chain []Validator
+
+// Chain returns a validator running the validators in order, each seeing the families returned
+// by the previous one. The first error rejects the upload without running the validators after
+// it. Nil validators are skipped.
+func Chain(validators ...Validator) Validator {
+	var c chain
+	for _, v := range validators {
+		if v != nil {
+			c = append(c, v)
+		}
+	}
+	return c
+}
+
+func (c chain) ValidateUpload(ctx context.Context, client *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+	for _, v := range c {
+		var err error
+		if families, err = v.ValidateUpload(ctx, client, families); err != nil {
+			return nil, err
+		}
+	}
+	return families, nil
+}
+
+// transformFamilies applies the transformer to the families, returning those it keeps.
+func transformFamilies(t metricfamily.Transformer, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+	kept := families[:0]
+	for _, family := range families {
+		ok, err := t.Transform(family)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			kept = append(kept, family)
+		}
+	}
+	return kept, nil
+}
+
+// RequireClientLabels returns a validator failing uploads with series lacking the labels of
+// the client with *metricfamily.ErrRequiredLabelMissing, or with other values.
+func RequireClientLabels() Validator {
+	return ValidatorFunc(func(_ context.Context, client *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+		return transformFamilies(metricfamily.NewRequiredLabels(client.Labels), families)
+	})
+}
+
+// RequireLabels returns a validator failing uploads with series that do not satisfy every
+// requirement with *ErrRequirementsFailed. It returns nil if there are no requirements.
+func RequireLabels(requirements []Requirement) Validator {
+	t := NewRequirements(requirements)
+	if t == nil {
+		return nil
+	}
+	return ValidatorFunc(func(_ context.Context, _ *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+		return transformFamilies(t, families)
+	})
+}
+
+// LimitSeries returns a validator failing uploads with more than limit series with
+// *ErrTooManySeries. It returns nil if limit is not positive.
+func LimitSeries(limit int) Validator {
+	if limit <= 0 {
+		return nil
+	}
+	return ValidatorFunc(func(_ context.Context, _ *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+		count := metricfamily.NewCount(limit, nil)
+		for _, family := range families {
+			if _, err := count.Transform(family); err != nil {
+				return nil, &ErrTooManySeries{Limit: limit}
+			}
+		}
+		return families, nil
+	})
+}
@@ -0,0 +1,122 @@
+package validate
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func TestChain(t *testing.T) {
+	errFatal := fmt.Errorf("fatal")
+	var calls []string
+	// record returns a validator recording its call and the families it sees
+	record := func(name string, err error) Validator {
+		return ValidatorFunc(func(_ context.Context, _ *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+			var names []string
+			for _, f := range families {
+				names = append(names, f.GetName())
+			}
+			calls = append(calls, fmt.Sprintf("%s%v", name, names))
+			return families, err
+		})
+	}
+	// dropFirst is a lenient validator dropping the first family
+	dropFirst := ValidatorFunc(func(_ context.Context, _ *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+		return families[1:], nil
+	})
+
+	tests := []struct {
+		name       string
+		validators []Validator
+		wantCalls  []string
+		wantNames  []string
+		wantErr    error
+	}{
+		{
+			name:       "runs in order",
+			validators: []Validator{record("a", nil), record("b", nil), record("c", nil)},
+			wantCalls:  []string{"a[up down]", "b[up down]", "c[up down]"},
+			wantNames:  []string{"up", "down"},
+		},
+		{
+			name:       "stops at the first error",
+			validators: []Validator{record("a", nil), record("b", errFatal), record("c", nil)},
+			wantCalls:  []string{"a[up down]", "b[up down]"},
+			wantErr:    errFatal,
+		},
+		{
+			name:       "later validators see the families of lenient ones",
+			validators: []Validator{record("a", nil), dropFirst, record("b", nil)},
+			wantCalls:  []string{"a[up down]", "b[down]"},
+			wantNames:  []string{"down"},
+		},
+		{
+			name:       "skips nil validators",
+			validators: []Validator{nil, record("a", nil), RequireLabels(nil), LimitSeries(0)},
+			wantCalls:  []string{"a[up down]"},
+			wantNames:  []string{"up", "down"},
+		},
+		{
+			name:      "empty",
+			wantNames: []string{"up", "down"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			families, err := Chain(tt.validators...).ValidateUpload(context.Background(), &authorize.Client{ID: "test"}, []*clientmodel.MetricFamily{family("up", 1), family("down", 1)})
+			if err != tt.wantErr {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("want calls %v, got %v", tt.wantCalls, calls)
+			}
+			var names []string
+			for _, f := range families {
+				names = append(names, f.GetName())
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("want families %v, got %v", tt.wantNames, names)
+			}
+		})
+	}
+}
+
+func TestPortedValidators(t *testing.T) {
+	client := &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "cluster-1"}}
+	job, err := ParseRequirement("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		validator Validator
+		families  []*clientmodel.MetricFamily
+		wantErr   bool
+	}{
+		{name: "client labels present", validator: RequireClientLabels(), families: []*clientmodel.MetricFamily{series("up", "cluster", "cluster-1")}},
+		{name: "client labels missing", validator: RequireClientLabels(), families: []*clientmodel.MetricFamily{series("up")}, wantErr: true},
+		{name: "client labels differ", validator: RequireClientLabels(), families: []*clientmodel.MetricFamily{series("up", "cluster", "cluster-2")}, wantErr: true},
+		{name: "requirements satisfied", validator: RequireLabels([]Requirement{job}), families: []*clientmodel.MetricFamily{series("up", "job", "api")}},
+		{name: "requirements failed", validator: RequireLabels([]Requirement{job}), families: []*clientmodel.MetricFamily{series("up")}, wantErr: true},
+		{name: "under the series limit", validator: LimitSeries(2), families: []*clientmodel.MetricFamily{family("up", 1), family("down", 1)}},
+		{name: "over the series limit", validator: LimitSeries(1), families: []*clientmodel.MetricFamily{family("up", 1), family("down", 1)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			families, err := tt.validator.ValidateUpload(context.Background(), client, tt.families)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("want error %t, got %v", tt.wantErr, err)
+			}
+			if err == nil && len(families) != len(tt.families) {
+				t.Errorf("want %d families, got %d", len(tt.families), len(families))
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package validate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/metricfamily"
+)
+
+var (
+	configReloadFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "telemeter_validation_config_reload_failures_total",
+		Help: "Tracks the number of failed reloads of the validation config file. The previous rules are kept when a reload fails.",
+	})
+	configLastReload = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "telemeter_validation_config_last_reload_success_timestamp_seconds",
+		Help: "The time of the last successful load of the validation config file.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(configReloadFailures, configLastReload)
+}
+
+// Config is the content of a validation config file. Unset fields keep the rules the validator
+// is configured with otherwise.
+type Config struct {
+	// AllowMetrics replaces the allowlist rules. An empty list accepts every metric.
+	AllowMetrics    *[]string `json:"allow_metrics,omitempty"`
+	StrictAllowlist *bool     `json:"strict_allowlist,omitempty"`
+	// RequireLabels replaces the requirements, in the form name or name=~regex.
+	RequireLabels *[]string `json:"require_labels,omitempty"`
+	// MaxSeries replaces the series limit and LimitBytes the byte limit of uploads. 0 disables
+	// the limit.
+	MaxSeries  *int   `json:"max_series,omitempty"`
+	LimitBytes *int64 `json:"limit_bytes,omitempty"`
+	// ElideLabels are labels removed from incoming series.
+	ElideLabels []string `json:"elide_labels,omitempty"`
+	// LabelLimits replaces the label limits that are set.
+	LabelLimits *LabelLimitsConfig `json:"label_limits,omitempty"`
+	// Overrides are the profiles of the clients validated with other rules, layered over these.
+	Overrides []Override `json:"overrides,omitempty"`
+}
+
+// LabelLimitsConfig are the label limits of a config or profile. Unset fields keep the limits
+// of the options they apply to, 0 disables a limit.
+type LabelLimitsConfig struct {
+	MaxLabels      *int  `json:"max_labels,omitempty"`
+	MaxNameLength  *int  `json:"max_name_length,omitempty"`
+	MaxValueLength *int  `json:"max_value_length,omitempty"`
+	MaxSeriesSize  *int  `json:"max_series_size,omitempty"`
+	ValidateUTF8   *bool `json:"validate_utf8,omitempty"`
+	TruncateValues *bool `json:"truncate_values,omitempty"`
+}
+
+// apply returns the limits with the fields of the config replaced.
+func (c *LabelLimitsConfig) apply(limits metricfamily.LabelLimits) metricfamily.LabelLimits {
+	if c == nil {
+		return limits
+	}
+	if c.MaxLabels != nil {
+		limits.MaxLabels = *c.MaxLabels
+	}
+	if c.MaxNameLength != nil {
+		limits.MaxNameLength = *c.MaxNameLength
+	}
+	if c.MaxValueLength != nil {
+		limits.MaxValueLength = *c.MaxValueLength
+	}
+	if c.MaxSeriesSize != nil {
+		limits.MaxSeriesSize = *c.MaxSeriesSize
+	}
+	if c.ValidateUTF8 != nil {
+		limits.ValidateUTF8 = *c.ValidateUTF8
+	}
+	if c.TruncateValues != nil {
+		limits.TruncateValues = *c.TruncateValues
+	}
+	return limits
+}
+
+// options returns the base options with the rules of the config applied.
+func (c *Config) options(base Options) (Options, error) {
+	options := base
+	if c.AllowMetrics != nil {
+		allowlist, err := NewAllowlist(*c.AllowMetrics)
+		if err != nil {
+			return Options{}, err
+		}
+		options.Allowlist = allowlist
+	}
+	if c.StrictAllowlist != nil {
+		options.StrictAllowlist = *c.StrictAllowlist
+	}
+	if c.RequireLabels != nil {
+		options.Requirements = nil
+		for _, s := range *c.RequireLabels {
+			r, err := ParseRequirement(s)
+			if err != nil {
+				return Options{}, err
+			}
+			options.Requirements = append(options.Requirements, r)
+		}
+	}
+	if c.MaxSeries != nil {
+		options.MaxSeries = *c.MaxSeries
+	}
+	if len(c.ElideLabels) > 0 {
+		options.ElideLabels = c.ElideLabels
+	}
+	options.LabelLimits = c.LabelLimits.apply(options.LabelLimits)
+	if len(c.Overrides) > 0 {
+		if base.Overrides != nil {
+			return Options{}, fmt.Errorf("overrides may not be set by both the config and an overrides file")
+		}
+		overrides, err := newOverridesFromConfig(OverridesConfig{Overrides: c.Overrides}, options)
+		if err != nil {
+			return Options{}, err
+		}
+		options.Overrides = overrides
+	}
+	return options, nil
+}
+
+// Reloadable is implemented by validators whose rules change while they are in use. Current
+// returns the validator of the active rules, which every check of an upload should be made
+// with, so that uploads in flight finish under the rules they started with.
+type Reloadable interface {
+	Validator
+	Current() Validator
+}
+
+// ConfigFile is a validator whose rules are loaded from a JSON file, or YAML in JSON syntax,
+// layered over the options it is created with. Reload swaps the rules atomically, and keeps
+// the previous ones if the file is invalid.
+type ConfigFile struct {
+	path         string
+	partitionKey string
+	limitBytes   int64
+	maxAge       time.Duration
+	nowFunc      func() time.Time
+	base         Options
+
+	// mu serializes reloads.
+	mu      sync.Mutex
+	modTime time.Time
+	current atomic.Value
+}
+
+// NewConfigFile returns a validator of the rules of the file at path, layered over the
+// arguments of NewWithOptions. It fails if the file cannot be loaded.
+func NewConfigFile(path, partitionKey string, limitBytes int64, maxAge time.Duration, nowFunc func() time.Time, base Options) (*ConfigFile, error) {
+	c := &ConfigFile{
+		path:         path,
+		partitionKey: partitionKey,
+		limitBytes:   limitBytes,
+		maxAge:       maxAge,
+		nowFunc:      nowFunc,
+		base:         base,
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the rules of the file, replacing the active rules for uploads that start
+// afterwards. If the file is invalid, the failure is counted and the active rules are kept.
+func (c *ConfigFile) Reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.reload(); err != nil {
+		configReloadFailures.Inc()
+		return err
+	}
+	configLastReload.SetToCurrentTime()
+	return nil
+}
+
+// reload reads the file. The caller must hold the lock.
+func (c *ConfigFile) reload() error {
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		return fmt.Errorf("unable to read validation config file: %v", err)
+	}
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return fmt.Errorf("unable to read validation config file: %v", err)
+	}
+	var config Config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return fmt.Errorf("unable to parse validation config file %s: %v", c.path, err)
+	}
+	options, err := config.options(c.base)
+	if err != nil {
+		return fmt.Errorf("invalid validation config file %s: %v", c.path, err)
+	}
+	limitBytes := c.limitBytes
+	if config.LimitBytes != nil {
+		limitBytes = *config.LimitBytes
+	}
+	c.current.Store(NewWithOptions(c.partitionKey, limitBytes, c.maxAge, c.nowFunc, options))
+	c.modTime = fi.ModTime()
+	return nil
+}
+
+// Watch reloads the file when it changes, checking every interval until stop is closed.
+func (c *ConfigFile) Watch(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(c.path)
+		if err != nil {
+			log.Printf("error: unable to check validation config file, continuing with the previous rules: %v", err)
+			continue
+		}
+		c.mu.Lock()
+		changed := !fi.ModTime().Equal(c.modTime)
+		c.mu.Unlock()
+		if !changed {
+			continue
+		}
+		if err := c.Reload(); err != nil {
+			log.Printf("error: unable to reload validation config file, continuing with the previous rules: %v", err)
+		}
+	}
+}
+
+// Current implements the Reloadable interface. It returns the validator of the active rules.
+func (c *ConfigFile) Current() Validator {
+	return c.current.Load().(RequestValidator)
+}
+
+// Validate implements the RequestValidator interface with the active rules.
+func (c *ConfigFile) Validate(ctx context.Context, req *http.Request) (string, metricfamily.Transformer, error) {
+	return c.Current().(RequestValidator).Validate(ctx, req)
+}
+
+// ValidateUpload implements the Validator interface with the active rules.
+func (c *ConfigFile) ValidateUpload(ctx context.Context, client *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+	return c.Current().ValidateUpload(ctx, client, families)
+}
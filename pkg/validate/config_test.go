@@ -0,0 +1,107 @@
+package validate
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func reloadFailures(t *testing.T) float64 {
+	t.Helper()
+	var m clientmodel.Metric
+	if err := configReloadFailures.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "validation.json")
+	writeOverrides(t, path, `{"allow_metrics": ["up"], "strict_allowlist": true}`, time.Unix(100, 0))
+
+	now := time.Unix(1, 0)
+	client := &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "cluster-1"}}
+	c, err := NewConfigFile(path, "cluster", 0, 0, func() time.Time { return now }, Options{MaxSeries: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// validate uploads a series of up and of other with the validator
+	validate := func(v Validator) error {
+		req := httptest.NewRequest("POST", "/upload", nil)
+		_, transforms, err := v.(RequestValidator).Validate(authorize.WithClient(context.Background(), client), req)
+		if err != nil {
+			return err
+		}
+		var families []*clientmodel.MetricFamily
+		for _, f := range []*clientmodel.MetricFamily{family("up", 1), family("other", 1)} {
+			ok, err := transforms.Transform(f)
+			if err != nil {
+				return err
+			}
+			if ok {
+				families = append(families, f)
+			}
+		}
+		_, err = v.ValidateUpload(context.Background(), client, families)
+		return err
+	}
+	notAllowlisted := &ErrNotAllowlisted{Name: "other", Names: []string{"other"}, Count: 1}
+	if err := validate(c); !reflect.DeepEqual(err, notAllowlisted) {
+		t.Fatalf("want error %v, got %v", notAllowlisted, err)
+	}
+
+	// uploads in flight keep the rules they started with
+	inFlight := c.Current()
+	writeOverrides(t, path, `{"allow_metrics": ["up", "other"], "max_series": 1}`, time.Unix(200, 0))
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	tooMany := &ErrTooManySeries{Limit: 1}
+	if err := validate(c); !reflect.DeepEqual(err, tooMany) {
+		t.Fatalf("want error %v after reloading, got %v", tooMany, err)
+	}
+	if err := validate(inFlight); !reflect.DeepEqual(err, notAllowlisted) {
+		t.Fatalf("want error %v of the previous rules, got %v", notAllowlisted, err)
+	}
+
+	// invalid files are counted and leave the rules in place
+	for _, content := range []string{`{"allow_metrics": ["("]}`, `{"max_serie": 1}`, `{"require_labels": ["=~"]}`, `{`} {
+		before := reloadFailures(t)
+		writeOverrides(t, path, content, time.Unix(300, 0))
+		if err := c.Reload(); err == nil {
+			t.Errorf("%s: want the config to be rejected", content)
+		}
+		if got := reloadFailures(t) - before; got != 1 {
+			t.Errorf("%s: want 1 failure counted, got %v", content, got)
+		}
+		if err := validate(c); !reflect.DeepEqual(err, tooMany) {
+			t.Fatalf("%s: want error %v of the previous rules, got %v", content, tooMany, err)
+		}
+	}
+
+	// changes are picked up by watching the file
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.Watch(stop, time.Millisecond)
+	writeOverrides(t, path, `{}`, time.Unix(400, 0))
+	for i := 0; validate(c) != nil; i++ {
+		if i == 1000 {
+			t.Fatal("want the changed file to be reloaded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,118 @@
+package validate
+
+import (
+	"fmt"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricfamily"
+)
+
+// ErrDuplicateSeries is returned when an upload has the same series more than once, naming
+// the first duplicate found.
+type ErrDuplicateSeries struct {
+	Series string
+}
+
+func (e *ErrDuplicateSeries) Error() string {
+	return fmt.Sprintf("the upload has series %s more than once", e.Series)
+}
+
+// keptSeries is the sample kept for a series of an upload, with the timestamp it was uploaded
+// with.
+type keptSeries struct {
+	name        string
+	family      *clientmodel.MetricFamily
+	index       int
+	metric      *clientmodel.Metric
+	timestampMs int64
+}
+
+// duplicates finds the duplicate series of an upload across its families.
+type duplicates struct {
+	strict         bool
+	keepTimestamps bool
+	metrics        *Metrics
+	seen           map[uint64][]keptSeries
+}
+
+// DetectDuplicates returns a transformer finding series with the same name and labels within an
+// upload, in any order and across families of the same name. It is stateful and must be used for
+// a single upload, before the timestamps of its samples are overwritten. Duplicates are merged
+// into the sample with the newest timestamp, or fail the upload with *ErrDuplicateSeries if
+// strict is set. If keepTimestamps is set, only samples of a series with the same timestamp are
+// duplicates, as the samples the series has at other times are all stored. Merged series are
+// counted as dropped by metrics.
+func DetectDuplicates(strict, keepTimestamps bool, metrics *Metrics) metricfamily.Transformer {
+	return &duplicates{strict: strict, keepTimestamps: keepTimestamps, metrics: metrics, seen: make(map[uint64][]keptSeries)}
+}
+
+func (d *duplicates) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	merged := 0
+	for i, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		h := seriesHash(family.GetName(), m.Label)
+		kept, ok := d.find(h, family.GetName(), m)
+		if !ok {
+			d.seen[h] = append(d.seen[h], keptSeries{name: family.GetName(), family: family, index: i, metric: m, timestampMs: m.GetTimestampMs()})
+			continue
+		}
+		if d.strict {
+			return false, &ErrDuplicateSeries{Series: metricfamily.SeriesString(family.GetName(), m.Label)}
+		}
+		if m.GetTimestampMs() >= kept.timestampMs {
+			kept.timestampMs = m.GetTimestampMs()
+			if kept.family == family {
+				family.Metric[kept.index], kept.metric = m, m
+			} else {
+				// the family of the kept sample went through the rest of the transformers, which
+				// may have overwritten its timestamp, so that only its value is replaced
+				kept.metric.Gauge, kept.metric.Counter, kept.metric.Summary, kept.metric.Untyped, kept.metric.Histogram = m.Gauge, m.Counter, m.Summary, m.Untyped, m.Histogram
+			}
+		}
+		family.Metric[i] = nil
+		merged++
+	}
+	if merged == 0 {
+		return true, nil
+	}
+	d.metrics.observeDropped(ReasonDuplicateSeries, merged)
+	metricfamily.PackMetrics(family)
+	return len(family.Metric) > 0, nil
+}
+
+// find returns the sample kept for the series of m, if it has one.
+func (d *duplicates) find(h uint64, name string, m *clientmodel.Metric) (*keptSeries, bool) {
+	refs := d.seen[h]
+	for i := range refs {
+		kept := &refs[i]
+		// a colliding hash of another series leaves it unchecked
+		if kept.name != name || !sameLabels(kept.metric.Label, m.Label) {
+			continue
+		}
+		if d.keepTimestamps && kept.timestampMs != m.GetTimestampMs() {
+			continue
+		}
+		return kept, true
+	}
+	return nil, false
+}
+
+// sameLabels returns true if the label sets are equal, regardless of their order.
+func sameLabels(a, b []*clientmodel.LabelPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	values := make(map[string]string, len(a))
+	for _, l := range a {
+		values[l.GetName()] = l.GetValue()
+	}
+	for _, l := range b {
+		if v, ok := values[l.GetName()]; !ok || v != l.GetValue() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package validate
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricfamily"
+)
+
+func TestDetectDuplicates(t *testing.T) {
+	// sample returns a series of the labels with a sample at ts
+	sample := func(ts int64, labels ...string) *clientmodel.Metric {
+		m := series("", labels...).Metric[0]
+		m.TimestampMs = proto.Int64(ts)
+		return m
+	}
+	families := func(families ...*clientmodel.MetricFamily) []*clientmodel.MetricFamily { return families }
+	withMetrics := func(name string, metrics ...*clientmodel.Metric) *clientmodel.MetricFamily {
+		return &clientmodel.MetricFamily{Name: proto.String(name), Type: clientmodel.MetricType_GAUGE.Enum(), Metric: metrics}
+	}
+	// timestamps returns the samples of the series in the families, as name{labels}@ts
+	timestamps := func(families []*clientmodel.MetricFamily) []string {
+		var samples []string
+		for _, f := range families {
+			for _, m := range f.Metric {
+				samples = append(samples, fmt.Sprintf("%s@%d", metricfamily.SeriesString(f.GetName(), m.Label), m.GetTimestampMs()))
+			}
+		}
+		return samples
+	}
+
+	tests := []struct {
+		name     string
+		strict   bool
+		keep     bool
+		families []*clientmodel.MetricFamily
+		want     []string
+		wantErr  error
+	}{
+		{
+			name:     "no duplicates",
+			families: families(withMetrics("up", sample(1, "job", "a"), sample(1, "job", "b")), withMetrics("down", sample(1, "job", "a"))),
+			want:     []string{`up{job="a"}@1`, `up{job="b"}@1`, `down{job="a"}@1`},
+		},
+		{
+			name:     "exact duplicates",
+			families: families(withMetrics("up", sample(1, "job", "a"), sample(1, "job", "b"), sample(1, "job", "a"))),
+			want:     []string{`up{job="a"}@1`, `up{job="b"}@1`},
+		},
+		{
+			name:     "duplicates differing only in timestamp keep the newest",
+			families: families(withMetrics("up", sample(1, "job", "a"), sample(3, "job", "a"), sample(2, "job", "a"))),
+			want:     []string{`up{job="a"}@3`},
+		},
+		{
+			name:     "duplicates with labels in another order",
+			families: families(withMetrics("up", sample(1, "job", "a", "instance", "i"), sample(2, "instance", "i", "job", "a"))),
+			want:     []string{`up{instance="i",job="a"}@2`},
+		},
+		{
+			name:     "duplicates across families of the same name",
+			families: families(withMetrics("up", sample(2, "job", "a")), withMetrics("up", sample(1, "job", "a"))),
+			want:     []string{`up{job="a"}@2`},
+		},
+		{
+			name:     "same labels of other metrics",
+			families: families(withMetrics("up", sample(1, "job", "a")), withMetrics("down", sample(1, "job", "a"))),
+			want:     []string{`up{job="a"}@1`, `down{job="a"}@1`},
+		},
+		{
+			name:     "samples at other times kept with their timestamps",
+			keep:     true,
+			families: families(withMetrics("up", sample(1, "job", "a"), sample(2, "job", "a"), sample(2, "job", "a")), withMetrics("up", sample(1, "job", "a"))),
+			want:     []string{`up{job="a"}@1`, `up{job="a"}@2`},
+		},
+		{
+			name:     "strict without duplicates",
+			strict:   true,
+			families: families(withMetrics("up", sample(1, "job", "a"), sample(1, "job", "b"))),
+			want:     []string{`up{job="a"}@1`, `up{job="b"}@1`},
+		},
+		{
+			name:     "strict with duplicates",
+			strict:   true,
+			families: families(withMetrics("up", sample(1, "job", "a", "instance", "i"), sample(2, "instance", "i", "job", "a"))),
+			wantErr:  &ErrDuplicateSeries{Series: `up{instance="i",job="a"}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := metricfamily.Filter(tt.families, DetectDuplicates(tt.strict, tt.keep, nil))
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if got := timestamps(metricfamily.Pack(tt.families)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want series %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func BenchmarkDetectDuplicates(b *testing.B) {
+	const familyCount, seriesCount = 1000, 100
+	upload := func() []*clientmodel.MetricFamily {
+		families := make([]*clientmodel.MetricFamily, 0, familyCount)
+		for i := 0; i < familyCount; i++ {
+			f := &clientmodel.MetricFamily{Name: proto.String(fmt.Sprintf("metric_%d", i)), Type: clientmodel.MetricType_GAUGE.Enum()}
+			for j := 0; j < seriesCount; j++ {
+				f.Metric = append(f.Metric, &clientmodel.Metric{
+					Label: []*clientmodel.LabelPair{
+						{Name: proto.String("cluster"), Value: proto.String("cluster-1")},
+						{Name: proto.String("instance"), Value: proto.String(fmt.Sprintf("instance-%d", j))},
+						{Name: proto.String("job"), Value: proto.String("job")},
+					},
+					Gauge:       &clientmodel.Gauge{Value: proto.Float64(1)},
+					TimestampMs: proto.Int64(1),
+				})
+			}
+			families = append(families, f)
+		}
+		return families
+	}
+	families := upload()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := metricfamily.Filter(families, DetectDuplicates(false, false, nil)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
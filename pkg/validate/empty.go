@@ -0,0 +1,30 @@
+package validate
+
+import (
+	"context"
+	"fmt"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/metricfamily"
+)
+
+// ErrEmptyUpload is returned when an upload has no series left to store.
+var ErrEmptyUpload = fmt.Errorf("the upload has no metrics, the federation rules of the client may not match any")
+
+// DetectEmptyUploads returns a validator counting the uploads without series by client in
+// metrics. Empty uploads fail with ErrEmptyUpload if reject is set, and are otherwise passed on
+// for the caller to skip.
+func DetectEmptyUploads(reject bool, metrics *Metrics) Validator {
+	return ValidatorFunc(func(_ context.Context, client *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+		if metricfamily.MetricsCount(families) > 0 {
+			return families, nil
+		}
+		metrics.observeEmpty(client.ID)
+		if reject {
+			return nil, ErrEmptyUpload
+		}
+		return families, nil
+	})
+}
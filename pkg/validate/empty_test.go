@@ -0,0 +1,43 @@
+package validate
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func TestDetectEmptyUploads(t *testing.T) {
+	tests := []struct {
+		name      string
+		reject    bool
+		families  []*clientmodel.MetricFamily
+		wantErr   error
+		wantEmpty map[string]float64
+	}{
+		{name: "series", families: []*clientmodel.MetricFamily{series("up", "job", "a")}, wantEmpty: map[string]float64{}},
+		{name: "series rejecting", reject: true, families: []*clientmodel.MetricFamily{series("up", "job", "a")}, wantEmpty: map[string]float64{}},
+		{name: "no families", wantEmpty: map[string]float64{"test": 1}},
+		{name: "families without series", families: []*clientmodel.MetricFamily{family("up", 0)}, wantEmpty: map[string]float64{"test": 1}},
+		{name: "no families rejecting", reject: true, wantErr: ErrEmptyUpload, wantEmpty: map[string]float64{"test": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			families, err := DetectEmptyUploads(tt.reject, NewMetrics(reg)).ValidateUpload(context.Background(), &authorize.Client{ID: "test"}, tt.families)
+			if err != tt.wantErr {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && !reflect.DeepEqual(families, tt.families) {
+				t.Errorf("want families %v, got %v", tt.families, families)
+			}
+			if got := counts(t, reg, "telemeter_validation_empty_uploads_total"); !reflect.DeepEqual(got, tt.wantEmpty) {
+				t.Errorf("want empty uploads %v, got %v", tt.wantEmpty, got)
+			}
+		})
+	}
+}
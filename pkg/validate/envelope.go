@@ -0,0 +1,30 @@
+package validate
+
+import "context"
+
+type key int
+
+const envelopeKey key = iota
+
+// Envelope describes an upload. It is sent by clients ahead of the metrics on
+// versions of the upload endpoint that support it.
+type Envelope struct {
+	// AgentVersion is the version of the client that collected the metrics.
+	AgentVersion string `json:"agent_version"`
+	// ScrapeTimestampMs is when the metrics were collected, in milliseconds since the epoch.
+	ScrapeTimestampMs int64 `json:"scrape_timestamp"`
+	// Format is the media type of the metrics that follow. If empty, the
+	// Content-Type of the request applies.
+	Format string `json:"format"`
+}
+
+// WithEnvelope returns a context carrying the envelope of the upload being validated.
+func WithEnvelope(ctx context.Context, envelope *Envelope) context.Context {
+	return context.WithValue(ctx, envelopeKey, envelope)
+}
+
+// EnvelopeFromContext returns the envelope of the upload, if the client sent one.
+func EnvelopeFromContext(ctx context.Context) (*Envelope, bool) {
+	envelope, ok := ctx.Value(envelopeKey).(*Envelope)
+	return envelope, ok
+}
@@ -0,0 +1,159 @@
+package validate
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricfamily"
+)
+
+// Reasons uploads are rejected or series are dropped for, as counted by Metrics.
+const (
+	ReasonUnauthorized          = "unauthorized"
+	ReasonMissingPartitionLabel = "missing_partition_label"
+	ReasonInvalidPartitionLabel = "invalid_partition_label"
+	ReasonMissingLabel          = "missing_label"
+	ReasonLabelRequirement      = "label_requirement"
+	ReasonLabelTooLong          = "label_too_long"
+	ReasonNameTooLong           = "name_too_long"
+	ReasonTooManyLabels         = "too_many_labels"
+	ReasonSeriesTooLarge        = "series_too_large"
+	ReasonInvalidUTF8           = "invalid_utf8"
+	ReasonMissingTimestamp      = "missing_timestamp"
+	ReasonInconsistentType      = "inconsistent_type"
+	ReasonUnsorted              = "unsorted"
+	ReasonSampleTooOld          = "sample_too_old"
+	ReasonSampleInFuture        = "sample_in_future"
+	ReasonNotAllowlisted        = "not_allowlisted"
+	ReasonOverSeriesLimit       = "over_series_limit"
+	ReasonDuplicateSeries       = "duplicate_series"
+	ReasonOverCardinalityBudget = "over_cardinality_budget"
+	ReasonTooLarge              = "too_large"
+	ReasonEmptyUpload           = "empty_upload"
+	ReasonInvalid               = "invalid"
+)
+
+// Reason returns the reason an upload failing validation with err is rejected for.
+func Reason(err error) string {
+	switch err.(type) {
+	case ErrMissingPartitionKey:
+		return ReasonMissingPartitionLabel
+	case *ErrInvalidPartitionKey:
+		return ReasonInvalidPartitionLabel
+	case *ErrRequirementsFailed:
+		return ReasonLabelRequirement
+	case *metricfamily.ErrSeriesOutOfOrder:
+		return ReasonUnsorted
+	case *metricfamily.ErrInconsistentType:
+		return ReasonInconsistentType
+	case *metricfamily.ErrFutureSample:
+		return ReasonSampleInFuture
+	case *ErrNotAllowlisted:
+		return ReasonNotAllowlisted
+	case *ErrTooManySeries:
+		return ReasonOverSeriesLimit
+	case *ErrDuplicateSeries:
+		return ReasonDuplicateSeries
+	case *ErrCardinalityExceeded:
+		return ReasonOverCardinalityBudget
+	case *ErrTooLarge:
+		return ReasonTooLarge
+	case *metricfamily.ErrRequiredLabelMissing:
+		return ReasonMissingLabel
+	case *metricfamily.ErrLabelLimit:
+		switch err.(*metricfamily.ErrLabelLimit).Type {
+		case metricfamily.LabelLimitCount:
+			return ReasonTooManyLabels
+		case metricfamily.LabelLimitSeriesSize:
+			return ReasonSeriesTooLarge
+		case metricfamily.LabelLimitInvalidUTF8:
+			return ReasonInvalidUTF8
+		}
+		return ReasonLabelTooLong
+	}
+	switch err {
+	case ErrNoClient:
+		return ReasonUnauthorized
+	case metricfamily.ErrLabelNameTooLong, metricfamily.ErrLabelValueTooLong:
+		return ReasonLabelTooLong
+	case metricfamily.ErrMetricNameTooLong:
+		return ReasonNameTooLong
+	case metricfamily.ErrNoTimestamp:
+		return ReasonMissingTimestamp
+	case metricfamily.ErrUnsorted:
+		return ReasonUnsorted
+	case metricfamily.ErrTimestampTooOld:
+		return ReasonSampleTooOld
+	case ErrEmptyUpload:
+		return ReasonEmptyUpload
+	}
+	return ReasonInvalid
+}
+
+// Metrics counts the uploads rejected by a validator and the series it drops, by reason, and
+// the empty uploads of each client. A nil Metrics counts nothing.
+type Metrics struct {
+	rejections *prometheus.CounterVec
+	dropped    *prometheus.CounterVec
+	empty      *prometheus.CounterVec
+}
+
+// NewMetrics returns the metrics of a validator, registered with reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		rejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "telemeter_validation_rejections_total",
+			Help: "Tracks the number of uploads rejected by validation, by reason.",
+		}, []string{"reason"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "telemeter_validation_dropped_series_total",
+			Help: "Tracks the number of series dropped from uploads by validation instead of rejecting them, by reason.",
+		}, []string{"reason"}),
+		empty: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "telemeter_validation_empty_uploads_total",
+			Help: "Tracks the number of uploads without series to store, accepted or rejected, by client.",
+		}, []string{"client"}),
+	}
+	reg.MustRegister(m.rejections, m.dropped, m.empty)
+	return m
+}
+
+// ObserveRejection records an upload rejected with err.
+func (m *Metrics) ObserveRejection(err error) {
+	if m == nil || err == nil {
+		return
+	}
+	m.rejections.WithLabelValues(Reason(err)).Inc()
+}
+
+// observeDropped records series dropped for reason.
+func (m *Metrics) observeDropped(reason string, series int) {
+	if m == nil {
+		return
+	}
+	m.dropped.WithLabelValues(reason).Add(float64(series))
+}
+
+// observeEmpty records an upload of the client without series.
+func (m *Metrics) observeEmpty(client string) {
+	if m == nil {
+		return
+	}
+	m.empty.WithLabelValues(client).Inc()
+}
+
+// countDropped returns a transformer counting the series of the families t drops for reason.
+// Series t removes from families it keeps are not counted.
+func (m *Metrics) countDropped(reason string, t metricfamily.Transformer) metricfamily.Transformer {
+	if m == nil {
+		return t
+	}
+	return metricfamily.TransformerFunc(func(family *clientmodel.MetricFamily) (bool, error) {
+		series := len(family.Metric)
+		ok, err := t.Transform(family)
+		if err == nil && !ok {
+			m.observeDropped(reason, series)
+		}
+		return ok, err
+	})
+}
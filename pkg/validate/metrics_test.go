@@ -0,0 +1,235 @@
+package validate
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/cache"
+)
+
+// counts returns the values of the counter of the registry by reason.
+func counts(t *testing.T, reg *prometheus.Registry, name string) map[string]float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.Metric {
+			values[m.Label[0].GetValue()] = m.GetCounter().GetValue()
+		}
+	}
+	return values
+}
+
+func TestMetrics(t *testing.T) {
+	now := time.Unix(7200, 0)
+	client := &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "cluster-1"}}
+	// at returns the family with all samples at the given time
+	at := func(f *clientmodel.MetricFamily, ts time.Time) *clientmodel.MetricFamily {
+		for _, m := range f.Metric {
+			m.TimestampMs = proto.Int64(ts.UnixNano() / int64(time.Millisecond))
+		}
+		return f
+	}
+	fresh := func(name string, series int) *clientmodel.MetricFamily {
+		return at(family(name, series), now)
+	}
+	withLabel := func(f *clientmodel.MetricFamily, name, value string) *clientmodel.MetricFamily {
+		for _, m := range f.Metric {
+			m.Label = append(m.Label, &clientmodel.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+		}
+		return f
+	}
+	allowlist := func(t *testing.T) *Allowlist {
+		a, err := NewAllowlist([]string{"up"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	job, err := ParseRequirement("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		client      *authorize.Client
+		limitBytes  int64
+		body        string
+		options     func(t *testing.T) Options
+		family      *clientmodel.MetricFamily
+		wantReason  string
+		wantDropped map[string]float64
+	}{
+		{name: "no client", wantReason: ReasonUnauthorized},
+		{name: "no partition label", client: &authorize.Client{ID: "test"}, wantReason: ReasonMissingPartitionLabel},
+		{
+			name: "invalid partition label",
+			options: func(t *testing.T) Options {
+				format, err := NewPartitionKeyFormat(PartitionKeyFormatUUID, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return Options{PartitionKeyFormat: format}
+			},
+			wantReason: ReasonInvalidPartitionLabel,
+		},
+		{
+			name:       "missing client label",
+			family:     &clientmodel.MetricFamily{Name: proto.String("up"), Type: clientmodel.MetricType_GAUGE.Enum(), Metric: []*clientmodel.Metric{{Gauge: &clientmodel.Gauge{Value: proto.Float64(1)}, TimestampMs: proto.Int64(7200000)}}},
+			wantReason: ReasonMissingLabel,
+		},
+		{
+			name:       "label requirement",
+			options:    func(t *testing.T) Options { return Options{Requirements: []Requirement{job}} },
+			family:     fresh("up", 1),
+			wantReason: ReasonLabelRequirement,
+		},
+		{name: "label too long", family: withLabel(fresh("up", 1), "long", strings.Repeat("a", 256)), wantReason: ReasonLabelTooLong},
+		{name: "name too long", family: fresh(strings.Repeat("a", 256), 1), wantReason: ReasonNameTooLong},
+		{
+			name:       "missing timestamp",
+			family:     &clientmodel.MetricFamily{Name: proto.String("up"), Type: clientmodel.MetricType_GAUGE.Enum(), Metric: []*clientmodel.Metric{{Gauge: &clientmodel.Gauge{Value: proto.Float64(1)}}}},
+			wantReason: ReasonMissingTimestamp,
+		},
+		{
+			name: "unsorted",
+			family: func() *clientmodel.MetricFamily {
+				f := fresh("up", 2)
+				f.Metric[0].TimestampMs = proto.Int64(7200001)
+				return f
+			}(),
+			wantReason: ReasonUnsorted,
+		},
+		{name: "sample too old", family: at(family("up", 1), now.Add(-2*time.Hour)), wantReason: ReasonSampleTooOld},
+		{
+			name:       "sample in future",
+			options:    func(t *testing.T) Options { return Options{MaxFutureSkew: time.Minute} },
+			family:     at(family("up", 1), now.Add(time.Hour)),
+			wantReason: ReasonSampleInFuture,
+		},
+		{
+			name:       "not allowlisted",
+			options:    func(t *testing.T) Options { return Options{Allowlist: allowlist(t), StrictAllowlist: true} },
+			family:     fresh("go_goroutines", 2),
+			wantReason: ReasonNotAllowlisted,
+		},
+		{
+			name:        "not allowlisted in lenient mode",
+			options:     func(t *testing.T) Options { return Options{Allowlist: allowlist(t)} },
+			family:      fresh("go_goroutines", 2),
+			wantDropped: map[string]float64{ReasonNotAllowlisted: 2},
+		},
+		{
+			name:       "over series limit",
+			options:    func(t *testing.T) Options { return Options{MaxSeries: 1} },
+			family:     fresh("up", 2),
+			wantReason: ReasonOverSeriesLimit,
+		},
+		{
+			name: "over cardinality budget",
+			options: func(t *testing.T) Options {
+				c, err := cache.NewMemory(10)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return Options{Cardinality: NewCardinalityBudget(1, time.Hour, c)}
+			},
+			family: func() *clientmodel.MetricFamily {
+				f := fresh("up", 2)
+				f.Metric[1].Label = append(f.Metric[1].Label, &clientmodel.LabelPair{Name: proto.String("instance"), Value: proto.String("a")})
+				return f
+			}(),
+			wantReason: ReasonOverCardinalityBudget,
+		},
+		{name: "too large", limitBytes: 4, body: "12345", wantReason: ReasonTooLarge},
+		{
+			name: "inconsistent type",
+			family: func() *clientmodel.MetricFamily {
+				f := fresh("up", 1)
+				f.Type = clientmodel.MetricType_COUNTER.Enum()
+				return f
+			}(),
+			wantReason: ReasonInconsistentType,
+		},
+		{
+			name: "invalid",
+			family: func() *clientmodel.MetricFamily {
+				f := fresh("up", 1)
+				f.Type = clientmodel.MetricType(99).Enum()
+				return f
+			}(),
+			wantReason: ReasonInvalid,
+		},
+		{name: "valid", family: fresh("up", 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			var options Options
+			if tt.options != nil {
+				options = tt.options(t)
+			}
+			options.Metrics = NewMetrics(reg)
+			v := NewWithOptions("cluster", tt.limitBytes, time.Hour, func() time.Time { return now }, options)
+
+			req := httptest.NewRequest("POST", "/upload", bytes.NewBufferString(tt.body))
+			ctx := context.Background()
+			if tt.name != "no client" {
+				c := tt.client
+				if c == nil {
+					c = client
+				}
+				ctx = authorize.WithClient(ctx, c)
+			}
+			_, transforms, err := v.Validate(ctx, req)
+			if err == nil {
+				// a rejection is counted once, even if it is reported again
+				ioutil.ReadAll(req.Body)
+				ioutil.ReadAll(req.Body)
+				if tt.family != nil {
+					ok, err := transforms.Transform(tt.family)
+					if err != nil {
+						if tt.wantReason == "" {
+							t.Fatal(err)
+						}
+						transforms.Transform(tt.family)
+					} else if ok {
+						c, _ := authorize.FromContext(ctx)
+						if _, err := v.ValidateUpload(ctx, c, []*clientmodel.MetricFamily{tt.family}); err != nil && tt.wantReason == "" {
+							t.Fatal(err)
+						}
+					}
+				}
+			}
+
+			want := map[string]float64{}
+			if tt.wantReason != "" {
+				want[tt.wantReason] = 1
+			}
+			got := counts(t, reg, "telemeter_validation_rejections_total")
+			if len(got) != len(want) || got[tt.wantReason] != want[tt.wantReason] {
+				t.Errorf("want rejections %v, got %v", want, got)
+			}
+			if got := counts(t, reg, "telemeter_validation_dropped_series_total"); len(got) != len(tt.wantDropped) || got[ReasonNotAllowlisted] != tt.wantDropped[ReasonNotAllowlisted] {
+				t.Errorf("want dropped series %v, got %v", tt.wantDropped, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package validate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+// overridesCheckInterval is how often the overrides file is checked for changes.
+const overridesCheckInterval = 10 * time.Second
+
+// Override is a profile of validation rules applied to the clients it selects instead of the
+// defaults. Unset fields keep the defaults.
+type Override struct {
+	Name string `json:"name"`
+	// ClientIDs and Labels select the clients of the profile. A client is selected if its ID is
+	// listed, or if it has all the labels with the same values.
+	ClientIDs []string          `json:"client_ids,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+
+	// AllowMetrics are allowlist rules added to the default allowlist, if there is one.
+	// DenyMetrics are rules of metrics that are not accepted even if allowlisted.
+	AllowMetrics []string `json:"allow_metrics,omitempty"`
+	DenyMetrics  []string `json:"deny_metrics,omitempty"`
+	// MaxSeries replaces the default series limit. 0 disables the limit.
+	MaxSeries *int `json:"max_series,omitempty"`
+	// RequireLabels replaces the default requirements, in the form name or name=~regex.
+	RequireLabels *[]string `json:"require_labels,omitempty"`
+	// LabelLimits replaces the default label limits that are set.
+	LabelLimits *LabelLimitsConfig `json:"label_limits,omitempty"`
+}
+
+// OverridesConfig is the content of an overrides file. Clients are validated by the first
+// profile that selects them.
+type OverridesConfig struct {
+	Overrides []Override `json:"overrides"`
+}
+
+// selects returns true if the profile applies to the client.
+func (o *Override) selects(client *authorize.Client) bool {
+	for _, id := range o.ClientIDs {
+		if id == client.ID {
+			return true
+		}
+	}
+	if len(o.Labels) == 0 {
+		return false
+	}
+	for k, v := range o.Labels {
+		if client.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// options returns the defaults with the rules of the profile applied.
+func (o *Override) options(defaults Options) (Options, error) {
+	options := defaults
+	if len(o.AllowMetrics) > 0 || len(o.DenyMetrics) > 0 {
+		allowlist, err := defaults.Allowlist.Override(o.AllowMetrics, o.DenyMetrics)
+		if err != nil {
+			return Options{}, err
+		}
+		options.Allowlist = allowlist
+	}
+	if o.MaxSeries != nil {
+		options.MaxSeries = *o.MaxSeries
+	}
+	if o.RequireLabels != nil {
+		options.Requirements = nil
+		for _, s := range *o.RequireLabels {
+			r, err := ParseRequirement(s)
+			if err != nil {
+				return Options{}, err
+			}
+			options.Requirements = append(options.Requirements, r)
+		}
+	}
+	options.LabelLimits = o.LabelLimits.apply(options.LabelLimits)
+	return options, nil
+}
+
+type profile struct {
+	override Override
+	options  Options
+}
+
+// Overrides holds the validation rule profiles of clients, loaded from a JSON file that is
+// reloaded when it changes, at most every overridesCheckInterval. As JSON is valid YAML, the
+// file may be maintained with YAML tooling.
+type Overrides struct {
+	path     string
+	defaults Options
+	nowFn    func() time.Time
+
+	mu       sync.RWMutex
+	profiles []profile
+	modTime  time.Time
+	checked  time.Time
+}
+
+// NewOverrides loads the profiles stored at path, layered over the defaults. A missing file
+// applies the defaults to all clients.
+func NewOverrides(path string, defaults Options) (*Overrides, error) {
+	o := &Overrides{
+		path:     path,
+		defaults: defaults,
+		nowFn:    time.Now,
+	}
+	if err := o.reload(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// newOverridesFromConfig returns the profiles of the config, layered over the defaults. They
+// are not reloaded.
+func newOverridesFromConfig(config OverridesConfig, defaults Options) (*Overrides, error) {
+	o := &Overrides{defaults: defaults, nowFn: time.Now}
+	if err := o.load(config); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// load replaces the profiles with those of the config. The caller must hold the lock.
+func (o *Overrides) load(config OverridesConfig) error {
+	profiles := make([]profile, 0, len(config.Overrides))
+	for _, override := range config.Overrides {
+		options, err := override.options(o.defaults)
+		if err != nil {
+			return fmt.Errorf("invalid validation override %q: %v", override.Name, err)
+		}
+		profiles = append(profiles, profile{override: override, options: options})
+	}
+	o.profiles = profiles
+	return nil
+}
+
+// reload reads the profiles from disk. The caller must hold the lock.
+func (o *Overrides) reload() error {
+	fi, err := os.Stat(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read validation overrides file: %v", err)
+	}
+	data, err := ioutil.ReadFile(o.path)
+	if err != nil {
+		return fmt.Errorf("unable to read validation overrides file: %v", err)
+	}
+	var config OverridesConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("unable to parse validation overrides file %s: %v", o.path, err)
+	}
+	if err := o.load(config); err != nil {
+		return err
+	}
+	o.modTime = fi.ModTime()
+	return nil
+}
+
+// check reloads the file if it changed, at most every overridesCheckInterval. Profiles that
+// are not loaded from a file are never reloaded. A removed file applies the defaults to all
+// clients, as a missing one does on start.
+func (o *Overrides) check() {
+	if len(o.path) == 0 {
+		return
+	}
+	now := o.nowFn()
+	o.mu.RLock()
+	checked := o.checked
+	o.mu.RUnlock()
+	if now.Sub(checked) < overridesCheckInterval {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if now.Sub(o.checked) < overridesCheckInterval {
+		return
+	}
+	o.checked = now
+	fi, err := os.Stat(o.path)
+	if os.IsNotExist(err) {
+		if !o.modTime.IsZero() {
+			log.Printf("Validation overrides file %s was removed, applying the defaults to all clients", o.path)
+		}
+		o.profiles = nil
+		o.modTime = time.Time{}
+		return
+	}
+	if err != nil {
+		log.Printf("error: unable to check validation overrides file, continuing with the previous profiles: %v", err)
+		return
+	}
+	if fi.ModTime().Equal(o.modTime) {
+		return
+	}
+	if err := o.reload(); err != nil {
+		log.Printf("error: unable to reload validation overrides file, continuing with the previous profiles: %v", err)
+	}
+}
+
+// Resolve returns the options the upload of the client is validated with: those of the first
+// profile selecting it, or the defaults.
+func (o *Overrides) Resolve(client *authorize.Client) Options {
+	o.check()
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for i := range o.profiles {
+		if o.profiles[i].override.selects(client) {
+			return o.profiles[i].options
+		}
+	}
+	return o.defaults
+}
@@ -0,0 +1,147 @@
+package validate
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+const testOverrides = `{"overrides": [
+	{"name": "test-clusters", "labels": {"cluster": "test-cluster"}, "allow_metrics": ["test_.*"], "require_labels": []},
+	{"name": "noisy", "client_ids": ["noisy"], "deny_metrics": ["cluster:.*"], "max_series": 1}
+]}`
+
+func writeOverrides(t *testing.T, path, content string, modTime time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overrides")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "overrides.json")
+	writeOverrides(t, path, testOverrides, time.Unix(100, 0))
+
+	allowlist, err := NewAllowlist([]string{"up", "cluster:.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := ParseRequirement("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := NewOverrides(path, Options{Allowlist: allowlist, StrictAllowlist: true, Requirements: []Requirement{job}, MaxSeries: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1, 0)
+	overrides.nowFn = func() time.Time { return now }
+	v := NewWithOptions("cluster", 0, 0, func() time.Time { return now }, Options{Overrides: overrides})
+
+	// the same upload is validated by each client, labeled with its cluster
+	upload := func(cluster string) []*clientmodel.MetricFamily {
+		families := []*clientmodel.MetricFamily{family("up", 1), family("cluster:usage", 1), family("test_metric", 1)}
+		for _, f := range families {
+			f.Metric[0].Label = []*clientmodel.LabelPair{
+				{Name: proto.String("cluster"), Value: proto.String(cluster)},
+				{Name: proto.String("job"), Value: proto.String("telemeter")},
+			}
+		}
+		return families
+	}
+	validate := func(client *authorize.Client) error {
+		req := httptest.NewRequest("POST", "/upload", nil)
+		_, transforms, err := v.Validate(authorize.WithClient(context.Background(), client), req)
+		if err != nil {
+			return err
+		}
+		families := upload(client.Labels["cluster"])
+		for _, f := range families {
+			if _, err := transforms.Transform(f); err != nil {
+				return err
+			}
+		}
+		_, err = v.ValidateUpload(context.Background(), client, families)
+		return err
+	}
+
+	tests := []struct {
+		name    string
+		client  *authorize.Client
+		wantErr error
+	}{
+		{
+			name:    "defaults",
+			client:  &authorize.Client{ID: "customer", Labels: map[string]string{"cluster": "cluster-1"}},
+			wantErr: &ErrNotAllowlisted{Name: "test_metric", Names: []string{"test_metric"}, Count: 1},
+		},
+		{
+			name:   "test clusters are allowed extra metrics and no required labels",
+			client: &authorize.Client{ID: "internal", Labels: map[string]string{"cluster": "test-cluster"}},
+		},
+		{
+			name:    "noisy client has removed metrics",
+			client:  &authorize.Client{ID: "noisy", Labels: map[string]string{"cluster": "cluster-1"}},
+			wantErr: &ErrNotAllowlisted{Name: "cluster:usage", Names: []string{"cluster:usage", "test_metric"}, Count: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validate(tt.client); !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	// the defaults require the job label, but the profile of test clusters does not
+	if got := overrides.Resolve(&authorize.Client{ID: "internal", Labels: map[string]string{"cluster": "test-cluster"}}); len(got.Requirements) != 0 {
+		t.Errorf("want no requirements, got %v", got.Requirements)
+	}
+	if got := overrides.Resolve(&authorize.Client{ID: "noisy"}); got.MaxSeries != 1 || !reflect.DeepEqual(got.Requirements, []Requirement{job}) {
+		t.Errorf("want the series limit replaced and the requirements kept, got %+v", got)
+	}
+
+	// changes are picked up once the check interval passed
+	writeOverrides(t, path, `{"overrides": [{"name": "noisy", "client_ids": ["noisy"], "allow_metrics": ["test_.*"]}]}`, time.Unix(200, 0))
+	if err := validate(&authorize.Client{ID: "noisy", Labels: map[string]string{"cluster": "cluster-1"}}); err == nil {
+		t.Fatal("want the previous profiles before the check interval passed")
+	}
+	now = now.Add(overridesCheckInterval)
+	if err := validate(&authorize.Client{ID: "noisy", Labels: map[string]string{"cluster": "cluster-1"}}); err != nil {
+		t.Fatalf("want the reloaded profiles to apply, got %v", err)
+	}
+
+	// an invalid file keeps the previous profiles
+	writeOverrides(t, path, `{"overrides": [{"name": "broken", "allow_metrics": ["(test"]}]}`, time.Unix(300, 0))
+	now = now.Add(overridesCheckInterval)
+	if err := validate(&authorize.Client{ID: "noisy", Labels: map[string]string{"cluster": "cluster-1"}}); err != nil {
+		t.Fatalf("want the previous profiles to apply, got %v", err)
+	}
+
+	// a removed file applies the defaults
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(overridesCheckInterval)
+	if got := overrides.Resolve(&authorize.Client{ID: "noisy"}); got.MaxSeries != 10 {
+		t.Errorf("want the defaults once the file is removed, got %+v", got)
+	}
+}
@@ -0,0 +1,70 @@
+package validate
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// PartitionKeyFormatUUID is the format of partition keys that must be UUID v4s, in any case.
+const PartitionKeyFormatUUID = "uuid"
+
+var uuidV4 = regexp.MustCompile(`^(?i)[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// ErrInvalidPartitionKey is returned when the partition label of the client does not have the
+// expected format.
+type ErrInvalidPartitionKey struct {
+	Label  string
+	Value  string
+	Format string
+}
+
+func (e *ErrInvalidPartitionKey) Error() string {
+	return fmt.Sprintf("the '%s' label %q must be %s", e.Label, e.Value, e.Format)
+}
+
+// PartitionKeyFormat checks the values of the partition label.
+type PartitionKeyFormat struct {
+	pattern     *regexp.Regexp
+	description string
+	bypass      map[string]struct{}
+}
+
+// NewPartitionKeyFormat returns the check of partition keys of the given format, either
+// PartitionKeyFormatUUID or a regular expression matching entire values. The values of bypass
+// are accepted regardless of the format. It returns nil if format is empty.
+func NewPartitionKeyFormat(format string, bypass []string) (*PartitionKeyFormat, error) {
+	if len(format) == 0 {
+		return nil, nil
+	}
+	f := &PartitionKeyFormat{bypass: make(map[string]struct{}, len(bypass))}
+	if format == PartitionKeyFormatUUID {
+		f.pattern = uuidV4
+		f.description = "a UUID v4"
+	} else {
+		pattern, err := regexp.Compile("^(?:" + format + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid partition key format %q: %v", format, err)
+		}
+		f.pattern = pattern
+		f.description = fmt.Sprintf("matching %s", pattern)
+	}
+	for _, value := range bypass {
+		f.bypass[value] = struct{}{}
+	}
+	return f, nil
+}
+
+// Check returns *ErrInvalidPartitionKey if the value of the label does not have the format and
+// is not bypassed.
+func (f *PartitionKeyFormat) Check(label, value string) error {
+	if f == nil {
+		return nil
+	}
+	if _, ok := f.bypass[value]; ok {
+		return nil
+	}
+	if !f.pattern.MatchString(value) {
+		return &ErrInvalidPartitionKey{Label: label, Value: value, Format: f.description}
+	}
+	return nil
+}
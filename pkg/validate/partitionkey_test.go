@@ -0,0 +1,81 @@
+package validate
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func TestPartitionKeyFormat(t *testing.T) {
+	uuid, err := NewPartitionKeyFormat(PartitionKeyFormatUUID, []string{"legacy-cluster"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, err := NewPartitionKeyFormat("cluster-[0-9]+", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		format *PartitionKeyFormat
+		value  string
+		valid  bool
+	}{
+		{name: "uuid", format: uuid, value: "3c9b2bba-6a6e-4d1c-a0a7-1b4b4d7c9b61", valid: true},
+		{name: "uppercase uuid", format: uuid, value: "3C9B2BBA-6A6E-4D1C-A0A7-1B4B4D7C9B61", valid: true},
+		{name: "uuid of another version", format: uuid, value: "3c9b2bba-6a6e-1d1c-a0a7-1b4b4d7c9b61"},
+		{name: "uuid of another variant", format: uuid, value: "3c9b2bba-6a6e-4d1c-c0a7-1b4b4d7c9b61"},
+		{name: "uuid without dashes", format: uuid, value: "3c9b2bba6a6e4d1ca0a71b4b4d7c9b61"},
+		{name: "uuid in braces", format: uuid, value: "{3c9b2bba-6a6e-4d1c-a0a7-1b4b4d7c9b61}"},
+		{name: "short uuid", format: uuid, value: "3c9b2bba-6a6e-4d1c-a0a7-1b4b4d7c9b6"},
+		{name: "uuid with a trailing character", format: uuid, value: "3c9b2bba-6a6e-4d1c-a0a7-1b4b4d7c9b61a"},
+		{name: "non-hex uuid", format: uuid, value: "3c9b2bba-6a6e-4d1c-a0a7-1b4b4d7c9g61"},
+		{name: "hostname", format: uuid, value: "node-1.example.com"},
+		{name: "test", format: uuid, value: "test"},
+		{name: "empty", format: uuid, value: ""},
+		{name: "bypassed", format: uuid, value: "legacy-cluster", valid: true},
+		{name: "bypass is exact", format: uuid, value: "legacy-cluster-2"},
+		{name: "custom format", format: custom, value: "cluster-42", valid: true},
+		{name: "custom format matches entire values", format: custom, value: "my-cluster-42"},
+		{name: "no format", value: "test", valid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.format.Check("cluster", tt.value)
+			if tt.valid {
+				if err != nil {
+					t.Errorf("want no error, got %v", err)
+				}
+				return
+			}
+			if _, ok := err.(*ErrInvalidPartitionKey); !ok {
+				t.Errorf("want *ErrInvalidPartitionKey, got %v", err)
+			}
+		})
+	}
+
+	if _, err := NewPartitionKeyFormat("(cluster", nil); err == nil {
+		t.Error("want an error for an invalid format")
+	}
+	if f, err := NewPartitionKeyFormat("", nil); f != nil || err != nil {
+		t.Errorf("want no format, got %v, %v", f, err)
+	}
+}
+
+func TestValidatePartitionKeyFormat(t *testing.T) {
+	format, err := NewPartitionKeyFormat(PartitionKeyFormatUUID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewWithOptions("cluster", 0, 0, time.Now, Options{PartitionKeyFormat: format})
+
+	ctx := authorize.WithClient(context.Background(), &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}})
+	_, _, err = v.Validate(ctx, httptest.NewRequest("POST", "/upload", nil))
+	if err, ok := err.(*ErrInvalidPartitionKey); !ok || err.Error() != `the 'cluster' label "test" must be a UUID v4` {
+		t.Errorf("want *ErrInvalidPartitionKey naming the format, got %v", err)
+	}
+}
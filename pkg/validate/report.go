@@ -0,0 +1,211 @@
+package validate
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/metricfamily"
+)
+
+// Rules of a validator that may be switched to report-only with Options.ReportOnly. Checks of
+// sample timestamps and of the request itself are always enforced.
+const (
+	RuleAllowlist        = "allowlist"
+	RuleInconsistentType = "inconsistent_type"
+	RuleClientLabels     = "client_labels"
+	RuleRequiredLabels   = "required_labels"
+	RuleDuplicates       = "duplicates"
+	RuleSeriesLimit      = "series_limit"
+	RuleEmptyUploads     = "empty_uploads"
+	RuleLabelLimits      = "label_limits"
+)
+
+// IsRule returns true if name is a rule that may be switched to report-only.
+func IsRule(name string) bool {
+	switch name {
+	case RuleAllowlist, RuleInconsistentType, RuleClientLabels, RuleRequiredLabels, RuleDuplicates, RuleSeriesLimit, RuleEmptyUploads, RuleLabelLimits:
+		return true
+	}
+	return false
+}
+
+// Report collects what the validation of an upload found without rejecting it: the report-only
+// rules that would have rejected the upload or dropped some of its series, and the metrics
+// dropped as not allowlisted. It is safe for concurrent use.
+type Report struct {
+	mu             sync.Mutex
+	fired          map[string]struct{}
+	notAllowlisted metricNames
+}
+
+type reportKey struct{}
+
+// WithReport returns a context collecting the report-only rules firing during validation in the
+// returned report.
+func WithReport(ctx context.Context) (context.Context, *Report) {
+	r := &Report{fired: make(map[string]struct{})}
+	return context.WithValue(ctx, reportKey{}, r), r
+}
+
+// ReportFromContext returns the report of the context, if any.
+func ReportFromContext(ctx context.Context) (*Report, bool) {
+	r, ok := ctx.Value(reportKey{}).(*Report)
+	return r, ok
+}
+
+// Fired returns the sorted rules that fired.
+func (r *Report) Fired() []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rules := make([]string, 0, len(r.fired))
+	for rule := range r.fired {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// NotAllowlisted returns the metrics dropped as not allowlisted, or nil if there are none.
+func (r *Report) NotAllowlisted() *NotAllowlisted {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.notAllowlisted.notAllowlisted()
+}
+
+// dropNotAllowlisted records a metric dropped as not allowlisted, listing up to max of them. A
+// nil report records nothing.
+func (r *Report) dropNotAllowlisted(name string, max int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notAllowlisted.max = max
+	r.notAllowlisted.add(name)
+}
+
+// fire records the rule, returning true the first time it fires. A nil report records nothing.
+func (r *Report) fire(rule string) bool {
+	if r == nil {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.fired[rule]; ok {
+		return false
+	}
+	r.fired[rule] = struct{}{}
+	return true
+}
+
+// reportFired records that the rule would have rejected the upload of the client with err, or
+// dropped series if err is nil. The rejection is counted once per upload, as if the rule were
+// enforced.
+func reportFired(ctx context.Context, rule string, client *authorize.Client, metrics *Metrics, err error) {
+	r, _ := ReportFromContext(ctx)
+	if !r.fire(rule) && err == nil {
+		return
+	}
+	id := "unknown"
+	if client != nil {
+		id = client.ID
+	}
+	if err != nil {
+		metrics.ObserveRejection(err)
+		log.Printf("report-only rule %s would have rejected the upload of client %s: %v", rule, id, err)
+		return
+	}
+	log.Printf("report-only rule %s would have dropped series of the upload of client %s", rule, id)
+}
+
+// ReportOnly returns a validator evaluating v on a copy of the families of uploads, recording
+// in the report of the context and in metrics whether it would have rejected the upload or
+// dropped series, without changing the families. It returns nil if v is nil.
+func ReportOnly(rule string, v Validator, metrics *Metrics) Validator {
+	if v == nil {
+		return nil
+	}
+	return ValidatorFunc(func(ctx context.Context, client *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+		kept, err := v.ValidateUpload(ctx, client, cloneFamilies(families))
+		if err != nil || metricfamily.MetricsCount(kept) < metricfamily.MetricsCount(families) {
+			reportFired(ctx, rule, client, metrics, err)
+		}
+		return families, nil
+	})
+}
+
+// reportOnlyTransformer evaluates a transformer on a copy of each family, like ReportOnly.
+type reportOnlyTransformer struct {
+	ctx      context.Context
+	rule     string
+	client   *authorize.Client
+	metrics  *Metrics
+	t        metricfamily.Transformer
+	rejected bool
+}
+
+func (t *reportOnlyTransformer) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	clone := proto.Clone(family).(*clientmodel.MetricFamily)
+	ok, err := t.t.Transform(clone)
+	switch {
+	case err != nil:
+		// an enforced rule aborts the upload at its first error
+		if !t.rejected {
+			t.rejected = true
+			reportFired(t.ctx, t.rule, t.client, t.metrics, err)
+		}
+	case !ok || len(clone.Metric) < len(family.Metric):
+		reportFired(t.ctx, t.rule, t.client, t.metrics, nil)
+	}
+	return true, nil
+}
+
+// cloneFamilies returns a deep copy of the families.
+func cloneFamilies(families []*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	clones := make([]*clientmodel.MetricFamily, len(families))
+	for i, family := range families {
+		if family != nil {
+			clones[i] = proto.Clone(family).(*clientmodel.MetricFamily)
+		}
+	}
+	return clones
+}
+
+// reportOnly returns whether the rule is report-only.
+func (o Options) reportOnly(rule string) bool {
+	for _, r := range o.ReportOnly {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// enforce returns v, or a report-only evaluation of it if the rule is report-only.
+func (o Options) enforce(rule string, v Validator) Validator {
+	if o.reportOnly(rule) {
+		return ReportOnly(rule, v, o.Metrics)
+	}
+	return v
+}
+
+// enforceTransformer returns t, or a report-only evaluation of it for the upload of the client
+// if the rule is report-only.
+func (o Options) enforceTransformer(ctx context.Context, client *authorize.Client, rule string, t metricfamily.Transformer) metricfamily.Transformer {
+	if o.reportOnly(rule) {
+		return &reportOnlyTransformer{ctx: ctx, rule: rule, client: client, metrics: o.Metrics, t: t}
+	}
+	return t
+}
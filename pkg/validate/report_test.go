@@ -0,0 +1,54 @@
+package validate
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+)
+
+func TestReportOnly(t *testing.T) {
+	client := &authorize.Client{ID: "test"}
+	dropAll := ValidatorFunc(func(_ context.Context, _ *authorize.Client, _ []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+		return nil, nil
+	})
+
+	tests := []struct {
+		name        string
+		validator   Validator
+		wantFired   []string
+		wantRejects map[string]float64
+	}{
+		{name: "passing", validator: LimitSeries(10), wantFired: []string{}, wantRejects: map[string]float64{}},
+		{name: "rejecting", validator: LimitSeries(1), wantFired: []string{"rule"}, wantRejects: map[string]float64{ReasonOverSeriesLimit: 1}},
+		{name: "dropping", validator: dropAll, wantFired: []string{"rule"}, wantRejects: map[string]float64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			families := []*clientmodel.MetricFamily{family("up", 2)}
+			ctx, report := WithReport(context.Background())
+			got, err := ReportOnly("rule", tt.validator, NewMetrics(reg)).ValidateUpload(ctx, client, families)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, []*clientmodel.MetricFamily{family("up", 2)}) {
+				t.Errorf("want families unchanged, got %v", got)
+			}
+			if fired := report.Fired(); !reflect.DeepEqual(fired, tt.wantFired) {
+				t.Errorf("want fired rules %v, got %v", tt.wantFired, fired)
+			}
+			if rejects := counts(t, reg, "telemeter_validation_rejections_total"); !reflect.DeepEqual(rejects, tt.wantRejects) {
+				t.Errorf("want rejections %v, got %v", tt.wantRejects, rejects)
+			}
+		})
+	}
+
+	if ReportOnly("rule", nil, nil) != nil {
+		t.Error("want no validator for a nil validator")
+	}
+}
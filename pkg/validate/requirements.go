@@ -0,0 +1,115 @@
+package validate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricfamily"
+)
+
+// Requirement is a label every incoming series must have with a non-empty value. If Value is
+// set, the value must also match it.
+type Requirement struct {
+	Name  string
+	Value *regexp.Regexp
+}
+
+// ParseRequirement parses a requirement in the form name, or name=~regex where regex must
+// match entire values.
+func ParseRequirement(s string) (Requirement, error) {
+	parts := strings.SplitN(s, "=~", 2)
+	if len(parts[0]) == 0 {
+		return Requirement{}, fmt.Errorf("requirement %q has no label name", s)
+	}
+	r := Requirement{Name: parts[0]}
+	if len(parts) == 2 {
+		re, err := regexp.Compile("^(?:" + parts[1] + ")$")
+		if err != nil {
+			return Requirement{}, fmt.Errorf("requirement %q has an invalid value pattern: %v", s, err)
+		}
+		r.Value = re
+	}
+	return r, nil
+}
+
+// RequirementFailure describes why a series did not satisfy a requirement.
+type RequirementFailure struct {
+	Label  string
+	Reason string
+}
+
+// Reasons of requirement failures.
+const (
+	ReasonMissing = "missing"
+	ReasonEmpty   = "empty"
+	ReasonNoMatch = "no_match"
+)
+
+// ErrRequirementsFailed is returned for a series that does not satisfy the requirements of the
+// validator. All the requirements it fails are reported together.
+type ErrRequirementsFailed struct {
+	Name     string
+	Failures []RequirementFailure
+}
+
+func (e *ErrRequirementsFailed) Error() string {
+	failures := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		failures = append(failures, fmt.Sprintf("label %s is %s", f.Label, describeReason(f.Reason)))
+	}
+	return fmt.Sprintf("metric %s does not satisfy the label requirements: %s", e.Name, strings.Join(failures, ", "))
+}
+
+func describeReason(reason string) string {
+	switch reason {
+	case ReasonEmpty:
+		return "empty"
+	case ReasonNoMatch:
+		return "not matching the required pattern"
+	default:
+		return "missing"
+	}
+}
+
+// NewRequirements returns a transformer failing with *ErrRequirementsFailed for the first series
+// of a family that does not satisfy every requirement.
+func NewRequirements(requirements []Requirement) metricfamily.Transformer {
+	if len(requirements) == 0 {
+		return nil
+	}
+	return metricfamily.TransformerFunc(func(family *clientmodel.MetricFamily) (bool, error) {
+		for _, m := range family.Metric {
+			if m == nil {
+				continue
+			}
+			if failures := checkRequirements(requirements, m); len(failures) > 0 {
+				return false, &ErrRequirementsFailed{Name: family.GetName(), Failures: failures}
+			}
+		}
+		return true, nil
+	})
+}
+
+func checkRequirements(requirements []Requirement, m *clientmodel.Metric) []RequirementFailure {
+	var failures []RequirementFailure
+Requirements:
+	for _, r := range requirements {
+		for _, label := range m.Label {
+			if label == nil || label.GetName() != r.Name {
+				continue
+			}
+			switch {
+			case len(label.GetValue()) == 0:
+				failures = append(failures, RequirementFailure{Label: r.Name, Reason: ReasonEmpty})
+			case r.Value != nil && !r.Value.MatchString(label.GetValue()):
+				failures = append(failures, RequirementFailure{Label: r.Name, Reason: ReasonNoMatch})
+			}
+			continue Requirements
+		}
+		failures = append(failures, RequirementFailure{Label: r.Name, Reason: ReasonMissing})
+	}
+	return failures
+}
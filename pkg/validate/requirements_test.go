@@ -0,0 +1,108 @@
+package validate
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func series(name string, labels ...string) *clientmodel.MetricFamily {
+	m := &clientmodel.Metric{Gauge: &clientmodel.Gauge{Value: proto.Float64(1)}}
+	for i := 0; i+1 < len(labels); i += 2 {
+		m.Label = append(m.Label, &clientmodel.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+	}
+	return &clientmodel.MetricFamily{Name: proto.String(name), Type: clientmodel.MetricType_GAUGE.Enum(), Metric: []*clientmodel.Metric{m}}
+}
+
+func TestParseRequirement(t *testing.T) {
+	r, err := ParseRequirement("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "job" || r.Value != nil {
+		t.Errorf("unexpected requirement %+v", r)
+	}
+
+	r, err = ParseRequirement("cluster=~[0-9a-f-]+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "cluster" || r.Value == nil || r.Value.MatchString("cluster-abc") {
+		t.Errorf("want a value pattern matching entire values, got %+v", r)
+	}
+
+	for _, s := range []string{"", "=~.*", "cluster=~(abc"} {
+		if _, err := ParseRequirement(s); err == nil {
+			t.Errorf("%q: want an error", s)
+		}
+	}
+}
+
+func TestRequirements(t *testing.T) {
+	var requirements []Requirement
+	for _, s := range []string{"cluster=~[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}", "job"} {
+		r, err := ParseRequirement(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requirements = append(requirements, r)
+	}
+	const uuid = "3c9b2bba-6a6e-4d1c-a0a7-1b4b4d7c9b61"
+
+	tests := []struct {
+		name    string
+		family  *clientmodel.MetricFamily
+		wantErr error
+	}{
+		{
+			name:   "all requirements satisfied",
+			family: series("up", "cluster", uuid, "job", "telemeter"),
+		},
+		{
+			name:   "missing label",
+			family: series("up", "cluster", uuid),
+			wantErr: &ErrRequirementsFailed{Name: "up", Failures: []RequirementFailure{
+				{Label: "job", Reason: ReasonMissing},
+			}},
+		},
+		{
+			name:   "empty value",
+			family: series("up", "cluster", uuid, "job", ""),
+			wantErr: &ErrRequirementsFailed{Name: "up", Failures: []RequirementFailure{
+				{Label: "job", Reason: ReasonEmpty},
+			}},
+		},
+		{
+			name:   "non-matching value",
+			family: series("up", "cluster", "cluster-1", "job", "telemeter"),
+			wantErr: &ErrRequirementsFailed{Name: "up", Failures: []RequirementFailure{
+				{Label: "cluster", Reason: ReasonNoMatch},
+			}},
+		},
+		{
+			name:   "multiple failures are reported together",
+			family: series("up", "cluster", uuid+"x"),
+			wantErr: &ErrRequirementsFailed{Name: "up", Failures: []RequirementFailure{
+				{Label: "cluster", Reason: ReasonNoMatch},
+				{Label: "job", Reason: ReasonMissing},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := NewRequirements(requirements).Transform(tt.family)
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+			if ok != (tt.wantErr == nil) {
+				t.Fatalf("want family kept %t, got %t", tt.wantErr == nil, ok)
+			}
+		})
+	}
+
+	if NewRequirements(nil) != nil {
+		t.Error("want no transformer without requirements")
+	}
+}
@@ -3,16 +3,60 @@ package validate
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
+	clientmodel "github.com/prometheus/client_model/go"
+
 	"github.com/openshift/telemeter/pkg/authorize"
 	"github.com/openshift/telemeter/pkg/metricfamily"
 	"github.com/openshift/telemeter/pkg/reader"
 )
 
-// Validator validates an upload.
+var (
+	// ErrNoClient is returned when the request has not been authorized.
+	ErrNoClient = fmt.Errorf("unable to find user info")
+)
+
+// ErrMissingPartitionKey is returned when the authorized client lacks the partition label.
+type ErrMissingPartitionKey string
+
+func (e ErrMissingPartitionKey) Error() string {
+	return fmt.Sprintf("user data must contain a '%s' label", string(e))
+}
+
+// ErrTooLarge is returned when the body of an upload exceeds the byte limit of the validator.
+type ErrTooLarge struct {
+	Limit int64
+}
+
+func (e *ErrTooLarge) Error() string {
+	return fmt.Sprintf("the incoming sample data is too long, the limit is %d bytes", e.Limit)
+}
+
+// ErrTooManySeries is returned when an upload has more series than the limit of the validator.
+type ErrTooManySeries struct {
+	Limit int
+}
+
+func (e *ErrTooManySeries) Error() string {
+	return fmt.Sprintf("the upload has more than %d series", e.Limit)
+}
+
+// Validator validates the families of an upload of an authorized client. It returns the
+// families to store, which lenient validators may filter or modify, or an error rejecting the
+// upload. Validators are composed with Chain.
 type Validator interface {
+	ValidateUpload(ctx context.Context, client *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error)
+}
+
+// RequestValidator is a Validator that also checks an upload before its body is read. Validate
+// returns the partition key of the upload and a transformer applied to each family as it is
+// decoded, so that uploads failing it are aborted early. Families are then validated with
+// ValidateUpload.
+type RequestValidator interface {
+	Validator
 	Validate(ctx context.Context, req *http.Request) (string, metricfamily.Transformer, error)
 }
 
@@ -21,43 +65,273 @@ type validator struct {
 	limitBytes   int64
 	maxAge       time.Duration
 	nowFunc      func() time.Time
+
+	options Options
+}
+
+// Options are the optional checks of a validator.
+type Options struct {
+	// Allowlist, if set, restricts the metrics accepted. Families of other metrics are dropped
+	// and recorded in the Report of the context, or fail the upload with *ErrNotAllowlisted if
+	// StrictAllowlist is set. Up to MaxNotAllowlisted of their metrics are listed, or
+	// DefaultMaxNotAllowlisted if it is zero.
+	Allowlist         *Allowlist
+	StrictAllowlist   bool
+	MaxNotAllowlisted int
+	// SortSamples sorts the samples of each series by timestamp instead of failing uploads whose
+	// samples are not in increasing order with metricfamily.ErrUnsorted. If StrictSampleOrder
+	// is set, uploads with samples older than a previous sample of their series by more than
+	// SampleOrderTolerance fail with *metricfamily.ErrSeriesOutOfOrder.
+	SortSamples          bool
+	StrictSampleOrder    bool
+	SampleOrderTolerance time.Duration
+	// DropInconsistentTypes drops series lacking the value of the type of their family instead
+	// of failing the upload with *metricfamily.ErrInconsistentType.
+	DropInconsistentTypes bool
+	// Requirements are the labels every series must have. Series failing any of them fail the
+	// upload with *ErrRequirementsFailed.
+	Requirements []Requirement
+	// MaxSeries, if set, fails uploads with more valid series with *ErrTooManySeries.
+	MaxSeries int
+	// Duplicates, if set, merges series present more than once in an upload into the newest,
+	// or fails the upload with *ErrDuplicateSeries if StrictDuplicates is set. Only samples of a
+	// series with the same timestamp are duplicates if KeepTimestamps is set.
+	Duplicates       bool
+	StrictDuplicates bool
+	// RejectEmptyUploads fails uploads without series left to store with ErrEmptyUpload. They
+	// are otherwise returned without families for the caller to skip. Empty uploads are
+	// counted either way.
+	RejectEmptyUploads bool
+	// MaxFutureSkew, if set, is how far ahead of now samples may be. Uploads with samples
+	// further in the future fail with *metricfamily.ErrFutureSample, or are clamped to the
+	// bound if ClampFutureSamples is set.
+	MaxFutureSkew      time.Duration
+	ClampFutureSamples bool
+	// ClampOldSamples sets samples older than the maximum age of the validator to the bound
+	// instead of failing the upload with metricfamily.ErrTimestampTooOld.
+	ClampOldSamples bool
+	// KeepTimestamps stores samples with the timestamps they were uploaded with, once bounded by
+	// the maximum age and MaxFutureSkew, instead of the time of the upload. It keeps the samples
+	// of series sent more than once with different timestamps, such as those a client could not
+	// upload before.
+	KeepTimestamps bool
+
+	// Cardinality, if set, bounds the distinct series of each partition within a window.
+	// Uploads taking a partition over the budget fail with *ErrCardinalityExceeded. The
+	// returned transformer implements Committer to record the series of stored uploads.
+	Cardinality *CardinalityBudget
+
+	// PartitionKeyFormat, if set, rejects clients whose partition label does not have the
+	// format with *ErrInvalidPartitionKey. It is not replaced by overrides.
+	PartitionKeyFormat *PartitionKeyFormat
+
+	// ReportOnly lists the rules that are evaluated without being enforced. Uploads they would
+	// reject or series they would drop are counted by Metrics and recorded in the Report of the
+	// context, but are stored unchanged.
+	ReportOnly []string
+
+	// ElideLabels are removed from incoming series. Series made identical are merged.
+	ElideLabels []string
+
+	// LabelLimits bounds the labels of series. Uploads with a series exceeding them fail with
+	// *metricfamily.ErrLabelLimit, unless the limits truncate its values.
+	LabelLimits metricfamily.LabelLimits
+
+	// Metrics, if set, counts rejected uploads and dropped series.
+	Metrics *Metrics
+
+	// Overrides, if set, resolves the options of each client, replacing these.
+	Overrides *Overrides
 }
 
 // New handles Prometheus metrics from end clients that must be assumed to be hostile.
 // It implements metrics transforms that sanitize the incoming content.
-func New(partitionKey string, limitBytes int64, maxAge time.Duration, nowFunc func() time.Time) Validator {
+func New(partitionKey string, limitBytes int64, maxAge time.Duration, nowFunc func() time.Time) RequestValidator {
+	return &validator{
+		partitionKey: partitionKey,
+		limitBytes:   limitBytes,
+		maxAge:       maxAge,
+		nowFunc:      nowFunc,
+	}
+}
+
+// NewWithOptions is like New, but also applies the optional checks of the options.
+func NewWithOptions(partitionKey string, limitBytes int64, maxAge time.Duration, nowFunc func() time.Time, options Options) RequestValidator {
 	return &validator{
 		partitionKey: partitionKey,
 		limitBytes:   limitBytes,
 		maxAge:       maxAge,
 		nowFunc:      nowFunc,
+		options:      options,
 	}
 }
 
-// Validate implements the Validator interface. It validates an upload.
+// Validate implements the RequestValidator interface. It validates the request of an upload.
 func (v *validator) Validate(ctx context.Context, req *http.Request) (string, metricfamily.Transformer, error) {
 	client, ok := authorize.FromContext(ctx)
 	if !ok {
-		return "", nil, fmt.Errorf("unable to find user info")
+		v.options.Metrics.ObserveRejection(ErrNoClient)
+		return "", nil, ErrNoClient
 	}
 	if len(client.Labels[v.partitionKey]) == 0 {
-		return "", nil, fmt.Errorf("user data must contain a '%s' label", v.partitionKey)
+		v.options.Metrics.ObserveRejection(ErrMissingPartitionKey(v.partitionKey))
+		return "", nil, ErrMissingPartitionKey(v.partitionKey)
+	}
+	if err := v.options.PartitionKeyFormat.Check(v.partitionKey, client.Labels[v.partitionKey]); err != nil {
+		v.options.Metrics.ObserveRejection(err)
+		return "", nil, err
 	}
 
-	var transforms metricfamily.MultiTransformer
+	options := v.optionsFor(client)
 
+	// an upload collected too long ago is rejected before reading its samples
+	if envelope, ok := EnvelopeFromContext(ctx); ok && v.maxAge > 0 && envelope.ScrapeTimestampMs > 0 {
+		if time.Unix(0, envelope.ScrapeTimestampMs*int64(time.Millisecond)).Before(v.nowFunc().Add(-v.maxAge)) {
+			options.Metrics.ObserveRejection(metricfamily.ErrTimestampTooOld)
+			return "", nil, metricfamily.ErrTimestampTooOld
+		}
+	}
+
+	transforms := &uploadTransformer{metrics: options.Metrics}
+
+	// families of other metrics are dropped before they are validated, unless the upload is
+	// rejected for them once all are known
+	if options.Allowlist != nil && !options.StrictAllowlist {
+		var report *Report
+		if !options.reportOnly(RuleAllowlist) {
+			report, _ = ReportFromContext(ctx)
+		}
+		transforms.With(options.enforceTransformer(ctx, client, RuleAllowlist, options.Metrics.countDropped(ReasonNotAllowlisted, options.Allowlist.uploadTransformer(report, options.maxNotAllowlisted()))))
+	}
+	transforms.With(options.enforceTransformer(ctx, client, RuleInconsistentType, options.Metrics.countDropped(ReasonInconsistentType, metricfamily.NewErrorOnInconsistentTypes(options.DropInconsistentTypes))))
+	// sample timestamps are bounded before they are overwritten below
+	now := v.nowFunc()
 	if v.maxAge > 0 {
-		transforms.With(metricfamily.NewErrorInvalidFederateSamples(time.Now().Add(-v.maxAge)))
+		if options.ClampOldSamples {
+			transforms.With(metricfamily.NewClampExpiredSamples(now.Add(-v.maxAge)))
+		}
+		transforms.With(options.Metrics.countDropped(ReasonInvalid, metricfamily.NewErrorInvalidFederateSamples(now.Add(-v.maxAge))))
+	}
+	if options.MaxFutureSkew > 0 {
+		if options.ClampFutureSamples {
+			transforms.With(metricfamily.NewClampFutureSamples(now.Add(options.MaxFutureSkew)))
+		} else {
+			transforms.With(metricfamily.NewErrorOnFutureSamples(now.Add(options.MaxFutureSkew)))
+		}
 	}
 
-	transforms.With(metricfamily.NewErrorOnUnsorted(true))
-	transforms.With(metricfamily.NewRequiredLabels(client.Labels))
+	if options.SortSamples {
+		transforms.With(metricfamily.NewSortSeriesSamples(options.StrictSampleOrder, options.SampleOrderTolerance))
+	} else {
+		transforms.With(metricfamily.NewErrorOnUnsorted(true))
+	}
+	if len(options.ElideLabels) > 0 {
+		transforms.With(metricfamily.NewElide(options.KeepTimestamps, options.ElideLabels...))
+	}
+	if options.LabelLimits.Enabled() {
+		transforms.With(options.enforceTransformer(ctx, client, RuleLabelLimits, metricfamily.NewLabelLimits(options.LabelLimits)))
+	}
+	if options.Duplicates {
+		transforms.With(options.enforceTransformer(ctx, client, RuleDuplicates, DetectDuplicates(options.StrictDuplicates, options.KeepTimestamps, options.Metrics)))
+	}
 	transforms.With(metricfamily.TransformerFunc(metricfamily.DropEmptyFamilies))
-	transforms.With(metricfamily.OverwriteTimestamps(v.nowFunc))
+	if !options.KeepTimestamps {
+		transforms.With(metricfamily.OverwriteTimestamps(v.nowFunc))
+	}
+	if options.Cardinality != nil {
+		upload := options.Cardinality.newUpload(client.Labels[v.partitionKey])
+		transforms.With(upload)
+		transforms.commits = append(transforms.commits, upload)
+	}
 
+	// the body is expected to be decoded already, so that the limit applies to the decoded size
 	if v.limitBytes > 0 {
-		req.Body = reader.NewLimitReadCloser(req.Body, v.limitBytes)
+		req.Body = &limitReadCloser{ReadCloser: reader.NewLimitReadCloser(req.Body, v.limitBytes), limit: v.limitBytes, metrics: options.Metrics}
 	}
 
 	return client.Labels[v.partitionKey], transforms, nil
 }
+
+// ValidateUpload implements the Validator interface. It checks the labels and series of the
+// decoded families of an upload.
+func (v *validator) ValidateUpload(ctx context.Context, client *authorize.Client, families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+	options := v.optionsFor(client)
+	families, err := Chain(
+		options.enforce(RuleAllowlist, options.rejectNotAllowlisted()),
+		options.enforce(RuleEmptyUploads, DetectEmptyUploads(options.RejectEmptyUploads, options.Metrics)),
+		options.enforce(RuleClientLabels, RequireClientLabels()),
+		options.enforce(RuleRequiredLabels, RequireLabels(options.Requirements)),
+		options.enforce(RuleSeriesLimit, LimitSeries(options.MaxSeries)),
+	).ValidateUpload(ctx, client, families)
+	if err != nil {
+		options.Metrics.ObserveRejection(err)
+		return nil, err
+	}
+	return families, nil
+}
+
+func (o Options) rejectNotAllowlisted() Validator {
+	if !o.StrictAllowlist {
+		return nil
+	}
+	return RejectNotAllowlisted(o.Allowlist, o.maxNotAllowlisted())
+}
+
+func (o Options) maxNotAllowlisted() int {
+	if o.MaxNotAllowlisted > 0 {
+		return o.MaxNotAllowlisted
+	}
+	return DefaultMaxNotAllowlisted
+}
+
+// optionsFor returns the options the upload of the client is validated with.
+func (v *validator) optionsFor(client *authorize.Client) Options {
+	if v.options.Overrides != nil {
+		return v.options.Overrides.Resolve(client)
+	}
+	return v.options
+}
+
+// limitReadCloser reports reading past the limit of the validator as *ErrTooLarge.
+type limitReadCloser struct {
+	io.ReadCloser
+	limit   int64
+	metrics *Metrics
+	failed  bool
+}
+
+func (r *limitReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == reader.ErrTooLong {
+		err = &ErrTooLarge{Limit: r.limit}
+		if !r.failed {
+			r.failed = true
+			r.metrics.ObserveRejection(err)
+		}
+	}
+	return n, err
+}
+
+// uploadTransformer is the transformer of an upload. It counts the rejection of the upload and
+// commits the state of its checks.
+type uploadTransformer struct {
+	metricfamily.MultiTransformer
+	metrics *Metrics
+	commits []Committer
+}
+
+// Transform counts the first error as the rejection of the upload, which is aborted by it.
+func (t *uploadTransformer) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	ok, err := t.MultiTransformer.Transform(family)
+	if err != nil && t.metrics != nil {
+		t.metrics.ObserveRejection(err)
+		t.metrics = nil
+	}
+	return ok, err
+}
+
+func (t *uploadTransformer) Commit() {
+	for _, c := range t.commits {
+		c.Commit()
+	}
+}
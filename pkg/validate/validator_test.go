@@ -0,0 +1,221 @@
+package validate
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/metricfamily"
+)
+
+func TestValidateLimitBytes(t *testing.T) {
+	now := time.Unix(1, 0)
+	tests := []struct {
+		name    string
+		limit   int64
+		body    string
+		wantErr error
+	}{
+		{name: "under the limit", limit: 8, body: "1234567"},
+		{name: "unlimited", body: "123456789"},
+		{name: "over the limit", limit: 8, body: "123456789", wantErr: &ErrTooLarge{Limit: 8}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := New("cluster", tt.limit, 0, func() time.Time { return now })
+			req := httptest.NewRequest("POST", "/upload", bytes.NewBufferString(tt.body))
+			ctx := authorize.WithClient(context.Background(), &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "cluster-1"}})
+			if _, _, err := v.Validate(ctx, req); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(req.Body)
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && string(data) != tt.body {
+				t.Fatalf("want body %q, got %q", tt.body, data)
+			}
+		})
+	}
+}
+
+func TestValidateMaxSeries(t *testing.T) {
+	now := time.Unix(1, 0)
+	tests := []struct {
+		name     string
+		limit    int
+		families []*clientmodel.MetricFamily
+		wantErr  error
+	}{
+		{
+			name:     "under the limit",
+			limit:    3,
+			families: []*clientmodel.MetricFamily{family("a", 1), family("b", 2)},
+		},
+		{
+			name:     "unlimited",
+			families: []*clientmodel.MetricFamily{family("a", 1), family("b", 2)},
+		},
+		{
+			name:     "over the limit across families",
+			limit:    2,
+			families: []*clientmodel.MetricFamily{family("a", 1), family("b", 2)},
+			wantErr:  &ErrTooManySeries{Limit: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewWithOptions("cluster", 0, 0, func() time.Time { return now }, Options{MaxSeries: tt.limit})
+			client := &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "cluster-1"}}
+			_, err := v.ValidateUpload(context.Background(), client, tt.families)
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateLabelLimits(t *testing.T) {
+	now := time.Unix(1000, 0)
+	four := 4
+	tests := []struct {
+		name       string
+		options    Options
+		config     *Config
+		override   *Override
+		wantErr    error
+		wantLabels []string
+	}{
+		{
+			name:    "too many labels",
+			options: Options{LabelLimits: metricfamily.LabelLimits{MaxLabels: 2}},
+			wantErr: &metricfamily.ErrLabelLimit{Type: metricfamily.LabelLimitCount, Name: "up", Limit: 2},
+		},
+		{
+			name:    "value too long",
+			options: Options{LabelLimits: metricfamily.LabelLimits{MaxValueLength: 4}},
+			wantErr: &metricfamily.ErrLabelLimit{Type: metricfamily.LabelLimitValueLength, Name: "up", Label: "a", Limit: 4},
+		},
+		{
+			name:       "value truncated",
+			options:    Options{LabelLimits: metricfamily.LabelLimits{MaxValueLength: 4, TruncateValues: true}},
+			wantLabels: []string{"cluster=test", "a=1234"},
+		},
+		{
+			name:       "reported only",
+			options:    Options{LabelLimits: metricfamily.LabelLimits{MaxValueLength: 4}, ReportOnly: []string{RuleLabelLimits}},
+			wantLabels: []string{"cluster=test", "a=12345"},
+		},
+		{
+			name:    "set by the config",
+			config:  &Config{LabelLimits: &LabelLimitsConfig{MaxValueLength: &four}},
+			wantErr: &metricfamily.ErrLabelLimit{Type: metricfamily.LabelLimitValueLength, Name: "up", Label: "a", Limit: 4},
+		},
+		{
+			name:       "disabled by the config",
+			options:    Options{LabelLimits: metricfamily.LabelLimits{MaxValueLength: 4}},
+			config:     &Config{LabelLimits: &LabelLimitsConfig{MaxValueLength: new(int)}},
+			wantLabels: []string{"cluster=test", "a=12345"},
+		},
+		{
+			name:     "set by an override",
+			override: &Override{LabelLimits: &LabelLimitsConfig{MaxLabels: new(int), MaxValueLength: &four}},
+			options:  Options{LabelLimits: metricfamily.LabelLimits{MaxLabels: 1}},
+			wantErr:  &metricfamily.ErrLabelLimit{Type: metricfamily.LabelLimitValueLength, Name: "up", Label: "a", Limit: 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := tt.options
+			if tt.config != nil {
+				var err error
+				if options, err = tt.config.options(options); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.override != nil {
+				var err error
+				if options, err = tt.override.options(options); err != nil {
+					t.Fatal(err)
+				}
+			}
+			v := NewWithOptions("cluster", 0, 0, func() time.Time { return now }, options)
+			client := &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}}
+			_, transforms, err := v.Validate(authorize.WithClient(context.Background(), client), httptest.NewRequest("POST", "/upload", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := family("up", 1)
+			f.Metric[0].TimestampMs = proto.Int64(999000)
+			f.Metric[0].Label = []*clientmodel.LabelPair{
+				{Name: proto.String("cluster"), Value: proto.String("test")},
+				{Name: proto.String("a"), Value: proto.String("12345")},
+			}
+			if _, err := transforms.Transform(f); !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			var labels []string
+			for _, l := range f.Metric[0].Label {
+				labels = append(labels, l.GetName()+"="+l.GetValue())
+			}
+			if !reflect.DeepEqual(labels, tt.wantLabels) {
+				t.Fatalf("want labels %v, got %v", tt.wantLabels, labels)
+			}
+		})
+	}
+}
+
+func TestValidateSampleAge(t *testing.T) {
+	now := time.Unix(1000, 0)
+	sample := func(ms int64) *clientmodel.MetricFamily {
+		f := family("up", 1)
+		f.Metric[0].TimestampMs = &ms
+		return f
+	}
+	tests := []struct {
+		name    string
+		clamp   bool
+		family  *clientmodel.MetricFamily
+		wantErr error
+	}{
+		{name: "fresh", family: sample(999000)},
+		{name: "old", family: sample(899000), wantErr: metricfamily.ErrTimestampTooOld},
+		{name: "future", family: sample(1061000), wantErr: &metricfamily.ErrFutureSample{Name: "up", TimestampMs: 1061000}},
+		{name: "fresh clamped", clamp: true, family: sample(999000)},
+		{name: "old clamped", clamp: true, family: sample(899000)},
+		{name: "future clamped", clamp: true, family: sample(1061000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewWithOptions("cluster", 0, 100*time.Second, func() time.Time { return now }, Options{
+				MaxFutureSkew:      time.Minute,
+				ClampFutureSamples: tt.clamp,
+				ClampOldSamples:    tt.clamp,
+			})
+			req := httptest.NewRequest("POST", "/upload", nil)
+			ctx := authorize.WithClient(context.Background(), &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "cluster-1"}})
+			_, transforms, err := v.Validate(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, err := transforms.Transform(tt.family)
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+			if ok != (tt.wantErr == nil) {
+				t.Fatalf("want family kept %t, got %t", tt.wantErr == nil, ok)
+			}
+		})
+	}
+}
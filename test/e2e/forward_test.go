@@ -83,9 +83,8 @@ func TestForward(t *testing.T) {
 		store = forward.New(receiveURL, store)
 
 		s := server.New(store, validator, nil, ttl)
-		telemeterServer = httptest.NewServer(
-			fakeAuthorizeHandler(http.HandlerFunc(s.Post), &authorize.Client{ID: "test", Labels: labels}),
-		)
+		authorizer := authorize.NewStaticAuthorizer(map[string]*authorize.Client{testToken: {ID: "test", Labels: labels}})
+		telemeterServer = httptest.NewServer(authorize.Middleware(authorize.TokenAuthorizer(authorizer))(http.HandlerFunc(s.Post)))
 		defer telemeterServer.Close()
 	}
 
@@ -103,7 +102,13 @@ func TestForward(t *testing.T) {
 	// which then forwards the converted metrics as time series to the mocked receive server.
 	// In the end we check for a 200 OK status code.
 
-	resp, err := http.Post(telemeterServer.URL, string(expfmt.FmtProtoDelim), buf)
+	req, err := http.NewRequest("POST", telemeterServer.URL+"/upload", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		t.Errorf("failed sending the upload request: %v", err)
 	}
@@ -137,12 +142,8 @@ func readMetrics(m string) []*clientmodel.MetricFamily {
 	return families
 }
 
-func fakeAuthorizeHandler(h http.Handler, client *authorize.Client) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		req = req.WithContext(authorize.WithClient(req.Context(), client))
-		h.ServeHTTP(w, req)
-	})
-}
+// testToken authorizes uploads to the telemeter server.
+const testToken = "test-token"
 
 // mockedReceiver unmarshalls the request body into prompb.WriteRequests
 // and asserts the seeing contents against the pre-defined expectedTimeSeries from the top.